@@ -1,43 +1,116 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
+	"persishtent/internal/api"
 	"persishtent/internal/cli"
 	"persishtent/internal/client"
 	"persishtent/internal/config"
+	"persishtent/internal/metrics"
+	"persishtent/internal/protocol"
 	"persishtent/internal/server"
 	"persishtent/internal/session"
+	"persishtent/internal/timing"
+	"persishtent/internal/web"
+
+	"golang.org/x/term"
 )
 
 func checkNesting() {
 	if os.Getenv("PERSISHTENT_SESSION") != "" {
-		fmt.Printf("[error: already inside a persishtent session (%s)]\n", os.Getenv("PERSISHTENT_SESSION"))
-		os.Exit(1)
+		fmt.Println(config.Message("already_inside", "Name", os.Getenv("PERSISHTENT_SESSION")))
+		exit(1)
 	}
 }
 
+// showTiming is set by --timing, which may be given anywhere on the command line
+var showTiming bool
+
+// exit reports the timing of the command and exits with code
+func exit(code int) {
+	finishTiming()
+	os.Exit(code)
+}
+
+// finishTiming prints the time spent per phase with --timing and appends it
+// to timing_file if configured. Daemons are long-lived and never reported.
+func finishTiming() {
+	if len(os.Args) > 1 && os.Args[1] == "daemon" {
+		return
+	}
+	if showTiming {
+		timing.Report(os.Stderr)
+	}
+	if config.Current().TimingFile != "" {
+		if err := timing.Append(config.Current().TimingFile, os.Args[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to write timing file: %v\n", err)
+		}
+	}
+}
+
+// fastAttach reports whether the command attaches to a named session with
+// PERSISHTENT_FAST=1. Such attaches skip the clean, which dials every session
+// socket, to reach the first byte sooner.
+func fastAttach(args []string) bool {
+	if os.Getenv("PERSISHTENT_FAST") != "1" || len(args) < 2 {
+		return false
+	}
+	switch args[1] {
+	case "attach", "a":
+		return true
+	}
+	return len(args) == 2 && !cli.IsCommand(args[1])
+}
+
 func main() {
+	args := os.Args[:1]
+	for _, arg := range os.Args[1:] {
+		if arg == "--timing" || arg == "-timing" {
+			showTiming = true
+			continue
+		}
+		args = append(args, arg)
+	}
+	os.Args = args
+	defer finishTiming()
+
 	// Load config
+	done := timing.Track("config load")
 	if err := config.Load(); err != nil {
-		fmt.Printf("Warning: failed to load config: %v\n", err)
+		fmt.Println(config.Message("config_load_failed", "Err", err))
 	}
+	done()
 
-	// Auto-prune stale sessions on every invocation
-	sessions, _, _ := session.Clean()
+	// Remove stale sockets on every invocation, archiving ended sessions
+	// and pruning the history is up to clean
+	var sessions []session.Info
+	if !fastAttach(os.Args) {
+		done = timing.Track("clean")
+		sessions, _, _ = session.CleanSockets()
+		done()
+	}
 
 	if len(os.Args) < 2 {
 		checkNesting()
 		if len(sessions) == 1 {
-			cli.AttachSession(sessions[0].Name, "", true, false, 0)
+			cli.AttachSession(sessions[0].Name, "", true, false, false, 0, "")
 		} else if len(sessions) == 0 {
-			cli.StartSession(cli.GenerateAutoName(), false, "", "", true, false, "")
+			cli.StartSession(cli.GenerateAutoName(server.Options{}), false, true, false, server.Options{})
 		} else {
 			name := cli.SelectSession(sessions)
 			if name != "" {
-				cli.AttachSession(name, "", true, false, 0)
+				cli.AttachSession(name, "", true, false, false, 0, "")
 			}
 		}
 		return
@@ -53,20 +126,174 @@ func main() {
 		log := startCmd.String("l", "", "Custom log path")
 		command := startCmd.String("c", "", "Custom command to run")
 		readOnly := startCmd.Bool("ro", false, "Start in read-only mode")
-		_ = startCmd.Parse(os.Args[2:])
+		ephemeral := startCmd.Bool("ephemeral", false, "Kill the session when the last client detaches")
+		exclusive := startCmd.Bool("exclusive", false, "Refuse other master attaches while one is attached")
+		linger := startCmd.Duration("linger", 0, "Grace period before an ephemeral session is killed")
+		banner := startCmd.String("banner", "", "Banner template shown at start and on attach")
+		cwd := startCmd.String("cwd", "", "Starting directory of the session")
+		tagList := startCmd.String("tag", "", "Comma-separated session tags")
+		record := startCmd.Bool("record", false, "Save an asciicast recording of the session")
+		shell := startCmd.String("shell", "", "Shell with arguments (e.g. \"/bin/zsh -l\")")
+		tty := startCmd.String("tty", "", "Serial device to proxy instead of a shell")
+		baud := startCmd.Int("baud", server.DefaultBaud, "Baud rate of the serial device")
+		profileName := startCmd.String("profile", "", "Start with the options of a config profile")
+		keepalive := startCmd.Duration("keepalive", 0, "Write keepalive_input into the session after this much idle time")
+		noLog := startCmd.Bool("no-log", false, "Keep output in memory only, without log files or recordings")
+		umask := startCmd.String("umask", "", "Octal umask of the session (e.g. 027)")
+		locale := startCmd.String("locale", "", "LANG of the session, replacing inherited LC_* variables")
+		tz := startCmd.String("tz", "", "Timezone of the session (e.g. UTC)")
+		var env []string
+		startCmd.Func("e", "Environment variable KEY=VALUE of the session (repeatable)", func(s string) error {
+			_, _, err := config.ParseEnvVar(s)
+			env = append(env, s)
+			return err
+		})
+		// Everything after -- is the command, run without a shell
+		startArgs, argv := os.Args[2:], []string(nil)
+		if i := slices.Index(startArgs, "--"); i >= 0 {
+			startArgs, argv = startArgs[:i], startArgs[i+1:]
+			if len(argv) == 0 {
+				fmt.Println("Usage: persishtent start [flags] [name] -- <command> [args...]")
+				return
+			}
+		}
+		_ = startCmd.Parse(startArgs)
 
 		checkNesting()
+		if *profileName != "" {
+			profile, ok := config.Current().Profiles[*profileName]
+			if !ok {
+				fmt.Println(config.Message("unknown_profile", "Profile", *profileName))
+				return
+			}
+			// Flags given on the command line take precedence
+			explicit := make(map[string]bool)
+			startCmd.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+			if !explicit["c"] && len(argv) == 0 {
+				*command = profile.Command
+			}
+			if !explicit["shell"] {
+				*shell = profile.Shell
+			}
+			if !explicit["cwd"] && profile.Cwd != "" {
+				*cwd = profile.Cwd
+				if rest, ok := strings.CutPrefix(*cwd, "~"); ok {
+					home, _ := os.UserHomeDir()
+					*cwd = home + rest
+				}
+			}
+			if !explicit["tag"] {
+				*tagList = strings.Join(profile.Tags, ",")
+			}
+			if !explicit["banner"] {
+				*banner = profile.Banner
+			}
+			if !explicit["record"] {
+				*record = profile.Record
+			}
+			if !explicit["ephemeral"] {
+				*ephemeral = profile.Ephemeral
+			}
+			if !explicit["umask"] {
+				*umask = profile.Umask
+			}
+			if !explicit["locale"] {
+				*locale = profile.Locale
+			}
+			if !explicit["tz"] {
+				*tz = profile.TZ
+			}
+		}
 		name := ""
 		if startCmd.NArg() > 0 {
 			name = startCmd.Arg(0)
 		} else {
-			name = cli.GenerateAutoName()
+			name = cli.GenerateAutoName(server.Options{Command: *command, Argv: argv, Cwd: *cwd, TTY: *tty, Profile: *profileName})
 		}
 		if err := session.ValidateName(name); err != nil {
-			fmt.Printf("Error: %v\n", err)
+			fmt.Println(config.Message("error", "Err", err))
+			return
+		}
+		tags, err := session.ParseTags(*tagList)
+		if err != nil {
+			fmt.Println(config.Message("error", "Err", err))
+			return
+		}
+		if *cwd != "" {
+			dir, err := filepath.Abs(*cwd)
+			if err == nil {
+				_, err = os.Stat(dir)
+			}
+			if err != nil {
+				fmt.Printf("Error: invalid directory: %v\n", err)
+				return
+			}
+			*cwd = dir
+		}
+		if *shell != "" {
+			if _, err := exec.LookPath(server.ShellArgs(*shell)[0]); err != nil {
+				fmt.Printf("Error: invalid shell: %v\n", err)
+				return
+			}
+		}
+		if *noLog && (*log != "" || *record) {
+			fmt.Println("Error: -no-log cannot be combined with -l or -record")
 			return
 		}
-		cli.StartSession(name, *detach, *sock, *command, true, *readOnly, *log)
+		if *umask != "" {
+			if _, err := config.ParseUmask(*umask); err != nil {
+				fmt.Println(config.Message("error", "Err", err))
+				return
+			}
+		}
+		if len(argv) > 0 {
+			if *command != "" {
+				fmt.Println("Error: -c cannot be combined with a command after --")
+				return
+			}
+			// Relative paths such as ./run.sh start in -cwd
+			prog := argv[0]
+			if *cwd != "" && strings.Contains(prog, "/") && !filepath.IsAbs(prog) {
+				prog = filepath.Join(*cwd, prog)
+			}
+			if _, err := exec.LookPath(prog); err != nil {
+				fmt.Printf("Error: invalid command: %v\n", err)
+				return
+			}
+		}
+		if *tty != "" {
+			if *command != "" || *shell != "" || len(argv) > 0 {
+				fmt.Println("Error: -tty cannot be combined with -c or -shell")
+				return
+			}
+			if err := server.CheckSerial(*tty, *baud); err != nil {
+				fmt.Printf("Error: invalid serial device: %v\n", err)
+				return
+			}
+		}
+		cli.StartSession(name, *detach, true, *readOnly, server.Options{
+			SockPath:  *sock,
+			LogPath:   *log,
+			Command:   *command,
+			Argv:      argv,
+			Ephemeral: *ephemeral,
+			Exclusive: *exclusive,
+			Linger:    *linger,
+			Banner:    *banner,
+			Cwd:       *cwd,
+			Tags:      tags,
+			Record:    *record,
+			Shell:     *shell,
+			TTY:       *tty,
+			Baud:      *baud,
+			Profile:   *profileName,
+			Keepalive: *keepalive,
+			NoLog:     *noLog,
+			Umask:     *umask,
+			Locale:    *locale,
+			TZ:        *tz,
+			Env:       env,
+		})
 
 	case "attach", "a":
 		attachCmd := flag.NewFlagSet("attach", flag.ExitOnError)
@@ -74,7 +301,15 @@ func main() {
 		noReplay := attachCmd.Bool("n", false, "Do not replay session output")
 		tail := attachCmd.Int("t", 0, "Only replay last N lines of output")
 		readOnly := attachCmd.Bool("ro", false, "Attach in read-only mode")
+		exclusive := attachCmd.Bool("x", false, "Refuse other master attaches until detached")
+		replayRate := attachCmd.Int("replay-rate", config.Current().ReplayRate, "Replay speed limit in bytes/sec (0 for unlimited)")
+		transcript := attachCmd.String("transcript", "", "Save live session output to a local file")
 		_ = attachCmd.Parse(os.Args[2:])
+		config.Update(func(c *config.Config) { c.ReplayRate = *replayRate })
+		if *exclusive && *readOnly {
+			fmt.Println("Error: -x cannot be combined with -ro")
+			return
+		}
 
 		checkNesting()
 		name := ""
@@ -83,13 +318,13 @@ func main() {
 		} else {
 			sessions, err := session.List()
 			if err != nil {
-				fmt.Printf("Error checking sessions: %v\n", err)
+				fmt.Println(config.Message("list_failed", "Err", err))
 				return
 			}
 			if len(sessions) == 1 {
 				name = sessions[0].Name
 			} else if len(sessions) == 0 {
-				fmt.Println("No active sessions.")
+				fmt.Println(config.Message("no_sessions"))
 				return
 			} else {
 				name = cli.SelectSession(sessions)
@@ -98,22 +333,27 @@ func main() {
 				}
 			}
 		}
-		cli.AttachSession(name, *sock, !*noReplay, *readOnly, *tail)
+		cli.AttachSession(name, *sock, !*noReplay, *readOnly, *exclusive, *tail, *transcript)
 
 	case "kill", "k":
 		killCmd := flag.NewFlagSet("kill", flag.ExitOnError)
 		all := killCmd.Bool("a", false, "Kill all sessions")
 		sock := killCmd.String("s", "", "Custom socket path")
+		sigName := killCmd.String("signal", "TERM", "Signal to send (TERM, INT, HUP, KILL)")
+		timeout := killCmd.Duration("timeout", client.DefaultKillTimeout, "Time to wait before escalating to KILL")
 		_ = killCmd.Parse(os.Args[2:])
 
+		sig, err := client.ParseSignal(*sigName)
+		if err != nil {
+			fmt.Println(config.Message("error", "Err", err))
+			return
+		}
+
+		interactive := term.IsTerminal(int(os.Stdin.Fd()))
 		if *all {
-			sessions, _ := session.List()
-			for _, s := range sessions {
-				if err := client.Kill(s.Name, ""); err != nil {
-					fmt.Printf("Error killing session '%s': %v\n", s.Name, err)
-				} else {
-					fmt.Printf("Session '%s' killed.\n", s.Name)
-				}
+			ok := cli.KillAll(sig, *timeout)
+			if !cli.CleanCustomLogs(nil, config.Current().CustomLogCleanup, interactive, os.Stdin, os.Stdout) || !ok {
+				exit(1)
 			}
 			return
 		}
@@ -122,30 +362,324 @@ func main() {
 		if killCmd.NArg() > 0 {
 			name = killCmd.Arg(0)
 		} else {
-			fmt.Println("Usage: persishtent kill [-a] [-s socket] <name>")
+			fmt.Println("Usage: persishtent kill [-a] [-s socket] [-signal name] [-timeout d] <name>")
 			return
 		}
 
-		if err := client.Kill(name, *sock); err != nil {
-			fmt.Printf("Error killing session '%s': %v\n", name, err)
+		if err := client.Kill(name, *sock, sig, *timeout); errors.Is(err, session.ErrSessionNotFound) {
+			fmt.Println(config.Message("session_not_found", "Name", name))
+		} else if err != nil {
+			fmt.Println(config.Message("kill_failed", "Name", name, "Err", err))
 		} else {
-			fmt.Printf("Session '%s' killed.\n", name)
+			fmt.Println(config.Message("session_killed", "Name", name))
+			cli.CleanCustomLogs([]string{name}, config.Current().CustomLogCleanup, interactive, os.Stdin, os.Stdout)
+		}
+
+	case "shutdown":
+		shutdownCmd := flag.NewFlagSet("shutdown", flag.ExitOnError)
+		all := shutdownCmd.Bool("a", false, "Shut down all sessions")
+		sock := shutdownCmd.String("s", "", "Custom socket path")
+		reason := shutdownCmd.String("reason", "", "Reason shown to attached clients")
+		timeout := shutdownCmd.Duration("timeout", client.DefaultKillTimeout, "Time to wait before escalating to KILL")
+		_ = shutdownCmd.Parse(os.Args[2:])
+		// Without a deadline the escalation would never come
+		if *timeout <= 0 {
+			fmt.Println(config.Message("shutdown_no_timeout"))
+			exit(1)
 		}
 
+		interactive := term.IsTerminal(int(os.Stdin.Fd()))
+		if *all {
+			ok := cli.ShutdownAll(*reason, *timeout)
+			if !cli.CleanCustomLogs(nil, config.Current().CustomLogCleanup, interactive, os.Stdin, os.Stdout) || !ok {
+				exit(1)
+			}
+			return
+		}
+		if shutdownCmd.NArg() != 1 {
+			fmt.Println("Usage: persishtent shutdown [-a] [-s socket] [-reason text] [-timeout d] <name>")
+			exit(1)
+		}
+		name := shutdownCmd.Arg(0)
+		if !cli.ShutdownSession(name, *sock, *reason, *timeout) {
+			exit(1)
+		}
+		cli.CleanCustomLogs([]string{name}, config.Current().CustomLogCleanup, interactive, os.Stdin, os.Stdout)
+
+	case "upgrade":
+		upgradeCmd := flag.NewFlagSet("upgrade", flag.ExitOnError)
+		all := upgradeCmd.Bool("a", false, "Upgrade all sessions")
+		sock := upgradeCmd.String("s", "", "Custom socket path")
+		exe := upgradeCmd.String("exe", "", "Daemon binary to hand over to, instead of this one")
+		_ = upgradeCmd.Parse(os.Args[2:])
+
+		if *all {
+			if !cli.UpgradeAll(*exe) {
+				exit(1)
+			}
+			return
+		}
+		if upgradeCmd.NArg() != 1 {
+			fmt.Println("Usage: persishtent upgrade [-a] [-s socket] [-exe path] <name>")
+			exit(1)
+		}
+		if !cli.UpgradeSession(upgradeCmd.Arg(0), *sock, *exe) {
+			exit(1)
+		}
+
+	case "wait", "w":
+		waitCmd := flag.NewFlagSet("wait", flag.ExitOnError)
+		sock := waitCmd.String("s", "", "Custom socket path")
+		_ = waitCmd.Parse(os.Args[2:])
+
+		if waitCmd.NArg() < 1 {
+			fmt.Println("Usage: persishtent wait [-s socket] <name>")
+			exit(1)
+		}
+		code, err := client.Wait(waitCmd.Arg(0), *sock)
+		if err != nil {
+			fmt.Println(config.Message("wait_failed", "Name", waitCmd.Arg(0), "Err", err))
+			exit(1)
+		}
+		exit(code)
+
 	case "rename", "r":
 		if len(os.Args) < 4 {
 			fmt.Println("Usage: persishtent rename <old> <new>")
 			return
 		}
 		if err := session.ValidateName(os.Args[3]); err != nil {
-			fmt.Printf("Error: %v\n", err)
+			fmt.Println(config.Message("error", "Err", err))
 			return
 		}
-		if err := session.Rename(os.Args[2], os.Args[3]); err != nil {
-			fmt.Printf("Error renaming session: %v\n", err)
+		// Live sessions are renamed by their daemon so the socket stays usable
+		renameFn := session.Rename
+		if info, err := session.ReadInfo(os.Args[2]); err == nil && info.IsAlive() {
+			renameFn = func(oldName, newName string) error {
+				return client.Rename(oldName, newName, "")
+			}
+		}
+		if err := renameFn(os.Args[2], os.Args[3]); err != nil {
+			fmt.Println(config.Message("rename_failed", "Err", err))
 		} else {
-			fmt.Printf("Session '%s' renamed to '%s'.\n", os.Args[2], os.Args[3])
+			fmt.Println(config.Message("session_renamed", "Name", os.Args[2], "NewName", os.Args[3]))
+		}
+
+	case "retag":
+		if len(os.Args) != 4 {
+			fmt.Println("Usage: persishtent retag <pattern> <tags>  (e.g. 'api-*' prod,api or +prod,-staging)")
+			exit(1)
+		}
+		change, err := session.ParseTagChange(os.Args[3])
+		if err != nil {
+			fmt.Println(config.Message("error", "Err", err))
+			exit(1)
+		}
+		if !cli.ChangeMeta(os.Args[2], change) {
+			exit(1)
+		}
+
+	case "regroup":
+		if len(os.Args) != 4 {
+			fmt.Println("Usage: persishtent regroup <pattern> <group>  (\"\" removes the group)")
+			exit(1)
+		}
+		group := os.Args[3]
+		if err := session.ValidateGroup(group); err != nil {
+			fmt.Println(config.Message("error", "Err", err))
+			exit(1)
+		}
+		if !cli.ChangeMeta(os.Args[2], session.MetaChange{Group: &group}) {
+			exit(1)
+		}
+
+	case "reload":
+		// Without names, all sessions pick up the new config
+		names := os.Args[2:]
+		if len(names) == 0 {
+			sessions, _ := session.List()
+			for _, s := range sessions {
+				names = append(names, s.Name)
+			}
+		}
+		for _, name := range names {
+			if err := client.Reload(name, ""); err != nil {
+				fmt.Println(config.Message("reload_failed", "Name", name, "Err", err))
+			} else {
+				fmt.Println(config.Message("session_reloaded", "Name", name))
+			}
+		}
+
+	case "suspend", "resume":
+		suspendCmd := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+		sock := suspendCmd.String("s", "", "Custom socket path")
+		_ = suspendCmd.Parse(os.Args[2:])
+
+		if suspendCmd.NArg() < 1 {
+			fmt.Printf("Usage: persishtent %s [-s socket] <name>\n", os.Args[1])
+			return
+		}
+		name := suspendCmd.Arg(0)
+		if os.Args[1] == "suspend" {
+			if err := client.Suspend(name, *sock); err != nil {
+				fmt.Println(config.Message("suspend_failed", "Name", name, "Err", err))
+			} else {
+				fmt.Println(config.Message("session_suspended", "Name", name))
+			}
+			return
+		}
+		if err := client.Resume(name, *sock); err != nil {
+			fmt.Println(config.Message("resume_failed", "Name", name, "Err", err))
+		} else {
+			fmt.Println(config.Message("session_resumed", "Name", name))
+		}
+
+	case "pipe":
+		pipeCmd := flag.NewFlagSet("pipe", flag.ExitOnError)
+		sock := pipeCmd.String("s", "", "Custom socket path")
+		stop := pipeCmd.Bool("stop", false, "Stop piping output")
+		_ = pipeCmd.Parse(os.Args[2:])
+
+		args := pipeCmd.Args()
+		if len(args) > 1 && args[1] == "--" {
+			args = append(args[:1], args[2:]...)
+		}
+		if len(args) < 1 || (*stop != (len(args) == 1)) {
+			fmt.Println("Usage: persishtent pipe [-s socket] <name> -- <command>  or  pipe -stop <name>")
+			exit(1)
+		}
+		name := args[0]
+		if *stop {
+			if err := client.Pipe(name, *sock, ""); err != nil {
+				fmt.Println(config.Message("error", "Err", err))
+				exit(1)
+			}
+			fmt.Println(config.Message("pipe_stopped", "Name", name))
+			return
 		}
+		command := cli.PipeCommand(args[1:])
+		if err := client.Pipe(name, *sock, command); err != nil {
+			fmt.Println(config.Message("error", "Err", err))
+			exit(1)
+		}
+		fmt.Println(config.Message("pipe_started", "Name", name, "Command", command))
+
+	case "capture":
+		captureCmd := flag.NewFlagSet("capture", flag.ExitOnError)
+		sock := captureCmd.String("s", "", "Custom socket path")
+		start := captureCmd.Int("S", 0, "Include this many scrollback lines above the screen, e.g. -100")
+		_ = captureCmd.Parse(os.Args[2:])
+
+		if captureCmd.NArg() < 1 {
+			fmt.Println("Usage: persishtent capture [-s socket] [-S -lines] <name>")
+			exit(1)
+		}
+		history := *start
+		if history < 0 {
+			history = -history
+		}
+		text, err := client.Capture(captureCmd.Arg(0), *sock, history)
+		if err != nil {
+			fmt.Println(config.Message("error", "Err", err))
+			exit(1)
+		}
+		fmt.Print(text)
+
+	case "broadcast":
+		broadcastCmd := flag.NewFlagSet("broadcast", flag.ExitOnError)
+		group := broadcastCmd.String("g", "", "Broadcast to all sessions of this group")
+		_ = broadcastCmd.Parse(os.Args[2:])
+
+		var names []string
+		for _, arg := range broadcastCmd.Args() {
+			for _, name := range strings.Split(arg, ",") {
+				if name != "" {
+					names = append(names, name)
+				}
+			}
+		}
+		if len(names) == 0 && *group == "" {
+			fmt.Println("Usage: persishtent broadcast <name1,name2,...> | -g <group>")
+			exit(1)
+		}
+		if !cli.Broadcast(names, *group) {
+			exit(1)
+		}
+
+	case "view":
+		viewCmd := flag.NewFlagSet("view", flag.ExitOnError)
+		group := viewCmd.String("g", "", "Show all sessions of this group")
+		readOnly := viewCmd.Bool("ro", false, "Send no input to any pane")
+		_ = viewCmd.Parse(os.Args[2:])
+
+		var names []string
+		for _, arg := range viewCmd.Args() {
+			for _, name := range strings.Split(arg, ",") {
+				if name != "" {
+					names = append(names, name)
+				}
+			}
+		}
+		if len(names) == 0 && *group == "" {
+			fmt.Println("Usage: persishtent view [-ro] <name>... | -g <group>")
+			exit(1)
+		}
+		if !cli.View(names, *group, *readOnly) {
+			exit(1)
+		}
+
+	case "ssh":
+		sshCmd := flag.NewFlagSet("ssh", flag.ExitOnError)
+		install := sshCmd.Bool("install", false, "Copy this binary to the host if persishtent isn't installed there")
+		readOnly := sshCmd.Bool("ro", false, "Attach in read-only mode")
+		noReplay := sshCmd.Bool("n", false, "Do not replay session history")
+		_ = sshCmd.Parse(os.Args[2:])
+
+		if sshCmd.NArg() < 1 || sshCmd.NArg() > 2 {
+			fmt.Println("Usage: persishtent ssh [-install] [-ro] [-n] <[user@]host> [name]")
+			exit(1)
+		}
+		if !cli.SSH(sshCmd.Arg(0), sshCmd.Arg(1), *install, *readOnly, !*noReplay) {
+			exit(1)
+		}
+
+	case "reattach-all":
+		reattachCmd := flag.NewFlagSet("reattach-all", flag.ExitOnError)
+		layout := reattachCmd.String("layout", "", "Layout file saved with -save instead of the recorded attachments")
+		save := reattachCmd.Bool("save", false, "Save the current attachments to the layout file")
+		execute := reattachCmd.Bool("exec", false, "Open the windows instead of printing the commands")
+		_ = reattachCmd.Parse(os.Args[2:])
+
+		if reattachCmd.NArg() > 0 || (*save && *layout == "") {
+			fmt.Println("Usage: persishtent reattach-all [-exec] [-layout file [-save]]")
+			exit(1)
+		}
+		if !cli.ReattachAll(*layout, *save, *execute) {
+			exit(1)
+		}
+
+	case "secret":
+		if len(os.Args) < 3 || os.Args[2] != "inject" {
+			fmt.Println("Usage: persishtent secret inject [-backend name] [-enter] [-force] [-s socket] <name> <ref>")
+			exit(1)
+		}
+		secretCmd := flag.NewFlagSet("secret inject", flag.ExitOnError)
+		backend := secretCmd.String("backend", "", "Secret backend from the secret_backends config")
+		enter := secretCmd.Bool("enter", false, "Press Enter after the secret")
+		force := secretCmd.Bool("force", false, "Inject even if the session isn't at a password prompt")
+		sock := secretCmd.String("s", "", "Custom socket path")
+		_ = secretCmd.Parse(os.Args[3:])
+
+		if secretCmd.NArg() < 2 {
+			fmt.Println("Usage: persishtent secret inject [-backend name] [-enter] [-force] [-s socket] <name> <ref>")
+			exit(1)
+		}
+		name := secretCmd.Arg(0)
+		if err := cli.InjectSecret(name, *sock, secretCmd.Arg(1), *backend, *enter, *force); err != nil {
+			fmt.Println(config.Message("secret_failed", "Name", name, "Err", err))
+			exit(1)
+		}
+		fmt.Println(config.Message("secret_injected", "Name", name))
 
 	case "daemon": // Internal
 	
@@ -153,28 +687,469 @@ daemonCmd := flag.NewFlagSet("daemon", flag.ExitOnError)
 		sock := daemonCmd.String("s", "", "Custom socket path")
 		log := daemonCmd.String("l", "", "Custom log path")
 		command := daemonCmd.String("c", "", "Custom command")
+		ephemeral := daemonCmd.Bool("e", false, "Ephemeral session")
+		exclusive := daemonCmd.Bool("exclusive", false, "Exclusive attaches")
+		linger := daemonCmd.Duration("linger", 0, "Ephemeral linger timeout")
+		banner := daemonCmd.String("banner", "", "Banner template")
+		cwd := daemonCmd.String("cwd", "", "Starting directory")
+		tagList := daemonCmd.String("tag", "", "Session tags")
+		record := daemonCmd.Bool("record", false, "Record the session")
+		shell := daemonCmd.String("shell", "", "Shell with arguments")
+		tty := daemonCmd.String("tty", "", "Serial device")
+		baud := daemonCmd.Int("baud", server.DefaultBaud, "Baud rate")
+		profile := daemonCmd.String("profile", "", "Config profile")
+		keepalive := daemonCmd.Duration("keepalive", 0, "Keepalive input interval")
+		noLog := daemonCmd.Bool("no-log", false, "Don't write a log file")
+		umask := daemonCmd.String("umask", "", "Umask of the shell")
+		locale := daemonCmd.String("locale", "", "LANG of the shell")
+		tz := daemonCmd.String("tz", "", "Timezone of the shell")
+		term := daemonCmd.String("term", "", "TERM of the terminal the session starts attached to")
+		colorTerm := daemonCmd.String("colorterm", "", "COLORTERM of that terminal")
+		upgrade := daemonCmd.Int("upgrade", -1, "Take over a session handed over on this descriptor")
+		canUpgrade := daemonCmd.Bool("can-upgrade", false, "Exit successfully if sessions can be taken over")
 		_ = daemonCmd.Parse(os.Args[2:])
 
+		if *canUpgrade {
+			return
+		}
+		if *upgrade >= 0 {
+			// Daemon runs until shell exits
+			if err := server.Resume(*upgrade); err != nil {
+				// Ends up in the daemon output, see spawnDaemon
+				fmt.Fprintln(os.Stderr, config.Message("error", "Err", err))
+				exit(1)
+			}
+			return
+		}
 		if daemonCmd.NArg() < 1 {
 			return
 		}
 		name := daemonCmd.Arg(0)
+		var argv []string
+		if daemonCmd.NArg() > 2 && daemonCmd.Arg(1) == "--" {
+			argv = daemonCmd.Args()[2:]
+		}
+		tags, _ := session.ParseTags(*tagList)
+		env, err := server.TakeStartEnv()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, config.Message("error", "Err", err))
+			exit(1)
+		}
 		// Daemon runs until shell exits
-		if err := server.Run(name, *sock, *log, *command); err != nil {
-			os.Exit(1)
+		if err := server.Run(name, server.Options{
+			SockPath:  *sock,
+			LogPath:   *log,
+			Command:   *command,
+			Argv:      argv,
+			Ephemeral: *ephemeral,
+			Exclusive: *exclusive,
+			Linger:    *linger,
+			Banner:    *banner,
+			Cwd:       *cwd,
+			Tags:      tags,
+			Record:    *record,
+			Shell:     *shell,
+			TTY:       *tty,
+			Baud:      *baud,
+			Profile:   *profile,
+			Keepalive: *keepalive,
+			NoLog:     *noLog,
+			Umask:     *umask,
+			Locale:    *locale,
+			TZ:        *tz,
+			Env:       env,
+			Term:      *term,
+			ColorTerm: *colorTerm,
+		}); err != nil {
+			fmt.Fprintln(os.Stderr, config.Message("error", "Err", err))
+			exit(1)
 		}
 
 	case "list", "ls":
-		cli.ListSessions()
+		listCmd := flag.NewFlagSet("list", flag.ExitOnError)
+		allHosts := listCmd.Bool("all-hosts", false, "Include sessions of other hosts sharing the state directory")
+		quiet := listCmd.Bool("q", false, "Only print session names")
+		listCmd.BoolVar(quiet, "quiet", false, "Only print session names")
+		verbose := listCmd.Bool("v", false, "Include live size, clients and traffic")
+		sortBy := listCmd.String("sort", "", "Order sessions by "+strings.Join(cli.ListSorts, ", ")+" instead of the state directory")
+		var filters []cli.ListFilter
+		listCmd.Func("filter", "Only list sessions matching key=value or key~regex (repeatable)", func(s string) error {
+			f, err := cli.ParseListFilter(s)
+			filters = append(filters, f)
+			return err
+		})
+		_ = listCmd.Parse(os.Args[2:])
+		if *sortBy != "" && !slices.Contains(cli.ListSorts, *sortBy) {
+			fmt.Println(config.Message("list_sort_invalid", "Sort", *sortBy, "Sorts", strings.Join(cli.ListSorts, ", ")))
+			exit(1)
+		}
+		cli.ListSessions(*allHosts, *quiet, *verbose, *sortBy, filters)
+	case "logs":
+		logsCmd := flag.NewFlagSet("logs", flag.ExitOnError)
+		verify := logsCmd.Bool("verify", false, "Check the log files against their integrity index")
+		sinceFlag := logsCmd.String("since", "", "Only show output since a duration ago or a time, e.g. 1h or \"2006-01-02 15:04\"")
+		fromMark := logsCmd.String("from-mark", "", "Only show output since the latest mark of this name, see mark")
+		_ = logsCmd.Parse(os.Args[2:])
+
+		if logsCmd.NArg() < 1 {
+			fmt.Println("Usage: persishtent logs [-verify] [-since time] [-from-mark name] <name>")
+			return
+		}
+		var since time.Time
+		if *sinceFlag != "" {
+			var err error
+			if since, err = cli.ParseSince(*sinceFlag); err != nil {
+				fmt.Println(config.Message("error", "Err", err))
+				exit(1)
+			}
+		}
+		if *verify {
+			if !cli.VerifyLogs(logsCmd.Arg(0)) {
+				exit(1)
+			}
+			return
+		}
+		if !cli.ShowLogs(logsCmd.Arg(0), since, *fromMark) {
+			exit(1)
+		}
+	case "mark":
+		markCmd := flag.NewFlagSet("mark", flag.ExitOnError)
+		sock := markCmd.String("s", "", "Custom socket path")
+		_ = markCmd.Parse(os.Args[2:])
+
+		if markCmd.NArg() != 2 {
+			fmt.Println("Usage: persishtent mark [-s socket] <name> <mark>")
+			exit(1)
+		}
+		if !cli.SetMark(markCmd.Arg(0), *sock, markCmd.Arg(1)) {
+			exit(1)
+		}
+	case "info", "i":
+		infoCmd := flag.NewFlagSet("info", flag.ExitOnError)
+		sock := infoCmd.String("s", "", "Custom socket path")
+		_ = infoCmd.Parse(os.Args[2:])
+
+		if infoCmd.NArg() < 1 {
+			fmt.Println("Usage: persishtent info [-s socket] <name>")
+			return
+		}
+		cli.ShowInfo(infoCmd.Arg(0), *sock)
+	case "clients":
+		clientsCmd := flag.NewFlagSet("clients", flag.ExitOnError)
+		sock := clientsCmd.String("s", "", "Custom socket path")
+		_ = clientsCmd.Parse(os.Args[2:])
+
+		if clientsCmd.NArg() < 1 {
+			fmt.Println("Usage: persishtent clients [-s socket] <name>")
+			exit(1)
+		}
+		if !cli.ShowClients(clientsCmd.Arg(0), *sock) {
+			exit(1)
+		}
+	case "kick":
+		kickCmd := flag.NewFlagSet("kick", flag.ExitOnError)
+		sock := kickCmd.String("s", "", "Custom socket path")
+		_ = kickCmd.Parse(os.Args[2:])
+
+		id, err := strconv.Atoi(kickCmd.Arg(1))
+		if kickCmd.NArg() != 2 || err != nil {
+			fmt.Println("Usage: persishtent kick [-s socket] <name> <client-id>")
+			exit(1)
+		}
+		if !cli.KickClient(kickCmd.Arg(0), *sock, id) {
+			exit(1)
+		}
+	case "detach":
+		detachCmd := flag.NewFlagSet("detach", flag.ExitOnError)
+		sock := detachCmd.String("s", "", "Custom socket path")
+		all := detachCmd.Bool("all", false, "Detach all clients")
+		_ = detachCmd.Parse(os.Args[2:])
+
+		if detachCmd.NArg() != 1 {
+			fmt.Println("Usage: persishtent detach [-s socket] [-all] <name>")
+			exit(1)
+		}
+		if !cli.DetachClients(detachCmd.Arg(0), *sock, *all) {
+			exit(1)
+		}
+	case "msg":
+		msgCmd := flag.NewFlagSet("msg", flag.ExitOnError)
+		sock := msgCmd.String("s", "", "Custom socket path")
+		_ = msgCmd.Parse(os.Args[2:])
+
+		text := strings.Join(msgCmd.Args()[min(1, msgCmd.NArg()):], " ")
+		if msgCmd.NArg() < 2 || strings.TrimSpace(text) == "" {
+			fmt.Println("Usage: persishtent msg [-s socket] <name> <text>")
+			exit(1)
+		}
+		if !cli.SendMessage(msgCmd.Arg(0), *sock, text) {
+			exit(1)
+		}
+	case "grant", "revoke":
+		grantCmd := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+		sock := grantCmd.String("s", "", "Custom socket path")
+		_ = grantCmd.Parse(os.Args[2:])
+
+		id, err := strconv.Atoi(grantCmd.Arg(1))
+		if grantCmd.NArg() != 2 || err != nil {
+			fmt.Printf("Usage: persishtent %s [-s socket] <name> <client-id>\n", os.Args[1])
+			exit(1)
+		}
+		if !cli.SetWriteAccess(grantCmd.Arg(0), *sock, id, os.Args[1] == "grant") {
+			exit(1)
+		}
+	case "prune-history":
+		pruneCmd := flag.NewFlagSet("prune-history", flag.ExitOnError)
+		sock := pruneCmd.String("s", "", "Custom socket path")
+		keep := pruneCmd.String("keep", "", "Keep this much of the newest output, e.g. 10MB")
+		before := pruneCmd.String("before", "", "Remove output older than a duration (24h) or a time")
+		_ = pruneCmd.Parse(os.Args[2:])
+
+		if pruneCmd.NArg() != 1 || (*keep == "" && *before == "") {
+			fmt.Println("Usage: persishtent prune-history [-s socket] [-keep size] [-before time] <name>")
+			exit(1)
+		}
+		var req protocol.Prune
+		var err error
+		if *keep != "" {
+			if req.Keep, err = cli.ParseSize(*keep); err != nil {
+				fmt.Println(config.Message("error", "Err", err))
+				exit(1)
+			}
+		}
+		if *before != "" {
+			if req.Before, err = cli.ParseSince(*before); err != nil {
+				fmt.Println(config.Message("error", "Err", err))
+				exit(1)
+			}
+		}
+		if !cli.PruneHistory(pruneCmd.Arg(0), *sock, req) {
+			exit(1)
+		}
+	case "tree":
+		treeCmd := flag.NewFlagSet("tree", flag.ExitOnError)
+		watch := treeCmd.Bool("watch", false, "Refresh the view until the session ends")
+		interval := treeCmd.Duration("interval", 2*time.Second, "Refresh interval with -watch")
+		_ = treeCmd.Parse(os.Args[2:])
+
+		if treeCmd.NArg() < 1 {
+			fmt.Println("Usage: persishtent tree [-watch] [-interval d] <name>")
+			exit(1)
+		}
+		cli.ShowTree(treeCmd.Arg(0), *watch, *interval)
 	case "clean":
-		_, count, err := session.Clean()
-		if err != nil {
-			fmt.Printf("Error cleaning sessions: %v\n", err)
+		cleanCmd := flag.NewFlagSet("clean", flag.ExitOnError)
+		logs := cleanCmd.Bool("logs", false, "Offer to remove logs of ended sessions outside the state directory")
+		verbose := cleanCmd.Bool("v", false, "List the removed files")
+		dryRun := cleanCmd.Bool("n", false, "Only list the files that would be removed")
+		olderThan := cleanCmd.String("logs-older-than", "", "Also remove history entries and rotated logs older than a duration (e.g. 30d) or a time")
+		archived := cleanCmd.Bool("archived", false, "Also remove the whole history of ended sessions")
+		_ = cleanCmd.Parse(os.Args[2:])
+
+		opts := session.CleanOptions{DryRun: *dryRun, Archived: *archived}
+		if *olderThan != "" {
+			var err error
+			if opts.LogsOlderThan, err = cli.ParseSince(*olderThan); err != nil {
+				fmt.Println(config.Message("error", "Err", err))
+				exit(1)
+			}
+		}
+		if !cli.Clean(*verbose, opts) || *dryRun {
+			return
+		}
+		policy := config.Current().CustomLogCleanup
+		if *logs {
+			policy = config.CustomLogAsk
+		}
+		if !cli.CleanCustomLogs(nil, policy, term.IsTerminal(int(os.Stdin.Fd())), os.Stdin, os.Stdout) {
+			exit(1)
+		}
+	case "gc":
+		gcCmd := flag.NewFlagSet("gc", flag.ExitOnError)
+		kill := gcCmd.Bool("kill", false, "Kill all orphaned daemons")
+		register := gcCmd.Bool("register", false, "Register all orphaned daemons again")
+		_ = gcCmd.Parse(os.Args[2:])
+
+		action := ""
+		switch {
+		case *kill && *register:
+			fmt.Println("Error: -kill and -register are mutually exclusive")
+			exit(1)
+		case *kill:
+			action = "kill"
+		case *register:
+			action = "register"
+		}
+		if !cli.GC(action, term.IsTerminal(int(os.Stdin.Fd())), os.Stdin, os.Stdout) {
+			exit(1)
+		}
+	case "audit":
+		auditCmd := flag.NewFlagSet("audit", flag.ExitOnError)
+		last := auditCmd.Int("n", 0, "Only show the last events")
+		_ = auditCmd.Parse(os.Args[2:])
+
+		cli.ShowAudit(auditCmd.Arg(0), *last)
+	case "debug":
+		debugCmd := flag.NewFlagSet("debug", flag.ExitOnError)
+		last := debugCmd.Int("n", 50, "Only show the last events, 0 for all")
+		level := debugCmd.String("level", config.DebugLogDebug, "Only show events up to this level (error, info or debug)")
+		_ = debugCmd.Parse(os.Args[2:])
+
+		if debugCmd.NArg() < 1 {
+			fmt.Println("Usage: persishtent debug [-n count] [-level level] <name>")
+			exit(1)
+		}
+		if !cli.ShowDebugLog(debugCmd.Arg(0), *last, *level) {
+			exit(1)
+		}
+	case "crashes":
+		crashesCmd := flag.NewFlagSet("crashes", flag.ExitOnError)
+		clearAll := crashesCmd.Bool("clear", false, "Remove all crash reports")
+		_ = crashesCmd.Parse(os.Args[2:])
+
+		if *clearAll {
+			cli.ClearCrashes()
+		} else if crashesCmd.NArg() > 0 {
+			cli.ShowCrash(crashesCmd.Arg(0))
 		} else {
-			fmt.Printf("Cleaned up %d stale files.\n", count)
+			cli.ListCrashes()
+		}
+	case "history":
+		if !cli.HistoryCommand(os.Args[2:]) {
+			exit(1)
 		}
+	case "load-buffer":
+		loadCmd := flag.NewFlagSet("load-buffer", flag.ExitOnError)
+		buffer := loadCmd.String("b", session.DefaultBuffer, "Buffer name")
+		_ = loadCmd.Parse(os.Args[2:])
+
+		if !cli.LoadBuffer(*buffer, loadCmd.Arg(0), os.Stdin) {
+			exit(1)
+		}
+	case "paste":
+		pasteCmd := flag.NewFlagSet("paste", flag.ExitOnError)
+		buffer := pasteCmd.String("b", "", "Buffer name, the most recently written if empty")
+		sock := pasteCmd.String("s", "", "Custom socket path")
+		_ = pasteCmd.Parse(os.Args[2:])
+
+		name := pasteCmd.Arg(0)
+		if name == "" {
+			name = os.Getenv("PERSISHTENT_SESSION")
+		}
+		if name == "" {
+			fmt.Println("Usage: persishtent paste [-b buffer] [-s socket] <name>")
+			exit(1)
+		}
+		if !cli.PasteBuffer(name, *sock, *buffer) {
+			exit(1)
+		}
+	case "buffers":
+		buffersCmd := flag.NewFlagSet("buffers", flag.ExitOnError)
+		remove := buffersCmd.String("d", "", "Remove this buffer")
+		_ = buffersCmd.Parse(os.Args[2:])
+
+		if !cli.ListBuffers(*remove) {
+			exit(1)
+		}
+	case "metrics":
+		metricsCmd := flag.NewFlagSet("metrics", flag.ExitOnError)
+		listen := metricsCmd.String("listen", config.Current().MetricsListen, "Listen address (host:port or unix:/path)")
+		_ = metricsCmd.Parse(os.Args[2:])
+
+		if *listen == "" {
+			fmt.Println("Usage: persishtent metrics -listen <host:port|unix:/path> (or set metrics_listen in the config)")
+			exit(1)
+		}
+		l, err := metrics.Listen(*listen)
+		if err != nil {
+			fmt.Println(config.Message("error", "Err", err))
+			exit(1)
+		}
+		fmt.Println(config.Message("metrics_serving", "Address", *listen))
+		if err := metrics.Serve(l); err != nil {
+			fmt.Println(config.Message("error", "Err", err))
+			exit(1)
+		}
+	case "api":
+		apiCmd := flag.NewFlagSet("api", flag.ExitOnError)
+		listen := apiCmd.String("listen", "", "Socket path (default api.socket in the runtime directory)")
+		_ = apiCmd.Parse(os.Args[2:])
+
+		path := *listen
+		if path == "" {
+			var err error
+			if path, err = api.ListenPath(); err != nil {
+				fmt.Println(config.Message("error", "Err", err))
+				exit(1)
+			}
+		}
+		l, err := api.Listen(path)
+		if err != nil {
+			fmt.Println(config.Message("error", "Err", err))
+			exit(1)
+		}
+		fmt.Println(config.Message("api_serving", "Path", path))
+		if err := api.Serve(l, cli.StartDetached); err != nil {
+			fmt.Println(config.Message("error", "Err", err))
+			exit(1)
+		}
+	case "web":
+		webCmd := flag.NewFlagSet("web", flag.ExitOnError)
+		listen := webCmd.String("listen", "localhost:8080", "Listen address (host:port, :port for all interfaces)")
+		cert := webCmd.String("cert", "", "TLS certificate file, serves HTTPS with -key")
+		key := webCmd.String("key", "", "TLS key file")
+		readOnly := webCmd.Bool("ro", false, "Attach all browsers read-only")
+		resetToken := webCmd.Bool("reset-token", false, "Generate a new token, logging out all browsers")
+		_ = webCmd.Parse(os.Args[2:])
+
+		if (*cert == "") != (*key == "") {
+			fmt.Println("Usage: persishtent web [-listen addr] [-cert file -key file] [-ro] [-reset-token]")
+			exit(1)
+		}
+		if err := web.CheckAssets(); err != nil {
+			fmt.Println(config.Message("error", "Err", err))
+			exit(1)
+		}
+		token, err := web.Token(*resetToken)
+		if err != nil {
+			fmt.Println(config.Message("error", "Err", err))
+			exit(1)
+		}
+		opts := web.Options{Token: token, ReadOnly: *readOnly, CertFile: *cert, KeyFile: *key}
+		l, err := net.Listen("tcp", *listen)
+		if err != nil {
+			fmt.Println(config.Message("error", "Err", err))
+			exit(1)
+		}
+		if *cert == "" && !web.IsLoopback(*listen) {
+			fmt.Println(config.Message("web_insecure", "Address", *listen))
+		}
+		fmt.Println(config.Message("web_serving", "URL", web.URL(l.Addr().String(), opts)))
+		if err := web.Serve(l, opts); err != nil {
+			fmt.Println(config.Message("error", "Err", err))
+			exit(1)
+		}
+	case "config":
+		if !cli.ConfigCommand(os.Args[2:]) {
+			exit(1)
+		}
+	case "launchd":
+		if !cli.LaunchdCommand(os.Args[2:]) {
+			exit(1)
+		}
+	case "selftest":
+		fmt.Println(config.Message("selftest_running"))
+		if !cli.SelfTest() {
+			fmt.Println(config.Message("selftest_failed"))
+			exit(1)
+		}
+		fmt.Println(config.Message("selftest_passed"))
 	case "completion":
-		cli.PrintCompletionScript()
+		shell := ""
+		if len(os.Args) > 2 {
+			shell = os.Args[2]
+		}
+		cli.PrintCompletionScript(shell)
 	case "init":
 		if len(os.Args) < 3 {
 			fmt.Println("Usage: persishtent init <bash|zsh>")
@@ -187,11 +1162,11 @@ daemonCmd := flag.NewFlagSet("daemon", flag.ExitOnError)
 		// Treat as attach/start shortcut
 		checkNesting()
 		// Check if session exists
-		sock, _ := session.GetSocketPath(cmd)
-		if _, err := os.Stat(sock); err == nil {
-			cli.AttachSession(cmd, "", true, false, 0)
+		sock, _ := session.ResolveSocketPath(cmd)
+		if _, _, qualified := session.SplitHost(cmd); qualified || session.SocketExists(sock) {
+			cli.AttachSession(cmd, "", true, false, false, 0, "")
 		} else {
-			cli.StartSession(cmd, false, "", "", true, false, "")
+			cli.StartSession(cmd, false, true, false, server.Options{})
 		}
 	}
 }
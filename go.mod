@@ -3,7 +3,7 @@ module persishtent
 go 1.25.6
 
 require (
-	github.com/creack/pty v1.1.24 // indirect
-	golang.org/x/sys v0.40.0 // indirect
-	golang.org/x/term v0.39.0 // indirect
+	github.com/creack/pty v1.1.24
+	golang.org/x/sys v0.40.0
+	golang.org/x/term v0.39.0
 )
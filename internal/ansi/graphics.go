@@ -0,0 +1,166 @@
+// Package ansi recognizes terminal escape sequences in session output.
+package ansi
+
+import (
+	"bytes"
+	"io"
+)
+
+const (
+	esc = 0x1b
+	bel = 0x07
+)
+
+// maxSixelParams bounds how many parameter bytes are inspected to tell a
+// sixel DCS apart from other device control strings.
+const maxSixelParams = 32
+
+// iTerm2 inline images are sent as OSC 1337;File=...
+var itermImage = []byte("]1337;File=")
+
+// GraphicsFilter copies output to w while dropping inline graphics: sixel
+// (DCS ... q ... ST), kitty graphics (APC G ... ST) and iTerm2 images
+// (OSC 1337;File= ... BEL/ST). All other bytes pass through unmodified.
+// Sequences may span Write calls.
+type GraphicsFilter struct {
+	w       io.Writer
+	pending []byte // Possible start of a graphics sequence
+	drop    bool   // Inside a graphics sequence
+	esc     bool   // Last dropped byte was ESC
+	osc     bool   // The dropped sequence may also end with BEL
+}
+
+func NewGraphicsFilter(w io.Writer) *GraphicsFilter {
+	return &GraphicsFilter{w: w}
+}
+
+func (f *GraphicsFilter) Write(p []byte) (int, error) {
+	data := p
+	if len(f.pending) > 0 {
+		data = append(f.pending, p...)
+		f.pending = nil
+	}
+
+	var out bytes.Buffer
+	i := 0
+	for i < len(data) {
+		if f.drop {
+			end := f.skip(data[i:])
+			if end < 0 {
+				break
+			}
+			i += end
+			continue
+		}
+
+		k := bytes.IndexByte(data[i:], esc)
+		if k < 0 {
+			out.Write(data[i:])
+			break
+		}
+		out.Write(data[i : i+k])
+		i += k
+
+		graphics, hdr, osc := classify(data[i:])
+		switch {
+		case hdr == 0:
+			// Not enough bytes to decide yet
+			f.pending = append([]byte(nil), data[i:]...)
+			i = len(data)
+		case graphics:
+			f.drop, f.esc, f.osc = true, false, osc
+			i += hdr
+		default:
+			out.WriteByte(esc)
+			i++
+		}
+	}
+
+	if out.Len() > 0 {
+		if _, err := f.w.Write(out.Bytes()); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush writes out a buffered partial sequence start, e.g. before closing.
+func (f *GraphicsFilter) Flush() error {
+	if len(f.pending) == 0 {
+		return nil
+	}
+	_, err := f.w.Write(f.pending)
+	f.pending = nil
+	return err
+}
+
+// skip consumes bytes of a dropped sequence and returns the index just past
+// its terminator, or -1 if the sequence continues beyond data.
+func (f *GraphicsFilter) skip(data []byte) int {
+	for j, b := range data {
+		if (f.esc && b == '\\') || (f.osc && b == bel) {
+			f.drop, f.esc = false, false
+			return j + 1
+		}
+		f.esc = b == esc
+	}
+	return -1
+}
+
+// classify inspects an escape sequence at the start of b. hdr is the length
+// of the sequence introducer, or 0 if more bytes are needed to decide.
+func classify(b []byte) (graphics bool, hdr int, osc bool) {
+	if len(b) < 2 {
+		return false, 0, false
+	}
+	switch b[1] {
+	case 'P':
+		// Sixel: DCS P1;P2;P3 q
+		for j := 2; j < len(b); j++ {
+			c := b[j]
+			if c == 'q' {
+				return true, j + 1, false
+			}
+			if ((c < '0' || c > '9') && c != ';') || j >= maxSixelParams {
+				return false, 1, false
+			}
+		}
+		return false, 0, false
+	case '_':
+		// Kitty graphics: APC G
+		if len(b) < 3 {
+			return false, 0, false
+		}
+		return b[2] == 'G', 3, false
+	case ']':
+		n := min(len(b)-1, len(itermImage))
+		if !bytes.Equal(b[1:1+n], itermImage[:n]) {
+			return false, 1, false
+		}
+		if n < len(itermImage) {
+			return false, 0, false
+		}
+		return true, 1 + len(itermImage), true
+	}
+	return false, 1, false
+}
+
+// StripGraphics returns data without inline graphics sequences.
+func StripGraphics(data []byte) []byte {
+	var out bytes.Buffer
+	f := NewGraphicsFilter(&out)
+	_, _ = f.Write(data)
+	_ = f.Flush()
+	return out.Bytes()
+}
+
+// TrimPartialString drops a leading fragment of a string sequence (DCS, APC,
+// OSC, ...) whose start was cut off, as happens when output is tailed from
+// the middle. Such a fragment ends at the first ESC if it is an ST.
+func TrimPartialString(data []byte) []byte {
+	k := bytes.IndexByte(data, esc)
+	if k >= 0 && k+1 < len(data) && data[k+1] == '\\' {
+		return data[k+2:]
+	}
+	return data
+}
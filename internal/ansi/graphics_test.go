@@ -0,0 +1,60 @@
+package ansi
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestStripGraphics(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "hello\r\nworld", "hello\r\nworld"},
+		{"sixel", "a\x1bP0;1;0q#0;2;0;0;0~~-~~\x1b\\b", "ab"},
+		{"sixel without params", "a\x1bPq#0~~\x1b\\b", "ab"},
+		{"kitty", "a\x1b_Gf=100,a=T;iVBORw0KGgo=\x1b\\b", "ab"},
+		{"iterm", "a\x1b]1337;File=inline=1:AAAA\x07b", "ab"},
+		{"other dcs", "a\x1bP+q544e\x1b\\b", "a\x1bP+q544e\x1b\\b"},
+		{"other apc", "a\x1b_Xdata\x1b\\b", "a\x1b_Xdata\x1b\\b"},
+		{"title", "a\x1b]0;title\x07b", "a\x1b]0;title\x07b"},
+		{"csi", "\x1b[31mred\x1b[0m", "\x1b[31mred\x1b[0m"},
+	}
+	for _, tt := range tests {
+		if got := string(StripGraphics([]byte(tt.in))); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGraphicsFilterChunked(t *testing.T) {
+	in := "before\x1b[1mX\x1bP0;1q" + strings.Repeat("#0~~-", 1000) + "\x1b\\after\x1b_Ga=T;" + strings.Repeat("QUFB", 500) + "\x1b\\end\x1b"
+	want := "before\x1b[1mXafterend\x1b"
+
+	// Every split point must give the same result
+	for _, size := range []int{1, 2, 3, 7, 64, 4096} {
+		var out bytes.Buffer
+		f := NewGraphicsFilter(&out)
+		for i := 0; i < len(in); i += size {
+			end := min(i+size, len(in))
+			if n, err := f.Write([]byte(in[i:end])); err != nil || n != end-i {
+				t.Fatalf("Write returned %d, %v", n, err)
+			}
+		}
+		_ = f.Flush()
+		if out.String() != want {
+			t.Errorf("chunk size %d: got %q, want %q", size, out.String(), want)
+		}
+	}
+}
+
+func TestTrimPartialString(t *testing.T) {
+	if got := string(TrimPartialString([]byte("~~-~~\x1b\\prompt$ "))); got != "prompt$ " {
+		t.Errorf("Expected fragment to be trimmed, got %q", got)
+	}
+	if got := string(TrimPartialString([]byte("text\x1b[0m"))); got != "text\x1b[0m" {
+		t.Errorf("Expected data to be kept, got %q", got)
+	}
+}
@@ -0,0 +1,599 @@
+package ansi
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Parser states of Screen
+const (
+	stGround = iota
+	stEscape
+	stCharset // ESC followed by an intermediate byte, e.g. ESC ( B
+	stCSI
+	stString // OSC, DCS, APC, PM or SOS up to BEL or ST
+	stStringEsc
+)
+
+const tabWidth = 8
+
+// Screen keeps the text a terminal would display for the output written to
+// it, plus the lines scrolled off its top. It understands cursor movement,
+// erasing, insert/delete, scroll regions, the alternate screen and SGR
+// attributes, which are kept for RenderRow but not in the history. All
+// characters are one column wide. Screen is not safe for concurrent use.
+type Screen struct {
+	rows, cols int
+	grid       [][]cell
+	saved      [][]cell // Main screen while the alternate screen is active
+	alt        bool
+	history    []string // Lines scrolled off the main screen, oldest first
+	maxHistory int
+
+	x, y         int
+	wrapNext     bool // The last column was written, the next rune wraps
+	noWrap       bool // Autowrap disabled with CSI ? 7 l
+	paste        bool // Bracketed paste enabled with CSI ? 2004 h
+	top, bottom  int  // Scroll region
+	saveX, saveY int
+	pen          string // SGR parameters of printed characters, each prefixed with ;
+
+	state  int
+	params []byte // CSI parameter and intermediate bytes
+	utf    []byte // Incomplete UTF-8 sequence
+}
+
+// cell is a character on the screen with the SGR parameters it was printed
+// with.
+type cell struct {
+	r   rune
+	pen string
+}
+
+var blankCell = cell{r: ' '}
+
+// NewScreen returns an empty screen of the given size that keeps up to
+// maxHistory lines scrolled off its top.
+func NewScreen(rows, cols, maxHistory int) *Screen {
+	s := &Screen{maxHistory: maxHistory}
+	s.rows, s.cols = max(rows, 1), max(cols, 1)
+	s.grid = s.blank(s.rows)
+	s.bottom = s.rows - 1
+	return s
+}
+
+// Size returns the number of rows and columns.
+func (s *Screen) Size() (rows, cols int) {
+	return s.rows, s.cols
+}
+
+// Lines returns the last n history lines followed by the visible screen,
+// without trailing spaces and trailing empty lines.
+func (s *Screen) Lines(n int) []string {
+	n = min(max(n, 0), len(s.history), s.maxHistory)
+	lines := append([]string(nil), s.history[len(s.history)-n:]...)
+	for _, row := range s.grid {
+		lines = append(lines, rowText(row))
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// Resize changes the screen size. Rows above the cursor that no longer fit
+// move to the history, columns that no longer fit are cut off.
+func (s *Screen) Resize(rows, cols int) {
+	rows, cols = max(rows, 1), max(cols, 1)
+	if rows == s.rows && cols == s.cols {
+		return
+	}
+	if s.alt && s.saved != nil {
+		s.saved = resizeGrid(s.saved, rows, cols, len(s.saved)-rows)
+	}
+	if drop := s.y - rows + 1; drop > 0 {
+		if !s.alt {
+			for _, row := range s.grid[:drop] {
+				s.pushHistory(row)
+			}
+		}
+		s.y -= drop
+		s.grid = resizeGrid(s.grid, rows, cols, drop)
+	} else {
+		s.grid = resizeGrid(s.grid, rows, cols, 0)
+	}
+	s.rows, s.cols = rows, cols
+	s.top, s.bottom = 0, rows-1
+	s.x, s.y = min(s.x, cols-1), min(s.y, rows-1)
+	s.saveX, s.saveY = min(s.saveX, cols-1), min(s.saveY, rows-1)
+	s.wrapNext = false
+}
+
+// BracketedPaste reports whether the application asked for pastes to be
+// marked with CSI 200 ~ and CSI 201 ~.
+func (s *Screen) BracketedPaste() bool {
+	return s.paste
+}
+
+// Cursor returns the cursor position, counted from 0.
+func (s *Screen) Cursor() (row, col int) {
+	return s.y, s.x
+}
+
+// RenderRow returns row y of the screen as terminal output with its
+// attributes, cut or padded to cols columns. It starts and ends with the
+// attributes reset.
+func (s *Screen) RenderRow(y, cols int) string {
+	var b strings.Builder
+	b.WriteString("\x1b[0m")
+	pen := ""
+	for x := 0; x < cols; x++ {
+		c := blankCell
+		if y >= 0 && y < s.rows && x < s.cols {
+			c = s.grid[y][x]
+		}
+		if c.pen != pen {
+			b.WriteString("\x1b[0" + c.pen + "m")
+			pen = c.pen
+		}
+		b.WriteRune(c.r)
+	}
+	if pen != "" {
+		b.WriteString("\x1b[0m")
+	}
+	return b.String()
+}
+
+// Render returns terminal output that redraws the whole screen, switching
+// to the alternate screen first if the application uses it, and leaves the
+// cursor and attributes where the application had them.
+func (s *Screen) Render() string {
+	var b strings.Builder
+	if s.alt {
+		b.WriteString("\x1b[?1049h")
+	}
+	b.WriteString("\x1b[H")
+	for y := 0; y < s.rows; y++ {
+		if y > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString(s.RenderRow(y, s.cols))
+	}
+	fmt.Fprintf(&b, "\x1b[%d;%dH\x1b[0%sm", s.y+1, s.x+1, s.pen)
+	return b.String()
+}
+
+func rowText(row []cell) string {
+	text := make([]rune, len(row))
+	for i, c := range row {
+		text[i] = c.r
+	}
+	return strings.TrimRight(string(text), " ")
+}
+
+// resizeGrid drops the first skip rows of grid and fits the rest to
+// rows x cols.
+func resizeGrid(grid [][]cell, rows, cols, skip int) [][]cell {
+	if skip > 0 {
+		grid = grid[min(skip, len(grid)):]
+	}
+	out := make([][]cell, rows)
+	for i := range out {
+		row := make([]cell, cols)
+		n := 0
+		if i < len(grid) {
+			n = copy(row, grid[i])
+		}
+		fill(row[n:])
+		out[i] = row
+	}
+	return out
+}
+
+func (s *Screen) blank(n int) [][]cell {
+	grid := make([][]cell, n)
+	for i := range grid {
+		grid[i] = s.blankRow()
+	}
+	return grid
+}
+
+func (s *Screen) blankRow() []cell {
+	row := make([]cell, s.cols)
+	fill(row)
+	return row
+}
+
+func (s *Screen) pushHistory(row []cell) {
+	if s.maxHistory <= 0 {
+		return
+	}
+	s.history = append(s.history, rowText(row))
+	if over := len(s.history) - s.maxHistory; over > s.maxHistory/4 {
+		// Trim in batches so the slice isn't copied for every line
+		s.history = append([]string(nil), s.history[over:]...)
+	}
+}
+
+// Write updates the screen with terminal output. Sequences may span Write
+// calls.
+func (s *Screen) Write(p []byte) (int, error) {
+	for _, b := range p {
+		s.feed(b)
+	}
+	return len(p), nil
+}
+
+func (s *Screen) feed(b byte) {
+	switch s.state {
+	case stEscape:
+		s.escape(b)
+		return
+	case stCharset:
+		s.state = stGround
+		return
+	case stCSI:
+		if b >= 0x40 && b <= 0x7e {
+			s.csi(b)
+			s.state = stGround
+		} else if b == esc {
+			s.state = stEscape
+		} else if len(s.params) < 64 {
+			s.params = append(s.params, b)
+		}
+		return
+	case stString:
+		if b == bel {
+			s.state = stGround
+		} else if b == esc {
+			s.state = stStringEsc
+		}
+		return
+	case stStringEsc:
+		if b == '\\' {
+			s.state = stGround
+		} else if b != esc {
+			s.state = stString
+		}
+		return
+	}
+
+	if len(s.utf) > 0 {
+		if b&0xc0 == 0x80 {
+			s.utf = append(s.utf, b)
+			if utf8.FullRune(s.utf) {
+				r, _ := utf8.DecodeRune(s.utf)
+				s.utf = s.utf[:0]
+				s.print(r)
+			}
+			return
+		}
+		s.utf = s.utf[:0]
+		s.print(utf8.RuneError)
+	}
+	switch {
+	case b == esc:
+		s.state = stEscape
+	case b < 0x20 || b == 0x7f:
+		s.control(b)
+	case b < 0x80:
+		s.print(rune(b))
+	case b >= 0xc0 && b < 0xf8:
+		s.utf = append(s.utf, b)
+	default:
+		s.print(utf8.RuneError)
+	}
+}
+
+func (s *Screen) control(b byte) {
+	switch b {
+	case '\r':
+		s.x, s.wrapNext = 0, false
+	case '\n', '\v', '\f':
+		s.index()
+	case '\b':
+		if s.x > 0 {
+			s.x--
+		}
+		s.wrapNext = false
+	case '\t':
+		s.x = min((s.x/tabWidth+1)*tabWidth, s.cols-1)
+		s.wrapNext = false
+	}
+}
+
+func (s *Screen) escape(b byte) {
+	s.state = stGround
+	switch b {
+	case '[':
+		s.state, s.params = stCSI, s.params[:0]
+	case ']', 'P', '_', '^', 'X':
+		s.state = stString
+	case '(', ')', '*', '+', '-', '.', '/', '#', '%', ' ':
+		s.state = stCharset
+	case '7':
+		s.saveX, s.saveY = s.x, s.y
+	case '8':
+		s.x, s.y, s.wrapNext = s.saveX, s.saveY, false
+	case 'D':
+		s.index()
+	case 'E':
+		s.x = 0
+		s.index()
+	case 'M':
+		s.reverseIndex()
+	case 'c':
+		history := s.history
+		*s = *NewScreen(s.rows, s.cols, s.maxHistory)
+		s.history = history
+	case esc:
+		s.state = stEscape
+	}
+}
+
+func (s *Screen) print(r rune) {
+	if s.wrapNext {
+		s.x = 0
+		s.index()
+	}
+	s.grid[s.y][s.x] = cell{r: r, pen: s.pen}
+	if s.x < s.cols-1 {
+		s.x++
+	} else {
+		s.wrapNext = !s.noWrap
+	}
+}
+
+// index moves the cursor down, scrolling the region at its bottom.
+func (s *Screen) index() {
+	s.wrapNext = false
+	if s.y == s.bottom {
+		s.scrollUp(1)
+	} else if s.y < s.rows-1 {
+		s.y++
+	}
+}
+
+func (s *Screen) reverseIndex() {
+	s.wrapNext = false
+	if s.y == s.top {
+		s.scrollDown(1)
+	} else if s.y > 0 {
+		s.y--
+	}
+}
+
+// scrollUp moves the scroll region up by n lines. Lines leaving the top of
+// the full main screen go to the history.
+func (s *Screen) scrollUp(n int) {
+	n = min(n, s.bottom-s.top+1)
+	for i := 0; i < n; i++ {
+		if s.top == 0 && !s.alt {
+			s.pushHistory(s.grid[0])
+		}
+		copy(s.grid[s.top:s.bottom], s.grid[s.top+1:s.bottom+1])
+		s.grid[s.bottom] = s.blankRow()
+	}
+}
+
+func (s *Screen) scrollDown(n int) {
+	n = min(n, s.bottom-s.top+1)
+	for i := 0; i < n; i++ {
+		copy(s.grid[s.top+1:s.bottom+1], s.grid[s.top:s.bottom])
+		s.grid[s.top] = s.blankRow()
+	}
+}
+
+// csi executes a control sequence with the given final byte.
+func (s *Screen) csi(final byte) {
+	private := len(s.params) > 0 && s.params[0] >= '<' && s.params[0] <= '?'
+	if hasIntermediate(s.params) {
+		return
+	}
+	raw := string(s.params)
+	if private {
+		raw = raw[1:]
+	} else if final == 'm' {
+		s.sgr(raw)
+		return
+	}
+	var args []int
+	for _, field := range strings.Split(raw, ";") {
+		field, _, _ = strings.Cut(field, ":")
+		n, _ := strconv.Atoi(field)
+		args = append(args, n)
+	}
+	// arg returns parameter i, or def if it is missing or zero
+	arg := func(i, def int) int {
+		if i < len(args) && args[i] > 0 {
+			return args[i]
+		}
+		return def
+	}
+
+	if private {
+		if s.params[0] == '?' && (final == 'h' || final == 'l') {
+			for _, mode := range args {
+				s.setMode(mode, final == 'h')
+			}
+		}
+		return
+	}
+
+	s.wrapNext = false
+	switch final {
+	case 'A':
+		s.y = max(s.y-arg(0, 1), 0)
+	case 'B', 'e':
+		s.y = min(s.y+arg(0, 1), s.rows-1)
+	case 'C', 'a':
+		s.x = min(s.x+arg(0, 1), s.cols-1)
+	case 'D':
+		s.x = max(s.x-arg(0, 1), 0)
+	case 'E':
+		s.x, s.y = 0, min(s.y+arg(0, 1), s.rows-1)
+	case 'F':
+		s.x, s.y = 0, max(s.y-arg(0, 1), 0)
+	case 'G', '`':
+		s.x = min(arg(0, 1), s.cols) - 1
+	case 'd':
+		s.y = min(arg(0, 1), s.rows) - 1
+	case 'H', 'f':
+		s.y, s.x = min(arg(0, 1), s.rows)-1, min(arg(1, 1), s.cols)-1
+	case 'J':
+		s.eraseDisplay(arg(0, 0))
+	case 'K':
+		s.eraseLine(arg(0, 0))
+	case '@':
+		row := s.grid[s.y]
+		n := min(arg(0, 1), s.cols-s.x)
+		copy(row[s.x+n:], row[s.x:])
+		fill(row[s.x : s.x+n])
+	case 'P':
+		row := s.grid[s.y]
+		n := min(arg(0, 1), s.cols-s.x)
+		copy(row[s.x:], row[s.x+n:])
+		fill(row[s.cols-n:])
+	case 'X':
+		fill(s.grid[s.y][s.x:min(s.x+arg(0, 1), s.cols)])
+	case 'L', 'M':
+		if s.y < s.top || s.y > s.bottom {
+			return
+		}
+		top := s.top
+		s.top = s.y
+		if final == 'L' {
+			s.scrollDown(arg(0, 1))
+		} else {
+			// Deleted lines never go to the history
+			alt := s.alt
+			s.alt = true
+			s.scrollUp(arg(0, 1))
+			s.alt = alt
+		}
+		s.top = top
+		s.x = 0
+	case 'S':
+		s.scrollUp(arg(0, 1))
+	case 'T':
+		s.scrollDown(arg(0, 1))
+	case 'r':
+		top, bottom := arg(0, 1)-1, min(arg(1, s.rows), s.rows)-1
+		if top < bottom {
+			s.top, s.bottom = top, bottom
+			s.x, s.y = 0, 0
+		}
+	case 's':
+		s.saveX, s.saveY = s.x, s.y
+	case 'u':
+		s.x, s.y = s.saveX, s.saveY
+	}
+}
+
+// sgr updates the pen with SGR parameters. Instead of interpreting them,
+// the pen collects them since the last reset; later ones override earlier
+// ones when rendered.
+func (s *Screen) sgr(raw string) {
+	fields := strings.Split(raw, ";")
+	for i := 0; i < len(fields); i++ {
+		field := fields[i]
+		switch field {
+		case "", "0":
+			s.pen = ""
+			continue
+		case "38", "48", "58":
+			// Extended colors: 5;n or 2;r;g;b
+			n := 0
+			if i+1 < len(fields) && fields[i+1] == "5" {
+				n = 2
+			} else if i+1 < len(fields) && fields[i+1] == "2" {
+				n = 4
+			}
+			n = min(n, len(fields)-1-i)
+			field = strings.Join(fields[i:i+n+1], ";")
+			i += n
+		}
+		if len(s.pen) < maxPen {
+			s.pen += ";" + field
+		}
+	}
+}
+
+// maxPen limits the SGR parameters collected without a reset
+const maxPen = 64
+
+func hasIntermediate(params []byte) bool {
+	for _, b := range params {
+		if b >= 0x20 && b <= 0x2f {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Screen) setMode(mode int, on bool) {
+	switch mode {
+	case 7:
+		s.noWrap = !on
+	case 2004:
+		s.paste = on
+	case 47, 1047, 1049:
+		if on == s.alt {
+			return
+		}
+		if mode == 1049 && on {
+			s.saveX, s.saveY = s.x, s.y
+		}
+		if on {
+			s.saved, s.grid = s.grid, s.blank(s.rows)
+		} else {
+			s.grid, s.saved = s.saved, nil
+		}
+		s.alt = on
+		if mode == 1049 && !on {
+			s.x, s.y = s.saveX, s.saveY
+		}
+		s.wrapNext = false
+	}
+}
+
+func (s *Screen) eraseDisplay(mode int) {
+	switch mode {
+	case 0:
+		s.eraseLine(0)
+		for _, row := range s.grid[s.y+1:] {
+			fill(row)
+		}
+	case 1:
+		s.eraseLine(1)
+		for _, row := range s.grid[:s.y] {
+			fill(row)
+		}
+	case 2:
+		for _, row := range s.grid {
+			fill(row)
+		}
+	case 3:
+		s.history = nil
+	}
+}
+
+func (s *Screen) eraseLine(mode int) {
+	row := s.grid[s.y]
+	switch mode {
+	case 0:
+		fill(row[s.x:])
+	case 1:
+		fill(row[:s.x+1])
+	case 2:
+		fill(row)
+	}
+}
+
+func fill(row []cell) {
+	for i := range row {
+		row[i] = blankCell
+	}
+}
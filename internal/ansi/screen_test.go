@@ -0,0 +1,148 @@
+package ansi
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestScreen(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "hello\r\nworld", "hello\nworld"},
+		{"colors", "\x1b[31mred\x1b[0m \x1b[1;4mbold\x1b[m", "red bold"},
+		{"carriage return", "aaaa\rbb", "bbaa"},
+		{"backspace", "abc\b\bX", "aXc"},
+		{"tab", "a\tb", "a       b"},
+		{"wrap", "abcdefghijkl", "abcdefghij\nkl"},
+		{"cursor position", "\x1b[2;3Hx\x1b[1;1Hy", "y\n  x"},
+		{"cursor movement", "abc\x1b[2D\x1b[BX\x1b[AY", "abY\n X"},
+		{"erase line", "abcdef\x1b[3G\x1b[K", "ab"},
+		{"erase display", "one\r\ntwo\x1b[2J\x1b[Hnew", "new"},
+		{"insert and delete", "abcdef\x1b[3G\x1b[2P\x1b[1G\x1b[@", " abef"},
+		{"erase chars", "abcdef\x1b[2G\x1b[3X", "a   ef"},
+		{"title and osc", "a\x1b]0;title\x07b\x1b]8;;http://x\x1b\\c", "abc"},
+		{"charset", "\x1b(Bab\x1b)0c", "abc"},
+		{"utf-8", "grüße ✓", "grüße ✓"},
+		{"alternate screen", "shell\x1b[?1049hvim\x1b[?1049l", "shell"},
+		{"alternate screen shown", "shell\x1b[?1049h\x1b[Hvim", "vim"},
+		{"save and restore", "ab\x1b7\x1b[3;1Hc\x1b8d", "abd\n\nc"},
+		{"reverse index", "a\x1b[1;1H\x1bMb", "b\na"},
+		{"scroll region", "\x1b[2;3r\x1b[1;1Htop\x1b[3;1Hx\r\ny\r\nz", "top\ny\nz"},
+	}
+	for _, tt := range tests {
+		s := NewScreen(4, 10, 100)
+		_, _ = s.Write([]byte(tt.in))
+		if got := strings.Join(s.Lines(0), "\n"); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestScreenHistory(t *testing.T) {
+	s := NewScreen(2, 10, 3)
+	for _, line := range []string{"1", "2", "3", "4", "5", "6"} {
+		_, _ = s.Write([]byte(line + "\r\n"))
+	}
+	if got := strings.Join(s.Lines(0), ","); got != "6" {
+		t.Errorf("Expected screen 6, got %q", got)
+	}
+	if got := strings.Join(s.Lines(2), ","); got != "4,5,6" {
+		t.Errorf("Expected 4,5,6, got %q", got)
+	}
+	// History is capped at 3 lines
+	if got := strings.Join(s.Lines(100), ","); got != "3,4,5,6" {
+		t.Errorf("Expected 3,4,5,6, got %q", got)
+	}
+
+	// Scrolling in the alternate screen or a region doesn't add history
+	_, _ = s.Write([]byte("\x1b[?1049h1\r\n2\r\n3\x1b[?1049l"))
+	if got := strings.Join(s.Lines(100), ","); got != "3,4,5,6" {
+		t.Errorf("Expected history unchanged, got %q", got)
+	}
+}
+
+func TestScreenResize(t *testing.T) {
+	s := NewScreen(4, 10, 100)
+	_, _ = s.Write([]byte("one\r\ntwo\r\nthree\r\nfour"))
+	s.Resize(2, 3)
+	if rows, cols := s.Size(); rows != 2 || cols != 3 {
+		t.Errorf("Expected 2x3, got %dx%d", rows, cols)
+	}
+	// Rows above the cursor move to the history, columns are cut
+	if got := strings.Join(s.Lines(10), ","); got != "one,two,thr,fou" {
+		t.Errorf("Unexpected lines after resize: %q", got)
+	}
+	_, _ = s.Write([]byte("\r\nabcd"))
+	if got := strings.Join(s.Lines(0), ","); got != "abc,d" {
+		t.Errorf("Unexpected lines after writing: %q", got)
+	}
+}
+
+func TestScreenChunked(t *testing.T) {
+	in := "\x1b[31mred\x1b[0m\x1b]0;title\x1b\\ grüße\x1b[2;1Hnext\x1b[?1049h\x1b[?1049l"
+	for _, size := range []int{1, 2, 3} {
+		s := NewScreen(4, 20, 0)
+		for i := 0; i < len(in); i += size {
+			_, _ = s.Write([]byte(in[i:min(i+size, len(in))]))
+		}
+		if got := strings.Join(s.Lines(0), "\n"); got != "red grüße\nnext" {
+			t.Errorf("chunk size %d: got %q", size, got)
+		}
+	}
+}
+
+func TestScreenBracketedPaste(t *testing.T) {
+	s := NewScreen(4, 20, 0)
+	for _, step := range []struct {
+		in   string
+		want bool
+	}{
+		{"", false},
+		{"\x1b[?2004h", true},
+		{"\x1b[?2004l", false},
+		{"\x1b[?2004h\x1bc", false}, // Reset
+	} {
+		_, _ = s.Write([]byte(step.in))
+		if got := s.BracketedPaste(); got != step.want {
+			t.Errorf("After %q: BracketedPaste() = %v", step.in, got)
+		}
+	}
+}
+
+func TestScreenRenderRow(t *testing.T) {
+	s := NewScreen(2, 8, 0)
+	_, _ = s.Write([]byte("a\x1b[1;31mb\x1b[38;5;0mc\x1b[mde\r\n\x1b[44mx"))
+	tests := []struct {
+		y, cols int
+		want    string
+	}{
+		{0, 6, "\x1b[0ma\x1b[0;1;31mb\x1b[0;1;31;38;5;0mc\x1b[0mde "},
+		{0, 2, "\x1b[0ma\x1b[0;1;31mb\x1b[0m"},
+		{1, 3, "\x1b[0m\x1b[0;44mx\x1b[0m  "},
+		{5, 2, "\x1b[0m  "},
+	}
+	for _, tt := range tests {
+		if got := s.RenderRow(tt.y, tt.cols); got != tt.want {
+			t.Errorf("RenderRow(%d, %d) = %q, want %q", tt.y, tt.cols, got, tt.want)
+		}
+	}
+	if row, col := s.Cursor(); row != 1 || col != 1 {
+		t.Errorf("Cursor() = %d, %d", row, col)
+	}
+}
+
+func TestScreenRender(t *testing.T) {
+	s := NewScreen(2, 3, 0)
+	_, _ = s.Write([]byte("ab\r\n\x1b[1mc"))
+	want := "\x1b[H\x1b[0mab \r\n\x1b[0m\x1b[0;1mc\x1b[0m  \x1b[2;2H\x1b[0;1m"
+	if got := s.Render(); got != want {
+		t.Errorf("Render() = %q, want %q", got, want)
+	}
+	_, _ = s.Write([]byte("\x1b[?1049h"))
+	if got := s.Render(); !strings.HasPrefix(got, "\x1b[?1049h\x1b[H") {
+		t.Errorf("Render() on the alternate screen = %q", got)
+	}
+}
@@ -0,0 +1,379 @@
+// Package api serves a JSON-RPC 2.0 management API on a unix socket, so
+// tools and GUIs can manage sessions without parsing the output of the CLI.
+// Requests and responses are JSON objects, one per line.
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"persishtent/internal/client"
+	"persishtent/internal/config"
+	"persishtent/internal/protocol"
+	"persishtent/internal/server"
+	"persishtent/internal/session"
+)
+
+// Error codes of the JSON-RPC 2.0 specification
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeInternalError  = -32603
+)
+
+// Error codes of failures a client may want to handle, see session.ErrSessionNotFound etc.
+const (
+	CodeFailed          = -32000 // Any other failure
+	CodeSessionNotFound = 1
+	CodeSessionExists   = 2
+	CodeNotOwner        = 3
+	CodeReadOnly        = 4
+	CodeProtocolVersion = 5
+)
+
+// maxRequestSize limits a request line, e.g. send-keys with a large paste
+const maxRequestSize = 1024 * 1024
+
+// followInterval is how often subscriptions check the audit log for events
+var followInterval = 250 * time.Millisecond
+
+// Error is the error object of a failed request
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string { return e.Message }
+
+type request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"` // Absent for notifications, which get no response
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"` // Set on event notifications
+	Params  any             `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+}
+
+// StartFunc starts a detached session and returns its name, see cli.StartDetached
+type StartFunc func(name string, opts server.Options) (string, error)
+
+// ListenPath returns the default path of the API socket. It doesn't end in
+// .sock, which would make it look like the socket of a session named api.
+func ListenPath() (string, error) {
+	dir, err := session.EnsureRuntimeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "api.socket"), nil
+}
+
+// Listen opens the API socket at path, replacing a stale one. Only the user
+// may connect, as the API can type into their sessions.
+func Listen(path string) (net.Listener, error) {
+	if conn, err := net.DialTimeout("unix", path, 100*time.Millisecond); err == nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("API already served on %s", path)
+	}
+	return session.ListenUnix(path)
+}
+
+// Serve answers API requests until the listener fails. start starts
+// sessions for the start method.
+func Serve(l net.Listener, start StartFunc) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go newConn(conn, start).serve()
+	}
+}
+
+// apiConn is a connection of an API client
+type apiConn struct {
+	conn  net.Conn
+	start StartFunc
+
+	mu         sync.Mutex // Serializes responses and event notifications
+	enc        *json.Encoder
+	subscribed bool
+	done       chan struct{} // Closed when the connection ends
+}
+
+func newConn(conn net.Conn, start StartFunc) *apiConn {
+	return &apiConn{conn: conn, start: start, enc: json.NewEncoder(conn), done: make(chan struct{})}
+}
+
+func (c *apiConn) serve() {
+	defer func() { _ = c.conn.Close() }()
+	defer close(c.done)
+	scanner := bufio.NewScanner(c.conn)
+	scanner.Buffer(make([]byte, 64*1024), maxRequestSize)
+	for scanner.Scan() {
+		var req request
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			c.write(response{ID: json.RawMessage("null"), Error: &Error{CodeParseError, "parse error"}})
+			continue
+		}
+		if req.JSONRPC != "2.0" || req.Method == "" {
+			c.write(response{ID: idOrNull(req.ID), Error: &Error{CodeInvalidRequest, "invalid request"}})
+			continue
+		}
+		result, err := c.call(req.Method, req.Params)
+		if req.ID == nil {
+			continue
+		}
+		resp := response{ID: req.ID}
+		if err != nil {
+			resp.Error = toError(err)
+		} else if resp.Result, err = json.Marshal(result); err != nil {
+			resp.Result, resp.Error = nil, &Error{CodeInternalError, err.Error()}
+		}
+		c.write(resp)
+	}
+}
+
+func idOrNull(id json.RawMessage) json.RawMessage {
+	if id == nil {
+		return json.RawMessage("null")
+	}
+	return id
+}
+
+func (c *apiConn) write(resp response) {
+	resp.JSONRPC = "2.0"
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_ = c.enc.Encode(resp)
+}
+
+// toError maps err to an error object, with the code of its kind
+func toError(err error) *Error {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	code := CodeFailed
+	switch {
+	case errors.Is(err, session.ErrSessionNotFound):
+		code = CodeSessionNotFound
+	case errors.Is(err, session.ErrSessionExists):
+		code = CodeSessionExists
+	case errors.Is(err, session.ErrNotOwner):
+		code = CodeNotOwner
+	case errors.Is(err, session.ErrStateReadOnly):
+		code = CodeReadOnly
+	case errors.Is(err, session.ErrInvalidName):
+		code = CodeInvalidParams
+	case errors.Is(err, protocol.ErrProtocolVersion):
+		code = CodeProtocolVersion
+	}
+	return &Error{code, err.Error()}
+}
+
+// Params of the methods
+type (
+	ListParams struct {
+		AllHosts bool `json:"all_hosts"`
+	}
+	StartParams struct {
+		Name    string   `json:"name"` // Generated if empty
+		Command string   `json:"command"`
+		Argv    []string `json:"argv"` // Run without a shell, instead of command
+		Shell   string   `json:"shell"`
+		Cwd     string   `json:"cwd"`
+		Tags    []string `json:"tags"`
+		Env     []string `json:"env"` // KEY=value variables of the shell
+	}
+	KillParams struct {
+		Name    string  `json:"name"`
+		Signal  string  `json:"signal"`  // TERM if empty
+		Timeout float64 `json:"timeout"` // Seconds before escalating to KILL, client.DefaultKillTimeout if 0
+	}
+	RenameParams struct {
+		Name    string `json:"name"`
+		NewName string `json:"new_name"`
+	}
+	SendKeysParams struct {
+		Name  string `json:"name"`
+		Keys  string `json:"keys"`
+		Enter bool   `json:"enter"` // Press Enter after the keys
+	}
+	SubscribeParams struct {
+		Session string `json:"session"` // Only events of this session, all if empty
+	}
+)
+
+// call runs method with the given params and returns its result
+func (c *apiConn) call(method string, raw json.RawMessage) (any, error) {
+	switch method {
+	case "list":
+		var p ListParams
+		if err := decode(raw, &p); err != nil {
+			return nil, err
+		}
+		details, err := session.ListDetails(p.AllHosts)
+		if details == nil {
+			details = []session.Details{}
+		}
+		return details, err
+	case "start":
+		var p StartParams
+		if err := decode(raw, &p); err != nil {
+			return nil, err
+		}
+		for _, kv := range p.Env {
+			if _, _, err := config.ParseEnvVar(kv); err != nil {
+				return nil, &Error{CodeInvalidParams, err.Error()}
+			}
+		}
+		name, err := c.start(p.Name, server.Options{Command: p.Command, Argv: p.Argv, Shell: p.Shell, Cwd: p.Cwd, Tags: p.Tags, Env: p.Env})
+		return map[string]string{"name": name}, err
+	case "kill":
+		var p KillParams
+		if err := decodeNamed(raw, &p, &p.Name); err != nil {
+			return nil, err
+		}
+		sig := syscall.SIGTERM
+		if p.Signal != "" {
+			var err error
+			if sig, err = client.ParseSignal(p.Signal); err != nil {
+				return nil, &Error{CodeInvalidParams, err.Error()}
+			}
+		}
+		timeout := client.DefaultKillTimeout
+		if p.Timeout > 0 {
+			timeout = time.Duration(p.Timeout * float64(time.Second))
+		}
+		return true, client.Kill(p.Name, "", sig, timeout)
+	case "rename":
+		var p RenameParams
+		if err := decodeNamed(raw, &p, &p.Name); err != nil {
+			return nil, err
+		}
+		if err := session.ValidateName(p.NewName); err != nil {
+			return nil, &Error{CodeInvalidParams, err.Error()}
+		}
+		return true, client.Rename(p.Name, p.NewName, "")
+	case "send-keys":
+		var p SendKeysParams
+		if err := decodeNamed(raw, &p, &p.Name); err != nil {
+			return nil, err
+		}
+		keys := p.Keys
+		if p.Enter {
+			keys += "\r"
+		}
+		return true, client.SendKeys(p.Name, "", []byte(keys))
+	case "subscribe":
+		var p SubscribeParams
+		if err := decode(raw, &p); err != nil {
+			return nil, err
+		}
+		return true, c.subscribe(p.Session)
+	}
+	return nil, &Error{CodeMethodNotFound, "method not found: " + method}
+}
+
+func decode(raw json.RawMessage, params any) error {
+	if len(raw) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(raw, params); err != nil {
+		return &Error{CodeInvalidParams, "invalid params: " + err.Error()}
+	}
+	return nil
+}
+
+// decodeNamed decodes the params of a method that needs a session name
+func decodeNamed(raw json.RawMessage, params any, name *string) error {
+	if err := decode(raw, params); err != nil {
+		return err
+	}
+	if *name == "" {
+		return &Error{CodeInvalidParams, "invalid params: name is required"}
+	}
+	return nil
+}
+
+// subscribe sends the events appended to the audit log from now on as
+// "event" notifications, only those of session name unless it is empty.
+func (c *apiConn) subscribe(name string) error {
+	path, err := session.GetAuditPath()
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.subscribed {
+		return errors.New("already subscribed")
+	}
+	c.subscribed = true
+	var offset int64
+	if fi, err := os.Stat(path); err == nil {
+		offset = fi.Size()
+	}
+	go followAudit(path, offset, followInterval, c.done, func(e session.AuditEvent) {
+		if name == "" || e.Session == name {
+			c.write(response{Method: "event", Params: e})
+		}
+	})
+	return nil
+}
+
+// followAudit calls event for each event appended to the audit log at path
+// after offset, checking every interval until done is closed.
+func followAudit(path string, offset int64, interval time.Duration, done <-chan struct{}, event func(session.AuditEvent)) {
+	var partial []byte
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(interval):
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		if fi, err := f.Stat(); err == nil && fi.Size() < offset {
+			// Truncated or replaced, e.g. by log rotation
+			offset, partial = 0, nil
+		}
+		if _, err := f.Seek(offset, io.SeekStart); err == nil {
+			data, _ := io.ReadAll(f)
+			offset += int64(len(data))
+			partial = append(partial, data...)
+		}
+		_ = f.Close()
+		for {
+			line, rest, ok := bytes.Cut(partial, []byte{'\n'})
+			if !ok {
+				break
+			}
+			partial = rest
+			var e session.AuditEvent
+			if json.Unmarshal(line, &e) == nil {
+				event(e)
+			}
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"persishtent/internal/server"
+	"persishtent/internal/session"
+)
+
+// rpc sends request lines to a served connection and decodes the replies
+type rpc struct {
+	t       *testing.T
+	conn    net.Conn
+	replies *bufio.Scanner
+}
+
+func newRPC(t *testing.T, start StartFunc) *rpc {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("PERSISHTENT_DIR", filepath.Join(home, ".persishtent"))
+	clientSide, serverSide := net.Pipe()
+	go newConn(serverSide, start).serve()
+	t.Cleanup(func() { _ = clientSide.Close() })
+	return &rpc{t: t, conn: clientSide, replies: bufio.NewScanner(clientSide)}
+}
+
+func (r *rpc) send(line string) {
+	r.t.Helper()
+	_ = r.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := r.conn.Write([]byte(line + "\n")); err != nil {
+		r.t.Fatalf("Write failed: %v", err)
+	}
+}
+
+func (r *rpc) reply() map[string]any {
+	r.t.Helper()
+	if !r.replies.Scan() {
+		r.t.Fatalf("No reply: %v", r.replies.Err())
+	}
+	var m map[string]any
+	if err := json.Unmarshal(r.replies.Bytes(), &m); err != nil {
+		r.t.Fatalf("Invalid reply %q: %v", r.replies.Text(), err)
+	}
+	return m
+}
+
+func errorCode(m map[string]any) int {
+	e, ok := m["error"].(map[string]any)
+	if !ok {
+		return 0
+	}
+	return int(e["code"].(float64))
+}
+
+func TestAPIRequests(t *testing.T) {
+	var started server.Options
+	r := newRPC(t, func(name string, opts server.Options) (string, error) {
+		started = opts
+		if name == "" {
+			name = "auto"
+		}
+		return name, nil
+	})
+
+	r.send(`{"jsonrpc":"2.0","id":1,"method":"list"}`)
+	if m := r.reply(); m["id"] != 1.0 || m["result"] == nil || len(m["result"].([]any)) != 0 {
+		t.Errorf("list = %v, want an empty list", m)
+	}
+
+	r.send(`{"jsonrpc":"2.0","id":"s","method":"start","params":{"command":"top","tags":["a"]}}`)
+	if m := r.reply(); m["id"] != "s" || m["result"].(map[string]any)["name"] != "auto" {
+		t.Errorf("start = %v", m)
+	}
+	if started.Command != "top" || len(started.Tags) != 1 {
+		t.Errorf("Started with %+v", started)
+	}
+
+	// Notifications get no reply, so the next reply is the one of id 3
+	r.send(`{"jsonrpc":"2.0","method":"list"}`)
+	r.send(`{"jsonrpc":"2.0","id":3,"method":"kill","params":{"name":"missing"}}`)
+	if m := r.reply(); m["id"] != 3.0 || errorCode(m) != CodeSessionNotFound {
+		t.Errorf("kill of a missing session = %v, want code %d", m, CodeSessionNotFound)
+	}
+
+	tests := []struct {
+		line string
+		code int
+	}{
+		{`{"jsonrpc":"2.0","id":4,"method":"send-keys","params":{"keys":"ls"}}`, CodeInvalidParams},
+		{`{"jsonrpc":"2.0","id":5,"method":"rename","params":{"name":"a","new_name":"b/c"}}`, CodeInvalidParams},
+		{`{"jsonrpc":"2.0","id":6,"method":"resize"}`, CodeMethodNotFound},
+		{`{"id":7,"method":"list"}`, CodeInvalidRequest},
+		{`{"jsonrpc":`, CodeParseError},
+	}
+	for _, tt := range tests {
+		r.send(tt.line)
+		if m := r.reply(); errorCode(m) != tt.code {
+			t.Errorf("%s = %v, want code %d", tt.line, m, tt.code)
+		}
+	}
+}
+
+func TestAPISubscribe(t *testing.T) {
+	followInterval = 10 * time.Millisecond
+	defer func() { followInterval = 250 * time.Millisecond }()
+	r := newRPC(t, nil)
+
+	// Events recorded before the subscription aren't sent
+	_ = session.AppendAudit(session.AuditEvent{Session: "old", Event: session.AuditStart})
+	r.send(`{"jsonrpc":"2.0","id":1,"method":"subscribe","params":{"session":"web"}}`)
+	if m := r.reply(); m["result"] != true {
+		t.Fatalf("subscribe = %v", m)
+	}
+	_ = session.AppendAudit(session.AuditEvent{Session: "db", Event: session.AuditStart})
+	_ = session.AppendAudit(session.AuditEvent{Session: "web", Event: session.AuditAttach, Client: "alice"})
+
+	m := r.reply()
+	params, _ := m["params"].(map[string]any)
+	if m["method"] != "event" || m["id"] != nil || params["session"] != "web" || params["event"] != "attach" {
+		t.Errorf("Expected the attach event of web, got %v", m)
+	}
+
+	r.send(`{"jsonrpc":"2.0","id":2,"method":"subscribe"}`)
+	if m := r.reply(); errorCode(m) != CodeFailed {
+		t.Errorf("Second subscribe = %v, want an error", m)
+	}
+}
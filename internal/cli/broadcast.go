@@ -0,0 +1,74 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+
+	"persishtent/internal/client"
+	"persishtent/internal/config"
+	"persishtent/internal/session"
+)
+
+// Broadcast sends typed input to the sessions in names, or to all local
+// sessions of group if it is set. Sessions carrying one of the confirm_tags
+// need confirmation first, as for a writable attach. It returns false if a
+// session can't be used.
+func Broadcast(names []string, group string) bool {
+	targets, ok := broadcastTargets(names, group)
+	if !ok {
+		return false
+	}
+	for _, info := range targets {
+		if !confirmAttach(info, os.Stdin, os.Stdout) {
+			return false
+		}
+	}
+
+	list := make([]string, len(targets))
+	for i, info := range targets {
+		list[i] = info.Name
+	}
+	if err := client.Broadcast(list); err != nil {
+		fmt.Println(config.Message("error", "Err", err))
+		return false
+	}
+	return true
+}
+
+// broadcastTargets looks up the sessions named, or the local sessions of
+// group if it is set.
+func broadcastTargets(names []string, group string) ([]session.Info, bool) {
+	if group != "" {
+		sessions, err := session.List()
+		if err != nil {
+			fmt.Println(config.Message("list_failed", "Err", err))
+			return nil, false
+		}
+		var targets []session.Info
+		for _, s := range sessions {
+			if s.Group == group && s.IsLocal() {
+				targets = append(targets, s)
+			}
+		}
+		if len(targets) == 0 {
+			fmt.Println(config.Message("no_group_sessions", "Group", group))
+			return nil, false
+		}
+		return targets, true
+	}
+
+	var targets []session.Info
+	for _, name := range names {
+		info, err := session.ReadInfo(name)
+		if err != nil {
+			fmt.Println(config.Message("session_not_found", "Name", name))
+			return nil, false
+		}
+		if !info.IsLocal() {
+			fmt.Println(config.Message("session_on_host", "Name", name, "Host", info.Host))
+			return nil, false
+		}
+		targets = append(targets, info)
+	}
+	return targets, true
+}
@@ -0,0 +1,75 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"persishtent/internal/client"
+	"persishtent/internal/config"
+	"persishtent/internal/session"
+)
+
+// LoadBuffer fills paste buffer name with the contents of file, or of in if
+// file is empty or "-". It returns false on errors.
+func LoadBuffer(name string, file string, in io.Reader) bool {
+	var data []byte
+	var err error
+	if file == "" || file == "-" {
+		data, err = io.ReadAll(in)
+	} else {
+		data, err = os.ReadFile(file)
+	}
+	if err == nil {
+		err = session.WriteBuffer(name, data)
+	}
+	if err != nil {
+		fmt.Println(config.Message("buffer_failed", "Err", err))
+		return false
+	}
+	fmt.Println(config.Message("buffer_loaded", "Buffer", name, "Size", formatBytes(uint64(len(data)))))
+	return true
+}
+
+// PasteBuffer types paste buffer buffer, or the most recently written one if
+// empty, into session name, bracketed if the application enabled bracketed
+// paste. Like other control input, lines matching guard_patterns are
+// discarded. It returns false on errors.
+func PasteBuffer(name string, sockPath string, buffer string) bool {
+	data, err := session.ReadBuffer(buffer)
+	if err == nil {
+		err = client.SendKeys(name, sockPath, client.PasteData(name, sockPath, data))
+	}
+	if err != nil {
+		fmt.Println(config.Message("paste_failed", "Name", name, "Err", err))
+		return false
+	}
+	return true
+}
+
+// ListBuffers prints the paste buffers, most recently written first, or
+// removes buffer remove if set. It returns false on errors.
+func ListBuffers(remove string) bool {
+	if remove != "" {
+		if err := session.RemoveBuffer(remove); err != nil {
+			fmt.Println(config.Message("buffer_failed", "Err", err))
+			return false
+		}
+		fmt.Println(config.Message("buffer_removed", "Buffer", remove))
+		return true
+	}
+	buffers, err := session.ListBuffers()
+	if err != nil {
+		fmt.Println(config.Message("buffer_failed", "Err", err))
+		return false
+	}
+	if len(buffers) == 0 {
+		fmt.Println(config.Message("no_buffers"))
+		return true
+	}
+	fmt.Println(config.Message("buffers_header"))
+	for _, b := range buffers {
+		fmt.Printf("  %s (%s, written: %s)\n", b.Name, formatBytes(uint64(b.Size)), b.Modified.Format("2006-01-02 15:04:05"))
+	}
+	return true
+}
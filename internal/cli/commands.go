@@ -1,25 +1,90 @@
 package cli
 
 import (
+	"bufio"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 	"syscall"
+	"text/template"
 	"time"
 
 	"golang.org/x/term"
 
 	"persishtent/internal/client"
+	"persishtent/internal/config"
+	"persishtent/internal/protocol"
+	"persishtent/internal/server"
 	"persishtent/internal/session"
+	"persishtent/internal/timing"
 )
 
-func GenerateAutoName() string {
+// autoNameData is the data available to auto_name_template
+type autoNameData struct {
+	Command string // Program of -c or start --, or the serial device, without its directory; empty for a shell
+	Dir     string // Base name of the starting directory
+	Profile string // Config profile, if any
+}
+
+// invalidNameChars matches runs of characters not allowed in session names
+var invalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// GenerateAutoName returns a free name for a session started with opts. The
+// auto_name_template gives the base, e.g. the command or the directory, and
+// a number makes it unique. Without a template or a usable base, sessions
+// are numbered from 0.
+func GenerateAutoName(opts server.Options) string {
 	sessions, _ := session.List()
 	var names []string
 	for _, s := range sessions {
 		names = append(names, s.Name)
 	}
-	return FindNextAutoName(names)
+	base := autoNameBase(config.Current().AutoNameTemplate, opts)
+	if base == "" {
+		return FindNextAutoName(names)
+	}
+	return findNextSuffixedName(base, names)
+}
+
+// autoNameBase renders tmpl for a session started with opts and makes the
+// result a valid session name. It returns "" if nothing usable remains.
+func autoNameBase(tmpl string, opts server.Options) string {
+	if tmpl == "" {
+		return ""
+	}
+	data := autoNameData{Profile: opts.Profile}
+	if len(opts.Argv) > 0 {
+		data.Command = filepath.Base(opts.Argv[0])
+	} else if fields := strings.Fields(opts.Command); len(fields) > 0 {
+		data.Command = filepath.Base(fields[0])
+	} else if opts.TTY != "" {
+		data.Command = filepath.Base(opts.TTY)
+	}
+	dir := opts.Cwd
+	if dir == "" {
+		dir, _ = os.Getwd()
+	}
+	if abs, err := filepath.Abs(dir); err == nil && dir != "" {
+		data.Dir = filepath.Base(abs)
+	}
+
+	t, err := template.New("auto_name").Parse(tmpl)
+	if err != nil {
+		return ""
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return ""
+	}
+	return strings.Trim(invalidNameChars.ReplaceAllString(b.String(), "-"), "-")
 }
 
 func FindNextAutoName(existingNames []string) string {
@@ -38,110 +103,984 @@ func FindNextAutoName(existingNames []string) string {
 	}
 }
 
-func StartSession(name string, detach bool, sockPath string, customCmd string, replay bool, readOnly bool, logPath string) {
+// findNextSuffixedName returns base with the lowest number from 1 that no
+// existing session uses, e.g. make-2 if make-1 runs.
+func findNextSuffixedName(base string, existingNames []string) string {
+	used := make(map[string]bool)
+	for _, name := range existingNames {
+		used[name] = true
+	}
+	for i := 1; ; i++ {
+		if name := fmt.Sprintf("%s-%d", base, i); !used[name] {
+			return name
+		}
+	}
+}
+
+func StartSession(name string, detach bool, replay bool, readOnly bool, opts server.Options) {
 	// 1. Check if already exists
-	checkPath := sockPath
+	if info, err := session.ReadInfo(name); err == nil && !info.IsLocal() && info.IsAlive() {
+		fmt.Println(config.Message("session_exists_host", "Name", name, "Host", info.Host))
+		return
+	}
+	checkPath := opts.SockPath
 	if checkPath == "" {
-		checkPath, _ = session.GetSocketPath(name)
+		checkPath, _ = session.ResolveSocketPath(name)
 	}
 
-	if _, err := os.Stat(checkPath); err == nil {
+	if session.SocketExists(checkPath) {
 		if detach {
-			fmt.Printf("Session '%s' already exists.\n", name)
+			fmt.Println(config.Message("session_exists", "Name", name))
 			return
 		}
-		AttachSession(name, sockPath, replay, readOnly, 0)
+		AttachSession(name, opts.SockPath, replay, readOnly, false, 0, "")
 		return
 	}
 
-	// 2. Spawn daemon
-	exe, err := os.Executable()
+	// 2. Spawn daemon. A session shown right away starts with the TERM of
+	// this terminal; detached ones take that of their first master.
+	if !detach {
+		opts.Term, opts.ColorTerm = os.Getenv("TERM"), os.Getenv("COLORTERM")
+	}
+	done := timing.Track("spawn daemon")
+	err := spawnDaemon(name, opts)
+	done()
 	if err != nil {
-		fmt.Println("Error finding executable:", err)
+		fmt.Println(config.Message("start_failed", "Err", err))
 		return
 	}
 
+	if detach {
+		fmt.Println(config.Message("session_started", "Name", name))
+		return
+	}
+
+	// 3. Attach once the socket appears
+	done = timing.Track("socket wait")
+	ok := waitForStart(name, checkPath)
+	done()
+	if ok {
+		AttachSession(name, opts.SockPath, replay, readOnly, false, 0, "")
+	}
+}
+
+// StartDetached starts session name in the background, with an automatic
+// name if it is empty, and returns the name once its daemon listens. Unlike
+// StartSession it prints nothing, for callers that report errors themselves.
+func StartDetached(name string, opts server.Options) (string, error) {
+	if name == "" {
+		name = GenerateAutoName(opts)
+	}
+	if err := session.ValidateName(name); err != nil {
+		return "", err
+	}
+	sockPath := opts.SockPath
+	if sockPath == "" {
+		sockPath, _ = session.ResolveSocketPath(name)
+	}
+	if session.SocketExists(sockPath) {
+		return "", fmt.Errorf("%w: %s", session.ErrSessionExists, name)
+	}
+	if err := spawnDaemon(name, opts); err != nil {
+		return "", err
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if session.SocketExists(sockPath) {
+			return name, nil
+		}
+		if info, err := session.ReadInfo(name); err == nil && info.Waiting != "" {
+			// Started, waiting for the preconditions of its profile
+			return name, nil
+		}
+	}
+	return "", errors.New("timed out waiting for the session to start")
+}
+
+// waitForStart waits for the daemon of a new session to listen on sockPath.
+// While the daemon waits for the preconditions of its profile, so does this.
+func waitForStart(name string, sockPath string) bool {
+	waiting := ""
+	deadline := time.Now().Add(time.Second)
+	for {
+		if session.SocketExists(sockPath) {
+			return true
+		}
+		info, err := session.ReadInfo(name)
+		switch {
+		case err == nil && info.Waiting != "" && info.IsAlive():
+			if info.Waiting != waiting {
+				fmt.Println(config.Message("start_waiting", "Resource", info.Waiting))
+				waiting = info.Waiting
+			}
+			deadline = time.Now().Add(time.Second)
+		case err != nil && waiting != "":
+			// The daemon removes its info when it gives up
+			fmt.Println(config.Message("start_gave_up", "Name", name, "Resource", waiting))
+			return false
+		case time.Now().After(deadline):
+			fmt.Println(config.Message("start_timeout"))
+			printDaemonOutput(name)
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// PipeCommand returns the shell command for the arguments of pipe after the
+// session name. A single argument is a command line of its own, e.g.
+// 'grep err > errors.txt'; several are quoted, so the command gets them as
+// given.
+func PipeCommand(args []string) string {
+	if len(args) == 1 {
+		return args[0]
+	}
+	return shellJoin(args)
+}
+
+// spawnDaemon starts a detached daemon process for a session
+func spawnDaemon(name string, opts server.Options) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("finding executable: %w", err)
+	}
+
 	args := []string{"daemon"}
-	if sockPath != "" {
-		args = append(args, "-s", sockPath)
+	if opts.SockPath != "" {
+		args = append(args, "-s", opts.SockPath)
+	}
+	if opts.LogPath != "" {
+		args = append(args, "-l", opts.LogPath)
 	}
-	if logPath != "" {
-		args = append(args, "-l", logPath)
+	if len(opts.Argv) > 0 {
+		// Shown as the session's command, the daemon runs Argv
+		args = append(args, "-c", shellJoin(opts.Argv))
+	} else if opts.Command != "" {
+		args = append(args, "-c", opts.Command)
 	}
-	if customCmd != "" {
-		args = append(args, "-c", customCmd)
+	if opts.Ephemeral {
+		args = append(args, "-e", "-linger", opts.Linger.String())
+	}
+	if opts.Exclusive {
+		args = append(args, "-exclusive")
+	}
+	if opts.Banner != "" {
+		args = append(args, "-banner", opts.Banner)
+	}
+	if opts.Cwd != "" {
+		args = append(args, "-cwd", opts.Cwd)
+	}
+	if len(opts.Tags) > 0 {
+		args = append(args, "-tag", strings.Join(opts.Tags, ","))
+	}
+	if opts.Record {
+		args = append(args, "-record")
+	}
+	if opts.Shell != "" {
+		args = append(args, "-shell", opts.Shell)
+	}
+	if opts.TTY != "" {
+		args = append(args, "-tty", opts.TTY, "-baud", strconv.Itoa(opts.Baud))
+	}
+	if opts.Profile != "" {
+		args = append(args, "-profile", opts.Profile)
+	}
+	if opts.Keepalive > 0 {
+		args = append(args, "-keepalive", opts.Keepalive.String())
+	}
+	if opts.NoLog {
+		args = append(args, "-no-log")
+	}
+	if opts.Umask != "" {
+		args = append(args, "-umask", opts.Umask)
+	}
+	if opts.Locale != "" {
+		args = append(args, "-locale", opts.Locale)
+	}
+	if opts.TZ != "" {
+		args = append(args, "-tz", opts.TZ)
+	}
+	if opts.Term != "" {
+		args = append(args, "-term", opts.Term)
+	}
+	if opts.ColorTerm != "" {
+		args = append(args, "-colorterm", opts.ColorTerm)
 	}
 	args = append(args, name)
+	if len(opts.Argv) > 0 {
+		args = append(append(args, "--"), opts.Argv...)
+	}
 
 	cmd := exec.Command(exe, args...)
+	if len(opts.Env) > 0 {
+		// Kept off the command line, which every user can read in ps
+		cmd.Env = append(os.Environ(), server.StartEnvVar+"="+server.EncodeStartEnv(opts.Env))
+	}
 	// Detach process
 	cmd.SysProcAttr = &syscall.SysProcAttr{
 		Setsid: true,
 	}
+	// Crashes the daemon can't report itself end up in its output
+	if out, err := session.CreateDaemonOutput(name); err == nil {
+		defer func() { _ = out.Close() }()
+		cmd.Stdout = out
+		cmd.Stderr = out
+	}
+	return cmd.Start()
+}
 
-	if err := cmd.Start(); err != nil {
-		fmt.Println("Error starting session:", err)
-		return
+// confirmAttach asks the user to type the session name before a writable
+// attach to a session carrying one of the configured confirm_tags.
+func confirmAttach(info session.Info, in io.Reader, out io.Writer) bool {
+	tag := ""
+	for _, t := range config.Current().ConfirmTags {
+		if info.HasTag(t) {
+			tag = t
+			break
+		}
+	}
+	if tag == "" {
+		return true
 	}
 
-	if detach {
-		fmt.Printf("Session '%s' started in detached mode.\n", name)
+	_, _ = fmt.Fprint(out, config.Message("confirm_tag", "Name", info.Name, "Tag", tag))
+	line, _ := bufio.NewReader(in).ReadString('\n')
+	if strings.TrimSpace(line) != info.Name {
+		_, _ = fmt.Fprintln(out, config.Message("confirm_failed"))
+		return false
+	}
+	return true
+}
+
+// AttachSession attaches this terminal to session name. An exclusive attach
+// locks the session, so other Master attaches are refused until it detaches.
+// The switch-next binding attaches the next session the same way.
+func AttachSession(name string, sockPath string, replay bool, readOnly bool, exclusive bool, tail int, transcript string) {
+	// name@host attaches over ssh; a bare name@ uses the recorded host
+	name, host, qualified := session.SplitHost(name)
+	if qualified && host == "" {
+		info, err := session.ReadInfo(name)
+		if err != nil {
+			fmt.Println(config.Message("session_not_found", "Name", name))
+			return
+		}
+		host = info.Host
+	}
+	if host != "" && host != session.Hostname() {
+		attachRemote(name, host, replay, readOnly, exclusive, tail, transcript)
 		return
 	}
 
-	// 3. Attach with retry
-	// Wait for socket to appear
-	for i := 0; i < 10; i++ {
-		if _, err := os.Stat(checkPath); err == nil {
-			AttachSession(name, sockPath, replay, readOnly, 0)
+	if info, err := session.ReadInfo(name); err == nil {
+		if sockPath == "" && !info.IsLocal() {
+			fmt.Println(config.Message("attach_remote_hint", "Name", name, "Host", info.Host))
 			return
 		}
-		time.Sleep(100 * time.Millisecond)
+		if !readOnly && !confirmAttach(info, os.Stdin, os.Stdout) {
+			return
+		}
+		if info.Waiting != "" && info.IsAlive() {
+			checkPath := sockPath
+			if checkPath == "" {
+				checkPath, _ = session.ResolveSocketPath(name)
+			}
+			if !waitForStart(name, checkPath) {
+				return
+			}
+		}
 	}
-	fmt.Println("Timed out waiting for session to start.")
-}
 
-func AttachSession(name string, sockPath string, replay bool, readOnly bool, tail int) {
 	fmt.Print("\x1b[H\x1b[2J")
 	if readOnly {
-		fmt.Printf("[attaching to session '%s' (READ-ONLY). press ctrl+d, d to detach]\n", name)
+		fmt.Println(config.Message("attaching_readonly", "Name", name))
 	} else {
-		fmt.Printf("[attaching to session '%s'. press ctrl+d, d to detach]\n", name)
-	}
-	if err := client.Attach(name, sockPath, replay, readOnly, tail); err != nil {
-		switch err {
-		case client.ErrDetached:
-			fmt.Println("\n[detached]")
-		case client.ErrKicked:
-			fmt.Println("\n[detached by another connection]")
+		fmt.Println(config.Message("attaching", "Name", name))
+	}
+	// Record the window until the client detaches, so reattach-all can
+	// restore it if the terminal goes away first
+	terminal, window := session.DetectWindow(os.Getenv)
+	_ = session.RecordAttachment(session.Attachment{
+		Session: name, ReadOnly: readOnly, Terminal: terminal, Window: window, PID: os.Getpid(), Time: time.Now(),
+	})
+	defer func() { _ = session.RemoveAttachment(os.Getpid()) }()
+
+	var kicked *client.KickedError
+	if err := client.Attach(name, sockPath, replay, readOnly, exclusive, tail, transcript); err != nil {
+		switch {
+		case errors.Is(err, client.ErrDetached):
+			fmt.Println("\n" + config.Message("detached"))
+		case errors.Is(err, client.ErrSwitch):
+			// The switch-next binding; the transcript stays with this session
+			if next := session.Next(name); next != "" {
+				AttachSession(next, "", replay, readOnly, exclusive, tail, "")
+				return
+			}
+			fmt.Println("\n" + config.Message("detached"))
+		case errors.As(err, &kicked) && kicked.By != "":
+			fmt.Println("\n" + config.Message("detached_by", "By", kicked.By))
+		case errors.Is(err, client.ErrKicked):
+			fmt.Println("\n" + config.Message("detached_by_other"))
+		case errors.Is(err, client.ErrRefused):
+			fmt.Println(config.Message("attach_refused", "Name", name))
+		case errors.Is(err, session.ErrSessionNotFound):
+			fmt.Println(config.Message("session_not_found", "Name", name))
 		default:
-			fmt.Printf("[error attaching to '%s': %v]\n", name, err)
+			fmt.Println(config.Message("attach_failed", "Name", name, "Err", err))
 		}
 	} else {
-		fmt.Println("\n[terminated]")
+		fmt.Println("\n" + config.Message("terminated"))
 	}
 }
 
-func ListSessions() {
+// ListSessions prints the active sessions passing all filters, ordered by
+// sortBy (see ListSorts) or in the order of the state directory if empty
+func ListSessions(allHosts bool, quiet bool, verbose bool, sortBy string, filters []ListFilter) {
 	current := os.Getenv("PERSISHTENT_SESSION")
-	sessions, err := session.List()
+	sessions, err := session.ListDetails(allHosts)
 	if err != nil {
-		fmt.Printf("Error listing sessions: %v\n", err)
+		fmt.Println(config.Message("list_failed", "Err", err))
+		return
+	}
+	sessions = matchListFilters(sessions, filters)
+	sortSessions(sessions, sortBy)
+	if quiet {
+		for _, s := range sessions {
+			if !s.IsLocal() {
+				// Printed in a form that can be passed to attach
+				fmt.Println(s.Name + "@" + s.Host)
+				continue
+			}
+			fmt.Println(s.Name)
+		}
 		return
 	}
 	if len(sessions) == 0 {
-		fmt.Println("No active sessions.")
+		fmt.Println(config.Message("no_sessions"))
 		return
 	}
-	fmt.Println("Active sessions:")
+	fmt.Println(config.Message("sessions_header"))
 	for _, s := range sessions {
 		prefix := "  "
 		if s.Name == current {
 			prefix = "* "
 		}
 		duration := time.Since(s.StartTime).Round(time.Second)
-		fmt.Printf("%s%s (pid: %d, cmd: %s, up: %s)\n", prefix, s.Name, s.PID, s.Command, duration)
+		extra := ""
+		if allHosts && s.Host != "" {
+			extra += ", host: " + s.Host
+		}
+		if s.Cwd != "" {
+			extra += ", cwd: " + shortenHome(s.Cwd)
+		}
+		if s.Ephemeral {
+			extra += ", ephemeral"
+		}
+		if s.Exclusive {
+			extra += ", exclusive"
+		}
+		if s.Profile != "" {
+			extra += ", profile: " + s.Profile
+		}
+		if s.State == session.StateSuspended {
+			extra += ", suspended"
+		}
+		if len(s.Tags) > 0 {
+			extra += ", tags: " + strings.Join(s.Tags, ",")
+		}
+		if s.Group != "" {
+			extra += ", group: " + s.Group
+		}
+		if s.Waiting != "" {
+			extra += ", waiting: " + s.Waiting
+		}
+		fmt.Printf("%s%s (pid: %d, cmd: %s, up: %s%s)\n", prefix, s.Name, s.PID, s.Command, duration, extra)
+		if verbose && s.IsLocal() {
+			if st, err := client.Query(s.Name, ""); err == nil {
+				fmt.Printf("    size: %dx%d, clients: %s, in: %s, out: %s\n", st.Cols, st.Rows, describeClients(st), formatBytes(st.BytesIn), formatBytes(st.BytesOut))
+				fmt.Printf("    logged: %s, rotations: %d, connects: %d\n", formatBytes(st.LogBytes), st.Rotations, st.Connects)
+				if st.Degraded != "" {
+					fmt.Printf("    degraded: %s\n", st.Degraded)
+				}
+			}
+		}
+		if verbose {
+			describeFiles(s)
+		}
+	}
+}
+
+// describeFiles prints the details of a session's files for list -v
+func describeFiles(s session.Details) {
+	details := []string{}
+	if s.LogFiles > 0 {
+		details = append(details, fmt.Sprintf("log: %s in %d files", formatBytes(uint64(s.LogSize)), s.LogFiles))
+	} else if s.LogPath == "" {
+		details = append(details, "log: disabled")
 	}
+	if s.HeartbeatAge > 0 {
+		details = append(details, fmt.Sprintf("heartbeat: %s ago", s.HeartbeatAge.Round(time.Second)))
+	}
+	if s.CustomSocket {
+		details = append(details, "socket: "+shortenHome(s.Socket))
+	}
+	if s.CustomLog {
+		details = append(details, "log path: "+shortenHome(s.LogPath))
+	}
+	if len(details) > 0 {
+		fmt.Printf("    %s\n", strings.Join(details, ", "))
+	}
+}
+
+// Clean removes stale session files and reports how much was reclaimed,
+// listing each file if verbose.
+func Clean(verbose bool, opts session.CleanOptions) bool {
+	_, removed, err := session.CleanWith(opts)
+	if err != nil {
+		fmt.Println(config.Message("clean_failed", "Err", err))
+		return false
+	}
+	var size int64
+	for _, f := range removed {
+		size += f.Size
+		if verbose || opts.DryRun {
+			fmt.Printf("  %s (%s)\n", shortenHome(f.Path), f.Reason)
+		}
+	}
+	if opts.DryRun {
+		fmt.Println(config.Message("clean_dry_run", "Count", len(removed), "Size", formatBytes(uint64(size))))
+		return true
+	}
+	fmt.Println(config.Message("cleaned", "Count", len(removed), "Size", formatBytes(uint64(size))))
+	return true
+}
+
+// ShowClients lists who is attached to a session and since when
+func ShowClients(name string, sockPath string) bool {
+	list, err := client.Clients(name, sockPath)
+	if err != nil {
+		fmt.Println(config.Message("query_failed", "Name", name, "Err", err))
+		return false
+	}
+	if len(list) == 0 {
+		fmt.Println(config.Message("no_clients", "Name", name))
+		return true
+	}
+	for _, c := range list {
+		role := "viewer"
+		if c.Master {
+			role = "master"
+		} else if c.Writable {
+			role = "writer"
+		}
+		size := ""
+		if c.Cols > 0 {
+			size = fmt.Sprintf(", %dx%d", c.Cols, c.Rows)
+		}
+		since := c.Since.Format("2006-01-02 15:04:05")
+		fmt.Printf("  %-3d %-7s %s, since %s (%s%s)\n", c.ID, role, c.Identity, since, time.Since(c.Since).Round(time.Second), size)
+	}
+	return true
+}
+
+// SetWriteAccess grants or revokes write access of a read-only client
+func SetWriteAccess(name string, sockPath string, id int, writable bool) bool {
+	if err := client.Grant(name, sockPath, id, writable); err != nil {
+		fmt.Println(config.Message("grant_failed", "Name", name, "ID", id, "Err", err))
+		return false
+	}
+	if writable {
+		fmt.Println(config.Message("access_granted", "Name", name, "ID", id))
+	} else {
+		fmt.Println(config.Message("access_revoked", "Name", name, "ID", id))
+	}
+	return true
+}
+
+// PruneHistory removes old output from the log files of a running session
+func PruneHistory(name string, sockPath string, req protocol.Prune) bool {
+	removed, err := client.PruneHistory(name, sockPath, req)
+	if err != nil {
+		fmt.Println(config.Message("prune_failed", "Name", name, "Err", err))
+		return false
+	}
+	fmt.Println(config.Message("history_pruned", "Name", name, "Size", formatBytes(uint64(removed))))
+	return true
+}
+
+// DetachClients detaches the Master of a session, or all its clients
+func DetachClients(name string, sockPath string, all bool) bool {
+	if err := client.Detach(name, sockPath, all); err != nil {
+		fmt.Println(config.Message("detach_failed", "Name", name, "Err", err))
+		return false
+	}
+	if all {
+		fmt.Println(config.Message("clients_detached", "Name", name))
+	} else {
+		fmt.Println(config.Message("master_detached", "Name", name))
+	}
+	return true
+}
+
+// SendMessage shows text on every client attached to a session
+func SendMessage(name string, sockPath string, text string) bool {
+	if err := client.SendMessage(name, sockPath, text); err != nil {
+		fmt.Println(config.Message("message_failed", "Name", name, "Err", err))
+		return false
+	}
+	return true
+}
+
+// KickClient detaches the client with the given ID from a session
+func KickClient(name string, sockPath string, id int) bool {
+	if err := client.Kick(name, sockPath, id); err != nil {
+		fmt.Println(config.Message("kick_failed", "Name", name, "ID", id, "Err", err))
+		return false
+	}
+	fmt.Println(config.Message("client_kicked", "Name", name, "ID", id))
+	return true
+}
+
+// ShowInfo prints the live status of a session as reported by its daemon
+func ShowInfo(name string, sockPath string) {
+	st, err := client.Query(name, sockPath)
+	if err != nil {
+		fmt.Println(config.Message("query_failed", "Name", name, "Err", err))
+		return
+	}
+	fmt.Printf("Session:  %s\n", st.Name)
+	fmt.Printf("PID:      %d\n", st.PID)
+	fmt.Printf("Size:     %dx%d\n", st.Cols, st.Rows)
+	fmt.Printf("Clients:  %s\n", describeClients(st))
+	if st.Suspended {
+		fmt.Printf("State:    suspended\n")
+	}
+	if st.Pipe != "" {
+		fmt.Printf("Pipe:     %s\n", st.Pipe)
+	}
+	if st.Degraded != "" {
+		fmt.Printf("Warning:  session state not saved, output kept in memory (%s)\n", st.Degraded)
+	}
+	fmt.Printf("Uptime:   %s\n", time.Since(st.Started).Round(time.Second))
+	fmt.Printf("Traffic:  in %s, out %s, logged %s\n", formatBytes(st.BytesIn), formatBytes(st.BytesOut), formatBytes(st.LogBytes))
+	fmt.Printf("Counts:   %d client connects, %d log rotations\n", st.Connects, st.Rotations)
+	if st.Cwd != "" {
+		fmt.Printf("Cwd:      %s\n", shortenHome(st.Cwd))
+	}
+	if info, err := session.ReadInfo(st.Name); err == nil {
+		if info.Recording != "" {
+			fmt.Printf("Record:   %s\n", shortenHome(info.Recording))
+		}
+		if info.Socket != "" {
+			fmt.Printf("Socket:   %s\n", shortenHome(info.Socket))
+		}
+		if defaultLog, _ := session.GetLogPath(info.Name); info.LogPath == "" {
+			fmt.Printf("Log:      disabled\n")
+		} else if info.LogPath != defaultLog {
+			fmt.Printf("Log:      %s\n", shortenHome(info.LogPath))
+		}
+		if info.Umask != "" {
+			fmt.Printf("Umask:    %s\n", info.Umask)
+		}
+		if info.Locale != "" {
+			fmt.Printf("Locale:   %s\n", info.Locale)
+		}
+		if info.TZ != "" {
+			fmt.Printf("TZ:       %s\n", info.TZ)
+		}
+		if info.Term != "" {
+			fmt.Printf("Term:     %s\n", info.Term)
+		}
+		if len(info.Env) > 0 {
+			// Only the names are recorded, values may be secrets
+			fmt.Printf("Env:      %s\n", strings.Join(info.Env, ", "))
+		}
+	}
+}
+
+// ShowLogs prints the log files of a session, oldest first, with a marker
+// wherever rotation split or truncated the history. With a non-zero since,
+// files last written before it are left out and the others are read from
+// the chunk of their index covering since. With a mark, output starts at
+// the latest mark of that name. It returns false if nothing could be shown.
+func ShowLogs(name string, since time.Time, mark string) bool {
+	segments, err := session.LogSegments(name)
+	if err != nil {
+		fmt.Println(config.Message("logs_failed", "Err", err))
+		return false
+	}
+	if len(segments) == 0 {
+		fmt.Println(config.Message("no_logs", "Name", name))
+		return false
+	}
+	var from int64
+	if mark != "" {
+		i, offset, ok := findMark(segments, mark)
+		if !ok {
+			fmt.Println(config.Message("mark_not_found", "Name", name, "Mark", mark))
+			return false
+		}
+		segments, from = segments[i:], offset
+	}
+	printSegments(segments, since, from)
+	return true
+}
+
+// findMark returns the segment holding the latest mark named mark and the
+// mark's offset in it. Only the indexes are read.
+func findMark(segments []session.LogSegment, mark string) (int, int64, bool) {
+	for i := len(segments) - 1; i >= 0; i-- {
+		marks, _ := session.ReadMarks(segments[i].Path)
+		for j := len(marks) - 1; j >= 0; j-- {
+			if marks[j].Mark == mark {
+				return i, marks[j].Offset, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// SetMark records a mark in a session's log, see ShowLogs
+func SetMark(name string, sockPath string, mark string) bool {
+	if err := client.Mark(name, sockPath, mark); err != nil {
+		fmt.Println(config.Message("mark_failed", "Name", name, "Err", err))
+		return false
+	}
+	fmt.Println(config.Message("mark_set", "Name", name, "Mark", mark))
+	return true
+}
+
+// printSegments writes the output in log segments to stdout, starting at
+// offset start of the first one, and at since if it isn't zero
+func printSegments(segments []session.LogSegment, since time.Time, start int64) {
+	tty := term.IsTerminal(int(os.Stdout.Fd()))
+	shown := false
+	for i, seg := range segments {
+		var from int64
+		if i == 0 {
+			from = start
+		}
+		if !since.IsZero() {
+			if fi, err := os.Stat(seg.Path); err == nil && fi.ModTime().Before(since) {
+				continue
+			}
+			from = max(from, session.SeekTime(seg.Path, since))
+		}
+		if seg.Marker != "" && from == 0 {
+			line, eol := seg.Marker, "\n"
+			if tty {
+				line, eol = "\x1b[7m"+seg.Marker+"\x1b[0m", "\r\n"
+			}
+			line += eol
+			// Rotated files usually end mid-line
+			if shown {
+				line = eol + line
+			}
+			fmt.Print(line)
+		}
+		shown = true
+		// Damaged chunks are left out, so output picks up at the next intact one
+		_ = session.CopyVerified(os.Stdout, seg.Path, from, func(m session.IntegrityMarker) {
+			line := config.Message("log_damaged", "Size", m.Size)
+			if tty {
+				line = "\x1b\\\x1b[m\r\n\x1b[7m" + line + "\x1b[0m\r\n"
+			} else {
+				line = "\n" + line + "\n"
+			}
+			fmt.Print(line)
+		})
+	}
+}
+
+// ParseSince parses the argument of logs -since: a duration before now, such
+// as 90m or 30d, or a local time, such as "2006-01-02 15:04" or 15:04 for today.
+func ParseSince(value string) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if days, err := strconv.Atoi(strings.TrimSuffix(value, "d")); err == nil && strings.HasSuffix(value, "d") && days >= 0 {
+		return time.Now().AddDate(0, 0, -days), nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	for _, layout := range []string{"15:04:05", "15:04"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			y, m, d := time.Now().Date()
+			return time.Date(y, m, d, t.Hour(), t.Minute(), t.Second(), 0, time.Local), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, expected a duration like 90m or 30d or a time like \"2006-01-02 15:04\"", value)
+}
+
+// ParseSize parses a size like 10MB, 512K or 4096. Units are powers of 1024,
+// as printed by formatBytes.
+func ParseSize(value string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(value))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+	mult := int64(1)
+	if i := strings.IndexAny(s, "KMGT"); i >= 0 && i == len(s)-1 {
+		mult = int64(1) << (10 * (strings.IndexByte("KMGT", s[i]) + 1))
+		s = s[:i]
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q, expected a size like 10MB", value)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+// VerifyLogs checks every log file of a session against its integrity index
+// and prints the result per file. It returns false if any file is damaged or
+// can't be verified.
+func VerifyLogs(name string) bool {
+	files, err := session.GetLogFiles(name)
+	if err != nil {
+		fmt.Println(config.Message("logs_failed", "Err", err))
+		return false
+	}
+	if len(files) == 0 {
+		fmt.Println(config.Message("no_logs", "Name", name))
+		return false
+	}
+	intact, verified := true, true
+	for _, path := range files {
+		check, err := session.VerifyLog(path)
+		if err != nil {
+			fmt.Printf("  %s: %v\n", shortenHome(path), err)
+			intact = false
+			continue
+		}
+		verified = verified && check.Verified()
+		var problems []string
+		if len(check.Corrupt) > 0 {
+			problems = append(problems, fmt.Sprintf("%d damaged chunks, first at offset %d", len(check.Corrupt), check.Corrupt[0].Offset))
+		}
+		if check.Missing > 0 {
+			problems = append(problems, fmt.Sprintf("%d bytes missing at the end", check.Missing))
+		}
+		switch {
+		case len(problems) > 0:
+			intact = false
+		case check.Markers == 0:
+			problems = append(problems, "unverified, no integrity index")
+		case check.Unkeyed > 0:
+			problems = append(problems, fmt.Sprintf("unverified, %d of %d markers without a valid key", check.Unkeyed, check.Markers))
+		default:
+			problems = append(problems, fmt.Sprintf("ok, %d markers", check.Markers))
+		}
+		if check.Unindexed > 0 && check.Markers > 0 {
+			problems = append(problems, fmt.Sprintf("%d bytes not indexed yet", check.Unindexed))
+		}
+		fmt.Printf("  %s: %s\n", shortenHome(path), strings.Join(problems, ", "))
+	}
+	switch {
+	case !intact:
+		fmt.Println(config.Message("logs_damaged", "Name", name))
+	case !verified:
+		fmt.Println(config.Message("logs_unverified", "Name", name))
+	default:
+		fmt.Println(config.Message("logs_intact", "Name", name))
+	}
+	return intact && verified
+}
+
+// describeClients summarizes the clients attached to a session
+func describeClients(st protocol.Status) string {
+	if st.Locked {
+		return fmt.Sprintf("%d (master attached, locked)", st.Clients)
+	}
+	if st.Master {
+		return fmt.Sprintf("%d (master attached)", st.Clients)
+	}
+	return fmt.Sprintf("%d", st.Clients)
+}
+
+// formatBytes renders a byte count with a binary unit suffix
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// ShowAudit prints the last events of the audit log, all if last is 0, only
+// those of session name unless it is empty.
+func ShowAudit(name string, last int) {
+	events, err := session.ReadAudit(name)
+	if err != nil {
+		fmt.Println(config.Message("audit_failed", "Err", err))
+		return
+	}
+	if len(events) == 0 {
+		fmt.Println(config.Message("no_audit_events"))
+		return
+	}
+	if last > 0 && len(events) > last {
+		events = events[len(events)-last:]
+	}
+	for _, e := range events {
+		fmt.Printf("%s  %-12s %-7s %s\n", e.Time.Local().Format("2006-01-02 15:04:05"), e.Session, e.Event, describeAudit(e))
+	}
+}
+
+// describeAudit returns what an audit event concerns, e.g. "bob@box (pid 2)
+// as read-only by alice@box (pid 1)".
+func describeAudit(e session.AuditEvent) string {
+	var parts []string
+	if e.Client != "" {
+		client := e.Client
+		if e.Mode != "" {
+			client += " as " + e.Mode
+		}
+		parts = append(parts, client)
+	}
+	if e.Detail != "" {
+		parts = append(parts, e.Detail)
+	}
+	if e.By != "" {
+		parts = append(parts, "by "+e.By)
+	}
+	return strings.Join(parts, " ")
+}
+
+// ShowDebugLog prints the last events of the debug log of session name, all
+// if last is 0, up to level. It returns false on errors.
+func ShowDebugLog(name string, last int, level string) bool {
+	maxLevel := slices.Index(config.DebugLogLevels, level)
+	if maxLevel <= 0 {
+		fmt.Println(config.Message("debug_level_invalid", "Level", level))
+		return false
+	}
+	events, err := session.ReadDebugLog(name)
+	if err != nil {
+		fmt.Println(config.Message("debug_log_failed", "Err", err))
+		return false
+	}
+	events = slices.DeleteFunc(events, func(e session.DebugEvent) bool {
+		return slices.Index(config.DebugLogLevels, e.Level) > maxLevel
+	})
+	if len(events) == 0 {
+		fmt.Println(config.Message("no_debug_events", "Name", name))
+		return true
+	}
+	if last > 0 && len(events) > last {
+		events = events[len(events)-last:]
+	}
+	for _, e := range events {
+		fmt.Printf("%s  %-5s %-7d %s\n", e.Time.Local().Format("2006-01-02 15:04:05.000"), e.Level, e.PID, e.Message)
+	}
+	printDaemonOutput(name)
+	return true
+}
+
+// printDaemonOutput prints what the daemon of session name wrote to stdout
+// and stderr, if anything, e.g. why it failed to start or a crash trace
+func printDaemonOutput(name string) {
+	data, _ := session.ReadDaemonOutput(name)
+	if output := strings.TrimSpace(data); output != "" {
+		fmt.Println(config.Message("daemon_output", "Output", output))
+	}
+}
+
+// ListCrashes prints all crash reports left behind by daemons
+func ListCrashes() {
+	reports, err := session.ListCrashes()
+	if err != nil {
+		fmt.Println(config.Message("crash_list_failed", "Err", err))
+		return
+	}
+	if len(reports) == 0 {
+		fmt.Println(config.Message("no_crash_reports"))
+		return
+	}
+	fmt.Println(config.Message("crash_reports_header"))
+	for _, r := range reports {
+		fmt.Printf("  %s (%s, %s)\n", r.Name, r.Time.Format("2006-01-02 15:04:05"), r.Path)
+	}
+}
+
+// ShowCrash prints the crash report of a session
+func ShowCrash(name string) {
+	path, err := session.GetCrashPath(name)
+	if err != nil {
+		fmt.Println(config.Message("error", "Err", err))
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Println(config.Message("crash_not_found", "Name", name))
+		return
+	}
+	fmt.Print(string(data))
+}
+
+// ClearCrashes removes all crash reports
+func ClearCrashes() {
+	reports, _ := session.ListCrashes()
+	for _, r := range reports {
+		_ = os.Remove(r.Path)
+	}
+	fmt.Println(config.Message("crashes_removed", "Count", len(reports)))
+}
+
+// ConfigCommand runs config get, set or list. It returns false on errors.
+func ConfigCommand(args []string) bool {
+	usage := "Usage: persishtent config get <key> | set <key> <value> | list"
+	if len(args) < 1 {
+		fmt.Println(usage)
+		return false
+	}
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		for _, key := range config.Keys() {
+			value, _ := config.Get(*config.Current(), key)
+			fmt.Printf("%s = %s\n", key, value)
+		}
+	case args[0] == "get" && len(args) == 2:
+		value, err := config.Get(*config.Current(), args[1])
+		if err != nil {
+			fmt.Println(config.Message("error", "Err", err))
+			return false
+		}
+		// Strings are printed as is for use in scripts
+		var str string
+		if json.Unmarshal([]byte(value), &str) == nil {
+			value = str
+		}
+		fmt.Println(value)
+	case args[0] == "set" && len(args) == 3:
+		if err := config.Set(args[1], args[2]); err != nil {
+			fmt.Println(config.Message("error", "Err", err))
+			return false
+		}
+		fmt.Println(config.Message("config_saved", "Key", args[1]))
+	default:
+		fmt.Println(usage)
+		return false
+	}
+	return true
+}
+
+// shortenHome replaces the home directory prefix of path with ~
+func shortenHome(path string) string {
+	home, err := os.UserHomeDir()
+	if err != nil || home == "" {
+		return path
+	}
+	if path == home {
+		return "~"
+	}
+	if strings.HasPrefix(path, home+"/") {
+		return "~" + path[len(home):]
+	}
+	return path
 }
 
 func PrintHelp() {
@@ -150,55 +1089,146 @@ func PrintHelp() {
 	fmt.Println("  persishtent                      Start a new auto-named session")
 	fmt.Println("  persishtent <name>               Start or attach to session")
 	fmt.Println("  persishtent list (ls)            List active sessions")
-	fmt.Println("  persishtent clean                Clean up stale sessions and log files")
-	fmt.Println("  persishtent completion           Generate shell completion script")
+	fmt.Println("    -all-hosts                     Include sessions of other hosts sharing the state directory")
+	fmt.Println("    -q                             Only print session names")
+	fmt.Println("    -v                             Include live size, clients, traffic and log files")
+	fmt.Println("  persishtent info (i) <name>      Show live status of a session")
+	fmt.Println("  persishtent clients <name>       List who is attached to a session and since when")
+	fmt.Println("  persishtent kick <name> <id>     Detach one client listed by clients")
+	fmt.Println("  persishtent detach <name>        Detach the master, e.g. one left on a dead connection")
+	fmt.Println("    -all                           Detach all clients")
+	fmt.Println("  persishtent msg <name> <text>    Show a message on the clients attached to a session")
+	fmt.Println("  persishtent grant <name> <id>    Let a read-only client type (revoke to undo)")
+	fmt.Println("  persishtent logs <name>          Print the session history from its log files")
+	fmt.Println("  persishtent logs -verify <name>  Check the log files for truncation and tampering")
+	fmt.Println("    -since <time>                  Only show output since a duration ago (1h) or a time")
+	fmt.Println("  persishtent prune-history <name> Remove old output from a running session's logs")
+	fmt.Println("    -keep <size>                   Keep this much of the newest output (10MB)")
+	fmt.Println("    -before <time>                 Remove output older than a duration ago (24h) or a time")
+	fmt.Println("  persishtent tree <name>          Show the processes running in a session with CPU and memory")
+	fmt.Println("    -watch                         Refresh until the session ends (every -interval, default 2s)")
+	fmt.Println("  persishtent clean [flags]        Clean up stale sessions and log files")
+	fmt.Println("    -logs                          Offer to remove logs of ended sessions kept outside the state directory")
+	fmt.Println("    -v                             List the removed files")
+	fmt.Println("    -n                             Only list the files that would be removed")
+	fmt.Println("    -logs-older-than <age>         Also remove history entries and rotated logs older than e.g. 30d")
+	fmt.Println("    -archived                      Also remove the whole history of ended sessions")
+	fmt.Println("  persishtent gc [flags]           Find daemons whose session files are gone and kill or register them")
+	fmt.Println("    -kill                          Kill all of them without asking")
+	fmt.Println("    -register                      Register all of them again without asking")
+	fmt.Println("  persishtent audit [name]         Show who attached to sessions and what was done to them")
+	fmt.Println("    -n <count>                     Only show the last events")
+	fmt.Println("  persishtent debug <name>         Show what the session's daemon did and what went wrong")
+	fmt.Println("    -n <count>                     Only show the last events (default 50, 0 for all)")
+	fmt.Println("    -level <level>                 Only show events up to error, info or debug")
+	fmt.Println("  persishtent crashes [name]       List or show daemon crash reports")
+	fmt.Println("    -clear                         Remove all crash reports")
+	fmt.Println("  persishtent history [show name]  List ended sessions or show their logs")
+	fmt.Println("    -since <time>                  With show, only show output since a duration ago or a time")
+	fmt.Println("  persishtent load-buffer [file]   Fill a paste buffer from a file or stdin")
+	fmt.Println("    -b <name>                      Buffer name (default)")
+	fmt.Println("  persishtent paste <name>         Type the newest paste buffer into a session")
+	fmt.Println("    -b <name>                      Paste this buffer instead")
+	fmt.Println("  persishtent buffers [-d name]    List paste buffers, or remove one")
+	fmt.Println("  persishtent metrics [-listen a]  Serve Prometheus metrics for all sessions")
+	fmt.Println("  persishtent api [-listen path]   Serve the JSON-RPC management API on a unix socket")
+	fmt.Println("  persishtent web [-listen addr]   Serve a web terminal for the sessions (localhost:8080)")
+	fmt.Println("    -cert <file> -key <file>       Serve HTTPS")
+	fmt.Println("    -ro                            Attach all browsers read-only")
+	fmt.Println("    -reset-token                   Generate a new token, logging out all browsers")
+	fmt.Println("  persishtent selftest             Verify start/attach/resize/kick/kill on this machine")
+	fmt.Println("  persishtent completion [shell]   Generate shell completion script (bash|zsh|fish)")
 	fmt.Println("  persishtent init <shell>         Generate shell integration script (bash|zsh)")
-	fmt.Println("  persishtent start (s) [flags] [name]")
+	fmt.Println("  persishtent start (s) [flags] [name] [-- <cmd> [args...]]")
 	fmt.Println("    -d                             Start in detached mode")
 	fmt.Println("    -s <path>                      Custom socket path")
 	fmt.Println("    -c <cmd>                       Custom command to run")
-	fmt.Println("  persishtent attach (a) [flags] [name]")
+	fmt.Println("    -- <cmd> [args...]             Run a program with these arguments, without a shell")
+	fmt.Println("    -ephemeral                     Kill the session when the last client detaches")
+	fmt.Println("    -linger <d>                    Grace period before an ephemeral session is killed")
+	fmt.Println("    -exclusive                     Refuse other master attaches while one is attached")
+	fmt.Println("    -cwd <dir>                     Starting directory of the session")
+	fmt.Println("    -tag <a,b>                     Tag the session (e.g. prod)")
+	fmt.Println("    -banner <tmpl>                 Banner shown at start and on attach (e.g. \"PRODUCTION {{.Host}}\")")
+	fmt.Println("    -record                        Save an asciicast recording of the session")
+	fmt.Println("    -shell <cmd>                   Shell with arguments (e.g. \"/bin/zsh -l\"), overrides default_shell")
+	fmt.Println("    -tty <dev>                     Proxy a serial device instead of a shell (e.g. /dev/ttyUSB0)")
+	fmt.Println("    -baud <n>                      Baud rate of the serial device (default 115200)")
+	fmt.Println("    -profile <name>                Use the options of a profile from the config (flags take precedence)")
+	fmt.Println("    -keepalive <d>                 Write keepalive_input into the session when idle for d (e.g. for ssh)")
+	fmt.Println("    -no-log                        Keep output in memory only, without log files or recordings")
+	fmt.Println("    -umask <mask>                  Octal umask of the session (e.g. 027)")
+	fmt.Println("    -locale <locale>               LANG of the session, replacing inherited LC_* variables")
+	fmt.Println("    -tz <zone>                     Timezone of the session (e.g. UTC)")
+	fmt.Println("    -e <KEY=VALUE>                 Set an environment variable of the session (repeatable)")
+	fmt.Println("  persishtent attach (a) [flags] [name[@host]]")
 	fmt.Println("    -n                             Do not replay session output")
 	fmt.Println("    -t <n>                         Only replay last N lines of output")
+	fmt.Println("    -replay-rate <n>               Replay speed limit in bytes/sec (0 for unlimited)")
 	fmt.Println("    -ro                            Attach in read-only mode")
+	fmt.Println("    -x                             Refuse other master attaches until you detach")
+	fmt.Println("    -transcript <file>             Save live output to a local file (toggle with Prefix, t)")
 	fmt.Println("    -s <path>                      Custom socket path")
 	fmt.Println("  persishtent kill (k) [flags] [name]")
-	fmt.Println("    -a                             Kill all sessions")
+	fmt.Println("    -a                             Kill all sessions in parallel and summarize the results")
+	fmt.Println("    -signal <name>                 Signal to send: TERM (default), INT, HUP, KILL")
+	fmt.Println("    -timeout <d>                   Wait before escalating to KILL (default 3s)")
 	fmt.Println("    -s <path>                      Custom socket path")
+	fmt.Println("  persishtent shutdown [flags] <name|-a>")
+	fmt.Println("    -reason <text>                 Reason shown to attached clients")
+	fmt.Println("    -timeout <d>                   Wait before escalating to KILL (default 3s)")
+	fmt.Println("  persishtent upgrade [flags] <name|-a>")
+	fmt.Println("    -exe <path>                    Daemon binary to hand over to (default: this one)")
 	fmt.Println("  persishtent rename (r) <old> <new>")
+	fmt.Println("  persishtent retag <pat> <tags>   Set tags of all sessions matching a glob (+tag/-tag to add/remove)")
+	fmt.Println("  persishtent regroup <pat> <grp>  Move all sessions matching a glob to a group (\"\" to remove)")
+	fmt.Println("  persishtent wait (w) [flags] <name>")
+	fmt.Println("    -s <path>                      Custom socket path")
+	fmt.Println("  persishtent reload [name...]     Reload config in running sessions (all if no name given)")
+	fmt.Println("  persishtent config get <key>     Print a setting of the config file")
+	fmt.Println("  persishtent config set <k> <v>   Validate and save a setting (lists comma-separated)")
+	fmt.Println("  persishtent config list          Print all settings with their current values")
+	fmt.Println("  persishtent pipe [flags] <name> -- <command>")
+	fmt.Println("                                   Feed live session output into a command, without attaching")
+	fmt.Println("    -stop                          Stop piping output (no command)")
+	fmt.Println("    -s <path>                      Custom socket path")
+	fmt.Println("  persishtent capture [flags] <name>")
+	fmt.Println("                                   Print the text on a session's screen, without attaching")
+	fmt.Println("    -S <-lines>                    Include that many scrollback lines above the screen")
+	fmt.Println("    -s <path>                      Custom socket path")
+	fmt.Println("  persishtent broadcast <name1,name2,...>")
+	fmt.Println("                                   Type into several sessions at once (ctrl+d, d to stop)")
+	fmt.Println("    -g <group>                     All local sessions of a group instead of names")
+	fmt.Println("  persishtent view [flags] <name>...")
+	fmt.Println("                                   Show sessions side by side (ctrl+d, o to switch, ctrl+d, d to quit)")
+	fmt.Println("    -g <group>                     All local sessions of a group instead of names")
+	fmt.Println("    -ro                            Send no input to any pane")
+	fmt.Println("  persishtent ssh [flags] <host> [name]")
+	fmt.Println("                                   Start or attach to a session on another host over ssh")
+	fmt.Println("    -install                       Copy this binary to ~/.local/bin there if persishtent is missing")
+	fmt.Println("    -ro                            Attach in read-only mode")
+	fmt.Println("    -n                             Do not replay session history")
+	fmt.Println("  persishtent reattach-all [flags]")
+	fmt.Println("                                   Print commands reattaching sessions of closed terminal windows")
+	fmt.Println("    -exec                          Open the windows instead (tmux, WezTerm, kitty, iTerm2, Terminal)")
+	fmt.Println("    -layout <file>                 Restore a layout saved with -save instead")
+	fmt.Println("    -save                          Save the current attachments to the -layout file")
+	fmt.Println("  persishtent suspend <name>       Stop all processes of a session (SIGSTOP)")
+	fmt.Println("  persishtent resume <name>        Continue a suspended session (SIGCONT)")
+	fmt.Println("  persishtent secret inject [flags] <name> <ref>")
+	fmt.Println("                                   Type a secret from a backend into a session, unlogged")
+	fmt.Println("    -backend <name>                Backend from secret_backends (needed if several are configured)")
+	fmt.Println("    -enter                         Press Enter after the secret")
+	fmt.Println("    -force                         Inject even if terminal echo is on")
+	fmt.Println("    -s <path>                      Custom socket path")
+	fmt.Println("  persishtent launchd install|uninstall <name>")
+	fmt.Println("                                   Start a session again at login with a LaunchAgent (macOS)")
+	fmt.Println("  --timing                         Print where a command spent its time (with any command)")
 	fmt.Println("")
 	fmt.Println("Shortcuts:")
 	fmt.Println("  Ctrl+D, d                        Detach from session")
 	fmt.Println("  Ctrl+D, Ctrl+D                   Send Ctrl+D to session")
-}
-
-func PrintCompletionScript() {
-	script := `#!/bin/bash
-# Bash/Zsh completion for persishtent
-
-_persishtent_completions() {
-	local cur prev opts
-	COMPREPLY=()
-	cur="${COMP_WORDS[COMP_CWORD]}"
-	prev="${COMP_WORDS[COMP_CWORD-1]}"
-	opts="start attach list kill rename clean completion init help"
-
-	case "${prev}" in
-		start|attach|kill|rename)
-			local sessions=$(persishtent list 2>/dev/null | grep "^  " | awk '{print $1}')
-			COMPREPLY=( $(compgen -W "${sessions}" -- ${cur}) )
-			return 0
-			;;
-		*)
-			;;
-	esac
-
-	COMPREPLY=( $(compgen -W "${opts}" -- ${cur}) )
-}
-
-complete -F _persishtent_completions persishtent
-`
-	fmt.Print(script)
+	fmt.Println("  q (during replay)                Skip history replay and jump to live output")
 }
 
 func PrintInitScript(shell string) {
@@ -206,13 +1236,19 @@ func PrintInitScript(shell string) {
 	case "bash":
 		fmt.Print(`
 if [ -n "$PERSISHTENT_SESSION" ]; then
-    PROMPT_COMMAND='echo -ne "\033]0;persishtent: ${PERSISHTENT_SESSION}\007"'
+    # Follow live renames of the session
+    # and pick up environment forwarded by the latest client (DISPLAY, ...)
+    PROMPT_COMMAND='[ -r "$PERSISHTENT_NAME_FILE" ] && read -r PERSISHTENT_SESSION < "$PERSISHTENT_NAME_FILE"; [ -r "$PERSISHTENT_ENV_FILE" ] && . "$PERSISHTENT_ENV_FILE"; echo -ne "\033]0;persishtent: ${PERSISHTENT_SESSION}\007"'
 fi
 `)
 	case "zsh":
 		fmt.Print(`
 if [ -n "$PERSISHTENT_SESSION" ]; then
     precmd() {
+        # Follow live renames of the session
+        [ -r "$PERSISHTENT_NAME_FILE" ] && read -r PERSISHTENT_SESSION < "$PERSISHTENT_NAME_FILE"
+        # Pick up environment forwarded by the latest client (DISPLAY, ...)
+        [ -r "$PERSISHTENT_ENV_FILE" ] && . "$PERSISHTENT_ENV_FILE"
         print -Pn "\e]0;persishtent: ${PERSISHTENT_SESSION}\a"
     }
 fi
@@ -222,6 +1258,9 @@ fi
 	}
 }
 
+// SelectSession lets the user pick one of sessions, filtering them as they
+// type, and shows the last output of the one under the cursor. It returns
+// "" if cancelled or not run in a terminal.
 func SelectSession(sessions []session.Info) string {
 	if !term.IsTerminal(int(os.Stdin.Fd())) {
 		// Fallback for non-interactive: print list and exit
@@ -239,57 +1278,101 @@ func SelectSession(sessions []session.Info) string {
 	defer func() { _ = term.Restore(int(os.Stdin.Fd()), oldState) }()
 
 	idx := 0
+	filter := ""
+	matches := sessions
+	previews := make(map[string][]string)
+	cols, _, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		cols = 80
+	}
 	// Hide cursor
 	fmt.Print("\x1b[?25l")
 	defer fmt.Print("\x1b[?25h")
 
-	first := true
+	drawn := 0
 	printList := func() {
-		if !first {
-			// Move up N+1 lines (N sessions + header)
-			fmt.Printf("\x1b[%dA", len(sessions)+1)
-		}
-		first = false
-		
-		fmt.Printf("Select a session (Up/Down/Enter/q):\r\n")
-		for i, s := range sessions {
+		if drawn > 0 {
+			// Move back to the header and clear the previous list
+			fmt.Printf("\x1b[%dA", drawn)
+		}
+		fmt.Print("\r\x1b[J")
+
+		fmt.Printf("Select a session (type to filter, Up/Down/Enter, Esc to cancel): %s\r\n", filter)
+		for i, s := range matches {
 			prefix := "   "
 			if i == idx {
 				prefix = " > "
 			}
 			fmt.Printf("%s%s (pid: %d, cmd: %s)\x1b[K\r\n", prefix, s.Name, s.PID, s.Command)
 		}
+		if len(matches) == 0 {
+			fmt.Print("   (no matching sessions)\r\n")
+		}
+		drawn = max(len(matches), 1) + 1
+
+		// The last output tells apart sessions with similar names
+		if len(matches) > 0 {
+			name := matches[idx].Name
+			lines, ok := previews[name]
+			if !ok {
+				lines = sessionPreview(name, previewLines, cols-5)
+				previews[name] = lines
+			}
+			fmt.Printf("\x1b[2m   --- %s ---\x1b[0m\r\n", name)
+			for _, line := range lines {
+				fmt.Printf("\x1b[2m   | %s\x1b[0m\r\n", line)
+			}
+			drawn += len(lines) + 1
+		}
+	}
+
+	refilter := func() {
+		matches = filterSessions(sessions, filter)
+		idx = 0
 	}
 
 	printList()
 
-	buf := make([]byte, 3)
+	buf := make([]byte, 64)
 	for {
 		n, err := os.Stdin.Read(buf)
 		if err != nil {
 			return ""
 		}
-		
-		if n == 1 {
-			if buf[0] == 3 || buf[0] == 4 || buf[0] == 113 { // Ctrl+C, Ctrl+D, q
+
+		for i := 0; i < n; i++ {
+			b := buf[i]
+			switch {
+			case b == 27 && i+2 < n && buf[i+1] == 91:
+				// Arrow keys
+				switch buf[i+2] {
+				case 65: // Up
+					if idx > 0 {
+						idx--
+					}
+				case 66: // Down
+					if idx < len(matches)-1 {
+						idx++
+					}
+				}
+				i += 2
+			case b == 27 || b == 3 || b == 4: // Esc, Ctrl+C, Ctrl+D
 				return ""
-			}
-			if buf[0] == 13 || buf[0] == 10 { // Enter
-				return sessions[idx].Name
-			}
-		} else if n == 3 && buf[0] == 27 && buf[1] == 91 {
-			switch buf[2] {
-			case 65: // Up
-				if idx > 0 {
-					idx--
-					printList()
+			case b == 13 || b == 10: // Enter
+				if len(matches) == 0 {
+					continue
 				}
-			case 66: // Down
-				if idx < len(sessions)-1 {
-					idx++
-					printList()
+				return matches[idx].Name
+			case b == 127 || b == 8: // Backspace
+				if filter != "" {
+					filter = filter[:len(filter)-1]
+					refilter()
 				}
+			case b >= 32 && b < 127:
+				filter += string(b)
+				refilter()
 			}
 		}
+		printList()
 	}
-}
\ No newline at end of file
+}
@@ -1,7 +1,15 @@
 package cli
 
 import (
+	"io"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"persishtent/internal/config"
+	"persishtent/internal/server"
+	"persishtent/internal/session"
 )
 
 func TestFindNextAutoName(t *testing.T) {
@@ -26,4 +34,177 @@ func TestFindNextAutoName(t *testing.T) {
 			}
 		})
 	}
-}
\ No newline at end of file
+}
+
+func TestAutoNameBase(t *testing.T) {
+	tmpl := config.DefaultAutoNameTemplate
+	tests := []struct {
+		tmpl string
+		opts server.Options
+		want string
+	}{
+		{tmpl, server.Options{Command: "/usr/bin/cat -n file"}, "cat"},
+		{tmpl, server.Options{Cwd: "/home/me/my.project"}, "my-project"},
+		{tmpl, server.Options{TTY: "/dev/ttyUSB0"}, "ttyUSB0"},
+		{"{{.Profile}}", server.Options{Profile: "build"}, "build"},
+		{"{{.Profile}}", server.Options{}, ""},
+		{"", server.Options{Command: "cat"}, ""},
+		{"{{.Nope}}", server.Options{}, ""},
+	}
+	for _, tt := range tests {
+		if got := autoNameBase(tt.tmpl, tt.opts); got != tt.want {
+			t.Errorf("autoNameBase(%q, %+v) = %q, want %q", tt.tmpl, tt.opts, got, tt.want)
+		}
+	}
+
+	if got := findNextSuffixedName("cat", []string{"cat-1", "cat-2", "0"}); got != "cat-3" {
+		t.Errorf("Expected cat-3, got %s", got)
+	}
+}
+
+func TestShortenHome(t *testing.T) {
+	t.Setenv("HOME", "/home/user")
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"/home/user", "~"},
+		{"/home/user/src/app", "~/src/app"},
+		{"/home/username", "/home/username"},
+		{"/tmp", "/tmp"},
+	}
+	for _, tt := range tests {
+		if got := shortenHome(tt.path); got != tt.expected {
+			t.Errorf("shortenHome(%q) = %q, want %q", tt.path, got, tt.expected)
+		}
+	}
+}
+
+func TestConfirmAttach(t *testing.T) {
+	defer config.Use(*config.Current())
+	config.Update(func(c *config.Config) { c.ConfirmTags = []string{"prod"} })
+
+	plain := session.Info{Name: "dev"}
+	if !confirmAttach(plain, strings.NewReader(""), io.Discard) {
+		t.Error("Untagged session should not require confirmation")
+	}
+
+	prod := session.Info{Name: "db", Tags: []string{"prod"}}
+	if !confirmAttach(prod, strings.NewReader("db\n"), io.Discard) {
+		t.Error("Typing the session name should confirm")
+	}
+	if confirmAttach(prod, strings.NewReader("yes\n"), io.Discard) {
+		t.Error("Wrong confirmation should be rejected")
+	}
+	if confirmAttach(prod, strings.NewReader(""), io.Discard) {
+		t.Error("Missing confirmation should be rejected")
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := map[uint64]string{
+		0:           "0 B",
+		1023:        "1023 B",
+		1536:        "1.5 KiB",
+		3 << 20:     "3.0 MiB",
+		5 << 30 / 2: "2.5 GiB",
+	}
+	for n, want := range tests {
+		if got := formatBytes(n); got != want {
+			t.Errorf("formatBytes(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
+
+func TestParseSince(t *testing.T) {
+	if got, err := ParseSince("90m"); err != nil || time.Since(got).Round(time.Minute) != 90*time.Minute {
+		t.Errorf("Duration parsed as %v, %v", got, err)
+	}
+	if got, err := ParseSince("2024-05-01 14:00"); err != nil || !got.Equal(time.Date(2024, 5, 1, 14, 0, 0, 0, time.Local)) {
+		t.Errorf("Time parsed as %v, %v", got, err)
+	}
+	if got, err := ParseSince("30d"); err != nil || !got.Before(time.Now().AddDate(0, 0, -29)) || got.Before(time.Now().AddDate(0, 0, -31)) {
+		t.Errorf("Days parsed as %v, %v", got, err)
+	}
+	y, m, d := time.Now().Date()
+	if got, err := ParseSince("14:30"); err != nil || !got.Equal(time.Date(y, m, d, 14, 30, 0, 0, time.Local)) {
+		t.Errorf("Clock time parsed as %v, %v", got, err)
+	}
+	if _, err := ParseSince("yesterday"); err == nil {
+		t.Error("Expected an error for an invalid time")
+	}
+}
+
+func TestFindMark(t *testing.T) {
+	t.Setenv("PERSISHTENT_DIR", t.TempDir())
+	dir := t.TempDir()
+	var segments []session.LogSegment
+	for _, name := range []string{"s.log.1", "s.log"} {
+		path := filepath.Join(dir, name)
+		index, err := session.OpenIndex(path, 1024, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = index.Add([]byte("output\n"))
+		_ = index.Mark("build")
+		_ = index.Add([]byte("more\n"))
+		if name == "s.log.1" {
+			_ = index.Mark("deploy")
+		}
+		_ = index.Close()
+		segments = append(segments, session.LogSegment{Path: path})
+	}
+
+	// The latest mark of the name wins, in whichever file it is
+	if i, offset, ok := findMark(segments, "build"); !ok || i != 1 || offset != 7 {
+		t.Errorf("findMark(build) = %d, %d, %v", i, offset, ok)
+	}
+	if i, offset, ok := findMark(segments, "deploy"); !ok || i != 0 || offset != 12 {
+		t.Errorf("findMark(deploy) = %d, %d, %v", i, offset, ok)
+	}
+	if _, _, ok := findMark(segments, "release"); ok {
+		t.Error("Found a mark that was never set")
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := map[string]int64{
+		"4096":   4096,
+		"512K":   512 << 10,
+		"10MB":   10 << 20,
+		"1.5GiB": 3 << 29,
+		"2 kb":   2048,
+	}
+	for value, want := range tests {
+		if got, err := ParseSize(value); err != nil || got != want {
+			t.Errorf("ParseSize(%q) = %d, %v, want %d", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"", "MB", "-1K", "10XB"} {
+		if _, err := ParseSize(value); err == nil {
+			t.Errorf("Expected an error for %q", value)
+		}
+	}
+}
+
+func TestDescribeAudit(t *testing.T) {
+	tests := map[string]session.AuditEvent{
+		"bob@box (pid 2) as read-only by alice@box (pid 1)": {Event: session.AuditKick, Client: "bob@box (pid 2)", Mode: "read-only", By: "alice@box (pid 1)"},
+		"SIGTERM by alice@box (pid 1)":                      {Event: session.AuditSignal, Detail: "SIGTERM", By: "alice@box (pid 1)"},
+		"exit status 0":                                     {Event: session.AuditExit, Detail: "exit status 0"},
+	}
+	for want, e := range tests {
+		if got := describeAudit(e); got != want {
+			t.Errorf("describeAudit(%+v) = %q, want %q", e, got, want)
+		}
+	}
+}
+
+func TestPipeCommand(t *testing.T) {
+	if got := PipeCommand([]string{"cat > out.txt"}); got != "cat > out.txt" {
+		t.Errorf("PipeCommand() of a command line = %q", got)
+	}
+	if got := PipeCommand([]string{"grep", "a b", "-e", "it's"}); got != `grep 'a b' -e 'it'\''s'` {
+		t.Errorf("PipeCommand() of arguments = %q", got)
+	}
+}
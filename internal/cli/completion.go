@@ -0,0 +1,383 @@
+package cli
+
+import (
+	"fmt"
+	"strings"
+)
+
+// completionFlag describes a subcommand flag for shell completion
+type completionFlag struct {
+	name string
+	desc string
+	arg  string // Value placeholder, empty for boolean flags
+}
+
+// completionCommand describes a subcommand for shell completion
+type completionCommand struct {
+	name     string
+	aliases  []string
+	desc     string
+	flags    []completionFlag
+	sessions bool     // Complete session names as arguments
+	args     []string // Fixed argument values
+}
+
+var completionCommands = []completionCommand{
+	{name: "start", aliases: []string{"s"}, desc: "Start a new session", sessions: true, flags: []completionFlag{
+		{"d", "Start in detached mode", ""},
+		{"s", "Custom socket path", "path"},
+		{"l", "Custom log path", "path"},
+		{"c", "Custom command to run", "cmd"},
+		{"ro", "Start in read-only mode", ""},
+		{"ephemeral", "Kill the session when the last client detaches", ""},
+		{"linger", "Grace period before an ephemeral session is killed", "duration"},
+		{"exclusive", "Refuse other master attaches while one is attached", ""},
+		{"banner", "Banner template shown at start and on attach", "template"},
+		{"cwd", "Starting directory of the session", "dir"},
+		{"tag", "Comma-separated session tags", "tags"},
+		{"record", "Save an asciicast recording of the session", ""},
+		{"shell", "Shell with arguments", "path"},
+		{"tty", "Serial device to proxy instead of a shell", "path"},
+		{"baud", "Baud rate of the serial device", "rate"},
+		{"profile", "Start with the options of a config profile", "name"},
+		{"keepalive", "Write keepalive input into the session when idle", "duration"},
+		{"no-log", "Keep output in memory only", ""},
+		{"umask", "Octal umask of the session", "mask"},
+		{"locale", "LANG of the session", "locale"},
+		{"tz", "Timezone of the session", "zone"},
+		{"e", "Environment variable of the session", "var"},
+	}},
+	{name: "attach", aliases: []string{"a"}, desc: "Attach to a session", sessions: true, flags: []completionFlag{
+		{"s", "Custom socket path", "path"},
+		{"n", "Do not replay session output", ""},
+		{"t", "Only replay last N lines of output", "lines"},
+		{"ro", "Attach in read-only mode", ""},
+		{"x", "Refuse other master attaches until detached", ""},
+		{"replay-rate", "Replay speed limit in bytes/sec", "rate"},
+		{"transcript", "Save live session output to a local file", "path"},
+	}},
+	{name: "list", aliases: []string{"ls"}, desc: "List active sessions", flags: []completionFlag{
+		{"all-hosts", "Include sessions of other hosts", ""},
+		{"q", "Only print session names", ""},
+		{"quiet", "Only print session names", ""},
+		{"v", "Include live size, clients, traffic and log files", ""},
+		{"sort", "Order by name, uptime or activity", "order"},
+		{"filter", "Only list sessions matching key=value or key~regex", "filter"},
+	}},
+	{name: "info", aliases: []string{"i"}, desc: "Show live status of a session", sessions: true, flags: []completionFlag{
+		{"s", "Custom socket path", "path"},
+	}},
+	{name: "clients", desc: "List who is attached to a session", sessions: true, flags: []completionFlag{
+		{"s", "Custom socket path", "path"},
+	}},
+	{name: "kick", desc: "Detach one client from a session", sessions: true, flags: []completionFlag{
+		{"s", "Custom socket path", "path"},
+	}},
+	{name: "msg", desc: "Show a message on the clients attached to a session", sessions: true, flags: []completionFlag{
+		{"s", "Custom socket path", "path"},
+	}},
+	{name: "detach", desc: "Detach the master or all clients of a session", sessions: true, flags: []completionFlag{
+		{"all", "Detach all clients", ""},
+		{"s", "Custom socket path", "path"},
+	}},
+	{name: "grant", desc: "Let a read-only client type", sessions: true, flags: []completionFlag{
+		{"s", "Custom socket path", "path"},
+	}},
+	{name: "revoke", desc: "Make a client read-only again", sessions: true, flags: []completionFlag{
+		{"s", "Custom socket path", "path"},
+	}},
+	{name: "prune-history", desc: "Remove old output from a running session's logs", sessions: true, flags: []completionFlag{
+		{"s", "Custom socket path", "path"},
+		{"keep", "Keep this much of the newest output", "size"},
+		{"before", "Remove output older than this", "time"},
+	}},
+	{name: "kill", aliases: []string{"k"}, desc: "Kill a session", sessions: true, flags: []completionFlag{
+		{"a", "Kill all sessions", ""},
+		{"s", "Custom socket path", "path"},
+		{"signal", "Signal to send", "signal"},
+		{"timeout", "Time to wait before escalating to KILL", "duration"},
+	}},
+	{name: "shutdown", desc: "End a session gracefully, telling attached clients why", sessions: true, flags: []completionFlag{
+		{"a", "Shut down all sessions", ""},
+		{"s", "Custom socket path", "path"},
+		{"reason", "Reason shown to attached clients", "text"},
+		{"timeout", "Time to wait before escalating to KILL", "duration"},
+	}},
+	{name: "upgrade", desc: "Hand a session over to the new daemon binary without ending it", sessions: true, flags: []completionFlag{
+		{"a", "Upgrade all sessions", ""},
+		{"s", "Custom socket path", "path"},
+		{"exe", "Daemon binary to hand over to, instead of this one", "path"},
+	}},
+	{name: "rename", aliases: []string{"r"}, desc: "Rename a session", sessions: true},
+	{name: "retag", desc: "Change the tags of sessions matching a pattern", sessions: true},
+	{name: "regroup", desc: "Change the group of sessions matching a pattern", sessions: true},
+	{name: "wait", aliases: []string{"w"}, desc: "Wait for a session to exit", sessions: true, flags: []completionFlag{
+		{"s", "Custom socket path", "path"},
+	}},
+	{name: "reload", desc: "Reload config in running sessions", sessions: true},
+	{name: "pipe", desc: "Feed live session output into a command", sessions: true, flags: []completionFlag{
+		{"s", "Custom socket path", "path"},
+		{"stop", "Stop piping output", ""},
+	}},
+	{name: "capture", desc: "Print the current screen of a session", sessions: true, flags: []completionFlag{
+		{"s", "Custom socket path", "path"},
+		{"S", "Scrollback lines above the screen, e.g. -100", "lines"},
+	}},
+	{name: "broadcast", desc: "Type into several sessions at once", sessions: true, flags: []completionFlag{
+		{"g", "All sessions of this group", "group"},
+	}},
+	{name: "view", desc: "Show several sessions side by side", sessions: true, flags: []completionFlag{
+		{"g", "All sessions of this group", "group"},
+		{"ro", "Send no input to any pane", ""},
+	}},
+	{name: "ssh", desc: "Start or attach to a session on another host", flags: []completionFlag{
+		{"install", "Copy this binary to the host if needed", ""},
+		{"ro", "Attach in read-only mode", ""},
+		{"n", "Do not replay session output", ""},
+	}},
+	{name: "reattach-all", desc: "Restore attachments of closed terminal windows", flags: []completionFlag{
+		{"exec", "Open the windows instead of printing the commands", ""},
+		{"layout", "Layout file", "path"},
+		{"save", "Save the current attachments to the layout file", ""},
+	}},
+	{name: "suspend", desc: "Stop all processes of a session", sessions: true, flags: []completionFlag{
+		{"s", "Custom socket path", "path"},
+	}},
+	{name: "resume", desc: "Continue a suspended session", sessions: true, flags: []completionFlag{
+		{"s", "Custom socket path", "path"},
+	}},
+	{name: "secret", desc: "Type a secret from a backend into a session", args: []string{"inject"}, flags: []completionFlag{
+		{"backend", "Secret backend", "name"},
+		{"enter", "Press Enter after the secret", ""},
+		{"force", "Inject even if terminal echo is on", ""},
+		{"s", "Custom socket path", "path"},
+	}},
+	{name: "logs", desc: "Print the session history from its log files", sessions: true, flags: []completionFlag{
+		{"verify", "Check the log files against their integrity index", ""},
+		{"since", "Only show output since a duration ago or a time", "time"},
+		{"from-mark", "Only show output since the latest mark of this name", "mark"},
+	}},
+	{name: "mark", desc: "Set a mark in the session log for logs -from-mark", sessions: true, flags: []completionFlag{
+		{"s", "Custom socket path", "path"},
+	}},
+	{name: "tree", desc: "Show the processes running in a session", sessions: true, flags: []completionFlag{
+		{"watch", "Refresh until the session ends", ""},
+		{"interval", "Refresh interval", "duration"},
+	}},
+	{name: "clean", desc: "Clean up stale sessions and log files", flags: []completionFlag{
+		{"logs", "Offer to remove logs of ended sessions outside the state directory", ""},
+		{"v", "List the removed files", ""},
+		{"n", "Only list the files that would be removed", ""},
+		{"logs-older-than", "Also remove history entries and rotated logs older than this", "age"},
+		{"archived", "Also remove the whole history of ended sessions", ""},
+	}},
+	{name: "gc", desc: "Find daemons whose session files are gone", flags: []completionFlag{
+		{"kill", "Kill all orphaned daemons", ""},
+		{"register", "Register all orphaned daemons again", ""},
+	}},
+	{name: "config", desc: "Get, set or list config settings", args: []string{"get", "set", "list"}},
+	{name: "audit", desc: "Show the attach and kill audit log", sessions: true, flags: []completionFlag{
+		{"n", "Only show the last events", "count"},
+	}},
+	{name: "debug", desc: "Show the debug log of a session's daemon", sessions: true, flags: []completionFlag{
+		{"n", "Only show the last events, 0 for all", "count"},
+		{"level", "Only show events up to this level", "level"},
+	}},
+	{name: "crashes", desc: "List or show daemon crash reports", sessions: true, flags: []completionFlag{
+		{"clear", "Remove all crash reports", ""},
+	}},
+	{name: "metrics", desc: "Serve Prometheus metrics for all sessions", flags: []completionFlag{
+		{"listen", "Listen address (host:port or unix:/path)", "addr"},
+	}},
+	{name: "history", desc: "List ended sessions or show their logs", args: []string{"show"}},
+	{name: "load-buffer", desc: "Fill a paste buffer from a file or stdin", flags: []completionFlag{
+		{"b", "Buffer name", "name"},
+	}},
+	{name: "paste", desc: "Type a paste buffer into a session", sessions: true, flags: []completionFlag{
+		{"b", "Buffer name, the most recently written if empty", "name"},
+		{"s", "Custom socket path", "path"},
+	}},
+	{name: "buffers", desc: "List paste buffers", flags: []completionFlag{
+		{"d", "Remove this buffer", "name"},
+	}},
+	{name: "launchd", desc: "Start a session again at login (macOS)", sessions: true, args: []string{"install", "uninstall"}},
+	{name: "api", desc: "Serve the JSON-RPC management API", flags: []completionFlag{
+		{"listen", "Socket path", "path"},
+	}},
+	{name: "web", desc: "Serve a web terminal for the sessions", flags: []completionFlag{
+		{"listen", "Listen address (host:port)", "addr"},
+		{"cert", "TLS certificate file", "path"},
+		{"key", "TLS key file", "path"},
+		{"ro", "Attach all browsers read-only", ""},
+		{"reset-token", "Generate a new token", ""},
+	}},
+	{name: "selftest", desc: "Verify the client/daemon path on this machine"},
+	{name: "completion", desc: "Generate shell completion script", args: []string{"bash", "zsh", "fish"}},
+	{name: "init", desc: "Generate shell integration script", args: []string{"bash", "zsh"}},
+	{name: "help", desc: "Show help"},
+}
+
+// sessionListCommand prints the names of active sessions, one per line
+const sessionListCommand = "persishtent list -q 2>/dev/null"
+
+func (c completionCommand) names() []string {
+	return append([]string{c.name}, c.aliases...)
+}
+
+// IsCommand reports whether name is a command or alias rather than a session
+// name for the attach/start shortcut
+func IsCommand(name string) bool {
+	if name == "daemon" {
+		return true
+	}
+	for _, c := range completionCommands {
+		for _, n := range c.names() {
+			if n == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func PrintCompletionScript(shell string) {
+	switch shell {
+	case "", "bash":
+		fmt.Print(bashCompletion())
+	case "zsh":
+		fmt.Print(zshCompletion())
+	case "fish":
+		fmt.Print(fishCompletion())
+	default:
+		fmt.Printf("Unsupported shell: %s\n", shell)
+	}
+}
+
+func bashCompletion() string {
+	var b strings.Builder
+	var commands []string
+	for _, c := range completionCommands {
+		commands = append(commands, c.name)
+	}
+
+	b.WriteString("#!/bin/bash\n# Bash completion for persishtent\n\n")
+	b.WriteString("_persishtent_completions() {\n")
+	b.WriteString("\tlocal cur flags words sessions\n")
+	b.WriteString("\tCOMPREPLY=()\n")
+	b.WriteString("\tcur=\"${COMP_WORDS[COMP_CWORD]}\"\n\n")
+	b.WriteString("\tif [ \"$COMP_CWORD\" -eq 1 ]; then\n")
+	fmt.Fprintf(&b, "\t\tCOMPREPLY=( $(compgen -W \"%s\" -- \"$cur\") )\n", strings.Join(commands, " "))
+	b.WriteString("\t\treturn 0\n\tfi\n\n")
+	b.WriteString("\tcase \"${COMP_WORDS[1]}\" in\n")
+	for _, c := range completionCommands {
+		var flags []string
+		for _, f := range c.flags {
+			flags = append(flags, "-"+f.name)
+		}
+		fmt.Fprintf(&b, "\t\t%s)\n", strings.Join(c.names(), "|"))
+		fmt.Fprintf(&b, "\t\t\tflags=\"%s\"\n", strings.Join(flags, " "))
+		fmt.Fprintf(&b, "\t\t\twords=\"%s\"\n", strings.Join(c.args, " "))
+		if c.sessions {
+			b.WriteString("\t\t\tsessions=1\n")
+		}
+		b.WriteString("\t\t\t;;\n")
+	}
+	b.WriteString("\tesac\n\n")
+	b.WriteString("\tif [[ \"$cur\" == -* ]]; then\n")
+	b.WriteString("\t\tCOMPREPLY=( $(compgen -W \"$flags\" -- \"$cur\") )\n")
+	b.WriteString("\t\treturn 0\n\tfi\n")
+	b.WriteString("\tif [ -n \"$sessions\" ]; then\n")
+	fmt.Fprintf(&b, "\t\twords=\"$words $(%s)\"\n", sessionListCommand)
+	b.WriteString("\tfi\n")
+	b.WriteString("\tCOMPREPLY=( $(compgen -W \"$words\" -- \"$cur\") )\n")
+	b.WriteString("}\n\n")
+	b.WriteString("complete -F _persishtent_completions persishtent\n")
+	return b.String()
+}
+
+func zshCompletion() string {
+	var b strings.Builder
+	b.WriteString("#compdef persishtent\n# Zsh completion for persishtent\n\n")
+	b.WriteString("_persishtent_sessions() {\n")
+	b.WriteString("\tlocal -a sessions\n")
+	fmt.Fprintf(&b, "\tsessions=(${(f)\"$(%s)\"})\n", sessionListCommand)
+	b.WriteString("\t_describe 'session' sessions\n")
+	b.WriteString("}\n\n")
+	b.WriteString("_persishtent() {\n")
+	b.WriteString("\tlocal -a commands\n")
+	b.WriteString("\tcommands=(\n")
+	for _, c := range completionCommands {
+		fmt.Fprintf(&b, "\t\t'%s:%s'\n", c.name, c.desc)
+	}
+	b.WriteString("\t)\n\n")
+	b.WriteString("\tif (( CURRENT == 2 )); then\n")
+	b.WriteString("\t\t_describe 'command' commands\n")
+	b.WriteString("\t\treturn\n\tfi\n\n")
+	b.WriteString("\tlocal cmd=$words[2]\n")
+	b.WriteString("\tshift words\n")
+	b.WriteString("\t(( CURRENT-- ))\n\n")
+	b.WriteString("\tcase $cmd in\n")
+	for _, c := range completionCommands {
+		if len(c.flags) == 0 && !c.sessions && len(c.args) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "\t\t%s)\n", strings.Join(c.names(), "|"))
+		b.WriteString("\t\t\t_arguments")
+		for _, f := range c.flags {
+			if f.arg == "" {
+				fmt.Fprintf(&b, " \\\n\t\t\t\t'-%s[%s]'", f.name, f.desc)
+			} else {
+				action := " "
+				if f.arg == "path" {
+					action = "_files"
+				} else if f.arg == "dir" {
+					action = "_files -/"
+				}
+				fmt.Fprintf(&b, " \\\n\t\t\t\t'-%s[%s]:%s:%s'", f.name, f.desc, f.arg, action)
+			}
+		}
+		if c.sessions {
+			b.WriteString(" \\\n\t\t\t\t'*:session:_persishtent_sessions'")
+		} else if len(c.args) > 0 {
+			fmt.Fprintf(&b, " \\\n\t\t\t\t'1:shell:(%s)'", strings.Join(c.args, " "))
+		}
+		b.WriteString("\n\t\t\t;;\n")
+	}
+	b.WriteString("\tesac\n")
+	b.WriteString("}\n\n")
+	b.WriteString("compdef _persishtent persishtent\n")
+	return b.String()
+}
+
+func fishCompletion() string {
+	var b strings.Builder
+	b.WriteString("# Fish completion for persishtent\n\n")
+	b.WriteString("complete -c persishtent -f\n")
+	for _, c := range completionCommands {
+		fmt.Fprintf(&b, "complete -c persishtent -n __fish_use_subcommand -a %s -d '%s'\n", c.name, c.desc)
+	}
+	for _, c := range completionCommands {
+		cond := fmt.Sprintf("'__fish_seen_subcommand_from %s'", strings.Join(c.names(), " "))
+		for _, f := range c.flags {
+			extra := ""
+			if f.arg == "path" || f.arg == "dir" {
+				extra = " -r -F"
+			} else if f.arg != "" {
+				extra = " -r"
+			}
+			// Single-letter flags are short options, longer ones are old-style (-name)
+			opt := "-o"
+			if len(f.name) == 1 {
+				opt = "-s"
+			}
+			fmt.Fprintf(&b, "complete -c persishtent -n %s %s %s%s -d '%s'\n", cond, opt, f.name, extra, f.desc)
+		}
+		if c.sessions {
+			fmt.Fprintf(&b, "complete -c persishtent -n %s -a '(%s)'\n", cond, sessionListCommand)
+		}
+		if len(c.args) > 0 {
+			fmt.Fprintf(&b, "complete -c persishtent -n %s -a '%s'\n", cond, strings.Join(c.args, " "))
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,55 @@
+package cli
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestCompletionScripts(t *testing.T) {
+	scripts := map[string]string{
+		"bash": bashCompletion(),
+		"zsh":  zshCompletion(),
+		"fish": fishCompletion(),
+	}
+	for shell, script := range scripts {
+		for _, c := range completionCommands {
+			if !strings.Contains(script, c.name) {
+				t.Errorf("%s: missing command %s", shell, c.name)
+			}
+		}
+		if !strings.Contains(script, sessionListCommand) {
+			t.Errorf("%s: missing dynamic session completion", shell)
+		}
+	}
+
+	if !strings.Contains(scripts["zsh"], "'-replay-rate[") {
+		t.Error("zsh: missing attach flag completion")
+	}
+	if !strings.Contains(scripts["fish"], "'__fish_seen_subcommand_from kill k' -o signal -r") {
+		t.Error("fish: missing kill flag completion")
+	}
+}
+
+func TestIsCommand(t *testing.T) {
+	for _, name := range []string{"attach", "a", "list", "ls", "daemon"} {
+		if !IsCommand(name) {
+			t.Errorf("IsCommand(%q) = false", name)
+		}
+	}
+	if IsCommand("work") {
+		t.Error("Session names are not commands")
+	}
+}
+
+func TestBashCompletionSyntax(t *testing.T) {
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("bash not available")
+	}
+	cmd := exec.Command(bash, "-n")
+	cmd.Stdin = strings.NewReader(bashCompletion())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("bash completion has syntax errors: %v\n%s", err, out)
+	}
+}
@@ -0,0 +1,60 @@
+package cli
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"persishtent/internal/config"
+	"persishtent/internal/session"
+)
+
+// CleanCustomLogs handles the tracked logs that ended sessions kept outside
+// the state directory, of the named sessions or of all if names is empty.
+// policy is a custom_log_cleanup value: keep leaves them alone, remove
+// deletes them and ask lists them and deletes them if the user agrees, which
+// needs interactive. It returns false if removing failed.
+func CleanCustomLogs(names []string, policy string, interactive bool, in io.Reader, out io.Writer) bool {
+	if policy == config.CustomLogKeep {
+		return true
+	}
+	logs, err := session.ListExternalLogs()
+	if err != nil {
+		fmt.Fprintln(out, config.Message("error", "Err", err))
+		return false
+	}
+	if len(names) > 0 {
+		logs = slices.DeleteFunc(logs, func(l session.ExternalLog) bool {
+			return !slices.Contains(names, l.Session)
+		})
+	}
+	if len(logs) == 0 {
+		return true
+	}
+
+	if policy == config.CustomLogAsk {
+		fmt.Fprintln(out, config.Message("custom_logs", "Count", len(logs)))
+		for _, l := range logs {
+			fmt.Fprintf(out, "  %s (session '%s')\n", l.Path, l.Session)
+		}
+		if !interactive {
+			fmt.Fprintln(out, config.Message("custom_logs_hint"))
+			return true
+		}
+		fmt.Fprint(out, config.Message("custom_logs_prompt"))
+		line, _ := bufio.NewReader(in).ReadString('\n')
+		if answer := strings.ToLower(strings.TrimSpace(line)); answer != "y" && answer != "yes" {
+			return true
+		}
+	}
+
+	count, err := session.RemoveExternalLogs(logs)
+	fmt.Fprintln(out, config.Message("custom_logs_removed", "Count", count))
+	if err != nil {
+		fmt.Fprintln(out, config.Message("error", "Err", err))
+		return false
+	}
+	return true
+}
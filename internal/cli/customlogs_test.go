@@ -0,0 +1,42 @@
+package cli
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"persishtent/internal/config"
+	"persishtent/internal/session"
+)
+
+func TestCleanCustomLogs(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("PERSISHTENT_DIR", filepath.Join(home, ".persishtent"))
+	custom := filepath.Join(t.TempDir(), "build.txt")
+	_ = os.WriteFile(custom, []byte("output"), 0600)
+	if err := session.TrackExternalLogs(session.Info{Name: "build", LogPath: custom}); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	CleanCustomLogs(nil, config.CustomLogAsk, false, strings.NewReader(""), &out)
+	if !strings.Contains(out.String(), custom) || !strings.Contains(out.String(), "clean -logs") {
+		t.Errorf("Expected the log listed with a hint, got %q", out.String())
+	}
+	out.Reset()
+	CleanCustomLogs(nil, config.CustomLogAsk, true, strings.NewReader("n\n"), &out)
+	CleanCustomLogs([]string{"other"}, config.CustomLogRemove, false, nil, &out)
+	if _, err := os.Stat(custom); err != nil {
+		t.Fatalf("Log removed without consent: %v", err)
+	}
+
+	if !CleanCustomLogs([]string{"build"}, config.CustomLogAsk, true, strings.NewReader("y\n"), &out) {
+		t.Error("CleanCustomLogs failed")
+	}
+	if _, err := os.Stat(custom); !os.IsNotExist(err) {
+		t.Errorf("Expected the log removed after agreeing, got %q", out.String())
+	}
+}
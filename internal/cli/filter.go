@@ -0,0 +1,98 @@
+package cli
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"persishtent/internal/session"
+)
+
+// ListSorts are the orders list can print sessions in
+var ListSorts = []string{"name", "uptime", "activity"}
+
+// ListFilter selects sessions by one of their fields, see ParseListFilter
+type ListFilter struct {
+	key   string
+	value string
+	re    *regexp.Regexp // Set for key~regex, nil for key=value
+}
+
+// listFilterKeys are the fields a ListFilter can look at
+var listFilterKeys = []string{"name", "tag", "group", "cmd", "host", "profile", "cwd"}
+
+// ParseListFilter parses a filter of the form key=value, which matches the
+// value exactly, or key~regex. Key is one of name, tag, group, cmd, host,
+// profile or cwd; a tag filter matches if any of the session's tags does.
+func ParseListFilter(s string) (ListFilter, error) {
+	i := strings.IndexAny(s, "=~")
+	if i < 0 {
+		return ListFilter{}, fmt.Errorf("invalid filter %q: expected key=value or key~regex", s)
+	}
+	f := ListFilter{key: s[:i], value: s[i+1:]}
+	if !slices.Contains(listFilterKeys, f.key) {
+		return ListFilter{}, fmt.Errorf("invalid filter %q: key must be one of %s", s, strings.Join(listFilterKeys, ", "))
+	}
+	if s[i] == '~' {
+		re, err := regexp.Compile(f.value)
+		if err != nil {
+			return ListFilter{}, fmt.Errorf("invalid filter %q: %w", s, err)
+		}
+		f.re = re
+	}
+	return f, nil
+}
+
+// Match reports whether the session passes the filter
+func (f ListFilter) Match(s session.Details) bool {
+	var values []string
+	switch f.key {
+	case "name":
+		values = []string{s.Name}
+	case "tag":
+		values = s.Tags
+	case "group":
+		values = []string{s.Group}
+	case "cmd":
+		values = []string{s.Command}
+	case "host":
+		values = []string{s.Host}
+	case "profile":
+		values = []string{s.Profile}
+	case "cwd":
+		values = []string{s.Cwd}
+	}
+	for _, v := range values {
+		if f.re != nil && f.re.MatchString(v) || f.re == nil && v == f.value {
+			return true
+		}
+	}
+	return false
+}
+
+// matchListFilters returns the sessions passing all filters
+func matchListFilters(sessions []session.Details, filters []ListFilter) []session.Details {
+	var kept []session.Details
+	for _, s := range sessions {
+		if !slices.ContainsFunc(filters, func(f ListFilter) bool { return !f.Match(s) }) {
+			kept = append(kept, s)
+		}
+	}
+	return kept
+}
+
+// sortSessions orders sessions by name, by uptime (longest running first)
+// or by activity (most recent output first, sessions without a log last).
+// Ties keep the order of the state directory.
+func sortSessions(sessions []session.Details, by string) {
+	switch by {
+	case "name":
+		sort.SliceStable(sessions, func(i, j int) bool { return sessions[i].Name < sessions[j].Name })
+	case "uptime":
+		sort.SliceStable(sessions, func(i, j int) bool { return sessions[i].StartTime.Before(sessions[j].StartTime) })
+	case "activity":
+		sort.SliceStable(sessions, func(i, j int) bool { return sessions[i].LastOutput.After(sessions[j].LastOutput) })
+	}
+}
@@ -0,0 +1,64 @@
+package cli
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"persishtent/internal/session"
+)
+
+func TestListFilter(t *testing.T) {
+	build := session.Details{Info: session.Info{Name: "build", Command: "/bin/bash", Tags: []string{"ci", "work"}, Group: "dev"}}
+	vim := session.Details{Info: session.Info{Name: "vim", Command: "nvim main.go"}}
+
+	tests := []struct {
+		filter string
+		want   []string
+	}{
+		{"tag=work", []string{"build"}},
+		{"tag=wor", nil},
+		{"tag~^w", []string{"build"}},
+		{"cmd~vim", []string{"vim"}},
+		{"group=dev", []string{"build"}},
+		{"name~.", []string{"build", "vim"}},
+	}
+	for _, tt := range tests {
+		f, err := ParseListFilter(tt.filter)
+		if err != nil {
+			t.Fatalf("ParseListFilter(%q) failed: %v", tt.filter, err)
+		}
+		var got []string
+		for _, s := range matchListFilters([]session.Details{build, vim}, []ListFilter{f}) {
+			got = append(got, s.Name)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%q matched %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"work", "color=red", "cmd~("} {
+		if _, err := ParseListFilter(bad); err == nil {
+			t.Errorf("ParseListFilter(%q) should fail", bad)
+		}
+	}
+}
+
+func TestSortSessions(t *testing.T) {
+	now := time.Now()
+	sessions := []session.Details{
+		{Info: session.Info{Name: "b", StartTime: now.Add(-time.Hour)}, LastOutput: now.Add(-time.Minute)},
+		{Info: session.Info{Name: "c", StartTime: now}},
+		{Info: session.Info{Name: "a", StartTime: now.Add(-time.Minute)}, LastOutput: now},
+	}
+	for by, want := range map[string]string{"name": "abc", "uptime": "bac", "activity": "abc"} {
+		sortSessions(sessions, by)
+		got := ""
+		for _, s := range sessions {
+			got += s.Name
+		}
+		if got != want {
+			t.Errorf("Sorted by %s: got %s, want %s", by, got, want)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package cli
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+
+	"persishtent/internal/session"
+)
+
+// fuzzyScore reports whether all characters of pattern appear in text in
+// order (case-insensitive) and scores the match. Consecutive characters and
+// matches at word starts score higher.
+func fuzzyScore(pattern, text string) (int, bool) {
+	if pattern == "" {
+		return 0, true
+	}
+	p := []rune(strings.ToLower(pattern))
+	t := []rune(strings.ToLower(text))
+
+	score := 0
+	pi := 0
+	prevMatch := -2
+	for ti := 0; ti < len(t) && pi < len(p); ti++ {
+		if t[ti] != p[pi] {
+			continue
+		}
+		score++
+		if ti == prevMatch+1 {
+			score += 2
+		}
+		if ti == 0 || !unicode.IsLetter(t[ti-1]) && !unicode.IsDigit(t[ti-1]) {
+			score += 3
+		}
+		prevMatch = ti
+		pi++
+	}
+	if pi < len(p) {
+		return 0, false
+	}
+	// Prefer shorter texts for equal matches
+	return score*100 - len(t), true
+}
+
+// filterSessions returns the sessions whose name, command, group or tags fuzzily
+// match the pattern, best matches first.
+func filterSessions(sessions []session.Info, pattern string) []session.Info {
+	type scored struct {
+		info  session.Info
+		score int
+	}
+	var matches []scored
+	for _, s := range sessions {
+		best, found := 0, false
+		for _, field := range append([]string{s.Name, s.Command, s.Group}, s.Tags...) {
+			if score, ok := fuzzyScore(pattern, field); ok && (!found || score > best) {
+				best, found = score, true
+			}
+		}
+		if found {
+			matches = append(matches, scored{s, best})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].score > matches[j].score
+	})
+
+	result := make([]session.Info, len(matches))
+	for i, m := range matches {
+		result[i] = m.info
+	}
+	return result
+}
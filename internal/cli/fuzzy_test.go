@@ -0,0 +1,46 @@
+package cli
+
+import (
+	"testing"
+
+	"persishtent/internal/session"
+)
+
+func TestFuzzyScore(t *testing.T) {
+	if _, ok := fuzzyScore("wbs", "web-server"); !ok {
+		t.Error("Expected subsequence to match")
+	}
+	if _, ok := fuzzyScore("xyz", "web-server"); ok {
+		t.Error("Expected non-subsequence not to match")
+	}
+	if _, ok := fuzzyScore("WEB", "web"); !ok {
+		t.Error("Expected case-insensitive match")
+	}
+	prefix, _ := fuzzyScore("web", "web-server")
+	scattered, _ := fuzzyScore("web", "a-wide-bear")
+	if prefix <= scattered {
+		t.Errorf("Expected consecutive prefix match to score higher (%d <= %d)", prefix, scattered)
+	}
+}
+
+func TestFilterSessions(t *testing.T) {
+	sessions := []session.Info{
+		{Name: "api", Command: "bash"},
+		{Name: "db", Command: "psql", Tags: []string{"prod"}},
+		{Name: "web", Command: "npm run dev"},
+	}
+
+	if got := filterSessions(sessions, ""); len(got) != 3 {
+		t.Errorf("Empty filter should keep all sessions, got %d", len(got))
+	}
+
+	got := filterSessions(sessions, "prod")
+	if len(got) != 1 || got[0].Name != "db" {
+		t.Errorf("Expected tag match on db, got %v", got)
+	}
+
+	got = filterSessions(sessions, "npm")
+	if len(got) != 1 || got[0].Name != "web" {
+		t.Errorf("Expected command match on web, got %v", got)
+	}
+}
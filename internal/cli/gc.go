@@ -0,0 +1,116 @@
+package cli
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"syscall"
+	"time"
+
+	"persishtent/internal/client"
+	"persishtent/internal/config"
+	"persishtent/internal/session"
+)
+
+// orphanMinAge keeps gc away from daemons that were just spawned and haven't
+// written their session info yet.
+const orphanMinAge = 3 * time.Second
+
+// GC actions, chosen by flag or answered per daemon
+const (
+	gcKill     = "kill"
+	gcRegister = "register"
+)
+
+// GC finds daemons whose session files are gone, e.g. after the state
+// directory was deleted, which hides them from every other command. Each is
+// killed or registered again according to action; without one, the user is
+// asked if interactive is set, otherwise the daemons are only listed. It
+// returns false if handling any daemon failed.
+func GC(action string, interactive bool, in io.Reader, out io.Writer) bool {
+	daemons, err := session.Daemons()
+	if err != nil {
+		fmt.Fprintln(out, config.Message("error", "Err", err))
+		return false
+	}
+	sessions, err := session.List()
+	if err != nil {
+		fmt.Fprintln(out, config.Message("error", "Err", err))
+		return false
+	}
+	found := orphans(daemons, knownDaemons(sessions))
+	if len(found) == 0 {
+		fmt.Fprintln(out, config.Message("gc_none"))
+		return true
+	}
+
+	ok := true
+	answers := bufio.NewReader(in)
+	for _, d := range found {
+		desc := fmt.Sprintf("daemon %d (session '%s', up %s)", d.PID, d.Name, d.Age.Round(time.Second))
+		choice := action
+		if choice == "" && interactive {
+			fmt.Fprint(out, config.Message("gc_prompt", "Daemon", desc))
+			line, _ := answers.ReadString('\n')
+			switch strings.ToLower(strings.TrimSpace(line)) {
+			case "k", "kill":
+				choice = gcKill
+			case "r", "register":
+				choice = gcRegister
+			}
+		}
+
+		switch choice {
+		case gcKill:
+			// The daemon terminates its shell gracefully on SIGTERM
+			if err := syscall.Kill(d.PID, syscall.SIGTERM); err != nil {
+				fmt.Fprintln(out, config.Message("gc_kill_failed", "Daemon", desc, "Err", err))
+				ok = false
+				continue
+			}
+			fmt.Fprintln(out, config.Message("gc_killed", "Daemon", desc))
+		case gcRegister:
+			if err := client.Register(d.Name, d.SockPath); err != nil {
+				fmt.Fprintln(out, config.Message("gc_register_failed", "Daemon", desc, "Err", err))
+				ok = false
+				continue
+			}
+			fmt.Fprintln(out, config.Message("gc_registered", "Name", d.Name))
+		default:
+			if !interactive {
+				fmt.Fprintln(out, config.Message("gc_orphan", "Daemon", desc))
+			}
+		}
+	}
+	if action == "" && !interactive {
+		fmt.Fprintln(out, config.Message("gc_hint"))
+	}
+	return ok
+}
+
+// knownDaemons returns the PIDs of the daemons serving sessions: the parents
+// of their shells, or the session PID itself for serial consoles and daemons
+// still waiting for preconditions.
+func knownDaemons(sessions []session.Info) map[int]bool {
+	known := make(map[int]bool)
+	for _, s := range sessions {
+		known[s.PID] = true
+		if ppid, err := session.ProcParent(s.PID); err == nil {
+			known[ppid] = true
+		}
+	}
+	return known
+}
+
+// orphans returns the daemons that serve no known session and are old
+// enough to have registered one.
+func orphans(daemons []session.Daemon, known map[int]bool) []session.Daemon {
+	var found []session.Daemon
+	for _, d := range daemons {
+		if !known[d.PID] && d.Age >= orphanMinAge {
+			found = append(found, d)
+		}
+	}
+	return found
+}
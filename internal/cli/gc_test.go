@@ -0,0 +1,20 @@
+package cli
+
+import (
+	"testing"
+	"time"
+
+	"persishtent/internal/session"
+)
+
+func TestOrphans(t *testing.T) {
+	daemons := []session.Daemon{
+		{PID: 10, Name: "known", Age: time.Hour},
+		{PID: 20, Name: "orphan", Age: time.Hour},
+		{PID: 30, Name: "starting", Age: time.Second},
+	}
+	found := orphans(daemons, map[int]bool{10: true, 11: true})
+	if len(found) != 1 || found[0].Name != "orphan" {
+		t.Errorf("orphans = %+v, want only the orphan", found)
+	}
+}
@@ -0,0 +1,87 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"time"
+
+	"persishtent/internal/config"
+	"persishtent/internal/session"
+)
+
+// HistoryCommand lists the ended sessions kept in the history, or shows the
+// transcript of one with show. It returns false on errors.
+func HistoryCommand(args []string) bool {
+	usage := "Usage: persishtent history [show [-since time] <name>]"
+	if len(args) == 0 {
+		return listHistory()
+	}
+	if args[0] != "show" {
+		fmt.Println(usage)
+		return false
+	}
+	showCmd := flag.NewFlagSet("history show", flag.ExitOnError)
+	sinceFlag := showCmd.String("since", "", "Only show output since a duration ago or a time, e.g. 1h or \"2006-01-02 15:04\"")
+	_ = showCmd.Parse(args[1:])
+	if showCmd.NArg() != 1 {
+		fmt.Println(usage)
+		return false
+	}
+	var since time.Time
+	if *sinceFlag != "" {
+		var err error
+		if since, err = ParseSince(*sinceFlag); err != nil {
+			fmt.Println(config.Message("error", "Err", err))
+			return false
+		}
+	}
+	return showHistory(showCmd.Arg(0), since)
+}
+
+// listHistory prints the ended sessions, most recently ended first
+func listHistory() bool {
+	entries, err := session.ListHistory()
+	if err != nil {
+		fmt.Println(config.Message("history_failed", "Err", err))
+		return false
+	}
+	if len(entries) == 0 {
+		fmt.Println(config.Message("no_history"))
+		return true
+	}
+	fmt.Println(config.Message("history_header"))
+	for _, e := range entries {
+		up := e.Ended.Sub(e.StartTime).Round(time.Second)
+		fmt.Printf("  %s (%s, ended: %s, cmd: %s, up: %s)\n", e.ID, describeExit(e.Info), e.Ended.Format("2006-01-02 15:04:05"), e.Command, up)
+	}
+	return true
+}
+
+// describeExit tells how the command of an ended session exited
+func describeExit(info session.Info) string {
+	if info.ExitCode == nil {
+		return "exit status unknown"
+	}
+	return "exit status " + strconv.Itoa(*info.ExitCode)
+}
+
+// showHistory prints the transcript of an ended session
+func showHistory(name string, since time.Time) bool {
+	entry, ok := session.FindHistory(name)
+	if !ok {
+		fmt.Println(config.Message("history_not_found", "Name", name))
+		return false
+	}
+	segments, err := entry.LogSegments()
+	if err != nil {
+		fmt.Println(config.Message("logs_failed", "Err", err))
+		return false
+	}
+	if len(segments) == 0 {
+		fmt.Println(config.Message("no_logs", "Name", name))
+		return false
+	}
+	printSegments(segments, since, 0)
+	return true
+}
@@ -0,0 +1,103 @@
+package cli
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+
+	"persishtent/internal/client"
+	"persishtent/internal/config"
+	"persishtent/internal/session"
+)
+
+// killWorkers bounds the number of sessions kill -a signals at once, so that
+// a burst of exiting shells doesn't overwhelm the machine.
+const killWorkers = 8
+
+// killGrace is added to the kill timeout before a session counts as timed out,
+// leaving time for the escalation to SIGKILL.
+const killGrace = 2 * time.Second
+
+// killSummary counts the outcomes of kill -a
+type killSummary struct {
+	killed, failed, timedOut int
+}
+
+// KillAll kills all sessions in parallel and prints a summary. It returns
+// false if any session failed or timed out.
+func KillAll(sig syscall.Signal, timeout time.Duration) bool {
+	sessions, err := session.List()
+	if err != nil {
+		fmt.Println(config.Message("error", "Err", err))
+		return false
+	}
+	if len(sessions) == 0 {
+		fmt.Println(config.Message("no_sessions"))
+		return true
+	}
+	names := make([]string, len(sessions))
+	for i, s := range sessions {
+		names[i] = s.Name
+	}
+
+	deadline := killGrace
+	if sig != syscall.SIGKILL {
+		deadline += timeout
+	}
+	sum := killAll(names, func(name string) error {
+		return client.Kill(name, "", sig, timeout)
+	}, deadline, "session_killed", "kill_failed")
+	fmt.Println(config.Message("kill_summary", "Killed", sum.killed, "Failed", sum.failed, "TimedOut", sum.timedOut))
+	return sum.failed == 0 && sum.timedOut == 0
+}
+
+// killAll runs kill for each session on a pool of workers, giving up on
+// sessions that take longer than deadline. Each outcome is reported with the
+// message doneMsg or failedMsg.
+func killAll(names []string, kill func(string) error, deadline time.Duration, doneMsg, failedMsg string) killSummary {
+	var (
+		mu  sync.Mutex
+		sum killSummary
+		wg  sync.WaitGroup
+	)
+	jobs := make(chan string)
+	for i := 0; i < killWorkers && i < len(names); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range jobs {
+				done := make(chan error, 1)
+				go func() { done <- kill(name) }()
+
+				var err error
+				timedOut := false
+				select {
+				case err = <-done:
+				case <-time.After(deadline):
+					timedOut = true
+				}
+
+				mu.Lock()
+				switch {
+				case timedOut:
+					sum.timedOut++
+					fmt.Println(config.Message("kill_timeout", "Name", name, "Timeout", deadline))
+				case err != nil:
+					sum.failed++
+					fmt.Println(config.Message(failedMsg, "Name", name, "Err", err))
+				default:
+					sum.killed++
+					fmt.Println(config.Message(doneMsg, "Name", name))
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, name := range names {
+		jobs <- name
+	}
+	close(jobs)
+	wg.Wait()
+	return sum
+}
@@ -0,0 +1,51 @@
+package cli
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestKillAll(t *testing.T) {
+	var running, peak atomic.Int32
+	kill := func(name string) error {
+		if name == "stuck" {
+			// Abandoned after the deadline, so it doesn't hold a worker
+			time.Sleep(time.Second)
+			return nil
+		}
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		switch name {
+		case "broken":
+			return errors.New("connection refused")
+		default:
+			time.Sleep(50 * time.Millisecond)
+		}
+		return nil
+	}
+
+	names := []string{"broken", "stuck"}
+	for i := 0; i < 30; i++ {
+		names = append(names, "s")
+	}
+	start := time.Now()
+	sum := killAll(names, kill, 200*time.Millisecond, "session_killed", "kill_failed")
+	if sum != (killSummary{killed: 30, failed: 1, timedOut: 1}) {
+		t.Errorf("Unexpected summary %+v", sum)
+	}
+	if p := peak.Load(); p > killWorkers {
+		t.Errorf("%d kills ran at once, limit is %d", p, killWorkers)
+	}
+	// Sequential kills would take at least 1.5s
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Kills not parallel, took %s", elapsed)
+	}
+}
@@ -0,0 +1,182 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"persishtent/internal/config"
+	"persishtent/internal/server"
+	"persishtent/internal/session"
+)
+
+// launchdLabel returns the label of the LaunchAgent of session name
+func launchdLabel(name string) string {
+	return "com.persishtent." + name
+}
+
+// launchAgentPath returns where the LaunchAgent of session name is installed
+func launchAgentPath(name string) (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, "Library", "LaunchAgents", launchdLabel(name)+".plist"), nil
+}
+
+// launchdArgs returns the start command that recreates the session of info
+// with the options it was started with.
+func launchdArgs(exe string, info session.Info) []string {
+	args := []string{exe, "start", "-d"}
+	if info.Profile != "" {
+		args = append(args, "-profile", info.Profile)
+	}
+	if len(info.Argv) == 0 && info.Command != "" && info.Command != strings.Join(server.ShellArgs(""), " ") {
+		args = append(args, "-c", info.Command)
+	}
+	if info.Socket != "" {
+		args = append(args, "-s", info.Socket)
+	}
+	if info.StartDir != "" {
+		args = append(args, "-cwd", info.StartDir)
+	}
+	if len(info.Tags) > 0 {
+		args = append(args, "-tag", strings.Join(info.Tags, ","))
+	}
+	if info.Exclusive {
+		args = append(args, "-exclusive")
+	}
+	if info.Banner != "" {
+		args = append(args, "-banner", info.Banner)
+	}
+	if info.Umask != "" {
+		args = append(args, "-umask", info.Umask)
+	}
+	if info.Locale != "" {
+		args = append(args, "-locale", info.Locale)
+	}
+	if info.TZ != "" {
+		args = append(args, "-tz", info.TZ)
+	}
+	args = append(args, info.Name)
+	if len(info.Argv) > 0 {
+		args = append(append(args, "--"), info.Argv...)
+	}
+	return args
+}
+
+// launchdPlist renders a LaunchAgent that runs args once at login. The daemon
+// outlives the start command, so launchd must not kill its process group,
+// and ProcessType Interactive keeps App Nap from throttling it.
+func launchdPlist(label string, args []string, env map[string]string) string {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+`)
+	fmt.Fprintf(&b, "\t<key>Label</key>\n\t<string>%s</string>\n", html.EscapeString(label))
+	b.WriteString("\t<key>ProgramArguments</key>\n\t<array>\n")
+	for _, arg := range args {
+		fmt.Fprintf(&b, "\t\t<string>%s</string>\n", html.EscapeString(arg))
+	}
+	b.WriteString("\t</array>\n")
+	if len(env) > 0 {
+		keys := make([]string, 0, len(env))
+		for key := range env {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		b.WriteString("\t<key>EnvironmentVariables</key>\n\t<dict>\n")
+		for _, key := range keys {
+			fmt.Fprintf(&b, "\t\t<key>%s</key>\n\t\t<string>%s</string>\n", html.EscapeString(key), html.EscapeString(env[key]))
+		}
+		b.WriteString("\t</dict>\n")
+	}
+	b.WriteString(`	<key>RunAtLoad</key>
+	<true/>
+	<key>AbandonProcessGroup</key>
+	<true/>
+	<key>ProcessType</key>
+	<string>Interactive</string>
+</dict>
+</plist>
+`)
+	return b.String()
+}
+
+// launchdEnv returns the environment the LaunchAgent needs to start the
+// session like this shell would: launchd's PATH is minimal, and a custom
+// state directory must be found again.
+func launchdEnv() map[string]string {
+	env := make(map[string]string)
+	for _, key := range []string{"PATH", "PERSISHTENT_DIR", "XDG_STATE_HOME", "XDG_RUNTIME_DIR"} {
+		if value := os.Getenv(key); value != "" {
+			env[key] = value
+		}
+	}
+	return env
+}
+
+// LaunchdCommand installs or removes the LaunchAgent that starts a session
+// again at login, e.g. after a reboot.
+func LaunchdCommand(args []string) bool {
+	usage := "Usage: persishtent launchd install|uninstall <name>"
+	if len(args) != 2 || (args[0] != "install" && args[0] != "uninstall") {
+		fmt.Println(usage)
+		return false
+	}
+	if runtime.GOOS != "darwin" {
+		fmt.Println(config.Message("launchd_unsupported"))
+		return false
+	}
+	name := args[1]
+	path, err := launchAgentPath(name)
+	if err != nil {
+		fmt.Println(config.Message("error", "Err", err))
+		return false
+	}
+
+	if args[0] == "uninstall" {
+		if err := os.Remove(path); errors.Is(err, os.ErrNotExist) {
+			fmt.Println(config.Message("launchd_missing", "Name", name))
+			return false
+		} else if err != nil {
+			fmt.Println(config.Message("error", "Err", err))
+			return false
+		}
+		fmt.Println(config.Message("launchd_uninstalled", "Name", name))
+		return true
+	}
+
+	info, err := session.ReadInfo(name)
+	if err != nil || !info.IsLocal() {
+		fmt.Println(config.Message("session_not_found", "Name", name))
+		return false
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Println(config.Message("error", "Err", err))
+		return false
+	}
+	if len(info.Env) > 0 {
+		// Values of -e aren't recorded, so they can't be restored
+		fmt.Println(config.Message("launchd_env_dropped", "Names", strings.Join(info.Env, ", ")))
+	}
+	plist := launchdPlist(launchdLabel(name), launchdArgs(exe, info), launchdEnv())
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		fmt.Println(config.Message("error", "Err", err))
+		return false
+	}
+	if err := os.WriteFile(path, []byte(plist), 0644); err != nil {
+		fmt.Println(config.Message("error", "Err", err))
+		return false
+	}
+	fmt.Println(config.Message("launchd_installed", "Name", name, "Path", shortenHome(path)))
+	return true
+}
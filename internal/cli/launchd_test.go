@@ -0,0 +1,45 @@
+package cli
+
+import (
+	"strings"
+	"testing"
+
+	"persishtent/internal/server"
+	"persishtent/internal/session"
+)
+
+func TestLaunchdArgs(t *testing.T) {
+	shell := strings.Join(server.ShellArgs(""), " ")
+	tests := []struct {
+		info session.Info
+		want string
+	}{
+		{session.Info{Name: "web", Command: shell}, "/bin/persishtent start -d web"},
+		{session.Info{Name: "db", Command: "top -d 5", StartDir: "/srv", Tags: []string{"prod", "db"}, TZ: "UTC"},
+			"/bin/persishtent start -d -c 'top -d 5' -cwd /srv -tag prod,db -tz UTC db"},
+		{session.Info{Name: "dev", Command: shell, Profile: "go", Exclusive: true}, "/bin/persishtent start -d -profile go -exclusive dev"},
+		// Only the names of -e variables are recorded, so they are left out
+		{session.Info{Name: "api", Command: shell, Env: []string{"PORT", "DSN"}}, "/bin/persishtent start -d api"},
+		{session.Info{Name: "job", Command: "sleep 'a b'", Argv: []string{"sleep", "a b"}}, "/bin/persishtent start -d job -- sleep 'a b'"},
+	}
+	for _, tt := range tests {
+		if got := shellJoin(launchdArgs("/bin/persishtent", tt.info)); got != tt.want {
+			t.Errorf("launchdArgs(%s) = %q, want %q", tt.info.Name, got, tt.want)
+		}
+	}
+}
+
+func TestLaunchdPlist(t *testing.T) {
+	plist := launchdPlist(launchdLabel("web"), []string{"/bin/persishtent", "start", "-d", "-c", "a && b", "web"}, map[string]string{"PATH": "/usr/bin"})
+	for _, want := range []string{
+		"<string>com.persishtent.web</string>",
+		"<string>a &amp;&amp; b</string>",
+		"<key>PATH</key>\n\t\t<string>/usr/bin</string>",
+		"<key>RunAtLoad</key>\n\t<true/>",
+		"<key>AbandonProcessGroup</key>\n\t<true/>",
+	} {
+		if !strings.Contains(plist, want) {
+			t.Errorf("Plist lacks %q:\n%s", want, plist)
+		}
+	}
+}
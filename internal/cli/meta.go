@@ -0,0 +1,55 @@
+package cli
+
+import (
+	"fmt"
+	"strings"
+
+	"persishtent/internal/client"
+	"persishtent/internal/config"
+	"persishtent/internal/session"
+)
+
+// ChangeMeta applies change to all sessions whose name matches the glob
+// pattern. Each daemon updates its own session info. It returns false if no
+// session matched or any update failed.
+func ChangeMeta(pattern string, change session.MetaChange) bool {
+	sessions, err := session.List()
+	if err != nil {
+		fmt.Println(config.Message("error", "Err", err))
+		return false
+	}
+	matched, err := session.Match(sessions, pattern)
+	if err != nil {
+		fmt.Println(config.Message("error", "Err", err))
+		return false
+	}
+	if len(matched) == 0 {
+		fmt.Println(config.Message("no_match", "Pattern", pattern))
+		return false
+	}
+
+	ok := true
+	for _, s := range matched {
+		if err := client.ChangeMeta(s.Name, "", change); err != nil {
+			fmt.Println(config.Message("update_failed", "Name", s.Name, "Err", err))
+			ok = false
+			continue
+		}
+		updated := s
+		change.Apply(&updated)
+		fmt.Println(config.Message("session_updated", "Name", s.Name, "Change", describeMeta(updated)))
+	}
+	return ok
+}
+
+// describeMeta summarizes the tags and group of a session
+func describeMeta(info session.Info) string {
+	tags := "no tags"
+	if len(info.Tags) > 0 {
+		tags = "tags: " + strings.Join(info.Tags, ",")
+	}
+	if info.Group == "" {
+		return tags + ", no group"
+	}
+	return tags + ", group: " + info.Group
+}
@@ -0,0 +1,68 @@
+package cli
+
+import (
+	"io"
+	"os"
+	"strings"
+
+	"persishtent/internal/ansi"
+	"persishtent/internal/client"
+	"persishtent/internal/session"
+)
+
+// previewLines is the number of output lines SelectSession shows for the
+// session under the cursor
+const previewLines = 5
+
+// previewTailSize is how much of the end of a log without an integrity
+// index is read for a preview
+const previewTailSize = 16 * 1024
+
+// sessionPreview returns the last n lines of a session's output as plain
+// text of at most cols columns. The output comes from the newest non-empty
+// log file, or from the daemon's screen for sessions without logs.
+func sessionPreview(name string, n, cols int) []string {
+	data := logTail(name, n)
+	if data == nil {
+		screen, err := client.Capture(name, "", 0)
+		if err != nil {
+			return nil
+		}
+		data = []byte(strings.ReplaceAll(screen, "\n", "\r\n"))
+	}
+	// Rendering the output drops escape sequences and applies overwrites
+	screen := ansi.NewScreen(n, cols, n)
+	_, _ = screen.Write(ansi.StripGraphics(ansi.TrimPartialString(data)))
+	lines := screen.Lines(n)
+	return lines[max(len(lines)-n, 0):]
+}
+
+// logTail returns the end of the session's log with at least its last n
+// lines, or nil if it has no log output
+func logTail(name string, n int) []byte {
+	files, err := session.GetLogFiles(name)
+	if err != nil {
+		return nil
+	}
+	for i := len(files) - 1; i >= 0; i-- {
+		if data, ok := session.ReadTail(files[i], n, nil); ok && len(data) > 0 {
+			return data
+		}
+		f, err := os.Open(files[i])
+		if err != nil {
+			continue
+		}
+		fi, err := f.Stat()
+		if err == nil && fi.Size() > 0 {
+			start := max(fi.Size()-previewTailSize, 0)
+			data, err := io.ReadAll(io.NewSectionReader(f, start, fi.Size()-start))
+			_ = f.Close()
+			if err == nil {
+				return data[session.TailStart(data, n):]
+			}
+			continue
+		}
+		_ = f.Close()
+	}
+	return nil
+}
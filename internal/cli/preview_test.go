@@ -0,0 +1,34 @@
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"persishtent/internal/session"
+)
+
+func TestSessionPreview(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("PERSISHTENT_DIR", t.TempDir())
+	dir, _ := session.EnsureDir()
+
+	// The active log just rotated, so the preview comes from the rotated one
+	output := "one\r\ntwo\r\n\x1b[31mred\x1b[0m\r\nprogress 10%\rprogress 100%\r\nthis line is too long\r\n"
+	_ = os.WriteFile(filepath.Join(dir, "build.log.1"), []byte(output), 0600)
+	_ = os.WriteFile(filepath.Join(dir, "build.log"), nil, 0600)
+
+	got := sessionPreview("build", 3, 40)
+	if want := "red|progress 100%|this line is too long"; strings.Join(got, "|") != want {
+		t.Errorf("Preview = %q, want %q", got, want)
+	}
+
+	// Lines wider than the preview wrap like in a terminal
+	if got := sessionPreview("build", 2, 12); strings.Join(got, "|") != "this line is| too long" {
+		t.Errorf("Unexpected narrow preview %q", got)
+	}
+	if got := sessionPreview("missing", 3, 40); len(got) != 0 {
+		t.Errorf("Expected no preview without logs or daemon, got %q", got)
+	}
+}
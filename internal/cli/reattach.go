@@ -0,0 +1,131 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"persishtent/internal/config"
+	"persishtent/internal/session"
+)
+
+// restoreArgs builds the command that attaches to a's session again in a new
+// window of the terminal it was attached from. Unknown terminals get a plain
+// attach, to be run in a window of the user's choice.
+func restoreArgs(a session.Attachment) []string {
+	attach := []string{"persishtent", "attach"}
+	if a.ReadOnly {
+		attach = append(attach, "-ro")
+	}
+	attach = append(attach, a.Session)
+	command := strings.Join(attach, " ")
+
+	switch a.Terminal {
+	case session.TerminalTmux:
+		return append([]string{"tmux", "new-window", "-n", a.Session}, attach...)
+	case session.TerminalWezTerm:
+		return append([]string{"wezterm", "cli", "spawn", "--new-window", "--"}, attach...)
+	case session.TerminalKitty:
+		return append([]string{"kitty", "@", "launch", "--type=os-window"}, attach...)
+	case session.TerminalITerm:
+		return []string{"osascript", "-e", `tell application "iTerm2" to create window with default profile command "` + command + `"`}
+	case session.TerminalAppleTerminal:
+		return []string{"osascript", "-e", `tell application "Terminal" to do script "` + command + `"`}
+	}
+	return attach
+}
+
+var shellSafe = regexp.MustCompile(`^[a-zA-Z0-9_@%+=:,./-]+$`)
+
+// shellJoin quotes args for a POSIX shell
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if shellSafe.MatchString(arg) {
+			quoted[i] = arg
+		} else {
+			quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+// restorable returns the attachments of layout whose sessions still run
+// here. Attachments whose client still runs are left out of the recorded
+// layout, as they need no restoring; a saved layout restores all.
+func restorable(l session.Layout, saved bool) []session.Attachment {
+	var list []session.Attachment
+	for _, a := range l.Attachments {
+		if !saved && session.IsPIDAlive(a.PID) {
+			continue
+		}
+		info, err := session.ReadInfo(a.Session)
+		if err != nil || !info.IsLocal() || !info.IsAlive() {
+			continue
+		}
+		list = append(list, a)
+	}
+	return list
+}
+
+// ReattachAll prints the commands restoring the attachments of terminal
+// windows that are gone, or runs them if execute is set. With layoutPath the
+// attachments come from a layout saved with save instead. It returns false
+// if a command failed.
+func ReattachAll(layoutPath string, save bool, execute bool) bool {
+	recorded, err := session.GetLayoutPath()
+	if err != nil {
+		fmt.Println(config.Message("error", "Err", err))
+		return false
+	}
+
+	if save {
+		l, err := session.ReadLayout(recorded)
+		if err != nil {
+			fmt.Println(config.Message("error", "Err", err))
+			return false
+		}
+		l.Attachments = restorable(l, true)
+		if err := session.WriteLayout(layoutPath, l); err != nil {
+			fmt.Println(config.Message("error", "Err", err))
+			return false
+		}
+		fmt.Println(config.Message("layout_saved", "Count", len(l.Attachments), "Path", layoutPath))
+		return true
+	}
+
+	path := recorded
+	if layoutPath != "" {
+		path = layoutPath
+	}
+	l, err := session.ReadLayout(path)
+	if err != nil {
+		fmt.Println(config.Message("error", "Err", err))
+		return false
+	}
+	list := restorable(l, layoutPath != "")
+	if len(list) == 0 {
+		fmt.Println(config.Message("reattach_none"))
+		return true
+	}
+
+	ok := true
+	for _, a := range list {
+		args := restoreArgs(a)
+		// A plain attach would take over this terminal, so it is only printed
+		if !execute || a.Terminal == "" {
+			fmt.Println(shellJoin(args))
+			continue
+		}
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			fmt.Println(config.Message("reattach_failed", "Name", a.Session, "Err", err))
+			ok = false
+		}
+	}
+	return ok
+}
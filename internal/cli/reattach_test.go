@@ -0,0 +1,31 @@
+package cli
+
+import (
+	"testing"
+
+	"persishtent/internal/session"
+)
+
+func TestRestoreArgs(t *testing.T) {
+	tests := []struct {
+		a    session.Attachment
+		want string
+	}{
+		{session.Attachment{Session: "web"}, "persishtent attach web"},
+		{session.Attachment{Session: "web", ReadOnly: true, Terminal: session.TerminalTmux}, "tmux new-window -n web persishtent attach -ro web"},
+		{session.Attachment{Session: "db", Terminal: session.TerminalWezTerm}, "wezterm cli spawn --new-window -- persishtent attach db"},
+		{session.Attachment{Session: "db", Terminal: session.TerminalKitty}, "kitty @ launch --type=os-window persishtent attach db"},
+		{session.Attachment{Session: "db", Terminal: session.TerminalAppleTerminal}, `osascript -e 'tell application "Terminal" to do script "persishtent attach db"'`},
+	}
+	for _, tt := range tests {
+		if got := shellJoin(restoreArgs(tt.a)); got != tt.want {
+			t.Errorf("restoreArgs(%+v) = %q, want %q", tt.a, got, tt.want)
+		}
+	}
+}
+
+func TestShellJoin(t *testing.T) {
+	if got := shellJoin([]string{"echo", "it's", "a b", "%1"}); got != `echo 'it'\''s' 'a b' %1` {
+		t.Errorf("shellJoin() = %q", got)
+	}
+}
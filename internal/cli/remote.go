@@ -0,0 +1,83 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"persishtent/internal/config"
+	"persishtent/internal/session"
+)
+
+// sshArgs builds the ssh command line that runs command on host, with a
+// terminal if tty is set. host is checked and passed after "--", so that it
+// can't be taken for an ssh option like -oProxyCommand=...
+func sshArgs(host string, tty bool, command ...string) ([]string, error) {
+	if host == "" || strings.HasPrefix(host, "-") || strings.ContainsFunc(host, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r)
+	}) {
+		return nil, fmt.Errorf("invalid host %q", host)
+	}
+	var args []string
+	if tty {
+		args = append(args, "-t")
+	}
+	return append(append(args, "--", host), command...), nil
+}
+
+// remoteAttachArgs builds the ssh command line that attaches to a session on
+// another host. The remote shell sees name unquoted, so it must be valid.
+func remoteAttachArgs(name, host string, replay bool, readOnly bool, exclusive bool, tail int) ([]string, error) {
+	if err := session.ValidateName(name); err != nil {
+		return nil, err
+	}
+	args := []string{"persishtent", "attach"}
+	if !replay {
+		args = append(args, "-n")
+	}
+	if readOnly {
+		args = append(args, "-ro")
+	}
+	if exclusive {
+		args = append(args, "-x")
+	}
+	if tail > 0 {
+		args = append(args, "-t", strconv.Itoa(tail))
+	}
+	return sshArgs(host, true, append(args, name)...)
+}
+
+// attachRemote attaches to a session on another host by running persishtent
+// there over ssh. A transcript, if requested, is saved on this machine.
+func attachRemote(name, host string, replay bool, readOnly bool, exclusive bool, tail int, transcript string) {
+	var out io.Writer = os.Stdout
+	if transcript != "" {
+		f, err := os.OpenFile(transcript, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			fmt.Println(config.Message("error", "Err", err))
+			return
+		}
+		defer func() { _ = f.Close() }()
+		out = io.MultiWriter(os.Stdout, f)
+	}
+
+	args, err := remoteAttachArgs(name, host, replay, readOnly, exclusive, tail)
+	if err != nil {
+		fmt.Println(config.Message("remote_failed", "Name", name, "Host", host, "Err", err))
+		return
+	}
+	fmt.Println(config.Message("connecting", "Name", name, "Host", host))
+	cmd := exec.Command("ssh", args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = out
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			fmt.Println(config.Message("remote_failed", "Name", name, "Host", host, "Err", err))
+		}
+	}
+}
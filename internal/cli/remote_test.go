@@ -0,0 +1,40 @@
+package cli
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRemoteAttachArgs(t *testing.T) {
+	tests := []struct {
+		replay    bool
+		readOnly  bool
+		exclusive bool
+		tail      int
+		want      string
+	}{
+		{true, false, false, 0, "-t -- web1 persishtent attach dev"},
+		{false, true, false, 0, "-t -- web1 persishtent attach -n -ro dev"},
+		{true, false, false, 50, "-t -- web1 persishtent attach -t 50 dev"},
+		{true, false, true, 0, "-t -- web1 persishtent attach -x dev"},
+	}
+	for _, tt := range tests {
+		args, err := remoteAttachArgs("dev", "web1", tt.replay, tt.readOnly, tt.exclusive, tt.tail)
+		if got := strings.Join(args, " "); err != nil || got != tt.want {
+			t.Errorf("remoteAttachArgs() = %q, %v, want %q", got, err, tt.want)
+		}
+	}
+
+	// Neither may smuggle options or shell code into the ssh command line
+	for _, target := range [][2]string{
+		{"dev", "-oProxyCommand=touch /tmp/x"},
+		{"dev", "web1 touch /tmp/x"},
+		{"dev", ""},
+		{"dev;touch /tmp/x", "web1"},
+		{"$(id)", "web1"},
+	} {
+		if args, err := remoteAttachArgs(target[0], target[1], true, false, false, 0); err == nil {
+			t.Errorf("remoteAttachArgs(%q, %q) = %q, want an error", target[0], target[1], args)
+		}
+	}
+}
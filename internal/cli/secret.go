@@ -0,0 +1,93 @@
+package cli
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+
+	"persishtent/internal/client"
+	"persishtent/internal/config"
+)
+
+// InjectSecret fetches the secret ref from a backend of the secret_backends
+// config and has the daemon of session name type it. The secret is never
+// printed, and the daemon doesn't log the output that follows it.
+func InjectSecret(name, sockPath, ref, backend string, enter, force bool) error {
+	command, err := secretBackend(config.Current().SecretBackends, backend)
+	if err != nil {
+		return err
+	}
+	secret, err := fetchSecret(command, ref)
+	if err != nil {
+		return err
+	}
+	defer clear(secret)
+	if enter {
+		secret = append(secret, '\r')
+	}
+	return client.InjectSecret(name, sockPath, secret, force)
+}
+
+// secretBackend returns the command of the named backend. Without a name,
+// the only configured backend is used.
+func secretBackend(backends map[string]string, name string) (string, error) {
+	if len(backends) == 0 {
+		return "", errors.New("no secret backends configured (see secret_backends in the config)")
+	}
+	if name == "" {
+		if len(backends) == 1 {
+			for _, command := range backends {
+				return command, nil
+			}
+		}
+		return "", fmt.Errorf("several secret backends configured, choose one with -backend: %s", backendNames(backends))
+	}
+	command, ok := backends[name]
+	if !ok {
+		return "", fmt.Errorf("unknown secret backend '%s' (configured: %s)", name, backendNames(backends))
+	}
+	return command, nil
+}
+
+func backendNames(backends map[string]string) string {
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return strings.Join(names, ", ")
+}
+
+// fetchSecret runs a backend command with {ref} replaced by the quoted ref
+// (or ref appended if there is no {ref}) and returns its output without the
+// trailing newline. The command can prompt on the terminal, e.g. to unlock
+// the store.
+func fetchSecret(command, ref string) ([]byte, error) {
+	quoted := "'" + strings.ReplaceAll(ref, "'", `'\''`) + "'"
+	if strings.Contains(command, "{ref}") {
+		command = strings.ReplaceAll(command, "{ref}", quoted)
+	} else {
+		command += " " + quoted
+	}
+	var out bytes.Buffer
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Env = append(os.Environ(), "PERSISHTENT_SECRET_REF="+ref)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		clear(out.Bytes())
+		return nil, fmt.Errorf("secret backend failed: %w", err)
+	}
+	secret := out.Bytes()
+	secret = bytes.TrimSuffix(secret, []byte("\n"))
+	secret = bytes.TrimSuffix(secret, []byte("\r"))
+	if len(secret) == 0 {
+		return nil, errors.New("secret backend returned nothing")
+	}
+	return secret, nil
+}
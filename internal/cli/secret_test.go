@@ -0,0 +1,53 @@
+package cli
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSecretBackend(t *testing.T) {
+	if _, err := secretBackend(nil, ""); err == nil {
+		t.Error("Expected an error without backends")
+	}
+
+	one := map[string]string{"pass": "pass show {ref}"}
+	if got, err := secretBackend(one, ""); err != nil || got != "pass show {ref}" {
+		t.Errorf("Single backend = %q, %v", got, err)
+	}
+
+	several := map[string]string{"pass": "pass show {ref}", "op": "op read {ref}"}
+	if _, err := secretBackend(several, ""); err == nil || !strings.Contains(err.Error(), "op, pass") {
+		t.Errorf("Expected an error listing the backends, got %v", err)
+	}
+	if got, err := secretBackend(several, "op"); err != nil || got != "op read {ref}" {
+		t.Errorf("Named backend = %q, %v", got, err)
+	}
+	if _, err := secretBackend(several, "vault"); err == nil {
+		t.Error("Expected an error for an unknown backend")
+	}
+}
+
+func TestFetchSecret(t *testing.T) {
+	tests := []struct {
+		command, ref, want string
+	}{
+		{"printf '%s\\n' {ref}", "db/prod", "db/prod"},
+		{"printf '%s\\n' {ref}", "it's; rm -rf ~", "it's; rm -rf ~"},
+		{"printf '%s'", "appended", "appended"},
+		{`printf '%s\r\n' "$PERSISHTENT_SECRET_REF" # {ref}`, "env", "env"},
+		{"printf 'two\\nlines\\n'", "x", "two\nlines"},
+	}
+	for _, tt := range tests {
+		got, err := fetchSecret(tt.command, tt.ref)
+		if err != nil || string(got) != tt.want {
+			t.Errorf("fetchSecret(%q, %q) = %q, %v; want %q", tt.command, tt.ref, got, err, tt.want)
+		}
+	}
+
+	if _, err := fetchSecret("exit 1", "x"); err == nil {
+		t.Error("Expected an error for a failing backend")
+	}
+	if _, err := fetchSecret("true", "x"); err == nil {
+		t.Error("Expected an error for an empty secret")
+	}
+}
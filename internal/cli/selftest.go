@@ -0,0 +1,197 @@
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"persishtent/internal/client"
+	"persishtent/internal/config"
+	"persishtent/internal/protocol"
+	"persishtent/internal/server"
+	"persishtent/internal/session"
+)
+
+const selfTestTimeout = 3 * time.Second
+
+// selfTestConn is a programmatic client that collects session output.
+type selfTestConn struct {
+	conn   net.Conn
+	mu     sync.Mutex
+	output bytes.Buffer
+	kicked chan struct{}
+}
+
+func dialSelfTest(sockPath string) (*selfTestConn, error) {
+	conn, err := net.Dial("unix", sockPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := protocol.WritePacket(conn, protocol.TypeMode, []byte{protocol.ModeMaster}); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	c := &selfTestConn{conn: conn, kicked: make(chan struct{})}
+	go c.readLoop()
+	return c, nil
+}
+
+func (c *selfTestConn) readLoop() {
+	for {
+		t, payload, err := protocol.ReadPacket(c.conn)
+		if err != nil {
+			return
+		}
+		switch t {
+		case protocol.TypeData:
+			c.mu.Lock()
+			c.output.Write(payload)
+			c.mu.Unlock()
+		case protocol.TypeKick:
+			close(c.kicked)
+			return
+		}
+	}
+}
+
+// waitFor blocks until the session output contains want or the timeout expires
+func (c *selfTestConn) waitFor(want string) error {
+	deadline := time.Now().Add(selfTestTimeout)
+	for time.Now().Before(deadline) {
+		c.mu.Lock()
+		found := bytes.Contains(c.output.Bytes(), []byte(want))
+		c.mu.Unlock()
+		if found {
+			return nil
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return fmt.Errorf("timed out waiting for %q", want)
+}
+
+func (c *selfTestConn) send(input string) error {
+	return protocol.WritePacket(c.conn, protocol.TypeData, []byte(input))
+}
+
+// SelfTest starts a hidden session in a temporary state directory and
+// exercises the full client/daemon path. It returns true if all checks pass.
+func SelfTest() bool {
+	tmpHome, err := os.MkdirTemp("", "persishtent-selftest-")
+	if err != nil {
+		fmt.Printf("Error creating temporary directory: %v\n", err)
+		return false
+	}
+	defer func() { _ = os.RemoveAll(tmpHome) }()
+
+	// Isolate the test session from the user's sessions. PERSISHTENT_DIR
+	// takes precedence over the XDG directories for state and sockets alike.
+	for key, value := range map[string]string{"HOME": tmpHome, "PERSISHTENT_DIR": tmpHome} {
+		if old, ok := os.LookupEnv(key); ok {
+			defer func() { _ = os.Setenv(key, old) }()
+		} else {
+			defer func() { _ = os.Unsetenv(key) }()
+		}
+		_ = os.Setenv(key, value)
+	}
+
+	// Unique even if the user has a session of the same name somewhere
+	name := fmt.Sprintf("selftest-%d", os.Getpid())
+	sockPath, err := session.GetSocketPath(name)
+	if err != nil {
+		fmt.Println(config.Message("error", "Err", err))
+		return false
+	}
+
+	var master *selfTestConn
+	defer func() {
+		if master != nil {
+			_ = master.conn.Close()
+		}
+	}()
+
+	checks := []struct {
+		name string
+		run  func() error
+	}{
+		{"start", func() error {
+			if err := spawnDaemon(name, server.Options{Command: "sh"}); err != nil {
+				return err
+			}
+			return waitForSocket(sockPath, true)
+		}},
+		{"attach", func() error {
+			master, err = dialSelfTest(sockPath)
+			return err
+		}},
+		{"input/output", func() error {
+			if err := master.send("echo selftest-$((6*7))\n"); err != nil {
+				return err
+			}
+			return master.waitFor("selftest-42")
+		}},
+		{"resize", func() error {
+			payload := protocol.ResizePayload(33, 99)
+			if err := protocol.WritePacket(master.conn, protocol.TypeResize, payload); err != nil {
+				return err
+			}
+			if err := master.send("stty size\n"); err != nil {
+				return err
+			}
+			return master.waitFor("33 99")
+		}},
+		{"kick", func() error {
+			second, err := dialSelfTest(sockPath)
+			if err != nil {
+				return err
+			}
+			defer func() { _ = second.conn.Close() }()
+			select {
+			case <-master.kicked:
+				return nil
+			case <-time.After(selfTestTimeout):
+				return fmt.Errorf("previous master was not kicked")
+			}
+		}},
+		{"kill", func() error {
+			if err := client.Kill(name, "", syscall.SIGHUP, selfTestTimeout); err != nil {
+				return err
+			}
+			return waitForSocket(sockPath, false)
+		}},
+	}
+
+	ok := true
+	for _, check := range checks {
+		if err := check.run(); err != nil {
+			fmt.Printf("  %-14s FAIL (%v)\n", check.name, err)
+			ok = false
+			break
+		}
+		fmt.Printf("  %-14s ok\n", check.name)
+	}
+
+	if !ok {
+		// Make sure no daemon is left behind
+		_ = client.Kill(name, "", syscall.SIGKILL, 0)
+	}
+	return ok
+}
+
+// waitForSocket waits until the socket accepts connections (or is gone, if exists is false)
+func waitForSocket(path string, exists bool) error {
+	deadline := time.Now().Add(selfTestTimeout)
+	for time.Now().Before(deadline) {
+		if session.SocketExists(path) == exists {
+			return nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if exists {
+		return fmt.Errorf("timed out waiting for %s", path)
+	}
+	return fmt.Errorf("%s still exists", path)
+}
@@ -0,0 +1,44 @@
+package cli
+
+import (
+	"fmt"
+	"time"
+
+	"persishtent/internal/client"
+	"persishtent/internal/config"
+	"persishtent/internal/session"
+)
+
+// ShutdownSession ends a session gracefully, telling its attached clients
+// reason first. It returns false on errors.
+func ShutdownSession(name string, sockPath string, reason string, timeout time.Duration) bool {
+	if err := client.Shutdown(name, sockPath, reason, timeout); err != nil {
+		fmt.Println(config.Message("shutdown_failed", "Name", name, "Err", err))
+		return false
+	}
+	fmt.Println(config.Message("session_shut_down", "Name", name))
+	return true
+}
+
+// ShutdownAll ends all sessions gracefully in parallel and prints a summary.
+// It returns false if any session failed or timed out.
+func ShutdownAll(reason string, timeout time.Duration) bool {
+	sessions, err := session.List()
+	if err != nil {
+		fmt.Println(config.Message("error", "Err", err))
+		return false
+	}
+	if len(sessions) == 0 {
+		fmt.Println(config.Message("no_sessions"))
+		return true
+	}
+	names := make([]string, len(sessions))
+	for i, s := range sessions {
+		names[i] = s.Name
+	}
+	sum := killAll(names, func(name string) error {
+		return client.Shutdown(name, "", reason, timeout)
+	}, timeout+killGrace, "session_shut_down", "shutdown_failed")
+	fmt.Println(config.Message("shutdown_summary", "Stopped", sum.killed, "Failed", sum.failed, "TimedOut", sum.timedOut))
+	return sum.failed == 0 && sum.timedOut == 0
+}
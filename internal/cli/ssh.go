@@ -0,0 +1,144 @@
+package cli
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"golang.org/x/term"
+
+	"persishtent/internal/config"
+)
+
+// remotePath makes a binary installed with ssh -install found on the remote
+// host, where non-interactive shells may not have ~/.local/bin in their PATH.
+const remotePath = `PATH="$PATH:$HOME/.local/bin"`
+
+// remoteMissing is the exit status of the remote shell if persishtent isn't found
+const remoteMissing = 127
+
+// sshAttachCommand returns the remote shell command that starts or attaches
+// to session name, or opens the session menu if name is empty. The window
+// size is set explicitly, as it isn't always passed on through jump hosts.
+func sshAttachCommand(name string, rows, cols int, readOnly bool, replay bool) string {
+	args := []string{"persishtent"}
+	if readOnly || !replay {
+		args = append(args, "attach")
+		if readOnly {
+			args = append(args, "-ro")
+		}
+		if !replay {
+			args = append(args, "-n")
+		}
+	}
+	if name != "" {
+		args = append(args, name)
+	}
+	cmd := remotePath + "; exec " + shellJoin(args)
+	if rows > 0 && cols > 0 {
+		cmd = fmt.Sprintf("stty rows %d cols %d 2>/dev/null; %s", rows, cols, cmd)
+	}
+	return cmd
+}
+
+// remotePlatform maps the output of uname -sm to a GOOS/GOARCH pair
+func remotePlatform(uname string) string {
+	system, machine, _ := strings.Cut(strings.TrimSpace(uname), " ")
+	goos := strings.ToLower(system)
+	switch machine {
+	case "x86_64", "amd64":
+		machine = "amd64"
+	case "aarch64", "arm64":
+		machine = "arm64"
+	case "i386", "i686":
+		machine = "386"
+	case "armv7l", "armv6l":
+		machine = "arm"
+	}
+	return goos + "/" + machine
+}
+
+// installRemote copies this binary to ~/.local/bin on host unless
+// persishtent is found there already. The binary must be built for the
+// host's system and architecture.
+func installRemote(host string) error {
+	probe := remotePath + "; command -v persishtent >/dev/null && echo found; uname -sm"
+	args, err := sshArgs(host, false, probe)
+	if err != nil {
+		return err
+	}
+	out, err := exec.Command("ssh", args...).Output()
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if lines[0] == "found" {
+		return nil
+	}
+	platform := remotePlatform(lines[len(lines)-1])
+	if local := runtime.GOOS + "/" + runtime.GOARCH; platform != local {
+		return errors.New(config.Message("ssh_platform", "Host", host, "Platform", platform, "Local", local))
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(exe)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	fmt.Println(config.Message("ssh_installing", "Host", host))
+	// Written to a temporary file first, so an interrupted copy leaves no broken binary
+	install := `mkdir -p "$HOME/.local/bin" && cat > "$HOME/.local/bin/.persishtent.tmp" && chmod 755 "$HOME/.local/bin/.persishtent.tmp" && mv "$HOME/.local/bin/.persishtent.tmp" "$HOME/.local/bin/persishtent"`
+	args, _ = sshArgs(host, false, install)
+	cmd := exec.Command("ssh", args...)
+	cmd.Stdin = bufio.NewReader(f)
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// SSH connects to host over ssh and starts or attaches to session name
+// there, or shows the session menu if name is empty. With install, this
+// binary is copied to the host first if persishtent isn't installed there.
+func SSH(host string, name string, install bool, readOnly bool, replay bool) bool {
+	if install {
+		if err := installRemote(host); err != nil {
+			fmt.Println(config.Message("ssh_failed", "Host", host, "Err", err))
+			return false
+		}
+	}
+
+	rows, cols := 0, 0
+	if w, h, err := term.GetSize(int(os.Stdin.Fd())); err == nil {
+		rows, cols = h, w
+	}
+	args, err := sshArgs(host, true, sshAttachCommand(name, rows, cols, readOnly, replay))
+	if err != nil {
+		fmt.Println(config.Message("ssh_failed", "Host", host, "Err", err))
+		return false
+	}
+	cmd := exec.Command("ssh", args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return true
+	case errors.As(err, &exitErr):
+		if exitErr.ExitCode() == remoteMissing {
+			fmt.Println(config.Message("ssh_missing", "Host", host))
+		}
+		return false
+	default:
+		fmt.Println(config.Message("ssh_failed", "Host", host, "Err", err))
+		return false
+	}
+}
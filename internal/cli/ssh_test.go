@@ -0,0 +1,49 @@
+package cli
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSSHAttachCommand(t *testing.T) {
+	tests := []struct {
+		name     string
+		rows     int
+		cols     int
+		readOnly bool
+		replay   bool
+		want     string
+	}{
+		{"dev", 40, 120, false, true, `stty rows 40 cols 120 2>/dev/null; PATH="$PATH:$HOME/.local/bin"; exec persishtent dev`},
+		{"", 0, 0, false, true, `PATH="$PATH:$HOME/.local/bin"; exec persishtent`},
+		{"it's", 0, 0, true, false, `PATH="$PATH:$HOME/.local/bin"; exec persishtent attach -ro -n 'it'\''s'`},
+	}
+	for _, tt := range tests {
+		if got := sshAttachCommand(tt.name, tt.rows, tt.cols, tt.readOnly, tt.replay); got != tt.want {
+			t.Errorf("sshAttachCommand(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSSHArgs(t *testing.T) {
+	if args, err := sshArgs("web1", false, "uname -sm"); err != nil || strings.Join(args, " ") != "-- web1 uname -sm" {
+		t.Errorf("sshArgs() = %q, %v", args, err)
+	}
+	if args, err := sshArgs("-oProxyCommand=sh", true, "uname"); err == nil {
+		t.Errorf("sshArgs() with an option as host = %q", args)
+	}
+}
+
+func TestRemotePlatform(t *testing.T) {
+	tests := map[string]string{
+		"Linux x86_64\n": "linux/amd64",
+		"Linux aarch64":  "linux/arm64",
+		"Darwin arm64":   "darwin/arm64",
+		"FreeBSD amd64":  "freebsd/amd64",
+	}
+	for uname, want := range tests {
+		if got := remotePlatform(uname); got != want {
+			t.Errorf("remotePlatform(%q) = %q, want %q", uname, got, want)
+		}
+	}
+}
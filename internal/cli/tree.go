@@ -0,0 +1,96 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"persishtent/internal/config"
+	"persishtent/internal/session"
+)
+
+// ShowTree prints the processes running under a session's shell with their
+// CPU and memory usage. With watch, the view is refreshed every interval
+// until the session ends.
+func ShowTree(name string, watch bool, interval time.Duration) {
+	info, err := session.ReadInfo(name)
+	if err != nil || !info.IsAlive() {
+		fmt.Println(config.Message("session_not_found", "Name", name))
+		return
+	}
+	if !info.IsLocal() {
+		fmt.Println(config.Message("session_on_host", "Name", name, "Host", info.Host))
+		return
+	}
+
+	var prev map[int]time.Duration
+	for {
+		root, err := session.ProcTree(info.PID)
+		if err != nil {
+			if prev == nil {
+				fmt.Println(config.Message("error", "Err", err))
+			} else {
+				fmt.Println(config.Message("session_ended"))
+			}
+			return
+		}
+		if watch {
+			fmt.Print("\x1b[H\x1b[2J")
+			fmt.Print(config.Message("tree_header", "Name", name, "Interval", interval) + "\n\n")
+		}
+		prev = renderTree(os.Stdout, root, prev, interval)
+		if !watch {
+			return
+		}
+		time.Sleep(interval)
+	}
+}
+
+// renderTree writes the process tree below root and returns the CPU time of
+// every process for the next refresh. prev holds the CPU times of the refresh
+// interval ago; processes without one show their CPU usage averaged over
+// their lifetime, like ps does.
+func renderTree(w io.Writer, root *session.Proc, prev map[int]time.Duration, interval time.Duration) map[int]time.Duration {
+	cpu := make(map[int]time.Duration)
+	fmt.Fprintf(w, "%7s %6s %10s  %s\n", "PID", "%CPU", "RSS", "COMMAND")
+
+	var walk func(p *session.Proc, indent, branch string)
+	walk = func(p *session.Proc, indent, branch string) {
+		cpu[p.PID] = p.CPU
+		used, elapsed := p.CPU, p.Age
+		if last, ok := prev[p.PID]; ok {
+			used, elapsed = p.CPU-last, interval
+		}
+		percent := 0.0
+		if elapsed > 0 {
+			percent = 100 * float64(used) / float64(elapsed)
+		}
+
+		state := ""
+		switch p.State {
+		case 'T':
+			state = " (stopped)"
+		case 'Z':
+			state = " (zombie)"
+		}
+		fmt.Fprintf(w, "%7d %6.1f %10s  %s%s%s%s\n", p.PID, percent, formatBytes(p.RSS), indent, branch, p.Command, state)
+
+		// Children are indented below the command of their parent
+		switch branch {
+		case "├─ ":
+			indent += "│  "
+		case "└─ ":
+			indent += "   "
+		}
+		for i, c := range p.Children {
+			if i == len(p.Children)-1 {
+				walk(c, indent, "└─ ")
+			} else {
+				walk(c, indent, "├─ ")
+			}
+		}
+	}
+	walk(root, "", "")
+	return cpu
+}
@@ -0,0 +1,39 @@
+package cli
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"persishtent/internal/session"
+)
+
+func TestRenderTree(t *testing.T) {
+	root := &session.Proc{PID: 10, Command: "bash", CPU: time.Second, Age: 10 * time.Second, RSS: 2048, Children: []*session.Proc{
+		{PID: 11, Command: "make", Children: []*session.Proc{
+			{PID: 13, Command: "cc main.c", CPU: 3 * time.Second, Age: 4 * time.Second},
+		}},
+		{PID: 12, Command: "vim", State: 'T'},
+	}}
+
+	var b strings.Builder
+	cpu := renderTree(&b, root, nil, time.Second)
+	want := []string{
+		"    PID   %CPU        RSS  COMMAND",
+		"     10   10.0    2.0 KiB  bash",
+		"     11    0.0        0 B  ├─ make",
+		"     13   75.0        0 B  │  └─ cc main.c",
+		"     12    0.0        0 B  └─ vim (stopped)",
+	}
+	if got := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Got:\n%s\nWant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// Refreshes show the CPU usage since the previous one
+	root.Children[0].Children[0].CPU += 500 * time.Millisecond
+	b.Reset()
+	renderTree(&b, root, cpu, time.Second)
+	if !strings.Contains(b.String(), "     13   50.0") {
+		t.Errorf("Expected 50%% CPU since the last refresh:\n%s", b.String())
+	}
+}
@@ -0,0 +1,57 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"persishtent/internal/client"
+	"persishtent/internal/config"
+	"persishtent/internal/session"
+)
+
+// upgradeExecutable returns the absolute path of the daemon binary sessions
+// are handed over to: exe if set, this binary otherwise.
+func upgradeExecutable(exe string) (string, error) {
+	if exe == "" {
+		return os.Executable()
+	}
+	return filepath.Abs(exe)
+}
+
+// UpgradeSession hands a session over to the daemon binary exe, or to this
+// binary if exe is empty, without ending it. It returns false on errors.
+func UpgradeSession(name string, sockPath string, exe string) bool {
+	path, err := upgradeExecutable(exe)
+	if err == nil {
+		err = client.Upgrade(name, sockPath, path)
+	}
+	if err != nil {
+		fmt.Println(config.Message("upgrade_failed", "Name", name, "Err", err))
+		return false
+	}
+	fmt.Println(config.Message("session_upgraded", "Name", name))
+	return true
+}
+
+// UpgradeAll hands all sessions over one after the other and prints a
+// summary. It returns false if any session failed.
+func UpgradeAll(exe string) bool {
+	sessions, err := session.List()
+	if err != nil {
+		fmt.Println(config.Message("error", "Err", err))
+		return false
+	}
+	if len(sessions) == 0 {
+		fmt.Println(config.Message("no_sessions"))
+		return true
+	}
+	upgraded := 0
+	for _, s := range sessions {
+		if UpgradeSession(s.Name, "", exe) {
+			upgraded++
+		}
+	}
+	fmt.Println(config.Message("upgrade_summary", "Upgraded", upgraded, "Failed", len(sessions)-upgraded))
+	return upgraded == len(sessions)
+}
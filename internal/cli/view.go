@@ -0,0 +1,34 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+
+	"persishtent/internal/client"
+	"persishtent/internal/config"
+)
+
+// View shows the sessions in names, or all local sessions of group if it is
+// set, side by side. Unless readOnly, sessions carrying one of the
+// confirm_tags need confirmation first, as the focused pane takes input.
+// It returns false if a session can't be shown.
+func View(names []string, group string, readOnly bool) bool {
+	targets, ok := broadcastTargets(names, group)
+	if !ok {
+		return false
+	}
+	list := make([]string, len(targets))
+	noInput := make(map[string]bool)
+	for i, info := range targets {
+		if !readOnly && !confirmAttach(info, os.Stdin, os.Stdout) {
+			return false
+		}
+		list[i] = info.Name
+		noInput[info.Name] = readOnly
+	}
+	if err := client.View(list, noInput); err != nil {
+		fmt.Println(config.Message("error", "Err", err))
+		return false
+	}
+	return true
+}
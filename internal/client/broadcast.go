@@ -0,0 +1,228 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/term"
+	"persishtent/internal/config"
+	"persishtent/internal/protocol"
+	"persishtent/internal/session"
+)
+
+// fanout sends input to several sessions over control connections, like
+// clusterssh. It serves the broadcast command and the group toggle of
+// attached clients.
+type fanout struct {
+	mu     sync.Mutex
+	conns  map[string]net.Conn
+	notice func(string)  // Shows problems reported by the sessions
+	empty  chan struct{} // Closed once no session is left
+}
+
+// dialFanout connects to the sessions in names. It fails if any of them
+// can't be reached.
+func dialFanout(names []string, notice func(string)) (*fanout, error) {
+	f := &fanout{conns: make(map[string]net.Conn), notice: notice, empty: make(chan struct{})}
+	for _, name := range names {
+		conn, err := dialControl(name, "")
+		if err != nil {
+			f.close()
+			return nil, fmt.Errorf("session '%s': %w", name, err)
+		}
+		f.conns[name] = conn
+	}
+	for name, conn := range f.conns {
+		go f.readReplies(name, conn)
+	}
+	return f, nil
+}
+
+// readReplies shows the errors a session reports for its input, and drops
+// the session once its connection ends.
+func (f *fanout) readReplies(name string, conn net.Conn) {
+	for {
+		t, reply, err := protocol.ReadPacket(conn)
+		if err != nil {
+			f.drop(name, conn)
+			return
+		}
+		if t == protocol.TypeInput && len(reply) > 0 {
+			f.notice(config.Message("broadcast_failed", "Name", name, "Err", string(reply)))
+		}
+	}
+}
+
+func (f *fanout) drop(name string, conn net.Conn) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.conns[name] != conn {
+		return
+	}
+	_ = conn.Close()
+	delete(f.conns, name)
+	if len(f.conns) == 0 {
+		close(f.empty)
+	}
+}
+
+// send writes input to all sessions. Sessions that can't be written to are
+// dropped.
+func (f *fanout) send(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	f.mu.Lock()
+	failed := make(map[string]net.Conn)
+	for name, conn := range f.conns {
+		if err := protocol.WritePacket(conn, protocol.TypeInput, data); err != nil {
+			failed[name] = conn
+		}
+	}
+	f.mu.Unlock()
+	for name, conn := range failed {
+		f.drop(name, conn)
+	}
+}
+
+// close disconnects from all sessions.
+func (f *fanout) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for name, conn := range f.conns {
+		_ = conn.Close()
+		delete(f.conns, name)
+	}
+	select {
+	case <-f.empty:
+	default:
+		close(f.empty)
+	}
+}
+
+// groupPeers returns the other local sessions in the group of session name.
+// Sessions carrying one of the confirm_tags are left out, since there is no
+// way to confirm them while attached.
+func groupPeers(name string) (group string, peers []string, err error) {
+	info, err := session.ReadInfo(name)
+	if err != nil || info.Group == "" {
+		return "", nil, err
+	}
+	sessions, err := session.List()
+	if err != nil {
+		return info.Group, nil, err
+	}
+	for _, s := range sessions {
+		if s.Group == info.Group && s.Name != name && s.IsLocal() && !needsConfirm(s) {
+			peers = append(peers, s.Name)
+		}
+	}
+	return info.Group, peers, nil
+}
+
+func needsConfirm(info session.Info) bool {
+	for _, tag := range config.Current().ConfirmTags {
+		if info.HasTag(tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// toggleBroadcast starts or stops sending input to the other sessions of
+// this session's group too, and returns the notice to show.
+func (c *SessionClient) toggleBroadcast() string {
+	if c.fanout != nil {
+		c.fanout.close()
+		c.fanout = nil
+		return config.Message("broadcast_off")
+	}
+	group, peers, err := groupPeers(c.Name)
+	switch {
+	case err != nil:
+		return config.Message("error", "Err", err)
+	case group == "":
+		return config.Message("broadcast_no_group", "Name", c.Name)
+	case len(peers) == 0:
+		return config.Message("broadcast_alone", "Group", group)
+	}
+	f, err := dialFanout(peers, drawNotice)
+	if err != nil {
+		return config.Message("error", "Err", err)
+	}
+	c.fanout = f
+	return config.Message("broadcast_on", "Count", len(peers), "Group", group)
+}
+
+// Broadcast sends input typed on this terminal to all sessions in names,
+// until the detach key and d are pressed or all sessions have ended. The
+// sessions' output isn't shown.
+func Broadcast(names []string) error {
+	notice := func(msg string) { _, _ = os.Stdout.Write([]byte(msg + "\r\n")) }
+	f, err := dialFanout(names, notice)
+	if err != nil {
+		return err
+	}
+	defer f.close()
+
+	oldState, err := term.MakeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = term.Restore(int(os.Stdin.Fd()), oldState) }()
+	notice(config.Message("broadcasting", "Names", strings.Join(names, ", ")))
+
+	input := make(chan []byte)
+	go func() {
+		// Prefix keys at most double a chunk, which then still fits a packet
+		buf := make([]byte, protocol.MaxPayloadSize/2)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if n > 0 {
+				input <- append([]byte(nil), buf[:n]...)
+			}
+			if err != nil {
+				close(input)
+				return
+			}
+		}
+	}()
+
+	detachKey := parseDetachKey(config.Current().DetachKey)
+	prefix := false
+	for {
+		var data []byte
+		var ok bool
+		select {
+		case data, ok = <-input:
+			if !ok {
+				return nil
+			}
+		case <-f.empty:
+			notice(config.Message("broadcast_ended"))
+			return nil
+		}
+		var run []byte
+		for _, b := range data {
+			switch {
+			case prefix && b == 'd':
+				f.send(run)
+				return nil
+			case prefix && b == detachKey:
+				run = append(run, b)
+			case prefix:
+				run = append(run, detachKey, b)
+			case b == detachKey:
+				prefix = true
+				continue
+			default:
+				run = append(run, b)
+			}
+			prefix = false
+		}
+		f.send(run)
+	}
+}
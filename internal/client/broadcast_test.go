@@ -0,0 +1,61 @@
+package client
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"persishtent/internal/protocol"
+)
+
+func TestFanout(t *testing.T) {
+	notices := make(chan string, 4)
+	f := &fanout{conns: make(map[string]net.Conn), notice: func(s string) { notices <- s }, empty: make(chan struct{})}
+	servers := make(map[string]net.Conn)
+	for _, name := range []string{"a", "b"} {
+		server, conn := net.Pipe()
+		defer func() { _ = server.Close() }()
+		servers[name] = server
+		f.conns[name] = conn
+		go f.readReplies(name, conn)
+	}
+
+	// Pipes block until read, so both sessions are read at once
+	go f.send([]byte("ls\r"))
+	var wg sync.WaitGroup
+	for name, server := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			typ, payload, err := protocol.ReadPacket(server)
+			if err != nil || typ != protocol.TypeInput || string(payload) != "ls\r" {
+				t.Errorf("%s got %d %q, %v", name, typ, payload, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Errors reported by a session are shown
+	go func() { _ = protocol.WritePacket(servers["a"], protocol.TypeInput, []byte("discarded")) }()
+	select {
+	case msg := <-notices:
+		if !strings.Contains(msg, "a: discarded") {
+			t.Errorf("Unexpected notice %q", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No notice for a failed input")
+	}
+
+	// Ended sessions are dropped until none is left
+	_ = servers["a"].Close()
+	_ = servers["b"].Close()
+	select {
+	case <-f.empty:
+	case <-time.After(time.Second):
+		t.Fatal("Fanout not empty after all sessions ended")
+	}
+	f.send([]byte("ignored"))
+	f.close()
+}
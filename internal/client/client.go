@@ -2,127 +2,514 @@ package client
 
 import (
 	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"os"
 	"os/signal"
+	"os/user"
+	"slices"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode"
 
+	"golang.org/x/sys/unix"
 	"golang.org/x/term"
+	"persishtent/internal/ansi"
 	"persishtent/internal/config"
 	"persishtent/internal/protocol"
 	"persishtent/internal/session"
+	"persishtent/internal/timing"
 )
 
 var ErrDetached = errors.New("detached")
 var ErrKicked = errors.New("kicked by another session")
 
+// ErrSwitch is returned when the user detached to attach the next session
+var ErrSwitch = errors.New("switching to the next session")
+
+// KickedError is returned when another Master took over the session. It
+// matches ErrKicked with errors.Is.
+type KickedError struct {
+	By string // Identity of the new Master, empty if the daemon didn't say
+}
+
+func (e *KickedError) Error() string {
+	if e.By == "" {
+		return ErrKicked.Error()
+	}
+	return "kicked by " + e.By
+}
+
+func (e *KickedError) Is(target error) bool { return target == ErrKicked }
+
+// ErrRefused is returned when the daemon turns down a Master attach because
+// another client holds the session with an exclusive lock.
+var ErrRefused = errors.New("attach refused")
+
 // SessionClient handles the client-side session logic.
 type SessionClient struct {
 	Conn       net.Conn
 	Name       string
 	DetachKey  byte
+	Bindings   map[byte]string // Actions of the keys pressed after DetachKey, nil for those of the config
 	ReadOnly   bool
+	Replay     bool // Ask the daemon for the session history
+	Tail       int  // Replay only the last lines of the history, if above 0
+	Exclusive  bool // Lock the session against other Master attaches
+	Peers      bool // Ask the daemon for the other attached clients
+	PrefixTimeout time.Duration // The prefix is sent as input if no key follows within it, 0 waits forever
+	refused    error // Set when the daemon refused the attach or sent an error during replay
+	others     string // Notice of the other clients the daemon listed during replay
+
+	connMu   sync.Mutex // Guards Conn, which reconnect replaces
+	sockPath string     // Socket given to Connect, reused by reconnect
+	resume   resumeState
+	unacked  uint32 // Output written to the terminal since the last TypeAck
+	limit    int    // Payload limit the daemon sent in TypeLimit, 0 for MaxPayloadSize
 	
 	stdinCh    chan []byte
+	pending    []byte // input read during replay, processed by DrainInput
+	transcript transcript
+	tab        *tabRelay // Writes live output and terminal integration sequences
+	fanout     *fanout   // Other sessions of the group receiving input, see toggleBroadcast
 	
 pendingPrefix bool
+prefixAt      time.Time // When the pending prefix was pressed
 detached      int32 // atomic
+switching     int32 // atomic, set when the client detached to attach the next session
+
+	// Bracketed paste state: inside a paste, prefix keys are not interpreted
+	inPaste    bool
+	pasteMatch int // Bytes of the next paste marker matched so far
+
+	confirming atomic.Bool // The server holds input until we answer y/n
+	locked     bool        // Input is dropped until the prefix and l are pressed again
+	copying    *copyMode   // Input goes to copy mode while set, see startCopyMode
+	writable   atomic.Bool // A read-only client was granted write access, see TypeGrant
+}
+
+// Bracketed paste markers sent by the terminal around pasted text
+var (
+	pasteStart = []byte("\x1b[200~")
+	pasteEnd   = []byte("\x1b[201~")
+)
+
+// matchMarker advances the partial match n of marker by b and reports
+// whether the marker is complete. Markers may be split across reads.
+func matchMarker(marker []byte, n *int, b byte) bool {
+	switch {
+	case b == marker[*n]:
+		*n++
+	case b == marker[0]:
+		*n = 1
+	default:
+		*n = 0
+	}
+	if *n == len(marker) {
+		*n = 0
+		return true
+	}
+	return false
 }
 
 func NewSessionClient(name string, detachKey byte, readOnly bool) *SessionClient {
 	return &SessionClient{
-		Name:      name,
-		DetachKey: detachKey,
-		ReadOnly:  readOnly,
-		stdinCh:   make(chan []byte),
+		Name:       name,
+		DetachKey:  detachKey,
+		ReadOnly:   readOnly,
+		stdinCh:    make(chan []byte),
+		transcript: transcript{name: name},
+		tab:        &tabRelay{out: os.Stdout},
 	}
 }
 
 func (c *SessionClient) Connect(sockPath string) error {
 	var err error
 	if sockPath == "" {
-		sockPath, err = session.GetSocketPath(c.Name)
+		sockPath, err = session.ResolveSocketPath(c.Name)
 		if err != nil {
 			return err
 		}
 	}
-	c.Conn, err = net.Dial("unix", sockPath)
-	return err
+	conn, err := net.Dial("unix", sockPath)
+	if err != nil {
+		return session.Classify(err)
+	}
+	c.connMu.Lock()
+	c.Conn, c.sockPath = conn, sockPath
+	c.connMu.Unlock()
+	return nil
+}
+
+// conn returns the connection to the daemon, which may be replaced by a
+// reconnect while input is forwarded.
+func (c *SessionClient) conn() net.Conn {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	return c.Conn
+}
+
+// newReader returns a Reader for the connection that accepts payloads of
+// up to the limit the daemon sent.
+func (c *SessionClient) newReader() *protocol.Reader {
+	packets := protocol.NewReader(c.conn())
+	if c.limit > 0 {
+		packets.SetLimit(c.limit)
+	}
+	return packets
+}
+
+// setLimit applies a TypeLimit payload to packets and later readers
+func (c *SessionClient) setLimit(payload []byte, packets *protocol.Reader) {
+	if limit, ok := protocol.DecodePayloadLimit(payload); ok {
+		c.limit = limit
+		packets.SetLimit(limit)
+	}
 }
 
 func (c *SessionClient) Handshake() error {
-	// Send Mode
-	mode := []byte{protocol.ModeMaster}
+	// Send Mode and capabilities
+	mode, caps := protocol.ModeMaster, protocol.CapPixels|protocol.CapIdentity|protocol.CapPing|protocol.CapResume|protocol.CapFlow|protocol.CapLargePayload|protocol.CapErrors
 	if c.ReadOnly {
-		mode = []byte{protocol.ModeReadOnly}
+		mode = protocol.ModeReadOnly
+	}
+	if c.Replay {
+		caps |= protocol.CapReplay
 	}
-	if err := protocol.WritePacket(c.Conn, protocol.TypeMode, mode); err != nil {
+	if c.Exclusive {
+		caps |= protocol.CapExclusive
+	}
+	if c.Peers {
+		caps |= protocol.CapPeers
+	}
+	payload := protocol.AppendIdentity(protocol.ModePayload(mode, caps, c.Tail), localIdentity())
+	if err := protocol.WritePacket(c.conn(), protocol.TypeMode, payload); err != nil {
 		return err
 	}
 
 	// Sync Env
-	currentSSH := os.Getenv("SSH_AUTH_SOCK")
-	if currentSSH != "" {
-		_ = protocol.WritePacket(c.Conn, protocol.TypeEnv, []byte("SSH_AUTH_SOCK="+currentSSH))
+	for _, key := range config.Current().ForwardEnv {
+		if value := os.Getenv(key); value != "" {
+			_ = protocol.WritePacket(c.conn(), protocol.TypeEnv, []byte(key+"="+value))
+		}
 	}
 	return nil
 }
 
+// processInput handles the prefix key sequences in data and forwards the
+// rest to the session. Runs of ordinary input are sent as one packet, so a
+// large paste doesn't turn into a packet per byte. Bracketed pastes are
+// forwarded as is, so pasted control characters never act as prefix keys.
 func (c *SessionClient) processInput(data []byte) error {
-	for _, b := range data {
+	if c.copying != nil {
+		c.copyInput(data)
+		return nil
+	}
+	var run []byte
+	if c.prefixExpired() {
+		// Too late for a binding, the prefix was meant for the session
+		c.pendingPrefix = false
+		if !c.locked {
+			run = append(run, c.DetachKey)
+		}
+	}
+	flush := func() error {
+		if len(run) == 0 || (c.ReadOnly && !c.writable.Load()) {
+			run = run[:0]
+			return nil
+		}
+		err := protocol.WritePacket(c.conn(), protocol.TypeData, run)
+		if c.fanout != nil {
+			c.fanout.send(run)
+		}
+		run = run[:0]
+		return err
+	}
+
+	dropped := false
+	for i, b := range data {
+		if len(run) >= protocol.MaxPayloadSize-1 {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		if c.locked {
+			// Only the unlock and detach bindings get through
+			if !c.pendingPrefix {
+				c.pendingPrefix, c.prefixAt = b == c.DetachKey, time.Now()
+				dropped = dropped || !c.pendingPrefix
+				continue
+			}
+			if action := c.binding(b); action != config.BindLock && action != config.BindDetach {
+				c.pendingPrefix = false
+				dropped = true
+				continue
+			}
+		} else if c.confirming.Load() {
+			// The next key answers the server's confirmation request
+			if err := flush(); err != nil {
+				return err
+			}
+			answer, notice := byte('n'), config.Message("guard_discarded")
+			if b == 'y' || b == 'Y' {
+				answer, notice = 'y', config.Message("guard_sent")
+			}
+			c.confirming.Store(false)
+			drawNotice(notice)
+			if err := protocol.WritePacket(c.conn(), protocol.TypeConfirm, []byte{answer}); err != nil {
+				return err
+			}
+			continue
+		}
+		if c.inPaste {
+			run = append(run, b)
+			if matchMarker(pasteEnd, &c.pasteMatch, b) {
+				c.inPaste = false
+			}
+			continue
+		}
+		if matchMarker(pasteStart, &c.pasteMatch, b) {
+			// The marker itself is ordinary input for the shell
+			c.inPaste = true
+		}
+
 		if c.pendingPrefix {
 			c.pendingPrefix = false
-			switch b {
-			case 'd':
-				// Prefix, d -> Detach
-				atomic.StoreInt32(&c.detached, 1)
-				_ = c.Conn.Close()
-				return io.EOF // signal stop
-			case c.DetachKey:
-				if c.ReadOnly {
-					continue
-				}
+			action := c.binding(b)
+			switch {
+			case b == c.DetachKey || action == config.BindSendLiteral:
 				// Prefix, Prefix -> Send single Prefix
-				if err := protocol.WritePacket(c.Conn, protocol.TypeData, []byte{c.DetachKey}); err != nil {
-					return err
-				}
+				run = append(run, c.DetachKey)
+			case action == "":
+				// Prefix, <other> -> Send Prefix then <other>
+				run = append(run, c.DetachKey, b)
 			default:
-				if c.ReadOnly {
-					continue
+				if err := flush(); err != nil {
+					return err
 				}
-				// Prefix, <other> -> Send Prefix then <other>
-				if err := protocol.WritePacket(c.Conn, protocol.TypeData, []byte{c.DetachKey, b}); err != nil {
+				if err := bindingHandlers[action](c); err != nil {
 					return err
 				}
+				if c.copying != nil {
+					// The rest of the input is meant for copy mode
+					c.copyInput(data[i+1:])
+					return nil
+				}
 			}
+		} else if b == c.DetachKey {
+			c.pendingPrefix, c.prefixAt = true, time.Now()
 		} else {
-			if b == c.DetachKey {
-				c.pendingPrefix = true
-			} else {
-				if c.ReadOnly {
-					continue
-				}
-				if err := protocol.WritePacket(c.Conn, protocol.TypeData, []byte{b}); err != nil {
-					return err
-				}
+			run = append(run, b)
+		}
+	}
+	if dropped {
+		drawNotice(config.Message("input_locked", "Keys", c.lockKeys()))
+	}
+	return flush()
+}
+
+// prefixExpired reports whether the pending prefix has waited longer than
+// PrefixTimeout for the next key
+func (c *SessionClient) prefixExpired() bool {
+	return c.pendingPrefix && c.PrefixTimeout > 0 && time.Since(c.prefixAt) >= c.PrefixTimeout
+}
+
+// prefixExpiry returns a channel that fires when the pending prefix expires,
+// or nil if no prefix is pending or it never expires
+func (c *SessionClient) prefixExpiry() <-chan time.Time {
+	if !c.pendingPrefix || c.PrefixTimeout <= 0 {
+		return nil
+	}
+	return time.After(time.Until(c.prefixAt.Add(c.PrefixTimeout)))
+}
+
+// bindingHandlers run the actions of the bindings setting, except
+// send-literal, which processInput handles. Returning io.EOF stops input.
+var bindingHandlers = map[string]func(c *SessionClient) error{
+	config.BindDetach: func(c *SessionClient) error {
+		return c.stop(&c.detached)
+	},
+	config.BindSwitchNext: func(c *SessionClient) error {
+		if session.Next(c.Name) == "" {
+			drawNotice(config.Message("no_next_session"))
+			return nil
+		}
+		return c.stop(&c.switching)
+	},
+	config.BindKill: func(c *SessionClient) error {
+		// The daemon ends the attachment with TypeExit. Input keeps going
+		// while Kill waits for it, e.g. to answer a prompt of the shell.
+		go func() {
+			if err := Kill(c.Name, c.sockPath, syscall.SIGTERM, DefaultKillTimeout); err != nil {
+				drawNotice(config.Message("kill_notice_failed", "Err", err))
 			}
+		}()
+		return nil
+	},
+	config.BindCopyMode: func(c *SessionClient) error {
+		c.startCopyMode()
+		return nil
+	},
+	config.BindPaste: (*SessionClient).paste,
+	config.BindToggleReadOnly: func(c *SessionClient) error {
+		// Grant the newest viewer write access, or revoke it
+		if c.ReadOnly {
+			return nil
+		}
+		return protocol.WritePacket(c.conn(), protocol.TypeGrant, nil)
+	},
+	config.BindTranscript: func(c *SessionClient) error {
+		drawNotice(c.transcript.toggle())
+		return nil
+	},
+	config.BindLock: func(c *SessionClient) error {
+		c.locked = !c.locked
+		c.inPaste, c.pasteMatch = false, 0
+		if c.locked {
+			drawNotice(config.Message("input_locked", "Keys", c.lockKeys()))
+		} else {
+			drawNotice(config.Message("input_unlocked"))
+		}
+		return nil
+	},
+	config.BindBroadcast: func(c *SessionClient) error {
+		// Send input to the rest of the group too
+		if !c.ReadOnly {
+			drawNotice(c.toggleBroadcast())
 		}
+		return nil
+	},
+}
+
+// binding returns the action bound to key b, or "" if it has none. Clients
+// without Bindings use those of the config.
+func (c *SessionClient) binding(b byte) string {
+	if c.Bindings == nil {
+		c.Bindings, _ = config.ParseBindings(config.Current().Bindings)
 	}
-	return nil
+	return c.Bindings[b]
 }
 
-func (c *SessionClient) DrainInput() error {
-	// Send Device Status Report (DSR) request.
-	_, _ = os.Stdout.Write([]byte("\x1b[6n"))
+// lockKeys returns the keys unlocking input, e.g. "ctrl-d, l"
+func (c *SessionClient) lockKeys() string {
+	c.binding(0)
+	key := -1
+	for b, action := range c.Bindings {
+		if action == config.BindLock && (key < 0 || int(b) < key) {
+			key = int(b)
+		}
+	}
+	if key < 0 {
+		return config.KeyName(c.DetachKey)
+	}
+	return config.KeyName(c.DetachKey) + ", " + config.KeyName(byte(key))
+}
+
+// stop sets flag, which tells Stream why the connection was closed, and
+// closes it. It returns io.EOF to stop processing input.
+func (c *SessionClient) stop(flag *int32) error {
+	atomic.StoreInt32(flag, 1)
+	if c.fanout != nil {
+		c.fanout.close()
+	}
+	_ = c.conn().Close()
+	return io.EOF
+}
+
+// startCopyMode shows the session's screen and history in copy mode. Session
+// output is held until it ends.
+func (c *SessionClient) startCopyMode() {
+	text, err := Capture(c.Name, c.sockPath, copyHistory)
+	if err != nil {
+		drawNotice(config.Message("copy_failed", "Err", err))
+		return
+	}
+	rows, cols := 24, 80
+	if ws, err := unix.IoctlGetWinsize(int(os.Stdin.Fd()), unix.TIOCGWINSZ); err == nil && ws.Row > 0 && ws.Col > 0 {
+		rows, cols = int(ws.Row), int(ws.Col)
+	}
+	c.tab.hold()
+	c.copying = newCopyMode(os.Stdout, text, rows, cols)
+	c.copying.render()
+}
+
+// copyInput passes input to copy mode. When it ends, the session's screen is
+// redrawn as the daemon has it and the selected lines are copied.
+func (c *SessionClient) copyInput(data []byte) {
+	text, done := c.copying.input(data)
+	if !done {
+		c.copying.render()
+		return
+	}
+	c.copying = nil
+	screen, offset := renderScreen(c.Name, c.sockPath)
+	c.tab.release(screen, offset)
+	if text != "" {
+		drawNotice(copyText(text))
+	}
+}
+
+// copyText copies text to the default paste buffer and to the clipboard of
+// the terminal with OSC 52, and returns the notice to show.
+func copyText(text string) string {
+	if err := session.WriteBuffer(session.DefaultBuffer, []byte(text)); err != nil {
+		return config.Message("copy_failed", "Err", err)
+	}
+	_, _ = os.Stdout.Write([]byte("\x1b]52;c;" + base64.StdEncoding.EncodeToString([]byte(text)) + "\a"))
+	return config.Message("lines_copied", "Lines", strings.Count(text, "\n"), "Buffer", session.DefaultBuffer)
+}
+
+// PasteData returns data as the session's application expects a paste:
+// between bracketed paste markers if it enabled them, so an editor doesn't
+// auto-indent it and a shell doesn't run it line by line. End markers in
+// data are dropped so that it can't end the paste early.
+func PasteData(name string, sockPath string, data []byte) []byte {
+	st, err := Query(name, sockPath)
+	if err != nil || !st.BracketedPaste {
+		return data
+	}
+	data = bytes.ReplaceAll(data, pasteEnd, nil)
+	return slices.Concat(pasteStart, data, pasteEnd)
+}
+
+// paste sends the most recently written paste buffer to the session as
+// input, in packets of at most MaxPayloadSize
+func (c *SessionClient) paste() error {
+	if c.ReadOnly && !c.writable.Load() {
+		return nil
+	}
+	data, err := session.ReadBuffer("")
+	if err != nil {
+		drawNotice(config.Message("paste_notice_failed", "Err", err))
+		return nil
+	}
+	data = PasteData(c.Name, c.sockPath, data)
+	for len(data) > 0 {
+		n := min(len(data), protocol.MaxPayloadSize)
+		if err := protocol.WritePacket(c.conn(), protocol.TypeData, data[:n]); err != nil {
+			return err
+		}
+		if c.fanout != nil {
+			c.fanout.send(data[:n])
+		}
+		data = data[n:]
+	}
+	return nil
+}
 
-	// Start Stdin reader
+// StartInput starts forwarding stdin chunks to the client's input channel.
+func (c *SessionClient) StartInput() {
 	go func() {
-		buf := make([]byte, 1024)
+		// Large reads keep pastes in few chunks
+		buf := make([]byte, 32*1024)
 		for {
 			n, err := os.Stdin.Read(buf)
 			if n > 0 {
@@ -136,56 +523,75 @@ func (c *SessionClient) DrainInput() error {
 			}
 		}
 	}()
+}
+
+func (c *SessionClient) DrainInput() error {
+	// Send Device Status Report (DSR) request.
+	_, _ = os.Stdout.Write([]byte("\x1b[6n"))
 
 	// Drain Phase
-	var drainBuf []byte
+	// Input read during replay may already contain terminal responses
+	drainBuf := c.pending
+	c.pending = nil
 	deadline := time.After(1000 * time.Millisecond)
 	inactivity := time.NewTimer(250 * time.Millisecond)
 	defer inactivity.Stop()
 
-DrainLoop:
-	for {
-		select {
-		case chunk, ok := <-c.stdinCh:
-			if !ok {
-				return nil // Stdin closed
+	// consume swallows terminal responses in drainBuf and forwards everything else.
+	// It returns false if input processing requested a stop.
+	consume := func() bool {
+		for {
+			seqLen := matchTerminalResponse(drainBuf)
+			if seqLen <= 0 {
+				break
 			}
-			drainBuf = append(drainBuf, chunk...)
-
-			for {
-				seqLen := matchTerminalResponse(drainBuf)
-				if seqLen <= 0 {
-					break
-				}
 
-				// Found a response!
-				// 1. Forward anything BEFORE the sequence
-				escIdx := bytes.Index(drainBuf, []byte("\x1b"))
-				if escIdx > 0 {
-					if err := c.processInput(drainBuf[:escIdx]); err != nil {
-						return nil
-					}
+			// Found a response!
+			// 1. Forward anything BEFORE the sequence
+			escIdx := bytes.Index(drainBuf, []byte("\x1b"))
+			if escIdx > 0 {
+				if err := c.processInput(drainBuf[:escIdx]); err != nil {
+					return false
 				}
+			}
 
-				// 2. Swallow the sequence
+			// 2. Swallow the sequence
 			drainBuf = drainBuf[escIdx+seqLen:]
 
-				// Reset inactivity timer
-				if !inactivity.Stop() {
-					select {
-					case <-inactivity.C:
-					default:
-					}
+			// Reset inactivity timer
+			if !inactivity.Stop() {
+				select {
+				case <-inactivity.C:
+				default:
 				}
-				inactivity.Reset(100 * time.Millisecond)
 			}
+			inactivity.Reset(100 * time.Millisecond)
+		}
 
-			// Forward non-escape data
-			if len(drainBuf) > 0 && !bytes.Contains(drainBuf, []byte("\x1b")) {
-				if err := c.processInput(drainBuf); err != nil {
-					return nil
-				}
-				drainBuf = nil
+		// Forward non-escape data
+		if len(drainBuf) > 0 && !bytes.Contains(drainBuf, []byte("\x1b")) {
+			if err := c.processInput(drainBuf); err != nil {
+				return false
+			}
+			drainBuf = nil
+		}
+		return true
+	}
+
+	if !consume() {
+		return nil
+	}
+
+DrainLoop:
+	for {
+		select {
+		case chunk, ok := <-c.stdinCh:
+			if !ok {
+				return nil // Stdin closed
+			}
+			drainBuf = append(drainBuf, chunk...)
+			if !consume() {
+				return nil
 			}
 
 			// Safety limit
@@ -213,57 +619,254 @@ DrainLoop:
 }
 
 func (c *SessionClient) Stream() error {
+	// Copy mode ends with the attachment
+	defer c.tab.release(nil, 0)
+
 	// 5. Initial Resize
-	if !c.ReadOnly {
-		sendResize(c.Conn)
-	}
+	// Read-only clients report their size too so the server's resize policy can account for them
+	sendResize(c.conn())
 
 	// 6. Handle Resize Signals
-	if !c.ReadOnly {
-		sigCh := make(chan os.Signal, 1)
-		signal.Notify(sigCh, syscall.SIGWINCH)
-		go func() {
-			for range sigCh {
-				sendResize(c.Conn)
-			}
-		}()
-	}
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGWINCH)
+	defer signal.Stop(sigCh)
+	go func() {
+		for range sigCh {
+			sendResize(c.conn())
+		}
+	}()
 
 	// 7. Stdin -> Socket (Main Loop)
 	// We continue reading from stdinCh
 	go func() {
-		for chunk := range c.stdinCh {
-			if err := c.processInput(chunk); err != nil {
+		for {
+			var chunk []byte
+			select {
+			case data, ok := <-c.stdinCh:
+				if !ok {
+					return
+				}
+				chunk = data
+			case <-c.prefixExpiry():
+				// Sends the prefix on its own
+			}
+			// Input typed while the connection is lost is dropped, a reconnect
+			// may follow. Other failures, e.g. of a binding, are shown.
+			err := c.processInput(chunk)
+			var netErr *net.OpError
+			switch {
+			case err == io.EOF:
 				return
+			case err != nil && !errors.As(err, &netErr) && !errors.Is(err, net.ErrClosed):
+				drawNotice(config.Message("input_failed", "Err", err))
 			}
 		}
 	}()
 
 	// 8. Socket -> Stdout
+	packets := c.newReader()
 	for {
-		t, payload, err := protocol.ReadPacket(c.Conn)
+		t, payload, err := packets.ReadPacket()
 		if err != nil {
 			if atomic.LoadInt32(&c.detached) == 1 {
 				restoreTerminal()
 				return ErrDetached
 			}
-			return nil
+			if atomic.LoadInt32(&c.switching) == 1 {
+				restoreTerminal()
+				return ErrSwitch
+			}
+			// The daemon ends with TypeExit or TypeKick, anything else is a lost connection
+			if !c.reconnect() {
+				return nil
+			}
+			packets = c.newReader()
+			continue
 		}
 		switch t {
+		case protocol.TypeLimit:
+			c.setLimit(payload, packets)
+		case protocol.TypeResume:
+			c.resume.start(payload)
+		case protocol.TypeClients:
+			if notice := peersNotice(payload); notice != "" {
+				drawNotice(notice)
+			}
 		case protocol.TypeData:
-			_, _ = os.Stdout.Write(payload)
+			c.resume.offset += uint64(len(payload))
+			c.tab.write(payload, c.resume.end())
+			c.transcript.write(payload)
+			c.ack(len(payload))
 		case protocol.TypeKick:
 			restoreTerminal()
-			return ErrKicked
+			return &KickedError{By: string(payload)}
+		case protocol.TypeRefused:
+			return refusedError(payload)
+		case protocol.TypeError:
+			// Only rejected input leaves the connection open
+			err := daemonError(payload)
+			var daemonErr *protocol.Error
+			if errors.As(err, &daemonErr) && (daemonErr.Code == protocol.ErrorNoWriteAccess || daemonErr.Code == protocol.ErrorLocked) {
+				drawNotice(config.Message("daemon_error", "Err", err))
+				break
+			}
+			restoreTerminal()
+			return err
+		case protocol.TypeExit:
+			return nil
+		case protocol.TypeConfirm:
+			if len(payload) == 0 {
+				c.confirming.Store(false)
+				drawNotice(config.Message("guard_expired"))
+				break
+			}
+			c.confirming.Store(true)
+			drawNotice(config.Message("guard_prompt", "Pattern", string(payload)))
+		case protocol.TypeResize:
+			if c.ReadOnly {
+				rows, cols := protocol.DecodeResizePayload(payload)
+				c.showSizeNotice(rows, cols)
+			}
+		case protocol.TypeGrant:
+			c.showGrant(payload)
+		case protocol.TypeJoin:
+			showJoin(payload)
+		case protocol.TypeMessage:
+			showMessage(payload)
+		case protocol.TypePing:
+			// Output before the ping has reached the terminal
+			_ = protocol.WritePacket(c.conn(), protocol.TypePing, nil)
+		}
+	}
+}
+
+// showGrant handles a change of write access: a viewer starts or stops
+// sending input, the Master learns whose access changed.
+func (c *SessionClient) showGrant(payload []byte) {
+	granted := len(payload) > 0 && payload[0] == 1
+	switch {
+	case c.ReadOnly:
+		c.writable.Store(granted)
+		if granted {
+			drawNotice(config.Message("write_granted"))
+		} else {
+			drawNotice(config.Message("write_revoked"))
 		}
+	case len(payload) <= 1:
+		drawNotice(config.Message("no_viewers"))
+	case granted:
+		drawNotice(config.Message("write_granted_to", "Client", string(payload[1:])))
+	default:
+		drawNotice(config.Message("write_revoked_from", "Client", string(payload[1:])))
+	}
+}
+
+// showJoin tells the user that another client attached to the session
+func showJoin(payload []byte) {
+	var joined protocol.ClientInfo
+	if err := json.Unmarshal(payload, &joined); err != nil {
+		return
+	}
+	drawNotice(config.Message("client_joined", "Client", joined.Identity.Short(), "ReadOnly", joined.ReadOnly, "From", joined.From))
+}
+
+// showMessage draws a message sent with SendMessage. Control characters are
+// dropped, so the sender can't move the cursor or change terminal modes.
+func showMessage(payload []byte) {
+	var msg protocol.Message
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return
+	}
+	drawNotice(config.Message("message", "Text", printable(msg.Text), "From", printable(msg.From)))
+}
+
+// printable replaces line breaks and tabs in s with spaces and drops other
+// control characters
+func printable(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\n' || r == '\r' || r == '\t':
+			return ' '
+		case unicode.IsControl(r):
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// othersNotice returns the line listing the clients attached besides this
+// one, or an empty string if there are none
+func othersNotice(clients []protocol.ClientInfo, self protocol.Identity) string {
+	var others []string
+	for _, ci := range clients {
+		if ci.PID == self.PID && ci.Host == self.Host {
+			continue
+		}
+		label := ci.Identity.Short()
+		if ci.ReadOnly && !ci.Writable {
+			label += " (read-only)"
+		}
+		others = append(others, label)
+	}
+	if len(others) == 0 {
+		return ""
+	}
+	return config.Message("also_attached", "Clients", strings.Join(others, ", "), "Count", len(others))
+}
+
+// showSizeNotice draws a banner on the top line when the session's PTY is
+// larger than this viewer's terminal, since output will wrap incorrectly.
+func (c *SessionClient) showSizeNotice(rows, cols uint16) {
+	w, h, err := term.GetSize(int(os.Stdin.Fd()))
+	if err != nil {
+		return
+	}
+	if notice := sizeNotice(rows, cols, uint16(h), uint16(w)); notice != "" {
+		drawNotice(notice)
+	}
+}
+
+// drawNotice shows a message on the top line without moving the cursor
+// peersNotice returns othersNotice for the TypeClients list the daemon sends
+// clients attaching with CapPeers
+func peersNotice(payload []byte) string {
+	var clients []protocol.ClientInfo
+	if json.Unmarshal(payload, &clients) != nil {
+		return ""
+	}
+	return othersNotice(clients, localIdentity())
+}
+
+func drawNotice(notice string) {
+	// Save cursor, draw in reverse video on the first line, restore cursor
+	_, _ = os.Stdout.Write([]byte("\x1b7\x1b[1;1H\x1b[7m" + notice + "\x1b[0m\x1b[K\x1b8"))
+}
+
+// sizeNotice returns a warning message if the session size exceeds the local
+// terminal size, or an empty string if the session fits.
+func sizeNotice(sessRows, sessCols, rows, cols uint16) string {
+	if sessRows == 0 || sessCols == 0 || (sessRows <= rows && sessCols <= cols) {
+		return ""
 	}
+	return config.Message("size_warning", "Cols", sessCols, "Rows", sessRows, "WindowCols", cols, "WindowRows", rows)
 }
 
-// Attach connects to an existing session
-func Attach(name string, sockPath string, replay bool, readOnly bool, tail int) error {
-	detachByte := parseDetachKey(config.Global.DetachKey)
+// Attach connects to an existing session. If transcriptPath is set, live
+// output is also saved to that file.
+func Attach(name string, sockPath string, replay bool, readOnly bool, exclusive bool, tail int, transcriptPath string) error {
+	detachByte := parseDetachKey(config.Current().DetachKey)
 	client := NewSessionClient(name, detachByte, readOnly)
+	client.Replay, client.Tail, client.Exclusive, client.Peers = replay, tail, exclusive, true
+	client.PrefixTimeout = time.Duration(config.Current().PrefixTimeout * float64(time.Second))
+	client.tab = newTabRelay()
+	if transcriptPath != "" {
+		if err := client.transcript.start(transcriptPath); err != nil {
+			return err
+		}
+	}
+	defer client.transcript.stop()
 
+	done := timing.Track("connect")
 	if err := client.Connect(sockPath); err != nil {
 		return err
 	}
@@ -272,6 +875,7 @@ func Attach(name string, sockPath string, replay bool, readOnly bool, tail int)
 	if err := client.Handshake(); err != nil {
 		return err
 	}
+	done()
 
 	// Raw Mode
 	// We enter raw mode early to handle log replay correctly and drain input
@@ -281,35 +885,67 @@ func Attach(name string, sockPath string, replay bool, readOnly bool, tail int)
 	}
 	defer func() { _ = term.Restore(int(os.Stdin.Fd()), oldState) }()
 
+	client.StartInput()
+
 	// Replay Log
 	if replay {
-		logFiles, _ := session.GetLogFiles(name)
-		for _, lp := range logFiles {
-			f, err := os.Open(lp)
-			if err == nil {
-				if tail > 0 {
-					replayTail(os.Stdout, f, tail)
-				} else {
-					_, _ = io.Copy(os.Stdout, f)
-				}
-				_ = f.Close()
-			}
+		done = timing.Track("replay")
+		client.replay(tail, config.Current().ReplayRate)
+		done()
+		if client.refused != nil {
+			return client.refused
 		}
 	}
 
+	// Show the banner last so warnings are not scrolled away by the replay
+	if info, err := session.ReadInfo(name); err == nil {
+		_, _ = os.Stdout.Write([]byte(session.BannerFor(info)))
+	}
+	if client.others != "" {
+		_, _ = os.Stdout.Write([]byte("\x1b[7m" + client.others + "\x1b[0m\r\n"))
+	}
+
+	done = timing.Track("terminal sync")
 	if err := client.DrainInput(); err != nil {
 		return err
 	}
+	done()
+
+	// Let the terminal label the tab with the session and follow its directory
+	client.tab.announce(name)
+	defer client.tab.announce("")
+	stopRelay := make(chan struct{})
+	defer close(stopRelay)
+	go client.tab.relayCwd(name, sockPath, stopRelay)
+	defer func() {
+		if client.fanout != nil {
+			client.fanout.close()
+		}
+	}()
 
 	return client.Stream()
 }
 
+// refusedError wraps ErrRefused with the reason sent by the daemon
+func refusedError(reason []byte) error {
+	if len(reason) == 0 {
+		return ErrRefused
+	}
+	return fmt.Errorf("%w: %s", ErrRefused, reason)
+}
+
 // restoreTerminal sends escape sequences to reset terminal modes
 func restoreTerminal() {
 	_, _ = os.Stdout.Write([]byte("\x1b[m\x1b[?1049l\x1b[?1000l\x1b[?1002l\x1b[?1003l\x1b[?1006l\x1b[?2004l\x1b[?25h\x1b[H\x1b[2J"))
 }
 
 func replayTail(w io.Writer, f *os.File, n int) {
+	// With an index only the end of the log is read
+	if data, ok := session.ReadTail(f.Name(), n, damagedNotice); ok {
+		writeTail(w, data)
+		return
+	}
+
 	stat, _ := f.Stat()
 	size := stat.Size()
 	if size == 0 {
@@ -338,7 +974,7 @@ func replayTail(w io.Writer, f *os.File, n int) {
 				lines++
 				if lines >= n {
 					finalData = append(buf[i+1:], finalData...)
-					_, _ = w.Write(finalData)
+					writeTail(w, finalData)
 					return
 				}
 			}
@@ -353,28 +989,18 @@ func replayTail(w io.Writer, f *os.File, n int) {
 			offset = 0
 		}
 	}
-	_, _ = w.Write(finalData)
+	writeTail(w, finalData)
+}
+
+// writeTail writes tailed output without inline graphics: they have no line
+// structure, and a tail cut through one would print its payload as text.
+func writeTail(w io.Writer, data []byte) {
+	_, _ = w.Write(ansi.StripGraphics(ansi.TrimPartialString(data)))
 }
 
 func parseDetachKey(key string) byte {
-	key = strings.ToLower(key)
-	if len(key) >= 6 && key[:5] == "ctrl-" {
-		c := key[5]
-		if c >= 'a' && c <= 'z' {
-			return byte(c - 'a' + 1)
-		}
-		switch c {
-		case '[':
-			return 27
-		case '\\':
-			return 28
-		case ']':
-			return 29
-		case '^':
-			return 30
-		case '_':
-			return 31
-		}
+	if b, err := config.ParseDetachKey(key); err == nil {
+		return b
 	}
 	return 0x04 // default ctrl-d
 }
@@ -419,37 +1045,821 @@ func matchTerminalResponse(data []byte) int {
 	return 0
 }
 
+// ackThreshold is how much output a client writes to the terminal before it
+// acknowledges it, well below protocol.FlowWindow so the daemon never waits
+// for an acknowledgement that is merely batched up.
+const ackThreshold = protocol.FlowWindow / 4
+
+// ack acknowledges n bytes of output written to the terminal, once enough piled up
+func (c *SessionClient) ack(n int) {
+	c.unacked += uint32(n)
+	if c.unacked >= ackThreshold {
+		_ = protocol.WritePacket(c.conn(), protocol.TypeAck, protocol.AckPayload(c.unacked))
+		c.unacked = 0
+	}
+}
+
 func sendResize(conn net.Conn) {
-	w, h, err := term.GetSize(int(os.Stdin.Fd()))
+	// TIOCGWINSZ also reports the window size in pixels, which graphics-capable TUIs need
+	ws, err := unix.IoctlGetWinsize(int(os.Stdin.Fd()), unix.TIOCGWINSZ)
 	if err != nil {
 		return
 	}
-	payload := protocol.ResizePayload(uint16(h), uint16(w))
+	payload := protocol.SizePayload(ws.Row, ws.Col, ws.Xpixel, ws.Ypixel)
 	_ = protocol.WritePacket(conn, protocol.TypeResize, payload)
 }
 
-// Kill sends a termination signal to the session
-func Kill(name string, sockPath string) error {
+// dialControl opens a control connection to a session. Control connections
+// manage the session without attaching to it or kicking the Master.
+func dialControl(name string, sockPath string) (net.Conn, error) {
 	var err error
 	if sockPath == "" {
-		sockPath, err = session.GetSocketPath(name)
+		sockPath, err = session.ResolveSocketPath(name)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
-
 	conn, err := net.Dial("unix", sockPath)
 	if err != nil {
-		return err
+		return nil, session.Classify(err)
 	}
-	defer func() { _ = conn.Close() }()
-
-	// Send Mode (Master mode to ensure signal is processed)
-	if err := protocol.WritePacket(conn, protocol.TypeMode, []byte{protocol.ModeMaster}); err != nil {
+	if err := protocol.WritePacket(conn, protocol.TypeMode, []byte{protocol.ModeControl, protocol.ControlErrors}); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// replyError turns the error reply of a control request back into an error,
+// for daemons that predate TypeError and only send the message. Replies
+// starting with one of the session errors match it with errors.Is.
+func replyError(reply []byte) error {
+	msg := string(reply)
+	for _, kind := range []error{session.ErrSessionNotFound, session.ErrSessionExists, session.ErrNotOwner, session.ErrStateReadOnly, session.ErrInvalidName} {
+		if rest, ok := strings.CutPrefix(msg, kind.Error()); ok {
+			return fmt.Errorf("%w%s", kind, rest)
+		}
+	}
+	return errors.New(msg)
+}
+
+// errorKinds are the session errors TypeError codes stand for
+var errorKinds = map[protocol.ErrorCode]error{
+	protocol.ErrorInvalidName:   session.ErrInvalidName,
+	protocol.ErrorSessionExists: session.ErrSessionExists,
+	protocol.ErrorAuth:          session.ErrNotOwner,
+	protocol.ErrorStateReadOnly: session.ErrStateReadOnly,
+}
+
+// sessionError is a TypeError whose code stands for one of the session
+// errors. It matches both with errors.Is and keeps the daemon's message.
+type sessionError struct {
+	err  *protocol.Error
+	kind error
+}
+
+func (e *sessionError) Error() string   { return e.err.Message }
+func (e *sessionError) Unwrap() []error { return []error{e.kind, e.err} }
+
+// daemonError turns a TypeError payload into an error, which matches the
+// session error its code stands for with errors.Is.
+func daemonError(payload []byte) error {
+	err := protocol.DecodeErrorPayload(payload)
+	if kind, ok := errorKinds[err.Code]; ok {
+		return &sessionError{err: err, kind: kind}
+	}
+	return err
+}
+
+// unexpectedReply returns the error for a reply of type t to a control
+// request, which is the daemon's own for a TypeError.
+func unexpectedReply(t protocol.Type, reply []byte) error {
+	if t == protocol.TypeError {
+		return daemonError(reply)
+	}
+	return errors.New("unexpected reply from daemon")
+}
+
+// Mark records a mark named mark at the end of a session's log so far
+func Mark(name string, sockPath string, mark string) error {
+	conn, err := dialControl(name, sockPath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+
+	if err := protocol.WritePacket(conn, protocol.TypeMark, []byte(mark)); err != nil {
+		return err
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(replyTimeout))
+	t, reply, err := protocol.ReadPacket(conn)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("%w to set marks", protocol.ErrProtocolVersion)
+	}
+	if err != nil {
+		return err
+	}
+	if t != protocol.TypeMark {
+		return unexpectedReply(t, reply)
+	}
+	if len(reply) > 0 {
+		return replyError(reply)
+	}
+	return nil
+}
+
+// Rename asks a running session's daemon to rename the session
+func Rename(name string, newName string, sockPath string) error {
+	conn, err := dialControl(name, sockPath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+
+	if err := protocol.WritePacket(conn, protocol.TypeRename, []byte(newName)); err != nil {
+		return err
+	}
+	t, payload, err := protocol.ReadPacket(conn)
+	if err != nil {
+		return err
+	}
+	if t != protocol.TypeRename {
+		return unexpectedReply(t, payload)
+	}
+	if len(payload) > 0 {
+		return replyError(payload)
+	}
+	return nil
+}
+
+// Suspend asks a running session's daemon to stop all of the session's processes
+func Suspend(name string, sockPath string) error {
+	return setSuspended(name, sockPath, true)
+}
+
+// Resume continues the processes of a suspended session
+func Resume(name string, sockPath string) error {
+	return setSuspended(name, sockPath, false)
+}
+
+func setSuspended(name string, sockPath string, stop bool) error {
+	payload := []byte{0}
+	if stop {
+		payload[0] = 1
+	}
+	return request(name, sockPath, protocol.TypeSuspend, payload)
+}
+
+// Reload makes a running session's daemon reload the config file
+func Reload(name string, sockPath string) error {
+	return request(name, sockPath, protocol.TypeReload, nil)
+}
+
+// ChangeMeta makes a running session's daemon change the session's tags or
+// group, so the change doesn't race with the daemon's own info updates.
+func ChangeMeta(name string, sockPath string, change session.MetaChange) error {
+	payload, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	return request(name, sockPath, protocol.TypeMeta, payload)
+}
+
+// InjectSecret makes a running session's daemon write secret to the PTY
+// without logging the output that follows. Unless force is set, the daemon
+// refuses if the terminal echoes input, i.e. isn't at a password prompt.
+func InjectSecret(name string, sockPath string, secret []byte, force bool) error {
+	payload := make([]byte, 1, len(secret)+1)
+	if force {
+		payload[0] = 1
+	}
+	payload = append(payload, secret...)
+	defer clear(payload)
+	return request(name, sockPath, protocol.TypeSecret, payload)
+}
+
+// Pipe makes a running session's daemon feed live output into command, run
+// with sh. An empty command stops the pipe.
+func Pipe(name string, sockPath string, command string) error {
+	return request(name, sockPath, protocol.TypePipe, []byte(command))
+}
+
+// replyTimeout bounds the wait for a reply from daemons that predate a
+// request type such as TypeRegister and ignore it.
+const replyTimeout = 2 * time.Second
+
+// Register asks a daemon whose session files were deleted to write them again.
+func Register(name string, sockPath string) error {
+	conn, err := dialControl(name, sockPath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+
+	if err := protocol.WritePacket(conn, protocol.TypeRegister, nil); err != nil {
+		return err
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(replyTimeout))
+	t, reply, err := protocol.ReadPacket(conn)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("%w to register again", protocol.ErrProtocolVersion)
+	}
+	if err != nil {
+		return err
+	}
+	if t != protocol.TypeRegister {
+		return unexpectedReply(t, reply)
+	}
+	if len(reply) > 0 {
+		return replyError(reply)
+	}
+	return nil
+}
+
+// localIdentity describes this client to the daemon
+func localIdentity() protocol.Identity {
+	id := protocol.Identity{User: os.Getenv("USER"), Host: session.Hostname(), PID: os.Getpid(), Term: os.Getenv("TERM"), ColorTerm: os.Getenv("COLORTERM")}
+	if u, err := user.Current(); id.User == "" && err == nil {
+		id.User = u.Username
+	}
+	// Only Linux exposes the terminal of a file descriptor this way
+	if tty, err := os.Readlink("/proc/self/fd/0"); err == nil && strings.HasPrefix(tty, "/dev/") {
+		id.TTY = tty
+	}
+	// SSH_CONNECTION is "client-ip client-port server-ip server-port"
+	if fields := strings.Fields(os.Getenv("SSH_CONNECTION")); len(fields) > 0 {
+		id.From = fields[0]
+	}
+	return id
+}
+
+// Clients returns the clients attached to a session, oldest first.
+func Clients(name string, sockPath string) ([]protocol.ClientInfo, error) {
+	conn, err := dialControl(name, sockPath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = conn.Close() }()
+
+	if err := protocol.WritePacket(conn, protocol.TypeClients, nil); err != nil {
+		return nil, err
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(replyTimeout))
+	t, reply, err := protocol.ReadPacket(conn)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return nil, fmt.Errorf("%w to list its clients", protocol.ErrProtocolVersion)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if t != protocol.TypeClients {
+		return nil, unexpectedReply(t, reply)
+	}
+	var list []protocol.ClientInfo
+	err = json.Unmarshal(reply, &list)
+	return list, err
+}
+
+// Kick detaches the client with the given ID, as listed by Clients, from a
+// session. The client is told it was detached by this process.
+func Kick(name string, sockPath string, id int) error {
+	conn, err := dialControl(name, sockPath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+
+	if err := protocol.WritePacket(conn, protocol.TypeKick, protocol.KickPayload(id, localIdentity().String())); err != nil {
+		return err
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(replyTimeout))
+	t, reply, err := protocol.ReadPacket(conn)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("%w to kick clients", protocol.ErrProtocolVersion)
+	}
+	if err != nil {
+		return err
+	}
+	if t != protocol.TypeKick {
+		return unexpectedReply(t, reply)
+	}
+	if len(reply) > 0 {
+		return replyError(reply)
+	}
+	return nil
+}
+
+// Detach detaches the Master of a session, or all its clients. Unlike an
+// attach, this doesn't wait for a stale Master to time out.
+func Detach(name string, sockPath string, all bool) error {
+	conn, err := dialControl(name, sockPath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+
+	flag := byte(0)
+	if all {
+		flag = 1
+	}
+	if err := protocol.WritePacket(conn, protocol.TypeDetach, append([]byte{flag}, localIdentity().String()...)); err != nil {
+		return err
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(replyTimeout))
+	t, reply, err := protocol.ReadPacket(conn)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("%w to detach clients", protocol.ErrProtocolVersion)
+	}
+	if err != nil {
+		return err
+	}
+	if t != protocol.TypeDetach {
+		return unexpectedReply(t, reply)
+	}
+	if len(reply) > 0 {
+		return replyError(reply)
+	}
+	return nil
+}
+
+// SendMessage shows text as a status message on every client attached to a
+// session, signed with the user and host of this process.
+func SendMessage(name string, sockPath string, text string) error {
+	conn, err := dialControl(name, sockPath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+
+	payload, err := json.Marshal(protocol.Message{Text: text, From: localIdentity().Short()})
+	if err != nil {
+		return err
+	}
+	if err := protocol.WritePacket(conn, protocol.TypeMessage, payload); err != nil {
+		return err
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(replyTimeout))
+	t, reply, err := protocol.ReadPacket(conn)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("%w to send messages", protocol.ErrProtocolVersion)
+	}
+	if err != nil {
+		return err
+	}
+	if t != protocol.TypeMessage {
+		return unexpectedReply(t, reply)
+	}
+	if len(reply) > 0 {
+		return replyError(reply)
+	}
+	return nil
+}
+
+// Grant grants or revokes write access of the read-only client with the
+// given ID, as listed by Clients.
+func Grant(name string, sockPath string, id int, writable bool) error {
+	conn, err := dialControl(name, sockPath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+
+	if err := protocol.WritePacket(conn, protocol.TypeGrant, protocol.GrantPayload(id, writable, localIdentity().String())); err != nil {
+		return err
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(replyTimeout))
+	t, reply, err := protocol.ReadPacket(conn)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("%w to change write access", protocol.ErrProtocolVersion)
+	}
+	if err != nil {
+		return err
+	}
+	if t != protocol.TypeGrant {
+		return unexpectedReply(t, reply)
+	}
+	if len(reply) > 0 {
+		return replyError(reply)
+	}
+	return nil
+}
+
+// PruneHistory asks a running session's daemon to remove old output from its
+// log files and returns the number of bytes removed, see protocol.Prune.
+func PruneHistory(name string, sockPath string, req protocol.Prune) (int64, error) {
+	conn, err := dialControl(name, sockPath)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = conn.Close() }()
+
+	data, _ := json.Marshal(req)
+	if err := protocol.WritePacket(conn, protocol.TypePrune, data); err != nil {
+		return 0, err
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(replyTimeout))
+	t, reply, err := protocol.ReadPacket(conn)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return 0, fmt.Errorf("%w to prune its history", protocol.ErrProtocolVersion)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if t != protocol.TypePrune {
+		return 0, unexpectedReply(t, reply)
+	}
+	// That was the acknowledgement, rewriting large files takes a while
+	_ = conn.SetReadDeadline(time.Time{})
+	t, reply, err = protocol.ReadPacket(conn)
+	if err != nil {
+		return 0, err
+	}
+	if t != protocol.TypePrune {
+		return 0, unexpectedReply(t, reply)
+	}
+	var res protocol.PruneResult
+	if err := json.Unmarshal(reply, &res); err != nil {
+		return 0, err
+	}
+	if res.Error != "" {
+		return res.Removed, errors.New(res.Error)
+	}
+	return res.Removed, nil
+}
+
+// Capture returns the text on a session's screen, preceded by up to history
+// lines scrolled off it.
+func Capture(name string, sockPath string, history int) (string, error) {
+	payload := binary.BigEndian.AppendUint32(nil, uint32(max(history, 0)))
+	reply, err := capture(name, sockPath, payload)
+	return string(reply), err
+}
+
+// renderScreen returns terminal output redrawing a session's screen and the
+// output offset it shows, see protocol.CaptureRender. It returns nil if the
+// daemon can't render it.
+func renderScreen(name string, sockPath string) ([]byte, uint64) {
+	payload := append(binary.BigEndian.AppendUint32(nil, 0), protocol.CaptureRender)
+	reply, err := capture(name, sockPath, payload)
+	if err != nil || len(reply) < 8 || !bytes.HasPrefix(reply, []byte("\x1b[")) {
+		return nil, 0
+	}
+	n := len(reply) - 8
+	return reply[:n], binary.BigEndian.Uint64(reply[n:])
+}
+
+// capture sends a TypeCapture request with payload and returns the reply.
+func capture(name string, sockPath string, payload []byte) ([]byte, error) {
+	conn, err := dialControl(name, sockPath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = conn.Close() }()
+
+	if err := protocol.WritePacket(conn, protocol.TypeCapture, payload); err != nil {
+		return nil, err
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(replyTimeout))
+	t, reply, err := protocol.ReadPacket(conn)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return nil, fmt.Errorf("%w to capture the screen", protocol.ErrProtocolVersion)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if t != protocol.TypeCapture {
+		return nil, unexpectedReply(t, reply)
+	}
+	return reply, nil
+}
+
+// SendKeys types keys into a running session without attaching, see
+// protocol.TypeInput. Input longer than a packet is sent in pieces.
+func SendKeys(name string, sockPath string, keys []byte) error {
+	conn, err := dialControl(name, sockPath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+
+	for len(keys) > 0 {
+		n := min(len(keys), protocol.MaxPayloadSize)
+		if err := protocol.WritePacket(conn, protocol.TypeInput, keys[:n]); err != nil {
+			return err
+		}
+		t, reply, err := protocol.ReadPacket(conn)
+		if err != nil {
+			return err
+		}
+		if t != protocol.TypeInput {
+			return unexpectedReply(t, reply)
+		}
+		if len(reply) > 0 {
+			return replyError(reply)
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+// request sends a control packet of type t and waits for the daemon's reply
+// of the same type, which carries an error message or nothing on success.
+func request(name string, sockPath string, t protocol.Type, payload []byte) error {
+	conn, err := dialControl(name, sockPath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+
+	if err := protocol.WritePacket(conn, t, payload); err != nil {
+		return err
+	}
+	rt, reply, err := protocol.ReadPacket(conn)
+	if err != nil {
+		return err
+	}
+	if rt != t {
+		return unexpectedReply(rt, reply)
+	}
+	if len(reply) > 0 {
+		return replyError(reply)
+	}
+	return nil
+}
+
+// Query asks a running session's daemon for its live status
+func Query(name string, sockPath string) (protocol.Status, error) {
+	conn, err := dialControl(name, sockPath)
+	if err != nil {
+		return protocol.Status{}, err
+	}
+	defer func() { _ = conn.Close() }()
+
+	if err := protocol.WritePacket(conn, protocol.TypeQuery, nil); err != nil {
+		return protocol.Status{}, err
+	}
+	t, payload, err := protocol.ReadPacket(conn)
+	if err != nil {
+		return protocol.Status{}, err
+	}
+	if t != protocol.TypeInfo {
+		return protocol.Status{}, unexpectedReply(t, payload)
+	}
+	return protocol.DecodeStatusPayload(payload)
+}
+
+// Wait blocks until the session's command exits and returns its exit status
+func Wait(name string, sockPath string) (int, error) {
+	var err error
+	if sockPath == "" {
+		sockPath, err = session.ResolveSocketPath(name)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	conn, err := net.Dial("unix", sockPath)
+	if err != nil {
+		return 0, session.Classify(err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	// Observe as read-only so the session is not disturbed
+	if err := protocol.WritePacket(conn, protocol.TypeMode, []byte{protocol.ModeReadOnly}); err != nil {
+		return 0, err
+	}
+
+	for {
+		t, payload, err := protocol.ReadPacket(conn)
+		if err != nil {
+			return 0, errors.New("connection closed before exit status was received")
+		}
+		if t == protocol.TypeExit {
+			return protocol.DecodeExitPayload(payload), nil
+		}
+	}
+}
+
+// DefaultKillTimeout is how long Kill waits after a graceful signal before escalating to SIGKILL.
+const DefaultKillTimeout = 3 * time.Second
+
+var signalNames = map[string]syscall.Signal{
+	"TERM": syscall.SIGTERM,
+	"INT":  syscall.SIGINT,
+	"HUP":  syscall.SIGHUP,
+	"KILL": syscall.SIGKILL,
+	"QUIT": syscall.SIGQUIT,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
+
+// ParseSignal converts a signal name like "TERM" or "SIGTERM" into a signal
+func ParseSignal(name string) (syscall.Signal, error) {
+	name = strings.TrimPrefix(strings.ToUpper(name), "SIG")
+	sig, ok := signalNames[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown signal %q", name)
+	}
+	return sig, nil
+}
+
+// Kill sends sig to the session and waits up to timeout for the daemon to
+// exit. Unless sig is SIGKILL, it then escalates to SIGKILL. Even after
+// SIGKILL the daemon still archives the session and audits its end, so
+// commands run right after Kill returns find the session gone.
+func Kill(name string, sockPath string, sig syscall.Signal, timeout time.Duration) error {
+	var err error
+	if sockPath == "" {
+		sockPath, err = session.ResolveSocketPath(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	conn, err := dialControl(name, sockPath)
+	if err != nil {
+		// A daemon waiting for preconditions has no socket and no shell yet
+		if info, infoErr := session.ReadInfo(name); infoErr == nil && info.Waiting != "" && info.IsAlive() {
+			return syscall.Kill(info.PID, sig)
+		}
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+
+	// A control connection signals even a session locked by an exclusive
+	// attach. Daemons that predate it only take signals from the Master.
+	// The sender follows the signal for the audit log.
+	payload := append([]byte{byte(sig)}, localIdentity().String()...)
+	if err := protocol.WritePacket(conn, protocol.TypeSignal, payload); err != nil {
+		return err
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(replyTimeout))
+	t, reply, err := protocol.ReadPacket(conn)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		_ = conn.Close()
+		if conn, err = net.Dial("unix", sockPath); err != nil {
+			return err
+		}
+		if err := protocol.WritePacket(conn, protocol.TypeMode, []byte{protocol.ModeMaster}); err != nil {
+			return err
+		}
+		if err := protocol.WritePacket(conn, protocol.TypeSignal, []byte{byte(sig)}); err != nil {
+			return err
+		}
+	} else if errors.Is(err, io.EOF) {
+		// The daemon exited before replying
+		return nil
+	} else if err != nil {
+		return err
+	} else if t != protocol.TypeSignal {
+		return unexpectedReply(t, reply)
+	}
+	if timeout <= 0 {
+		return nil
+	}
+
+	// Control connections see no TypeExit, but end when the daemon exits.
+	// After SIGKILL this only waits for the daemon to finish its cleanup.
+	if waitExit(conn, timeout) || sig == syscall.SIGKILL {
+		return nil
+	}
+	// Graceful termination timed out
+	if err := protocol.WritePacket(conn, protocol.TypeSignal, append([]byte{byte(syscall.SIGKILL)}, payload[1:]...)); err != nil {
 		return err
 	}
+	// Like after a plain SIGKILL, wait for the daemon to archive the session
+	waitExit(conn, timeout)
+	return nil
+}
 
-	// Send SIGKILL (9) to ensure immediate termination
-	payload := []byte{byte(syscall.SIGKILL)}
-	return protocol.WritePacket(conn, protocol.TypeSignal, payload)
+// Shutdown ends a session gracefully: its daemon tells the attached clients
+// reason, syncs the log and terminates the shell, escalating to SIGKILL after
+// timeout. It returns once the daemon exited, or with an error if it still
+// runs shortly after the escalation.
+func Shutdown(name string, sockPath string, reason string, timeout time.Duration) error {
+	conn, err := dialControl(name, sockPath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+
+	payload, err := json.Marshal(protocol.Shutdown{Reason: reason, From: localIdentity().String(), Timeout: timeout})
+	if err != nil {
+		return err
+	}
+	if err := protocol.WritePacket(conn, protocol.TypeShutdown, payload); err != nil {
+		return err
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(replyTimeout))
+	t, reply, err := protocol.ReadPacket(conn)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("%w to shut down gracefully", protocol.ErrProtocolVersion)
+	}
+	if errors.Is(err, io.EOF) {
+		// The daemon exited before replying
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if t != protocol.TypeShutdown {
+		return unexpectedReply(t, reply)
+	}
+	if len(reply) > 0 {
+		return replyError(reply)
+	}
+	if !waitExit(conn, timeout+shutdownGrace) {
+		return fmt.Errorf("session still running %v after the shutdown", timeout+shutdownGrace)
+	}
+	return nil
+}
+
+// Upgrade hands a session over to the daemon binary exe, which takes over
+// the shell and the clients in place of the running daemon. Attached clients
+// reconnect to it. It returns once the new daemon answers.
+func Upgrade(name string, sockPath string, exe string) error {
+	conn, err := dialControl(name, sockPath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+
+	payload, err := json.Marshal(protocol.Upgrade{Executable: exe, From: localIdentity().String()})
+	if err != nil {
+		return err
+	}
+	sent := time.Now()
+	if err := protocol.WritePacket(conn, protocol.TypeUpgrade, payload); err != nil {
+		return err
+	}
+	// The daemon checks the new binary before handing over
+	_ = conn.SetReadDeadline(time.Now().Add(upgradeTimeout))
+	t, reply, err := protocol.ReadPacket(conn)
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return fmt.Errorf("%w to upgrade", protocol.ErrProtocolVersion)
+	case errors.Is(err, io.EOF):
+		// The daemon was replaced
+	case err != nil:
+		return err
+	case t != protocol.TypeUpgrade:
+		return unexpectedReply(t, reply)
+	case len(reply) > 0:
+		return replyError(reply)
+	default:
+		return fmt.Errorf("session was not handed over")
+	}
+
+	// Connections wait in the socket's backlog until the new daemon accepts them
+	deadline := time.Now().Add(upgradeTimeout)
+	for {
+		st, err := Query(name, sockPath)
+		if err == nil {
+			if st.Upgraded.Before(sent) {
+				return fmt.Errorf("session was not handed over")
+			}
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// upgradeTimeout is how long Upgrade waits for the daemon to hand over, and
+// then for the new daemon to answer
+const upgradeTimeout = 10 * time.Second
+
+// shutdownGrace is how long Shutdown waits for the daemon to exit beyond the
+// shutdown timeout, for the escalation to SIGKILL and the daemon's cleanup
+const shutdownGrace = 2 * time.Second
+
+// waitExit reports whether the session exited within timeout
+func waitExit(conn net.Conn, timeout time.Duration) bool {
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	defer func() { _ = conn.SetReadDeadline(time.Time{}) }()
+	for {
+		t, _, err := protocol.ReadPacket(conn)
+		if err != nil {
+			// A timeout means the session is still running; any other error means the daemon is gone
+			var netErr net.Error
+			return !(errors.As(err, &netErr) && netErr.Timeout())
+		}
+		if t == protocol.TypeExit {
+			return true
+		}
+	}
 }
@@ -2,14 +2,18 @@ package client
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"net"
 	"os"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
+	"persishtent/internal/config"
 	"persishtent/internal/protocol"
+	"persishtent/internal/session"
 )
 
 type mockConn struct {
@@ -133,6 +137,142 @@ data := conn.out.Bytes()
 	}
 }
 
+func TestProcessInput_Batching(t *testing.T) {
+	conn := &mockConn{}
+	client := &SessionClient{
+		Conn:      conn,
+		DetachKey: defaultDetachByte,
+	}
+
+	// A large paste with a literal prefix in the middle
+	paste := bytes.Repeat([]byte("x"), 100*1024)
+	input := append(append(append([]byte{}, paste...), 0x04, 0x04), "tail"...)
+	if err := client.processInput(input); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []byte
+	packets := 0
+	for conn.out.Len() > 0 {
+		typ, payload, err := protocol.ReadPacket(&conn.out)
+		if err != nil || typ != protocol.TypeData {
+			t.Fatalf("Unexpected packet %d: %v", typ, err)
+		}
+		got = append(got, payload...)
+		packets++
+	}
+	want := append(append(paste, 0x04), "tail"...)
+	if !bytes.Equal(got, want) {
+		t.Errorf("Forwarded %d bytes, want %d", len(got), len(want))
+	}
+	// Split only where packets reach the maximum payload size
+	if packets != 2 {
+		t.Errorf("Expected 2 packets, got %d", packets)
+	}
+}
+
+func TestProcessInput_BracketedPaste(t *testing.T) {
+	conn := &mockConn{}
+	client := &SessionClient{
+		Conn:      conn,
+		DetachKey: defaultDetachByte,
+	}
+
+	// The pasted text contains the detach sequence, and the markers are
+	// split across reads
+	chunks := [][]byte{
+		[]byte("a\x1b[20"),
+		[]byte("0~x\x04d\x04"),
+		[]byte("y\x1b[201"),
+		[]byte("~b"),
+	}
+	for _, chunk := range chunks {
+		if err := client.processInput(chunk); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if atomic.LoadInt32(&client.detached) != 0 || client.pendingPrefix {
+		t.Fatal("Prefix key interpreted inside a paste")
+	}
+
+	var got []byte
+	for conn.out.Len() > 0 {
+		_, payload, err := protocol.ReadPacket(&conn.out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, payload...)
+	}
+	if want := "a\x1b[200~x\x04d\x04y\x1b[201~b"; string(got) != want {
+		t.Errorf("Forwarded %q, want %q", got, want)
+	}
+
+	// After the paste, the prefix key works again
+	_ = client.processInput([]byte{0x04})
+	if err := client.processInput([]byte{'d'}); err != io.EOF {
+		t.Errorf("Expected detach after the paste, got %v", err)
+	}
+}
+
+func TestProcessInput_Confirm(t *testing.T) {
+	conn := &mockConn{}
+	client := &SessionClient{
+		Conn:      conn,
+		DetachKey: defaultDetachByte,
+	}
+	client.confirming.Store(true)
+
+	// The answer is sent as a confirmation, not as input
+	if err := client.processInput([]byte("yes")); err != nil {
+		t.Fatal(err)
+	}
+	typ, payload, err := protocol.ReadPacket(&conn.out)
+	if err != nil || typ != protocol.TypeConfirm || string(payload) != "y" {
+		t.Errorf("Expected confirmation 'y', got %d %q (%v)", typ, payload, err)
+	}
+	typ, payload, _ = protocol.ReadPacket(&conn.out)
+	if typ != protocol.TypeData || string(payload) != "es" {
+		t.Errorf("Expected remaining input, got %d %q", typ, payload)
+	}
+	if client.confirming.Load() {
+		t.Error("Confirmation still pending")
+	}
+}
+
+func TestProcessInput_Lock(t *testing.T) {
+	conn := &mockConn{}
+	client := &SessionClient{
+		Conn:      conn,
+		DetachKey: defaultDetachByte,
+	}
+
+	// Everything between prefix, l and prefix, l is dropped, even the prefix
+	// with other keys and pastes
+	input := []byte("a\x04lb\x04x\x1b[200~rm -rf\x1b[201~\x04lc")
+	if err := client.processInput(input); err != nil {
+		t.Fatal(err)
+	}
+	var got []byte
+	for {
+		typ, payload, err := protocol.ReadPacket(&conn.out)
+		if err != nil {
+			break
+		}
+		if typ == protocol.TypeData {
+			got = append(got, payload...)
+		}
+	}
+	if string(got) != "ac" {
+		t.Errorf("Expected only input outside the lock, got %q", got)
+	}
+
+	// Detaching still works while locked
+	_ = client.processInput([]byte("\x04l"))
+	if err := client.processInput([]byte("\x04d")); err != io.EOF {
+		t.Errorf("Expected detach while locked, got %v", err)
+	}
+}
+
 func TestProcessInput_ReadOnly(t *testing.T) {
 	conn := &mockConn{}
 	client := &SessionClient{
@@ -161,6 +301,32 @@ func TestProcessInput_ReadOnly(t *testing.T) {
 	}
 }
 
+func TestProcessInput_Grant(t *testing.T) {
+	// Prefix, g asks the daemon to toggle write access of a viewer
+	conn := &mockConn{}
+	master := &SessionClient{Conn: conn, DetachKey: defaultDetachByte}
+	_ = master.processInput([]byte("\x04g"))
+	if typ, payload, err := protocol.ReadPacket(&conn.out); err != nil || typ != protocol.TypeGrant || len(payload) != 0 {
+		t.Errorf("Expected an empty TypeGrant, got %d %q %v", typ, payload, err)
+	}
+
+	// Viewers send input only while granted write access
+	conn = &mockConn{}
+	viewer := &SessionClient{Conn: conn, DetachKey: defaultDetachByte, ReadOnly: true}
+	_ = viewer.processInput([]byte("\x04g"))
+	viewer.showGrant([]byte{1})
+	_ = viewer.processInput([]byte("hi"))
+	viewer.showGrant([]byte{0})
+	_ = viewer.processInput([]byte("dropped"))
+	typ, payload, err := protocol.ReadPacket(&conn.out)
+	if err != nil || typ != protocol.TypeData || string(payload) != "hi" {
+		t.Errorf("Expected the granted input only, got %d %q %v", typ, payload, err)
+	}
+	if conn.out.Len() != 0 {
+		t.Errorf("Unexpected output after revoking: %q", conn.out.Bytes())
+	}
+}
+
 func TestProcessInput_CustomKey(t *testing.T) {
 	conn := &mockConn{}
 	// Use Ctrl+A (0x01) as detach key
@@ -207,6 +373,8 @@ func TestReplayTail(t *testing.T) {
 			return s
 		}(), 5, "line\nline\nline\nline\nline\n"},
 		{"NoTrailingNewline", "1\n2\n3", 2, "2\n3"},
+		{"Sixel", "1\n\x1bPq#0~~\n-~~\x1b\\2\n3\n", 3, "2\n3\n"},
+		{"CutSixel", "1\n\x1bPq#0~~\n-~~\n-~~\x1b\\2\n", 2, "2\n"},
 	}
 
 	for _, tt := range tests {
@@ -252,4 +420,164 @@ func TestParseDetachKey(t *testing.T) {
 			t.Errorf("parseDetachKey(%q) = 0x%x, want 0x%x", tt.input, got, tt.expected)
 		}
 	}
-}
\ No newline at end of file
+}
+
+func TestSizeNotice(t *testing.T) {
+	if got := sizeNotice(24, 80, 24, 80); got != "" {
+		t.Errorf("Expected no notice when sizes match, got %q", got)
+	}
+	if got := sizeNotice(24, 80, 50, 200); got != "" {
+		t.Errorf("Expected no notice when window is larger, got %q", got)
+	}
+	want := "[session is 120x40, your window is 100x30]"
+	if got := sizeNotice(40, 120, 30, 100); got != want {
+		t.Errorf("sizeNotice = %q, want %q", got, want)
+	}
+}
+
+func TestOthersNotice(t *testing.T) {
+	self := protocol.Identity{User: "alice", Host: "laptop", PID: 42}
+	clients := []protocol.ClientInfo{
+		{Identity: protocol.Identity{User: "bob", Host: "desk", PID: 7}, ReadOnly: true},
+		{Identity: protocol.Identity{User: "carol", Host: "desk", PID: 8}, ReadOnly: true, Writable: true},
+		{Identity: self},
+	}
+	if got, want := othersNotice(clients, self), "Also attached: bob@desk (read-only), carol@desk"; got != want {
+		t.Errorf("othersNotice = %q, want %q", got, want)
+	}
+	if got := othersNotice(clients[2:], self); got != "" {
+		t.Errorf("Expected no notice when attached alone, got %q", got)
+	}
+}
+
+func TestPrintable(t *testing.T) {
+	if got, want := printable("reboot\tat 5\r\nbye\x1b[2J\x07"), "reboot at 5  bye[2J"; got != want {
+		t.Errorf("printable = %q, want %q", got, want)
+	}
+}
+
+func TestParseSignal(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected syscall.Signal
+	}{
+		{"TERM", syscall.SIGTERM},
+		{"sigint", syscall.SIGINT},
+		{"Hup", syscall.SIGHUP},
+		{"SIGKILL", syscall.SIGKILL},
+	}
+	for _, tt := range tests {
+		got, err := ParseSignal(tt.input)
+		if err != nil || got != tt.expected {
+			t.Errorf("ParseSignal(%q) = %v, %v, want %v", tt.input, got, err, tt.expected)
+		}
+	}
+	if _, err := ParseSignal("BOGUS"); err == nil {
+		t.Error("Expected error for unknown signal")
+	}
+}
+
+func TestReplyError(t *testing.T) {
+	err := replyError([]byte("session already exists: work"))
+	if !errors.Is(err, session.ErrSessionExists) || err.Error() != "session already exists: work" {
+		t.Errorf("replyError = %v, want ErrSessionExists", err)
+	}
+	err = replyError([]byte("no client with ID 3"))
+	if errors.Is(err, session.ErrSessionExists) || err.Error() != "no client with ID 3" {
+		t.Errorf("replyError = %v", err)
+	}
+}
+
+func TestDaemonError(t *testing.T) {
+	err := daemonError(protocol.ErrorPayload(protocol.ErrorInvalidName, "invalid session name: cannot be empty"))
+	if !errors.Is(err, session.ErrInvalidName) {
+		t.Errorf("daemonError = %v, want ErrInvalidName", err)
+	}
+	err = daemonError(protocol.ErrorPayload(protocol.ErrorAuth, "session belongs to another user, uid 1001 may not use it"))
+	var daemonErr *protocol.Error
+	if !errors.Is(err, session.ErrNotOwner) || !errors.As(err, &daemonErr) || err.Error() != daemonErr.Message {
+		t.Errorf("daemonError = %v, want ErrNotOwner with the daemon's message", err)
+	}
+	err = unexpectedReply(protocol.TypeError, protocol.ErrorPayload(protocol.ErrorUnsupported, "unknown request 0x42"))
+	if !errors.Is(err, protocol.ErrProtocolVersion) || err.Error() != "unknown request 0x42" {
+		t.Errorf("unexpectedReply = %v, want ErrProtocolVersion", err)
+	}
+	if err := unexpectedReply(protocol.TypeData, nil); err.Error() != "unexpected reply from daemon" {
+		t.Errorf("unexpectedReply = %v", err)
+	}
+}
+
+func TestAck(t *testing.T) {
+	conn := &mockConn{}
+	c := &SessionClient{Conn: conn}
+	c.ack(ackThreshold - 1)
+	if conn.out.Len() != 0 {
+		t.Fatal("Acknowledged before the threshold")
+	}
+	c.ack(10)
+	typ, payload, err := protocol.ReadPacket(&conn.out)
+	if n, _ := protocol.DecodeAckPayload(payload); err != nil || typ != protocol.TypeAck || n != ackThreshold+9 {
+		t.Errorf("Expected an acknowledgement of %d bytes, got %d %d, %v", ackThreshold+9, typ, n, err)
+	}
+	if c.unacked != 0 {
+		t.Errorf("%d bytes left unacknowledged", c.unacked)
+	}
+}
+
+func TestProcessInput_Bindings(t *testing.T) {
+	conn := &mockConn{}
+	client := &SessionClient{
+		Conn:      conn,
+		DetachKey: defaultDetachByte,
+		Bindings:  map[byte]string{'q': config.BindDetach, 'a': config.BindSendLiteral},
+	}
+
+	// Default keys without a binding go to the session with the prefix
+	_ = client.processInput([]byte{0x04, 'd', 0x04, 'a'})
+	_, payload, err := protocol.ReadPacket(&conn.out)
+	if err != nil || string(payload) != "\x04d\x04" {
+		t.Errorf("Expected unbound key and literal prefix, got %q (%v)", payload, err)
+	}
+
+	_ = client.processInput([]byte{0x04})
+	if err := client.processInput([]byte{'q'}); err != io.EOF {
+		t.Errorf("Expected detach from the custom binding, got %v", err)
+	}
+	if atomic.LoadInt32(&client.detached) != 1 || !conn.closed {
+		t.Error("Client did not detach")
+	}
+
+	// The lock notice names the configured keys
+	client = &SessionClient{DetachKey: 0x01, Bindings: map[byte]string{'x': config.BindLock, 0x0c: config.BindLock}}
+	if got := client.lockKeys(); got != "ctrl-a, ctrl-l" {
+		t.Errorf("lockKeys() = %q", got)
+	}
+}
+
+func TestProcessInput_PrefixTimeout(t *testing.T) {
+	conn := &mockConn{}
+	client := &SessionClient{
+		Conn:          conn,
+		DetachKey:     defaultDetachByte,
+		PrefixTimeout: 20 * time.Millisecond,
+	}
+
+	_ = client.processInput([]byte{0x04})
+	select {
+	case <-client.prefixExpiry():
+	case <-time.After(time.Second):
+		t.Fatal("Pending prefix did not expire")
+	}
+
+	// The late key is ordinary input after the prefix
+	if err := client.processInput([]byte{'d'}); err != nil {
+		t.Fatalf("Expected no detach after the timeout, got %v", err)
+	}
+	_, payload, err := protocol.ReadPacket(&conn.out)
+	if err != nil || string(payload) != "\x04d" {
+		t.Errorf("Expected prefix and key as input, got %q (%v)", payload, err)
+	}
+	if client.prefixExpiry() != nil {
+		t.Error("No prefix should be pending")
+	}
+}
@@ -0,0 +1,124 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"persishtent/internal/config"
+)
+
+// copyHistory is how many lines scrolled off the screen copy mode asks for.
+// The daemon cuts them to fit one packet.
+const copyHistory = 10000
+
+// copyMode lets the user move through the session's screen and history and
+// copy a range of lines, while the terminal shows it instead of the session.
+type copyMode struct {
+	out    io.Writer
+	lines  []string
+	rows   int // Rows showing lines, above the status line
+	cols   int
+	top    int // First line shown
+	cursor int // Line of the cursor
+	mark   int // Other end of the selection, -1 without one
+}
+
+// newCopyMode returns copy mode for the captured text on a terminal of the
+// given size, with the cursor on the last line.
+func newCopyMode(out io.Writer, text string, rows, cols int) *copyMode {
+	m := &copyMode{out: out, rows: max(rows-1, 1), cols: max(cols, 1), mark: -1}
+	m.lines = strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	m.move(len(m.lines))
+	return m
+}
+
+// move moves the cursor by n lines and scrolls it into view
+func (m *copyMode) move(n int) {
+	m.cursor = min(max(m.cursor+n, 0), len(m.lines)-1)
+	if m.cursor < m.top {
+		m.top = m.cursor
+	} else if m.cursor >= m.top+m.rows {
+		m.top = m.cursor - m.rows + 1
+	}
+}
+
+// selection returns the first and last selected line, the cursor line if
+// nothing is selected.
+func (m *copyMode) selection() (first, last int) {
+	if m.mark < 0 {
+		return m.cursor, m.cursor
+	}
+	return min(m.mark, m.cursor), max(m.mark, m.cursor)
+}
+
+// input handles the keys in data. It reports whether copy mode ends and the
+// text to copy, if any.
+func (m *copyMode) input(data []byte) (text string, done bool) {
+	for i := 0; i < len(data); i++ {
+		key := string(data[i])
+		if data[i] == 0x1b && i+1 < len(data) && (data[i+1] == '[' || data[i+1] == 'O') {
+			// Cursor and editing keys, e.g. ESC [ A or ESC [ 5 ~
+			j := i + 2
+			for j < len(data) && (data[j] < 0x40 || data[j] > 0x7e) {
+				j++
+			}
+			j = min(j, len(data)-1)
+			key, i = string(data[i:j+1]), j
+		}
+		switch key {
+		case "k", "\x1b[A", "\x1bOA":
+			m.move(-1)
+		case "j", "\x1b[B", "\x1bOB":
+			m.move(1)
+		case "\x02", "\x1b[5~": // ctrl-b
+			m.move(-m.rows)
+		case "\x06", "\x1b[6~": // ctrl-f
+			m.move(m.rows)
+		case "g", "\x1b[H", "\x1bOH", "\x1b[1~":
+			m.move(-len(m.lines))
+		case "G", "\x1b[F", "\x1bOF", "\x1b[4~":
+			m.move(len(m.lines))
+		case "v", " ":
+			if m.mark < 0 {
+				m.mark = m.cursor
+			} else {
+				m.mark = -1
+			}
+		case "y", "\r":
+			first, last := m.selection()
+			return strings.Join(m.lines[first:last+1], "\n") + "\n", true
+		case "q", "\x1b", "\x03": // ctrl-c
+			return "", true
+		}
+	}
+	return "", false
+}
+
+// render draws the lines around the cursor, the selection in reverse video,
+// and a status line below them.
+func (m *copyMode) render() {
+	var b strings.Builder
+	b.WriteString("\x1b[?25l")
+	first, last := m.selection()
+	for r := 0; r < m.rows; r++ {
+		fmt.Fprintf(&b, "\x1b[%d;1H", r+1)
+		line := ""
+		if n := m.top + r; n < len(m.lines) {
+			line = m.lines[n]
+		}
+		if n := m.top + r; m.mark >= 0 && n >= first && n <= last {
+			b.WriteString("\x1b[7m" + fit(line, m.cols) + "\x1b[0m")
+		} else {
+			b.WriteString(fit(line, m.cols))
+		}
+	}
+	selected := 0
+	if m.mark >= 0 {
+		selected = last - first + 1
+	}
+	status := config.Message("copy_mode_status", "Line", m.cursor+1, "Lines", len(m.lines), "Selected", selected)
+	fmt.Fprintf(&b, "\x1b[%d;1H\x1b[7m%s\x1b[0m", m.rows+1, fit(status, m.cols))
+	fmt.Fprintf(&b, "\x1b[%d;1H\x1b[?25h", m.cursor-m.top+1)
+	_, _ = io.WriteString(m.out, b.String())
+}
@@ -0,0 +1,39 @@
+package client
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCopyMode(t *testing.T) {
+	var out bytes.Buffer
+	m := newCopyMode(&out, "one\ntwo\nthree\nfour\n", 3, 40)
+	if m.cursor != 3 || m.top != 2 {
+		t.Fatalf("Cursor on line %d, top %d", m.cursor, m.top)
+	}
+
+	// Moving up scrolls, keys may come in one read
+	if _, done := m.input([]byte("kk\x1b[A")); done || m.cursor != 0 || m.top != 0 {
+		t.Fatalf("Cursor on line %d, top %d after moving up", m.cursor, m.top)
+	}
+	m.render()
+	if !strings.Contains(out.String(), "\x1b[1;1Hone") || !strings.Contains(out.String(), "line 1 of 4") {
+		t.Errorf("Unexpected rendering %q", out.String())
+	}
+
+	// The selection spans from the mark to the cursor
+	text, done := m.input([]byte("jvj\x1bOBy"))
+	if !done || text != "two\nthree\nfour\n" {
+		t.Errorf("Copied %q, done %v", text, done)
+	}
+
+	// Without a selection the cursor line is copied, q copies nothing
+	m = newCopyMode(&out, "one\ntwo\n", 24, 80)
+	if text, done := m.input([]byte("gy")); !done || text != "one\n" {
+		t.Errorf("Copied %q, done %v", text, done)
+	}
+	if text, done := newCopyMode(&out, "", 24, 80).input([]byte("Gq")); !done || text != "" {
+		t.Errorf("Quitting copied %q, done %v", text, done)
+	}
+}
@@ -0,0 +1,177 @@
+package client
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"persishtent/internal/config"
+	"persishtent/internal/protocol"
+	"persishtent/internal/session"
+)
+
+// reconnectTimeout is how long a client that lost its connection tries to
+// reconnect before it gives up and exits like after a detach.
+const reconnectTimeout = 10 * time.Second
+
+// errMasterTaken stops reconnecting a Master client once another one attached
+var errMasterTaken = errors.New("another client attached as master")
+
+// resumeState tracks how much of the session's output a client has, so it
+// can pick up where it left off after a reconnect.
+type resumeState struct {
+	known  bool   // The daemon sent TypeResume, older daemons can't resume
+	offset uint64 // Offset in the session's output up to which the client has it
+}
+
+// start records the offset sent in a TypeResume payload
+func (r *resumeState) start(payload []byte) {
+	if len(payload) == 8 {
+		r.known, r.offset = true, binary.BigEndian.Uint64(payload)
+	}
+}
+
+// end returns the output offset up to which the client has the output, or
+// 0 if the daemon doesn't tell offsets.
+func (r *resumeState) end() uint64 {
+	if !r.known {
+		return 0
+	}
+	return r.offset
+}
+
+// missedOutput returns the part of history, which ends at the output offset
+// end, that comes after offset. ok is false if history doesn't reach back
+// to offset, e.g. as it was trimmed, and all of it is returned.
+func missedOutput(history []byte, offset uint64, end uint64) (missed []byte, ok bool) {
+	if end <= offset {
+		return nil, true
+	}
+	if n := end - offset; n <= uint64(len(history)) {
+		return history[uint64(len(history))-n:], true
+	}
+	return history, false
+}
+
+// reconnect attaches again after the connection to the daemon was lost
+// while the session lives on, and writes the output missed in between. It
+// reports whether the client is attached again.
+func (c *SessionClient) reconnect() bool {
+	if !c.resume.known || c.sockPath == "" {
+		return false
+	}
+	_ = c.conn().Close()
+	drawNotice(config.Message("reconnecting"))
+	deadline := time.Now().Add(reconnectTimeout)
+	for delay := 100 * time.Millisecond; ; delay = min(2*delay, time.Second) {
+		if atomic.LoadInt32(&c.detached) == 1 {
+			return false
+		}
+		err := c.resumeSession()
+		if err == nil {
+			sendResize(c.conn())
+			drawNotice(config.Message("reconnected"))
+			return true
+		}
+		var daemonErr *protocol.Error
+		permanent := errors.Is(err, ErrRefused) || errors.Is(err, ErrKicked) || errors.Is(err, session.ErrSessionNotFound) || errors.As(err, &daemonErr)
+		if permanent || time.Now().After(deadline) {
+			drawNotice(config.Message("reconnect_failed", "Err", err))
+			return false
+		}
+		time.Sleep(delay)
+	}
+}
+
+// resumeSession makes one attempt to attach again and replay what was missed
+func (c *SessionClient) resumeSession() error {
+	// Checks that the daemon answers before taking over the Master again
+	st, err := Query(c.Name, c.sockPath)
+	if err != nil {
+		return err
+	}
+	if !c.ReadOnly && st.Master && !c.masterIsSelf() {
+		return errMasterTaken
+	}
+	if err := c.Connect(c.sockPath); err != nil {
+		return err
+	}
+	replay, tail, peers := c.Replay, c.Tail, c.Peers
+	c.Replay, c.Tail, c.Peers, c.limit = true, 0, false, 0
+	err = c.Handshake()
+	c.Replay, c.Tail, c.Peers = replay, tail, peers
+	if err == nil {
+		err = c.replayMissed()
+	}
+	if err != nil {
+		_ = c.conn().Close()
+	}
+	return err
+}
+
+// masterIsSelf reports whether the session's Master is this client's lost
+// connection, which the daemon often hasn't noticed is gone yet. Attaching
+// again replaces it, like any Master attach, and takes over its lock.
+func (c *SessionClient) masterIsSelf() bool {
+	clients, err := Clients(c.Name, c.sockPath)
+	if err != nil {
+		return false
+	}
+	self := localIdentity()
+	for _, cl := range clients {
+		if cl.Master {
+			return cl.Identity == self
+		}
+	}
+	return false
+}
+
+// replayMissed reads the TypeResume offset and the history the daemon sends
+// after a reconnect, and writes the output that came after the client's offset.
+func (c *SessionClient) replayMissed() error {
+	conn := c.conn()
+	_ = conn.SetReadDeadline(time.Now().Add(historyTimeout))
+	defer func() { _ = conn.SetReadDeadline(time.Time{}) }()
+	packets := protocol.NewReader(conn)
+	var end uint64
+	var history []byte
+	for done := false; !done; {
+		t, payload, err := packets.ReadPacket()
+		if err != nil {
+			return err
+		}
+		switch t {
+		case protocol.TypeLimit:
+			c.setLimit(payload, packets)
+		case protocol.TypeResume:
+			if len(payload) != 8 {
+				return errors.New("invalid resume offset")
+			}
+			end = binary.BigEndian.Uint64(payload)
+		case protocol.TypeReplay:
+			history = append(history, payload...)
+			done = len(payload) == 0
+		case protocol.TypeRefused:
+			return refusedError(payload)
+		case protocol.TypeError:
+			return daemonError(payload)
+		case protocol.TypeKick:
+			return &KickedError{By: string(payload)}
+		default:
+			return fmt.Errorf("unexpected packet %#x while resuming", t)
+		}
+	}
+
+	missed, ok := missedOutput(history, c.resume.offset, end)
+	if !ok {
+		drawNotice(config.Message("reconnect_gap"))
+	}
+	c.tab.write(missed, end)
+	c.transcript.write(missed)
+	c.resume.offset = end
+	// The new connection starts with a full window
+	c.unacked = 0
+	return nil
+}
@@ -0,0 +1,119 @@
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"persishtent/internal/protocol"
+)
+
+func TestMissedOutput(t *testing.T) {
+	tests := []struct {
+		offset, end uint64
+		want        string
+		ok          bool
+	}{
+		{3, 6, "def", true},
+		{6, 6, "", true},
+		{0, 6, "abcdef", true},
+		{0, 10, "abcdef", false}, // Older output was trimmed from the history
+	}
+	for _, tt := range tests {
+		got, ok := missedOutput([]byte("abcdef"), tt.offset, tt.end)
+		if string(got) != tt.want || ok != tt.ok {
+			t.Errorf("missedOutput(%d, %d) = %q, %v, want %q, %v", tt.offset, tt.end, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func resumePayload(offset uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, offset)
+}
+
+func TestReconnect(t *testing.T) {
+	sockPath := filepath.Join(t.TempDir(), "web.sock")
+	l, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+
+	// A daemon that drops the first connection, answers the query of the
+	// reconnect and then replays the session history
+	go func() {
+		accept := func() net.Conn {
+			conn, err := l.Accept()
+			if err != nil {
+				return nil
+			}
+			if typ, _, err := protocol.ReadPacket(conn); err != nil || typ != protocol.TypeMode {
+				_ = conn.Close()
+				return nil
+			}
+			return conn
+		}
+		conn := accept()
+		if conn == nil {
+			return
+		}
+		_ = protocol.WritePacket(conn, protocol.TypeResume, resumePayload(0))
+		_ = protocol.WritePacket(conn, protocol.TypeData, []byte("abc"))
+		_ = conn.Close()
+
+		if conn = accept(); conn == nil {
+			return
+		}
+		if typ, _, err := protocol.ReadPacket(conn); err == nil && typ == protocol.TypeQuery {
+			_ = protocol.WritePacket(conn, protocol.TypeInfo, protocol.StatusPayload(protocol.Status{Name: "web"}))
+		}
+		_ = conn.Close()
+
+		if conn = accept(); conn == nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		_ = protocol.WritePacket(conn, protocol.TypeResume, resumePayload(6))
+		_ = protocol.WritePacket(conn, protocol.TypeReplay, []byte("abcdef"))
+		_ = protocol.WritePacket(conn, protocol.TypeReplay, nil)
+		_ = protocol.WritePacket(conn, protocol.TypeData, []byte("g"))
+		_ = protocol.WritePacket(conn, protocol.TypeExit, protocol.ExitPayload(0))
+	}()
+
+	c := NewSessionClient("web", 0x04, false)
+	var out bytes.Buffer
+	c.tab = &tabRelay{out: &out}
+	if err := c.Connect(sockPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- c.Stream() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Stream = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stream didn't return")
+	}
+	if out.String() != "abcdefg" {
+		t.Errorf("Output = %q, want each byte once", out.String())
+	}
+	if c.resume.offset != 7 {
+		t.Errorf("Offset = %d, want 7", c.resume.offset)
+	}
+}
+
+func TestReconnect_OldDaemon(t *testing.T) {
+	c := NewSessionClient("web", 0x04, false)
+	c.sockPath = "/nonexistent"
+	if c.reconnect() {
+		t.Error("Reconnected to a daemon that never sent TypeResume")
+	}
+}
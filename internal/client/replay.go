@@ -0,0 +1,192 @@
+package client
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"persishtent/internal/config"
+	"persishtent/internal/protocol"
+	"persishtent/internal/session"
+)
+
+// replayTick is the granularity at which throttled replay is paced.
+const replayTick = 50 * time.Millisecond
+
+// historyTimeout is how long to wait for the daemon to start sending the
+// session history. Daemons started by an older version don't send it, and the
+// history is read from the log files instead.
+const historyTimeout = time.Second
+
+// replayWriter paces writes to at most rate bytes per second and stops
+// writing once skip is closed. A rate of 0 or less disables throttling.
+type replayWriter struct {
+	w       io.Writer
+	rate    int
+	skip    <-chan struct{}
+	skipped bool
+	start   time.Time
+	written int64
+}
+
+func newReplayWriter(w io.Writer, rate int, skip <-chan struct{}) *replayWriter {
+	return &replayWriter{w: w, rate: rate, skip: skip, start: time.Now()}
+}
+
+func (r *replayWriter) Write(p []byte) (int, error) {
+	chunkSize := 4096
+	if r.rate > 0 {
+		chunkSize = max(r.rate/int(time.Second/replayTick), 1)
+	}
+
+	total := len(p)
+	for len(p) > 0 && !r.skipped {
+		select {
+		case <-r.skip:
+			r.skipped = true
+			continue
+		default:
+		}
+
+		n := min(chunkSize, len(p))
+		if _, err := r.w.Write(p[:n]); err != nil {
+			return total - len(p), err
+		}
+		p = p[n:]
+		r.written += int64(n)
+
+		if r.rate > 0 {
+			due := r.start.Add(time.Duration(r.written * int64(time.Second) / int64(r.rate)))
+			if wait := time.Until(due); wait > 0 {
+				select {
+				case <-r.skip:
+					r.skipped = true
+				case <-time.After(wait):
+				}
+			}
+		}
+	}
+	// Skipped data is discarded, not an error
+	return total, nil
+}
+
+// replay writes the session history to stdout, paced by the configured
+// replay rate. Pressing q during replay jumps straight to live output; any
+// other input is kept for DrainInput.
+func (c *SessionClient) replay(tail int, rate int) {
+	skip := make(chan struct{})
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case chunk, ok := <-c.stdinCh:
+				if !ok {
+					return
+				}
+				if string(chunk) == "q" {
+					close(skip)
+					return
+				}
+				c.pending = append(c.pending, chunk...)
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	out := newReplayWriter(os.Stdout, rate, skip)
+	ok, early := c.replayHistory(out)
+	if !ok {
+		replayLogs(out, c.Name, tail)
+		_, _ = os.Stdout.Write(early)
+	}
+
+	close(stop)
+	<-done
+
+	if out.skipped {
+		// The replay may have stopped mid-sequence (e.g. inside a sixel image);
+		// terminate any string sequence and reset attributes
+		_, _ = os.Stdout.Write([]byte("\x1b\\\x1b[m\r\n" + config.Message("replay_skipped") + "\r\n"))
+	}
+}
+
+// replayHistory copies the history sent by the daemon in TypeReplay packets
+// to out. It returns false if the daemon doesn't send any, along with live
+// output that arrived instead.
+func (c *SessionClient) replayHistory(out io.Writer) (bool, []byte) {
+	packets := c.newReader()
+	_ = c.conn().SetReadDeadline(time.Now().Add(historyTimeout))
+	for first := true; ; first = false {
+		t, payload, err := packets.ReadPacket()
+		if first {
+			_ = c.conn().SetReadDeadline(time.Time{})
+		}
+		if err != nil {
+			return !first, nil
+		}
+		switch {
+		case t == protocol.TypeLimit:
+			c.setLimit(payload, packets)
+			continue
+		case t == protocol.TypeResume:
+			c.resume.start(payload)
+			continue
+		case t == protocol.TypeClients:
+			c.others = peersNotice(payload)
+			continue
+		case t == protocol.TypeRefused:
+			// Nothing follows, and the logs must not be replayed either
+			c.refused = refusedError(payload)
+			return true, nil
+		case t == protocol.TypeError:
+			c.refused = daemonError(payload)
+			return true, nil
+		case t != protocol.TypeReplay:
+			// Other packets only come first from daemons without replay
+			if t == protocol.TypeData {
+				return false, append([]byte(nil), payload...)
+			}
+			return false, nil
+		case len(payload) == 0:
+			return true, nil
+		}
+		_, _ = out.Write(payload)
+	}
+}
+
+// replayLogs writes the log files of session name to out, for daemons that
+// don't send the history themselves.
+func replayLogs(out *replayWriter, name string, tail int) {
+	segments, _ := session.LogSegments(name)
+	for i, seg := range segments {
+		if out.skipped {
+			break
+		}
+		if seg.Marker != "" {
+			// Rotated files usually end mid-line
+			if i > 0 {
+				_, _ = out.Write([]byte("\r\n"))
+			}
+			_, _ = out.Write([]byte("\x1b[7m" + seg.Marker + "\x1b[0m\r\n"))
+		}
+		if tail > 0 {
+			if f, err := os.Open(seg.Path); err == nil {
+				replayTail(out, f, tail)
+				_ = f.Close()
+			}
+			continue
+		}
+		_ = session.CopyVerified(out, seg.Path, 0, func(m session.IntegrityMarker) {
+			_, _ = out.Write(damagedNotice(m))
+		})
+	}
+}
+
+// damagedNotice is replayed in place of a log chunk that doesn't match its
+// integrity marker. Output before it may stop mid-sequence, so it resets first.
+func damagedNotice(m session.IntegrityMarker) []byte {
+	return []byte("\x1b\\\x1b[m\r\n\x1b[7m" + config.Message("log_damaged", "Size", m.Size) + "\x1b[0m\r\n")
+}
@@ -0,0 +1,116 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"persishtent/internal/protocol"
+)
+
+func TestReplayWriter_Unthrottled(t *testing.T) {
+	var out bytes.Buffer
+	w := newReplayWriter(&out, 0, make(chan struct{}))
+	data := bytes.Repeat([]byte("x"), 10000)
+	if n, err := w.Write(data); err != nil || n != len(data) {
+		t.Fatalf("Write = %d, %v", n, err)
+	}
+	if out.Len() != len(data) {
+		t.Errorf("Expected %d bytes written, got %d", len(data), out.Len())
+	}
+}
+
+func TestReplayWriter_Throttled(t *testing.T) {
+	var out bytes.Buffer
+	// 2000 bytes at 10000 bytes/sec should take about 200ms
+	w := newReplayWriter(&out, 10000, make(chan struct{}))
+	start := time.Now()
+	_, _ = w.Write(bytes.Repeat([]byte("x"), 2000))
+	elapsed := time.Since(start)
+	if elapsed < 150*time.Millisecond {
+		t.Errorf("Replay was not throttled, took %v", elapsed)
+	}
+	if out.Len() != 2000 {
+		t.Errorf("Expected 2000 bytes written, got %d", out.Len())
+	}
+}
+
+func TestReplayWriter_Skip(t *testing.T) {
+	var out bytes.Buffer
+	skip := make(chan struct{})
+	w := newReplayWriter(&out, 1000, skip)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		close(skip)
+	}()
+
+	data := bytes.Repeat([]byte("x"), 10000)
+	start := time.Now()
+	n, err := w.Write(data)
+	if err != nil || n != len(data) {
+		t.Fatalf("Write = %d, %v", n, err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("Skip did not interrupt throttled replay")
+	}
+	if !w.skipped || out.Len() >= len(data) {
+		t.Errorf("Expected replay to be cut short, wrote %d bytes", out.Len())
+	}
+}
+
+func TestReplayHistory(t *testing.T) {
+	server, conn := net.Pipe()
+	defer func() { _ = server.Close() }()
+	c := &SessionClient{Conn: conn}
+	go func() {
+		_ = protocol.WritePacket(server, protocol.TypeReplay, []byte("hist"))
+		_ = protocol.WritePacket(server, protocol.TypeReplay, []byte("ory"))
+		_ = protocol.WritePacket(server, protocol.TypeReplay, nil)
+		_ = protocol.WritePacket(server, protocol.TypeData, []byte("live"))
+	}()
+
+	var out bytes.Buffer
+	if ok, _ := c.replayHistory(&out); !ok || out.String() != "history" {
+		t.Errorf("replayHistory = %v, %q", ok, out.String())
+	}
+	// Live output is left for Stream
+	if typ, payload, err := protocol.ReadPacket(conn); err != nil || typ != protocol.TypeData || string(payload) != "live" {
+		t.Errorf("Expected live output after the history, got %d %q, %v", typ, payload, err)
+	}
+}
+
+func TestReplayHistory_OldDaemon(t *testing.T) {
+	server, conn := net.Pipe()
+	defer func() { _ = server.Close() }()
+	c := &SessionClient{Conn: conn}
+
+	// Daemons without replay send live output right away, or nothing at all
+	go func() { _ = protocol.WritePacket(server, protocol.TypeData, []byte("live")) }()
+	if ok, early := c.replayHistory(&bytes.Buffer{}); ok || string(early) != "live" {
+		t.Errorf("replayHistory = %v, %q", ok, early)
+	}
+	start := time.Now()
+	if ok, _ := c.replayHistory(&bytes.Buffer{}); ok {
+		t.Error("Expected no history from a silent daemon")
+	}
+	if elapsed := time.Since(start); elapsed < historyTimeout {
+		t.Errorf("Gave up waiting after %v", elapsed)
+	}
+}
+
+func TestReplayHistory_Refused(t *testing.T) {
+	server, conn := net.Pipe()
+	defer func() { _ = server.Close() }()
+	c := &SessionClient{Conn: conn}
+
+	go func() { _ = protocol.WritePacket(server, protocol.TypeRefused, []byte("session is locked")) }()
+	if ok, _ := c.replayHistory(&bytes.Buffer{}); !ok {
+		t.Error("A refused attach must not fall back to the log files")
+	}
+	if !errors.Is(c.refused, ErrRefused) || !strings.Contains(c.refused.Error(), "session is locked") {
+		t.Errorf("Expected ErrRefused with the reason, got %v", c.refused)
+	}
+}
@@ -0,0 +1,275 @@
+package client
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"persishtent/internal/config"
+	"persishtent/internal/session"
+)
+
+// tabCwdInterval is how often the session's working directory is relayed to
+// the terminal while attached.
+const tabCwdInterval = 2 * time.Second
+
+// tabUserVar is the user variable naming the attached session, e.g. for
+// WezTerm's pane:get_user_vars() or iTerm2's \(user.persishtent_session).
+const tabUserVar = "persishtent_session"
+
+// terminalFeatures are the integration sequences the hosting terminal
+// understands.
+type terminalFeatures struct {
+	badge    bool // iTerm2 badge
+	userVars bool // OSC 1337 SetUserVar
+	cwd      bool // OSC 7 working directory
+}
+
+// detectTerminal guesses the hosting terminal from its environment variables.
+// Unknown terminals and multiplexers get nothing.
+func detectTerminal(getenv func(string) string) terminalFeatures {
+	if getenv("TMUX") != "" || getenv("STY") != "" {
+		return terminalFeatures{}
+	}
+	switch {
+	case getenv("TERM_PROGRAM") == "iTerm.app":
+		return terminalFeatures{badge: true, userVars: true, cwd: true}
+	case getenv("TERM_PROGRAM") == "WezTerm", getenv("WEZTERM_PANE") != "":
+		return terminalFeatures{userVars: true, cwd: true}
+	case getenv("KITTY_WINDOW_ID") != "", getenv("TERM") == "xterm-kitty":
+		return terminalFeatures{userVars: true, cwd: true}
+	case getenv("VTE_VERSION") != "", getenv("TERM_PROGRAM") == "Apple_Terminal":
+		return terminalFeatures{cwd: true}
+	}
+	return terminalFeatures{}
+}
+
+// tabSequences returns the sequences announcing session name, or clearing
+// the announcement if name is empty.
+func (f terminalFeatures) tabSequences(name string) string {
+	value := base64.StdEncoding.EncodeToString([]byte(name))
+	var s string
+	if f.userVars {
+		s += "\x1b]1337;SetUserVar=" + tabUserVar + "=" + value + "\a"
+	}
+	if f.badge {
+		s += "\x1b]1337;SetBadgeFormat=" + value + "\a"
+	}
+	return s
+}
+
+// cwdSequence returns the OSC 7 report of dir on host.
+func cwdSequence(host, dir string) string {
+	u := url.URL{Scheme: "file", Host: host, Path: dir}
+	return "\x1b]7;" + u.String() + "\a"
+}
+
+// maxHeld limits the output kept while the relay is held, older output is
+// dropped and redrawn by release.
+const maxHeld = 1 << 20
+
+// tabRelay writes integration sequences to the terminal between session
+// output, never inside an escape sequence of it.
+type tabRelay struct {
+	mu       sync.Mutex
+	out      io.Writer
+	features terminalFeatures
+	seq      byte   // Escape sequence state at the end of the output so far
+	ownCwd   bool   // The session reports its directory itself
+	cwd      string // Last relayed directory
+
+	holding bool   // The terminal shows copy mode, see hold
+	held    []byte // Output kept from the terminal while holding
+	end     uint64 // Output offset after the last write, 0 if unknown
+	skip    uint64 // Output up to this offset is already on the terminal
+}
+
+// write passes session output, which ends at offset end, to the terminal.
+// end is 0 if the daemon doesn't tell offsets.
+func (r *tabRelay) write(p []byte, end uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.skip > 0 && end > 0 {
+		p, _ = missedOutput(p, r.skip, end)
+		if end >= r.skip {
+			r.skip = 0
+		}
+	}
+	r.end = end
+	if r.holding {
+		r.held = append(r.held, p...)
+		if len(r.held) > maxHeld {
+			r.held = r.held[len(r.held)-maxHeld:]
+		}
+		return
+	}
+	r.output(p)
+}
+
+// output writes p to the terminal. Callers hold r.mu.
+func (r *tabRelay) output(p []byte) {
+	_, _ = r.out.Write(p)
+	r.seq = scanSequence(r.seq, p)
+	if bytes.Contains(p, []byte("\x1b]7;")) {
+		r.ownCwd = true
+	}
+}
+
+// hold switches the terminal to the alternate screen and keeps session
+// output from it until release.
+func (r *tabRelay) hold() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.holding {
+		return
+	}
+	// The escape ends a sequence the output stopped in
+	_, _ = r.out.Write([]byte("\x1b[?1049h"))
+	r.holding, r.held = true, nil
+}
+
+// release leaves the alternate screen, draws screen, which shows the session
+// output up to offset, and writes the output held since. Without screen all
+// held output is written. It does nothing unless the relay is held.
+func (r *tabRelay) release(screen []byte, offset uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.holding {
+		return
+	}
+	held := r.held
+	r.holding, r.held = false, nil
+	_, _ = r.out.Write([]byte("\x1b[?1049l"))
+	if len(screen) > 0 {
+		_, _ = r.out.Write(screen)
+		r.seq = seqNone
+		held, _ = missedOutput(held, offset, r.end)
+		if offset > r.end {
+			// The rest arrives later
+			r.skip = offset
+		}
+	}
+	r.output(held)
+}
+
+// setCwd reports dir to the terminal if it changed. It reports whether the
+// directory still needs to be sent.
+func (r *tabRelay) setCwd(dir string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.features.cwd || r.ownCwd || dir == "" || dir == r.cwd {
+		return false
+	}
+	if r.seq != seqNone || r.holding {
+		return true
+	}
+	_, _ = r.out.Write([]byte(cwdSequence(session.Hostname(), dir)))
+	r.cwd = dir
+	return false
+}
+
+// relayCwd polls the session's working directory until done is closed.
+func (r *tabRelay) relayCwd(name, sockPath string, done <-chan struct{}) {
+	if !r.features.cwd {
+		return
+	}
+	ticker := time.NewTicker(tabCwdInterval)
+	defer ticker.Stop()
+	for {
+		if st, err := Query(name, sockPath); err == nil {
+			// Retry soon when output was in the middle of a sequence
+			for r.setCwd(st.Cwd) {
+				select {
+				case <-done:
+					return
+				case <-time.After(50 * time.Millisecond):
+				}
+			}
+		}
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// announce tells the terminal which session the tab shows, or that it shows
+// none if name is empty.
+func (r *tabRelay) announce(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s := r.features.tabSequences(name); s != "" {
+		_, _ = r.out.Write([]byte(s))
+	}
+}
+
+// newTabRelay returns a relay for the terminal of this process, which does
+// nothing if terminal_integration is off.
+func newTabRelay() *tabRelay {
+	r := &tabRelay{out: os.Stdout}
+	if config.Current().TerminalIntegration {
+		r.features = detectTerminal(os.Getenv)
+	}
+	return r
+}
+
+// Escape sequence states of session output, see scanSequence
+const (
+	seqNone byte = iota
+	seqEscape
+	seqCSI
+	seqString // OSC, DCS, APC, PM or SOS
+	seqStringEscape
+	seqCharset
+)
+
+// scanSequence returns the escape sequence state after output p, starting
+// in state.
+func scanSequence(state byte, p []byte) byte {
+	for _, b := range p {
+		switch state {
+		case seqNone:
+			if b == 0x1b {
+				state = seqEscape
+			}
+		case seqEscape:
+			switch b {
+			case '[':
+				state = seqCSI
+			case ']', 'P', '_', '^', 'X':
+				state = seqString
+			case '(', ')', '*', '+', '#', '%', ' ':
+				state = seqCharset
+			case 0x1b:
+			default:
+				state = seqNone
+			}
+		case seqCSI:
+			if b >= 0x40 && b <= 0x7e {
+				state = seqNone
+			} else if b == 0x1b {
+				state = seqEscape
+			}
+		case seqString:
+			if b == 0x07 {
+				state = seqNone
+			} else if b == 0x1b {
+				state = seqStringEscape
+			}
+		case seqStringEscape:
+			if b == '\\' {
+				state = seqNone
+			} else if b != 0x1b {
+				state = seqString
+			}
+		case seqCharset:
+			state = seqNone
+		}
+	}
+	return state
+}
@@ -0,0 +1,130 @@
+package client
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDetectTerminal(t *testing.T) {
+	tests := []struct {
+		env  map[string]string
+		want terminalFeatures
+	}{
+		{map[string]string{"TERM_PROGRAM": "iTerm.app"}, terminalFeatures{badge: true, userVars: true, cwd: true}},
+		{map[string]string{"WEZTERM_PANE": "3"}, terminalFeatures{userVars: true, cwd: true}},
+		{map[string]string{"TERM": "xterm-kitty"}, terminalFeatures{userVars: true, cwd: true}},
+		{map[string]string{"VTE_VERSION": "7600"}, terminalFeatures{cwd: true}},
+		{map[string]string{"TERM_PROGRAM": "iTerm.app", "TMUX": "/tmp/tmux-1000/default,1,0"}, terminalFeatures{}},
+		{map[string]string{"TERM": "xterm-256color"}, terminalFeatures{}},
+	}
+	for _, tt := range tests {
+		if got := detectTerminal(func(k string) string { return tt.env[k] }); got != tt.want {
+			t.Errorf("detectTerminal(%v) = %+v, want %+v", tt.env, got, tt.want)
+		}
+	}
+}
+
+func TestTabSequences(t *testing.T) {
+	f := terminalFeatures{badge: true, userVars: true}
+	want := "\x1b]1337;SetUserVar=persishtent_session=d2Vi\a\x1b]1337;SetBadgeFormat=d2Vi\a"
+	if got := f.tabSequences("web"); got != want {
+		t.Errorf("tabSequences = %q, want %q", got, want)
+	}
+	if got := f.tabSequences(""); !strings.Contains(got, "persishtent_session=\a") {
+		t.Errorf("Expected the user var to be cleared, got %q", got)
+	}
+	if got := cwdSequence("box", "/home/me/my project"); got != "\x1b]7;file://box/home/me/my%20project\a" {
+		t.Errorf("cwdSequence = %q", got)
+	}
+}
+
+func TestScanSequence(t *testing.T) {
+	tests := []struct {
+		in      []string
+		partial bool
+	}{
+		{[]string{"plain text"}, false},
+		{[]string{"\x1b[31mred"}, false},
+		{[]string{"red\x1b[3"}, true},
+		{[]string{"red\x1b[3", "1m"}, false},
+		{[]string{"x\x1b"}, true},
+		{[]string{"\x1b]0;ti", "tle"}, true},
+		{[]string{"\x1b]0;ti", "tle\a$ "}, false},
+		{[]string{"\x1b]8;;http://x\x1b", "\\link"}, false},
+		{[]string{"\x1b("}, true},
+		{[]string{"\x1b(B"}, false},
+	}
+	for _, tt := range tests {
+		state := seqNone
+		for _, p := range tt.in {
+			state = scanSequence(state, []byte(p))
+		}
+		if got := state != seqNone; got != tt.partial {
+			t.Errorf("scanSequence(%q) partial = %v, want %v", tt.in, got, tt.partial)
+		}
+	}
+}
+
+func TestTabRelayCwd(t *testing.T) {
+	var out bytes.Buffer
+	r := &tabRelay{out: &out, features: terminalFeatures{cwd: true}}
+
+	// Held back while output is inside an escape sequence
+	r.write([]byte("\x1b[3"), 0)
+	if !r.setCwd("/srv") || strings.Contains(out.String(), "\x1b]7;") {
+		t.Fatalf("Expected the directory to wait, got %q", out.String())
+	}
+	r.write([]byte("1m"), 0)
+	if r.setCwd("/srv") || !strings.Contains(out.String(), "/srv\a") {
+		t.Fatalf("Expected the directory to be sent, got %q", out.String())
+	}
+	out.Reset()
+	if r.setCwd("/srv") || out.Len() > 0 {
+		t.Errorf("Unchanged directory sent again: %q", out.String())
+	}
+
+	// Sessions reporting their own directory are left alone
+	r.write([]byte("\x1b]7;file://box/tmp\a"), 0)
+	out.Reset()
+	if r.setCwd("/var") || out.Len() > 0 {
+		t.Errorf("Directory relayed although the shell reports it: %q", out.String())
+	}
+}
+
+func TestTabRelayHold(t *testing.T) {
+	var out bytes.Buffer
+	r := &tabRelay{out: &out}
+	r.write([]byte("abc"), 3)
+	r.hold()
+	r.write([]byte("def"), 6)
+	r.write([]byte("ghi"), 9)
+	if strings.Contains(out.String(), "def") {
+		t.Fatalf("Held output written: %q", out.String())
+	}
+
+	// The redrawn screen shows the output up to 7, the rest follows it
+	out.Reset()
+	r.release([]byte("SCREEN"), 7)
+	if got := out.String(); got != "\x1b[?1049lSCREENhi" {
+		t.Errorf("Released %q", got)
+	}
+
+	// Output the screen already shows is skipped
+	r.hold()
+	out.Reset()
+	r.release([]byte("SCREEN"), 12)
+	r.write([]byte("jklmn"), 14)
+	if got := out.String(); got != "\x1b[?1049lSCREENmn" {
+		t.Errorf("Released %q", got)
+	}
+
+	// Without a screen all held output is written
+	r.hold()
+	r.write([]byte("op"), 16)
+	out.Reset()
+	r.release(nil, 0)
+	if got := out.String(); got != "\x1b[?1049lop" {
+		t.Errorf("Released %q", got)
+	}
+}
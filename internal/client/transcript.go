@@ -0,0 +1,77 @@
+package client
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"persishtent/internal/config"
+)
+
+// transcript tees session output shown by the client into a local file.
+type transcript struct {
+	mu   sync.Mutex
+	name string
+	path string
+	f    *os.File
+}
+
+// defaultTranscriptPath names a transcript started from the prefix command
+func defaultTranscriptPath(name string, now time.Time) string {
+	return fmt.Sprintf("persishtent-%s-%s.txt", name, now.Format("20060102-150405"))
+}
+
+// start opens the transcript file for appending
+func (t *transcript) start(path string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.f != nil {
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	t.f = f
+	t.path = path
+	return nil
+}
+
+// stop closes the transcript file, if any
+func (t *transcript) stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.f != nil {
+		_ = t.f.Close()
+		t.f = nil
+	}
+}
+
+// toggle stops a running transcript or starts a new one, and returns a status message
+func (t *transcript) toggle() string {
+	t.mu.Lock()
+	running := t.f != nil
+	path := t.path
+	t.mu.Unlock()
+
+	if running {
+		t.stop()
+		return config.Message("transcript_saved", "Path", path)
+	}
+	if path == "" {
+		path = defaultTranscriptPath(t.name, time.Now())
+	}
+	if err := t.start(path); err != nil {
+		return config.Message("transcript_failed", "Err", err)
+	}
+	return config.Message("transcript_started", "Path", path)
+}
+
+func (t *transcript) write(p []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.f != nil {
+		_, _ = t.f.Write(p)
+	}
+}
@@ -0,0 +1,46 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTranscript(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.txt")
+	tr := transcript{name: "dev"}
+
+	tr.write([]byte("before\n")) // Not recording yet
+	if err := tr.start(path); err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+	tr.write([]byte("during\n"))
+	if msg := tr.toggle(); !strings.Contains(msg, "saved") {
+		t.Errorf("Unexpected toggle message %q", msg)
+	}
+	tr.write([]byte("paused\n"))
+
+	// Toggling again resumes the same file
+	if msg := tr.toggle(); !strings.Contains(msg, path) {
+		t.Errorf("Expected transcript to resume at %s, got %q", path, msg)
+	}
+	tr.write([]byte("resumed\n"))
+	tr.stop()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if string(data) != "during\nresumed\n" {
+		t.Errorf("Unexpected transcript %q", data)
+	}
+}
+
+func TestDefaultTranscriptPath(t *testing.T) {
+	now := time.Date(2024, 3, 1, 14, 5, 9, 0, time.UTC)
+	if got := defaultTranscriptPath("dev", now); got != "persishtent-dev-20240301-140509.txt" {
+		t.Errorf("Unexpected path %q", got)
+	}
+}
@@ -0,0 +1,330 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/term"
+	"persishtent/internal/ansi"
+	"persishtent/internal/config"
+	"persishtent/internal/protocol"
+)
+
+// viewFrame is the shortest time between two redraws of the view, so busy
+// sessions don't redraw the terminal for every packet.
+const viewFrame = 20 * time.Millisecond
+
+// pane shows one session in a column of the view.
+type pane struct {
+	name   string
+	conn   net.Conn       // Read-only attachment
+	client *SessionClient // Owner of conn, acknowledges the output
+	input  *fanout        // Control connection taking input while focused, nil if read-only
+	screen *ansi.Screen
+	left   int    // First terminal column, counted from 0
+	cols   int    // Width on the terminal
+	status string // Shown in the title, e.g. an error
+	ended  bool
+}
+
+// view renders sessions side by side in one terminal, see View.
+type view struct {
+	mu     sync.Mutex
+	out    io.Writer
+	panes  []*pane
+	focus  int
+	rows   int           // Rows of the panes, below their title line
+	dirty  chan struct{} // Asks the renderer for a redraw
+	ended  chan struct{} // Signals a pane whose session ended
+	width  int
+	height int
+	closed bool // The terminal is restored, nothing may be drawn
+}
+
+// openPane attaches read-only to session name. The screen starts at the
+// session's size, so the replayed history lands where it was written.
+func openPane(name string) (*pane, error) {
+	rows, cols := 24, 80
+	if st, err := Query(name, ""); err == nil && st.Rows > 0 && st.Cols > 0 {
+		rows, cols = int(st.Rows), int(st.Cols)
+	}
+	c := NewSessionClient(name, 0, true)
+	c.Replay = true
+	if err := c.Connect(""); err != nil {
+		return nil, err
+	}
+	if err := c.Handshake(); err != nil {
+		_ = c.Conn.Close()
+		return nil, err
+	}
+	return &pane{name: name, conn: c.Conn, client: c, screen: ansi.NewScreen(rows, cols, 0)}, nil
+}
+
+// layout splits the terminal into columns and reports each pane's size to
+// its session, which the resize policy takes into account like any other
+// client's. Must be called with mu held.
+func (v *view) layout(width, height int) error {
+	n := len(v.panes)
+	cols := (width - (n - 1)) / n
+	if cols < 1 || height < 2 {
+		return errors.New("terminal too small for the panes")
+	}
+	v.width, v.height, v.rows = width, height, height-1
+	for i, p := range v.panes {
+		p.left, p.cols = i*(cols+1), cols
+		if i == n-1 {
+			p.cols = width - p.left
+		}
+		payload := protocol.SizePayload(uint16(v.rows), uint16(p.cols), 0, 0)
+		_ = protocol.WritePacket(p.conn, protocol.TypeResize, payload)
+	}
+	return nil
+}
+
+func (v *view) redraw() {
+	select {
+	case v.dirty <- struct{}{}:
+	default:
+	}
+}
+
+// read feeds the output of pane p into its screen until its session ends.
+func (v *view) read(p *pane) {
+	packets := protocol.NewReader(p.conn)
+	for {
+		t, payload, err := packets.ReadPacket()
+		if err != nil || t == protocol.TypeExit {
+			break
+		}
+		v.mu.Lock()
+		switch t {
+		case protocol.TypeReplay, protocol.TypeData:
+			_, _ = p.screen.Write(payload)
+			if t == protocol.TypeData && p.client != nil {
+				p.client.ack(len(payload))
+			}
+		case protocol.TypeLimit:
+			if limit, ok := protocol.DecodePayloadLimit(payload); ok {
+				packets.SetLimit(limit)
+			}
+		case protocol.TypeResize:
+			rows, cols := protocol.DecodeResizePayload(payload)
+			p.screen.Resize(int(rows), int(cols))
+		case protocol.TypePing:
+			_ = protocol.WritePacket(p.conn, protocol.TypePing, nil)
+		}
+		v.mu.Unlock()
+		v.redraw()
+	}
+	v.mu.Lock()
+	p.ended, p.status = true, config.Message("session_ended")
+	v.mu.Unlock()
+	v.redraw()
+	v.ended <- struct{}{}
+}
+
+// render draws all panes. Sessions larger than their pane show the rows
+// around the cursor and are cut off on the right.
+func (v *view) render() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.closed {
+		return
+	}
+	var b strings.Builder
+	b.WriteString("\x1b[?25l")
+	cursor := ""
+	for i, p := range v.panes {
+		style := "\x1b[0;2;7m"
+		if i == v.focus {
+			style = "\x1b[0;7m"
+		}
+		title := " " + p.name
+		if p.input == nil {
+			title += " (read-only)"
+		}
+		if p.status != "" {
+			title += " " + p.status
+		}
+		fmt.Fprintf(&b, "\x1b[1;%dH%s%s\x1b[0m", p.left+1, style, fit(title, p.cols))
+
+		rows, _ := p.screen.Size()
+		y, x := p.screen.Cursor()
+		start := min(max(y-v.rows+1, 0), max(rows-v.rows, 0))
+		for r := 0; r < v.rows; r++ {
+			fmt.Fprintf(&b, "\x1b[%d;%dH%s", r+2, p.left+1, p.screen.RenderRow(start+r, p.cols))
+		}
+		if i > 0 {
+			for r := 0; r < v.height; r++ {
+				fmt.Fprintf(&b, "\x1b[%d;%dH│", r+1, p.left)
+			}
+		}
+		if i == v.focus && !p.ended && x < p.cols {
+			cursor = fmt.Sprintf("\x1b[%d;%dH\x1b[?25h", y-start+2, p.left+x+1)
+		}
+	}
+	b.WriteString(cursor)
+	_, _ = io.WriteString(v.out, b.String())
+}
+
+// fit cuts or pads s to n columns
+func fit(s string, n int) string {
+	r := []rune(s)
+	if len(r) > n {
+		return string(r[:n])
+	}
+	return s + strings.Repeat(" ", n-len(r))
+}
+
+// send writes input to the focused pane's session
+func (v *view) send(data []byte) {
+	if p := v.panes[v.focus]; len(data) > 0 && p.input != nil && !p.ended {
+		p.input.send(data)
+	}
+}
+
+// View shows the sessions in names side by side, one column each, until the
+// detach key and d are pressed or all sessions have ended. Input goes to the
+// focused pane, which the detach key and o move to the next one; panes of
+// sessions in readOnly get no input.
+func View(names []string, readOnly map[string]bool) error {
+	v := &view{out: os.Stdout, dirty: make(chan struct{}, 1), ended: make(chan struct{}, len(names))}
+	defer func() {
+		for _, p := range v.panes {
+			_ = p.conn.Close()
+			if p.input != nil {
+				p.input.close()
+			}
+		}
+	}()
+	for _, name := range names {
+		p, err := openPane(name)
+		if err != nil {
+			return fmt.Errorf("session '%s': %w", name, err)
+		}
+		v.panes = append(v.panes, p)
+		if readOnly[name] {
+			continue
+		}
+		notice := func(msg string) {
+			v.mu.Lock()
+			p.status = msg
+			v.mu.Unlock()
+			v.redraw()
+		}
+		if p.input, err = dialFanout([]string{name}, notice); err != nil {
+			return err
+		}
+	}
+
+	fd := int(os.Stdin.Fd())
+	width, height, err := term.GetSize(fd)
+	if err != nil {
+		return err
+	}
+	if err := v.layout(width, height); err != nil {
+		return err
+	}
+	oldState, err := term.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	_, _ = io.WriteString(v.out, "\x1b[?1049h\x1b[2J")
+	defer func() {
+		v.mu.Lock()
+		v.closed = true
+		v.mu.Unlock()
+		_, _ = io.WriteString(v.out, "\x1b[?25h\x1b[?1049l")
+		_ = term.Restore(fd, oldState)
+	}()
+
+	for _, p := range v.panes {
+		go v.read(p)
+	}
+	go func() {
+		for range v.dirty {
+			v.render()
+			time.Sleep(viewFrame)
+		}
+	}()
+	v.redraw()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGWINCH)
+	defer signal.Stop(sigCh)
+
+	input := make(chan []byte)
+	go func() {
+		buf := make([]byte, protocol.MaxPayloadSize/2)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if n > 0 {
+				input <- append([]byte(nil), buf[:n]...)
+			}
+			if err != nil {
+				close(input)
+				return
+			}
+		}
+	}()
+
+	detachKey := parseDetachKey(config.Current().DetachKey)
+	prefix := false
+	running := len(v.panes)
+	for {
+		select {
+		case <-sigCh:
+			if w, h, err := term.GetSize(fd); err == nil {
+				v.mu.Lock()
+				if v.layout(w, h) == nil {
+					_, _ = io.WriteString(v.out, "\x1b[2J")
+				}
+				v.mu.Unlock()
+				v.redraw()
+			}
+		case <-v.ended:
+			if running--; running == 0 {
+				return nil
+			}
+		case data, ok := <-input:
+			if !ok {
+				return nil
+			}
+			var run []byte
+			for _, b := range data {
+				switch {
+				case prefix && b == 'd':
+					v.send(run)
+					return nil
+				case prefix && b == 'o':
+					// Prefix, o -> Focus the next pane
+					v.send(run)
+					run = nil
+					v.mu.Lock()
+					v.focus = (v.focus + 1) % len(v.panes)
+					v.mu.Unlock()
+					v.redraw()
+				case prefix && b == detachKey:
+					run = append(run, b)
+				case prefix:
+					run = append(run, detachKey, b)
+				case b == detachKey:
+					prefix = true
+					continue
+				default:
+					run = append(run, b)
+				}
+				prefix = false
+			}
+			v.send(run)
+		}
+	}
+}
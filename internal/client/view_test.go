@@ -0,0 +1,66 @@
+package client
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"persishtent/internal/ansi"
+	"persishtent/internal/protocol"
+)
+
+func TestViewLayout(t *testing.T) {
+	a, b := &mockConn{}, &mockConn{}
+	v := &view{panes: []*pane{{name: "a", conn: a}, {name: "b", conn: b}}}
+	if err := v.layout(81, 25); err != nil {
+		t.Fatal(err)
+	}
+	// Two columns of 40 with a separator, the last takes the remainder
+	if p := v.panes[1]; v.panes[0].cols != 40 || p.left != 41 || p.cols != 40 || v.rows != 24 {
+		t.Errorf("Unexpected layout: %+v %+v", *v.panes[0], *p)
+	}
+	typ, payload, err := protocol.ReadPacket(&b.out)
+	if rows, cols, _, _ := protocol.DecodeSizePayload(payload); err != nil || typ != protocol.TypeResize || rows != 24 || cols != 40 {
+		t.Errorf("Expected the pane size sent to the session, got %d %dx%d (%v)", typ, cols, rows, err)
+	}
+	if err := v.layout(2, 25); err == nil {
+		t.Error("Expected an error for a terminal narrower than the panes")
+	}
+}
+
+func TestViewRender(t *testing.T) {
+	var out bytes.Buffer
+	screen := ansi.NewScreen(4, 10, 0)
+	_, _ = screen.Write([]byte("one\r\ntwo\r\nthree\r\nfour"))
+	v := &view{out: &out, panes: []*pane{{name: "web", conn: &mockConn{}, screen: screen}}}
+	v.panes[0].input = &fanout{}
+	_ = v.layout(8, 3)
+	v.render()
+
+	// The two rows of the pane show the end of the screen around the cursor
+	got := out.String()
+	for _, want := range []string{"\x1b[0;7m web    ", "three", "four", "\x1b[3;5H\x1b[?25h"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Expected %q in %q", want, got)
+		}
+	}
+	if strings.Contains(got, "two") {
+		t.Errorf("Rows above the pane were drawn: %q", got)
+	}
+
+	v.closed = true
+	out.Reset()
+	v.render()
+	if out.Len() > 0 {
+		t.Errorf("Drew %q after the terminal was restored", out.String())
+	}
+}
+
+func TestFit(t *testing.T) {
+	if got := fit("grüße", 3); got != "grü" {
+		t.Errorf("fit() = %q", got)
+	}
+	if got := fit("ab", 4); got != "ab  " {
+		t.Errorf("fit() = %q", got)
+	}
+}
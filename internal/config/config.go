@@ -4,34 +4,280 @@ import (
 	"encoding/json"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 )
 
 type Config struct {
-	LogRotationSizeMB int    `json:"log_rotation_size_mb"`
-	MaxLogRotations   int    `json:"max_log_rotations"`
-	PromptPrefix      string `json:"prompt_prefix"`
-	DetachKey         string `json:"detach_key"`
+	LogRotationSizeMB    int                `json:"log_rotation_size_mb"`
+	MaxLogRotations      int                `json:"max_log_rotations"`
+	PromptPrefix         string             `json:"prompt_prefix"`
+	DetachKey            string             `json:"detach_key"`
+	ResizePolicy         string             `json:"resize_policy"`
+	ReplayRate           int                `json:"replay_rate"`
+	Banner               string             `json:"banner"`
+	ConfirmTags          []string           `json:"confirm_tags"`
+	AbstractSockets      bool               `json:"abstract_sockets"`
+	ForwardEnv           []string           `json:"forward_env"`
+	Record               bool               `json:"record"`
+	RecordMaxPause       float64            `json:"record_max_pause"` // Seconds, 0 keeps idle gaps
+	MetricsListen        string             `json:"metrics_listen"`   // host:port or unix:/path
+	LogStripGraphics     bool               `json:"log_strip_graphics"`
+	NoLog                bool               `json:"no_log"`        // Keep session output in memory only, without log files or recordings
+	DefaultShell         string             `json:"default_shell"` // e.g. "/bin/zsh -l", $SHELL if empty
+	Profiles             map[string]Profile `json:"profiles"`
+	KeepaliveInterval    float64            `json:"keepalive_interval"` // Seconds, 0 disables keepalive input
+	KeepaliveInput       string             `json:"keepalive_input"`
+	TimingFile           string             `json:"timing_file"`          // Every command appends its --timing report here as a JSON line
+	GuardPatterns        []string           `json:"guard_patterns"`       // Regular expressions; matching input lines need confirmation
+	SecretBackends       map[string]string  `json:"secret_backends"`      // Name to command, e.g. "pass show {ref}"
+	ClientWriteTimeout   float64            `json:"client_write_timeout"` // Seconds, 0 waits forever
+	SlowClientPolicy     string             `json:"slow_client_policy"`
+	ScrollbackSizeMB     int                `json:"scrollback_size_mb"`     // Output kept in memory for replay on attach
+	RotationMarker       string             `json:"rotation_marker"`        // Template of the line between rotated log files, empty to disable
+	Messages             map[string]string  `json:"messages"`               // Message ID to template, overriding DefaultMessages
+	TerminalIntegration  bool               `json:"terminal_integration"`   // Tell known terminals which session a tab shows
+	CustomLogCleanup     string             `json:"custom_log_cleanup"`     // What clean and kill do with logs outside the state directory
+	LogIntegrityKB       int                `json:"log_integrity_kb"`       // Log output between integrity markers, 0 disables them
+	AuditLog             bool               `json:"audit_log"`              // Record attaches, kicks and kills in audit.jsonl
+	ClientKeepalive      float64            `json:"client_keepalive"`       // Seconds between pings of attached clients, 0 disables
+	DebugLog             string             `json:"debug_log"`              // Level of the daemon's debug log, see DebugLogLevels
+	HistoryRetentionDays int                `json:"history_retention_days"` // Days the logs of ended sessions are kept in the history, 0 removes them
+	Bindings             map[string]string  `json:"bindings"`               // Key pressed after the detach key to action, see BindingActions
+	PrefixTimeout        float64            `json:"prefix_timeout"`         // Seconds until a detach key without a following key is sent to the session, 0 waits forever
+	AutoNameTemplate     string             `json:"auto_name_template"`     // Base name of unnamed sessions, numbered to be unique; empty numbers them from 0
+	Term                 string             `json:"term"`                   // TERM of sessions, empty for that of their first master
 }
 
-var Global Config
+// Profile holds the options for a kind of session, used with start -profile.
+// Command line flags take precedence over profile values.
+type Profile struct {
+	Command   string            `json:"command"`
+	Shell     string            `json:"shell"`
+	Cwd       string            `json:"cwd"`
+	Env       map[string]string `json:"env"` // Values may refer to other variables, e.g. "$HOME/bin:$PATH"
+	Tags      []string          `json:"tags"`
+	Banner    string            `json:"banner"`
+	Record    bool              `json:"record"`
+	Ephemeral bool              `json:"ephemeral"`
+	Umask     string            `json:"umask"`  // Octal, e.g. "027"
+	Locale    string            `json:"locale"` // LANG of the session, e.g. "C.UTF-8"
+	TZ        string            `json:"tz"`     // e.g. "UTC"
+	// Log settings override the global ones when set
+	LogRotationSizeMB int  `json:"log_rotation_size_mb"`
+	MaxLogRotations   int  `json:"max_log_rotations"`
+	LogStripGraphics  bool `json:"log_strip_graphics"`
+	NoLog             bool `json:"no_log"`
+	// The daemon waits for these before starting the session command
+	WaitFor     []Precondition `json:"wait_for"`
+	WaitTimeout float64        `json:"wait_timeout"` // Seconds, 0 for the default of 5 minutes
+}
+
+// Precondition is a resource a session depends on, such as a database port or
+// a network mount. One of TCP and Mount is set.
+type Precondition struct {
+	Name  string `json:"name"`  // Shown by list while waiting, e.g. "nfs mount"
+	TCP   string `json:"tcp"`   // host:port that must accept connections
+	Mount string `json:"mount"` // Path that must be a mount point
+}
+
+// String returns the name of the precondition, or describes it if unnamed
+func (p Precondition) String() string {
+	switch {
+	case p.Name != "":
+		return p.Name
+	case p.TCP != "":
+		return p.TCP
+	}
+	return p.Mount
+}
+
+// ApplyLogSettings overrides the log settings of c with those set in the profile
+func (p Profile) ApplyLogSettings(c *Config) {
+	if p.LogRotationSizeMB > 0 {
+		c.LogRotationSizeMB = p.LogRotationSizeMB
+	}
+	if p.MaxLogRotations > 0 {
+		c.MaxLogRotations = p.MaxLogRotations
+	}
+	if p.LogStripGraphics {
+		c.LogStripGraphics = true
+	}
+	if p.NoLog {
+		c.NoLog = true
+	}
+}
+
+// Resize policies decide the PTY size when several clients are attached.
+const (
+	ResizeSmallest = "smallest"
+	ResizeLargest  = "largest"
+	ResizeLatest   = "latest"
+)
+
+// Slow client policies decide what the daemon does with output for a client
+// that falls too far behind.
+const (
+	SlowClientDisconnect = "disconnect"
+	SlowClientSkip       = "skip"
+	SlowClientBlock      = "block"
+)
+
+// Custom log cleanup policies decide what clean and kill do with the logs of
+// ended sessions that were kept outside the state directory.
+const (
+	CustomLogKeep   = "keep"
+	CustomLogAsk    = "ask"
+	CustomLogRemove = "remove"
+)
+
+// Debug log levels decide which daemon events go to the session's debug log.
+// Each level includes the ones before it.
+const (
+	DebugLogOff   = "off"
+	DebugLogError = "error"
+	DebugLogInfo  = "info"
+	DebugLogDebug = "debug"
+)
+
+// DebugLogLevels lists the debug log levels in order
+var DebugLogLevels = []string{DebugLogOff, DebugLogError, DebugLogInfo, DebugLogDebug}
+
+// Binding actions are what the attached client does when a key of the
+// bindings setting is pressed after the detach key. BindNone unbinds a
+// default binding, so the key is sent to the session with the prefix.
+const (
+	BindDetach         = "detach"
+	BindKill           = "kill"
+	BindSwitchNext     = "switch-next"
+	BindCopyMode       = "copy-mode"
+	BindPaste          = "paste"
+	BindToggleReadOnly = "toggle-readonly"
+	BindSendLiteral    = "send-literal"
+	BindTranscript     = "transcript"
+	BindLock           = "lock"
+	BindBroadcast      = "broadcast"
+	BindNone           = "none"
+)
+
+// BindingActions lists the actions keys can be bound to
+var BindingActions = []string{BindDetach, BindKill, BindSwitchNext, BindCopyMode, BindPaste, BindToggleReadOnly, BindSendLiteral, BindTranscript, BindLock, BindBroadcast, BindNone}
+
+// DefaultRotationMarker is shown where one log file of a session ends and the
+// next begins, and before the oldest kept file if rotation removed older ones.
+const DefaultRotationMarker = `{{if .Dropped}}[{{.Dropped}} older log files (about {{.DroppedMB}} MB) removed by rotation]{{else}}[log rotated {{.Time.Format "2006-01-02 15:04:05"}}]{{end}}`
+
+// DefaultAutoNameTemplate names unnamed sessions after their command, or
+// after their starting directory if they run a shell
+const DefaultAutoNameTemplate = `{{if .Command}}{{.Command}}{{else}}{{.Dir}}{{end}}`
+
+// current holds the settings in effect. Daemons reload them while their
+// goroutines read them, so they are never changed in place: Use and Update
+// publish a new copy.
+var current atomic.Pointer[Config]
 
 func init() {
-	// Set defaults
-	Global = Config{
-		LogRotationSizeMB: 1,
-		MaxLogRotations:   5,
-		PromptPrefix:      "persh",
-		DetachKey:         "ctrl-d",
+	Use(defaults())
+}
+
+// Current returns the settings in effect. The result must not be modified,
+// see Update.
+func Current() *Config {
+	return current.Load()
+}
+
+// Use makes c the settings in effect
+func Use(c Config) {
+	current.Store(&c)
+}
+
+// Update makes a copy of the settings in effect, changed by fn, the
+// settings in effect. Maps and slices are shared with the previous settings,
+// so fn must replace rather than modify them.
+func Update(fn func(*Config)) {
+	for {
+		old := current.Load()
+		c := *old
+		fn(&c)
+		if current.CompareAndSwap(old, &c) {
+			return
+		}
+	}
+}
+
+func defaults() Config {
+	return Config{
+		LogRotationSizeMB:    1,
+		MaxLogRotations:      5,
+		PromptPrefix:         "persh",
+		DetachKey:            "ctrl-d",
+		ResizePolicy:         ResizeSmallest,
+		ReplayRate:           2 * 1024 * 1024,
+		ConfirmTags:          []string{"prod"},
+		ForwardEnv:           []string{"SSH_AUTH_SOCK", "DISPLAY", "KRB5CCNAME", "WAYLAND_DISPLAY"},
+		RecordMaxPause:       2,
+		KeepaliveInput:       "\x00",
+		ClientWriteTimeout:   10,
+		SlowClientPolicy:     SlowClientDisconnect,
+		ScrollbackSizeMB:     2,
+		RotationMarker:       DefaultRotationMarker,
+		TerminalIntegration:  true,
+		CustomLogCleanup:     CustomLogKeep,
+		LogIntegrityKB:       64,
+		AuditLog:             true,
+		ClientKeepalive:      30,
+		DebugLog:             DebugLogInfo,
+		HistoryRetentionDays: 30,
+		PrefixTimeout:        1,
+		AutoNameTemplate:     DefaultAutoNameTemplate,
+		Bindings: map[string]string{
+			"d": BindDetach,
+			"t": BindTranscript,
+			"l": BindLock,
+			"g": BindToggleReadOnly,
+			"b": BindBroadcast,
+			"n": BindSwitchNext,
+			"[": BindCopyMode,
+			"]": BindPaste,
+		},
 	}
 }
 
+// Load overlays the settings in effect with the config file
 func Load() error {
+	c := *Current()
+	if err := load(&c); err != nil {
+		return err
+	}
+	Use(c)
+	return nil
+}
+
+// Reload replaces the settings in effect with the defaults overlaid by the
+// config file, so settings removed from the file revert to their defaults.
+// The settings are left unchanged if the file can't be read.
+func Reload() error {
+	c := defaults()
+	if err := load(&c); err != nil {
+		return err
+	}
+	Use(c)
+	return nil
+}
+
+// Path returns the location of the config file
+func Path() (string, error) {
 	home, err := os.UserHomeDir()
 	if err != nil {
-		return err
+		return "", err
 	}
+	return filepath.Join(home, ".config", "persishtent", "config.json"), nil
+}
 
-	configPath := filepath.Join(home, ".config", "persishtent", "config.json")
+func load(c *Config) error {
+	configPath, err := Path()
+	if err != nil {
+		return err
+	}
 	if _, err := os.Stat(configPath); os.IsNotExist(err) {
 		return nil // No config, use defaults
 	}
@@ -41,5 +287,5 @@ func Load() error {
 		return err
 	}
 
-	return json.Unmarshal(data, &Global)
+	return json.Unmarshal(data, c)
 }
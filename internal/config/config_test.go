@@ -7,21 +7,21 @@ import (
 )
 
 func TestDefaults(t *testing.T) {
-	// Reset Global to ensure we test defaults
-	Global = Config{
+	// Reset the settings to ensure we test defaults
+	Use(Config{
 		LogRotationSizeMB: 1,
 		MaxLogRotations:   5,
 		PromptPrefix:      "psh",
-	}
+	})
 	
-	if Global.LogRotationSizeMB != 1 {
-		t.Errorf("Default LogRotationSizeMB mismatch. Got %d, want 1", Global.LogRotationSizeMB)
+	if Current().LogRotationSizeMB != 1 {
+		t.Errorf("Default LogRotationSizeMB mismatch. Got %d, want 1", Current().LogRotationSizeMB)
 	}
-	if Global.MaxLogRotations != 5 {
-		t.Errorf("Default MaxLogRotations mismatch. Got %d, want 5", Global.MaxLogRotations)
+	if Current().MaxLogRotations != 5 {
+		t.Errorf("Default MaxLogRotations mismatch. Got %d, want 5", Current().MaxLogRotations)
 	}
-	if Global.PromptPrefix != "psh" {
-		t.Errorf("Default PromptPrefix mismatch. Got %s, want 'psh'", Global.PromptPrefix)
+	if Current().PromptPrefix != "psh" {
+		t.Errorf("Default PromptPrefix mismatch. Got %s, want 'psh'", Current().PromptPrefix)
 	}
 }
 
@@ -34,15 +34,15 @@ func TestLoad_MissingFile(t *testing.T) {
 		t.Fatalf("Load() should not fail on missing file: %v", err)
 	}
 
-	// Should still have defaults (or whatever was in Global before)
-	// Let's reset Global first to be sure
-	Global = Config{
+	// Should still have defaults (or whatever was in effect before)
+	// Let's reset the settings first to be sure
+	Use(Config{
 		LogRotationSizeMB: 1,
 		MaxLogRotations:   5,
 		PromptPrefix:      "psh",
-	}
+	})
 	
-	if Global.LogRotationSizeMB != 1 {
+	if Current().LogRotationSizeMB != 1 {
 		t.Error("Defaults should be preserved when file is missing")
 	}
 }
@@ -70,14 +70,14 @@ func TestLoad_ValidFile(t *testing.T) {
 		t.Fatalf("Load() failed on valid file: %v", err)
 	}
 
-	if Global.LogRotationSizeMB != 10 {
-		t.Errorf("LogRotationSizeMB mismatch. Got %d, want 10", Global.LogRotationSizeMB)
+	if Current().LogRotationSizeMB != 10 {
+		t.Errorf("LogRotationSizeMB mismatch. Got %d, want 10", Current().LogRotationSizeMB)
 	}
-	if Global.MaxLogRotations != 20 {
-		t.Errorf("MaxLogRotations mismatch. Got %d, want 20", Global.MaxLogRotations)
+	if Current().MaxLogRotations != 20 {
+		t.Errorf("MaxLogRotations mismatch. Got %d, want 20", Current().MaxLogRotations)
 	}
-	if Global.PromptPrefix != "test_prompt" {
-		t.Errorf("PromptPrefix mismatch. Got %s, want 'test_prompt'", Global.PromptPrefix)
+	if Current().PromptPrefix != "test_prompt" {
+		t.Errorf("PromptPrefix mismatch. Got %s, want 'test_prompt'", Current().PromptPrefix)
 	}
 }
 
@@ -101,3 +101,107 @@ func TestLoad_InvalidJSON(t *testing.T) {
 		t.Fatal("Load() should fail on invalid JSON")
 	}
 }
+
+func TestLoad_Profiles(t *testing.T) {
+	tmpDir := t.TempDir()
+	t.Setenv("HOME", tmpDir)
+
+	configDir := filepath.Join(tmpDir, ".config", "persishtent")
+	if err := os.MkdirAll(configDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	content := []byte(`{"profiles": {"build": {"command": "make watch", "tags": ["ci"], "env": {"GOFLAGS": "-race"}, "max_log_rotations": 20}}}`)
+	if err := os.WriteFile(filepath.Join(configDir, "config.json"), content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := Load(); err != nil {
+		t.Fatalf("Load() failed: %v", err)
+	}
+
+	p, ok := Current().Profiles["build"]
+	if !ok {
+		t.Fatal("Profile 'build' not loaded")
+	}
+	if p.Command != "make watch" || len(p.Tags) != 1 || p.Env["GOFLAGS"] != "-race" {
+		t.Errorf("Profile mismatch: %+v", p)
+	}
+
+	c := Config{LogRotationSizeMB: 1, MaxLogRotations: 5}
+	p.ApplyLogSettings(&c)
+	if c.MaxLogRotations != 20 {
+		t.Errorf("Expected max_log_rotations 20, got %d", c.MaxLogRotations)
+	}
+	if c.LogRotationSizeMB != 1 {
+		t.Errorf("Expected unset log_rotation_size_mb to keep the global value, got %d", c.LogRotationSizeMB)
+	}
+	Profile{NoLog: true}.ApplyLogSettings(&c)
+	if !c.NoLog {
+		t.Error("Expected no_log of the profile to apply")
+	}
+}
+
+func TestReload(t *testing.T) {
+	tmpDir := t.TempDir()
+	t.Setenv("HOME", tmpDir)
+	defer Use(*Current())
+
+	configDir := filepath.Join(tmpDir, ".config", "persishtent")
+	if err := os.MkdirAll(configDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	configPath := filepath.Join(configDir, "config.json")
+
+	_ = os.WriteFile(configPath, []byte(`{"log_rotation_size_mb": 8, "forward_env": ["DISPLAY"]}`), 0600)
+	if err := Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if Current().LogRotationSizeMB != 8 || len(Current().ForwardEnv) != 1 {
+		t.Errorf("Config not reloaded: %+v", *Current())
+	}
+
+	// Settings removed from the file revert to their defaults
+	_ = os.WriteFile(configPath, []byte(`{"max_log_rotations": 9}`), 0600)
+	if err := Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if Current().LogRotationSizeMB != 1 || Current().MaxLogRotations != 9 || len(Current().ForwardEnv) != 4 {
+		t.Errorf("Expected defaults for removed settings: %+v", *Current())
+	}
+
+	// A broken file keeps the current config
+	_ = os.WriteFile(configPath, []byte(`{`), 0600)
+	if err := Reload(); err == nil {
+		t.Error("Expected Reload to fail on invalid JSON")
+	}
+	if Current().MaxLogRotations != 9 {
+		t.Errorf("Config changed by failed reload: %+v", *Current())
+	}
+}
+
+func TestReload_Concurrent(t *testing.T) {
+	tmpDir := t.TempDir()
+	t.Setenv("HOME", tmpDir)
+	defer Use(*Current())
+	Use(defaults())
+
+	configDir := filepath.Join(tmpDir, ".config", "persishtent")
+	if err := os.MkdirAll(configDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	_ = os.WriteFile(filepath.Join(configDir, "config.json"), []byte(`{"resize_policy": "largest"}`), 0600)
+
+	// Daemons read settings while SIGHUP reloads them; go test -race checks this
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			_ = Reload()
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		if p := Current().ResizePolicy; p != ResizeSmallest && p != ResizeLargest {
+			t.Fatalf("Unexpected resize policy %q", p)
+		}
+	}
+	<-done
+}
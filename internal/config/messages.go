@@ -0,0 +1,322 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// DefaultMessages holds the user-facing notices of the CLI and the attached
+// client by ID. Each is a text/template whose fields are named in the
+// call to Message. The messages setting and locale files override them, see
+// Message. Help text and the field labels of list and info are not included.
+var DefaultMessages = map[string]string{
+	// Sessions
+	"already_inside":      "[error: already inside a persishtent session ({{.Name}})]",
+	"session_exists":      "Session '{{.Name}}' already exists.",
+	"session_exists_host": "Error: session '{{.Name}}' already exists on host '{{.Host}}'.",
+	"session_started":     "Session '{{.Name}}' started in detached mode.",
+	"start_failed":        "Error starting session: {{.Err}}",
+	"start_waiting":       "Waiting for {{.Resource}}...",
+	"start_gave_up":       "Error: session '{{.Name}}' gave up waiting for {{.Resource}}.",
+	"start_timeout":       "Timed out waiting for session to start.",
+	"session_not_found":   "Error: session '{{.Name}}' not found.",
+	"session_on_host":     "Error: session '{{.Name}}' is running on host '{{.Host}}'.",
+	"no_sessions":         "No active sessions.",
+	"list_failed":         "Error listing sessions: {{.Err}}",
+	"list_sort_invalid":   "Unknown sort order '{{.Sort}}', use {{.Sorts}}.",
+	"query_failed":        "Error querying session '{{.Name}}': {{.Err}}",
+	"wait_failed":         "Error waiting for session '{{.Name}}': {{.Err}}",
+	"unknown_profile":     "Error: unknown profile '{{.Profile}}'",
+	"sessions_header":     "Active sessions:",
+	"session_killed":      "Session '{{.Name}}' killed.",
+	"kill_failed":         "Error killing session '{{.Name}}': {{.Err}}",
+	"kill_timeout":        "Session '{{.Name}}' did not exit within {{.Timeout}}.",
+	"kill_summary":        "{{.Killed}} killed, {{.Failed}} failed, {{.TimedOut}} timed out.",
+	"session_shut_down":   "Session '{{.Name}}' shut down.",
+	"shutdown_failed":     "Error shutting down session '{{.Name}}': {{.Err}}",
+	"shutdown_no_timeout": "The -timeout of shutdown must be positive, SIGKILL follows once it passed.",
+	"shutdown_summary":    "{{.Stopped}} shut down, {{.Failed}} failed, {{.TimedOut}} timed out.",
+	"session_upgraded":    "Session '{{.Name}}' handed over to the new daemon.",
+	"upgrade_failed":      "Error upgrading session '{{.Name}}': {{.Err}}",
+	"upgrade_summary":     "{{.Upgraded}} upgraded, {{.Failed}} failed.",
+	"session_renamed":     "Session '{{.Name}}' renamed to '{{.NewName}}'.",
+	"rename_failed":       "Error renaming session: {{.Err}}",
+	"session_reloaded":    "Session '{{.Name}}' reloaded config.",
+	"reload_failed":       "Error reloading config of session '{{.Name}}': {{.Err}}",
+	"session_suspended":   "Session '{{.Name}}' suspended.",
+	"suspend_failed":      "Error suspending session '{{.Name}}': {{.Err}}",
+	"session_resumed":     "Session '{{.Name}}' resumed.",
+	"resume_failed":       "Error resuming session '{{.Name}}': {{.Err}}",
+	"session_updated":     "Session '{{.Name}}' updated ({{.Change}}).",
+	"update_failed":       "Error updating session '{{.Name}}': {{.Err}}",
+	"no_match":            "Error: no session matches '{{.Pattern}}'.",
+	"pipe_started":        "Piping output of session '{{.Name}}' to '{{.Command}}'.",
+	"pipe_stopped":        "Stopped piping output of session '{{.Name}}'.",
+	"secret_injected":     "Secret injected into session '{{.Name}}'.",
+	"secret_failed":       "Error injecting secret into session '{{.Name}}': {{.Err}}",
+	"no_logs":             "Error: no logs for session '{{.Name}}'.",
+	"logs_failed":         "Error reading logs: {{.Err}}",
+	"log_damaged":         "[{{.Size}} bytes of damaged log output skipped]",
+	"replay_trimmed":      "[older output {{if .Logged}}not replayed, see persishtent logs {{.Name}}{{else}}dropped from memory{{end}}]",
+	"mark_not_found":      "Error: no mark '{{.Mark}}' in the logs of session '{{.Name}}'.",
+	"mark_set":            "Mark '{{.Mark}}' set in the log of session '{{.Name}}'.",
+	"mark_failed":         "Error setting a mark in session '{{.Name}}': {{.Err}}",
+	"logs_intact":         "All logs of session '{{.Name}}' are intact.",
+	"logs_damaged":        "Logs of session '{{.Name}}' are damaged or truncated.",
+	"logs_unverified":     "Logs of session '{{.Name}}' can't be verified.",
+	"history_pruned":      "Removed {{.Size}} of old output from the logs of session '{{.Name}}'.",
+	"prune_failed":        "Error pruning logs of session '{{.Name}}': {{.Err}}",
+	"cleaned":             "Cleaned up {{.Count}} stale files ({{.Size}} reclaimed).",
+	"clean_dry_run":       "Would clean up {{.Count}} files ({{.Size}}).",
+	"clean_failed":        "Error cleaning sessions: {{.Err}}",
+	"no_clients":          "No clients attached to session '{{.Name}}'.",
+	"client_kicked":       "Client {{.ID}} detached from session '{{.Name}}'.",
+	"kick_failed":         "Error detaching client {{.ID}} from session '{{.Name}}': {{.Err}}",
+	"master_detached":     "Master of session '{{.Name}}' detached.",
+	"clients_detached":    "All clients of session '{{.Name}}' detached.",
+	"detach_failed":       "Error detaching clients from session '{{.Name}}': {{.Err}}",
+	"message_failed":      "Error sending message to session '{{.Name}}': {{.Err}}",
+	"access_granted":      "Client {{.ID}} of session '{{.Name}}' can now type.",
+	"access_revoked":      "Client {{.ID}} of session '{{.Name}}' is read-only again.",
+	"grant_failed":        "Error changing write access of client {{.ID}}: {{.Err}}",
+	"custom_logs":         "{{.Count}} log files of ended sessions are kept outside the state directory:",
+	"custom_logs_prompt":  "Remove them? [y/N] ",
+	"custom_logs_hint":    "Use clean -logs to remove them, or set custom_log_cleanup.",
+	"custom_logs_removed": "Removed {{.Count}} log files.",
+	"tree_header":         "Session '{{.Name}}', every {{.Interval}} (ctrl+c to stop)",
+	"config_load_failed":  "Warning: failed to load config: {{.Err}}",
+	"config_saved":        "Set {{.Key}}. Run 'persishtent reload' to apply it to running sessions.",
+	"error":               "Error: {{.Err}}",
+
+	// Crash reports, metrics and self-test
+	"crash_reports_header": "Crash reports:",
+	"no_crash_reports":     "No crash reports.",
+	"crash_list_failed":    "Error listing crash reports: {{.Err}}",
+	"crash_not_found":      "No crash report for session '{{.Name}}'.",
+	"crashes_removed":      "Removed {{.Count}} crash reports.",
+	"no_audit_events":      "No audit events recorded.",
+	"audit_failed":         "Error reading the audit log: {{.Err}}",
+	"no_debug_events":      "No debug log events for session '{{.Name}}'.",
+	"debug_log_failed":     "Error reading the debug log: {{.Err}}",
+	"debug_level_invalid":  "Unknown level '{{.Level}}', use error, info or debug.",
+	"daemon_output":        "Daemon output:\n{{.Output}}",
+	"history_header":       "Ended sessions:",
+	"no_history":           "No ended sessions in the history.",
+	"history_failed":       "Error reading the history: {{.Err}}",
+	"history_not_found":    "No ended session '{{.Name}}' in the history.",
+	"buffers_header":       "Paste buffers:",
+	"no_buffers":           "No paste buffers.",
+	"buffer_loaded":        "Loaded {{.Size}} into buffer '{{.Buffer}}'.",
+	"buffer_removed":       "Removed buffer '{{.Buffer}}'.",
+	"buffer_failed":        "Error: {{.Err}}",
+	"paste_failed":         "Error pasting into session '{{.Name}}': {{.Err}}",
+	"metrics_serving":      "Serving metrics on {{.Address}}/metrics",
+	"api_serving":          "Serving the JSON-RPC API on {{.Path}}",
+	"web_serving":          "Serving the web terminal, open {{.URL}}",
+	"web_insecure":         "Warning: {{.Address}} is reachable from other hosts without TLS, the token is sent in clear text. Use -cert and -key.",
+	"selftest_running":     "Running self-test...",
+	"selftest_failed":      "Self-test failed.",
+	"selftest_passed":      "All checks passed.",
+	"launchd_installed":    "Session '{{.Name}}' will be started again at login ({{.Path}}).",
+	"launchd_uninstalled":  "Session '{{.Name}}' will no longer be started at login.",
+	"launchd_missing":      "No LaunchAgent installed for session '{{.Name}}'.",
+	"launchd_unsupported":  "Error: launchd is only available on macOS.",
+	"launchd_env_dropped":  "Warning: variables set with -e ({{.Names}}) are not kept; add them to the env of a profile to have them at login.",
+
+	// Attaching
+	"confirm_tag":         "Session '{{.Name}}' is tagged '{{.Tag}}'. Type the session name to attach: ",
+	"confirm_failed":      "Confirmation failed, not attaching. Use -ro to attach read-only.",
+	"attach_remote_hint":  "Error: session '{{.Name}}' is running on host '{{.Host}}'. Use '{{.Name}}@{{.Host}}' to attach there.",
+	"attaching":           "[attaching to session '{{.Name}}'. press ctrl+d, d to detach]",
+	"attaching_readonly":  "[attaching to session '{{.Name}}' (READ-ONLY). press ctrl+d, d to detach]",
+	"connecting":          "[connecting to '{{.Name}}' on {{.Host}}]",
+	"attach_failed":       "[error attaching to '{{.Name}}': {{.Err}}]",
+	"remote_failed":       "[error attaching to '{{.Name}}' on {{.Host}}: {{.Err}}]",
+	"ssh_missing":         "Error: persishtent is not installed on {{.Host}}. Use 'persishtent ssh -install' to copy this binary there.",
+	"ssh_installing":      "[installing persishtent in ~/.local/bin on {{.Host}}]",
+	"ssh_platform":        "{{.Host}} runs {{.Platform}}, but this binary is built for {{.Local}}",
+	"ssh_failed":          "[error connecting to {{.Host}}: {{.Err}}]",
+	"session_locked":      "session is locked by an exclusive attach",
+	"attach_refused":      "[session '{{.Name}}' is locked by an exclusive attach. Use -ro to watch it]",
+	"detached":            "[detached]",
+	"reconnecting":        "[connection lost, reconnecting]",
+	"reconnected":         "[reconnected]",
+	"reconnect_gap":       "[older output was lost while disconnected]",
+	"reconnect_failed":    "[could not reconnect: {{.Err}}]",
+	"detached_by_other":   "[detached by another connection]",
+	"detached_by":         "[detached by {{.By}}]",
+	"write_granted":       "[you were granted write access]",
+	"write_revoked":       "[write access revoked, read-only again]",
+	"write_granted_to":    "[write access granted to {{.Client}}]",
+	"write_revoked_from":  "[write access revoked from {{.Client}}]",
+	"no_viewers":          "[no read-only viewer to grant write access to]",
+	"message":             "[{{if .From}}{{.From}}: {{end}}{{.Text}}]",
+	"shutting_down":       "session shutting down{{if .Reason}}: {{.Reason}}{{end}}",
+	"client_joined":       "[{{.Client}} attached{{if .ReadOnly}} read-only{{end}}]",
+	"also_attached":       "Also attached: {{.Clients}}",
+	"input_failed":        "[{{.Err}}]",
+	"daemon_error":        "[{{.Err}}]",
+	"terminated":          "[terminated]",
+	"session_ended":       "[session ended]",
+	"size_warning":        "[session is {{.Cols}}x{{.Rows}}, your window is {{.WindowCols}}x{{.WindowRows}}]",
+	"guard_prompt":        "[input matches guard pattern {{printf \"%q\" .Pattern}}. Send it? y/n]",
+	"guard_sent":          "[input sent]",
+	"guard_discarded":     "[input discarded]",
+	"guard_expired":       "[not confirmed in time, input discarded]",
+	"transcript_started":  "[transcript started: {{.Path}}]",
+	"transcript_saved":    "[transcript saved to {{.Path}}]",
+	"transcript_failed":   "[transcript failed: {{.Err}}]",
+	"replay_skipped":      "[replay skipped]",
+	"input_locked":        "[input locked. press {{.Keys}} to unlock]",
+	"input_unlocked":      "[input unlocked]",
+	"lines_copied":        "[{{.Lines}} lines copied to buffer '{{.Buffer}}' and the clipboard]",
+	"copy_mode_status":    "[copy mode, line {{.Line}} of {{.Lines}}{{if .Selected}}, {{.Selected}} selected{{end}}. v selects, y copies, q quits]",
+	"paste_notice_failed": "[could not paste: {{.Err}}]",
+	"copy_failed":         "[could not copy the screen: {{.Err}}]",
+	"kill_notice_failed":  "[could not kill the session: {{.Err}}]",
+	"no_next_session":     "[no other session to switch to]",
+	"reattach_none":       "No attachments to restore.",
+	"reattach_failed":     "Error restoring session '{{.Name}}': {{.Err}}",
+	"layout_saved":        "Saved {{.Count}} attachments to {{.Path}}.",
+
+	// Broadcast
+	"broadcasting":       "[broadcasting input to {{.Names}}. press ctrl+d, d to stop]",
+	"broadcast_ended":    "[all sessions ended]",
+	"broadcast_failed":   "[{{.Name}}: {{.Err}}]",
+	"broadcast_on":       "[input goes to {{.Count}} more sessions of group '{{.Group}}']",
+	"broadcast_off":      "[input goes to this session only]",
+	"broadcast_no_group": "[session '{{.Name}}' is in no group]",
+	"broadcast_alone":    "[no other sessions in group '{{.Group}}']",
+	"no_group_sessions":  "Error: no session in group '{{.Group}}'.",
+
+	// Garbage collection
+	"gc_none":            "No orphaned daemons.",
+	"gc_prompt":          "Orphaned {{.Daemon}}: [k]ill, [r]egister or [s]kip? ",
+	"gc_orphan":          "Orphaned {{.Daemon}}",
+	"gc_killed":          "Killed {{.Daemon}}.",
+	"gc_kill_failed":     "Error killing {{.Daemon}}: {{.Err}}",
+	"gc_registered":      "Registered session '{{.Name}}' again.",
+	"gc_register_failed": "Error registering {{.Daemon}}: {{.Err}}",
+	"gc_hint":            "Use gc -kill or gc -register to handle them.",
+}
+
+var (
+	localeOnce     sync.Once
+	localeMessages map[string]string
+)
+
+// Message renders message id with the given field names and values, e.g.
+// Message("session_killed", "Name", name). The template comes from the
+// messages setting, else from the locale file, else from DefaultMessages;
+// an override that fails to render falls back to the default.
+func Message(id string, fields ...any) string {
+	data := make(map[string]any, len(fields)/2)
+	for i := 0; i+1 < len(fields); i += 2 {
+		data[fmt.Sprint(fields[i])] = fields[i+1]
+	}
+	localeOnce.Do(func() { localeMessages = loadLocaleMessages() })
+	for _, tmpl := range []string{Current().Messages[id], localeMessages[id]} {
+		if tmpl == "" {
+			continue
+		}
+		if text, err := renderMessage(tmpl, data); err == nil {
+			return text
+		}
+	}
+	tmpl, ok := DefaultMessages[id]
+	if !ok {
+		return id
+	}
+	text, err := renderMessage(tmpl, data)
+	if err != nil {
+		return id
+	}
+	return text
+}
+
+func renderMessage(tmpl string, data map[string]any) (string, error) {
+	t, err := template.New("message").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// MessageLocales returns the locales whose message files are looked up, most
+// specific first, from LC_ALL, LC_MESSAGES or LANG. "de_DE.UTF-8" gives
+// de_DE and de.
+func MessageLocales() []string {
+	var locale string
+	for _, key := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		if locale = os.Getenv(key); locale != "" {
+			break
+		}
+	}
+	locale, _, _ = strings.Cut(locale, ".")
+	locale, _, _ = strings.Cut(locale, "@")
+	if locale == "" || locale == "C" || locale == "POSIX" {
+		return nil
+	}
+	locales := []string{locale}
+	if lang, _, ok := strings.Cut(locale, "_"); ok {
+		locales = append(locales, lang)
+	}
+	return locales
+}
+
+// MessagesDir returns the directory of the locale message files, which are
+// named after the locale, e.g. de.json, and map message IDs to templates.
+func MessagesDir() (string, error) {
+	configPath, err := Path()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(configPath), "messages"), nil
+}
+
+// loadLocaleMessages merges the message files of MessageLocales, the more
+// specific locale winning. Missing or invalid files are ignored.
+func loadLocaleMessages() map[string]string {
+	dir, err := MessagesDir()
+	if err != nil {
+		return nil
+	}
+	messages := make(map[string]string)
+	locales := MessageLocales()
+	for i := len(locales) - 1; i >= 0; i-- {
+		data, err := os.ReadFile(filepath.Join(dir, locales[i]+".json"))
+		if err != nil {
+			continue
+		}
+		var file map[string]string
+		if err := json.Unmarshal(data, &file); err != nil {
+			continue
+		}
+		for id, tmpl := range file {
+			messages[id] = tmpl
+		}
+	}
+	return messages
+}
+
+// validateMessages checks that overrides name known messages and parse.
+func validateMessages(messages map[string]string) error {
+	for id, tmpl := range messages {
+		if _, ok := DefaultMessages[id]; !ok {
+			return fmt.Errorf("unknown message %q", id)
+		}
+		if _, err := template.New(id).Parse(tmpl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestMessage(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("LC_ALL", "")
+	t.Setenv("LC_MESSAGES", "")
+	t.Setenv("LANG", "C")
+	old := *Current()
+	defer func() {
+		Use(old)
+		localeOnce = sync.Once{}
+	}()
+	Use(defaults())
+	localeOnce = sync.Once{}
+
+	if got := Message("session_killed", "Name", "web"); got != "Session 'web' killed." {
+		t.Errorf("Default message = %q", got)
+	}
+	if got := Message("error", "Err", errors.New("boom")); got != "Error: boom" {
+		t.Errorf("Error message = %q", got)
+	}
+
+	// The messages setting overrides the default; broken overrides fall back
+	Update(func(c *Config) {
+		c.Messages = map[string]string{
+			"session_killed": "Sitzung {{.Name}} beendet.",
+			"detached":       "{{.Missing}}",
+		}
+	})
+	if got := Message("session_killed", "Name", "web"); got != "Sitzung web beendet." {
+		t.Errorf("Overridden message = %q", got)
+	}
+	if got := Message("detached"); got != "[detached]" {
+		t.Errorf("Expected the default for a broken override, got %q", got)
+	}
+	if got := Message("no_such_message"); got != "no_such_message" {
+		t.Errorf("Unknown message = %q", got)
+	}
+}
+
+func TestMessageLocaleFiles(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("LC_ALL", "")
+	t.Setenv("LC_MESSAGES", "de_AT.UTF-8")
+	old := *Current()
+	defer func() {
+		Use(old)
+		localeOnce = sync.Once{}
+	}()
+	Use(defaults())
+	localeOnce = sync.Once{}
+
+	if got := MessageLocales(); !reflect.DeepEqual(got, []string{"de_AT", "de"}) {
+		t.Errorf("MessageLocales() = %v", got)
+	}
+
+	dir, _ := MessagesDir()
+	_ = os.MkdirAll(dir, 0700)
+	_ = os.WriteFile(filepath.Join(dir, "de.json"), []byte(`{"detached": "[getrennt]", "terminated": "[beendet]"}`), 0600)
+	_ = os.WriteFile(filepath.Join(dir, "de_AT.json"), []byte(`{"terminated": "[aus]"}`), 0600)
+
+	if got := Message("detached"); got != "[getrennt]" {
+		t.Errorf("Language file message = %q", got)
+	}
+	if got := Message("terminated"); got != "[aus]" {
+		t.Errorf("Expected the more specific locale to win, got %q", got)
+	}
+	// The messages setting takes precedence over locale files
+	Update(func(c *Config) { c.Messages = map[string]string{"detached": "[weg]"} })
+	if got := Message("detached"); got != "[weg]" {
+		t.Errorf("Expected the setting to win, got %q", got)
+	}
+}
+
+func TestDefaultMessagesParse(t *testing.T) {
+	if err := validateMessages(DefaultMessages); err != nil {
+		t.Error(err)
+	}
+}
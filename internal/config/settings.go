@@ -0,0 +1,318 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Keys returns the names of all settings in config file order
+func Keys() []string {
+	t := reflect.TypeOf(Config{})
+	keys := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		keys = append(keys, jsonKey(t.Field(i)))
+	}
+	return keys
+}
+
+// Get returns the JSON encoded value of setting key in c
+func Get(c Config, key string) (string, error) {
+	v, err := field(&c, key)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(v.Interface())
+	return string(data), err
+}
+
+// Set validates value for setting key and writes it to the config file,
+// keeping all other settings in the file. Lists may be given comma-separated
+// or as JSON, profiles only as JSON.
+func Set(key, value string) error {
+	var c Config
+	v, err := field(&c, key)
+	if err != nil {
+		return err
+	}
+	if err := parseValue(v, value); err != nil {
+		return fmt.Errorf("invalid value for %s: %w", key, err)
+	}
+	if err := validate(key, c); err != nil {
+		return fmt.Errorf("invalid value for %s: %w", key, err)
+	}
+	encoded, err := json.Marshal(v.Interface())
+	if err != nil {
+		return err
+	}
+
+	configPath, err := Path()
+	if err != nil {
+		return err
+	}
+	settings := make(map[string]json.RawMessage)
+	if data, err := os.ReadFile(configPath); err == nil {
+		if err := json.Unmarshal(data, &settings); err != nil {
+			return fmt.Errorf("%s: %w", configPath, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	settings[key] = encoded
+
+	data, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(configPath), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(configPath, append(data, '\n'), 0600)
+}
+
+// field returns the settable field of c for setting key
+func field(c *Config, key string) (reflect.Value, error) {
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if jsonKey(v.Type().Field(i)) == key {
+			return v.Field(i), nil
+		}
+	}
+	return reflect.Value{}, fmt.Errorf("unknown setting %q", key)
+}
+
+func jsonKey(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	return name
+}
+
+// parseValue parses a command line value into v according to its type
+func parseValue(v reflect.Value, value string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return fmt.Errorf("must not be negative")
+		}
+		v.SetInt(int64(n))
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		if f < 0 {
+			return fmt.Errorf("must not be negative")
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		if strings.HasPrefix(strings.TrimSpace(value), "[") {
+			return json.Unmarshal([]byte(value), v.Addr().Interface())
+		}
+		list := []string{}
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	default:
+		return json.Unmarshal([]byte(value), v.Addr().Interface())
+	}
+	return nil
+}
+
+// validate checks settings whose valid values are narrower than their type
+func validate(key string, c Config) error {
+	switch key {
+	case "detach_key":
+		_, err := ParseDetachKey(c.DetachKey)
+		return err
+	case "resize_policy":
+		switch c.ResizePolicy {
+		case ResizeSmallest, ResizeLargest, ResizeLatest:
+			return nil
+		}
+		return fmt.Errorf("must be %s, %s or %s", ResizeSmallest, ResizeLargest, ResizeLatest)
+	case "slow_client_policy":
+		switch c.SlowClientPolicy {
+		case SlowClientDisconnect, SlowClientSkip, SlowClientBlock:
+			return nil
+		}
+		return fmt.Errorf("must be %s, %s or %s", SlowClientDisconnect, SlowClientSkip, SlowClientBlock)
+	case "debug_log":
+		if slices.Contains(DebugLogLevels, c.DebugLog) {
+			return nil
+		}
+		return fmt.Errorf("must be %s, %s, %s or %s", DebugLogOff, DebugLogError, DebugLogInfo, DebugLogDebug)
+	case "custom_log_cleanup":
+		switch c.CustomLogCleanup {
+		case CustomLogKeep, CustomLogAsk, CustomLogRemove:
+			return nil
+		}
+		return fmt.Errorf("must be %s, %s or %s", CustomLogKeep, CustomLogAsk, CustomLogRemove)
+	case "profiles":
+		for name, p := range c.Profiles {
+			if _, err := ParseUmask(p.Umask); p.Umask != "" && err != nil {
+				return fmt.Errorf("profile %s: %v", name, err)
+			}
+			for key := range p.Env {
+				if !validEnvKey(key) {
+					return fmt.Errorf("profile %s: invalid environment variable name %q", name, key)
+				}
+			}
+			if p.WaitTimeout < 0 {
+				return fmt.Errorf("profile %s: wait_timeout must not be negative", name)
+			}
+			for _, cond := range p.WaitFor {
+				if (cond.TCP == "") == (cond.Mount == "") {
+					return fmt.Errorf("profile %s: wait_for entries need either tcp or mount", name)
+				}
+			}
+		}
+	case "bindings":
+		_, err := ParseBindings(c.Bindings)
+		return err
+	case "messages":
+		return validateMessages(c.Messages)
+	case "rotation_marker":
+		_, err := template.New("marker").Parse(c.RotationMarker)
+		return err
+	case "auto_name_template":
+		_, err := template.New("auto_name").Parse(c.AutoNameTemplate)
+		return err
+	case "guard_patterns":
+		for _, pattern := range c.GuardPatterns {
+			if _, err := regexp.Compile(pattern); err != nil {
+				return err
+			}
+		}
+	case "term":
+		// The value ends up in the shell's environment and env file
+		if strings.ContainsAny(c.Term, " \t\n='\"\\\x00") {
+			return fmt.Errorf("must be a terminal type such as xterm-256color")
+		}
+	case "default_shell":
+		if fields := strings.Fields(c.DefaultShell); len(fields) > 0 {
+			if _, err := exec.LookPath(fields[0]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ParseUmask parses an octal file mode creation mask such as "027"
+func ParseUmask(s string) (int, error) {
+	mask, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mask > 0777 {
+		return 0, fmt.Errorf("invalid umask %q, must be octal like 022", s)
+	}
+	return int(mask), nil
+}
+
+// ParseEnvVar splits a KEY=VALUE environment assignment such as those given
+// with start -e. Keys must not be empty or contain "=", and neither part may
+// contain NUL bytes.
+func ParseEnvVar(s string) (string, string, error) {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok || !validEnvKey(key) || strings.ContainsRune(value, 0) {
+		return "", "", fmt.Errorf("invalid environment variable %q, must be KEY=VALUE", s)
+	}
+	return key, value, nil
+}
+
+func validEnvKey(key string) bool {
+	return key != "" && !strings.ContainsAny(key, "=\x00")
+}
+
+// ParseBindings converts the bindings setting into actions by the byte the
+// terminal sends for each key. Keys are single characters such as "d" or
+// control keys such as "ctrl-k". Bindings to BindNone are left out. All
+// valid bindings are returned along with the error of the first invalid one.
+func ParseBindings(bindings map[string]string) (map[byte]string, error) {
+	actions := make(map[byte]string, len(bindings))
+	var firstErr error
+	for key, action := range bindings {
+		b, err := parseBindingKey(key)
+		if err == nil && !slices.Contains(BindingActions, action) {
+			err = fmt.Errorf("unknown action %q for key %q, expected one of %s", action, key, strings.Join(BindingActions, ", "))
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if action != BindNone {
+			actions[b] = action
+		}
+	}
+	return actions, firstErr
+}
+
+// parseBindingKey returns the byte the terminal sends for a key of the
+// bindings setting
+func parseBindingKey(key string) (byte, error) {
+	if len(key) == 1 && key[0] >= ' ' && key[0] < 0x7f {
+		return key[0], nil
+	}
+	return ParseDetachKey(key)
+}
+
+// ParseDetachKey converts a key name such as "ctrl-d" into the byte the
+// terminal sends for it.
+func ParseDetachKey(key string) (byte, error) {
+	key = strings.ToLower(key)
+	if len(key) >= 6 && key[:5] == "ctrl-" {
+		c := key[5]
+		if c >= 'a' && c <= 'z' {
+			return c - 'a' + 1, nil
+		}
+		switch c {
+		case '[':
+			return 27, nil
+		case '\\':
+			return 28, nil
+		case ']':
+			return 29, nil
+		case '^':
+			return 30, nil
+		case '_':
+			return 31, nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported key %q, expected ctrl-a to ctrl-z or ctrl-[, ctrl-\\, ctrl-], ctrl-^, ctrl-_", key)
+}
+
+// KeyName returns the name of the key sending b, the inverse of
+// parseBindingKey, e.g. "ctrl-d" for 0x04.
+func KeyName(b byte) string {
+	switch {
+	case b >= ' ' && b < 0x7f:
+		return string(b)
+	case b >= 1 && b <= 26:
+		return "ctrl-" + string('a'+b-1)
+	case b >= 27 && b <= 31:
+		return "ctrl-" + string("[\\]^_"[b-27])
+	}
+	return fmt.Sprintf("0x%02x", b)
+}
@@ -0,0 +1,156 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGet(t *testing.T) {
+	c := defaults()
+	tests := []struct {
+		key, want string
+	}{
+		{"prompt_prefix", `"persh"`},
+		{"max_log_rotations", "5"},
+		{"record", "false"},
+		{"forward_env", `["SSH_AUTH_SOCK","DISPLAY","KRB5CCNAME","WAYLAND_DISPLAY"]`},
+	}
+	for _, tt := range tests {
+		if got, err := Get(c, tt.key); err != nil || got != tt.want {
+			t.Errorf("Get(%q) = %q, %v; want %q", tt.key, got, err, tt.want)
+		}
+	}
+	if _, err := Get(c, "nope"); err == nil {
+		t.Error("Expected an error for an unknown setting")
+	}
+
+	keys := Keys()
+	if len(keys) == 0 || keys[0] != "log_rotation_size_mb" {
+		t.Errorf("Unexpected keys: %v", keys)
+	}
+}
+
+func TestParseUmask(t *testing.T) {
+	if mask, err := ParseUmask("027"); err != nil || mask != 027 {
+		t.Errorf("ParseUmask(027) = %o, %v", mask, err)
+	}
+	for _, s := range []string{"", "8", "1777", "-1"} {
+		if _, err := ParseUmask(s); err == nil {
+			t.Errorf("ParseUmask(%q) should fail", s)
+		}
+	}
+}
+
+func TestParseEnvVar(t *testing.T) {
+	if key, value, err := ParseEnvVar("DSN=host=db port=5432"); err != nil || key != "DSN" || value != "host=db port=5432" {
+		t.Errorf("ParseEnvVar = %q, %q, %v", key, value, err)
+	}
+	if key, value, err := ParseEnvVar("EMPTY="); err != nil || key != "EMPTY" || value != "" {
+		t.Errorf("ParseEnvVar(EMPTY=) = %q, %q, %v", key, value, err)
+	}
+	for _, s := range []string{"", "FOO", "=bar", "FOO=a\x00b"} {
+		if _, _, err := ParseEnvVar(s); err == nil {
+			t.Errorf("ParseEnvVar(%q) should fail", s)
+		}
+	}
+}
+
+func TestSet(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	configPath := filepath.Join(home, ".config", "persishtent", "config.json")
+
+	// Settings are added to the file without touching the others
+	_ = os.MkdirAll(filepath.Dir(configPath), 0700)
+	_ = os.WriteFile(configPath, []byte(`{"banner": "hi", "future_setting": 1}`), 0600)
+
+	sets := [][2]string{
+		{"prompt_prefix", "work"},
+		{"max_log_rotations", "9"},
+		{"record", "true"},
+		{"confirm_tags", "prod, staging"},
+		{"detach_key", "ctrl-b"},
+		{"term", "xterm-kitty"},
+	}
+	for _, s := range sets {
+		if err := Set(s[0], s[1]); err != nil {
+			t.Fatalf("Set(%q, %q) failed: %v", s[0], s[1], err)
+		}
+	}
+
+	c := defaults()
+	if err := load(&c); err != nil {
+		t.Fatal(err)
+	}
+	if c.PromptPrefix != "work" || c.MaxLogRotations != 9 || !c.Record || c.DetachKey != "ctrl-b" || c.Banner != "hi" || c.Term != "xterm-kitty" {
+		t.Errorf("Unexpected config: %+v", c)
+	}
+	if len(c.ConfirmTags) != 2 || c.ConfirmTags[1] != "staging" {
+		t.Errorf("ConfirmTags = %v", c.ConfirmTags)
+	}
+	var raw map[string]any
+	data, _ := os.ReadFile(configPath)
+	if err := json.Unmarshal(data, &raw); err != nil || raw["future_setting"] != 1.0 {
+		t.Errorf("Unknown settings not kept: %s", data)
+	}
+
+	invalid := [][2]string{
+		{"unknown", "x"},
+		{"max_log_rotations", "-1"},
+		{"record", "maybe"},
+		{"detach_key", "alt-x"},
+		{"resize_policy", "biggest"},
+		{"profiles", "not json"},
+		{"profiles", `{"db": {"wait_for": [{"name": "db"}]}}`},
+		{"profiles", `{"db": {"wait_for": [{"tcp": "db:5432", "mount": "/mnt"}]}}`},
+		{"profiles", `{"db": {"wait_timeout": -1}}`},
+		{"profiles", `{"db": {"umask": "099"}}`},
+		{"guard_patterns", "rm -rf /, (unclosed"},
+		{"slow_client_policy", "wait"},
+		{"custom_log_cleanup", "delete"},
+		{"debug_log", "verbose"},
+		{"history_retention_days", "-1"},
+		{"client_write_timeout", "-5"},
+		{"rotation_marker", "{{.Time"},
+		{"messages", `{"no_such_message": "hi"}`},
+		{"messages", `{"detached": "{{.Name"}`},
+		{"term", "xterm kitty"},
+	}
+	for _, s := range invalid {
+		if err := Set(s[0], s[1]); err == nil {
+			t.Errorf("Set(%q, %q) should fail", s[0], s[1])
+		}
+	}
+}
+
+func TestParseBindings(t *testing.T) {
+	actions, err := ParseBindings(map[string]string{"x": BindDetach, "ctrl-k": BindKill, "d": BindNone})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actions['x'] != BindDetach || actions[0x0b] != BindKill || len(actions) != 2 {
+		t.Errorf("Unexpected actions: %v", actions)
+	}
+	for _, bindings := range []map[string]string{{"x": "explode"}, {"ctrl-1": BindDetach}, {"xy": BindDetach}} {
+		if _, err := ParseBindings(bindings); err == nil {
+			t.Errorf("ParseBindings(%v) should fail", bindings)
+		}
+	}
+	if _, err := ParseBindings(defaults().Bindings); err != nil {
+		t.Errorf("Default bindings are invalid: %v", err)
+	}
+}
+
+func TestKeyName(t *testing.T) {
+	for _, key := range []string{"x", "[", "ctrl-a", "ctrl-d", "ctrl-z", "ctrl-[", "ctrl-\\", "ctrl-_"} {
+		b, err := parseBindingKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := KeyName(b); got != key {
+			t.Errorf("KeyName(%#x) = %q, want %q", b, got, key)
+		}
+	}
+}
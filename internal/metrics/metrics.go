@@ -0,0 +1,98 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"persishtent/internal/client"
+	"persishtent/internal/protocol"
+	"persishtent/internal/session"
+)
+
+// metric describes a per-session Prometheus metric
+type metric struct {
+	name  string
+	kind  string
+	help  string
+	value func(st protocol.Status, now time.Time) float64
+}
+
+var sessionMetrics = []metric{
+	{"persishtent_session_bytes_in_total", "counter", "Client input written to the session PTY in bytes.",
+		func(st protocol.Status, _ time.Time) float64 { return float64(st.BytesIn) }},
+	{"persishtent_session_bytes_out_total", "counter", "Output read from the session PTY in bytes.",
+		func(st protocol.Status, _ time.Time) float64 { return float64(st.BytesOut) }},
+	{"persishtent_session_log_bytes_total", "counter", "Output written to the session log files in bytes.",
+		func(st protocol.Status, _ time.Time) float64 { return float64(st.LogBytes) }},
+	{"persishtent_session_clients", "gauge", "Number of attached clients.",
+		func(st protocol.Status, _ time.Time) float64 { return float64(st.Clients) }},
+	{"persishtent_session_connects_total", "counter", "Number of clients attached since the session started.",
+		func(st protocol.Status, _ time.Time) float64 { return float64(st.Connects) }},
+	{"persishtent_session_log_rotations_total", "counter", "Number of session log rotations.",
+		func(st protocol.Status, _ time.Time) float64 { return float64(st.Rotations) }},
+	{"persishtent_session_broadcast_stalls_total", "counter", "Writes to a client that took over 100ms because it reads slowly.",
+		func(st protocol.Status, _ time.Time) float64 { return float64(st.Stalls) }},
+	{"persishtent_session_degraded", "gauge", "1 if the daemon can't write the session's log or info file.",
+		func(st protocol.Status, _ time.Time) float64 {
+			if st.Degraded != "" {
+				return 1
+			}
+			return 0
+		}},
+	{"persishtent_session_uptime_seconds", "gauge", "Time since the session was started.",
+		func(st protocol.Status, now time.Time) float64 { return now.Sub(st.Started).Seconds() }},
+}
+
+// Write renders session statuses in the Prometheus text exposition format.
+func Write(w io.Writer, statuses []protocol.Status, now time.Time) error {
+	var b strings.Builder
+	b.WriteString("# HELP persishtent_sessions Number of active sessions.\n")
+	b.WriteString("# TYPE persishtent_sessions gauge\n")
+	fmt.Fprintf(&b, "persishtent_sessions %d\n", len(statuses))
+	for _, m := range sessionMetrics {
+		fmt.Fprintf(&b, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(&b, "# TYPE %s %s\n", m.name, m.kind)
+		for _, st := range statuses {
+			fmt.Fprintf(&b, "%s{session=%q} %g\n", m.name, st.Name, m.value(st, now))
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// collect queries the daemons of all local sessions
+func collect() []protocol.Status {
+	sessions, _ := session.List()
+	var statuses []protocol.Status
+	for _, s := range sessions {
+		if st, err := client.Query(s.Name, ""); err == nil {
+			statuses = append(statuses, st)
+		}
+	}
+	return statuses
+}
+
+// Listen opens the metrics listener. Addresses starting with "unix:" are
+// unix socket paths only the user can connect to, anything else is a TCP
+// host:port.
+func Listen(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		return session.ListenUnix(path)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// Serve exposes session metrics on /metrics until the listener fails.
+func Serve(l net.Listener) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_ = Write(w, collect(), time.Now())
+	})
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	return srv.Serve(l)
+}
@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"persishtent/internal/protocol"
+)
+
+func TestWrite(t *testing.T) {
+	now := time.Now()
+	statuses := []protocol.Status{
+		{Name: "build", Clients: 2, Started: now.Add(-90 * time.Second), BytesIn: 10, BytesOut: 4096, Rotations: 3, Stalls: 1, LogBytes: 2048, Connects: 5, Degraded: "read-only file system"},
+		{Name: "dev", Started: now},
+	}
+	var b strings.Builder
+	if err := Write(&b, statuses, now); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	out := b.String()
+	for _, want := range []string{
+		"persishtent_sessions 2\n",
+		"# TYPE persishtent_session_bytes_out_total counter\n",
+		`persishtent_session_bytes_out_total{session="build"} 4096` + "\n",
+		`persishtent_session_clients{session="build"} 2` + "\n",
+		`persishtent_session_log_bytes_total{session="build"} 2048` + "\n",
+		`persishtent_session_connects_total{session="build"} 5` + "\n",
+		`persishtent_session_log_rotations_total{session="build"} 3` + "\n",
+		`persishtent_session_broadcast_stalls_total{session="build"} 1` + "\n",
+		`persishtent_session_degraded{session="build"} 1` + "\n",
+		`persishtent_session_uptime_seconds{session="build"} 90` + "\n",
+		`persishtent_session_clients{session="dev"} 0` + "\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Output missing %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestListen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.sock")
+	l, err := Listen("unix:" + path)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer func() { _ = l.Close() }()
+	if l.Addr().Network() != "unix" {
+		t.Errorf("Expected unix listener, got %s", l.Addr().Network())
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm()&0077 != 0 {
+		t.Errorf("Expected a socket only the user can use, got %v, %v", fi.Mode(), err)
+	}
+
+	// Other files at the path are left alone
+	file := filepath.Join(t.TempDir(), "metrics")
+	_ = os.WriteFile(file, []byte("data"), 0600)
+	if _, err := Listen("unix:" + file); err == nil {
+		t.Error("Listen should refuse to replace a regular file")
+	}
+	if data, _ := os.ReadFile(file); string(data) != "data" {
+		t.Errorf("Regular file was changed to %q", data)
+	}
+
+	tcp, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer func() { _ = tcp.Close() }()
+	if _, ok := tcp.Addr().(*net.TCPAddr); !ok {
+		t.Errorf("Expected TCP listener, got %s", tcp.Addr())
+	}
+}
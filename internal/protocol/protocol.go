@@ -2,7 +2,12 @@ package protocol
 
 import (
 	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"strconv"
+	"time"
 )
 
 type Type byte
@@ -10,41 +15,281 @@ type Type byte
 const (
 	TypeData   Type = 0x01
 	TypeResize Type = 0x02
+	// TypeSignal comes from the Master, or from a control connection which
+	// gets an empty reply. Control connections follow the signal byte with
+	// who sent it.
 	TypeSignal Type = 0x03
-	TypeKick   Type = 0x04
+	TypeKick   Type = 0x04 // See KickPayload
 	TypeMode   Type = 0x05
 	TypeEnv    Type = 0x06
+	TypeExit   Type = 0x07
+	TypeRename Type = 0x08
+	TypeQuery  Type = 0x09
+	TypeInfo   Type = 0x0A
+	// TypeSuspend stops (payload 1) or continues (payload 0) the session's
+	// processes. The reply carries an error message, or nothing on success.
+	TypeSuspend Type = 0x0B
+	// TypeReload makes the daemon reload the config file. The reply carries an
+	// error message, or nothing on success.
+	TypeReload Type = 0x0C
+	// TypeConfirm asks the Master to confirm input held back because it
+	// matched a guard pattern; the payload is the pattern, or empty when the
+	// request expired. The Master answers with payload 'y' or 'n'.
+	TypeConfirm Type = 0x0D
+	// TypeSecret writes a secret to the PTY without logging the output that
+	// follows. The first payload byte is 1 to skip the echo check, the rest is
+	// the secret. The reply carries an error message, or nothing on success.
+	TypeSecret Type = 0x0E
+	// TypeMeta changes the tags or group of a session. The payload is a JSON
+	// session.MetaChange; the reply carries an error message, or nothing.
+	TypeMeta Type = 0x0F
+	// TypeReplay carries session history, sent to clients that announced
+	// CapReplay before any live output. An empty TypeReplay ends the history.
+	TypeReplay Type = 0x10
+	// TypeRegister makes a daemon write its session info again from memory,
+	// after the state directory was deleted. The reply carries an error
+	// message, or nothing.
+	TypeRegister Type = 0x11
+	// TypePipe starts feeding live output into the shell command in the
+	// payload, or stops it if the payload is empty. The reply carries an
+	// error message, or nothing.
+	TypePipe Type = 0x12
+	// TypeCapture asks for the text on the session's screen. The payload is
+	// the number of history lines to include above it as a uint32, optionally
+	// followed by CaptureRender; the reply carries the lines.
+	TypeCapture Type = 0x13
+	// TypeInput writes the payload to the PTY as typed input, without
+	// attaching. Lines matching a guard pattern are discarded, as there is
+	// nobody to confirm them. The reply carries an error message, or nothing.
+	TypeInput Type = 0x14
+	// TypeRefused turns down a Master attach while another client holds the
+	// session with an exclusive lock. The payload is the reason; the daemon
+	// closes the connection afterwards.
+	TypeRefused Type = 0x15
+	// TypeClients asks for the clients attached to the session; the reply
+	// carries them as a JSON list of ClientInfo. Clients that attach with
+	// CapPeers get the list, themselves included, before any replay.
+	TypeClients Type = 0x16
+	// TypeGrant changes whether a read-only client may type. On a control
+	// connection the payload is a GrantPayload and the reply carries an error
+	// message, or nothing. An empty TypeGrant from the Master revokes write
+	// access from all viewers that have it, or else grants it to the newest
+	// viewer. The daemon tells each affected client, and the Master, with a
+	// TypeGrant whose first byte is 1 if access was granted, followed by the
+	// identity of the affected client for the Master. Without an identity,
+	// the Master had no viewer to grant access to.
+	TypeGrant Type = 0x17
+	// TypePrune removes old output from the session's log files. The payload
+	// is a JSON Prune request. Since rewriting large files takes a while, the
+	// daemon acknowledges it with an empty TypePrune before the reply, a JSON
+	// PruneResult.
+	TypePrune Type = 0x18
+	// TypeDetach detaches the Master, or all clients if the first payload
+	// byte is 1, with a TypeKick naming who asked. The rest of the payload
+	// describes them. The reply carries an error message, or nothing.
+	TypeDetach Type = 0x19
+	// TypePing checks that a client still reads. Clients that announced
+	// CapPing answer with an empty TypePing once they have handled the
+	// packets before it.
+	TypePing Type = 0x1A
+	// TypeResume tells a client that announced CapResume how many bytes of
+	// output the session produced before its live output starts, as a
+	// uint64. It is sent before the replayed history, so a client that lost
+	// its connection can skip the part of the history it already has.
+	TypeResume Type = 0x1B
+	// TypeAck grants a client that announced CapFlow more output credit: the
+	// payload is the number of output bytes it has written to its terminal
+	// since its last TypeAck, as a uint32. See FlowWindow.
+	TypeAck Type = 0x1C
+	// TypeLimit is the daemon's answer to CapLargePayload: the largest
+	// payload either side may send on the connection from now on, as a
+	// uint32. See PayloadLimitPayload.
+	TypeLimit Type = 0x1D
+	// TypeError tells a client why the daemon rejected a packet or request:
+	// an ErrorCode byte followed by the message, see ErrorPayload. Attached
+	// clients that announce CapErrors get it for rejected input or a refused
+	// attach, control clients that send ControlErrors in place of the reply
+	// to a failed request. Other clients never see it.
+	TypeError Type = 0x1E
+	// TypeJoin tells the attached clients that another client attached; the
+	// payload is its ClientInfo as JSON. It is queued after the history of
+	// every client, so clients that don't know it ignore it like any other
+	// unexpected live packet.
+	TypeJoin Type = 0x1F
+	// TypeMessage shows a status message on the attached clients without
+	// writing it to the PTY. On a control connection the payload is a JSON
+	// Message; the daemon passes it on to every attached client in a
+	// TypeMessage of its own, and replies with an error message or nothing.
+	TypeMessage Type = 0x20
+	// TypeShutdown ends the session gracefully. The payload is a JSON
+	// Shutdown; the daemon tells the attached clients why, syncs its log and
+	// sends the shell SIGTERM, then SIGKILL after the timeout. The reply
+	// carries an error message, or nothing; like after TypeSignal, the
+	// control connection ends when the daemon exits.
+	TypeShutdown Type = 0x21
+	// TypeUpgrade hands the session over to another daemon binary. The
+	// payload is a JSON Upgrade; the daemon passes the PTY and its listening
+	// socket to the new binary, which runs in its place with the same PID,
+	// so the shell keeps running. The daemon only replies if the upgrade
+	// failed, with an error message; otherwise the connections of all
+	// clients end, and attached clients reconnect to the new daemon.
+	TypeUpgrade Type = 0x22
+	// TypeMark records a mark in the session's log, which logs -from-mark
+	// starts at. The payload is the mark's name; the reply carries an error
+	// message, or nothing.
+	TypeMark Type = 0x23
 )
 
 const (
 	ModeMaster   byte = 0x00
 	ModeReadOnly byte = 0x01
+	// ModeControl connections manage a session without attaching to it.
+	ModeControl byte = 0x02
 )
 
+// ControlErrors follows ModeControl in the TypeMode payload of control
+// clients that understand TypeError replies. Older daemons ignore it.
+const ControlErrors byte = 0x01
+
+// ErrorCode classifies a TypeError, so clients can react to it without
+// parsing the message.
+type ErrorCode byte
+
+const (
+	ErrorFailed        ErrorCode = iota // The request failed, see the message
+	ErrorProtocol                       // Malformed packet or handshake
+	ErrorUnsupported                    // Request the daemon doesn't know
+	ErrorTooLarge                       // Payload above the connection's limit
+	ErrorInvalidName                    // Invalid session name
+	ErrorSessionExists                  // A session of that name is already running
+	ErrorNoWriteAccess                  // Input from a client without write access
+	ErrorLocked                         // Input or attach while another client holds the exclusive lock
+	ErrorAuth                           // The client's user may not use the session
+	ErrorStateReadOnly                  // The daemon can't write to the state directory
+)
+
+// Caps are the capability flags a client sends after the mode byte in
+// TypeMode. Peers that don't know a capability ignore it.
+type Caps uint16
+
+// Capability flags. The low seven fit into the first capability byte, the
+// others go into a second one, see capMore.
+const (
+	// CapPixels means the client understands TypeResize payloads carrying pixel dimensions.
+	CapPixels Caps = 0x01
+	// CapReplay means the client wants the session history replayed with
+	// TypeReplay. The capability byte is then followed by the number of lines
+	// to replay as a uint32, 0 for all.
+	CapReplay Caps = 0x02
+	// CapExclusive means a Master client locks the session, so other Master
+	// attaches are refused until it detaches.
+	CapExclusive Caps = 0x04
+	// CapIdentity means the TypeMode payload ends with the client's Identity
+	// as JSON, after the replay line count if any.
+	CapIdentity Caps = 0x08
+	// CapPing means the client answers TypePing, so the daemon can detect
+	// and detach a client that stopped reading.
+	CapPing Caps = 0x10
+	// CapResume means the client wants the output offset in TypeResume
+	CapResume Caps = 0x20
+	// CapFlow means the client acknowledges live output with TypeAck. The
+	// daemon stops reading the PTY while all clients have used up their
+	// credit, so the PTY holds back the session's programs.
+	CapFlow Caps = 0x40
+	// CapLargePayload means the client accepts payloads of up to
+	// LargePayloadSize. A daemon that does too answers with TypeLimit before
+	// any larger packet, peers that don't stay at MaxPayloadSize.
+	CapLargePayload Caps = 0x0100
+	// CapErrors means the client understands TypeError, for rejected input
+	// and refused attaches. Others get TypeRefused or nothing.
+	CapErrors Caps = 0x0200
+	// CapPeers means the client wants the attached clients in a TypeClients
+	// packet when it attaches, instead of asking on a control connection.
+	CapPeers Caps = 0x0400
+
+	// capMore in the first capability byte means a second one follows.
+	// ModePayload sets it, it is no capability of its own.
+	capMore Caps = 0x80
+)
+
+// FlowWindow is the output credit of a client with CapFlow: how many bytes of
+// TypeData it may be sent beyond what it acknowledged.
+const FlowWindow = 256 * 1024
+
+// CaptureRender asks TypeCapture for terminal output redrawing the screen,
+// see ansi.Screen.Render, followed by the session's output size as a uint64,
+// the offset in the output up to which it is drawn. The reply is empty if the
+// daemon can't render the screen. Older daemons send the text instead, which
+// never starts with an escape sequence.
+const CaptureRender byte = 1
+
 const (
-	// MaxPayloadSize is the maximum allowed size for a single packet payload (64KB).
+	// MaxPayloadSize is the maximum allowed size for a single packet payload
+	// (64KB), unless both peers agreed on a larger one with CapLargePayload.
 	MaxPayloadSize = 64 * 1024
+	// LargePayloadSize is the payload limit peers with CapLargePayload
+	// support, so fast transports need fewer frames for bulk output.
+	LargePayloadSize = 1024 * 1024
 )
 
-// WritePacket writes a typed packet with a payload to the writer.
+// ErrPayloadTooLarge is matched by a PayloadSizeError with errors.Is
+var ErrPayloadTooLarge = errors.New("packet payload too large")
+
+// PayloadSizeError is returned for a packet whose payload exceeds the limit
+// of the connection, either on write or when the peer sent one.
+type PayloadSizeError struct {
+	Size  uint32
+	Limit int
+}
+
+func (e *PayloadSizeError) Error() string {
+	return fmt.Sprintf("packet payload of %d bytes exceeds the limit of %d bytes", e.Size, e.Limit)
+}
+
+func (e *PayloadSizeError) Is(target error) bool { return target == ErrPayloadTooLarge }
+
+// ErrProtocolVersion is returned when the daemon doesn't answer a request
+// it predates, e.g. one of a newer client to a long-running session.
+var ErrProtocolVersion = errors.New("daemon is too old")
+
+// Error is the error sent in a TypeError packet. Unknown requests match
+// ErrProtocolVersion and oversized packets ErrPayloadTooLarge with errors.Is.
+type Error struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *Error) Error() string { return e.Message }
+
+func (e *Error) Is(target error) bool {
+	switch e.Code {
+	case ErrorUnsupported:
+		return target == ErrProtocolVersion
+	case ErrorTooLarge:
+		return target == ErrPayloadTooLarge
+	}
+	return false
+}
+
+// WritePacket writes a typed packet with a payload to the writer. The packet
+// is written with a single Write, so goroutines sharing a net.Conn never
+// interleave their packets.
 func WritePacket(w io.Writer, t Type, payload []byte) error {
-	if len(payload) > MaxPayloadSize {
-		return io.ErrShortBuffer
+	return WritePacketLimit(w, t, payload, MaxPayloadSize)
+}
+
+// WritePacketLimit writes a packet like WritePacket, to a peer that agreed
+// on payloads of up to limit bytes with TypeLimit.
+func WritePacketLimit(w io.Writer, t Type, payload []byte, limit int) error {
+	if len(payload) > limit {
+		return &PayloadSizeError{Size: uint32(len(payload)), Limit: limit}
 	}
 	// Header: Type (1) + Length (4)
-	header := make([]byte, 5)
-	header[0] = byte(t)
-	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
-	
-	if _, err := w.Write(header); err != nil {
-		return err
-	}
-	if len(payload) > 0 {
-		if _, err := w.Write(payload); err != nil {
-			return err
-		}
-	}
-	return nil
+	frame := make([]byte, 5, 5+len(payload))
+	frame[0] = byte(t)
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+	_, err := w.Write(append(frame, payload...))
+	return err
 }
 
 // ReadPacket reads a packet from the reader.
@@ -58,7 +303,7 @@ func ReadPacket(r io.Reader) (Type, []byte, error) {
 	length := binary.BigEndian.Uint32(header[1:])
 	
 	if length > MaxPayloadSize {
-		return 0, nil, io.ErrUnexpectedEOF
+		return 0, nil, &PayloadSizeError{Size: length, Limit: MaxPayloadSize}
 	}
 
 	payload := make([]byte, length)
@@ -71,6 +316,53 @@ func ReadPacket(r io.Reader) (Type, []byte, error) {
 	return t, payload, nil
 }
 
+// Reader reads packets from a stream into a buffer that is reused for every
+// packet, so hot read loops don't allocate per frame.
+type Reader struct {
+	r      io.Reader
+	header [5]byte
+	buf    []byte
+	limit  int
+}
+
+// NewReader returns a Reader reading packets from r with payloads of up to MaxPayloadSize.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r, limit: MaxPayloadSize}
+}
+
+// SetLimit changes the largest payload accepted, see TypeLimit
+func (r *Reader) SetLimit(limit int) {
+	r.limit = limit
+}
+
+// ReadPacket reads the next packet. The payload is only valid until the next
+// call; callers that keep it must copy it.
+func (r *Reader) ReadPacket() (Type, []byte, error) {
+	if _, err := io.ReadFull(r.r, r.header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	t := Type(r.header[0])
+	length := binary.BigEndian.Uint32(r.header[1:])
+
+	if length > uint32(r.limit) {
+		return 0, nil, &PayloadSizeError{Size: length, Limit: r.limit}
+	}
+
+	if cap(r.buf) < int(length) {
+		// Grow once to the largest frame seen so far
+		r.buf = make([]byte, length)
+	}
+	payload := r.buf[:length]
+	if length > 0 {
+		if _, err := io.ReadFull(r.r, payload); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	return t, payload, nil
+}
+
 // ResizePayload encodes rows and cols into a byte slice.
 func ResizePayload(rows, cols uint16) []byte {
 	buf := make([]byte, 4)
@@ -79,6 +371,302 @@ func ResizePayload(rows, cols uint16) []byte {
 	return buf
 }
 
+// SizePayload encodes rows, cols and the pixel dimensions of the window.
+// The first four bytes match ResizePayload, so peers that only decode rows
+// and cols still understand it.
+func SizePayload(rows, cols, xpixel, ypixel uint16) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint16(buf[0:], rows)
+	binary.BigEndian.PutUint16(buf[2:], cols)
+	binary.BigEndian.PutUint16(buf[4:], xpixel)
+	binary.BigEndian.PutUint16(buf[6:], ypixel)
+	return buf
+}
+
+// DecodeSizePayload decodes a resize payload with optional pixel dimensions.
+// Pixel dimensions are 0 if the payload does not carry them.
+func DecodeSizePayload(data []byte) (rows, cols, xpixel, ypixel uint16) {
+	rows, cols = DecodeResizePayload(data)
+	if len(data) >= 8 {
+		xpixel = binary.BigEndian.Uint16(data[4:])
+		ypixel = binary.BigEndian.Uint16(data[6:])
+	}
+	return rows, cols, xpixel, ypixel
+}
+
+// AckPayload encodes a TypeAck payload granting n bytes of output credit
+func AckPayload(n uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, n)
+}
+
+// DecodeAckPayload decodes a payload created by AckPayload
+func DecodeAckPayload(data []byte) (uint32, bool) {
+	if len(data) != 4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(data), true
+}
+
+// PayloadLimitPayload encodes a TypeLimit payload
+func PayloadLimitPayload(limit int) []byte {
+	return binary.BigEndian.AppendUint32(nil, uint32(limit))
+}
+
+// DecodePayloadLimit decodes a TypeLimit payload. Limits below
+// MaxPayloadSize or above LargePayloadSize are invalid.
+func DecodePayloadLimit(data []byte) (int, bool) {
+	if len(data) != 4 {
+		return 0, false
+	}
+	limit := int(binary.BigEndian.Uint32(data))
+	return limit, limit >= MaxPayloadSize && limit <= LargePayloadSize
+}
+
+// ErrorPayload encodes a TypeError payload
+func ErrorPayload(code ErrorCode, msg string) []byte {
+	return append([]byte{byte(code)}, msg...)
+}
+
+// DecodeErrorPayload decodes a TypeError payload
+func DecodeErrorPayload(data []byte) *Error {
+	if len(data) == 0 {
+		return &Error{Code: ErrorFailed, Message: "daemon reported an error"}
+	}
+	return &Error{Code: ErrorCode(data[0]), Message: string(data[1:])}
+}
+
+// ModePayload encodes a TypeMode payload. tail is only sent with CapReplay.
+func ModePayload(mode byte, caps Caps, tail int) []byte {
+	caps &^= capMore
+	buf := []byte{mode, byte(caps)}
+	if caps > 0xff {
+		buf[1] |= byte(capMore)
+		buf = append(buf, byte(caps>>8))
+	}
+	if caps&CapReplay != 0 {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(max(tail, 0)))
+	}
+	return buf
+}
+
+// AppendIdentity adds id to a TypeMode payload whose caps include CapIdentity
+func AppendIdentity(payload []byte, id Identity) []byte {
+	data, _ := json.Marshal(id)
+	return append(payload, data...)
+}
+
+// DecodeModeIdentity returns the Identity in a TypeMode payload, if the
+// client sent one.
+func DecodeModeIdentity(data []byte) (Identity, bool) {
+	var id Identity
+	_, caps, _, start := decodeMode(data)
+	if caps&CapIdentity == 0 || len(data) <= start {
+		return id, false
+	}
+	return id, json.Unmarshal(data[start:], &id) == nil
+}
+
+// DecodeModePayload decodes a TypeMode payload. Missing fields are zero.
+func DecodeModePayload(data []byte) (mode byte, caps Caps, tail int) {
+	mode, caps, tail, _ = decodeMode(data)
+	return mode, caps, tail
+}
+
+// decodeMode decodes a TypeMode payload and returns where the identity
+// starts.
+func decodeMode(data []byte) (mode byte, caps Caps, tail int, end int) {
+	if len(data) > 0 {
+		mode, end = data[0], 1
+	}
+	if len(data) > 1 {
+		caps, end = Caps(data[1]), 2
+	}
+	if caps&capMore != 0 && len(data) > 2 {
+		caps, end = caps&^capMore|Caps(data[2])<<8, 3
+	}
+	if caps&CapReplay != 0 && len(data) >= end+4 {
+		tail = int(binary.BigEndian.Uint32(data[end:]))
+		end += 4
+	}
+	return mode, caps, tail, end
+}
+
+// ExitPayload encodes a process exit status into a byte slice.
+func ExitPayload(code int) []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, uint32(int32(code)))
+	return buf
+}
+
+// DecodeExitPayload decodes the payload into an exit status.
+func DecodeExitPayload(data []byte) int {
+	if len(data) < 4 {
+		return -1
+	}
+	return int(int32(binary.BigEndian.Uint32(data)))
+}
+
+// Status is the live state of a session as reported by its daemon in reply to TypeQuery.
+type Status struct {
+	Name     string    `json:"name"`
+	PID      int       `json:"pid"`
+	Rows     uint16    `json:"rows"`
+	Cols     uint16    `json:"cols"`
+	Clients  int       `json:"clients"`
+	Master   bool      `json:"master"`
+	Locked   bool      `json:"locked,omitempty"` // The Master holds an exclusive lock
+	Started  time.Time `json:"started"`
+	BytesIn  uint64    `json:"bytes_in"`
+	BytesOut uint64    `json:"bytes_out"`
+	Cwd      string    `json:"cwd,omitempty"`
+	// Rotations counts log rotations, Stalls counts broadcasts held up by a slow client
+	Rotations uint64 `json:"rotations"`
+	Stalls    uint64 `json:"stalls"`
+	// LogBytes counts output written to the log files, Connects the clients
+	// attached since the daemon started
+	LogBytes  uint64 `json:"log_bytes"`
+	Connects  int    `json:"connects"`
+	Suspended bool   `json:"suspended,omitempty"`
+	// Degraded says why the daemon can't write the session's log or info file
+	Degraded string `json:"degraded,omitempty"`
+	// Pipe is the command live output is piped to, if any
+	Pipe string `json:"pipe,omitempty"`
+	// Upgraded is when the daemon last took over the session, see TypeUpgrade
+	Upgraded time.Time `json:"upgraded,omitzero"`
+	// BracketedPaste means the application wants pastes marked, see PasteData
+	BracketedPaste bool `json:"bracketed_paste,omitempty"`
+}
+
+// Identity describes who runs a client, so attached clients can be told apart.
+type Identity struct {
+	User string `json:"user"`
+	Host string `json:"host"`
+	TTY  string `json:"tty,omitempty"`  // Terminal device of the client, e.g. /dev/pts/3
+	PID  int    `json:"pid"`
+	From string `json:"from,omitempty"` // Address the client logged in from over ssh
+	// Term and ColorTerm are TERM and COLORTERM of the client's terminal,
+	// passed on to the shell when it is the session's first master
+	Term      string `json:"term,omitempty"`
+	ColorTerm string `json:"colorterm,omitempty"`
+}
+
+// String describes the client, e.g. "alice@laptop (/dev/pts/3, pid 4242)"
+func (id Identity) String() string {
+	if id.User == "" && id.Host == "" {
+		return "unknown client"
+	}
+	s := id.User + "@" + id.Host + " ("
+	if id.TTY != "" {
+		s += id.TTY + ", "
+	}
+	s += "pid " + strconv.Itoa(id.PID)
+	if id.From != "" {
+		s += ", from " + id.From
+	}
+	return s + ")"
+}
+
+// Short names the user and host of the client, e.g. "alice@laptop"
+func (id Identity) Short() string {
+	if id.User == "" && id.Host == "" {
+		return "unknown client"
+	}
+	return id.User + "@" + id.Host
+}
+
+// ClientInfo is an attached client as listed in reply to TypeClients.
+// Clients predating CapIdentity have an empty Identity.
+type ClientInfo struct {
+	ID int `json:"id"` // Unique within the daemon, for TypeKick
+	Identity
+	ReadOnly bool      `json:"read_only,omitempty"`
+	Writable bool      `json:"writable,omitempty"` // A read-only client granted write access, see TypeGrant
+	Master   bool      `json:"master,omitempty"`
+	Since    time.Time `json:"since"`
+	Rows     uint16    `json:"rows,omitempty"` // Terminal size reported by the client
+	Cols     uint16    `json:"cols,omitempty"`
+}
+
+// KickPayload encodes a request to detach the client with the given ID,
+// sent as TypeKick on a control connection. The daemon passes by on to the
+// client in its own TypeKick, naming who detached it, and replies with an
+// error message or nothing.
+func KickPayload(id int, by string) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(id)), by...)
+}
+
+// DecodeKickPayload decodes a payload created by KickPayload.
+func DecodeKickPayload(data []byte) (id int, by string, ok bool) {
+	if len(data) < 4 {
+		return 0, "", false
+	}
+	return int(binary.BigEndian.Uint32(data)), string(data[4:]), true
+}
+
+// GrantPayload encodes a request to grant or revoke write access of the
+// read-only client with the given ID, sent as TypeGrant on a control
+// connection. by describes who asks, for the audit log.
+func GrantPayload(id int, writable bool, by string) []byte {
+	flag := byte(0)
+	if writable {
+		flag = 1
+	}
+	return append(append(binary.BigEndian.AppendUint32(nil, uint32(id)), flag), by...)
+}
+
+// DecodeGrantPayload decodes a payload created by GrantPayload.
+func DecodeGrantPayload(data []byte) (id int, writable bool, by string, ok bool) {
+	if len(data) < 5 {
+		return 0, false, "", false
+	}
+	return int(binary.BigEndian.Uint32(data)), data[4] == 1, string(data[5:]), true
+}
+
+// Message is a status message for the clients of a session, see TypeMessage.
+type Message struct {
+	Text string `json:"text"`
+	From string `json:"from,omitempty"` // Who sent it, e.g. "alice@laptop"
+}
+
+// Shutdown asks the daemon to end the session, see TypeShutdown.
+type Shutdown struct {
+	Reason  string        `json:"reason,omitempty"`
+	From    string        `json:"from,omitempty"`    // Who asked, e.g. "alice@laptop (pid 4242)"
+	Timeout time.Duration `json:"timeout,omitempty"` // Grace period before SIGKILL, none if 0
+}
+
+// Upgrade asks the daemon to hand the session over, see TypeUpgrade.
+type Upgrade struct {
+	Executable string `json:"executable"` // Absolute path of the new binary
+	From       string `json:"from,omitempty"`
+}
+
+// Prune asks the daemon to remove the oldest output from its log files,
+// keeping at most Keep bytes and nothing from before Before, where set.
+type Prune struct {
+	Keep   int64     `json:"keep,omitempty"`
+	Before time.Time `json:"before,omitempty"`
+}
+
+// PruneResult is the reply to TypePrune.
+type PruneResult struct {
+	Removed int64  `json:"removed"`
+	Error   string `json:"error,omitempty"`
+}
+
+// StatusPayload encodes a session status into a byte slice.
+func StatusPayload(s Status) []byte {
+	data, _ := json.Marshal(s)
+	return data
+}
+
+// DecodeStatusPayload decodes the payload into a session status.
+func DecodeStatusPayload(data []byte) (Status, error) {
+	var s Status
+	err := json.Unmarshal(data, &s)
+	return s, err
+}
+
 // DecodeResizePayload decodes the payload into rows and cols.
 func DecodeResizePayload(data []byte) (uint16, uint16) {
 	if len(data) < 4 {
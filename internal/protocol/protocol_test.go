@@ -2,6 +2,7 @@ package protocol
 
 import (
 	"bytes"
+	"errors"
 	"testing"
 )
 
@@ -27,6 +28,96 @@ func TestPacketSerialization(t *testing.T) {
 	}
 }
 
+func TestReader(t *testing.T) {
+	buf := new(bytes.Buffer)
+	_ = WritePacket(buf, TypeData, []byte("first packet"))
+	_ = WritePacket(buf, TypeKick, nil)
+	_ = WritePacket(buf, TypeData, []byte("second"))
+
+	r := NewReader(buf)
+	want := []struct {
+		typ     Type
+		payload string
+	}{
+		{TypeData, "first packet"},
+		{TypeKick, ""},
+		{TypeData, "second"},
+	}
+	for _, w := range want {
+		typ, payload, err := r.ReadPacket()
+		if err != nil {
+			t.Fatalf("ReadPacket failed: %v", err)
+		}
+		if typ != w.typ || string(payload) != w.payload {
+			t.Errorf("Got %d %q, want %d %q", typ, payload, w.typ, w.payload)
+		}
+	}
+	if _, _, err := r.ReadPacket(); err == nil {
+		t.Error("Expected error at end of stream")
+	}
+
+	// Oversized frames are rejected like with ReadPacket
+	if _, _, err := NewReader(bytes.NewReader([]byte{0x01, 0xff, 0xff, 0xff, 0xff})).ReadPacket(); err == nil {
+		t.Error("Expected error for oversized payload")
+	}
+}
+
+func TestPayloadLimit(t *testing.T) {
+	large := make([]byte, MaxPayloadSize+1)
+	var sizeErr *PayloadSizeError
+	if err := WritePacket(new(bytes.Buffer), TypeData, large); !errors.As(err, &sizeErr) || sizeErr.Limit != MaxPayloadSize {
+		t.Errorf("WritePacket of %d bytes = %v", len(large), err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := WritePacketLimit(buf, TypeData, large, LargePayloadSize); err != nil {
+		t.Fatalf("WritePacketLimit failed: %v", err)
+	}
+	frame := buf.Bytes()
+	if _, _, err := ReadPacket(bytes.NewReader(frame)); !errors.Is(err, ErrPayloadTooLarge) {
+		t.Errorf("ReadPacket above the limit = %v", err)
+	}
+	r := NewReader(bytes.NewReader(frame))
+	r.SetLimit(LargePayloadSize)
+	if _, payload, err := r.ReadPacket(); err != nil || len(payload) != len(large) {
+		t.Errorf("ReadPacket with a larger limit = %d bytes, %v", len(payload), err)
+	}
+
+	if limit, ok := DecodePayloadLimit(PayloadLimitPayload(LargePayloadSize)); !ok || limit != LargePayloadSize {
+		t.Errorf("Decoded %d %v", limit, ok)
+	}
+	for _, limit := range []int{MaxPayloadSize - 1, LargePayloadSize + 1} {
+		if _, ok := DecodePayloadLimit(PayloadLimitPayload(limit)); ok {
+			t.Errorf("Limit %d accepted", limit)
+		}
+	}
+}
+
+func BenchmarkReadPacket(b *testing.B) {
+	frame := new(bytes.Buffer)
+	_ = WritePacket(frame, TypeData, make([]byte, 4096))
+	data := frame.Bytes()
+	src := bytes.NewReader(data)
+
+	b.Run("func", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			src.Reset(data)
+			_, _, _ = ReadPacket(src)
+		}
+	})
+	b.Run("Reader", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+		r := NewReader(src)
+		for i := 0; i < b.N; i++ {
+			src.Reset(data)
+			_, _, _ = r.ReadPacket()
+		}
+	})
+}
+
 func TestResizePayload(t *testing.T) {
 	rows := uint16(24)
 	cols := uint16(80)
@@ -47,6 +138,7 @@ func FuzzReadPacket(f *testing.F) {
 	f.Fuzz(func(t *testing.T, data []byte) {
 		r := bytes.NewReader(data)
 		_, _, _ = ReadPacket(r)
+		_, _, _ = NewReader(bytes.NewReader(data)).ReadPacket()
 	})
 }
 
@@ -56,3 +148,127 @@ func FuzzDecodeResizePayload(f *testing.F) {
 		_, _ = DecodeResizePayload(data)
 	})
 }
+
+func TestExitPayload(t *testing.T) {
+	for _, code := range []int{0, 1, 137, -1} {
+		if got := DecodeExitPayload(ExitPayload(code)); got != code {
+			t.Errorf("Exit decode failed. Got %d, want %d", got, code)
+		}
+	}
+	if got := DecodeExitPayload(nil); got != -1 {
+		t.Errorf("Expected -1 for short payload, got %d", got)
+	}
+}
+
+func TestModePayload(t *testing.T) {
+	mode, caps, tail := DecodeModePayload(ModePayload(ModeReadOnly, CapPixels|CapReplay, 50))
+	if mode != ModeReadOnly || caps != CapPixels|CapReplay || tail != 50 {
+		t.Errorf("Mode decode failed: %d, %d, %d", mode, caps, tail)
+	}
+	if got := ModePayload(ModeMaster, CapPixels, 50); len(got) != 2 {
+		t.Errorf("Tail should only be sent with CapReplay, got %v", got)
+	}
+	// Payloads of clients before capabilities
+	if mode, caps, tail := DecodeModePayload([]byte{ModeMaster}); mode != ModeMaster || caps != 0 || tail != 0 {
+		t.Errorf("Short payload decoded as %d, %d, %d", mode, caps, tail)
+	}
+	// Capabilities beyond the first byte take a second one
+	payload := ModePayload(ModeMaster, CapReplay|CapLargePayload, 7)
+	if len(payload) != 7 || payload[1] != byte(CapReplay|capMore) {
+		t.Errorf("Unexpected payload %v", payload)
+	}
+	if _, caps, tail := DecodeModePayload(payload); caps != CapReplay|CapLargePayload || tail != 7 {
+		t.Errorf("Second capability byte decoded as %#x, %d", caps, tail)
+	}
+}
+
+func TestModeIdentity(t *testing.T) {
+	id := Identity{User: "alice", Host: "laptop", TTY: "/dev/pts/3", PID: 4242, Term: "xterm-kitty", ColorTerm: "truecolor"}
+	for _, caps := range []Caps{CapIdentity, CapIdentity | CapReplay, CapIdentity | CapLargePayload} {
+		payload := AppendIdentity(ModePayload(ModeMaster, caps, 10), id)
+		if got, ok := DecodeModeIdentity(payload); !ok || got != id {
+			t.Errorf("caps %#x: decoded %+v, %v", caps, got, ok)
+		}
+		if _, _, tail := DecodeModePayload(payload); caps&CapReplay != 0 && tail != 10 {
+			t.Errorf("caps %#x: tail decoded as %d", caps, tail)
+		}
+	}
+	if _, ok := DecodeModeIdentity(ModePayload(ModeMaster, CapReplay, 10)); ok {
+		t.Error("Decoded an identity the client didn't send")
+	}
+	if got := id.String(); got != "alice@laptop (/dev/pts/3, pid 4242)" {
+		t.Errorf("String() = %q", got)
+	}
+	id.From = "192.0.2.7"
+	if got := id.String(); got != "alice@laptop (/dev/pts/3, pid 4242, from 192.0.2.7)" {
+		t.Errorf("String() = %q", got)
+	}
+}
+
+func TestKickPayload(t *testing.T) {
+	id, by, ok := DecodeKickPayload(KickPayload(70000, "alice@laptop (pid 1)"))
+	if !ok || id != 70000 || by != "alice@laptop (pid 1)" {
+		t.Errorf("Decoded %d %q %v", id, by, ok)
+	}
+	if _, _, ok := DecodeKickPayload([]byte{1, 2}); ok {
+		t.Error("Decoded a short payload")
+	}
+}
+
+func TestAckPayload(t *testing.T) {
+	if n, ok := DecodeAckPayload(AckPayload(FlowWindow)); !ok || n != FlowWindow {
+		t.Errorf("Decoded %d %v", n, ok)
+	}
+	if _, ok := DecodeAckPayload(nil); ok {
+		t.Error("Decoded an empty payload")
+	}
+}
+
+func TestErrorPayload(t *testing.T) {
+	err := DecodeErrorPayload(ErrorPayload(ErrorTooLarge, "too large"))
+	if err.Code != ErrorTooLarge || err.Error() != "too large" {
+		t.Errorf("Decoded %+v", err)
+	}
+	if !errors.Is(err, ErrPayloadTooLarge) || errors.Is(err, ErrProtocolVersion) {
+		t.Errorf("%v matches the wrong errors", err)
+	}
+	if !errors.Is(&Error{Code: ErrorUnsupported}, ErrProtocolVersion) {
+		t.Error("Unknown requests should match ErrProtocolVersion")
+	}
+	if err := DecodeErrorPayload(nil); err.Code != ErrorFailed || err.Message == "" {
+		t.Errorf("Decoded an empty payload as %+v", err)
+	}
+}
+
+func TestStatusPayload(t *testing.T) {
+	want := Status{Name: "dev", PID: 42, Rows: 24, Cols: 80, Clients: 2, Master: true, BytesIn: 10, BytesOut: 2048, Cwd: "/tmp"}
+	got, err := DecodeStatusPayload(StatusPayload(want))
+	if err != nil {
+		t.Fatalf("DecodeStatusPayload failed: %v", err)
+	}
+	if got != want {
+		t.Errorf("Status decode mismatch. Got %+v, want %+v", got, want)
+	}
+	if _, err := DecodeStatusPayload([]byte("garbage")); err == nil {
+		t.Error("Expected error for malformed payload")
+	}
+}
+
+func TestSizePayload(t *testing.T) {
+	payload := SizePayload(24, 80, 640, 384)
+	rows, cols, x, y := DecodeSizePayload(payload)
+	if rows != 24 || cols != 80 || x != 640 || y != 384 {
+		t.Errorf("Size decode failed. Got %d,%d,%d,%d", rows, cols, x, y)
+	}
+
+	// Peers decoding only rows and cols still understand the extended payload
+	if rows, cols := DecodeResizePayload(payload); rows != 24 || cols != 80 {
+		t.Errorf("Legacy decode failed. Got %d,%d", rows, cols)
+	}
+
+	// Legacy payloads carry no pixel dimensions
+	_, _, x, y = DecodeSizePayload(ResizePayload(24, 80))
+	if x != 0 || y != 0 {
+		t.Errorf("Expected no pixels for legacy payload, got %d,%d", x, y)
+	}
+}
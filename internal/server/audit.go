@@ -0,0 +1,33 @@
+package server
+
+import (
+	"persishtent/internal/config"
+	"persishtent/internal/protocol"
+	"persishtent/internal/session"
+)
+
+// audit records an event of the session in the audit log, unless audit_log
+// is off. Must be called with s.Lock held.
+func (s *Server) audit(e session.AuditEvent) {
+	if !config.Current().AuditLog {
+		return
+	}
+	e.Session = s.Name
+	if err := session.AppendAudit(e); err != nil {
+		errorf("audit log not written: %v", err)
+	}
+}
+
+// auditClient records an event concerning the attached client c.
+// Must be called with s.Lock held.
+func (s *Server) auditClient(event string, c protocol.ClientInfo, by string) {
+	s.audit(session.AuditEvent{Event: event, Client: c.Identity.String(), Mode: clientMode(c), By: by})
+}
+
+// clientMode describes how c is attached, for the audit log.
+func clientMode(c protocol.ClientInfo) string {
+	if c.ReadOnly {
+		return "read-only"
+	}
+	return "master"
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// castRecorder writes session output as an asciicast v2 recording. Idle gaps
+// longer than maxPause are shortened to maxPause, and every shortened gap is
+// followed by a marker event holding the wall-clock time, so the recording
+// stays short to replay but can still be correlated to real time.
+type castRecorder struct {
+	mu       sync.Mutex
+	f        *os.File
+	w        *bufio.Writer
+	maxPause time.Duration
+	start    time.Time
+	last     time.Time
+	skipped  time.Duration // Idle time cut from the recording so far
+	partial  []byte        // Incomplete UTF-8 sequence held for the next event
+	now      func() time.Time
+}
+
+type castHeader struct {
+	Version   int               `json:"version"`
+	Width     uint16            `json:"width"`
+	Height    uint16            `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+func newCastRecorder(path, title, shell, term string, cols, rows uint16, maxPause time.Duration) (*castRecorder, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	r := &castRecorder{f: f, w: bufio.NewWriter(f), maxPause: maxPause, now: time.Now}
+	r.start = r.now()
+	r.last = r.start
+
+	if cols == 0 || rows == 0 {
+		cols, rows = 80, 24
+	}
+	header, _ := json.Marshal(castHeader{
+		Version:   2,
+		Width:     cols,
+		Height:    rows,
+		Timestamp: r.start.Unix(),
+		Title:     title,
+		Env:       map[string]string{"SHELL": shell, "TERM": term},
+	})
+	_, _ = r.w.Write(append(header, '\n'))
+	return r, nil
+}
+
+// resumeCastRecorder continues the recording at path where another daemon
+// of the session left it, with the timing state returned by position.
+func resumeCastRecorder(path string, start, last time.Time, skipped, maxPause time.Duration) (*castRecorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &castRecorder{f: f, w: bufio.NewWriter(f), maxPause: maxPause, start: start, last: last, skipped: skipped, now: time.Now}, nil
+}
+
+// position returns the timing state of the recording, see resumeCastRecorder
+func (r *castRecorder) position() (start, last time.Time, skipped time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.start, r.last, r.skipped
+}
+
+// output records data written by the PTY
+func (r *castRecorder) output(data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	data = append(r.partial, data...)
+	data, r.partial = splitIncompleteUTF8(data)
+	if len(data) > 0 {
+		r.event("o", string(data))
+	}
+}
+
+// resize records a change of the PTY size
+func (r *castRecorder) resize(cols, rows uint16) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.event("r", fmt.Sprintf("%dx%d", cols, rows))
+}
+
+// event writes a single event. Must be called with mu held.
+func (r *castRecorder) event(kind, data string) {
+	now := r.now()
+	gap := now.Sub(r.last)
+	r.last = now
+	compressed := r.maxPause > 0 && gap > r.maxPause
+	if compressed {
+		r.skipped += gap - r.maxPause
+	}
+	t := now.Sub(r.start) - r.skipped
+
+	if compressed {
+		r.writeEvent(t, "m", now.Format(time.RFC3339))
+	}
+	r.writeEvent(t, kind, data)
+	_ = r.w.Flush()
+}
+
+func (r *castRecorder) writeEvent(t time.Duration, kind, data string) {
+	line, _ := json.Marshal([]any{t.Seconds(), kind, data})
+	_, _ = r.w.Write(append(line, '\n'))
+}
+
+func (r *castRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_ = r.w.Flush()
+	return r.f.Close()
+}
+
+// splitIncompleteUTF8 splits off a trailing incomplete UTF-8 sequence so
+// multi-byte characters are not broken across events.
+func splitIncompleteUTF8(p []byte) ([]byte, []byte) {
+	for i := len(p) - 1; i >= 0 && i >= len(p)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(p[i]) {
+			if !utf8.FullRune(p[i:]) {
+				return p[:i], append([]byte(nil), p[i:]...)
+			}
+			break
+		}
+	}
+	return p, nil
+}
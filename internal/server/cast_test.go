@@ -0,0 +1,77 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCastRecorder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.cast")
+	r, err := newCastRecorder(path, "test", "/bin/bash", "xterm-256color", 100, 30, 2*time.Second)
+	if err != nil {
+		t.Fatalf("newCastRecorder failed: %v", err)
+	}
+
+	clock := r.start
+	r.now = func() time.Time { return clock }
+
+	clock = clock.Add(1 * time.Second)
+	r.output([]byte("hello "))
+	// A long idle gap is shortened to the maximum pause
+	clock = clock.Add(1 * time.Hour)
+	r.output([]byte("w\xc3")) // Incomplete UTF-8 sequence
+	clock = clock.Add(500 * time.Millisecond)
+	r.output([]byte("\xa9rld"))
+	r.resize(120, 40)
+	_ = r.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+	scanner := bufio.NewScanner(f)
+
+	scanner.Scan()
+	var header castHeader
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		t.Fatalf("Bad header: %v", err)
+	}
+	if header.Version != 2 || header.Width != 100 || header.Height != 30 {
+		t.Errorf("Unexpected header %+v", header)
+	}
+
+	type event struct {
+		t    float64
+		kind string
+		data string
+	}
+	var events []event
+	for scanner.Scan() {
+		var raw []any
+		if err := json.Unmarshal(scanner.Bytes(), &raw); err != nil {
+			t.Fatalf("Bad event %s: %v", scanner.Text(), err)
+		}
+		events = append(events, event{raw[0].(float64), raw[1].(string), raw[2].(string)})
+	}
+
+	want := []event{
+		{1, "o", "hello "},
+		{3, "m", clock.Add(-500 * time.Millisecond).Format(time.RFC3339)},
+		{3, "o", "w"},
+		{3.5, "o", "érld"},
+		{3.5, "r", "120x40"},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("Got %d events, want %d: %+v", len(events), len(want), events)
+	}
+	for i := range want {
+		if events[i] != want[i] {
+			t.Errorf("Event %d = %+v, want %+v", i, events[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"persishtent/internal/config"
+	"persishtent/internal/session"
+)
+
+// maxRecentLines is the number of internal log lines kept for crash reports.
+const maxRecentLines = 100
+
+// recentLog keeps the most recent internal daemon events in memory so they
+// can be included in a crash report.
+var recentLog = &lineRing{max: maxRecentLines}
+
+type lineRing struct {
+	mu    sync.Mutex
+	lines []string
+	max   int
+}
+
+func (r *lineRing) add(line string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lines = append(r.lines, line)
+	if len(r.lines) > r.max {
+		r.lines = r.lines[len(r.lines)-r.max:]
+	}
+}
+
+func (r *lineRing) snapshot() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.lines...)
+}
+
+// logf records an internal daemon event.
+func logf(format string, args ...any) {
+	logEvent(config.DebugLogInfo, fmt.Sprintf(format, args...))
+}
+
+// recoverCrash must be deferred at the top of every daemon goroutine. On panic
+// it writes a crash report, marks the session as crashed and exits, since a
+// daemon in an unknown state cannot keep serving the session.
+func recoverCrash(name string) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	errorf("daemon crashed: %v", r)
+	_ = writeCrashReport(name, r, debug.Stack())
+	if info, err := session.ReadInfo(name); err == nil {
+		info.State = session.StateCrashed
+		_ = session.WriteInfo(info)
+	}
+	os.Exit(2)
+}
+
+// writeCrashReport writes the panic value, stack trace, recent internal log
+// lines and an environment summary to the session's .crash file.
+func writeCrashReport(name string, r any, stack []byte) error {
+	path, err := session.GetCrashPath(name)
+	if err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "session: %s\n", name)
+	fmt.Fprintf(&b, "time: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(&b, "panic: %v\n\n", r)
+
+	b.WriteString("== stack ==\n")
+	b.Write(stack)
+
+	b.WriteString("\n== recent log ==\n")
+	for _, line := range recentLog.snapshot() {
+		b.WriteString(line + "\n")
+	}
+
+	b.WriteString("\n== environment ==\n")
+	exe, _ := os.Executable()
+	fmt.Fprintf(&b, "pid: %d\n", os.Getpid())
+	fmt.Fprintf(&b, "executable: %s\n", exe)
+	fmt.Fprintf(&b, "args: %q\n", os.Args)
+	fmt.Fprintf(&b, "go: %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	fmt.Fprintf(&b, "goroutines: %d\n", runtime.NumGoroutine())
+	for _, key := range []string{"SHELL", "TERM", "HOME", "USER"} {
+		fmt.Fprintf(&b, "%s=%s\n", key, os.Getenv(key))
+	}
+
+	return os.WriteFile(path, []byte(b.String()), 0600)
+}
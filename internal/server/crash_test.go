@@ -0,0 +1,42 @@
+package server
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"persishtent/internal/session"
+)
+
+func TestLineRing(t *testing.T) {
+	r := &lineRing{max: 3}
+	for _, l := range []string{"a", "b", "c", "d"} {
+		r.add(l)
+	}
+	got := strings.Join(r.snapshot(), ",")
+	if got != "b,c,d" {
+		t.Errorf("Expected oldest line to be dropped, got %s", got)
+	}
+}
+
+func TestWriteCrashReport(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("PERSISHTENT_DIR", t.TempDir())
+
+	logf("before crash %d", 42)
+	if err := writeCrashReport("crashy", "boom", []byte("goroutine 1 [running]:")); err != nil {
+		t.Fatalf("writeCrashReport failed: %v", err)
+	}
+
+	path, _ := session.GetCrashPath("crashy")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Crash report not written: %v", err)
+	}
+	report := string(data)
+	for _, want := range []string{"panic: boom", "goroutine 1 [running]:", "before crash 42", "== environment =="} {
+		if !strings.Contains(report, want) {
+			t.Errorf("Crash report missing %q", want)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"persishtent/internal/config"
+	"persishtent/internal/session"
+)
+
+// maxDebugLogSize is the size at which the debug log moves to its .1 file
+const maxDebugLogSize = 1024 * 1024
+
+// maxPendingEvents bounds the events waiting to be written, beyond which
+// further ones are dropped
+const maxPendingEvents = 1000
+
+// debugLog writes the daemon's events to the session's debug log, see
+// session.DebugEvent. Nothing is written until Run names the session, so
+// tests and other processes using this package leave no files behind.
+var debugLog = &eventLog{wake: make(chan struct{}, 1)}
+
+// eventLog queues events and writes them in the background, as they are
+// often logged with s.Lock held.
+type eventLog struct {
+	mu      sync.Mutex // Guards name and pending
+	name    string
+	pending []session.DebugEvent
+	wake    chan struct{}
+	start   sync.Once
+	file    sync.Mutex // Held while writing or moving the log file
+}
+
+// setName starts writing to the debug log of session name, or stops if it
+// is empty. Events queued so far are written to the previous name first.
+func (l *eventLog) setName(name string) {
+	l.file.Lock()
+	defer l.file.Unlock()
+	l.writePending()
+	l.mu.Lock()
+	l.name = name
+	l.mu.Unlock()
+	if name != "" {
+		l.start.Do(func() { go l.run() })
+	}
+}
+
+// write queues msg for the debug log if debug_log includes level. The log
+// is best effort, failures to write it are ignored.
+func (l *eventLog) write(level, msg string) {
+	if slices.Index(config.DebugLogLevels, level) > slices.Index(config.DebugLogLevels, config.Current().DebugLog) {
+		return
+	}
+	l.mu.Lock()
+	if l.name == "" || len(l.pending) >= maxPendingEvents {
+		l.mu.Unlock()
+		return
+	}
+	l.pending = append(l.pending, session.DebugEvent{Time: time.Now(), Level: level, PID: os.Getpid(), Message: msg})
+	l.mu.Unlock()
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run writes queued events until the process exits
+func (l *eventLog) run() {
+	for range l.wake {
+		l.flush()
+	}
+}
+
+// flush writes the queued events, e.g. before the daemon exits
+func (l *eventLog) flush() {
+	l.file.Lock()
+	defer l.file.Unlock()
+	l.writePending()
+}
+
+// writePending writes the queued events. Must be called with l.file held.
+func (l *eventLog) writePending() {
+	l.mu.Lock()
+	name, events := l.name, l.pending
+	l.pending = nil
+	l.mu.Unlock()
+	if name == "" {
+		return
+	}
+	for _, e := range events {
+		_ = session.AppendDebugLog(name, e, maxDebugLogSize)
+	}
+}
+
+// rename moves the debug log along with a renamed session
+func (l *eventLog) rename(newName string) {
+	l.file.Lock()
+	defer l.file.Unlock()
+	l.writePending()
+	l.mu.Lock()
+	oldName := l.name
+	l.mu.Unlock()
+	if oldName == "" {
+		return
+	}
+	// Events queued meanwhile go to the moved log
+	_ = session.RenameDebugLog(oldName, newName)
+	l.mu.Lock()
+	l.name = newName
+	l.mu.Unlock()
+}
+
+// errorf records a failure of the daemon
+func errorf(format string, args ...any) {
+	logEvent(config.DebugLogError, fmt.Sprintf(format, args...))
+}
+
+// debugf records a detail only worth keeping while debugging, e.g. each resize
+func debugf(format string, args ...any) {
+	logEvent(config.DebugLogDebug, fmt.Sprintf(format, args...))
+}
+
+// logEvent keeps msg for crash reports and writes it to the debug log
+func logEvent(level, msg string) {
+	recentLog.add(time.Now().Format("15:04:05.000") + " " + msg)
+	debugLog.write(level, msg)
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"testing"
+
+	"persishtent/internal/config"
+	"persishtent/internal/session"
+)
+
+func TestDebugLog(t *testing.T) {
+	t.Setenv("PERSISHTENT_DIR", t.TempDir())
+	defer config.Use(*config.Current())
+	defer debugLog.setName("")
+
+	// Nothing is written before the daemon names its session
+	logf("unnamed")
+	debugLog.setName("dbg")
+	config.Update(func(c *config.Config) { c.DebugLog = config.DebugLogInfo })
+	logf("client connected")
+	errorf("log rotation failed")
+	debugf("terminal resized")
+	config.Update(func(c *config.Config) { c.DebugLog = config.DebugLogOff })
+	errorf("not recorded")
+	debugLog.flush()
+
+	events, err := session.ReadDebugLog("dbg")
+	if err != nil || len(events) != 2 {
+		t.Fatalf("Expected 2 events, got %+v, %v", events, err)
+	}
+	if events[0].Level != config.DebugLogInfo || events[0].Message != "client connected" || events[1].Level != config.DebugLogError || events[0].PID == 0 {
+		t.Errorf("Unexpected events: %+v", events)
+	}
+
+	// The log follows a renamed session
+	config.Update(func(c *config.Config) { c.DebugLog = config.DebugLogDebug })
+	debugLog.rename("renamed")
+	debugf("terminal resized")
+	debugLog.flush()
+	if events, _ := session.ReadDebugLog("renamed"); len(events) != 3 || events[2].Level != config.DebugLogDebug {
+		t.Errorf("Unexpected events after the rename: %+v", events)
+	}
+}
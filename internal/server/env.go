@@ -0,0 +1,188 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"persishtent/internal/config"
+	"persishtent/internal/session"
+)
+
+// forwardedEnv keeps the shell's view of forwarded environment variables
+// current across reconnects. Path values (agent sockets, credential caches)
+// are exposed through stable symlinks that are retargeted on every attach;
+// all values are also exported to an env file that shell integration sources
+// before each prompt.
+type forwardedEnv struct {
+	mu    sync.Mutex
+	name  string
+	file  string
+	links map[string]string // key -> symlink path
+	vals  map[string]string // key -> value as seen by the shell
+}
+
+func newForwardedEnv(name string) *forwardedEnv {
+	file, _ := session.GetEnvFilePath(name)
+	return &forwardedEnv{
+		name:  name,
+		file:  file,
+		links: make(map[string]string),
+		vals:  make(map[string]string),
+	}
+}
+
+// StartEnvVar carries the variables given with start -e to a new daemon.
+// Unlike arguments, the environment of a process is only readable by its
+// owner, and the values may be secrets.
+const StartEnvVar = "PERSISHTENT_START_ENV"
+
+// EncodeStartEnv returns the StartEnvVar value for KEY=value pairs
+func EncodeStartEnv(env []string) string {
+	data, _ := json.Marshal(env)
+	return string(data)
+}
+
+// TakeStartEnv returns the variables passed in StartEnvVar and removes it,
+// so the shell doesn't inherit it.
+func TakeStartEnv() ([]string, error) {
+	value, ok := os.LookupEnv(StartEnvVar)
+	if !ok {
+		return nil, nil
+	}
+	_ = os.Unsetenv(StartEnvVar)
+	var env []string
+	if err := json.Unmarshal([]byte(value), &env); err != nil {
+		return nil, fmt.Errorf("%s: %w", StartEnvVar, err)
+	}
+	return env, nil
+}
+
+// envNames returns the names of KEY=value pairs, which can be recorded
+// without their values
+func envNames(env []string) []string {
+	if len(env) == 0 {
+		return nil
+	}
+	names := make([]string, len(env))
+	for i, kv := range env {
+		names[i], _, _ = strings.Cut(kv, "=")
+	}
+	return names
+}
+
+// isForwardedEnv reports whether key is in the forward_env allowlist
+func isForwardedEnv(key string) bool {
+	return slices.Contains(config.Current().ForwardEnv, key)
+}
+
+// splitPathValue splits values like "/tmp/agent.1" or "FILE:/tmp/krb5cc"
+// into a prefix and an absolute path. ok is false for non-path values.
+func splitPathValue(value string) (prefix, path string, ok bool) {
+	path = value
+	if strings.HasPrefix(value, "FILE:") {
+		prefix, path = "FILE:", value[len("FILE:"):]
+	}
+	return prefix, path, filepath.IsAbs(path)
+}
+
+// set records a new value for key, retargeting its symlink if the value is
+// a path, and rewrites the env file. Keys outside the allowlist are ignored.
+func (e *forwardedEnv) set(key, value string) {
+	if !isForwardedEnv(key) {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if prefix, path, ok := splitPathValue(value); ok {
+		link, exists := e.links[key]
+		if !exists {
+			var err error
+			link, err = session.GetEnvLinkPath(e.name, key)
+			if err != nil {
+				return
+			}
+			e.links[key] = link
+		}
+		_ = os.Remove(link)
+		_ = os.Symlink(path, link)
+		value = prefix + link
+	}
+	e.vals[key] = value
+	e.writeFile()
+}
+
+// export records a value for key whether or not it is forwarded, for
+// variables the daemon itself sets, and rewrites the env file.
+func (e *forwardedEnv) export(key, value string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.vals[key] = value
+	e.writeFile()
+}
+
+// writeFile exports all values in a form that can be sourced by sh-like shells
+func (e *forwardedEnv) writeFile() {
+	keys := make([]string, 0, len(e.vals))
+	for k := range e.vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "export %s='%s'\n", k, strings.ReplaceAll(e.vals[k], "'", `'\''`))
+	}
+	_ = os.WriteFile(e.file, []byte(b.String()), 0600)
+}
+
+// environ returns the forwarded variables as KEY=value pairs for the shell
+func (e *forwardedEnv) environ() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	env := make([]string, 0, len(e.vals)+1)
+	for k, v := range e.vals {
+		env = append(env, k+"="+v)
+	}
+	return append(env, "PERSISHTENT_ENV_FILE="+e.file)
+}
+
+// values returns a copy of the key -> value map as seen by the shell
+func (e *forwardedEnv) values() map[string]string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return maps.Clone(e.vals)
+}
+
+// restore takes over the values and symlinks of another daemon of the
+// session, see values and linkPaths
+func (e *forwardedEnv) restore(vals, links map[string]string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	maps.Copy(e.vals, vals)
+	maps.Copy(e.links, links)
+}
+
+// linkPaths returns a copy of the key -> symlink map for the session info
+func (e *forwardedEnv) linkPaths() map[string]string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return maps.Clone(e.links)
+}
+
+// remove deletes the env file and all symlinks
+func (e *forwardedEnv) remove() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_ = os.Remove(e.file)
+	for _, link := range e.links {
+		_ = os.Remove(link)
+	}
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"persishtent/internal/config"
+)
+
+func TestSplitPathValue(t *testing.T) {
+	tests := []struct {
+		value, prefix, path string
+		ok                  bool
+	}{
+		{"/tmp/ssh-x/agent.1", "", "/tmp/ssh-x/agent.1", true},
+		{"FILE:/tmp/krb5cc_1000", "FILE:", "/tmp/krb5cc_1000", true},
+		{":0", "", ":0", false},
+		{"wayland-0", "", "wayland-0", false},
+	}
+	for _, tt := range tests {
+		prefix, path, ok := splitPathValue(tt.value)
+		if prefix != tt.prefix || path != tt.path || ok != tt.ok {
+			t.Errorf("splitPathValue(%q) = %q, %q, %v", tt.value, prefix, path, ok)
+		}
+	}
+}
+
+func TestForwardedEnv(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("PERSISHTENT_DIR", t.TempDir())
+	saved := config.Current().ForwardEnv
+	config.Update(func(c *config.Config) { c.ForwardEnv = []string{"SSH_AUTH_SOCK", "DISPLAY", "KRB5CCNAME"} })
+	defer config.Update(func(c *config.Config) { c.ForwardEnv = saved })
+
+	env := newForwardedEnv("envtest")
+	defer env.remove()
+
+	env.set("SSH_AUTH_SOCK", "/tmp/agent.1")
+	env.set("KRB5CCNAME", "FILE:/tmp/krb5cc")
+	env.set("DISPLAY", ":0")
+	env.set("EDITOR", "vi") // Not in the allowlist
+
+	link := env.links["SSH_AUTH_SOCK"]
+	if target, err := os.Readlink(link); err != nil || target != "/tmp/agent.1" {
+		t.Fatalf("Unexpected agent symlink target %q (%v)", target, err)
+	}
+
+	// A new client retargets the existing symlink
+	env.set("SSH_AUTH_SOCK", "/tmp/agent.2")
+	if env.links["SSH_AUTH_SOCK"] != link {
+		t.Error("Symlink path changed on update")
+	}
+	if target, _ := os.Readlink(link); target != "/tmp/agent.2" {
+		t.Errorf("Symlink not retargeted, points to %q", target)
+	}
+
+	data, err := os.ReadFile(env.file)
+	if err != nil {
+		t.Fatalf("Env file not written: %v", err)
+	}
+	content := string(data)
+	for _, want := range []string{
+		"export DISPLAY=':0'\n",
+		"export KRB5CCNAME='FILE:" + env.links["KRB5CCNAME"] + "'\n",
+		"export SSH_AUTH_SOCK='" + link + "'\n",
+	} {
+		if !strings.Contains(content, want) {
+			t.Errorf("Env file missing %q:\n%s", want, content)
+		}
+	}
+	if strings.Contains(content, "EDITOR") {
+		t.Error("Variable outside the allowlist was forwarded")
+	}
+
+	env.remove()
+	if _, err := os.Lstat(link); !os.IsNotExist(err) {
+		t.Error("Symlink not removed")
+	}
+}
+
+func TestStartEnv(t *testing.T) {
+	env := []string{"TOKEN=s3cret", "DSN=host=db user=app"}
+	t.Setenv(StartEnvVar, EncodeStartEnv(env))
+	got, err := TakeStartEnv()
+	if err != nil || strings.Join(got, "|") != strings.Join(env, "|") {
+		t.Errorf("TakeStartEnv() = %q, %v", got, err)
+	}
+	// The shell must not inherit the values a second time
+	if _, ok := os.LookupEnv(StartEnvVar); ok {
+		t.Errorf("%s left in the environment", StartEnvVar)
+	}
+	if got, err := TakeStartEnv(); got != nil || err != nil {
+		t.Errorf("TakeStartEnv() without variables = %q, %v", got, err)
+	}
+	if got := strings.Join(envNames(env), ","); got != "TOKEN,DSN" {
+		t.Errorf("envNames = %q", got)
+	}
+}
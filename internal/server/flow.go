@@ -0,0 +1,126 @@
+package server
+
+import (
+	"net"
+	"time"
+
+	"persishtent/internal/config"
+	"persishtent/internal/protocol"
+	"persishtent/internal/session"
+)
+
+// flowRecheck is how often a blocked output loop checks the credit of the
+// clients again, in case it missed a wakeup.
+const flowRecheck = time.Second
+
+// flowControl holds the output credit of the clients that announced
+// CapFlow, see protocol.FlowWindow. Guarded by Server.Lock.
+type flowControl struct {
+	credit   map[net.Conn]int64 // Output bytes each client may still be sent
+	released bool               // The shell exited, the PTY is read regardless
+	wake     chan struct{}      // Signals the output loop that credit changed
+}
+
+// addFlowClient gives conn its initial credit. Must be called with s.Lock held.
+func (s *Server) addFlowClient(conn net.Conn) {
+	if s.flow.credit == nil {
+		s.flow.credit = make(map[net.Conn]int64)
+	}
+	s.flow.credit[conn] = protocol.FlowWindow
+}
+
+// removeFlowClient forgets conn, which may unblock the output loop. Must be
+// called with s.Lock held.
+func (s *Server) removeFlowClient(conn net.Conn) {
+	if _, ok := s.flow.credit[conn]; ok {
+		delete(s.flow.credit, conn)
+		s.wakeOutput()
+	}
+}
+
+// ack adds the credit granted by a TypeAck payload
+func (s *Server) ack(conn net.Conn, payload []byte) {
+	n, ok := protocol.DecodeAckPayload(payload)
+	if !ok {
+		return
+	}
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	if credit, ok := s.flow.credit[conn]; ok {
+		s.flow.credit[conn] = min(credit+int64(n), protocol.FlowWindow)
+		s.wakeOutput()
+	}
+}
+
+// wakeOutput signals the output loop without blocking. Must be called with s.Lock held.
+func (s *Server) wakeOutput() {
+	if s.flow.wake == nil {
+		return
+	}
+	select {
+	case s.flow.wake <- struct{}{}:
+	default:
+	}
+}
+
+// saturated reports whether output must wait: there are clients, all of
+// them use flow control and none has credit left. Clients without CapFlow
+// are handled by slow_client_policy instead. Must be called with s.Lock held.
+func (s *Server) saturated() bool {
+	if s.flow.released || len(s.Clients) == 0 {
+		return false
+	}
+	for conn := range s.Clients {
+		if credit, ok := s.flow.credit[conn]; !ok || credit > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// waitForCredit blocks the output loop while all clients are saturated, so
+// the PTY's buffer fills up and holds back the programs writing to it. Like
+// a write, a client that doesn't acknowledge its output within
+// client_write_timeout seconds is disconnected.
+func (s *Server) waitForCredit() {
+	s.Lock.Lock()
+	if s.flow.wake == nil {
+		s.flow.wake = make(chan struct{}, 1)
+	}
+	wake := s.flow.wake
+	s.Lock.Unlock()
+
+	var since time.Time
+	for {
+		s.Lock.Lock()
+		if !s.saturated() {
+			s.Lock.Unlock()
+			return
+		}
+		timeout := time.Duration(config.Current().ClientWriteTimeout * float64(time.Second))
+		if since.IsZero() {
+			since = time.Now()
+		} else if timeout > 0 && time.Since(since) > timeout {
+			for conn := range s.Clients {
+				c := s.attached[conn]
+				logf("client %s stopped acknowledging output, disconnecting", c.Identity)
+				s.audit(session.AuditEvent{Event: session.AuditKick, Client: c.Identity.String(), Mode: clientMode(c), Detail: "not acknowledging output"})
+				s.dropClient(conn)
+			}
+		}
+		s.Lock.Unlock()
+		select {
+		case <-wake:
+		case <-time.After(flowRecheck):
+		}
+	}
+}
+
+// releaseFlow stops flow control for good, so the output loop drains the
+// PTY after the shell exited.
+func (s *Server) releaseFlow() {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	s.flow.released = true
+	s.wakeOutput()
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"persishtent/internal/config"
+	"persishtent/internal/protocol"
+)
+
+// flowServer returns a server with an attached client that announced
+// CapFlow and whose output is read and discarded.
+func flowServer(t *testing.T) (*Server, net.Conn) {
+	srv := &Server{Clients: make(map[net.Conn]struct{})}
+	s1, c1 := net.Pipe()
+	t.Cleanup(func() {
+		_ = s1.Close()
+		_ = c1.Close()
+	})
+	go func() { _, _ = io.Copy(io.Discard, c1) }()
+	srv.Lock.Lock()
+	srv.addClient(s1)
+	srv.addFlowClient(s1)
+	srv.Lock.Unlock()
+	return srv, s1
+}
+
+func waited(srv *Server, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		srv.waitForCredit()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func TestFlowControl(t *testing.T) {
+	srv, conn := flowServer(t)
+	srv.broadcast(make([]byte, protocol.FlowWindow-1))
+	if !waited(srv, time.Second) {
+		t.Fatal("Output blocked before the window was used up")
+	}
+
+	srv.broadcast([]byte("x"))
+	done := make(chan struct{})
+	go func() {
+		srv.waitForCredit()
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Output went on without credit")
+	case <-time.After(100 * time.Millisecond):
+	}
+	srv.ack(conn, protocol.AckPayload(1024))
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("An acknowledgement didn't unblock the output")
+	}
+
+	// A client without flow control keeps the output going
+	srv.broadcast(make([]byte, 1024))
+	s2, c2 := net.Pipe()
+	defer func() { _ = c2.Close() }()
+	go func() { _, _ = io.Copy(io.Discard, c2) }()
+	srv.Lock.Lock()
+	srv.addClient(s2)
+	srv.Lock.Unlock()
+	if !waited(srv, time.Second) {
+		t.Error("Output blocked by clients without flow control")
+	}
+	srv.Lock.Lock()
+	srv.removeClient(s2)
+	blocked := srv.saturated()
+	srv.Lock.Unlock()
+	if !blocked {
+		t.Error("Expected the flow client to be saturated again")
+	}
+
+	srv.releaseFlow()
+	if !waited(srv, time.Second) {
+		t.Error("Output blocked after the shell exited")
+	}
+}
+
+func TestFlowControl_Timeout(t *testing.T) {
+	defer config.Use(*config.Current())
+	config.Update(func(c *config.Config) { c.ClientWriteTimeout = 0.1 })
+	srv, conn := flowServer(t)
+	srv.broadcast(make([]byte, protocol.FlowWindow))
+	if !waited(srv, 3*time.Second) {
+		t.Fatal("A client that never acknowledges blocked the output")
+	}
+	srv.Lock.Lock()
+	_, attached := srv.Clients[conn]
+	srv.Lock.Unlock()
+	if attached {
+		t.Error("The client should be disconnected")
+	}
+}
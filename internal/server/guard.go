@@ -0,0 +1,155 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"regexp"
+	"time"
+
+	"persishtent/internal/config"
+	"persishtent/internal/protocol"
+)
+
+// guardTimeout is how long held input waits for the Master's confirmation.
+// Clients that don't know TypeConfirm never answer, so their input expires.
+const guardTimeout = 30 * time.Second
+
+// killLine is the terminal's line kill character (Ctrl+U). It is sent instead
+// of rejected input so the shell doesn't keep the typed command.
+const killLine = 0x15
+
+// guard tracks the line typed by the Master and holds it back if it matches
+// one of the configured guard_patterns. Line tracking is best effort: input
+// edited with cursor keys or history isn't reconstructed, so this is a safety
+// net against slips, not a security boundary.
+type guard struct {
+	line  []byte
+	held  []byte      // Input waiting for confirmation
+	owner net.Conn    // Master that has to confirm
+	timer *time.Timer // Expires held input
+}
+
+// matchGuard returns the first guard pattern matching line, or "".
+func matchGuard(line []byte) string {
+	for _, pattern := range config.Current().GuardPatterns {
+		re, err := regexp.Compile(pattern)
+		if err == nil && re.Match(line) {
+			return pattern
+		}
+	}
+	return ""
+}
+
+// guardInput returns the part of Master input that can be written to the PTY
+// right away. If a line ending in data matches a guard pattern, the rest of
+// data from the Enter on is held back and the Master is asked to confirm it.
+// While input is held, further input is dropped.
+// Must be called with s.Lock held.
+func (s *Server) guardInput(conn net.Conn, ptmx *os.File, data []byte) []byte {
+	g := &s.guard
+	if g.held != nil {
+		return nil
+	}
+	if len(config.Current().GuardPatterns) == 0 {
+		return data
+	}
+	for i, b := range data {
+		switch b {
+		case '\r', '\n':
+			pattern := matchGuard(g.line)
+			g.line = g.line[:0]
+			if pattern == "" {
+				continue
+			}
+			g.held = append([]byte(nil), data[i:]...)
+			g.owner = conn
+			g.timer = time.AfterFunc(guardTimeout, func() {
+				s.Lock.Lock()
+				if s.guard.owner != conn {
+					s.Lock.Unlock()
+					return
+				}
+				logf("guarded input expired")
+				out := s.resolveGuard(false)
+				s.send(conn, protocol.TypeConfirm, nil)
+				s.Lock.Unlock()
+				_, _ = ptmx.Write(out)
+			})
+			logf("holding input matching guard pattern %q", pattern)
+			s.send(conn, protocol.TypeConfirm, []byte(pattern))
+			return data[:i]
+		case 0x7f, 0x08:
+			if len(g.line) > 0 {
+				g.line = g.line[:len(g.line)-1]
+			}
+		case 0x03, killLine:
+			g.line = g.line[:0]
+		default:
+			g.line = append(g.line, b)
+		}
+	}
+	return data
+}
+
+// controlInput writes input from a control connection to the PTY, as if the
+// Master typed it. Lines matching a guard pattern are replaced by a line kill
+// right away, since a control connection can't confirm them. Input is refused
+// while a Master holds an exclusive lock.
+func (s *Server) controlInput(conn net.Conn, data []byte) error {
+	s.Lock.Lock()
+	if err := s.lockedOut(conn); err != nil {
+		s.Lock.Unlock()
+		return err
+	}
+	if s.guard.held != nil {
+		s.Lock.Unlock()
+		return errors.New("input held for confirmation by the attached client, discarded")
+	}
+	out := s.guardInput(conn, s.ptmx, data)
+	var err error
+	if s.guard.owner == conn {
+		out = append(out, s.resolveGuard(false)...)
+		err = errors.New("input matches a guard pattern, discarded")
+	}
+	s.Lock.Unlock()
+	if s.ptmx == nil {
+		return errors.New("session has no terminal")
+	}
+	if _, werr := s.ptmx.Write(out); werr != nil {
+		return werr
+	}
+	s.bytesIn.Add(uint64(len(out)))
+	s.lastInput.Store(time.Now().UnixNano())
+	return err
+}
+
+// confirmGuard handles the Master's answer to a TypeConfirm request and
+// returns the input to write to the PTY.
+// Must be called with s.Lock held.
+func (s *Server) confirmGuard(conn net.Conn, answer []byte) []byte {
+	if s.guard.owner != conn {
+		return nil
+	}
+	ok := len(answer) > 0 && answer[0] == 'y'
+	logf("guarded input confirmed: %v", ok)
+	return s.resolveGuard(ok)
+}
+
+// resolveGuard ends a confirmation request. It returns the held input if it
+// is to be forwarded, or a line kill that clears the rejected command. The
+// caller writes it to the PTY after releasing s.Lock, since the write may block.
+// Must be called with s.Lock held.
+func (s *Server) resolveGuard(forward bool) []byte {
+	g := &s.guard
+	if g.owner == nil {
+		return nil
+	}
+	out := []byte{killLine}
+	if forward {
+		out = g.held
+	}
+	g.timer.Stop()
+	g.held, g.owner, g.timer = nil, nil, nil
+	return out
+}
@@ -1,15 +1,20 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"strconv"
 	"sync"
+	"time"
 
 	"persishtent/internal/config"
 	"persishtent/internal/session"
 )
 
+// maxPendingLog caps the output kept in memory while the log can't be written.
+const maxPendingLog = 256 * 1024
+
 // LogRotator handles writing to a log file with size-based rotation.
 type LogRotator struct {
 	name        string
@@ -18,7 +23,18 @@ type LogRotator struct {
 	size        int64
 	maxSize     int64
 	maxFiles    int
+	rotations   uint64
+	written     uint64 // Bytes written to the log files, see Written
 	mu          sync.Mutex
+
+	// Integrity markers of the active file, nil if log_integrity_kb is 0
+	index    *session.IndexWriter
+	interval int64
+
+	// While writes fail (e.g. read-only remount, full quota) output is kept
+	// in pending until Retry succeeds
+	failure error
+	pending []byte
 }
 
 // NewLogRotator creates a new LogRotator.
@@ -28,57 +44,349 @@ func NewLogRotator(name string, path string) (*LogRotator, error) {
 		return nil, err
 	}
 
-	maxSize := int64(config.Global.LogRotationSizeMB) * 1024 * 1024
-	if maxSize <= 0 {
-		maxSize = 1024 * 1024 // Fallback to 1MB
+	l := &LogRotator{
+		name:        name,
+		basePath:    path,
+		currentFile: f,
+		interval:    int64(config.Current().LogIntegrityKB) * 1024,
 	}
+	l.SetLimits(config.Current().LogRotationSizeMB, config.Current().MaxLogRotations)
+	l.openIndex(0)
+	return l, nil
+}
 
-	return &LogRotator{
+// ResumeLogRotator continues the log at path where another daemon of the
+// session left it, see Checkpoint. The counters start from rotations and
+// written.
+func ResumeLogRotator(name string, path string, rotations, written uint64) (*LogRotator, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	var size int64
+	if fi, err := f.Stat(); err == nil {
+		size = fi.Size()
+	}
+
+	l := &LogRotator{
 		name:        name,
 		basePath:    path,
 		currentFile: f,
-		maxSize:     maxSize,
-		maxFiles:    config.Global.MaxLogRotations,
-	}, nil
+		size:        size,
+		rotations:   rotations,
+		written:     written,
+		interval:    int64(config.Current().LogIntegrityKB) * 1024,
+	}
+	l.SetLimits(config.Current().LogRotationSizeMB, config.Current().MaxLogRotations)
+	l.openIndex(size)
+	return l, nil
+}
+
+// SetLimits changes the rotation size and the number of rotated files kept.
+// The new limits apply from the next write on.
+func (l *LogRotator) SetLimits(sizeMB int, maxFiles int) {
+	maxSize := int64(sizeMB) * 1024 * 1024
+	if maxSize <= 0 {
+		maxSize = 1024 * 1024 // Fallback to 1MB
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.maxSize = maxSize
+	l.maxFiles = maxFiles
 }
 
 // Write implements io.Writer. It writes data to the log file, rotating if necessary.
+// If the file can't be written, data is kept in memory instead and Write
+// doesn't fail; see Err and Retry.
 func (l *LogRotator) Write(p []byte) (n int, err error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
+	if l.failure != nil {
+		l.buffer(p)
+		return len(p), nil
+	}
+
 	if l.size+int64(len(p)) > l.maxSize {
-		if err := l.rotate(); err != nil {
-			// If rotation fails, log to stderr but continue writing to current file
-			// to avoid data loss.
-			fmt.Fprintf(os.Stderr, "Log rotation failed: %v\n", err)
+		if _, err := l.rotate(); err != nil {
+			// If rotation fails, keep writing to the current file to avoid
+			// data loss
+			errorf("log rotation failed: %v", err)
+		} else {
+			l.rotations++
+			logf("log rotated at %d bytes", l.maxSize)
 		}
 	}
 
 	n, err = l.currentFile.Write(p)
-	if err == nil {
-		l.size += int64(n)
+	l.size += int64(n)
+	l.written += uint64(n)
+	_ = l.index.Add(p[:n])
+	if err != nil {
+		l.failure = err
+		l.buffer(p[n:])
+	}
+	return len(p), nil
+}
+
+// buffer keeps the most recent maxPendingLog bytes of unwritten output.
+func (l *LogRotator) buffer(p []byte) {
+	l.pending = append(l.pending, p...)
+	if len(l.pending) > maxPendingLog {
+		l.pending = append([]byte(nil), l.pending[len(l.pending)-maxPendingLog:]...)
+	}
+}
+
+// Err returns the error that keeps output from being written to the log, or
+// nil if the log is healthy.
+func (l *LogRotator) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.failure
+}
+
+// Pending returns a copy of the output not yet written to the log.
+func (l *LogRotator) Pending() []byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]byte(nil), l.pending...)
+}
+
+// Retry reopens the log after a failed write and appends the output kept in
+// memory meanwhile. It returns the error still preventing writes, if any.
+func (l *LogRotator) Retry() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.failure == nil {
+		return nil
+	}
+
+	// The old file may be gone or closed by a failed rotation
+	f, err := os.OpenFile(l.basePath, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0600)
+	if err != nil {
+		l.failure = err
+		return err
+	}
+	var offset int64
+	if fi, err := f.Stat(); err == nil {
+		offset = fi.Size()
+	}
+	_ = l.index.Close()
+	l.openIndex(offset)
+	n, err := f.Write(l.pending)
+	l.written += uint64(n)
+	_ = l.index.Add(l.pending[:n])
+	l.pending = l.pending[n:]
+	if err != nil {
+		_ = f.Close()
+		l.failure = err
+		return err
 	}
-	return n, err
+
+	_ = l.currentFile.Close()
+	l.currentFile = f
+	l.size = offset + int64(n)
+	l.failure = nil
+	l.pending = nil
+	return nil
+}
+
+// Path returns the path of the active log file.
+func (l *LogRotator) Path() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.basePath
+}
+
+// Rotations returns the number of log rotations performed so far.
+func (l *LogRotator) Rotations() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rotations
+}
+
+// Written returns the number of bytes written to the log files so far,
+// including output kept in memory while writes failed once it is flushed.
+func (l *LogRotator) Written() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.written
 }
 
-// Close closes the underlying file.
+// Mark records a mark named name in the index of the active log file, at
+// the end of the output written so far. See session.LogMark.
+func (l *LogRotator) Mark(name string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.failure != nil {
+		return l.failure
+	}
+	return l.index.Mark(name)
+}
+
+// Rename moves the active and rotated log files to basePath for session name.
+// The active file stays open, so writes continue uninterrupted.
+func (l *LogRotator) Rename(name string, basePath string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	files, err := session.GetLogFiles(l.name)
+	if err != nil {
+		return err
+	}
+	prefix := l.basePath + "."
+	for _, f := range files {
+		if len(f) > len(prefix) && f[:len(prefix)] == prefix {
+			if err := os.Rename(f, basePath+f[len(l.basePath):]); err != nil {
+				return err
+			}
+		}
+	}
+	if err := os.Rename(l.basePath, basePath); err != nil {
+		return err
+	}
+	l.name = name
+	l.basePath = basePath
+	return nil
+}
+
+// Prune removes the oldest output from the log files, keeping at most keep
+// bytes if keep is above 0, and none of the output written before before if
+// it isn't zero. The active file is rotated first if it has to be cut.
+// Cuts fall on line boundaries, so slightly less may be removed. It returns
+// the number of bytes removed, including files rotation dropped. Only the
+// rotation holds up writes; rotated files are rewritten meanwhile.
+func (l *LogRotator) Prune(keep int64, before time.Time) (int64, error) {
+	l.mu.Lock()
+	if l.failure != nil {
+		l.mu.Unlock()
+		return 0, l.failure
+	}
+	var removed int64
+	active := keep > 0 && l.size > keep
+	if !before.IsZero() {
+		// Without markers, only rotated files can be told apart by time
+		active = active || session.SeekTime(l.basePath, before) > 0
+	}
+	if active {
+		dropped, err := l.rotate()
+		if err != nil {
+			l.mu.Unlock()
+			return 0, err
+		}
+		removed += dropped
+		l.rotations++
+	}
+	files, err := session.GetLogFiles(l.name)
+	basePath, kept := l.basePath, l.size
+	l.mu.Unlock()
+	if err != nil {
+		return removed, err
+	}
+
+	for i := len(files) - 1; i >= 0; i-- {
+		path := files[i]
+		if path == basePath {
+			continue
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		var cut int64
+		if keep > 0 {
+			cut = fi.Size() - max(keep-kept, 0)
+		}
+		if !before.IsZero() {
+			if fi.ModTime().Before(before) {
+				cut = fi.Size()
+			} else {
+				cut = max(cut, session.SeekTime(path, before))
+			}
+		}
+		n, err := session.TrimLog(path, cut)
+		if errors.Is(err, os.ErrNotExist) {
+			// Dropped by a rotation meanwhile
+			continue
+		}
+		if err != nil {
+			return removed, err
+		}
+		removed += n
+		kept += fi.Size() - n
+	}
+	return removed, nil
+}
+
+// Reopen starts a new active log file if the current one was deleted, so that
+// output reaches the disk again. Output written to the deleted file is lost.
+func (l *LogRotator) Reopen() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := os.Stat(l.basePath); err == nil {
+		return nil
+	}
+	_ = l.currentFile.Close()
+	_ = l.index.Close()
+	l.index = nil
+	return l.reopen()
+}
+
+// Sync writes the output kept in memory after a failed write, if it can,
+// and commits the active file to disk.
+func (l *LogRotator) Sync() error {
+	if err := l.Retry(); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.currentFile.Sync()
+}
+
+// Checkpoint writes the output kept in memory after a failed write, and the
+// integrity marker of the output not covered by one yet, so that another
+// daemon can continue the log with ResumeLogRotator.
+func (l *LogRotator) Checkpoint() error {
+	if err := l.Retry(); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.index.Flush()
+}
+
+// Close closes the underlying file, completing its integrity index.
 func (l *LogRotator) Close() error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	_ = l.index.Close()
+	l.index = nil
 	return l.currentFile.Close()
 }
 
-// rotate performs the log rotation.
-func (l *LogRotator) rotate() error {
+// openIndex starts the integrity index of the active file for output
+// written from offset on. Without an index the log is still written.
+func (l *LogRotator) openIndex(offset int64) {
+	index, err := session.OpenIndex(l.basePath, l.interval, offset)
+	if err != nil {
+		errorf("log integrity index failed: %v", err)
+	}
+	l.index = index
+}
+
+// rotate performs the log rotation. It returns the size of the oldest file
+// if it was removed to stay within maxFiles.
+func (l *LogRotator) rotate() (int64, error) {
 	_ = l.currentFile.Close()
+	_ = l.index.Close()
+	l.index = nil
 
 	// Find highest index
 	files, err := session.GetLogFiles(l.name)
 	if err != nil {
 		// Try to reopen if getting files fails
 		_ = l.reopen()
-		return err
+		return 0, err
 	}
 
 	maxIdx := 0
@@ -97,8 +405,9 @@ func (l *LogRotator) rotate() error {
 	newName := fmt.Sprintf("%s.%d", l.basePath, nextIdx)
 	if err := os.Rename(l.basePath, newName); err != nil {
 		_ = l.reopen()
-		return err
+		return 0, err
 	}
+	_ = os.Rename(session.IndexPath(l.basePath), session.IndexPath(newName))
 
 	// Cleanup old rotations if limit exceeded
 	// Get files again or use our list (files was sorted oldest to newest by session.GetLogFiles)
@@ -121,6 +430,7 @@ func (l *LogRotator) rotate() error {
 	// `session.go` check was: `if len(files) >= session.MaxLogRotations { remove(files[0]) }`
 	// `files` included active log. So `MaxLogRotations` acts as "Total Log Files Retention".
 	
+	var dropped int64
 	if len(files) >= l.maxFiles {
 		// files[0] is the oldest
 		// Ensure we don't delete what we just renamed if maxFiles is 1?
@@ -128,12 +438,13 @@ func (l *LogRotator) rotate() error {
 		// active log is usually last in `files`.
 		toRemove := files[0]
 		// Sanity check: don't remove current active log path (though it should be renamed by now)
-		if toRemove != l.basePath {
-			_ = os.Remove(toRemove)
+		if fi, err := os.Stat(toRemove); err == nil && toRemove != l.basePath && os.Remove(toRemove) == nil {
+			dropped = fi.Size()
+			_ = os.Remove(session.IndexPath(toRemove))
 		}
 	}
 
-	return l.reopen()
+	return dropped, l.reopen()
 }
 
 func (l *LogRotator) reopen() error {
@@ -147,6 +458,7 @@ func (l *LogRotator) reopen() error {
 	if err == nil {
 		l.currentFile = f
 		l.size = 0
+		l.openIndex(0)
 	}
 	return err
 }
\ No newline at end of file
@@ -3,7 +3,9 @@ package server
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"persishtent/internal/config"
 	"persishtent/internal/session"
@@ -15,7 +17,7 @@ func TestLogRotator(t *testing.T) {
 	
 	// Mock config
 	// We want small size for testing
-	config.Global.LogRotationSizeMB = 0 // Will fallback to 1MB logic in constructor...
+	config.Update(func(c *config.Config) { c.LogRotationSizeMB = 0 }) // Will fallback to 1MB logic in constructor...
 	// Wait, constructor does: if maxSize <= 0 { maxSize = 1MB }
 	// We want SMALLER for test.
 	// But constructor uses config directly.
@@ -27,11 +29,14 @@ func TestLogRotator(t *testing.T) {
 	// We can set `LogRotationSizeMB` to 1, write 1MB?
 	// That's 1024*1024 bytes. Fast enough.
 	
-	config.Global.LogRotationSizeMB = 1
-	config.Global.MaxLogRotations = 3
+	config.Update(func(c *config.Config) {
+		c.LogRotationSizeMB = 1
+		c.MaxLogRotations = 3
+	})
 
 	// Need to ensure session directory is mocked too because GetLogFiles uses EnsureDir uses HOME.
 	t.Setenv("HOME", tmpDir)
+	t.Setenv("PERSISHTENT_DIR", filepath.Join(tmpDir, ".persishtent"))
 	
 	sessionName := "rotator_test"
 	// We need to ensure the session directory exists
@@ -109,4 +114,241 @@ func TestLogRotator(t *testing.T) {
 	if len(files) > 3 {
 		t.Errorf("Expected max 3 files, got %d: %v", len(files), files)
 	}
+	if got, want := logger.Written(), uint64(1024+3*(1024*1024)+2); got != want {
+		t.Errorf("Expected %d bytes written, got %d", want, got)
+	}
+}
+
+func TestLogRotator_Rename(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("PERSISHTENT_DIR", t.TempDir())
+	dir, err := session.EnsureDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldPath := filepath.Join(dir, "before.log")
+	_ = os.WriteFile(oldPath+".1", []byte("rotated"), 0600)
+	rotator, err := NewLogRotator("before", oldPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = rotator.Close() }()
+	_, _ = rotator.Write([]byte("first "))
+
+	newPath := filepath.Join(dir, "after.log")
+	if err := rotator.Rename("after", newPath); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	_, _ = rotator.Write([]byte("second"))
+
+	if _, err := os.Stat(oldPath); !os.IsNotExist(err) {
+		t.Error("Old active log still exists")
+	}
+	if _, err := os.Stat(newPath + ".1"); err != nil {
+		t.Error("Rotated log was not moved")
+	}
+	content, _ := os.ReadFile(newPath)
+	if string(content) != "first second" {
+		t.Errorf("Writes did not continue into renamed log, got %q", content)
+	}
+	if rotator.Path() != newPath {
+		t.Errorf("Path not updated, got %s", rotator.Path())
+	}
+}
+
+func TestLogRotator_Reopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reopen.log")
+	rotator, err := NewLogRotator("reopen", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = rotator.Close() }()
+	_, _ = rotator.Write([]byte("lost "))
+
+	_ = os.Remove(path)
+	if err := rotator.Reopen(); err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	_, _ = rotator.Write([]byte("kept"))
+	if content, _ := os.ReadFile(path); string(content) != "kept" {
+		t.Errorf("Writes did not continue into a new log, got %q", content)
+	}
+	if err := rotator.Reopen(); err != nil {
+		t.Errorf("Reopen of an existing log failed: %v", err)
+	}
+}
+
+func TestLogRotator_Failure(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "failing.log")
+	l, err := NewLogRotator("failing", logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+
+	if _, err := l.Write([]byte("before ")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes fail, as they would after a read-only remount
+	_ = l.currentFile.Close()
+	if _, err := l.Write([]byte("during ")); err != nil {
+		t.Errorf("Write should keep failing output in memory, got %v", err)
+	}
+	if l.Err() == nil {
+		t.Fatal("Expected the failure to be reported")
+	}
+	if got := string(l.Pending()); got != "during " {
+		t.Errorf("Pending = %q, want %q", got, "during ")
+	}
+
+	// Once the file can be opened again the buffered output is appended
+	if err := l.Retry(); err != nil {
+		t.Fatalf("Retry failed: %v", err)
+	}
+	if _, err := l.Write([]byte("after")); err != nil {
+		t.Fatal(err)
+	}
+	if l.Err() != nil || len(l.Pending()) != 0 {
+		t.Errorf("Expected a healthy log, got %v with %d pending bytes", l.Err(), len(l.Pending()))
+	}
+	data, _ := os.ReadFile(logPath)
+	if string(data) != "before during after" {
+		t.Errorf("Log = %q", data)
+	}
+}
+
+func TestLogRotatorIntegrity(t *testing.T) {
+	tmpDir := t.TempDir()
+	t.Setenv("HOME", tmpDir)
+	t.Setenv("PERSISHTENT_DIR", filepath.Join(tmpDir, ".persishtent"))
+	dir, err := session.EnsureDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := *config.Current()
+	t.Cleanup(func() { config.Use(old) })
+	config.Update(func(c *config.Config) {
+		c.LogIntegrityKB = 1
+		c.MaxLogRotations = 5
+	})
+
+	logPath := filepath.Join(dir, "integrity.log")
+	logger, err := NewLogRotator("integrity", logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := []byte(strings.Repeat("x", 1023) + "\n")
+	for i := 0; i < 3; i++ {
+		_, _ = logger.Write(line)
+	}
+	_, _ = logger.Write([]byte("partial"))
+
+	// Rotation completes the index and moves it along with the file
+	logger.mu.Lock()
+	_, err = logger.rotate()
+	logger.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check, err := session.VerifyLog(logPath + ".1")
+	if err != nil || !check.OK() || check.Markers != 4 || check.Unindexed != 0 {
+		t.Errorf("Unexpected check of rotated file %+v, %v", check, err)
+	}
+
+	_, _ = logger.Write([]byte("new"))
+	if err := logger.Mark("deploy"); err != nil {
+		t.Fatal(err)
+	}
+	_ = logger.Close()
+	if check, _ := session.VerifyLog(logPath); !check.OK() || check.Markers != 1 {
+		t.Errorf("Unexpected check of active file %+v", check)
+	}
+	if marks, _ := session.ReadMarks(logPath); len(marks) != 1 || marks[0].Offset != 3 {
+		t.Errorf("Unexpected marks of active file %+v", marks)
+	}
+}
+
+func TestLogRotatorPrune(t *testing.T) {
+	tmpDir := t.TempDir()
+	t.Setenv("HOME", tmpDir)
+	t.Setenv("PERSISHTENT_DIR", filepath.Join(tmpDir, ".persishtent"))
+	dir, err := session.EnsureDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := *config.Current()
+	t.Cleanup(func() { config.Use(old) })
+	config.Update(func(c *config.Config) {
+		c.LogIntegrityKB = 1
+		c.MaxLogRotations = 5
+	})
+
+	logPath := filepath.Join(dir, "prune.log")
+	logger, err := NewLogRotator("prune", logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = logger.Close() }()
+	line := []byte(strings.Repeat("x", 1023) + "\n")
+	for i := 0; i < 4; i++ {
+		_, _ = logger.Write(line)
+	}
+	logger.mu.Lock()
+	_, _ = logger.rotate()
+	logger.mu.Unlock()
+	for i := 0; i < 3; i++ {
+		_, _ = logger.Write(line)
+	}
+
+	// The active file is rotated, and the oldest output is cut at chunks
+	removed, err := logger.Prune(2500, time.Time{})
+	if err != nil || removed != 5*1024 {
+		t.Fatalf("Prune removed %d, %v", removed, err)
+	}
+	files, _ := session.GetLogFiles("prune")
+	var kept int64
+	for _, f := range files {
+		fi, _ := os.Stat(f)
+		kept += fi.Size()
+		if check, _ := session.VerifyLog(f); !check.OK() {
+			t.Errorf("Unexpected check of %s after prune %+v", f, check)
+		}
+	}
+	if kept != 2*1024 {
+		t.Errorf("Expected 2 KiB kept, got %d in %v", kept, files)
+	}
+
+	// Output is still logged afterwards
+	_, _ = logger.Write([]byte("new\n"))
+	if data, _ := os.ReadFile(logPath); string(data) != "new\n" {
+		t.Errorf("Unexpected active file %q", data)
+	}
+
+	// Everything written before now goes
+	if removed, err := logger.Prune(0, time.Now().Add(time.Second)); err != nil || removed != 2*1024 {
+		t.Errorf("Prune before removed %d, %v", removed, err)
+	}
+
+	// Files the rotation drops to stay within max_log_rotations count too
+	logger.mu.Lock()
+	logger.maxFiles = 1
+	logger.mu.Unlock()
+	for i := 0; i < 4; i++ {
+		_, _ = logger.Write(line)
+	}
+	logger.mu.Lock()
+	_, _ = logger.rotate()
+	logger.mu.Unlock()
+	_, _ = logger.Write(line)
+	var total int64
+	files, _ = session.GetLogFiles("prune")
+	for _, f := range files {
+		fi, _ := os.Stat(f)
+		total += fi.Size()
+	}
+	if removed, err := logger.Prune(512, time.Time{}); err != nil || removed != total {
+		t.Errorf("Prune with rotation removed %d of %d, %v", removed, total, err)
+	}
 }
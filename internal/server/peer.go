@@ -0,0 +1,44 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"persishtent/internal/protocol"
+	"persishtent/internal/session"
+)
+
+// identify returns who is at the other end of conn. The user, process and
+// terminal come from the kernel where it can tell, so a client can't make
+// the audit log name someone else. Other connections, e.g. net.Pipe in
+// tests, keep the identity the client reported.
+func identify(conn net.Conn, reported protocol.Identity) protocol.Identity {
+	id, ok := peerIdentity(conn)
+	if !ok {
+		return reported
+	}
+	id.Term, id.ColorTerm = reported.Term, reported.ColorTerm
+	return id
+}
+
+// sender describes who sent a request on conn, instead of the description
+// the client sent along with it where the kernel can tell.
+func sender(conn net.Conn, reported string) string {
+	if id, ok := peerIdentity(conn); ok {
+		return id.String()
+	}
+	return reported
+}
+
+// authorize returns why the client on conn may not use the session, or nil.
+// Only the session's user and root may, where the kernel can tell who the
+// client is; the socket's permissions already keep others out, unless they
+// were changed.
+func authorize(conn net.Conn) error {
+	uid, ok := peerUID(conn)
+	if !ok || uid == os.Getuid() || uid == 0 {
+		return nil
+	}
+	return &protocol.Error{Code: protocol.ErrorAuth, Message: fmt.Sprintf("%v, uid %d may not use it", session.ErrNotOwner, uid)}
+}
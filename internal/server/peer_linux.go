@@ -0,0 +1,75 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"persishtent/internal/protocol"
+	"persishtent/internal/session"
+)
+
+// peerIdentity identifies the process at the other end of the Unix socket
+// conn by the credentials the kernel recorded when it connected. Its
+// terminal and ssh origin are looked up in /proc, as far as it is readable.
+func peerIdentity(conn net.Conn) (protocol.Identity, bool) {
+	cred, ok := peerCred(conn)
+	if !ok {
+		return protocol.Identity{}, false
+	}
+
+	id := protocol.Identity{User: "uid " + strconv.Itoa(int(cred.Uid)), Host: session.Hostname(), PID: int(cred.Pid)}
+	if u, err := user.LookupId(strconv.Itoa(int(cred.Uid))); err == nil {
+		id.User = u.Username
+	}
+	proc := "/proc/" + strconv.Itoa(id.PID)
+	if tty, err := os.Readlink(proc + "/fd/0"); err == nil && strings.HasPrefix(tty, "/dev/") {
+		id.TTY = tty
+	}
+	if environ, err := os.ReadFile(proc + "/environ"); err == nil {
+		for _, kv := range bytes.Split(environ, []byte{0}) {
+			// SSH_CONNECTION is "client-ip client-port server-ip server-port"
+			if v, ok := bytes.CutPrefix(kv, []byte("SSH_CONNECTION=")); ok {
+				if fields := strings.Fields(string(v)); len(fields) > 0 {
+					id.From = fields[0]
+				}
+			}
+		}
+	}
+	return id, true
+}
+
+// peerUID returns the user ID of the process at the other end of conn
+func peerUID(conn net.Conn) (int, bool) {
+	cred, ok := peerCred(conn)
+	if !ok {
+		return 0, false
+	}
+	return int(cred.Uid), true
+}
+
+// peerCred returns the credentials the kernel recorded when the process at
+// the other end of the Unix socket conn connected.
+func peerCred(conn net.Conn) (*unix.Ucred, bool) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, false
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return nil, false
+	}
+	var cred *unix.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil || credErr != nil {
+		return nil, false
+	}
+	return cred, true
+}
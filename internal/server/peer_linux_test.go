@@ -0,0 +1,55 @@
+package server
+
+import (
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"testing"
+
+	"persishtent/internal/protocol"
+)
+
+func TestIdentify_PeerCredentials(t *testing.T) {
+	l, err := net.Listen("unix", filepath.Join(t.TempDir(), "s"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+	c, err := net.Dial("unix", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	// What the client claims gives way to what the kernel knows
+	id := identify(conn, protocol.Identity{User: "mallory", Host: "elsewhere", PID: 1, Term: "xterm"})
+	u, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.User != u.Username || id.PID != os.Getpid() || id.Term != "xterm" {
+		t.Errorf("identify = %+v, want user %s and pid %d", id, u.Username, os.Getpid())
+	}
+	if by := sender(conn, "mallory@elsewhere (pid 1)"); by != id.String() {
+		t.Errorf("sender = %q, want %q", by, id.String())
+	}
+	if uid, ok := peerUID(conn); !ok || uid != os.Getuid() {
+		t.Errorf("peerUID = %d, %v, want %d", uid, ok, os.Getuid())
+	}
+	if err := authorize(conn); err != nil {
+		t.Errorf("authorize refused the session's user: %v", err)
+	}
+
+	// Without credentials the reported identity is all there is
+	p1, p2 := net.Pipe()
+	defer func() { _ = p1.Close(); _ = p2.Close() }()
+	if by := sender(p1, "alice@box (pid 7)"); by != "alice@box (pid 7)" {
+		t.Errorf("sender over a pipe = %q", by)
+	}
+}
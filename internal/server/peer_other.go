@@ -0,0 +1,17 @@
+//go:build !linux
+
+package server
+
+import (
+	"net"
+
+	"persishtent/internal/protocol"
+)
+
+func peerIdentity(conn net.Conn) (protocol.Identity, bool) {
+	return protocol.Identity{}, false
+}
+
+func peerUID(conn net.Conn) (int, bool) {
+	return 0, false
+}
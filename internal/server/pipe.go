@@ -0,0 +1,125 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// pipeQueueSize is the number of output chunks buffered for a pipe command.
+// Chunks beyond it are dropped rather than holding up the session.
+const pipeQueueSize = 1024
+
+// pipeStopTimeout is how long stopPipe waits for the pipe command to exit
+// after closing its stdin before killing it.
+const pipeStopTimeout = 2 * time.Second
+
+// outputPipe feeds live session output into the stdin of a command, like
+// tmux pipe-pane.
+type outputPipe struct {
+	command string
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	data    chan []byte
+	done    chan struct{} // Closed once the command has been reaped
+	once    sync.Once
+	dropped bool
+}
+
+// startPipe runs command with sh and starts feeding it session output.
+// Only one pipe runs per session.
+func (s *Server) startPipe(command string) error {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	if s.pipe != nil {
+		return fmt.Errorf("output is already piped to '%s'; stop it first", s.pipe.command)
+	}
+
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Env = append(os.Environ(), "PERSISHTENT_SESSION="+s.Name)
+	// Its own process group, so stopPipe kills what sh started too
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	p := &outputPipe{command: command, cmd: cmd, stdin: stdin, data: make(chan []byte, pipeQueueSize), done: make(chan struct{})}
+	s.pipe = p
+	logf("piping output to %s (pid %d)", command, cmd.Process.Pid)
+
+	go func() {
+		defer recoverCrash(s.Name)
+		for chunk := range p.data {
+			if _, err := stdin.Write(chunk); err != nil {
+				break
+			}
+		}
+		_ = stdin.Close()
+	}()
+	go func() {
+		defer recoverCrash(s.Name)
+		err := cmd.Wait()
+		logf("pipe command %s exited: %v", command, err)
+		s.Lock.Lock()
+		if s.pipe == p {
+			s.pipe = nil
+		}
+		s.Lock.Unlock()
+		p.close()
+		close(p.done)
+	}()
+	return nil
+}
+
+// stopPipe closes the stdin of the pipe command, which ends most commands.
+// Commands still running after pipeStopTimeout are killed. It returns once
+// the command has been reaped.
+func (s *Server) stopPipe() error {
+	s.Lock.Lock()
+	p := s.pipe
+	s.pipe = nil
+	s.Lock.Unlock()
+	if p == nil {
+		return fmt.Errorf("output is not piped")
+	}
+	p.close()
+	select {
+	case <-p.done:
+	case <-time.After(pipeStopTimeout):
+		logf("pipe command %s still runs after its input ended, killing it", p.command)
+		_ = syscall.Kill(-p.cmd.Process.Pid, syscall.SIGKILL)
+		<-p.done
+	}
+	return nil
+}
+
+// pipeOutput queues output for the pipe command, if any. The command must not
+// slow down the session, so output is dropped while its queue is full.
+func (s *Server) pipeOutput(data []byte) {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	p := s.pipe
+	if p == nil {
+		return
+	}
+	select {
+	case p.data <- append([]byte(nil), data...):
+	default:
+		if !p.dropped {
+			logf("pipe command %s is too slow, dropping output", p.command)
+			p.dropped = true
+		}
+	}
+}
+
+// close ends the output of the pipe. Queued output is still written.
+func (p *outputPipe) close() {
+	p.once.Do(func() { close(p.data) })
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_Pipe(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "piped")
+	srv := &Server{Name: "pipe"}
+
+	if err := srv.stopPipe(); err == nil {
+		t.Error("Stopping without a pipe should fail")
+	}
+	if err := srv.startPipe("cat > " + out); err != nil {
+		t.Fatalf("startPipe failed: %v", err)
+	}
+	if err := srv.startPipe("cat"); err == nil || !strings.Contains(err.Error(), "already piped") {
+		t.Errorf("Expected a second pipe to be refused, got %v", err)
+	}
+
+	srv.pipeOutput([]byte("first "))
+	srv.pipeOutput([]byte("second"))
+	if err := srv.stopPipe(); err != nil {
+		t.Fatalf("stopPipe failed: %v", err)
+	}
+
+	// cat exits once its stdin is closed
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		data, _ := os.ReadFile(out)
+		if string(data) == "first second" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Piped output = %q", data)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// Output without a pipe goes nowhere
+	srv.pipeOutput([]byte("dropped"))
+}
+
+func TestServer_PipeCommandExits(t *testing.T) {
+	srv := &Server{Name: "pipe"}
+	if err := srv.startPipe("true"); err != nil {
+		t.Fatalf("startPipe failed: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		srv.Lock.Lock()
+		p := srv.pipe
+		srv.Lock.Unlock()
+		if p == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Pipe not cleared after its command exited")
+		}
+		srv.pipeOutput([]byte("data"))
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestServer_StopPipeKills(t *testing.T) {
+	srv := &Server{Name: "pipe"}
+	// Neither the shell nor its child read their input
+	if err := srv.startPipe("sleep 60; sleep 60"); err != nil {
+		t.Fatalf("startPipe failed: %v", err)
+	}
+	srv.Lock.Lock()
+	p := srv.pipe
+	srv.Lock.Unlock()
+
+	start := time.Now()
+	if err := srv.stopPipe(); err != nil {
+		t.Fatalf("stopPipe failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > pipeStopTimeout+time.Second {
+		t.Errorf("stopPipe took %v", elapsed)
+	}
+	if p.cmd.ProcessState == nil {
+		t.Error("Pipe command was not reaped")
+	}
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"persishtent/internal/config"
+	"persishtent/internal/protocol"
+)
+
+// clientQueueSize is how many packets may wait for a client. What happens to
+// a client that falls further behind is decided by slow_client_policy.
+const clientQueueSize = 1024
+
+// clientFlushTimeout is how long a detached client's queued packets, e.g. a
+// kick or the exit status, may take to be sent before its connection is closed.
+const clientFlushTimeout = time.Second
+
+type packet struct {
+	t       protocol.Type
+	payload []byte
+	timeout time.Duration // Write deadline, 0 for none
+}
+
+// outQueue sends packets to one client from its own goroutine, so a slow or
+// stalled client doesn't hold up the output of the others.
+type outQueue struct {
+	conn    net.Conn
+	packets chan packet
+	done    chan struct{} // Closed when the writer is finished
+	once    sync.Once
+
+	mu      sync.Mutex // Serializes write deadline changes
+	flushBy time.Time  // Set once the queue is closed
+
+	dropped  bool // Disconnected for falling behind, guarded by Server.Lock
+	skipping bool // Output is being skipped, guarded by Server.Lock
+
+	queued  uint64        // Packets queued so far, guarded by Server.Lock
+	written atomic.Uint64 // Packets written so far, to tell a slow client from a stalled one
+}
+
+func newOutQueue(conn net.Conn, stalls *atomic.Uint64) *outQueue {
+	q := &outQueue{
+		conn:    conn,
+		packets: make(chan packet, clientQueueSize),
+		done:    make(chan struct{}),
+	}
+	go q.run(stalls)
+	return q
+}
+
+// run writes queued packets until the queue is closed or a write fails,
+// then closes the connection. A write that misses its deadline fails, as the
+// client can't be sent the rest of a partially written packet later.
+func (q *outQueue) run(stalls *atomic.Uint64) {
+	defer close(q.done)
+	defer func() { _ = q.conn.Close() }()
+	for p := range q.packets {
+		start := time.Now()
+		q.setDeadline(start, p.timeout)
+		// Only clients that got TypeLimit are sent payloads above MaxPayloadSize
+		if err := protocol.WritePacketLimit(q.conn, p.t, p.payload, protocol.LargePayloadSize); err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				logf("client write timed out, disconnecting")
+			}
+			return
+		}
+		q.written.Add(1)
+		if time.Since(start) > broadcastStallThreshold {
+			stalls.Add(1)
+		}
+	}
+}
+
+// setDeadline limits the next write to timeout, or to the end of the flush
+// period of a closed queue.
+func (q *outQueue) setDeadline(now time.Time, timeout time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = now.Add(timeout)
+	}
+	if !q.flushBy.IsZero() && (deadline.IsZero() || q.flushBy.Before(deadline)) {
+		deadline = q.flushBy
+	}
+	_ = q.conn.SetWriteDeadline(deadline)
+}
+
+// close makes the writer send what is queued, within clientFlushTimeout, and
+// then close the connection.
+func (q *outQueue) close() {
+	q.once.Do(func() {
+		q.mu.Lock()
+		q.flushBy = time.Now().Add(clientFlushTimeout)
+		_ = q.conn.SetWriteDeadline(q.flushBy)
+		q.mu.Unlock()
+		close(q.packets)
+	})
+}
+
+// addClient registers conn to receive output. Must be called with s.Lock held.
+func (s *Server) addClient(conn net.Conn) {
+	if s.queues == nil {
+		s.queues = make(map[net.Conn]*outQueue)
+	}
+	s.Clients[conn] = struct{}{}
+	s.queues[conn] = newOutQueue(conn, &s.stalls)
+}
+
+// removeClient unregisters conn and closes it once its queued packets are
+// sent. Must be called with s.Lock held.
+func (s *Server) removeClient(conn net.Conn) {
+	delete(s.Clients, conn)
+	s.removeFlowClient(conn)
+	if q, ok := s.queues[conn]; ok {
+		q.close()
+		delete(s.queues, conn)
+	}
+}
+
+// send queues a packet for conn. The payload must not be modified afterwards.
+// If the client's queue is full, slow_client_policy decides whether it is
+// disconnected, misses the packet, or send waits for it to catch up.
+// Must be called with s.Lock held.
+func (s *Server) send(conn net.Conn, t protocol.Type, payload []byte) {
+	q, ok := s.queues[conn]
+	if !ok || q.dropped {
+		return
+	}
+	p := packet{t, payload, time.Duration(config.Current().ClientWriteTimeout * float64(time.Second))}
+	select {
+	case q.packets <- p:
+		q.queued++
+		q.skipping = false
+		return
+	default:
+	}
+
+	switch config.Current().SlowClientPolicy {
+	case config.SlowClientSkip:
+		if !q.skipping {
+			logf("client fell %d packets behind, skipping output", clientQueueSize)
+			q.skipping = true
+		}
+	case config.SlowClientBlock:
+		// Holds up the session until the client catches up or its write times out
+		select {
+		case q.packets <- p:
+			q.queued++
+		case <-q.done:
+		}
+	default:
+		logf("client fell %d packets behind, disconnecting", clientQueueSize)
+		q.dropped = true
+		_ = conn.Close()
+	}
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"fmt"
+	"os"
+
+	"persishtent/internal/session"
+)
+
+// rename moves a live session to a new name: it re-binds the socket, moves
+// logs and metadata, and updates the name seen by the shell integration.
+func (s *Server) rename(newName string) error {
+	if err := session.ValidateName(newName); err != nil {
+		return err
+	}
+
+	s.Lock.Lock()
+	oldName := s.Name
+	s.Lock.Unlock()
+	if newName == oldName {
+		return nil
+	}
+
+	newInfo, _ := session.GetInfoPath(newName)
+	newSock, err := session.GetSocketPath(newName)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(newInfo); err == nil {
+		return fmt.Errorf("%w: %s", session.ErrSessionExists, newName)
+	}
+	if session.SocketExists(newSock) {
+		return fmt.Errorf("%w: %s", session.ErrSessionExists, newName)
+	}
+
+	// 1. Socket: bind the new path before dropping the old one
+	if !s.customSock {
+		s.Lock.Lock()
+		oldListener, oldSock := s.listener, s.sockPath
+		s.Lock.Unlock()
+		if err := s.listen(newSock); err != nil {
+			return err
+		}
+		_ = oldListener.Close()
+		if !session.IsAbstract(oldSock) {
+			_ = os.Remove(oldSock)
+		}
+	}
+
+	// 2. Logs
+	info, infoErr := session.ReadInfo(oldName)
+	if s.logger != nil && !s.customLog {
+		newLog, err := session.GetLogPath(newName)
+		if err != nil {
+			return err
+		}
+		if err := s.logger.Rename(newName, newLog); err != nil {
+			return err
+		}
+		info.LogPath = newLog
+	}
+
+	// 3. Metadata
+	if infoErr == nil {
+		info.Name = newName
+		if err := session.WriteInfo(info); err != nil {
+			return err
+		}
+		oldInfo, _ := session.GetInfoPath(oldName)
+		_ = os.Remove(oldInfo)
+	}
+
+	// The forwarded env file and symlinks stay where they are: the shell's
+	// environment points at them, and Clean keeps them because the info file
+	// references them.
+
+	// 4. Name as seen by the shell and anything the daemon spawns later
+	s.Lock.Lock()
+	s.Name = newName
+	s.audit(session.AuditEvent{Event: session.AuditRename, Detail: "from " + oldName})
+	s.Lock.Unlock()
+	_ = os.Setenv("PERSISHTENT_SESSION", newName)
+	if s.nameFile != "" {
+		_ = os.WriteFile(s.nameFile, []byte(newName+"\n"), 0600)
+	}
+	debugLog.rename(newName)
+	if err := session.RenameDaemonOutput(oldName, newName); err != nil {
+		errorf("daemon output not renamed: %v", err)
+	}
+
+	logf("session renamed from %s to %s", oldName, newName)
+	return nil
+}
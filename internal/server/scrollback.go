@@ -0,0 +1,60 @@
+package server
+
+import (
+	"bytes"
+
+	"persishtent/internal/ansi"
+	"persishtent/internal/session"
+)
+
+// scrollback keeps the most recent session output in memory, replayed to
+// clients that attach with CapReplay.
+type scrollback struct {
+	buf     []byte
+	size    int
+	trimmed bool // Older output was dropped
+}
+
+// write appends output. The buffer grows to twice its size before old output
+// is dropped, so trimming is amortized over many writes.
+func (b *scrollback) write(p []byte) {
+	if b.size <= 0 {
+		return
+	}
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > 2*b.size {
+		b.buf = append(b.buf[:0], b.buf[len(b.buf)-b.size:]...)
+		b.trimmed = true
+	}
+}
+
+// snapshot returns a copy of the last size bytes of output, or of its last
+// tail lines if tail is above 0. Output cut off in the middle of a string
+// sequence starts after it, and tails have no inline graphics, since a cut
+// through one would print its payload as text.
+func (b *scrollback) snapshot(tail int) []byte {
+	data := b.buf
+	cut := b.trimmed
+	if len(data) > b.size {
+		data, cut = data[len(data)-b.size:], true
+	}
+	if tail > 0 {
+		data = data[session.TailStart(data, tail):]
+		return ansi.StripGraphics(ansi.TrimPartialString(data))
+	}
+	if cut {
+		data = ansi.TrimPartialString(data)
+	}
+	return bytes.Clone(data)
+}
+
+// missing reports whether output a snapshot of tail lines (0 for all) would
+// include is no longer in memory.
+func (b *scrollback) missing(tail int) bool {
+	data := b.buf
+	cut := b.trimmed
+	if len(data) > b.size {
+		data, cut = data[len(data)-b.size:], true
+	}
+	return cut && (tail <= 0 || session.TailStart(data, tail) == 0)
+}
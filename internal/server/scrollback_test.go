@@ -0,0 +1,54 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestScrollback(t *testing.T) {
+	var off scrollback
+	off.write([]byte("lost"))
+	if got := off.snapshot(0); len(got) != 0 {
+		t.Errorf("Disabled scrollback kept %q", got)
+	}
+
+	b := scrollback{size: 16}
+	b.write([]byte("one\ntwo\n"))
+	b.write([]byte("three\n"))
+	if got := string(b.snapshot(0)); got != "one\ntwo\nthree\n" {
+		t.Errorf("snapshot = %q", got)
+	}
+	if got := string(b.snapshot(2)); got != "two\nthree\n" {
+		t.Errorf("snapshot(2) = %q", got)
+	}
+	if got := string(b.snapshot(10)); got != "one\ntwo\nthree\n" {
+		t.Errorf("snapshot(10) = %q", got)
+	}
+	if b.missing(0) {
+		t.Error("Reported output missing before any was dropped")
+	}
+
+	// Only the last size bytes are kept
+	b.write([]byte(strings.Repeat("x", 40) + "\nlast"))
+	if got := string(b.snapshot(0)); got != strings.Repeat("x", 11)+"\nlast" {
+		t.Errorf("Trimmed snapshot = %q", got)
+	}
+	if got := string(b.snapshot(1)); got != "last" {
+		t.Errorf("Trimmed snapshot(1) = %q", got)
+	}
+	if !b.missing(0) || !b.missing(5) || b.missing(1) {
+		t.Errorf("missing = %v, %v, %v, want only the full and the long replay cut", b.missing(0), b.missing(5), b.missing(1))
+	}
+	if len(b.buf) > 2*b.size {
+		t.Errorf("Buffer grew to %d bytes", len(b.buf))
+	}
+}
+
+func TestScrollback_CutSequence(t *testing.T) {
+	b := scrollback{size: 16}
+	// The start of the OSC is dropped, its rest must not be replayed as text
+	b.write([]byte("\x1b]0;" + strings.Repeat("title", 5) + "\x1b\\prompt$ "))
+	if got := string(b.snapshot(0)); got != "prompt$ " {
+		t.Errorf("snapshot = %q", got)
+	}
+}
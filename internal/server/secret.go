@@ -0,0 +1,46 @@
+package server
+
+import (
+	"errors"
+	"time"
+)
+
+// secretQuietPeriod is how long PTY output isn't logged or recorded after a
+// secret is written, in case the program reading it echoes it after all.
+const secretQuietPeriod = 500 * time.Millisecond
+
+// injectSecret writes secret to the PTY as if it was typed. Unless force is
+// set, it refuses if the terminal echoes input, as then the secret would show
+// up on screen and in the log instead of being read by a password prompt.
+func (s *Server) injectSecret(secret []byte, force bool) error {
+	if s.ptmx == nil {
+		return errors.New("session has no terminal")
+	}
+	if !force {
+		if s.device {
+			return errors.New("cannot tell whether a serial device is at a password prompt (use -force)")
+		}
+		echo, err := terminalEchoes(int(s.ptmx.Fd()))
+		if err != nil {
+			return err
+		}
+		if echo {
+			return errors.New("session is not at a password prompt: terminal echo is on (use -force)")
+		}
+	}
+	s.quietUntil.Store(time.Now().Add(secretQuietPeriod).UnixNano())
+	logf("injecting secret (%d bytes)", len(secret))
+	if _, err := s.ptmx.Write(secret); err != nil {
+		return err
+	}
+	s.bytesIn.Add(uint64(len(secret)))
+	s.lastInput.Store(time.Now().UnixNano())
+	// Output caused by the secret may only arrive once it is read
+	s.quietUntil.Store(time.Now().Add(secretQuietPeriod).UnixNano())
+	return nil
+}
+
+// quiet reports whether PTY output is currently kept out of the log.
+func (s *Server) quiet() bool {
+	return time.Now().UnixNano() < s.quietUntil.Load()
+}
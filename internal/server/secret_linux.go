@@ -0,0 +1,12 @@
+package server
+
+import "golang.org/x/sys/unix"
+
+// terminalEchoes reports whether the terminal behind fd echoes input.
+func terminalEchoes(fd int) (bool, error) {
+	t, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return false, err
+	}
+	return t.Lflag&unix.ECHO != 0, nil
+}
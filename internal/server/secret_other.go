@@ -0,0 +1,9 @@
+//go:build !linux
+
+package server
+
+import "errors"
+
+func terminalEchoes(fd int) (bool, error) {
+	return false, errors.New("checking for a password prompt is only supported on Linux (use -force)")
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// DefaultBaud is the baud rate used for serial devices unless specified.
+const DefaultBaud = 115200
+
+// openSerial opens a serial device for a device session, configured for raw
+// 8N1 I/O at the given baud rate. The device stays in non-blocking mode so
+// closing it interrupts a pending read.
+func openSerial(path string, baud int) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := f.SyscallConn()
+	if err == nil {
+		ctlErr := rc.Control(func(fd uintptr) { err = configureSerial(int(fd), baud) })
+		if ctlErr != nil {
+			err = ctlErr
+		}
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("configuring %s: %w", path, err)
+	}
+	return f, nil
+}
+
+// CheckSerial reports whether path can be used as a serial device at baud
+// before a daemon is spawned for it.
+func CheckSerial(path string, baud int) error {
+	if len(baudRates) == 0 {
+		return errors.New("serial devices are only supported on Linux")
+	}
+	if _, ok := baudRates[baud]; !ok {
+		return fmt.Errorf("unsupported baud rate %d", baud)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeCharDevice == 0 {
+		return fmt.Errorf("%s is not a character device", path)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/creack/pty"
+	"golang.org/x/sys/unix"
+)
+
+func TestOpenSerial(t *testing.T) {
+	// A PTY slave stands in for the serial device
+	master, slave, err := pty.Open()
+	if err != nil {
+		t.Skipf("pty unavailable: %v", err)
+	}
+	defer func() { _ = master.Close() }()
+	defer func() { _ = slave.Close() }()
+
+	dev, err := openSerial(slave.Name(), 9600)
+	if err != nil {
+		t.Fatalf("openSerial failed: %v", err)
+	}
+
+	tio, err := unix.IoctlGetTermios(int(slave.Fd()), unix.TCGETS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tio.Lflag&(unix.ECHO|unix.ICANON) != 0 || tio.Oflag&unix.OPOST != 0 {
+		t.Error("Expected the device to be in raw mode")
+	}
+	if tio.Cflag&unix.CBAUD != unix.B9600 {
+		t.Errorf("Expected 9600 baud, got cflag %#x", tio.Cflag)
+	}
+
+	// Raw mode passes bytes through untranslated
+	_, _ = master.Write([]byte("boot\r\n"))
+	buf := make([]byte, 16)
+	n, err := dev.Read(buf)
+	if err != nil || string(buf[:n]) != "boot\r\n" {
+		t.Errorf("Expected raw device output, got %q (%v)", buf[:n], err)
+	}
+
+	// Closing the device must interrupt a pending read, as kill relies on it
+	done := make(chan struct{})
+	go func() {
+		_, _ = dev.Read(buf)
+		close(done)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	_ = dev.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Read was not interrupted by Close")
+	}
+}
+
+func TestCheckSerial(t *testing.T) {
+	if err := CheckSerial("/dev/null", 12345); err == nil {
+		t.Error("Expected error for unsupported baud rate")
+	}
+	file := filepath.Join(t.TempDir(), "file")
+	_ = os.WriteFile(file, nil, 0600)
+	if err := CheckSerial(file, DefaultBaud); err == nil {
+		t.Error("Expected error for a regular file")
+	}
+	if err := CheckSerial("/dev/null", DefaultBaud); err != nil {
+		t.Errorf("Expected character device to be accepted: %v", err)
+	}
+}
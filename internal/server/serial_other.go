@@ -0,0 +1,11 @@
+//go:build !linux
+
+package server
+
+import "errors"
+
+var baudRates = map[int]uint32{}
+
+func configureSerial(fd int, baud int) error {
+	return errors.New("serial devices are only supported on Linux")
+}
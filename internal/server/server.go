@@ -1,17 +1,26 @@
 package server
 
 import (
-	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/creack/pty"
+	"golang.org/x/sys/unix"
+	"persishtent/internal/ansi"
 	"persishtent/internal/config"
 	"persishtent/internal/protocol"
 	"persishtent/internal/session"
@@ -23,85 +32,299 @@ type Server struct {
 	Master  net.Conn
 	Clients map[net.Conn]struct{}
 	Lock    sync.Mutex
+
+	sizes map[net.Conn]pty.Winsize
+	caps  map[net.Conn]protocol.Caps // Capability flags sent by each client
+	pings map[net.Conn]ping          // Unanswered TypePing sent to each client, see sweep
+
+	attached map[net.Conn]protocol.ClientInfo // Who each client is and since when, see clientList
+	lastID   int                              // ID of the latest client in attached
+
+	queues map[net.Conn]*outQueue // Packets waiting to be written to each client
+	flow   flowControl            // Output credit of clients with CapFlow
+
+	ephemeral   bool
+	exclusive   bool     // Every Master locks the session, see locked
+	locked      net.Conn // Master holding an exclusive lock, refusing other Masters
+	linger      time.Duration
+	lingerTimer *time.Timer
+
+	listener   net.Listener
+	sockPath   string
+	customSock bool
+	logger     *LogRotator
+	customLog  bool
+	nameFile   string
+	ptmx       *os.File
+	ttyName    string   // Terminal of the shell, see reopenPTY
+	tty        *os.File // Terminal held open by reopenPTY, guarded by output
+	device     bool // ptmx is a serial device and there is no shell process
+	profile    string
+	env        *forwardedEnv
+	started    time.Time
+	upgraded   time.Time // When this daemon took over the session, see upgrade
+	options    Options   // Options the session was started with, passed on by upgrade
+	termSet    bool      // The shell got the terminal type of a master, see adoptTerm
+	cast       *castRecorder
+	suspended  bool // Processes stopped by suspend
+	infoErr    error  // Result of the last info file update
+	info       session.Info // Last info written, to register the session again
+	pipe       *outputPipe  // Command fed with live output, see pipe
+	degraded   string // Why session state can't be persisted, empty if it can
+	guard      guard  // Master input held back by guard_patterns
+	scrollback scrollback // Recent output replayed on attach, guarded by Lock
+	outputSize uint64     // Bytes of output broadcast so far, see TypeResume; guarded by Lock
+	screen     *ansi.Screen // Text on the terminal for capture, guarded by Lock
+
+	// Held by the output loop from a read until the output is handled, so
+	// upgrade can stop it between two reads
+	output sync.Mutex
+
+	bytesIn  atomic.Uint64 // Client input written to the PTY
+	bytesOut atomic.Uint64 // PTY output
+	stalls   atomic.Uint64 // Client writes held up by a slow reader
+
+	lastInput  atomic.Int64 // Time of the last client input in Unix nanoseconds
+	quietUntil atomic.Int64 // Output isn't logged until then (Unix nanoseconds), see injectSecret
+}
+
+// broadcastStallThreshold is how long a write to a single client may take
+// before it is counted as a stall.
+const broadcastStallThreshold = 100 * time.Millisecond
+
+// Options configures a session daemon.
+type Options struct {
+	SockPath  string        // Custom socket path
+	LogPath   string        // Custom log path
+	Command   string        // Custom command to run instead of the shell
+	Argv      []string      // Program and arguments to run directly, without a shell; Command only shows it
+	Ephemeral bool          // Kill the session once the last client detaches
+	Linger    time.Duration // Grace period before an ephemeral session is killed
+	Banner    string        // Banner template shown at start and on attach
+	Cwd       string        // Starting directory of the shell
+	Tags      []string      // Free-form labels such as "prod"
+	Record    bool          // Save an asciicast recording (also enabled by the record config)
+	Shell     string        // Shell with arguments, overrides default_shell and $SHELL
+	TTY       string        // Serial device to proxy instead of spawning a shell
+	Baud      int           // Baud rate of the serial device
+	Profile   string        // Config profile providing environment and log settings
+	Keepalive time.Duration // Keepalive input interval, overrides keepalive_interval
+	Umask     string        // Octal umask of the shell, e.g. "027"
+	Locale    string        // LANG of the shell; inherited LC_* variables are dropped
+	TZ        string        // Timezone of the shell
+	Env       []string      // Extra KEY=value variables of the shell, taking precedence over the profile's
+	NoLog     bool          // Keep output in memory only, also set by the no_log config
+	Exclusive bool          // Master attaches lock the session until they detach
+	Term      string        // TERM of the terminal the session starts attached to, if any
+	ColorTerm string        // COLORTERM of that terminal
 }
 
+// screenHistory is how many lines scrolled off the screen capture can include.
+const screenHistory = 5000
+
+// housekeepingInterval is how often the daemon refreshes its heartbeat and
+// the shell's working directory in the session info.
+const housekeepingInterval = 5 * time.Second
+
 // Run starts the session server. It blocks until the shell process exits.
-func Run(name string, sockPath string, logPath string, customCmd string) error {
-	// 1. Setup Log
-	if logPath == "" {
-		var err error
-		logPath, err = session.GetLogPath(name)
+func Run(name string, opts Options) error {
+	defer recoverCrash(name)
+	sockPath, logPath, customCmd := opts.SockPath, opts.LogPath, opts.Command
+	// Custom paths are recorded in the info file, where they must not depend
+	// on the working directory
+	if sockPath != "" && !session.IsAbstract(sockPath) {
+		sockPath, _ = filepath.Abs(sockPath)
+	}
+	if logPath != "" {
+		logPath, _ = filepath.Abs(logPath)
+	}
+	// A second daemon would take over the socket and truncate the log
+	checkPath := sockPath
+	if checkPath == "" {
+		checkPath, _ = session.GetSocketPath(name)
+	}
+	if session.SocketExists(checkPath) {
+		return fmt.Errorf("%w: %s", session.ErrSessionExists, name)
+	}
+	debugLog.setName(name)
+	defer debugLog.flush()
+	profile := config.Current().Profiles[opts.Profile]
+	config.Update(profile.ApplyLogSettings)
+
+	// 1. Setup Log, unless output must not reach the disk. The in-memory
+	// scrollback still serves replay.
+	noLog := opts.NoLog || config.Current().NoLog
+	var logger *LogRotator
+	var logOut io.Writer = io.Discard
+	var err error
+	if noLog {
+		logPath = ""
+	} else {
+		if logPath == "" {
+			logPath, err = session.GetLogPath(name)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Use LogRotator
+		logger, err = NewLogRotator(name, logPath)
 		if err != nil {
 			return err
 		}
-	}
-	
-	// Use LogRotator
-	logger, err := NewLogRotator(name, logPath)
-	if err != nil {
-		return err
-	}
-	defer func() { _ = logger.Close() }()
+		defer func() { _ = logger.Close() }()
 
-	// 1.5 Setup SSH Agent symlink
-	sshSymlink, _ := session.GetSSHSockPath(name)
-	currentSSH := os.Getenv("SSH_AUTH_SOCK")
-	if currentSSH != "" {
-		_ = os.Remove(sshSymlink)
-		_ = os.Symlink(currentSSH, sshSymlink)
+		// Inline images can be huge; optionally keep them out of the log
+		logOut = logger
+		if config.Current().LogStripGraphics {
+			logOut = ansi.NewGraphicsFilter(logger)
+		}
 	}
 
-	// 2. Setup PTY
-	shell := os.Getenv("SHELL")
-	if shell == "" {
-		shell = "bash"
-	}
-	
-	var cmd *exec.Cmd
-	if customCmd != "" {
-		shellPath := "/bin/sh"
-		if _, err := exec.LookPath("bash"); err == nil {
-			shellPath = "bash"
+	// 1.5 Forwarded environment (SSH agent, X display, ...)
+	env := newForwardedEnv(name)
+	for _, key := range config.Current().ForwardEnv {
+		if value := os.Getenv(key); value != "" {
+			env.set(key, value)
 		}
-		cmd = exec.Command(shellPath, "-c", customCmd)
-	} else {
-		cmd = exec.Command(shell)
 	}
-	
-	cmd.Env = append(os.Environ(), "TERM=xterm-256color", "PERSISHTENT_SESSION="+name)
-	
-	// Inject prompt prefix
-	promptPrefix := fmt.Sprintf("%s:%s ", config.Global.PromptPrefix, name)
-	ps1 := os.Getenv("PS1")
-	if ps1 == "" {
-		// Default prompts often look like this
-		ps1 = "[\\u@\\h \\W]\\$ "
+
+	// The name file tracks the current session name across live renames
+	nameFile, _ := session.GetNameFilePath(os.Getpid())
+	_ = os.WriteFile(nameFile, []byte(name+"\n"), 0600)
+	defer func() { _ = os.Remove(nameFile) }()
+
+	startDir := opts.Cwd
+	if startDir == "" {
+		startDir, _ = os.Getwd()
 	}
-	cmd.Env = append(cmd.Env, "PS1="+promptPrefix+ps1)
 
-	if currentSSH != "" {
-		// Point the child to the stable symlink
-		cmd.Env = append(cmd.Env, "SSH_AUTH_SOCK="+sshSymlink)
+	// 1.7 Wait for the resources the session depends on
+	if len(profile.WaitFor) > 0 {
+		procStart, _ := session.ProcStartTime(os.Getpid())
+		waiting := session.Info{
+			Name:      name,
+			PID:       os.Getpid(),
+			ProcStart: procStart,
+			Command:   customCmd,
+			LogPath:   logPath,
+			Socket:    sockPath,
+			StartTime: time.Now(),
+			Host:      session.Hostname(),
+			Tags:      opts.Tags,
+			Profile:   opts.Profile,
+		}
+		if err := waitPreconditions(waiting, profile.WaitFor, waitTimeout(profile)); err != nil {
+			errorf("%v", err)
+			_, _ = logOut.Write([]byte("[" + err.Error() + "]\r\n"))
+			removeInfo(name)
+			return err
+		}
 	}
 
-	ptmx, err := pty.Start(cmd)
-	if err != nil {
-		return err
+	// 2. Setup PTY, or open the serial device which takes its place
+	shellArgs := ShellArgs(opts.Shell)
+	var cmd *exec.Cmd
+	var ptmx *os.File
+	var ttyName string
+	infoCmd := customCmd
+	pid := os.Getpid()
+	if opts.TTY != "" {
+		ptmx, err = openSerial(opts.TTY, opts.Baud)
+		if err != nil {
+			return err
+		}
+		infoCmd = fmt.Sprintf("%s (%d baud)", opts.TTY, opts.Baud)
+		shellArgs = []string{""}
+	} else {
+		cmd, ptmx, err = startShell(name, opts, shellArgs, profileEnv(profile), env, nameFile)
+		if err != nil {
+			return err
+		}
+		if infoCmd == "" {
+			infoCmd = strings.Join(shellArgs, " ")
+		}
+		pid = cmd.Process.Pid
+		if tty, ok := cmd.Stdin.(*os.File); ok {
+			ttyName = tty.Name()
+		}
 	}
 	defer func() { _ = ptmx.Close() }()
 
 	// 2.5 Write Info
-	infoCmd := customCmd
-	if infoCmd == "" {
-		infoCmd = shell
-	}
-	_ = session.WriteInfo(session.Info{
+	procStart, _ := session.ProcStartTime(pid)
+	info := session.Info{
 		Name:      name,
-		PID:       cmd.Process.Pid,
+		PID:       pid,
 		Command:   infoCmd,
+		Argv:      opts.Argv,
 		LogPath:   logPath,
+		Socket:    sockPath,
 		StartTime: time.Now(),
-	})
+		Host:      session.Hostname(),
+		ProcStart:   procStart,
+		Ephemeral:   opts.Ephemeral,
+		Exclusive:   opts.Exclusive,
+		EnvFile:     env.file,
+		EnvLinks:    env.linkPaths(),
+		Banner:      opts.Banner,
+		StartDir:    startDir,
+		Cwd:         startDir,
+		Tags:        opts.Tags,
+		Profile:     opts.Profile,
+		Umask:       opts.Umask,
+		Locale:      opts.Locale,
+		TZ:          opts.TZ,
+		Env:         envNames(opts.Env),
+	}
+	term, _ := sessionTerm(opts.Term, opts.ColorTerm)
+	if opts.TTY == "" && (opts.Term != "" || config.Current().Term != "") {
+		info.Term = term
+	}
+
+	// Optional asciicast recording, which would persist output as well
+	var cast *castRecorder
+	if (opts.Record || config.Current().Record) && !noLog {
+		maxPause := time.Duration(config.Current().RecordMaxPause * float64(time.Second))
+		if recPath, err := session.GetRecordingPath(name, info.StartTime); err == nil {
+			if cast, err = newCastRecorder(recPath, name, shellArgs[0], term, 0, 0, maxPause); err == nil {
+				info.Recording = recPath
+				defer func() { _ = cast.Close() }()
+			}
+		}
+	}
+	infoErr := session.WriteInfo(info)
+
+	// Put the banner at the top of the session history
+	if banner := session.BannerFor(info); banner != "" {
+		_, _ = logOut.Write([]byte(banner))
+	}
+
+	srv := &Server{
+		Name:       name,
+		Cmd:        cmd,
+		Clients:    make(map[net.Conn]struct{}),
+		ephemeral:  opts.Ephemeral,
+		exclusive:  opts.Exclusive,
+		linger:     opts.Linger,
+		customSock: sockPath != "",
+		logger:     logger,
+		customLog:  opts.LogPath != "",
+		profile:    opts.Profile,
+		nameFile:   nameFile,
+		ptmx:       ptmx,
+		ttyName:    ttyName,
+		device:     opts.TTY != "",
+		env:        env,
+		started:    info.StartTime,
+		cast:       cast,
+		infoErr:    infoErr,
+		info:       info,
+		options:    opts,
+		termSet:    opts.Term != "",
+		scrollback: scrollback{size: config.Current().ScrollbackSizeMB * 1024 * 1024},
+		screen:     ansi.NewScreen(24, 80, screenHistory),
+	}
 
 	// 3. Setup Socket
 	if sockPath == "" {
@@ -110,52 +333,112 @@ func Run(name string, sockPath string, logPath string, customCmd string) error {
 			return err
 		}
 	}
-	_ = os.Remove(sockPath)
-
-	l, err := net.Listen("unix", sockPath)
-	if err != nil {
+	if err := srv.listen(sockPath); err != nil {
 		return err
 	}
+	logf("session %s started (pid %d)", name, pid)
+	srv.Lock.Lock()
+	srv.audit(session.AuditEvent{Event: session.AuditStart, Detail: fmt.Sprintf("pid %d", pid)})
+	srv.Lock.Unlock()
+
+	return srv.serve(opts.Keepalive, logOut)
+}
+
+// serve runs the session until it ends: it relays the shell's output to the
+// clients and waits for the shell to exit, then cleans up the session.
+func (s *Server) serve(keepalive time.Duration, logOut io.Writer) error {
 	defer func() {
-		_ = l.Close()
-		_ = os.Remove(sockPath)
-		infoPath, _ := session.GetInfoPath(name)
-		_ = os.Remove(infoPath)
+		s.Lock.Lock()
+		_ = s.listener.Close()
+		if !session.IsAbstract(s.sockPath) {
+			_ = os.Remove(s.sockPath)
+		}
+		infoPath, _ := session.GetInfoPath(s.Name)
+		info := s.info
+		s.Lock.Unlock()
+		// Logs outside the state directory are left behind, so clean can offer to remove them
+		_ = session.TrackExternalLogs(info)
+		// The debug log moves along, later events would start a new one
+		debugLog.setName("")
+		// Sessions that end without their command exiting are archived here
+		if archived, err := session.Archive(info); err != nil {
+			errorf("archiving the session failed: %v", err)
+		} else if !archived {
+			_ = os.Remove(infoPath)
+		}
+		s.env.remove()
 	}()
-	_ = os.Chmod(sockPath, 0600)
-
-	srv := &Server{
-		Name:    name,
-		Cmd:     cmd,
-		Clients: make(map[net.Conn]struct{}),
-	}
 
 	// 4. Output Loop
+	outputDone := make(chan struct{})
 	go func() {
+		defer recoverCrash(s.Name)
+		defer close(outputDone)
 		buf := make([]byte, 4096)
 		for {
-			n, err := ptmx.Read(buf)
+			s.waitForCredit()
+			// Output is only read once it's there, so upgrade can take the
+			// PTY while the loop waits
+			if !waitReadable(s.ptmx) {
+				continue
+			}
+			s.output.Lock()
+			n, err := s.ptmx.Read(buf)
+			if err != nil && s.reopenPTY(err) {
+				s.output.Unlock()
+				continue
+			}
 			if err != nil {
+				s.output.Unlock()
 				break
 			}
 			data := buf[:n]
+			s.bytesOut.Add(uint64(n))
+
+			// Write to logger (handles rotation), unless a secret was just injected
+			if !s.quiet() {
+				_, _ = logOut.Write(data)
+				if s.cast != nil {
+					s.cast.output(data)
+				}
+				s.pipeOutput(data)
+			}
 			
-			// Write to logger (handles rotation)
-			_, _ = logger.Write(data)
-			
-			srv.broadcast(data)
+			s.broadcast(data)
+			s.output.Unlock()
 		}
-		_ = l.Close()
+		_ = s.stopPipe()
+		s.Lock.Lock()
+		_ = s.listener.Close()
+		s.Lock.Unlock()
 	}()
 
-	// 5. Accept Clients
+	// 4.5 Heartbeat and working directory tracking
 	go func() {
-		for {
-			conn, err := l.Accept()
-			if err != nil {
-				return
-			}
-			go srv.handleClient(conn, ptmx)
+		defer recoverCrash(s.Name)
+		s.housekeeping(housekeepingInterval)
+	}()
+
+	// 4.6 Detach clients that stopped reading
+	go func() {
+		defer recoverCrash(s.Name)
+		s.sweepClients()
+	}()
+
+	// 4.7 Keepalive input for connections that drop when idle
+	s.lastInput.Store(time.Now().UnixNano())
+	go func() {
+		defer recoverCrash(s.Name)
+		s.keepalive(keepalive, outputDone)
+	}()
+
+	// 5.4 Reload the config on SIGHUP
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	go func() {
+		defer recoverCrash(s.Name)
+		for range hupCh {
+			_ = s.reloadConfig()
 		}
 	}()
 
@@ -163,164 +446,1413 @@ func Run(name string, sockPath string, logPath string, customCmd string) error {
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
 	go func() {
-		<-sigCh
-		_ = cmd.Process.Kill()
+		defer recoverCrash(s.Name)
+		sig := <-sigCh
+		logf("daemon received %v, ending the session", sig)
+		if s.Cmd == nil {
+			_ = s.ptmx.Close()
+			return
+		}
+		_ = s.Cmd.Process.Kill()
 	}()
 
 	// 6. Wait
-	err = cmd.Wait()
-	return err
-}
-
-func (s *Server) broadcast(data []byte) {
+	code := 0
+	var err error
+	if s.Cmd == nil {
+		// Device sessions end when the device is closed or goes away
+		<-outputDone
+		logf("device closed")
+	} else {
+		err = s.Cmd.Wait()
+		logf("shell exited: %v", err)
+		s.releasePTY()
+		// Output still in the PTY is logged even if no client takes it
+		s.releaseFlow()
+		code = exitStatus(s.Cmd.ProcessState)
+	}
+	// Recorded before clients learn of the exit and move on
 	s.Lock.Lock()
-	defer s.Lock.Unlock()
-	for conn := range s.Clients {
-		err := protocol.WritePacket(conn, protocol.TypeData, data)
-		if err != nil {
-			_ = conn.Close()
-			delete(s.Clients, conn)
+	s.audit(session.AuditEvent{Event: session.AuditExit, Detail: fmt.Sprintf("exit status %d", code)})
+	s.Lock.Unlock()
+	s.updateInfo(func(info *session.Info) {
+		info.Ended = time.Now()
+		info.ExitCode = &code
+	})
+	// Archived before clients learn of the exit, so wait finds the session in
+	// the history. Output still logged goes to the moved file.
+	s.Lock.Lock()
+	ended := s.info
+	s.Lock.Unlock()
+	// The debug log moves along, later events would start a new one
+	debugLog.setName("")
+	if _, err := session.Archive(ended); err != nil {
+		errorf("archiving the session failed: %v", err)
+	}
+	s.broadcastExit(code)
+	if s.ephemeral {
+		// Leave nothing behind, including logs
+		s.Lock.Lock()
+		name := s.Name
+		s.Lock.Unlock()
+		session.Cleanup(name)
+		if s.logger != nil {
+			_ = os.Remove(s.logger.Path())
+			_ = os.Remove(session.IndexPath(s.logger.Path()))
 		}
 	}
+	logf("daemon exiting")
+	return err
 }
 
-func (s *Server) handleClient(conn net.Conn, ptmx *os.File) {
-
-	// First packet MUST be TypeMode
-
-	t, payload, err := protocol.ReadPacket(conn)
-
-	if err != nil || t != protocol.TypeMode || len(payload) < 1 {
+// startShell starts the session's shell, or its custom command, on a new PTY.
+func startShell(name string, opts Options, shellArgs []string, extraEnv []string, env *forwardedEnv, nameFile string) (*exec.Cmd, *os.File, error) {
+	var cmd *exec.Cmd
+	if len(opts.Argv) > 0 {
+		// No shell in between, so signals and the exit status are the program's
+		cmd = exec.Command(opts.Argv[0], opts.Argv[1:]...)
+	} else if opts.Command != "" {
+		shellPath := "/bin/sh"
+		if _, err := exec.LookPath("bash"); err == nil {
+			shellPath = "bash"
+		}
+		cmd = exec.Command(shellPath, "-c", opts.Command)
+	} else {
+		cmd = exec.Command(shellArgs[0], shellArgs[1:]...)
+	}
 
-		_ = conn.Close()
+	term, colorTerm := sessionTerm(opts.Term, opts.ColorTerm)
+	cmd.Env = append(termEnv(localeEnv(os.Environ(), opts.Locale, opts.TZ), term, colorTerm), "PERSISHTENT_SESSION="+name, "PERSISHTENT_NAME_FILE="+nameFile)
+	// Programs spawning a subshell (editors, pagers) should use the session shell
+	cmd.Env = append(cmd.Env, "SHELL="+shellArgs[0])
+	
+	// Inject prompt prefix
+	promptPrefix := fmt.Sprintf("%s:%s ", config.Current().PromptPrefix, name)
+	ps1 := os.Getenv("PS1")
+	if ps1 == "" {
+		// Default prompts often look like this
+		ps1 = "[\\u@\\h \\W]\\$ "
+	}
+	cmd.Env = append(cmd.Env, "PS1="+promptPrefix+ps1)
+	cmd.Env = append(cmd.Env, extraEnv...)
+	cmd.Env = append(cmd.Env, opts.Env...)
 
-		return
+	// Point the child to the stable symlinks and env file
+	cmd.Env = append(cmd.Env, env.environ()...)
 
+	cmd.Dir = opts.Cwd
+	if opts.Umask != "" {
+		mask, err := config.ParseUmask(opts.Umask)
+		if err != nil {
+			return nil, nil, err
+		}
+		// The shell inherits the umask; the daemon's own is restored once it runs
+		defer syscall.Umask(syscall.Umask(mask))
 	}
+	ptmx, err := pty.Start(cmd)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cmd, ptmx, nil
+}
 
+// profileEnv returns the environment of a profile as sorted KEY=value pairs,
+// with references to the daemon's environment expanded.
+func profileEnv(p config.Profile) []string {
+	env := make([]string, 0, len(p.Env))
+	for k, v := range p.Env {
+		env = append(env, k+"="+os.ExpandEnv(v))
+	}
+	sort.Strings(env)
+	return env
+}
 
+// localeEnv applies the locale and timezone overrides of a session to env.
+// Inherited LC_* variables would take precedence over LANG, so a locale
+// override drops them; profiles can still set them through env.
+func localeEnv(env []string, locale, tz string) []string {
+	if locale == "" && tz == "" {
+		return env
+	}
+	out := make([]string, 0, len(env)+2)
+	for _, kv := range env {
+		key, _, _ := strings.Cut(kv, "=")
+		if locale != "" && (key == "LANG" || strings.HasPrefix(key, "LC_") || key == "LANGUAGE") {
+			continue
+		}
+		if tz != "" && key == "TZ" {
+			continue
+		}
+		out = append(out, kv)
+	}
+	if locale != "" {
+		out = append(out, "LANG="+locale)
+	}
+	if tz != "" {
+		out = append(out, "TZ="+tz)
+	}
+	return out
+}
 
-	isReadOnly := payload[0] == protocol.ModeReadOnly
-
+// ShellArgs returns the shell to start and its arguments: override if set,
+// then default_shell from the config, then $SHELL, then bash. The value is
+// split on whitespace, so "/bin/bash -l" starts a login shell.
+func ShellArgs(override string) []string {
+	for _, shell := range []string{override, config.Current().DefaultShell, os.Getenv("SHELL")} {
+		if args := strings.Fields(shell); len(args) > 0 {
+			return args
+		}
+	}
+	return []string{"bash"}
+}
 
+// reloadConfig re-reads the config file and applies it to the running
+// session. Settings read on demand (forward_env, resize_policy) take effect
+// immediately; log rotation limits are applied to the open log. Settings used
+// only at start, like the shell or prompt prefix, affect new sessions only.
+func (s *Server) reloadConfig() error {
+	if err := config.Reload(); err != nil {
+		errorf("config reload failed: %v", err)
+		return err
+	}
+	config.Update(config.Current().Profiles[s.profile].ApplyLogSettings)
+	if s.logger != nil {
+		cfg := config.Current()
+		s.logger.SetLimits(cfg.LogRotationSizeMB, cfg.MaxLogRotations)
+	}
+	logf("config reloaded")
+	return nil
+}
 
+// updateInfo applies fn to the session's info file.
+func (s *Server) updateInfo(fn func(*session.Info)) {
 	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	info, err := session.ReadInfo(s.Name)
+	if err != nil {
+		return
+	}
+	fn(&info)
+	s.infoErr = session.WriteInfo(info)
+	s.info = info
+}
 
-		if !isReadOnly {
-
-			// New Master client: kick existing Master
-
-			if s.Master != nil {
-
-				_ = protocol.WritePacket(s.Master, protocol.TypeKick, nil)
+// changeMeta applies a JSON encoded session.MetaChange to the session info.
+func (s *Server) changeMeta(payload []byte) error {
+	var change session.MetaChange
+	if err := json.Unmarshal(payload, &change); err != nil {
+		return err
+	}
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	info, err := session.ReadInfo(s.Name)
+	if err != nil {
+		return err
+	}
+	change.Apply(&info)
+	s.infoErr = session.WriteInfo(info)
+	s.info = info
+	return s.infoErr
+}
 
-				_ = s.Master.Close()
+// register writes the session info again from memory and recreates the
+// socket and log, for daemons whose files were deleted (see gc).
+func (s *Server) register() error {
+	s.Lock.Lock()
+	info := s.info
+	info.Name = s.Name
+	info.Heartbeat = time.Now()
+	if s.logger != nil {
+		info.LogPath = s.logger.Path()
+	}
+	s.infoErr = session.WriteInfo(info)
+	err := s.infoErr
+	if err == nil {
+		s.info = info
+	}
+	name, nameFile := s.Name, s.nameFile
+	s.Lock.Unlock()
+	if err != nil {
+		return err
+	}
+	if nameFile != "" {
+		_ = os.WriteFile(nameFile, []byte(name+"\n"), 0600)
+	}
+	if s.logger != nil {
+		_ = s.logger.Reopen()
+	}
+	s.rebind()
+	logf("session %s registered again", name)
+	return nil
+}
 
+// housekeeping periodically refreshes the daemon heartbeat and the shell's
+// current directory in the session info until the shell exits.
+func (s *Server) housekeeping(interval time.Duration) {
+	for {
+		s.updateInfo(func(info *session.Info) {
+			info.Heartbeat = time.Now()
+			if s.device {
+				return
 			}
-
-			s.Master = conn
-
+			if cwd, err := session.ProcCwd(s.Cmd.Process.Pid); err == nil {
+				info.Cwd = cwd
+			}
+		})
+		s.checkPersistence()
+		start := time.Now()
+		time.Sleep(interval)
+		if !s.device && !session.IsPIDAlive(s.Cmd.Process.Pid) {
+			return
 		}
+		if slept(start) {
+			s.resumed()
+		}
+		s.rebind()
+	}
+}
 
-	
+// checkPersistence retries writing output kept in memory since the log
+// failed, and records whether the session's state can be written. The daemon
+// keeps serving clients while it can't, e.g. after a read-only remount or with
+// a full quota, and reports the condition in its status.
+func (s *Server) checkPersistence() {
+	s.Lock.Lock()
+	err := s.infoErr
+	s.Lock.Unlock()
+	if s.logger != nil {
+		if logErr := s.logger.Retry(); logErr != nil {
+			err = logErr
+		}
+	}
+	msg := ""
+	if err != nil {
+		msg = err.Error()
+	}
 
-	s.Clients[conn] = struct{}{}
+	s.Lock.Lock()
+	changed := msg != s.degraded
+	s.degraded = msg
 	s.Lock.Unlock()
+	if !changed {
+		return
+	}
+	if msg != "" {
+		errorf("can't write session state, keeping output in memory: %s", msg)
+	} else {
+		logf("session state written again")
+	}
+}
 
+// rebind recreates the session socket if it was removed from under the
+// daemon, as systemd-logind does with $XDG_RUNTIME_DIR after the last logout.
+func (s *Server) rebind() {
+	s.Lock.Lock()
+	l, sockPath := s.listener, s.sockPath
+	s.Lock.Unlock()
+	if l == nil || session.IsAbstract(sockPath) {
+		return
+	}
+	if _, err := os.Stat(sockPath); !os.IsNotExist(err) {
+		return
+	}
+	// Fails until the runtime directory is back, e.g. on the next login
+	if err := os.MkdirAll(filepath.Dir(sockPath), 0700); err != nil {
+		return
+	}
+	// Closing the old listener must not unlink the new socket at the same path
+	if ul, ok := l.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(false)
+	}
+	if err := s.listen(sockPath); err != nil {
+		return
+	}
+	_ = l.Close()
+	logf("recreated socket %s", sockPath)
+}
 
+// keepalive writes keepalive_input into the session whenever no client input
+// arrived for the keepalive interval, so that connections inside the session
+// (e.g. ssh) that drop when idle stay up. interval overrides the config; the
+// config is re-read every round so a reload can turn keepalive on or off.
+func (s *Server) keepalive(interval time.Duration, done <-chan struct{}) {
+	for {
+		every := interval
+		if every <= 0 {
+			every = time.Duration(config.Current().KeepaliveInterval * float64(time.Second))
+		}
+		wait := every
+		if every <= 0 {
+			wait = housekeepingInterval
+		} else if idle := time.Since(time.Unix(0, s.lastInput.Load())); idle < every {
+			wait = every - idle
+		}
 
-	defer func() {
+		select {
+		case <-done:
+			return
+		case <-time.After(wait):
+		}
 
-		s.Lock.Lock()
+		idle := time.Since(time.Unix(0, s.lastInput.Load()))
+		if every <= 0 || idle < every || config.Current().KeepaliveInput == "" {
+			continue
+		}
+		if _, err := s.ptmx.Write([]byte(config.Current().KeepaliveInput)); err != nil {
+			return
+		}
+		s.lastInput.Store(time.Now().UnixNano())
+	}
+}
 
-		delete(s.Clients, conn)
+// listen binds the session socket and starts accepting clients on it.
+func (s *Server) listen(sockPath string) error {
+	abstract := session.IsAbstract(sockPath)
+	if !abstract {
+		_ = os.Remove(sockPath)
+	}
+	l, err := net.Listen("unix", sockPath)
+	if err != nil {
+		return err
+	}
+	if !abstract {
+		_ = os.Chmod(sockPath, 0600)
+	}
 
-		if s.Master == conn {
+	s.serveListener(l, sockPath)
+	return nil
+}
 
-			s.Master = nil
+// serveListener makes l the session's listener, bound to sockPath, and
+// starts accepting clients on it.
+func (s *Server) serveListener(l net.Listener, sockPath string) {
+	s.Lock.Lock()
+	s.listener = l
+	s.sockPath = sockPath
+	s.Lock.Unlock()
 
+	// 5. Accept Clients
+	go func() {
+		defer recoverCrash(s.Name)
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				// The listener is closed on exit and when the socket moves
+				if !errors.Is(err, net.ErrClosed) {
+					errorf("accepting connections on %s failed: %v", l.Addr(), err)
+				}
+				return
+			}
+			debugf("connection accepted")
+			go s.handleClient(conn, s.ptmx)
 		}
+	}()
+}
 
-		s.Lock.Unlock()
+// broadcast queues output for all clients and keeps it for replay. It never
+// blocks on a client, so the PTY keeps being read while one of them is slow.
+func (s *Server) broadcast(data []byte) {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	s.outputSize += uint64(len(data))
+	if !s.quiet() {
+		s.scrollback.write(data)
+		if s.screen != nil {
+			_, _ = s.screen.Write(data)
+		}
+	}
+	if len(s.Clients) == 0 {
+		return
+	}
+	// The caller reuses data, the copy is shared by all queues
+	data = append([]byte(nil), data...)
+	for conn := range s.Clients {
+		if _, ok := s.flow.credit[conn]; ok {
+			s.flow.credit[conn] -= int64(len(data))
+		}
+		s.send(conn, protocol.TypeData, data)
+	}
+}
 
-		_ = conn.Close()
+// capture returns the text on the screen below up to history lines scrolled
+// off it, cut at the top to fit into one packet.
+func (s *Server) capture(history int) []byte {
+	s.Lock.Lock()
+	var lines []string
+	if s.screen != nil {
+		lines = s.screen.Lines(history)
+	}
+	s.Lock.Unlock()
+	start, size := len(lines), 0
+	for start > 0 && size+len(lines[start-1])+1 <= protocol.MaxPayloadSize {
+		start--
+		size += len(lines[start]) + 1
+	}
+	out := make([]byte, 0, size)
+	for _, line := range lines[start:] {
+		out = append(append(out, line...), '\n')
+	}
+	return out
+}
 
-	}()
+// render returns the screen as terminal output redrawing it, followed by
+// the output size it reflects, see protocol.CaptureRender. It returns
+// nothing while output bypasses the screen or if it doesn't fit a packet.
+func (s *Server) render() []byte {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	if s.screen == nil || s.quiet() {
+		return nil
+	}
+	out := binary.BigEndian.AppendUint64([]byte(s.screen.Render()), s.outputSize)
+	if len(out) > protocol.MaxPayloadSize {
+		return nil
+	}
+	return out
+}
 
+// signal delivers sig to the PTY's foreground process group (e.g. an editor
+// or database running in the shell) and to the shell itself.
+func (s *Server) signal(ptmx *os.File, sig syscall.Signal) {
+	if s.device {
+		// There is no process to signal; any signal ends a device session
+		logf("closing device on signal %d", sig)
+		_ = ptmx.Close()
+		return
+	}
+	if s.Cmd == nil || s.Cmd.Process == nil {
+		return
+	}
+	if ptmx != nil {
+		pgrp, err := unix.IoctlGetInt(int(ptmx.Fd()), unix.TIOCGPGRP)
+		if err == nil && pgrp > 0 && pgrp != s.Cmd.Process.Pid {
+			_ = syscall.Kill(-pgrp, sig)
+		}
+	}
+	_ = s.Cmd.Process.Signal(sig)
+}
 
+// expire terminates an ephemeral session after its last client detached.
+func (s *Server) expire(ptmx *os.File) {
+	s.Lock.Lock()
+	stillEmpty := len(s.Clients) == 0
+	s.Lock.Unlock()
+	if !stillEmpty {
+		return
+	}
+	logf("ephemeral session expired")
+	s.signal(ptmx, syscall.SIGHUP)
+	// Shells and programs that ignore SIGHUP are killed
+	time.AfterFunc(3*time.Second, func() { s.signal(ptmx, syscall.SIGKILL) })
+}
 
-	for {
+// broadcastExit tells all clients the shell's exit status before the daemon
+// shuts down and waits until their queues are flushed.
+func (s *Server) broadcastExit(code int) {
+	s.Lock.Lock()
+	payload := protocol.ExitPayload(code)
+	var flushed []chan struct{}
+	for conn := range s.Clients {
+		s.send(conn, protocol.TypeExit, payload)
+		if q, ok := s.queues[conn]; ok {
+			flushed = append(flushed, q.done)
+		}
+		s.removeClient(conn)
+	}
+	s.Lock.Unlock()
+	for _, done := range flushed {
+		<-done
+	}
+}
 
-		t, payload, err := protocol.ReadPacket(conn)
+// exitStatus converts a process state into a shell-style exit status.
+func exitStatus(state *os.ProcessState) int {
+	if state == nil {
+		return -1
+	}
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return state.ExitCode()
+}
 
-		if err != nil {
+// setClientSize records the terminal size reported by a client and resizes
+// the PTY according to the configured resize policy.
+func (s *Server) setClientSize(conn net.Conn, ptmx *os.File, ws pty.Winsize) {
+	s.Lock.Lock()
+	if s.sizes == nil {
+		s.sizes = make(map[net.Conn]pty.Winsize)
+	}
+	s.sizes[conn] = ws
+	id := s.attached[conn].Identity
+	s.Lock.Unlock()
+	debugf("client %s reports a size of %dx%d", id, ws.Cols, ws.Rows)
+	s.applySize(ptmx)
+}
 
-			return
+// applySize resizes the PTY to the size chosen by the resize policy.
+// It is re-evaluated whenever a client reports a size or disconnects.
+func (s *Server) applySize(ptmx *os.File) {
+	s.Lock.Lock()
+	ws, ok := s.targetSize()
+	s.Lock.Unlock()
+	if !ok || ptmx == nil {
+		return
+	}
+	if err := pty.Setsize(ptmx, &ws); err != nil {
+		errorf("resizing the terminal to %dx%d failed: %v", ws.Cols, ws.Rows, err)
+	} else {
+		debugf("terminal resized to %dx%d", ws.Cols, ws.Rows)
+	}
+	s.Lock.Lock()
+	if s.screen != nil {
+		s.screen.Resize(int(ws.Rows), int(ws.Cols))
+	}
+	s.Lock.Unlock()
+	if s.cast != nil {
+		s.cast.resize(ws.Cols, ws.Rows)
+	}
+	s.notifyViewers(ws)
+}
 
+// notifyViewers tells read-only clients the current PTY size so they can
+// warn when their own window is too small to display it correctly.
+func (s *Server) notifyViewers(ws pty.Winsize) {
+	payload := protocol.ResizePayload(ws.Rows, ws.Cols)
+	pixelPayload := protocol.SizePayload(ws.Rows, ws.Cols, ws.X, ws.Y)
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	for conn := range s.Clients {
+		if conn == s.Master {
+			continue
 		}
+		p := payload
+		if s.caps[conn]&protocol.CapPixels != 0 {
+			p = pixelPayload
+		}
+		s.send(conn, protocol.TypeResize, p)
+	}
+}
 
+// targetSize computes the PTY size from the attached clients. Must be called with Lock held.
+func (s *Server) targetSize() (pty.Winsize, bool) {
+	if config.Current().ResizePolicy == config.ResizeLatest {
+		ws, ok := s.sizes[s.Master]
+		return ws, ok && s.Master != nil
+	}
 
+	var target pty.Winsize
+	found := false
+	for _, ws := range s.sizes {
+		if ws.Rows == 0 || ws.Cols == 0 {
+			continue
+		}
+		if !found {
+			target = ws
+			found = true
+			continue
+		}
+		if config.Current().ResizePolicy == config.ResizeLargest {
+			target.Rows = max(target.Rows, ws.Rows)
+			target.Cols = max(target.Cols, ws.Cols)
+		} else {
+			target.Rows = min(target.Rows, ws.Rows)
+			target.Cols = min(target.Cols, ws.Cols)
+		}
+	}
+	if found {
+		s.scalePixels(&target)
+	}
+	return target, found
+}
 
-		// Only Master can send Data, Resize, or Signal
-
-		if isReadOnly {
+// scalePixels sets the pixel dimensions of a combined size from the cell size
+// of the Master, or of any client that reported pixels if the Master did not.
+// Must be called with Lock held.
+func (s *Server) scalePixels(target *pty.Winsize) {
+	ref, ok := s.sizes[s.Master]
+	if !ok || ref.X == 0 || ref.Y == 0 {
+		ok = false
+		for _, ws := range s.sizes {
+			if ws.X != 0 && ws.Y != 0 && ws.Rows != 0 && ws.Cols != 0 {
+				ref, ok = ws, true
+				break
+			}
+		}
+	}
+	if !ok {
+		target.X, target.Y = 0, 0
+		return
+	}
+	target.X = uint16(uint32(ref.X) * uint32(target.Cols) / uint32(ref.Cols))
+	target.Y = uint16(uint32(ref.Y) * uint32(target.Rows) / uint32(ref.Rows))
+}
 
-			continue
+// status reports the live state of the session
+func (s *Server) status() protocol.Status {
+	pid := os.Getpid()
+	if !s.device {
+		pid = s.Cmd.Process.Pid
+	}
+	st := protocol.Status{
+		PID:      pid,
+		Started:  s.started,
+		BytesIn:  s.bytesIn.Load(),
+		BytesOut: s.bytesOut.Load(),
+		Stalls:   s.stalls.Load(),
+	}
+	if s.logger != nil {
+		st.Rotations = s.logger.Rotations()
+		st.LogBytes = s.logger.Written()
+	}
+	if size, err := pty.GetsizeFull(s.ptmx); err == nil {
+		st.Rows, st.Cols = size.Rows, size.Cols
+	}
+	if !s.device {
+		st.Cwd, _ = session.ProcCwd(st.PID)
+	}
 
+	s.Lock.Lock()
+	st.Name = s.Name
+	st.Clients = len(s.Clients)
+	st.Connects = s.lastID
+	st.Master = s.Master != nil
+	st.Locked = s.locked != nil
+	st.Suspended = s.suspended
+	st.Degraded = s.degraded
+	st.Upgraded = s.upgraded
+	if s.screen != nil {
+		st.BracketedPaste = s.screen.BracketedPaste()
+	}
+	if s.pipe != nil {
+		st.Pipe = s.pipe.command
+	}
+	s.Lock.Unlock()
+	if st.Degraded == "" && s.logger != nil {
+		// A log failure since the last housekeeping round
+		if err := s.logger.Err(); err != nil {
+			st.Degraded = err.Error()
 		}
+	}
+	return st
+}
 
+// clientList returns the attached clients, oldest first
+func (s *Server) clientList() []protocol.ClientInfo {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	return s.listClients()
+}
 
+// listClients is clientList for callers that hold s.Lock
+func (s *Server) listClients() []protocol.ClientInfo {
+	list := make([]protocol.ClientInfo, 0, len(s.attached))
+	for conn, c := range s.attached {
+		c.Master = s.Master == conn
+		if size, ok := s.sizes[conn]; ok {
+			c.Rows, c.Cols = size.Rows, size.Cols
+		}
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Since.Before(list[j].Since) })
+	return list
+}
 
-		switch t {
+// announceJoin tells the clients attached before conn who just attached.
+// Must be called with Lock held.
+func (s *Server) announceJoin(conn net.Conn, client protocol.ClientInfo) {
+	payload, err := json.Marshal(client)
+	if err != nil {
+		return
+	}
+	for other := range s.attached {
+		if other != conn {
+			s.send(other, protocol.TypeJoin, payload)
+		}
+	}
+}
 
-		case protocol.TypeData:
+// kick detaches the client with the given ID, telling it who did so.
+func (s *Server) kick(id int, by string) error {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	for conn, c := range s.attached {
+		if c.ID == id {
+			s.detachClient(conn, by)
+			return nil
+		}
+	}
+	return fmt.Errorf("no client with ID %d", id)
+}
 
-			if _, err := ptmx.Write(payload); err != nil {
+// detach detaches the Master, or all clients, telling them who did so. A
+// client whose connection died unnoticed frees the Master slot this way
+// before its keepalive expires.
+func (s *Server) detach(all bool, by string) error {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	if !all {
+		if s.Master == nil {
+			return errors.New("no master attached")
+		}
+		s.detachClient(s.Master, by)
+		return nil
+	}
+	if len(s.attached) == 0 {
+		return errors.New("no clients attached")
+	}
+	for conn := range s.attached {
+		s.detachClient(conn, by)
+	}
+	return nil
+}
 
-				return
+// message passes a TypeMessage payload on to all attached clients
+func (s *Server) message(payload []byte) error {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	if len(s.attached) == 0 {
+		return errors.New("no clients attached")
+	}
+	for conn := range s.attached {
+		s.send(conn, protocol.TypeMessage, payload)
+	}
+	return nil
+}
 
-			}
+// mark records a mark named name in the log, which logs -from-mark starts at
+func (s *Server) mark(name string) error {
+	if name == "" || strings.ContainsAny(name, "\r\n") {
+		return invalidRequest("mark")
+	}
+	if s.logger == nil {
+		return errors.New("session output isn't logged")
+	}
+	if err := s.logger.Mark(name); err != nil {
+		return err
+	}
+	logf("mark %q set", name)
+	return nil
+}
 
-		case protocol.TypeResize:
+// shutdown ends the session on behalf of req.From: the attached clients
+// are told why, the log is synced, and the shell gets SIGTERM, then SIGKILL
+// once req.Timeout passed. The daemon exits with the shell as usual.
+func (s *Server) shutdown(req protocol.Shutdown) error {
+	if req.Timeout <= 0 {
+		return errors.New("shutdown needs a positive timeout")
+	}
+	logf("shutdown requested by %s: %s", req.From, req.Reason)
+	s.Lock.Lock()
+	s.audit(session.AuditEvent{Event: session.AuditShutdown, By: req.From, Detail: req.Reason})
+	notice, err := json.Marshal(protocol.Message{Text: config.Message("shutting_down", "Reason", req.Reason)})
+	if err == nil {
+		for conn := range s.attached {
+			s.send(conn, protocol.TypeMessage, notice)
+		}
+	}
+	s.Lock.Unlock()
+	if s.logger != nil {
+		if err := s.logger.Sync(); err != nil {
+			errorf("syncing the log before shutdown failed: %v", err)
+		}
+	}
+	_ = s.suspend(false)
+	s.signal(s.ptmx, syscall.SIGTERM)
+	time.AfterFunc(req.Timeout, func() { s.signal(s.ptmx, syscall.SIGKILL) })
+	return nil
+}
 
-			rows, cols := protocol.DecodeResizePayload(payload)
+// detachClient sends a TypeKick naming by to the client on conn and stops
+// serving it. Must be called with s.Lock held.
+func (s *Server) detachClient(conn net.Conn, by string) {
+	c := s.attached[conn]
+	logf("client %s kicked by %s", c.Identity, by)
+	s.auditClient(session.AuditKick, c, by)
+	s.send(conn, protocol.TypeKick, []byte(by))
+	s.dropClient(conn)
+}
 
-			ws := &pty.Winsize{Rows: rows, Cols: cols}
+// dropClient stops serving the client on conn and frees the Master slot if
+// it held it. The client's handler cleans up once the connection is closed.
+// Must be called with s.Lock held.
+func (s *Server) dropClient(conn net.Conn) {
+	s.removeClient(conn)
+	delete(s.attached, conn)
+	delete(s.pings, conn)
+	if s.Master == conn {
+		s.Master = nil
+	}
+	if s.locked == conn {
+		s.locked = nil
+	}
+}
 
-			_ = pty.Setsize(ptmx, ws)
+// grant grants or revokes write access of the read-only client with the
+// given ID on behalf of by, see setWritable.
+func (s *Server) grant(id int, writable bool, by string) error {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	if err := s.lockedOut(nil); writable && err != nil {
+		return err
+	}
+	for conn, c := range s.attached {
+		if c.ID != id {
+			continue
+		}
+		if !c.ReadOnly {
+			return fmt.Errorf("client %d isn't read-only", id)
+		}
+		s.setWritable(conn, writable, by)
+		return nil
+	}
+	return fmt.Errorf("no client with ID %d", id)
+}
 
-				case protocol.TypeSignal:
+// lockedOut returns why conn may not write to the session while another
+// client holds its exclusive lock, or nil. This applies to attaches, typing
+// and control input alike; conn is nil for grants, which are refused. Must be
+// called with s.Lock held.
+func (s *Server) lockedOut(conn net.Conn) error {
+	if s.locked == nil || s.locked == conn {
+		return nil
+	}
+	return &protocol.Error{Code: protocol.ErrorLocked, Message: config.Message("session_locked")}
+}
 
-					if len(payload) > 0 {
+// toggleWrite handles a TypeGrant from the Master: write access is revoked
+// from all viewers that have it, or else granted to the newest viewer.
+// Must be called with s.Lock held.
+func (s *Server) toggleWrite() {
+	var newest net.Conn
+	revoked := false
+	by := s.attached[s.Master].Identity.String()
+	for conn, c := range s.attached {
+		if c.Writable {
+			s.setWritable(conn, false, by)
+			revoked = true
+		} else if c.ReadOnly && (newest == nil || c.ID > s.attached[newest].ID) {
+			newest = conn
+		}
+	}
+	switch {
+	case revoked:
+	case newest != nil && s.locked != nil:
+		// Not even the lock holder shares an exclusive session
+		s.sendError(s.Master, s.lockedOut(nil))
+	case newest != nil:
+		s.setWritable(newest, true, by)
+	default:
+		// Tell the Master there was nobody to grant access to
+		s.send(s.Master, protocol.TypeGrant, []byte{0})
+	}
+}
 
-						sig := syscall.Signal(payload[0])
+// setWritable changes whether the read-only client on conn may type, and
+// tells it and the Master. Must be called with s.Lock held.
+func (s *Server) setWritable(conn net.Conn, writable bool, by string) {
+	c := s.attached[conn]
+	c.Writable = writable
+	s.attached[conn] = c
+	flag := byte(0)
+	event := session.AuditRevoke
+	if writable {
+		flag = 1
+		event = session.AuditGrant
+	}
+	logf("write access of %s set to %v", c.Identity, writable)
+	s.auditClient(event, c, by)
+	s.send(conn, protocol.TypeGrant, []byte{flag})
+	if s.Master != nil {
+		s.send(s.Master, protocol.TypeGrant, append([]byte{flag}, c.Identity.String()...))
+	}
+}
 
-						if s.Cmd != nil && s.Cmd.Process != nil {
+// errorPayload encodes err as a TypeError payload, with the code of its kind
+func errorPayload(err error) []byte {
+	var protoErr *protocol.Error
+	code := protocol.ErrorFailed
+	switch {
+	case errors.As(err, &protoErr):
+		code = protoErr.Code
+	case errors.Is(err, protocol.ErrPayloadTooLarge):
+		code = protocol.ErrorTooLarge
+	case errors.Is(err, session.ErrInvalidName):
+		code = protocol.ErrorInvalidName
+	case errors.Is(err, session.ErrSessionExists):
+		code = protocol.ErrorSessionExists
+	case errors.Is(err, session.ErrNotOwner):
+		code = protocol.ErrorAuth
+	case errors.Is(err, session.ErrStateReadOnly):
+		code = protocol.ErrorStateReadOnly
+	}
+	return protocol.ErrorPayload(code, err.Error())
+}
 
-							_ = s.Cmd.Process.Signal(sig)
+// sendError tells the attached client on conn about err with TypeError, if
+// it announced CapErrors. Must be called with s.Lock held.
+func (s *Server) sendError(conn net.Conn, err error) {
+	if s.caps[conn]&protocol.CapErrors != 0 {
+		s.send(conn, protocol.TypeError, errorPayload(err))
+	}
+}
 
-							}
+// invalidRequest is the error for a control request with a malformed payload
+func invalidRequest(what string) error {
+	return &protocol.Error{Code: protocol.ErrorProtocol, Message: "invalid " + what + " request"}
+}
 
-						}
+// handleControl serves a control connection. Control connections manage the
+// session without attaching to it: they receive no output and never become
+// Master. Clients that sent ControlErrors get failures as TypeError.
+func (s *Server) handleControl(conn net.Conn, typedErrors bool) {
+	defer func() { _ = conn.Close() }()
+	// reply answers request t with an empty payload on success, and with
+	// the error message otherwise
+	reply := func(t protocol.Type, err error) error {
+		switch {
+		case err == nil:
+			return protocol.WritePacket(conn, t, nil)
+		case typedErrors:
+			return protocol.WritePacket(conn, protocol.TypeError, errorPayload(err))
+		}
+		return protocol.WritePacket(conn, t, []byte(err.Error()))
+	}
+	for {
+		t, payload, err := protocol.ReadPacket(conn)
+		if err != nil {
+			if typedErrors && errors.Is(err, protocol.ErrPayloadTooLarge) {
+				_ = protocol.WritePacket(conn, protocol.TypeError, errorPayload(err))
+			}
+			return
+		}
+		switch t {
+		case protocol.TypeRename:
+			if err := reply(protocol.TypeRename, s.rename(string(payload))); err != nil {
+				return
+			}
+		case protocol.TypeQuery:
+			if err := protocol.WritePacket(conn, protocol.TypeInfo, protocol.StatusPayload(s.status())); err != nil {
+				return
+			}
+		case protocol.TypeReload:
+			if err := reply(protocol.TypeReload, s.reloadConfig()); err != nil {
+				return
+			}
+		case protocol.TypeSuspend:
+			if err := reply(protocol.TypeSuspend, s.suspend(len(payload) > 0 && payload[0] == 1)); err != nil {
+				return
+			}
+		case protocol.TypeMeta:
+			if err := reply(protocol.TypeMeta, s.changeMeta(payload)); err != nil {
+				return
+			}
+		case protocol.TypePipe:
+			var err error
+			if len(payload) == 0 {
+				err = s.stopPipe()
+			} else {
+				err = s.startPipe(string(payload))
+			}
+			if err := reply(protocol.TypePipe, err); err != nil {
+				return
+			}
+		case protocol.TypeCapture:
+			lines := 0
+			if len(payload) >= 4 {
+				lines = int(binary.BigEndian.Uint32(payload))
+			}
+			var out []byte
+			if len(payload) >= 5 && payload[4]&protocol.CaptureRender != 0 {
+				out = s.render()
+			} else {
+				out = s.capture(lines)
+			}
+			if err := protocol.WritePacket(conn, protocol.TypeCapture, out); err != nil {
+				return
+			}
+		case protocol.TypeInput:
+			if err := reply(protocol.TypeInput, s.controlInput(conn, payload)); err != nil {
+				return
+			}
+		case protocol.TypeClients:
+			data, _ := json.Marshal(s.clientList())
+			if err := protocol.WritePacket(conn, protocol.TypeClients, data); err != nil {
+				return
+			}
+		case protocol.TypeKick:
+			err := invalidRequest("kick")
+			if id, by, ok := protocol.DecodeKickPayload(payload); ok {
+				err = s.kick(id, sender(conn, by))
+			}
+			if err := reply(protocol.TypeKick, err); err != nil {
+				return
+			}
+		case protocol.TypeDetach:
+			err := invalidRequest("detach")
+			if len(payload) > 0 {
+				err = s.detach(payload[0] == 1, sender(conn, string(payload[1:])))
+			}
+			if err := reply(protocol.TypeDetach, err); err != nil {
+				return
+			}
+		case protocol.TypeShutdown:
+			var req protocol.Shutdown
+			err := invalidRequest("shutdown")
+			if json.Unmarshal(payload, &req) == nil {
+				req.From = sender(conn, req.From)
+				err = s.shutdown(req)
+			}
+			if err := reply(protocol.TypeShutdown, err); err != nil {
+				return
+			}
+		case protocol.TypeUpgrade:
+			var req protocol.Upgrade
+			err := invalidRequest("upgrade")
+			if json.Unmarshal(payload, &req) == nil {
+				req.From = sender(conn, req.From)
+				// Only returns if the new daemon didn't take over
+				err = s.upgrade(req)
+			}
+			if err := reply(protocol.TypeUpgrade, err); err != nil {
+				return
+			}
+		case protocol.TypeMessage:
+			err := invalidRequest("message")
+			if json.Unmarshal(payload, &protocol.Message{}) == nil {
+				err = s.message(payload)
+			}
+			if err := reply(protocol.TypeMessage, err); err != nil {
+				return
+			}
+		case protocol.TypeMark:
+			if err := reply(protocol.TypeMark, s.mark(string(payload))); err != nil {
+				return
+			}
+		case protocol.TypeGrant:
+			err := invalidRequest("grant")
+			if id, writable, by, ok := protocol.DecodeGrantPayload(payload); ok {
+				err = s.grant(id, writable, sender(conn, by))
+			}
+			if err := reply(protocol.TypeGrant, err); err != nil {
+				return
+			}
+		case protocol.TypePrune:
+			if err := protocol.WritePacket(conn, protocol.TypePrune, nil); err != nil {
+				return
+			}
+			var req protocol.Prune
+			var res protocol.PruneResult
+			if err := json.Unmarshal(payload, &req); err != nil {
+				res.Error = "invalid prune request"
+			} else if s.logger == nil {
+				res.Error = "session has no log files"
+			} else if res.Removed, err = s.logger.Prune(req.Keep, req.Before); err != nil {
+				res.Error = err.Error()
+			}
+			if res.Removed > 0 {
+				logf("pruned %d bytes of log", res.Removed)
+			}
+			data, _ := json.Marshal(res)
+			if err := protocol.WritePacket(conn, protocol.TypePrune, data); err != nil {
+				return
+			}
+		case protocol.TypeSignal:
+			// Unlike an attach, this works while the session is locked
+			if len(payload) > 0 {
+				sig := syscall.Signal(payload[0])
+				logf("forwarding signal %d", sig)
+				s.Lock.Lock()
+				s.audit(session.AuditEvent{Event: session.AuditSignal, By: sender(conn, string(payload[1:])), Detail: unix.SignalName(sig)})
+				s.Lock.Unlock()
+				if sig != syscall.SIGKILL {
+					_ = s.suspend(false)
+				}
+				s.signal(s.ptmx, sig)
+			}
+			if err := protocol.WritePacket(conn, protocol.TypeSignal, nil); err != nil {
+				return
+			}
+		case protocol.TypeRegister:
+			if err := reply(protocol.TypeRegister, s.register()); err != nil {
+				return
+			}
+		case protocol.TypeSecret:
+			err := invalidRequest("secret")
+			if len(payload) > 0 {
+				err = s.injectSecret(payload[1:], payload[0] == 1)
+			}
+			clear(payload)
+			if err := reply(protocol.TypeSecret, err); err != nil {
+				return
+			}
+		default:
+			// Older clients wait for a reply to requests they know, newer
+			// ones learn that this daemon predates theirs
+			if typedErrors {
+				msg := fmt.Sprintf("unknown request %#x", byte(t))
+				_ = protocol.WritePacket(conn, protocol.TypeError, protocol.ErrorPayload(protocol.ErrorUnsupported, msg))
+			}
+		}
+	}
+}
 
-				case protocol.TypeEnv:
+func (s *Server) handleClient(conn net.Conn, ptmx *os.File) {
+	defer recoverCrash(s.Name)
 
-					// payload contains key=value
+	// First packet MUST be TypeMode
+	// The client can't have announced that it understands TypeError yet
+	t, payload, err := protocol.ReadPacket(conn)
+	if err != nil || t != protocol.TypeMode || len(payload) < 1 {
+		if err == nil {
+			err = errors.New("connection must start with a mode packet")
+		}
+		if !errors.Is(err, io.EOF) {
+			logf("handshake failed: %v", err)
+		}
+		_ = conn.Close()
+		return
+	}
+
+	if payload[0] == protocol.ModeControl {
+		typedErrors := len(payload) > 1 && payload[1]&protocol.ControlErrors != 0
+		if err := authorize(conn); err != nil {
+			logf("control connection refused: %v", err)
+			if typedErrors {
+				_ = protocol.WritePacket(conn, protocol.TypeError, errorPayload(err))
+			}
+			_ = conn.Close()
+			return
+		}
+		s.handleControl(conn, typedErrors)
+		return
+	}
 
-					if bytes.HasPrefix(payload, []byte("SSH_AUTH_SOCK=")) {
+	mode, caps, tail := protocol.DecodeModePayload(payload)
+	if err := authorize(conn); err != nil {
+		logf("attach refused: %v", err)
+		if caps&protocol.CapErrors != 0 {
+			_ = protocol.WritePacket(conn, protocol.TypeError, errorPayload(err))
+		} else {
+			_ = protocol.WritePacket(conn, protocol.TypeRefused, []byte(err.Error()))
+		}
+		_ = conn.Close()
+		return
+	}
+	isReadOnly := mode == protocol.ModeReadOnly
+	reported, _ := protocol.DecodeModeIdentity(payload)
+	id := identify(conn, reported)
 
-						newSock := string(payload[len("SSH_AUTH_SOCK="):])
+	s.Lock.Lock()
+	// A Master reconnecting replaces its lost connection, lock and all
+	rejoin := !isReadOnly && s.Master != nil && id.PID != 0 && s.attached[s.Master].Identity == id
+	if err := s.lockedOut(conn); !isReadOnly && !rejoin && err != nil {
+		s.Lock.Unlock()
+		logf("master attach of %s refused, session is locked", id)
+		_ = protocol.WritePacket(conn, protocol.TypeRefused, []byte(err.Error()))
+		_ = conn.Close()
+		return
+	}
+	if !isReadOnly {
+		// New Master client: kick existing Master
+		if s.Master != nil {
+			// The kicked client learns who took over
+			logf("master %s replaced by %s", s.attached[s.Master].Identity, id)
+			s.auditClient(session.AuditKick, s.attached[s.Master], id.String())
+			s.send(s.Master, protocol.TypeKick, []byte(id.String()))
+			s.removeClient(s.Master)
+			delete(s.attached, s.Master)
+		}
+		s.Master = conn
+		s.adoptTerm(id)
+		if rejoin && s.locked != nil || caps&protocol.CapExclusive != 0 || s.exclusive {
+			s.locked = conn
+		}
+	}
+	s.addClient(conn)
+	if s.attached == nil {
+		s.attached = make(map[net.Conn]protocol.ClientInfo)
+	}
+	s.lastID++
+	client := protocol.ClientInfo{ID: s.lastID, Identity: id, ReadOnly: isReadOnly, Since: time.Now()}
+	s.attached[conn] = client
+	s.auditClient(session.AuditAttach, client, "")
+	s.announceJoin(conn, client)
+	if len(payload) > 1 {
+		if s.caps == nil {
+			s.caps = make(map[net.Conn]protocol.Caps)
+		}
+		s.caps[conn] = caps
+	}
+	if s.lingerTimer != nil {
+		// A client came back before the ephemeral session expired
+		s.lingerTimer.Stop()
+		s.lingerTimer = nil
+	}
+	limit := protocol.MaxPayloadSize
+	if caps&protocol.CapLargePayload != 0 {
+		limit = protocol.LargePayloadSize
+		s.send(conn, protocol.TypeLimit, protocol.PayloadLimitPayload(limit))
+	}
+	if caps&protocol.CapFlow != 0 {
+		s.addFlowClient(conn)
+	}
+	if caps&protocol.CapResume != 0 {
+		s.send(conn, protocol.TypeResume, binary.BigEndian.AppendUint64(nil, s.outputSize))
+	}
+	if caps&protocol.CapPeers != 0 {
+		if data, err := json.Marshal(s.listClients()); err == nil {
+			s.send(conn, protocol.TypeClients, data)
+		}
+	}
+	if caps&protocol.CapReplay != 0 {
+		// History is queued under the same lock as live output, so the client
+		// sees every byte exactly once
+		history := s.scrollback.snapshot(tail)
+		if s.scrollback.missing(tail) {
+			// Say so where the replay starts instead of cutting it silently
+			notice := config.Message("replay_trimmed", "Name", s.Name, "Logged", s.logger != nil)
+			history = append([]byte("\x1b[7m"+notice+"\x1b[0m\r\n"), history...)
+		}
+		for len(history) > 0 {
+			n := min(len(history), limit)
+			s.send(conn, protocol.TypeReplay, history[:n])
+			history = history[n:]
+		}
+		s.send(conn, protocol.TypeReplay, nil)
+	}
+	s.Lock.Unlock()
+	logf("client %s connected (read-only: %v)", id, isReadOnly)
 
-						sshSymlink, _ := session.GetSSHSockPath(s.Name)
+	defer func() {
+		s.Lock.Lock()
+		s.removeClient(conn)
+		delete(s.sizes, conn)
+		delete(s.caps, conn)
+		delete(s.pings, conn)
+		delete(s.attached, conn)
+		if s.Master == conn {
+			s.Master = nil
+		}
+		if s.locked == conn {
+			s.locked = nil
+		}
+		s.auditClient(session.AuditDetach, client, "")
+		var rejected []byte
+		if s.guard.owner == conn {
+			// Nobody is left to confirm the held input
+			rejected = s.resolveGuard(false)
+		}
+		if s.ephemeral && len(s.Clients) == 0 && s.lingerTimer == nil {
+			s.lingerTimer = time.AfterFunc(s.linger, func() { s.expire(ptmx) })
+		}
+		s.Lock.Unlock()
+		_, _ = ptmx.Write(rejected)
+		_ = conn.Close()
+		logf("client %s disconnected (read-only: %v)", id, isReadOnly)
+		// Remaining clients may allow a different size now
+		s.applySize(ptmx)
+	}()
 
-						_ = os.Remove(sshSymlink)
+	// Payloads are only used within an iteration, so one buffer serves all packets
+	packets := protocol.NewReader(conn)
+	packets.SetLimit(limit)
+	rejected := false // Input was rejected since the client last had write access
+	for {
+		t, payload, err := packets.ReadPacket()
+		if err != nil {
+			if errors.Is(err, protocol.ErrPayloadTooLarge) {
+				logf("client %s: %v", id, err)
+				s.Lock.Lock()
+				s.sendError(conn, err)
+				s.Lock.Unlock()
+			}
+			return
+		}
 
-						_ = os.Symlink(newSock, sshSymlink)
+		if t == protocol.TypePing {
+			s.Lock.Lock()
+			delete(s.pings, conn)
+			s.Lock.Unlock()
+			continue
+		}
+		if t == protocol.TypeAck {
+			s.ack(conn, payload)
+			continue
+		}
 
-					}
+		// Every client reports its size so the resize policy can account for it
+		if t == protocol.TypeResize {
+			rows, cols, xpixel, ypixel := protocol.DecodeSizePayload(payload)
+			s.setClientSize(conn, ptmx, pty.Winsize{Rows: rows, Cols: cols, X: xpixel, Y: ypixel})
+			continue
+		}
 
+		// Only Master can send Data or Signal. A kicked Master is ignored
+		// while its queue is flushed. Viewers granted write access may type
+		// unless the Master holds an exclusive lock.
+		s.Lock.Lock()
+		isMaster := s.Master == conn
+		writable := s.attached[conn].Writable
+		lockErr := s.lockedOut(conn)
+		s.Lock.Unlock()
+		if !isMaster && !(writable && lockErr == nil && (t == protocol.TypeData || t == protocol.TypeConfirm)) {
+			// A viewer typing learns why once, until it may type again
+			if t == protocol.TypeData && !rejected {
+				rejected = true
+				err := error(&protocol.Error{Code: protocol.ErrorNoWriteAccess, Message: "read-only client, input ignored"})
+				if writable {
+					err = lockErr
 				}
-
+				s.Lock.Lock()
+				s.sendError(conn, err)
+				s.Lock.Unlock()
 			}
+			continue
+		}
+		rejected = false
 
-		}
\ No newline at end of file
+		switch t {
+		case protocol.TypeData:
+			s.Lock.Lock()
+			payload = s.guardInput(conn, ptmx, payload)
+			s.Lock.Unlock()
+			if _, err := ptmx.Write(payload); err != nil {
+				return
+			}
+			s.bytesIn.Add(uint64(len(payload)))
+			s.lastInput.Store(time.Now().UnixNano())
+		case protocol.TypeConfirm:
+			s.Lock.Lock()
+			out := s.confirmGuard(conn, payload)
+			s.Lock.Unlock()
+			if _, err := ptmx.Write(out); err != nil {
+				return
+			}
+		case protocol.TypeSignal:
+			if len(payload) > 0 {
+				sig := syscall.Signal(payload[0])
+				logf("forwarding signal %d", sig)
+				s.Lock.Lock()
+				s.audit(session.AuditEvent{Event: session.AuditSignal, By: s.attached[conn].Identity.String(), Detail: unix.SignalName(sig)})
+				s.Lock.Unlock()
+				if sig != syscall.SIGKILL {
+					// Stopped processes would only see the signal once continued
+					_ = s.suspend(false)
+				}
+				s.signal(ptmx, sig)
+			}
+		case protocol.TypeGrant:
+			s.Lock.Lock()
+			s.toggleWrite()
+			s.Lock.Unlock()
+		case protocol.TypeEnv:
+			// payload contains key=value
+			if key, value, ok := strings.Cut(string(payload), "="); ok && isForwardedEnv(key) {
+				s.env.set(key, value)
+				links := s.env.linkPaths()
+				s.updateInfo(func(info *session.Info) { info.EnvLinks = links })
+			}
+		}
+	}
+}
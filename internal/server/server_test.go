@@ -1,13 +1,26 @@
 package server
 
 import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
 	"net"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/creack/pty"
+	"golang.org/x/term"
+	"persishtent/internal/ansi"
+	"persishtent/internal/config"
 	"persishtent/internal/protocol"
+	"persishtent/internal/session"
 )
 
 func TestServer_Broadcast(t *testing.T) {
@@ -24,8 +37,10 @@ func TestServer_Broadcast(t *testing.T) {
 		_ = s2.Close()
 	}()
 
-	srv.Clients[s1] = struct{}{}
-	srv.Clients[s2] = struct{}{}
+	srv.Lock.Lock()
+	srv.addClient(s1)
+	srv.addClient(s2)
+	srv.Lock.Unlock()
 
 	data := []byte("hello")
 	
@@ -62,6 +77,105 @@ func TestServer_Broadcast(t *testing.T) {
 	}
 }
 
+func TestServer_SlowClient(t *testing.T) {
+	srv := &Server{Clients: make(map[net.Conn]struct{})}
+	slow, slowPeer := net.Pipe()
+	fast, fastPeer := net.Pipe()
+	defer func() {
+		_ = slowPeer.Close()
+		_ = fastPeer.Close()
+	}()
+	srv.Lock.Lock()
+	srv.addClient(slow)
+	srv.addClient(fast)
+	srv.Lock.Unlock()
+
+	// slowPeer never reads, which must not hold up the output for fastPeer
+	_ = fastPeer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < clientQueueSize+100; i++ {
+		srv.broadcast([]byte("output"))
+		if _, _, err := protocol.ReadPacket(fastPeer); err != nil {
+			t.Fatalf("Fast client stopped receiving after %d packets: %v", i, err)
+		}
+	}
+
+	// The slow client fell too far behind and was disconnected
+	_ = slowPeer.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		if _, _, err := protocol.ReadPacket(slowPeer); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Slow client should be disconnected, got %v", err)
+		}
+	}
+}
+
+func TestServer_SlowClientPolicy(t *testing.T) {
+	defer config.Use(*config.Current())
+	stalled := func() (*Server, *outQueue, net.Conn) {
+		srv := &Server{Clients: make(map[net.Conn]struct{})}
+		conn, peer := net.Pipe()
+		t.Cleanup(func() { _ = peer.Close() })
+		srv.Lock.Lock()
+		srv.addClient(conn)
+		q := srv.queues[conn]
+		srv.Lock.Unlock()
+		return srv, q, peer
+	}
+	closed := func(q *outQueue) bool {
+		select {
+		case <-q.done:
+			return true
+		case <-time.After(2 * time.Second):
+			return false
+		}
+	}
+
+	// A frozen connection misses the write deadline
+	config.Update(func(c *config.Config) { c.ClientWriteTimeout = 0.1 })
+	srv, q, _ := stalled()
+	srv.broadcast([]byte("output"))
+	if !closed(q) {
+		t.Error("Client should be disconnected after the write timeout")
+	}
+
+	// skip drops output while the queue is full
+	config.Update(func(c *config.Config) {
+		c.ClientWriteTimeout = 0
+		c.SlowClientPolicy = config.SlowClientSkip
+	})
+	srv, q, peer := stalled()
+	for i := 0; i < clientQueueSize+10; i++ {
+		srv.broadcast([]byte("output"))
+	}
+	srv.Lock.Lock()
+	if q.dropped || !q.skipping {
+		t.Errorf("Expected output to be skipped, dropped: %v, skipping: %v", q.dropped, q.skipping)
+	}
+	srv.Lock.Unlock()
+	_ = peer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := protocol.ReadPacket(peer); err != nil {
+		t.Errorf("Skipping client should stay connected: %v", err)
+	}
+
+	// block waits for the client until its write times out
+	config.Update(func(c *config.Config) {
+		c.ClientWriteTimeout = 0.2
+		c.SlowClientPolicy = config.SlowClientBlock
+	})
+	srv, q, _ = stalled()
+	start := time.Now()
+	for i := 0; i < clientQueueSize+2; i++ {
+		srv.broadcast([]byte("output"))
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("Broadcast should block for the slow client, returned after %v", elapsed)
+	}
+	if !closed(q) {
+		t.Error("Blocking client should be disconnected after the write timeout")
+	}
+}
+
 func TestServer_HandleClient_MasterKick(t *testing.T) {
 	pr, pw, _ := os.Pipe()
 	defer func() {
@@ -80,7 +194,11 @@ func TestServer_HandleClient_MasterKick(t *testing.T) {
 		_ = protocol.WritePacket(c1, protocol.TypeMode, []byte{protocol.ModeMaster})
 	}()
 	
-	go srv.handleClient(s1, pw)
+	done1 := make(chan struct{})
+	go func() {
+		srv.handleClient(s1, pw)
+		close(done1)
+	}()
 
 	time.Sleep(100 * time.Millisecond)
 
@@ -108,7 +226,11 @@ func TestServer_HandleClient_MasterKick(t *testing.T) {
 		_ = c1.Close()
 	}()
 
-	go srv.handleClient(s2, pw)
+	done2 := make(chan struct{})
+	go func() {
+		srv.handleClient(s2, pw)
+		close(done2)
+	}()
 
 	time.Sleep(100 * time.Millisecond)
 
@@ -127,6 +249,305 @@ func TestServer_HandleClient_MasterKick(t *testing.T) {
 	case <-time.After(1 * time.Second):
 		t.Error("Timed out waiting for kick on s1")
 	}
+
+	// Both clients are cleaned up before the next test touches the config
+	_ = c2.Close()
+	<-done1
+	<-done2
+}
+
+func TestServer_HandleClient_Exclusive(t *testing.T) {
+	pr, pw, _ := os.Pipe()
+	defer func() {
+		_ = pr.Close()
+		_ = pw.Close()
+	}()
+
+	srv := &Server{
+		Clients: make(map[net.Conn]struct{}),
+	}
+
+	// The first Master takes an exclusive lock
+	s1, c1 := net.Pipe()
+	go func() {
+		_ = protocol.WritePacket(c1, protocol.TypeMode, protocol.ModePayload(protocol.ModeMaster, protocol.CapExclusive, 0))
+	}()
+	done1 := make(chan struct{})
+	go func() {
+		srv.handleClient(s1, pw)
+		close(done1)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// A second Master is refused instead of kicking it
+	s2, c2 := net.Pipe()
+	defer func() { _ = c2.Close() }()
+	go srv.handleClient(s2, pw)
+	_ = protocol.WritePacket(c2, protocol.TypeMode, []byte{protocol.ModeMaster})
+	_ = c2.SetReadDeadline(time.Now().Add(time.Second))
+	typ, payload, err := protocol.ReadPacket(c2)
+	if err != nil || typ != protocol.TypeRefused || len(payload) == 0 {
+		t.Fatalf("Expected TypeRefused with a reason, got %d %q (%v)", typ, payload, err)
+	}
+	if _, _, err := protocol.ReadPacket(c2); err == nil {
+		t.Error("Expected the refused connection to be closed")
+	}
+
+	srv.Lock.Lock()
+	if srv.Master != s1 || srv.locked != s1 {
+		t.Error("s1 should still be the locking Master")
+	}
+	srv.Lock.Unlock()
+
+	// Grants and control input are refused the same way, with the message
+	defer config.Use(*config.Current())
+	config.Update(func(c *config.Config) { c.Messages = map[string]string{"session_locked": "ask ops"} })
+	if err := srv.grant(1, true, "test"); err == nil || err.Error() != "ask ops" {
+		t.Errorf("grant while locked = %v", err)
+	}
+	if err := srv.controlInput(nil, []byte("x")); err == nil || err.Error() != "ask ops" {
+		t.Errorf("controlInput while locked = %v", err)
+	}
+
+	// Detaching releases the lock
+	_ = c1.Close()
+	<-done1
+	srv.Lock.Lock()
+	defer srv.Lock.Unlock()
+	if srv.locked != nil || srv.Master != nil {
+		t.Error("Expected the lock to be released on detach")
+	}
+}
+
+func TestServer_HandleClient_Rejoin(t *testing.T) {
+	pr, pw, _ := os.Pipe()
+	defer func() {
+		_ = pr.Close()
+		_ = pw.Close()
+	}()
+	srv := &Server{Clients: make(map[net.Conn]struct{})}
+	connect := func(pid int) (net.Conn, net.Conn) {
+		s, c := net.Pipe()
+		id := protocol.Identity{User: "alice", Host: "box", PID: pid}
+		go func() {
+			_ = protocol.WritePacket(c, protocol.TypeMode, protocol.AppendIdentity(protocol.ModePayload(protocol.ModeMaster, protocol.CapIdentity|protocol.CapExclusive, 0), id))
+		}()
+		go srv.handleClient(s, pw)
+		return s, c
+	}
+
+	s1, c1 := connect(7)
+	defer func() { _ = c1.Close() }()
+	go func() { _, _ = io.Copy(io.Discard, c1) }()
+	time.Sleep(100 * time.Millisecond)
+
+	// The same client reconnecting replaces its lost connection and lock
+	s2, c2 := connect(7)
+	defer func() { _ = c2.Close() }()
+	go func() { _, _ = io.Copy(io.Discard, c2) }()
+	time.Sleep(100 * time.Millisecond)
+	srv.Lock.Lock()
+	if srv.Master != s2 || srv.locked != s2 {
+		t.Error("Expected the reconnect to take over Master and the lock")
+	}
+	if _, ok := srv.attached[s1]; ok {
+		t.Error("Expected the stale connection to be dropped")
+	}
+	srv.Lock.Unlock()
+
+	// Anyone else is still refused
+	_, c3 := connect(8)
+	defer func() { _ = c3.Close() }()
+	_ = c3.SetReadDeadline(time.Now().Add(time.Second))
+	if typ, _, err := protocol.ReadPacket(c3); err != nil || typ != protocol.TypeRefused {
+		t.Errorf("Expected TypeRefused for another client, got %d (%v)", typ, err)
+	}
+}
+
+func TestServer_Clients(t *testing.T) {
+	pr, pw, _ := os.Pipe()
+	defer func() {
+		_ = pr.Close()
+		_ = pw.Close()
+	}()
+	srv := &Server{Clients: make(map[net.Conn]struct{})}
+	connect := func(mode byte, user string) (net.Conn, chan struct{}) {
+		s, c := net.Pipe()
+		id := protocol.Identity{User: user, Host: "box", PID: 7}
+		go func() {
+			_ = protocol.WritePacket(c, protocol.TypeMode, protocol.AppendIdentity(protocol.ModePayload(mode, protocol.CapIdentity, 0), id))
+		}()
+		done := make(chan struct{})
+		go func() {
+			srv.handleClient(s, pw)
+			close(done)
+		}()
+		time.Sleep(100 * time.Millisecond)
+		return c, done
+	}
+
+	alice, done1 := connect(protocol.ModeMaster, "alice")
+	viewer, done2 := connect(protocol.ModeReadOnly, "carol")
+	kick := make(chan []byte, 1)
+	var joined []protocol.ClientInfo
+	go func() {
+		_ = alice.SetReadDeadline(time.Now().Add(time.Second))
+		for {
+			typ, payload, _ := protocol.ReadPacket(alice)
+			if typ != protocol.TypeJoin {
+				kick <- payload
+				break
+			}
+			var ci protocol.ClientInfo
+			_ = json.Unmarshal(payload, &ci)
+			joined = append(joined, ci)
+		}
+		_ = alice.Close()
+	}()
+	bob, done3 := connect(protocol.ModeMaster, "bob")
+
+	// The kicked Master learns who took over
+	if payload := <-kick; string(payload) != "bob@box (pid 7)" {
+		t.Errorf("Kick payload %q", payload)
+	}
+	// Attached clients are told about those attaching after them, but a
+	// replaced Master is only told it was kicked
+	if len(joined) != 1 || joined[0].User != "carol" || !joined[0].ReadOnly {
+		t.Errorf("Unexpected join notices %+v", joined)
+	}
+	list := srv.clientList()
+	if len(list) != 2 || list[0].User != "carol" || !list[0].ReadOnly || list[1].User != "bob" || !list[1].Master {
+		t.Errorf("Unexpected clients %+v", list)
+	}
+
+	// A single client can be kicked by its ID
+	go func() {
+		_ = viewer.SetReadDeadline(time.Now().Add(time.Second))
+		for {
+			typ, payload, err := protocol.ReadPacket(viewer)
+			if err != nil || typ == protocol.TypeKick {
+				kick <- payload
+				return
+			}
+		}
+	}()
+	if err := srv.kick(list[0].ID, "dave@box (pid 9)"); err != nil {
+		t.Fatal(err)
+	}
+	if payload := <-kick; string(payload) != "dave@box (pid 9)" {
+		t.Errorf("Kick payload %q", payload)
+	}
+	if list := srv.clientList(); len(list) != 1 || list[0].User != "bob" {
+		t.Errorf("Unexpected clients after kick %+v", list)
+	}
+	if err := srv.kick(list[0].ID, "dave"); err == nil {
+		t.Error("Expected an error kicking a client that is gone")
+	}
+
+	// Clients attaching with CapPeers get the list first
+	peer, c := net.Pipe()
+	done4 := make(chan struct{})
+	go func() {
+		srv.handleClient(peer, pw)
+		close(done4)
+	}()
+	id := protocol.Identity{User: "erin", Host: "box", PID: 8}
+	_ = c.SetDeadline(time.Now().Add(time.Second))
+	_ = protocol.WritePacket(c, protocol.TypeMode, protocol.AppendIdentity(protocol.ModePayload(protocol.ModeReadOnly, protocol.CapIdentity|protocol.CapPeers, 0), id))
+	typ, payload, err := protocol.ReadPacket(c)
+	var peers []protocol.ClientInfo
+	if err != nil || typ != protocol.TypeClients || json.Unmarshal(payload, &peers) != nil {
+		t.Fatalf("Expected TypeClients, got %d %q (%v)", typ, payload, err)
+	}
+	if len(peers) != 2 || peers[0].User != "bob" || peers[1].User != "erin" {
+		t.Errorf("Unexpected peers %+v", peers)
+	}
+	_ = c.Close()
+	<-done4
+
+	_ = viewer.Close()
+	_ = bob.Close()
+	<-done1
+	<-done2
+	<-done3
+	if list := srv.clientList(); len(list) != 0 {
+		t.Errorf("Clients left after disconnecting: %+v", list)
+	}
+}
+
+func TestServer_Grant(t *testing.T) {
+	pr, pw, _ := os.Pipe()
+	defer func() {
+		_ = pr.Close()
+		_ = pw.Close()
+	}()
+	srv := &Server{Clients: make(map[net.Conn]struct{})}
+	connect := func(mode byte) net.Conn {
+		s, c := net.Pipe()
+		go srv.handleClient(s, pw)
+		id := protocol.Identity{User: "carol", Host: "box", PID: 7}
+		if err := protocol.WritePacket(c, protocol.TypeMode, protocol.AppendIdentity(protocol.ModePayload(mode, protocol.CapIdentity, 0), id)); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	expect := func(conn net.Conn, want string) {
+		t.Helper()
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		for {
+			typ, payload, err := protocol.ReadPacket(conn)
+			if err != nil {
+				t.Fatalf("No TypeGrant %q: %v", want, err)
+			}
+			if typ == protocol.TypeGrant {
+				if string(payload) != want {
+					t.Errorf("TypeGrant %q, want %q", payload, want)
+				}
+				return
+			}
+		}
+	}
+	master := connect(protocol.ModeMaster)
+	defer func() { _ = master.Close() }()
+
+	// Without viewers the Master is told there is nobody to grant access to
+	_ = protocol.WritePacket(master, protocol.TypeGrant, nil)
+	expect(master, "\x00")
+
+	viewer := connect(protocol.ModeReadOnly)
+	defer func() { _ = viewer.Close() }()
+	time.Sleep(50 * time.Millisecond)
+	list := srv.clientList()
+	if err := srv.grant(list[0].ID, true, ""); err == nil {
+		t.Error("Expected an error granting access to the Master")
+	}
+
+	// The Master's toggle grants the viewer write access
+	_ = protocol.WritePacket(master, protocol.TypeGrant, nil)
+	expect(viewer, "\x01")
+	expect(master, "\x01carol@box (pid 7)")
+	_ = protocol.WritePacket(viewer, protocol.TypeData, []byte("typed"))
+	buf := make([]byte, 5)
+	_ = pr.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(pr, buf); err != nil || string(buf) != "typed" {
+		t.Errorf("Viewer input not written: %q, %v", buf, err)
+	}
+	if list := srv.clientList(); !list[1].Writable {
+		t.Errorf("Viewer not listed as writable: %+v", list)
+	}
+
+	// Revoked viewers are read-only again
+	if err := srv.grant(list[1].ID, false, ""); err != nil {
+		t.Fatal(err)
+	}
+	expect(viewer, "\x00")
+	expect(master, "\x00carol@box (pid 7)")
+	_ = protocol.WritePacket(viewer, protocol.TypeData, []byte("ignored"))
+	_ = protocol.WritePacket(master, protocol.TypeData, []byte("own"))
+	buf = make([]byte, 3)
+	if _, err := io.ReadFull(pr, buf); err != nil || string(buf) != "own" {
+		t.Errorf("Expected only the Master's input, got %q, %v", buf, err)
+	}
 }
 
 func TestServer_HandleClient_ReadOnly(t *testing.T) {
@@ -167,4 +588,1055 @@ func TestServer_HandleClient_ReadOnly(t *testing.T) {
 		t.Error("Master should be nil")
 	}
 	srv.Lock.Unlock()
-}
\ No newline at end of file
+}
+
+func TestServer_Replay(t *testing.T) {
+	pr, pw, _ := os.Pipe()
+	defer func() {
+		_ = pr.Close()
+		_ = pw.Close()
+	}()
+	srv := &Server{
+		Clients:    make(map[net.Conn]struct{}),
+		scrollback: scrollback{size: 1024},
+	}
+	srv.broadcast([]byte("old\noutput\n"))
+
+	s1, c1 := net.Pipe()
+	defer func() { _ = c1.Close() }()
+	go srv.handleClient(s1, pw)
+	if err := protocol.WritePacket(c1, protocol.TypeMode, protocol.ModePayload(protocol.ModeReadOnly, protocol.CapReplay, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// History comes first, then live output
+	_ = c1.SetReadDeadline(time.Now().Add(time.Second))
+	var history []byte
+	for {
+		typ, payload, err := protocol.ReadPacket(c1)
+		if err != nil || typ != protocol.TypeReplay {
+			t.Fatalf("Expected history, got %d, %v", typ, err)
+		}
+		if len(payload) == 0 {
+			break
+		}
+		history = append(history, payload...)
+	}
+	if string(history) != "output\n" {
+		t.Errorf("History = %q", history)
+	}
+	srv.broadcast([]byte("live"))
+	if typ, payload, err := protocol.ReadPacket(c1); err != nil || typ != protocol.TypeData || string(payload) != "live" {
+		t.Errorf("Expected live output, got %d %q, %v", typ, payload, err)
+	}
+}
+
+func TestServer_Resume(t *testing.T) {
+	pr, pw, _ := os.Pipe()
+	defer func() {
+		_ = pr.Close()
+		_ = pw.Close()
+	}()
+	srv := &Server{
+		Clients:    make(map[net.Conn]struct{}),
+		scrollback: scrollback{size: 1024},
+	}
+	srv.broadcast([]byte("abc"))
+
+	s1, c1 := net.Pipe()
+	defer func() { _ = c1.Close() }()
+	go srv.handleClient(s1, pw)
+	caps := protocol.CapReplay | protocol.CapResume
+	if err := protocol.WritePacket(c1, protocol.TypeMode, protocol.ModePayload(protocol.ModeReadOnly, caps, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The offset comes before the history it ends
+	_ = c1.SetReadDeadline(time.Now().Add(time.Second))
+	typ, payload, err := protocol.ReadPacket(c1)
+	if err != nil || typ != protocol.TypeResume || binary.BigEndian.Uint64(payload) != 3 {
+		t.Fatalf("Expected the offset 3, got %d %v, %v", typ, payload, err)
+	}
+	if typ, payload, err := protocol.ReadPacket(c1); err != nil || typ != protocol.TypeReplay || string(payload) != "abc" {
+		t.Errorf("Expected the history, got %d %q, %v", typ, payload, err)
+	}
+}
+
+func TestServer_LargePayload(t *testing.T) {
+	pr, pw, _ := os.Pipe()
+	defer func() {
+		_ = pr.Close()
+		_ = pw.Close()
+	}()
+	srv := &Server{
+		Clients:    make(map[net.Conn]struct{}),
+		scrollback: scrollback{size: 512 * 1024},
+	}
+	srv.broadcast([]byte(strings.Repeat("x", 200*1024)))
+
+	replay := func(caps protocol.Caps) []int {
+		t.Helper()
+		s, c := net.Pipe()
+		defer func() { _ = c.Close() }()
+		go srv.handleClient(s, pw)
+		if err := protocol.WritePacket(c, protocol.TypeMode, protocol.ModePayload(protocol.ModeReadOnly, caps, 0)); err != nil {
+			t.Fatal(err)
+		}
+		_ = c.SetReadDeadline(time.Now().Add(time.Second))
+		packets := protocol.NewReader(c)
+		var chunks []int
+		for {
+			typ, payload, err := packets.ReadPacket()
+			if err != nil {
+				t.Fatalf("ReadPacket failed: %v", err)
+			}
+			switch {
+			case typ == protocol.TypeLimit:
+				limit, ok := protocol.DecodePayloadLimit(payload)
+				if !ok || len(chunks) > 0 {
+					t.Fatalf("Unexpected limit %v after %d chunks", payload, len(chunks))
+				}
+				packets.SetLimit(limit)
+			case typ != protocol.TypeReplay:
+				t.Fatalf("Unexpected packet %d", typ)
+			case len(payload) == 0:
+				return chunks
+			default:
+				chunks = append(chunks, len(payload))
+			}
+		}
+	}
+
+	if chunks := replay(protocol.CapReplay); len(chunks) != 4 || chunks[0] != protocol.MaxPayloadSize {
+		t.Errorf("Old client got chunks of %v bytes", chunks)
+	}
+	if chunks := replay(protocol.CapReplay | protocol.CapLargePayload); len(chunks) != 1 || chunks[0] != 200*1024 {
+		t.Errorf("Client with CapLargePayload got chunks of %v bytes", chunks)
+	}
+}
+
+func TestServer_Errors(t *testing.T) {
+	pr, pw, _ := os.Pipe()
+	defer func() {
+		_ = pr.Close()
+		_ = pw.Close()
+	}()
+	srv := &Server{Clients: make(map[net.Conn]struct{})}
+	connect := func(mode []byte) net.Conn {
+		t.Helper()
+		s, c := net.Pipe()
+		t.Cleanup(func() { _ = c.Close() })
+		go srv.handleClient(s, pw)
+		_ = c.SetDeadline(time.Now().Add(time.Second))
+		if err := protocol.WritePacket(c, protocol.TypeMode, mode); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	expectError := func(c net.Conn, code protocol.ErrorCode) {
+		t.Helper()
+		typ, payload, err := protocol.ReadPacket(c)
+		if err != nil || typ != protocol.TypeError {
+			t.Fatalf("Expected TypeError, got %d %q (%v)", typ, payload, err)
+		}
+		if got := protocol.DecodeErrorPayload(payload); got.Code != code || got.Message == "" {
+			t.Errorf("Got error %d %q, want code %d", got.Code, got.Message, code)
+		}
+	}
+
+	// Control clients announcing ControlErrors get failures as TypeError
+	control := connect([]byte{protocol.ModeControl, protocol.ControlErrors})
+	_ = protocol.WritePacket(control, protocol.TypeRename, []byte("no spaces"))
+	expectError(control, protocol.ErrorInvalidName)
+	_ = protocol.WritePacket(control, protocol.TypeKick, nil)
+	expectError(control, protocol.ErrorProtocol)
+	_ = protocol.WritePacket(control, protocol.Type(0xfe), nil)
+	expectError(control, protocol.ErrorUnsupported)
+
+	// Older ones get the message in the usual reply
+	control = connect([]byte{protocol.ModeControl})
+	_ = protocol.WritePacket(control, protocol.TypeRename, []byte("no spaces"))
+	if typ, payload, err := protocol.ReadPacket(control); err != nil || typ != protocol.TypeRename || !strings.HasPrefix(string(payload), "invalid session name") {
+		t.Errorf("Expected the message in TypeRename, got %d %q (%v)", typ, payload, err)
+	}
+
+	// A viewer typing is told once why its input is ignored
+	viewer := connect(protocol.ModePayload(protocol.ModeReadOnly, protocol.CapErrors, 0))
+	_ = protocol.WritePacket(viewer, protocol.TypeData, []byte("ls"))
+	_ = protocol.WritePacket(viewer, protocol.TypeData, []byte("\r"))
+	_ = protocol.WritePacket(viewer, protocol.TypePing, nil)
+	expectError(viewer, protocol.ErrorNoWriteAccess)
+	srv.broadcast([]byte("output"))
+	if typ, _, err := protocol.ReadPacket(viewer); err != nil || typ != protocol.TypeData {
+		t.Errorf("Expected output after the error, got %d (%v)", typ, err)
+	}
+
+	// Viewers that didn't announce CapErrors never see TypeError
+	viewer = connect(protocol.ModePayload(protocol.ModeReadOnly, protocol.CapPing, 0))
+	_ = protocol.WritePacket(viewer, protocol.TypeData, []byte("ls"))
+	_ = protocol.WritePacket(viewer, protocol.TypePing, nil)
+	srv.broadcast([]byte("output"))
+	for {
+		typ, _, err := protocol.ReadPacket(viewer)
+		if err != nil || typ == protocol.TypeError {
+			t.Fatalf("Expected output without an error, got %d (%v)", typ, err)
+		}
+		if typ == protocol.TypeData {
+			break
+		}
+	}
+
+	// A broken handshake just ends the connection
+	s, c := net.Pipe()
+	defer func() { _ = c.Close() }()
+	go srv.handleClient(s, pw)
+	_ = c.SetDeadline(time.Now().Add(time.Second))
+	_ = protocol.WritePacket(c, protocol.TypeData, []byte("hello"))
+	if typ, _, err := protocol.ReadPacket(c); !errors.Is(err, io.EOF) {
+		t.Errorf("Expected the connection to end, got %d (%v)", typ, err)
+	}
+}
+
+func TestServer_Capture(t *testing.T) {
+	srv := &Server{
+		Clients: make(map[net.Conn]struct{}),
+		screen:  ansi.NewScreen(2, 20, 10),
+	}
+	srv.broadcast([]byte("one\r\ntwo\r\n\x1b[32mthree\x1b[0m"))
+	if got := string(srv.capture(0)); got != "two\nthree\n" {
+		t.Errorf("Screen = %q", got)
+	}
+	if got := string(srv.capture(5)); got != "one\ntwo\nthree\n" {
+		t.Errorf("Screen with history = %q", got)
+	}
+
+	// Large captures keep the lines at the bottom
+	srv.screen = ansi.NewScreen(2, 1000, 1000)
+	for i := 0; i < 200; i++ {
+		srv.broadcast([]byte(strings.Repeat("x", 999) + "\r\n"))
+	}
+	srv.broadcast([]byte("end"))
+	got := srv.capture(1000)
+	if len(got) > protocol.MaxPayloadSize || !strings.HasSuffix(string(got), "x\nend\n") {
+		t.Errorf("Unexpected large capture of %d bytes ending in %q", len(got), got[max(len(got)-10, 0):])
+	}
+
+	// Rendered screens end in the output size they reflect
+	srv.screen = ansi.NewScreen(2, 20, 10)
+	srv.outputSize = 0
+	srv.broadcast([]byte("one\r\ntwo"))
+	rendered := srv.render()
+	if len(rendered) < 8 || binary.BigEndian.Uint64(rendered[len(rendered)-8:]) != 8 {
+		t.Fatalf("Rendered screen = %q", rendered)
+	}
+	if want := srv.screen.Render(); string(rendered[:len(rendered)-8]) != want {
+		t.Errorf("Rendered screen = %q, want %q", rendered[:len(rendered)-8], want)
+	}
+}
+
+func TestServer_TargetSize(t *testing.T) {
+	defer config.Use(*config.Current())
+
+	master, _ := net.Pipe()
+	viewer, _ := net.Pipe()
+	srv := &Server{
+		Clients: make(map[net.Conn]struct{}),
+		Master:  master,
+		sizes: map[net.Conn]pty.Winsize{
+			master: {Rows: 40, Cols: 120},
+			viewer: {Rows: 30, Cols: 150},
+		},
+	}
+
+	tests := []struct {
+		policy string
+		rows   uint16
+		cols   uint16
+	}{
+		{config.ResizeSmallest, 30, 120},
+		{config.ResizeLargest, 40, 150},
+		{config.ResizeLatest, 40, 120},
+	}
+
+	for _, tt := range tests {
+		config.Update(func(c *config.Config) { c.ResizePolicy = tt.policy })
+		ws, ok := srv.targetSize()
+		if !ok {
+			t.Fatalf("%s: expected a target size", tt.policy)
+		}
+		if ws.Rows != tt.rows || ws.Cols != tt.cols {
+			t.Errorf("%s: got %dx%d, want %dx%d", tt.policy, ws.Cols, ws.Rows, tt.cols, tt.rows)
+		}
+	}
+
+	// Departing clients no longer constrain the size
+	config.Update(func(c *config.Config) { c.ResizePolicy = config.ResizeSmallest })
+	delete(srv.sizes, viewer)
+	ws, _ := srv.targetSize()
+	if ws.Rows != 40 || ws.Cols != 120 {
+		t.Errorf("After viewer left: got %dx%d, want 120x40", ws.Cols, ws.Rows)
+	}
+}
+
+func TestServer_TargetSizePixels(t *testing.T) {
+	defer config.Use(*config.Current())
+	config.Update(func(c *config.Config) { c.ResizePolicy = config.ResizeSmallest })
+
+	master, _ := net.Pipe()
+	viewer, _ := net.Pipe()
+	srv := &Server{
+		Clients: make(map[net.Conn]struct{}),
+		Master:  master,
+		sizes: map[net.Conn]pty.Winsize{
+			// 10x20 pixel cells
+			master: {Rows: 40, Cols: 120, X: 1200, Y: 800},
+			viewer: {Rows: 30, Cols: 150},
+		},
+	}
+
+	ws, ok := srv.targetSize()
+	if !ok {
+		t.Fatal("Expected a target size")
+	}
+	// The combined size keeps the Master's cell size
+	if ws.Rows != 30 || ws.Cols != 120 || ws.X != 1200 || ws.Y != 600 {
+		t.Errorf("Got %dx%d (%dx%d px), want 120x30 (1200x600 px)", ws.Cols, ws.Rows, ws.X, ws.Y)
+	}
+
+	// Without any pixel information the pixel size stays unset
+	srv.sizes[master] = pty.Winsize{Rows: 40, Cols: 120}
+	ws, _ = srv.targetSize()
+	if ws.X != 0 || ws.Y != 0 {
+		t.Errorf("Expected no pixel size, got %dx%d", ws.X, ws.Y)
+	}
+}
+
+func TestServer_Rebind(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "run")
+	sockPath := filepath.Join(dir, "rebind.sock")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Clients: make(map[net.Conn]struct{})}
+	if err := srv.listen(sockPath); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = srv.listener.Close() }()
+
+	// Nothing to do while the socket exists
+	old := srv.listener
+	srv.rebind()
+	if srv.listener != old {
+		t.Error("Expected the listener to be kept")
+	}
+
+	// The runtime directory is wiped, e.g. by logind on logout
+	_ = os.RemoveAll(dir)
+	srv.rebind()
+	if srv.listener == old {
+		t.Fatal("Expected a new listener")
+	}
+	conn, err := net.Dial("unix", sockPath)
+	if err != nil {
+		t.Fatalf("Expected the socket to be recreated: %v", err)
+	}
+	_ = conn.Close()
+}
+
+func TestShellArgs(t *testing.T) {
+	t.Setenv("SHELL", "/bin/zsh")
+	defer config.Update(func(c *config.Config) { c.DefaultShell = "" })
+
+	tests := []struct {
+		override, configured string
+		want                 string
+	}{
+		{"", "", "/bin/zsh"},
+		{"", "/bin/bash -l", "/bin/bash -l"},
+		{"/usr/bin/fish  -l", "/bin/bash", "/usr/bin/fish -l"},
+		{"  ", "", "/bin/zsh"},
+	}
+	for _, tt := range tests {
+		config.Update(func(c *config.Config) { c.DefaultShell = tt.configured })
+		if got := strings.Join(ShellArgs(tt.override), " "); got != tt.want {
+			t.Errorf("ShellArgs(%q) with default_shell %q = %q, want %q", tt.override, tt.configured, got, tt.want)
+		}
+	}
+
+	config.Update(func(c *config.Config) { c.DefaultShell = "" })
+	t.Setenv("SHELL", "")
+	if got := ShellArgs(""); len(got) != 1 || got[0] != "bash" {
+		t.Errorf("Expected bash fallback, got %v", got)
+	}
+}
+
+func TestProfileEnv(t *testing.T) {
+	t.Setenv("BASE", "/opt")
+	p := config.Profile{Env: map[string]string{"PATH_EXTRA": "$BASE/bin", "MODE": "ci"}}
+	got := strings.Join(profileEnv(p), " ")
+	if want := "MODE=ci PATH_EXTRA=/opt/bin"; got != want {
+		t.Errorf("profileEnv = %q, want %q", got, want)
+	}
+}
+
+func TestLocaleEnv(t *testing.T) {
+	env := []string{"HOME=/home/me", "LANG=de_DE.UTF-8", "LC_TIME=de_DE.UTF-8", "TZ=Europe/Berlin"}
+	got := strings.Join(localeEnv(env, "C.UTF-8", "UTC"), " ")
+	if want := "HOME=/home/me LANG=C.UTF-8 TZ=UTC"; got != want {
+		t.Errorf("localeEnv = %q, want %q", got, want)
+	}
+	got = strings.Join(localeEnv(env, "", "UTC"), " ")
+	if want := "HOME=/home/me LANG=de_DE.UTF-8 LC_TIME=de_DE.UTF-8 TZ=UTC"; got != want {
+		t.Errorf("localeEnv = %q, want %q", got, want)
+	}
+}
+
+func TestTermEnv(t *testing.T) {
+	defer config.Use(*config.Current())
+	env := []string{"HOME=/home/me", "TERM=screen", "COLORTERM=truecolor"}
+	term, colorTerm := sessionTerm("", "")
+	got := strings.Join(termEnv(env, term, colorTerm), " ")
+	if want := "HOME=/home/me TERM=xterm-256color"; got != want {
+		t.Errorf("termEnv = %q, want %q", got, want)
+	}
+	term, colorTerm = sessionTerm("xterm-kitty", "truecolor")
+	got = strings.Join(termEnv(env, term, colorTerm), " ")
+	if want := "HOME=/home/me TERM=xterm-kitty COLORTERM=truecolor"; got != want {
+		t.Errorf("termEnv = %q, want %q", got, want)
+	}
+	// The term setting wins over the terminal
+	config.Update(func(c *config.Config) { c.Term = "tmux-256color" })
+	if term, colorTerm := sessionTerm("xterm-kitty", "truecolor"); term != "tmux-256color" || colorTerm != "truecolor" {
+		t.Errorf("sessionTerm = %q, %q with the term setting", term, colorTerm)
+	}
+}
+
+func TestStartShell_Env(t *testing.T) {
+	t.Setenv("PERSISHTENT_DIR", t.TempDir())
+	opts := Options{
+		Argv: []string{"sh", "-c", `printf '%s|%s' "$FROM_PROFILE" "$SHARED"`},
+		Env:  []string{"SHARED=flag"},
+	}
+	// Variables given with -e take precedence over the profile's
+	profile := []string{"FROM_PROFILE=profile", "SHARED=profile"}
+	cmd, ptmx, err := startShell("env", opts, ShellArgs(""), profile, newForwardedEnv("env"), "")
+	if err != nil {
+		t.Fatalf("startShell failed: %v", err)
+	}
+	defer func() { _ = ptmx.Close() }()
+	out, _ := io.ReadAll(ptmx)
+	_ = cmd.Wait()
+	if got := string(out); got != "profile|flag" {
+		t.Errorf("Shell environment = %q, want %q", got, "profile|flag")
+	}
+}
+
+func TestServer_ReloadConfig(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("PERSISHTENT_DIR", t.TempDir())
+	defer config.Use(*config.Current())
+
+	logger, err := NewLogRotator("reload", filepath.Join(t.TempDir(), "reload.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = logger.Close() }()
+	srv := &Server{logger: logger, profile: "big"}
+
+	configDir := filepath.Join(home, ".config", "persishtent")
+	_ = os.MkdirAll(configDir, 0700)
+	cfg := `{"log_rotation_size_mb": 4, "max_log_rotations": 2, "profiles": {"big": {"max_log_rotations": 50}}}`
+	_ = os.WriteFile(filepath.Join(configDir, "config.json"), []byte(cfg), 0600)
+
+	if err := srv.reloadConfig(); err != nil {
+		t.Fatalf("reloadConfig failed: %v", err)
+	}
+	// The session's profile still overrides the global log settings
+	if logger.maxSize != 4*1024*1024 || logger.maxFiles != 50 {
+		t.Errorf("Log limits not applied: size %d, files %d", logger.maxSize, logger.maxFiles)
+	}
+}
+
+func TestServer_Keepalive(t *testing.T) {
+	defer config.Use(*config.Current())
+	config.Update(func(c *config.Config) { c.KeepaliveInput = "ping" })
+
+	pr, pw, _ := os.Pipe()
+	defer func() {
+		_ = pr.Close()
+		_ = pw.Close()
+	}()
+	srv := &Server{ptmx: pw}
+	srv.lastInput.Store(time.Now().UnixNano())
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		srv.keepalive(50*time.Millisecond, done)
+		close(stopped)
+	}()
+
+	// Client input postpones the keepalive
+	time.Sleep(30 * time.Millisecond)
+	srv.lastInput.Store(time.Now().UnixNano())
+	start := time.Now()
+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(pr, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("Expected keepalive input, got %q (%v)", buf, err)
+	}
+	if waited := time.Since(start); waited < 40*time.Millisecond {
+		t.Errorf("Keepalive sent %v after input, expected the full interval", waited)
+	}
+
+	close(done)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("keepalive didn't stop")
+	}
+}
+
+func TestServer_Guard(t *testing.T) {
+	defer config.Use(*config.Current())
+	config.Update(func(c *config.Config) { c.GuardPatterns = []string{`rm -rf /(\s|$)`, `^\s*shutdown\b`} })
+
+	srv := &Server{Clients: make(map[net.Conn]struct{})}
+	master, c := net.Pipe()
+	defer func() {
+		_ = master.Close()
+		_ = c.Close()
+	}()
+	srv.Lock.Lock()
+	srv.addClient(master)
+	srv.Lock.Unlock()
+	prompts := make(chan string, 4)
+	go func() {
+		for {
+			typ, payload, err := protocol.ReadPacket(c)
+			if err != nil {
+				return
+			}
+			if typ == protocol.TypeConfirm {
+				prompts <- string(payload)
+			}
+		}
+	}()
+
+	input := func(data string) string {
+		srv.Lock.Lock()
+		defer srv.Lock.Unlock()
+		return string(srv.guardInput(master, nil, []byte(data)))
+	}
+	confirm := func(answer byte) string {
+		srv.Lock.Lock()
+		defer srv.Lock.Unlock()
+		return string(srv.confirmGuard(master, []byte{answer}))
+	}
+
+	if got := input("ls /tmp\r"); got != "ls /tmp\r" {
+		t.Errorf("Harmless input changed: %q", got)
+	}
+
+	// Typed character by character, only the Enter is held
+	if got := input("rm -rf /"); got != "rm -rf /" {
+		t.Errorf("Input before Enter should be forwarded, got %q", got)
+	}
+	if got := input("\rexit\r"); got != "" {
+		t.Errorf("Expected input to be held, got %q", got)
+	}
+	select {
+	case p := <-prompts:
+		if p != `rm -rf /(\s|$)` {
+			t.Errorf("Unexpected prompt %q", p)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No confirmation request sent")
+	}
+	if got := input("more"); got != "" {
+		t.Errorf("Input while waiting for confirmation should be dropped, got %q", got)
+	}
+	if got := confirm('y'); got != "\rexit\r" {
+		t.Errorf("Confirmed input = %q", got)
+	}
+
+	// Edited lines are tracked, and rejected input is cleared from the shell
+	if got := input("shutdownx\x7f -h now\r"); got != "shutdownx\x7f -h now" {
+		t.Errorf("Expected the Enter to be held, got %q", got)
+	}
+	<-prompts
+	if got := confirm('n'); got != string([]byte{killLine}) {
+		t.Errorf("Rejected input should be replaced by a line kill, got %q", got)
+	}
+	if got := input("rm -rf /tmp/x\r"); got != "rm -rf /tmp/x\r" {
+		t.Errorf("Non-matching input held: %q", got)
+	}
+}
+
+func TestServer_ControlInput(t *testing.T) {
+	defer config.Use(*config.Current())
+	config.Update(func(c *config.Config) { c.GuardPatterns = []string{`^\s*shutdown\b`} })
+
+	pr, pw, _ := os.Pipe()
+	defer func() {
+		_ = pr.Close()
+		_ = pw.Close()
+	}()
+	srv := &Server{ptmx: pw}
+	ctl, other := net.Pipe()
+	defer func() {
+		_ = ctl.Close()
+		_ = other.Close()
+	}()
+	read := func(n int) string {
+		buf := make([]byte, n)
+		_, _ = io.ReadFull(pr, buf)
+		return string(buf)
+	}
+
+	if err := srv.controlInput(ctl, []byte("uptime\r")); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(7); got != "uptime\r" {
+		t.Errorf("PTY got %q", got)
+	}
+	if srv.bytesIn.Load() != 7 || srv.lastInput.Load() == 0 {
+		t.Errorf("Input not counted: %d bytes", srv.bytesIn.Load())
+	}
+
+	// Guarded lines are killed at once instead of waiting for confirmation
+	if err := srv.controlInput(ctl, []byte("shutdown -h now\r")); err == nil {
+		t.Error("Expected guarded input to be reported")
+	}
+	if got := read(16); got != "shutdown -h now"+string([]byte{killLine}) {
+		t.Errorf("PTY got %q", got)
+	}
+	if srv.guard.held != nil {
+		t.Error("Guarded input left held")
+	}
+
+	// An exclusive attach locks out send-keys, paste and the API alike
+	srv.locked = other
+	if err := srv.controlInput(ctl, []byte("uptime\r")); err == nil {
+		t.Error("Expected input to be refused while the session is locked")
+	}
+	if srv.bytesIn.Load() != 23 {
+		t.Errorf("Refused input was counted: %d bytes", srv.bytesIn.Load())
+	}
+}
+
+func TestServer_InjectSecret(t *testing.T) {
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		t.Skipf("No PTY available: %v", err)
+	}
+	defer func() {
+		_ = ptmx.Close()
+		_ = tty.Close()
+	}()
+	srv := &Server{ptmx: ptmx}
+
+	// A fresh terminal echoes input, so it isn't at a password prompt
+	if err := srv.injectSecret([]byte("hunter2"), false); err == nil {
+		t.Error("Expected injecting with echo on to fail")
+	}
+	if srv.quiet() {
+		t.Error("Refused secret should not silence the log")
+	}
+
+	// Password prompts turn echo off
+	if _, err := term.MakeRaw(int(tty.Fd())); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.injectSecret([]byte("hunter2\r"), false); err != nil {
+		t.Fatalf("Inject failed: %v", err)
+	}
+	if !srv.quiet() {
+		t.Error("Output after a secret should not be logged")
+	}
+	buf := make([]byte, 16)
+	_ = tty.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := tty.Read(buf)
+	if err != nil || string(buf[:n]) != "hunter2\r" {
+		t.Errorf("Shell read %q, %v", buf[:n], err)
+	}
+}
+
+func TestServer_Audit(t *testing.T) {
+	tmpDir := t.TempDir()
+	t.Setenv("HOME", tmpDir)
+	t.Setenv("PERSISHTENT_DIR", filepath.Join(tmpDir, ".persishtent"))
+	defer config.Use(*config.Current())
+	config.Update(func(c *config.Config) { c.AuditLog = true })
+
+	pr, pw, _ := os.Pipe()
+	defer func() {
+		_ = pr.Close()
+		_ = pw.Close()
+	}()
+	srv := &Server{Name: "audited", Clients: make(map[net.Conn]struct{})}
+	connect := func(mode byte, id protocol.Identity) (net.Conn, chan struct{}) {
+		s, c := net.Pipe()
+		go func() {
+			_ = protocol.WritePacket(c, protocol.TypeMode, protocol.AppendIdentity(protocol.ModePayload(mode, protocol.CapIdentity, 0), id))
+		}()
+		done := make(chan struct{})
+		go func() {
+			srv.handleClient(s, pw)
+			close(done)
+		}()
+		// Output is never read, so the queues are drained to avoid blocking
+		go func() { _, _ = io.Copy(io.Discard, c) }()
+		time.Sleep(100 * time.Millisecond)
+		return c, done
+	}
+
+	master, done1 := connect(protocol.ModeMaster, protocol.Identity{User: "alice", Host: "box", PID: 1})
+	viewer, done2 := connect(protocol.ModeReadOnly, protocol.Identity{User: "bob", Host: "box", PID: 2, From: "192.0.2.7"})
+	list := srv.clientList()
+	if err := srv.kick(list[1].ID, "alice@box (pid 1)"); err != nil {
+		t.Fatal(err)
+	}
+	_ = viewer.Close()
+	<-done2
+	_ = master.Close()
+	<-done1
+
+	events, err := session.ReadAudit("audited")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range events {
+		got = append(got, e.Event+" "+e.Client+" "+e.Mode+" "+e.By)
+	}
+	want := []string{
+		"attach alice@box (pid 1) master ",
+		"attach bob@box (pid 2, from 192.0.2.7) read-only ",
+		"kick bob@box (pid 2, from 192.0.2.7) read-only alice@box (pid 1)",
+		"detach bob@box (pid 2, from 192.0.2.7) read-only ",
+		"detach alice@box (pid 1) master ",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Unexpected audit events:\n%s", strings.Join(got, "\n"))
+	}
+
+	// Nothing is recorded with audit_log off
+	config.Update(func(c *config.Config) { c.AuditLog = false })
+	srv.Lock.Lock()
+	srv.audit(session.AuditEvent{Event: session.AuditExit})
+	srv.Lock.Unlock()
+	if events, _ := session.ReadAudit(""); len(events) != len(want) {
+		t.Errorf("Expected no more events, got %d", len(events))
+	}
+}
+
+func TestServer_AdoptTerm(t *testing.T) {
+	t.Setenv("PERSISHTENT_DIR", t.TempDir())
+	defer config.Use(*config.Current())
+	config.Update(func(c *config.Config) { c.Term = "" })
+	if err := session.WriteInfo(session.Info{Name: "term", PID: os.Getpid()}); err != nil {
+		t.Fatal(err)
+	}
+
+	pr, pw, _ := os.Pipe()
+	defer func() {
+		_ = pr.Close()
+		_ = pw.Close()
+	}()
+	srv := &Server{Name: "term", Clients: make(map[net.Conn]struct{}), env: newForwardedEnv("term")}
+	connect := func(mode byte, id protocol.Identity) (net.Conn, chan struct{}) {
+		s, c := net.Pipe()
+		go func() {
+			_ = protocol.WritePacket(c, protocol.TypeMode, protocol.AppendIdentity(protocol.ModePayload(mode, protocol.CapIdentity, 0), id))
+		}()
+		done := make(chan struct{})
+		go func() {
+			srv.handleClient(s, pw)
+			close(done)
+		}()
+		go func() { _, _ = io.Copy(io.Discard, c) }()
+		time.Sleep(100 * time.Millisecond)
+		return c, done
+	}
+
+	// Viewers don't decide the terminal type, the first master does
+	viewer, done1 := connect(protocol.ModeReadOnly, protocol.Identity{User: "bob", Host: "box", PID: 1, Term: "vt100"})
+	first, done2 := connect(protocol.ModeMaster, protocol.Identity{User: "alice", Host: "box", PID: 2, Term: "xterm-kitty", ColorTerm: "truecolor"})
+	_ = first.Close()
+	<-done2
+	second, done3 := connect(protocol.ModeMaster, protocol.Identity{User: "alice", Host: "box", PID: 3, Term: "linux"})
+	_ = second.Close()
+	<-done3
+	_ = viewer.Close()
+	<-done1
+
+	data, err := os.ReadFile(srv.env.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "export COLORTERM='truecolor'\nexport TERM='xterm-kitty'\n"; string(data) != want {
+		t.Errorf("Env file = %q, want %q", data, want)
+	}
+	if info, err := session.ReadInfo("term"); err != nil || info.Term != "xterm-kitty" {
+		t.Errorf("Info term = %q, %v", info.Term, err)
+	}
+}
+
+func TestServer_Detach(t *testing.T) {
+	pr, pw, _ := os.Pipe()
+	defer func() {
+		_ = pr.Close()
+		_ = pw.Close()
+	}()
+	srv := &Server{Clients: make(map[net.Conn]struct{})}
+	connect := func(mode byte) (chan string, chan struct{}) {
+		s, c := net.Pipe()
+		go func() {
+			_ = protocol.WritePacket(c, protocol.TypeMode, []byte{mode})
+		}()
+		done := make(chan struct{})
+		go func() {
+			srv.handleClient(s, pw)
+			close(done)
+		}()
+		kicked := make(chan string, 1)
+		go func() {
+			defer func() { _ = c.Close() }()
+			for {
+				typ, payload, err := protocol.ReadPacket(c)
+				if err != nil {
+					return
+				}
+				if typ == protocol.TypeKick {
+					kicked <- string(payload)
+					return
+				}
+			}
+		}()
+		time.Sleep(100 * time.Millisecond)
+		return kicked, done
+	}
+	waitKick := func(kicked chan string, who string) {
+		t.Helper()
+		select {
+		case by := <-kicked:
+			if by != "alice@box (pid 1)" {
+				t.Errorf("%s kicked by %q", who, by)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s wasn't kicked", who)
+		}
+	}
+
+	master, done1 := connect(protocol.ModeMaster)
+	viewer, done2 := connect(protocol.ModeReadOnly)
+
+	// Only the Master is detached by default
+	if err := srv.detach(false, "alice@box (pid 1)"); err != nil {
+		t.Fatal(err)
+	}
+	waitKick(master, "Master")
+	<-done1
+	if list := srv.clientList(); len(list) != 1 || !list[0].ReadOnly {
+		t.Errorf("Expected the viewer to stay attached, got %+v", list)
+	}
+	if err := srv.detach(false, "alice@box (pid 1)"); err == nil {
+		t.Error("Expected an error without a Master")
+	}
+
+	if err := srv.detach(true, "alice@box (pid 1)"); err != nil {
+		t.Fatal(err)
+	}
+	waitKick(viewer, "Viewer")
+	<-done2
+	if err := srv.detach(true, "alice@box (pid 1)"); err == nil {
+		t.Error("Expected an error without clients")
+	}
+}
+
+func TestServer_Message(t *testing.T) {
+	pr, pw, _ := os.Pipe()
+	defer func() {
+		_ = pr.Close()
+		_ = pw.Close()
+	}()
+	srv := &Server{Clients: make(map[net.Conn]struct{})}
+	payload := []byte(`{"text":"rebooting in 5 min","from":"alice@box"}`)
+	if err := srv.message(payload); err == nil {
+		t.Error("Expected an error without clients")
+	}
+
+	var conns []net.Conn
+	for _, mode := range []byte{protocol.ModeMaster, protocol.ModeReadOnly} {
+		s, c := net.Pipe()
+		defer func() { _ = c.Close() }()
+		go srv.handleClient(s, pw)
+		_ = protocol.WritePacket(c, protocol.TypeMode, []byte{mode})
+		conns = append(conns, c)
+	}
+	waitAttached(t, srv, len(conns))
+	if err := srv.message(payload); err != nil {
+		t.Fatal(err)
+	}
+	// Every client gets the message, nothing reaches the PTY
+	for i, c := range conns {
+		_ = c.SetReadDeadline(time.Now().Add(time.Second))
+		for {
+			typ, got, err := protocol.ReadPacket(c)
+			if err != nil {
+				t.Fatalf("Client %d got no message: %v", i, err)
+			}
+			if typ == protocol.TypeMessage {
+				if string(got) != string(payload) {
+					t.Errorf("Client %d got %q", i, got)
+				}
+				break
+			}
+		}
+	}
+	_ = pr.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, _ := pr.Read(make([]byte, 64)); n > 0 {
+		t.Error("Message was written to the PTY")
+	}
+}
+
+// waitAttached waits until n clients are attached to srv
+func waitAttached(t *testing.T, srv *Server, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		srv.Lock.Lock()
+		attached := len(srv.attached)
+		srv.Lock.Unlock()
+		if attached == n {
+			return
+		}
+	}
+	t.Fatalf("Expected %d clients to attach", n)
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	t.Setenv("PERSISHTENT_DIR", t.TempDir())
+	pr, pw, _ := os.Pipe()
+	defer func() {
+		_ = pr.Close()
+		_ = pw.Close()
+	}()
+	// The shell ignores SIGTERM, so only the escalation ends it
+	cmd := exec.Command("sh", "-c", `trap "" TERM; sleep 10`)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Clients: make(map[net.Conn]struct{}), Cmd: cmd}
+	s, c := net.Pipe()
+	defer func() { _ = c.Close() }()
+	go srv.handleClient(s, pw)
+	_ = protocol.WritePacket(c, protocol.TypeMode, []byte{protocol.ModeReadOnly})
+	time.Sleep(100 * time.Millisecond)
+
+	// Without a timeout the shell would never get SIGKILL
+	if err := srv.shutdown(protocol.Shutdown{Reason: "maintenance"}); err == nil {
+		t.Error("Expected a shutdown without a timeout to be refused")
+	}
+	if err := srv.shutdown(protocol.Shutdown{Reason: "maintenance", From: "alice@box (pid 1)", Timeout: 200 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	// Attached clients are told why
+	_ = c.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		typ, payload, err := protocol.ReadPacket(c)
+		if err != nil {
+			t.Fatalf("No shutdown notice: %v", err)
+		}
+		if typ == protocol.TypeMessage {
+			var msg protocol.Message
+			if err := json.Unmarshal(payload, &msg); err != nil || msg.Text != "session shutting down: maintenance" {
+				t.Errorf("Unexpected notice %q", payload)
+			}
+			break
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		_ = cmd.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		if ws := cmd.ProcessState.Sys().(syscall.WaitStatus); !ws.Signaled() || ws.Signal() != syscall.SIGKILL {
+			t.Errorf("Shell ended with %v, want SIGKILL", cmd.ProcessState)
+		}
+	case <-time.After(2 * time.Second):
+		_ = cmd.Process.Kill()
+		t.Fatal("Shell still running after the shutdown timeout")
+	}
+}
+
+func TestServer_Sweep(t *testing.T) {
+	pr, pw, _ := os.Pipe()
+	defer func() {
+		_ = pr.Close()
+		_ = pw.Close()
+	}()
+	srv := &Server{Clients: make(map[net.Conn]struct{})}
+	connect := func(mode byte, caps protocol.Caps, user string) (net.Conn, chan struct{}) {
+		s, c := net.Pipe()
+		go func() {
+			_ = protocol.WritePacket(c, protocol.TypeMode, protocol.AppendIdentity(protocol.ModePayload(mode, caps|protocol.CapIdentity, 0), protocol.Identity{User: user, Host: "box"}))
+		}()
+		done := make(chan struct{})
+		go func() {
+			srv.handleClient(s, pw)
+			close(done)
+		}()
+		time.Sleep(100 * time.Millisecond)
+		return c, done
+	}
+
+	// The Master stopped reading, the viewer answers pings and the old client
+	// can't be pinged
+	stale, done1 := connect(protocol.ModeMaster, protocol.CapPing, "stale")
+	viewer, done2 := connect(protocol.ModeReadOnly, protocol.CapPing, "viewer")
+	old, done3 := connect(protocol.ModeReadOnly, 0, "old")
+	go func() {
+		for {
+			typ, _, err := protocol.ReadPacket(viewer)
+			if err != nil {
+				return
+			}
+			if typ == protocol.TypePing {
+				_ = protocol.WritePacket(viewer, protocol.TypePing, nil)
+			}
+		}
+	}()
+
+	srv.sweep(time.Now().Add(-time.Hour))
+	time.Sleep(100 * time.Millisecond)
+	srv.sweep(time.Now().Add(time.Second))
+	list := srv.clientList()
+	if len(list) != 2 || list[0].User != "viewer" || list[1].User != "old" {
+		t.Errorf("Expected the stale Master to be detached, got %+v", list)
+	}
+	srv.Lock.Lock()
+	if srv.Master != nil {
+		t.Error("The stale Master still holds the Master slot")
+	}
+	pinged := false
+	for conn, c := range srv.attached {
+		if c.User == "viewer" {
+			_, pinged = srv.pings[conn]
+		}
+	}
+	srv.Lock.Unlock()
+	if !pinged {
+		t.Error("Expected the viewer to be pinged again")
+	}
+
+	<-done1
+	_ = stale.Close()
+	_ = viewer.Close()
+	_ = old.Close()
+	<-done2
+	<-done3
+}
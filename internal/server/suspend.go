@@ -0,0 +1,77 @@
+package server
+
+import (
+	"errors"
+	"slices"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"persishtent/internal/session"
+)
+
+// suspend stops (stop == true) or continues all processes of the session.
+// The shell is stopped before its jobs and continued after them, so it never
+// notices a job being stopped and doesn't take the terminal back from it.
+func (s *Server) suspend(stop bool) error {
+	if s.device {
+		return errors.New("serial device sessions cannot be suspended")
+	}
+	if s.Cmd == nil || s.Cmd.Process == nil {
+		return errors.New("session has no process")
+	}
+	s.Lock.Lock()
+	if s.suspended == stop {
+		s.Lock.Unlock()
+		return nil
+	}
+	s.suspended = stop
+	s.Lock.Unlock()
+
+	shell := s.Cmd.Process.Pid
+	groups := session.ProcGroups(shell)
+	if s.ptmx != nil {
+		// The foreground job, in case the process table can't be scanned
+		if pgrp, err := unix.IoctlGetInt(int(s.ptmx.Fd()), unix.TIOCGPGRP); err == nil && !slices.Contains(groups, pgrp) {
+			groups = append(groups, pgrp)
+		}
+	}
+	var jobs []int
+	for _, pgrp := range groups {
+		if pgrp > 0 && pgrp != shell {
+			jobs = append(jobs, pgrp)
+		}
+	}
+
+	if stop {
+		_ = syscall.Kill(-shell, syscall.SIGSTOP)
+		waitStopped(shell)
+		for _, pgrp := range jobs {
+			_ = syscall.Kill(-pgrp, syscall.SIGSTOP)
+		}
+		logf("session suspended")
+	} else {
+		for _, pgrp := range jobs {
+			_ = syscall.Kill(-pgrp, syscall.SIGCONT)
+		}
+		_ = syscall.Kill(-shell, syscall.SIGCONT)
+		logf("session resumed")
+	}
+
+	state := ""
+	if stop {
+		state = session.StateSuspended
+	}
+	s.updateInfo(func(info *session.Info) { info.State = state })
+	return nil
+}
+
+// waitStopped waits briefly for a process to enter the stopped state.
+func waitStopped(pid int) {
+	for range 20 {
+		if state, err := session.ProcState(pid); err != nil || state == 'T' {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
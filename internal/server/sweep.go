@@ -0,0 +1,69 @@
+package server
+
+import (
+	"net"
+	"time"
+
+	"persishtent/internal/config"
+	"persishtent/internal/protocol"
+	"persishtent/internal/session"
+)
+
+// ping is an unanswered TypePing sent to a client.
+type ping struct {
+	sent    time.Time
+	written uint64 // Packets written to the client at the last sweep, see outQueue
+	queued  uint64 // Packets to write up to and including the ping
+}
+
+// sweepClients pings the attached clients every client_keepalive seconds
+// until the daemon exits, see sweep.
+func (s *Server) sweepClients() {
+	for {
+		interval := time.Duration(config.Current().ClientKeepalive * float64(time.Second))
+		if interval <= 0 {
+			// Disabled until a reload sets it
+			time.Sleep(housekeepingInterval)
+			continue
+		}
+		time.Sleep(interval)
+		s.sweep(time.Now().Add(-interval))
+	}
+}
+
+// sweep detaches clients that neither answered a TypePing sent before
+// expired nor read anything since, and pings the others. A client that
+// stopped reading, e.g. behind an ssh connection that died without closing
+// its socket, would otherwise hold the Master slot until a write to it times
+// out, which only happens once enough output piled up. A client still
+// working through a long replay keeps reading, so it isn't detached. Clients
+// without CapPing are left alone.
+func (s *Server) sweep(expired time.Time) {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	if s.pings == nil {
+		s.pings = make(map[net.Conn]ping)
+	}
+	for conn, c := range s.attached {
+		q, ok := s.queues[conn]
+		if !ok || s.caps[conn]&protocol.CapPing == 0 {
+			continue
+		}
+		written := q.written.Load()
+		if p, ok := s.pings[conn]; ok {
+			switch {
+			case written < p.queued && written != p.written:
+				// Still catching up with the output before the ping
+				p.sent, p.written = time.Now(), written
+				s.pings[conn] = p
+			case !p.sent.After(expired):
+				logf("client %s stopped responding, disconnecting", c.Identity)
+				s.audit(session.AuditEvent{Event: session.AuditKick, Client: c.Identity.String(), Mode: clientMode(c), Detail: "not responding"})
+				s.dropClient(conn)
+			}
+			continue
+		}
+		s.send(conn, protocol.TypePing, nil)
+		s.pings[conn] = ping{sent: time.Now(), written: written, queued: q.queued}
+	}
+}
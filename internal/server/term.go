@@ -0,0 +1,63 @@
+package server
+
+import (
+	"strings"
+
+	"persishtent/internal/config"
+	"persishtent/internal/protocol"
+	"persishtent/internal/session"
+)
+
+// defaultTerm is the TERM of sessions until a master reports its terminal
+const defaultTerm = "xterm-256color"
+
+// sessionTerm returns TERM and COLORTERM for a shell shown on a terminal of
+// type term. The term setting takes precedence over the terminal's TERM.
+func sessionTerm(term, colorTerm string) (string, string) {
+	if config.Current().Term != "" {
+		term = config.Current().Term
+	}
+	if term == "" {
+		term = defaultTerm
+	}
+	return term, colorTerm
+}
+
+// termEnv replaces TERM and COLORTERM inherited from the starting terminal,
+// which need not be the one the session is shown on.
+func termEnv(env []string, term, colorTerm string) []string {
+	out := make([]string, 0, len(env)+2)
+	for _, kv := range env {
+		key, _, _ := strings.Cut(kv, "=")
+		if key == "TERM" || key == "COLORTERM" {
+			continue
+		}
+		out = append(out, kv)
+	}
+	out = append(out, "TERM="+term)
+	if colorTerm != "" {
+		out = append(out, "COLORTERM="+colorTerm)
+	}
+	return out
+}
+
+// adoptTerm passes the terminal type of the session's first master to the
+// shell through the env file, for sessions started without a terminal. The
+// shell picks it up before its next prompt. Callers hold s.Lock.
+func (s *Server) adoptTerm(id protocol.Identity) {
+	if s.termSet || s.device || id.Term == "" {
+		return
+	}
+	s.termSet = true
+	term, colorTerm := sessionTerm(id.Term, id.ColorTerm)
+	s.env.export("TERM", term)
+	if colorTerm != "" {
+		s.env.export("COLORTERM", colorTerm)
+	}
+	if info, err := session.ReadInfo(s.Name); err == nil {
+		info.Term = term
+		s.infoErr = session.WriteInfo(info)
+		s.info = info
+	}
+	logf("using terminal type %s of %s", term, id)
+}
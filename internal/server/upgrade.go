@@ -0,0 +1,350 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/creack/pty"
+	"golang.org/x/sys/unix"
+	"persishtent/internal/ansi"
+	"persishtent/internal/config"
+	"persishtent/internal/protocol"
+	"persishtent/internal/session"
+)
+
+// handover is the state of a session passed to the daemon taking it over,
+// besides the PTY and the listening socket. Both daemons may run different
+// versions, so fields are only ever added.
+type handover struct {
+	Name       string            `json:"name"`
+	Options    Options           `json:"options"`
+	SockPath   string            `json:"sock_path"`
+	Device     bool              `json:"device,omitempty"`
+	TTY        string            `json:"tty,omitempty"` // Terminal of the shell, see reopenPTY
+	Info       session.Info      `json:"info"`
+	Log        string            `json:"log,omitempty"` // Active log file, empty if output isn't logged
+	Rotations  uint64            `json:"rotations"`
+	LogBytes   uint64            `json:"log_bytes"`
+	Scrollback []byte            `json:"scrollback"`
+	Trimmed    bool              `json:"trimmed,omitempty"`
+	OutputSize uint64            `json:"output_size"`
+	BytesIn    uint64            `json:"bytes_in"`
+	BytesOut   uint64            `json:"bytes_out"`
+	Stalls     uint64            `json:"stalls"`
+	Connects   int               `json:"connects"`
+	Env        map[string]string `json:"env,omitempty"`       // Forwarded variables as seen by the shell
+	EnvLinks   map[string]string `json:"env_links,omitempty"` // Symlinks of forwarded paths
+	Suspended  bool              `json:"suspended,omitempty"`
+	TermSet    bool              `json:"term_set,omitempty"`
+	Cast       *castPosition     `json:"cast,omitempty"`
+}
+
+// castPosition is the timing state of an asciicast recording
+type castPosition struct {
+	Start   time.Time     `json:"start"`
+	Last    time.Time     `json:"last"`
+	Skipped time.Duration `json:"skipped"`
+}
+
+// handoverMagic is the data sent along with the file descriptors
+const handoverMagic = "persishtent-upgrade"
+
+// pollInterval bounds how long waitReadable blocks, so that closing the PTY
+// ends the output loop
+const pollInterval = time.Second
+
+// upgrade hands the session over to the daemon binary req.Executable, which
+// replaces this process. It only returns if the handover failed, leaving the
+// session to this daemon.
+func (s *Server) upgrade(req protocol.Upgrade) error {
+	exe := req.Executable
+	if !filepath.IsAbs(exe) {
+		return fmt.Errorf("%s is not an absolute path", exe)
+	}
+	// The new daemon can't reap a command started by this one
+	s.Lock.Lock()
+	pipe := s.pipe
+	s.Lock.Unlock()
+	if pipe != nil {
+		return fmt.Errorf("output is piped to %s, stop the pipe first", pipe.command)
+	}
+	// A binary that can't take over would leave the shell without its PTY
+	if err := exec.Command(exe, "daemon", "-can-upgrade").Run(); err != nil {
+		return fmt.Errorf("%s can't take over sessions: %w", exe, err)
+	}
+	// The output loop would hold s.output in a read that waits for output
+	if err := checkWaitable(s.ptmx); err != nil {
+		return err
+	}
+
+	// The output loop stops between two reads, so no output is lost
+	s.output.Lock()
+	defer s.output.Unlock()
+	if s.logger != nil {
+		if err := s.logger.Checkpoint(); err != nil {
+			return fmt.Errorf("log can't be written: %w", err)
+		}
+	}
+	state, err := s.handoverFile()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = state.Close() }()
+	s.Lock.Lock()
+	l, ok := s.listener.(*net.UnixListener)
+	s.Lock.Unlock()
+	if !ok {
+		return fmt.Errorf("session socket can't be passed on")
+	}
+	listener, err := l.File()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = listener.Close() }()
+
+	// Only the new daemon's end survives exec
+	syscall.ForkLock.RLock()
+	pair, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err == nil {
+		unix.CloseOnExec(pair[0])
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = unix.Close(pair[0])
+		_ = unix.Close(pair[1])
+	}()
+	if err := sendHandover(pair[0], s.ptmx, listener, state); err != nil {
+		return err
+	}
+
+	logf("handing the session over to %s, requested by %s", exe, req.From)
+	s.Lock.Lock()
+	s.audit(session.AuditEvent{Event: session.AuditUpgrade, By: req.From, Detail: exe})
+	s.Lock.Unlock()
+	debugLog.flush()
+	err = syscall.Exec(exe, []string{exe, "daemon", "-upgrade", strconv.Itoa(pair[1])}, os.Environ())
+	errorf("starting %s failed: %v", exe, err)
+	return err
+}
+
+// handoverFile writes the session state to an unlinked temporary file, read
+// from the start by the new daemon.
+func (s *Server) handoverFile() (*os.File, error) {
+	h := handover{
+		Device:   s.device,
+		TTY:      s.ttyName,
+		BytesIn:  s.bytesIn.Load(),
+		BytesOut: s.bytesOut.Load(),
+		Stalls:   s.stalls.Load(),
+		Env:      s.env.values(),
+		EnvLinks: s.env.linkPaths(),
+	}
+	if s.logger != nil {
+		h.Log = s.logger.Path()
+		h.Rotations = s.logger.Rotations()
+		h.LogBytes = s.logger.Written()
+	}
+	if s.cast != nil {
+		start, last, skipped := s.cast.position()
+		h.Cast = &castPosition{Start: start, Last: last, Skipped: skipped}
+	}
+	s.Lock.Lock()
+	h.Name = s.Name
+	h.Options = s.options
+	h.SockPath = s.sockPath
+	h.Info = s.info
+	h.Scrollback = s.scrollback.buf
+	h.Trimmed = s.scrollback.trimmed
+	h.OutputSize = s.outputSize
+	h.Connects = s.lastID
+	h.Suspended = s.suspended
+	h.TermSet = s.termSet
+	data, err := json.Marshal(h)
+	s.Lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := session.EnsureDir()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(dir, ".upgrade-*")
+	if err != nil {
+		return nil, err
+	}
+	_ = os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// sendHandover passes the PTY, the listening socket and the state file over
+// the Unix socket fd.
+func sendHandover(fd int, ptmx, listener, state *os.File) error {
+	rights := unix.UnixRights(int(ptmx.Fd()), int(listener.Fd()), int(state.Fd()))
+	return unix.Sendmsg(fd, []byte(handoverMagic), rights, nil, 0)
+}
+
+// receiveHandover receives the files sent with sendHandover.
+func receiveHandover(fd int) (ptmx, listener, state *os.File, err error) {
+	buf := make([]byte, len(handoverMagic))
+	oob := make([]byte, unix.CmsgSpace(3*4))
+	n, oobn, _, _, err := unix.Recvmsg(fd, buf, oob, 0)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var fds []int
+	for _, msg := range msgs {
+		rights, err := unix.ParseUnixRights(&msg)
+		if err == nil {
+			fds = append(fds, rights...)
+		}
+	}
+	if string(buf[:n]) != handoverMagic || len(fds) != 3 {
+		for _, fd := range fds {
+			_ = unix.Close(fd)
+		}
+		return nil, nil, nil, fmt.Errorf("invalid session handover")
+	}
+	for _, fd := range fds {
+		unix.CloseOnExec(fd)
+	}
+	return os.NewFile(uintptr(fds[0]), "/dev/ptmx"), os.NewFile(uintptr(fds[1]), "listener"), os.NewFile(uintptr(fds[2]), "handover"), nil
+}
+
+// Resume takes over a session handed over by the daemon this process
+// replaced, from the Unix socket fd. It blocks until the shell process exits.
+func Resume(fd int) error {
+	ptmx, lf, sf, err := receiveHandover(fd)
+	_ = unix.Close(fd)
+	if err != nil {
+		errorf("%v", err)
+		return err
+	}
+	defer func() { _ = ptmx.Close() }()
+	var h handover
+	err = json.NewDecoder(sf).Decode(&h)
+	_ = sf.Close()
+	if err != nil {
+		_ = lf.Close()
+		errorf("reading the session handover failed: %v", err)
+		return err
+	}
+	l, err := net.FileListener(lf)
+	_ = lf.Close()
+	if err != nil {
+		errorf("session socket not taken over: %v", err)
+		return err
+	}
+
+	name := h.Name
+	defer recoverCrash(name)
+	debugLog.setName(name)
+	defer debugLog.flush()
+	profile := config.Current().Profiles[h.Options.Profile]
+	config.Update(profile.ApplyLogSettings)
+
+	// The log and recording continue where the old daemon left them
+	var logger *LogRotator
+	var logOut io.Writer = io.Discard
+	if h.Log != "" {
+		// The shell outlives a log that can't be continued
+		if logger, err = ResumeLogRotator(name, h.Log, h.Rotations, h.LogBytes); err == nil {
+			defer func() { _ = logger.Close() }()
+			logOut = logger
+			if config.Current().LogStripGraphics {
+				logOut = ansi.NewGraphicsFilter(logger)
+			}
+		} else {
+			errorf("log not taken over, output is no longer logged: %v", err)
+			logger = nil
+		}
+	}
+	var cast *castRecorder
+	if h.Cast != nil && h.Info.Recording != "" {
+		maxPause := time.Duration(config.Current().RecordMaxPause * float64(time.Second))
+		if cast, err = resumeCastRecorder(h.Info.Recording, h.Cast.Start, h.Cast.Last, h.Cast.Skipped, maxPause); err == nil {
+			defer func() { _ = cast.Close() }()
+		} else {
+			errorf("recording not taken over: %v", err)
+			cast = nil
+		}
+	}
+
+	env := newForwardedEnv(name)
+	env.restore(h.Env, h.EnvLinks)
+	nameFile, _ := session.GetNameFilePath(os.Getpid())
+	defer func() { _ = os.Remove(nameFile) }()
+
+	// The shell is still a child of this process, which kept its PID
+	var cmd *exec.Cmd
+	if !h.Device {
+		proc, err := os.FindProcess(h.Info.PID)
+		if err != nil {
+			return err
+		}
+		cmd = &exec.Cmd{Process: proc}
+	}
+
+	srv := &Server{
+		Name:       name,
+		Cmd:        cmd,
+		Clients:    make(map[net.Conn]struct{}),
+		ephemeral:  h.Options.Ephemeral,
+		exclusive:  h.Options.Exclusive,
+		linger:     h.Options.Linger,
+		customSock: h.Options.SockPath != "",
+		logger:     logger,
+		customLog:  h.Options.LogPath != "",
+		profile:    h.Options.Profile,
+		nameFile:   nameFile,
+		ptmx:       ptmx,
+		ttyName:    h.TTY,
+		device:     h.Device,
+		env:        env,
+		started:    h.Info.StartTime,
+		upgraded:   time.Now(),
+		cast:       cast,
+		info:       h.Info,
+		options:    h.Options,
+		suspended:  h.Suspended,
+		termSet:    h.TermSet,
+		lastID:     h.Connects,
+		outputSize: h.OutputSize,
+		scrollback: scrollback{buf: h.Scrollback, size: config.Current().ScrollbackSizeMB * 1024 * 1024, trimmed: h.Trimmed},
+		screen:     ansi.NewScreen(24, 80, screenHistory),
+	}
+	if size, err := pty.GetsizeFull(ptmx); err == nil && size.Rows > 0 && size.Cols > 0 {
+		srv.screen = ansi.NewScreen(int(size.Rows), int(size.Cols), screenHistory)
+	}
+	_, _ = srv.screen.Write(h.Scrollback)
+	srv.bytesIn.Store(h.BytesIn)
+	srv.bytesOut.Store(h.BytesOut)
+	srv.stalls.Store(h.Stalls)
+	srv.serveListener(l, h.SockPath)
+
+	logf("session %s taken over (pid %d)", name, h.Info.PID)
+	return srv.serve(h.Options.Keepalive, logOut)
+}
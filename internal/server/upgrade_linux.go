@@ -0,0 +1,29 @@
+package server
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// waitReadable waits up to pollInterval for f to have data to read. It
+// returns true as well if the wait failed, so the read reports the error.
+func waitReadable(f *os.File) bool {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return true
+	}
+	ready := true
+	_ = rc.Control(func(fd uintptr) {
+		fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+		n, err := unix.Poll(fds, int(pollInterval.Milliseconds()))
+		ready = n > 0 || err != nil && !errors.Is(err, unix.EINTR)
+	})
+	return ready
+}
+
+// checkWaitable returns an error if waitReadable can't wait for f
+func checkWaitable(f *os.File) error {
+	return nil
+}
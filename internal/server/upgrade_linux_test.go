@@ -0,0 +1,33 @@
+package server
+
+import (
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestWaitReadable_HighFD(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = w.Close() }()
+	defer func() { _ = r.Close() }()
+
+	// Above the descriptors select can wait for
+	fd, err := unix.FcntlInt(r.Fd(), unix.F_DUPFD_CLOEXEC, 2000)
+	if err != nil {
+		t.Skipf("no descriptor above 2000: %v", err)
+	}
+	high := os.NewFile(uintptr(fd), "pipe")
+	defer func() { _ = high.Close() }()
+
+	if waitReadable(high) {
+		t.Error("An empty pipe should not be readable")
+	}
+	_, _ = w.Write([]byte("x"))
+	if !waitReadable(high) {
+		t.Error("A pipe with data should be readable")
+	}
+}
@@ -0,0 +1,54 @@
+//go:build !linux
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxSelectFD is the lowest descriptor select can't wait for
+const maxSelectFD = 1024
+
+// waitReadable waits up to pollInterval for f to have data to read. It
+// returns true as well if the wait failed, so the read reports the error.
+// select is used since poll doesn't support devices on macOS.
+func waitReadable(f *os.File) bool {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return true
+	}
+	ready := true
+	_ = rc.Control(func(fd uintptr) {
+		if fd >= maxSelectFD {
+			return
+		}
+		var set unix.FdSet
+		set.Set(int(fd))
+		tv := unix.NsecToTimeval(pollInterval.Nanoseconds())
+		n, err := unix.Select(int(fd)+1, &set, nil, nil, &tv)
+		ready = n > 0 || err != nil && !errors.Is(err, unix.EINTR)
+	})
+	return ready
+}
+
+// checkWaitable returns an error if waitReadable can't wait for f
+func checkWaitable(f *os.File) error {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var high uintptr
+	_ = rc.Control(func(fd uintptr) {
+		if fd >= maxSelectFD {
+			high = fd
+		}
+	})
+	if high != 0 {
+		return fmt.Errorf("the PTY's descriptor %d is too high to wait for output", high)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+	"persishtent/internal/protocol"
+)
+
+func TestHandover(t *testing.T) {
+	pair, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = unix.Close(pair[0]) }()
+
+	var files []*os.File
+	for _, content := range []string{"ptmx", "listener", "state"} {
+		f, err := os.CreateTemp(t.TempDir(), content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = f.WriteString(content)
+		_, _ = f.Seek(0, 0)
+		defer func() { _ = f.Close() }()
+		files = append(files, f)
+	}
+	if err := sendHandover(pair[0], files[0], files[1], files[2]); err != nil {
+		t.Fatalf("sendHandover: %v", err)
+	}
+
+	ptmx, listener, state, err := receiveHandover(pair[1])
+	_ = unix.Close(pair[1])
+	if err != nil {
+		t.Fatalf("receiveHandover: %v", err)
+	}
+	for i, f := range []*os.File{ptmx, listener, state} {
+		data, _ := io.ReadAll(f)
+		_ = f.Close()
+		if want := []string{"ptmx", "listener", "state"}[i]; string(data) != want {
+			t.Errorf("File %d holds %q, want %q", i, data, want)
+		}
+	}
+}
+
+func TestReceiveHandover_Invalid(t *testing.T) {
+	pair, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = unix.Close(pair[0]) }()
+	defer func() { _ = unix.Close(pair[1]) }()
+
+	if _, err := unix.Write(pair[0], []byte(handoverMagic)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := receiveHandover(pair[1]); err == nil {
+		t.Error("A handover without files should fail")
+	}
+}
+
+func TestUpgrade_Pipe(t *testing.T) {
+	srv := &Server{pipe: &outputPipe{command: "cat > out"}}
+	err := srv.upgrade(protocol.Upgrade{Executable: "/bin/true"})
+	if err == nil || !strings.Contains(err.Error(), "cat > out") {
+		t.Errorf("Upgrade with an active pipe = %v", err)
+	}
+}
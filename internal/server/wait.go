@@ -0,0 +1,95 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"persishtent/internal/config"
+	"persishtent/internal/session"
+)
+
+// defaultWaitTimeout is how long a daemon waits for the preconditions of its
+// profile unless the profile sets wait_timeout.
+const defaultWaitTimeout = 5 * time.Minute
+
+// waitInterval is how often an unmet precondition is checked again.
+const waitInterval = time.Second
+
+// waitPreconditions waits until all preconditions hold, in order, before the
+// session command is started. The session info names the one being waited
+// for, which keeps the session listed although it has no socket yet.
+func waitPreconditions(info session.Info, conds []config.Precondition, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for _, cond := range conds {
+		logf("waiting for %s", cond)
+		var written time.Time
+		for {
+			err := checkPrecondition(cond)
+			if err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("gave up waiting for %s after %s: %w", cond, timeout, err)
+			}
+			if time.Since(written) >= housekeepingInterval || info.Waiting != cond.String() {
+				info.Waiting = cond.String()
+				info.Heartbeat = time.Now()
+				_ = session.WriteInfo(info)
+				written = info.Heartbeat
+			}
+			time.Sleep(waitInterval)
+		}
+	}
+	return nil
+}
+
+// checkPrecondition returns why cond doesn't hold, or nil if it does.
+func checkPrecondition(cond config.Precondition) error {
+	switch {
+	case cond.TCP != "":
+		conn, err := net.DialTimeout("tcp", cond.TCP, waitInterval)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case cond.Mount != "":
+		return checkMount(cond.Mount)
+	}
+	return nil
+}
+
+// checkMount reports whether path is a mount point, i.e. on another device
+// than its parent directory. Stat also triggers automounts. Bind mounts of a
+// directory on the same file system aren't recognized.
+func checkMount(path string) error {
+	var st, parent syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return err
+	}
+	if err := syscall.Stat(filepath.Join(path, ".."), &parent); err != nil {
+		return err
+	}
+	if st.Dev == parent.Dev && st.Ino != parent.Ino {
+		return fmt.Errorf("%s is not mounted", path)
+	}
+	return nil
+}
+
+// waitTimeout returns the wait_timeout of a profile as a duration.
+func waitTimeout(p config.Profile) time.Duration {
+	if p.WaitTimeout <= 0 {
+		return defaultWaitTimeout
+	}
+	return time.Duration(p.WaitTimeout * float64(time.Second))
+}
+
+// removeInfo deletes the info file of a session that never started.
+func removeInfo(name string) {
+	if path, err := session.GetInfoPath(name); err == nil {
+		_ = os.Remove(path)
+	}
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"persishtent/internal/config"
+	"persishtent/internal/session"
+)
+
+func TestCheckPrecondition(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+
+	if err := checkPrecondition(config.Precondition{TCP: addr}); err != nil {
+		t.Errorf("Listening port not reachable: %v", err)
+	}
+	_ = l.Close()
+	if err := checkPrecondition(config.Precondition{TCP: addr}); err == nil {
+		t.Error("Closed port should not be reachable")
+	}
+
+	if err := checkPrecondition(config.Precondition{Mount: "/"}); err != nil {
+		t.Errorf("/ should count as mounted: %v", err)
+	}
+	if err := checkPrecondition(config.Precondition{Mount: t.TempDir()}); err == nil {
+		t.Error("Plain directory should not count as mounted")
+	}
+	if err := checkPrecondition(config.Precondition{Mount: "/does/not/exist"}); err == nil {
+		t.Error("Missing path should not count as mounted")
+	}
+}
+
+func TestWaitPreconditions(t *testing.T) {
+	t.Setenv("PERSISHTENT_DIR", t.TempDir())
+
+	// The port opens while the daemon waits
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+	go func() {
+		time.Sleep(1500 * time.Millisecond)
+		if l, err := net.Listen("tcp", addr); err == nil {
+			time.Sleep(2 * time.Second)
+			_ = l.Close()
+		}
+	}()
+
+	info := session.Info{Name: "waiter", PID: 1}
+	conds := []config.Precondition{{Name: "db", TCP: addr}}
+	if err := waitPreconditions(info, conds, 10*time.Second); err != nil {
+		t.Fatalf("waitPreconditions failed: %v", err)
+	}
+	got, err := session.ReadInfo("waiter")
+	if err != nil || got.Waiting != "db" {
+		t.Errorf("Waiting not recorded: %+v, %v", got, err)
+	}
+
+	conds = []config.Precondition{{Mount: t.TempDir()}}
+	err = waitPreconditions(info, conds, 0)
+	if err == nil || !strings.Contains(err.Error(), "gave up waiting") {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+
+	"persishtent/internal/session"
+)
+
+// sleepThreshold is how far the wall clock may get ahead of the monotonic
+// clock between two housekeeping rounds before the daemon assumes that the
+// machine was asleep. The monotonic clock stands still during sleep.
+const sleepThreshold = 10 * time.Second
+
+// slept reports whether the machine slept since start, a time.Now reading.
+func slept(start time.Time) bool {
+	now := time.Now()
+	return now.Round(0).Sub(start.Round(0))-now.Sub(start) > sleepThreshold
+}
+
+// resumed catches up after the machine woke from sleep, e.g. a laptop whose
+// lid was closed: the log is reopened in case it was removed meanwhile, and
+// pings sent before the sleep are forgotten, so clients get a full
+// client_keepalive to answer instead of being detached right away.
+func (s *Server) resumed() {
+	logf("resumed from sleep")
+	if s.logger != nil {
+		_ = s.logger.Reopen()
+	}
+	s.Lock.Lock()
+	clear(s.pings)
+	s.Lock.Unlock()
+}
+
+// reopenPTY reports whether the output loop may read the PTY again after
+// err. Reads fail once no process has the terminal open, which is how the
+// loop learns that the shell exited. They fail as well while the shell still
+// runs if the PTY lost its terminal side, e.g. around sleep on macOS or when
+// the command closes its terminal to run in the background; the daemon then
+// opens the terminal itself and holds it until the shell exits, see
+// releasePTY. Must be called with s.output held.
+func (s *Server) reopenPTY(err error) bool {
+	if s.ttyName == "" || s.tty != nil || s.Cmd == nil || errors.Is(err, os.ErrClosed) || !session.IsPIDAlive(s.Cmd.Process.Pid) {
+		return false
+	}
+	tty, openErr := os.OpenFile(s.ttyName, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if openErr != nil {
+		logf("reading the terminal failed (%v), reopening %s failed: %v", err, s.ttyName, openErr)
+		return false
+	}
+	logf("reading the terminal failed (%v) while the shell runs, reopened %s", err, s.ttyName)
+	s.tty = tty
+	return true
+}
+
+// releasePTY closes the terminal held by reopenPTY once the shell exited, so
+// the output loop reads what is left and ends.
+func (s *Server) releasePTY() {
+	s.output.Lock()
+	defer s.output.Unlock()
+	s.ttyName = ""
+	if s.tty != nil {
+		_ = s.tty.Close()
+		s.tty = nil
+	}
+}
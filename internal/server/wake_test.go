@@ -0,0 +1,47 @@
+package server
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/creack/pty"
+)
+
+func TestServer_ReopenPTY(t *testing.T) {
+	// The command lets go of its terminal but keeps running
+	cmd := exec.Command("sh", "-c", "exec </dev/null >/dev/null 2>&1; sleep 10")
+	ptmx, err := pty.Start(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ptmx.Close() }()
+	defer func() { _ = cmd.Process.Kill(); _ = cmd.Wait() }()
+	s := &Server{Cmd: cmd, ptmx: ptmx, ttyName: cmd.Stdin.(*os.File).Name()}
+
+	_ = ptmx.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	for err == nil {
+		_, err = ptmx.Read(buf)
+	}
+	if !s.reopenPTY(err) || s.tty == nil {
+		t.Fatalf("Terminal not reopened after %v", err)
+	}
+	if _, err := io.WriteString(s.tty, "still here"); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := ptmx.Read(buf); err != nil || string(buf[:n]) != "still here" {
+		t.Errorf("Read %q (%v) after reopening", buf[:n], err)
+	}
+	if s.reopenPTY(err) {
+		t.Error("Terminal reopened twice")
+	}
+
+	// Once the shell exited, reads end the output loop
+	s.releasePTY()
+	if s.tty != nil || s.reopenPTY(io.EOF) {
+		t.Error("Terminal still held after releasePTY")
+	}
+}
@@ -0,0 +1,101 @@
+package session
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Audit events, see AuditEvent
+const (
+	AuditStart  = "start"
+	AuditAttach = "attach"
+	AuditDetach = "detach"
+	AuditKick   = "kick"
+	AuditGrant  = "grant"
+	AuditRevoke = "revoke"
+	AuditSignal = "signal"
+	AuditRename = "rename"
+	AuditExit   = "exit"
+	// AuditShutdown records a shutdown request, before the exit it causes
+	AuditShutdown = "shutdown"
+	// AuditUpgrade records that the daemon handed the session over to
+	// another binary
+	AuditUpgrade = "upgrade"
+)
+
+// AuditEvent is an entry of the audit log, which records who attached to
+// which session and what was done to it. Daemons append one JSON object per
+// line and never rewrite the file.
+type AuditEvent struct {
+	Time    time.Time `json:"time"`
+	Session string    `json:"session"`
+	Event   string    `json:"event"`
+	Client  string    `json:"client,omitempty"` // e.g. "alice@laptop (/dev/pts/3, pid 4242)"
+	Mode    string    `json:"mode,omitempty"`   // master or read-only
+	By      string    `json:"by,omitempty"`     // Who kicked, signalled or changed the client
+	Detail  string    `json:"detail,omitempty"` // e.g. the signal or exit status
+}
+
+// GetAuditPath returns the path of the audit log. It doesn't end in .log,
+// which Clean would take for the log of a session named audit.
+func GetAuditPath() (string, error) {
+	dir, err := EnsureDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "audit.jsonl"), nil
+}
+
+// AppendAudit adds e to the audit log. Each event is a single append, so
+// daemons writing at the same time don't interleave their lines.
+func AppendAudit(e AuditEvent) error {
+	path, err := GetAuditPath()
+	if err != nil {
+		return err
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	return errors.Join(err, f.Close())
+}
+
+// ReadAudit returns the events of the audit log in the order they were
+// recorded, only those of session name unless it is empty. Lines that can't
+// be parsed are skipped.
+func ReadAudit(name string) ([]AuditEvent, error) {
+	path, err := GetAuditPath()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	var events []AuditEvent
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e AuditEvent
+		if json.Unmarshal(scanner.Bytes(), &e) == nil && (name == "" || e.Session == name) {
+			events = append(events, e)
+		}
+	}
+	return events, scanner.Err()
+}
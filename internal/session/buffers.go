@@ -0,0 +1,137 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultBuffer is the paste buffer that copy mode and load-buffer fill
+// unless given another name
+const DefaultBuffer = "default"
+
+var (
+	// ErrBufferNotFound means there is no paste buffer of that name, or none at all
+	ErrBufferNotFound = errors.New("paste buffer not found")
+	// ErrInvalidBufferName means a buffer name is empty or has characters
+	// other than letters, digits, underscores and hyphens
+	ErrInvalidBufferName = errors.New("invalid buffer name")
+)
+
+// Buffer is a named paste buffer. Buffers are files in the state directory,
+// so all sessions and clients of the user share them.
+type Buffer struct {
+	Name     string
+	Size     int64
+	Modified time.Time
+}
+
+// GetBufferDir returns the directory holding the paste buffers
+func GetBufferDir() (string, error) {
+	dir, err := EnsureDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "buffers"), nil
+}
+
+// validateBufferName checks that name follows the rules of session names
+func validateBufferName(name string) error {
+	if name == "" {
+		return fmt.Errorf("%w: cannot be empty", ErrInvalidBufferName)
+	}
+	if !nameRegex.MatchString(name) {
+		return fmt.Errorf("%w: must only contain alphanumeric characters, underscores, and hyphens", ErrInvalidBufferName)
+	}
+	return nil
+}
+
+// WriteBuffer replaces the contents of paste buffer name with data
+func WriteBuffer(name string, data []byte) error {
+	if err := validateBufferName(name); err != nil {
+		return err
+	}
+	dir, err := GetBufferDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, name), data)
+}
+
+// ReadBuffer returns the contents of paste buffer name, or of the most
+// recently written buffer if name is empty
+func ReadBuffer(name string) ([]byte, error) {
+	if name == "" {
+		buffers, err := ListBuffers()
+		if err != nil {
+			return nil, err
+		}
+		if len(buffers) == 0 {
+			return nil, ErrBufferNotFound
+		}
+		name = buffers[0].Name
+	} else if err := validateBufferName(name); err != nil {
+		return nil, err
+	}
+	dir, err := GetBufferDir()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrBufferNotFound, name)
+	}
+	return data, err
+}
+
+// ListBuffers returns the paste buffers, most recently written first
+func ListBuffers() ([]Buffer, error) {
+	dir, err := GetBufferDir()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var buffers []Buffer
+	for _, e := range entries {
+		// Dot files are buffers still being written
+		if !e.Type().IsRegular() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		buffers = append(buffers, Buffer{Name: e.Name(), Size: fi.Size(), Modified: fi.ModTime()})
+	}
+	sort.SliceStable(buffers, func(i, j int) bool { return buffers[i].Modified.After(buffers[j].Modified) })
+	return buffers, nil
+}
+
+// RemoveBuffer deletes paste buffer name
+func RemoveBuffer(name string) error {
+	if err := validateBufferName(name); err != nil {
+		return err
+	}
+	dir, err := GetBufferDir()
+	if err != nil {
+		return err
+	}
+	err = os.Remove(filepath.Join(dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: %s", ErrBufferNotFound, name)
+	}
+	return err
+}
@@ -0,0 +1,266 @@
+package session
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DebugEvent is an entry of a daemon's debug log, which records what the
+// daemon did and what went wrong, one JSON object per line. Unlike the
+// session log it is kept after the session ended.
+type DebugEvent struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"` // config.DebugLogError, DebugLogInfo or DebugLogDebug
+	PID     int       `json:"pid"`   // Tells apart the daemons of sessions that had the same name
+	Message string    `json:"msg"`
+}
+
+// GetDebugLogPath returns the path of the debug log of session name. Once
+// the session ended, Archive moves it to the history along with the logs.
+func GetDebugLogPath(name string) (string, error) {
+	dir, err := EnsureDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name+".debug.jsonl"), nil
+}
+
+// AppendDebugLog adds e to the debug log of session name. A log that grew
+// beyond maxSize moves to the .1 file first, replacing an older one.
+func AppendDebugLog(name string, e DebugEvent, maxSize int64) error {
+	path, err := GetDebugLogPath(name)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if st, err := os.Stat(path); err == nil && st.Size()+int64(len(data)) > maxSize {
+		_ = os.Rename(path, path+".1")
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	return errors.Join(err, f.Close())
+}
+
+// RenameDebugLog moves the debug log of session oldName, including the
+// rotated file, to newName. The events are added to a debug log newName
+// has already, e.g. one left by an ended session of that name.
+func RenameDebugLog(oldName, newName string) error {
+	oldPath, err := GetDebugLogPath(oldName)
+	if err != nil {
+		return err
+	}
+	newPath, err := GetDebugLogPath(newName)
+	if err != nil {
+		return err
+	}
+	if !exists(newPath) && !exists(newPath+".1") {
+		_ = os.Rename(oldPath+".1", newPath+".1")
+		if err := os.Rename(oldPath, newPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	for _, p := range []string{oldPath + ".1", oldPath} {
+		if err := appendFile(newPath, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendFile appends the file src to dst and removes it. A missing src is
+// nothing to append.
+func appendFile(dst, src string) error {
+	data, err := os.ReadFile(src)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err := errors.Join(err, f.Close()); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// exists reports whether path exists
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// debugFiles are the suffixes of the files a daemon keeps for debugging
+// besides its logs: the debug log, its rotated file and the daemon output.
+// They outlive the session until it is archived or cleaned up.
+var debugFiles = []string{".debug.jsonl", ".debug.jsonl.1", ".out"}
+
+// debugFileSession returns the session a debug file belongs to, see debugFiles
+func debugFileSession(file string) (string, bool) {
+	for _, suffix := range debugFiles {
+		if name, ok := strings.CutSuffix(file, suffix); ok && name != "" {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// ReadDebugLog returns the events of the debug log of session name, oldest
+// first, taken from the history once the session was archived. Lines that
+// can't be parsed are skipped.
+func ReadDebugLog(name string) ([]DebugEvent, error) {
+	path, err := GetDebugLogPath(name)
+	if err != nil {
+		return nil, err
+	}
+	if !exists(path) && !exists(path+".1") {
+		if e, ok := FindHistory(name); ok {
+			path = filepath.Join(e.Dir, filepath.Base(path))
+		}
+	}
+	var events []DebugEvent
+	for _, p := range []string{path + ".1", path} {
+		f, err := os.Open(p)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var e DebugEvent
+			if json.Unmarshal(scanner.Bytes(), &e) == nil {
+				events = append(events, e)
+			}
+		}
+		err = scanner.Err()
+		_ = f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return events, nil
+}
+
+// GetDaemonOutputPath returns the path of the file catching the stdout and
+// stderr of the daemon of session name, such as the trace of a crash the
+// daemon couldn't report itself. Like the debug log, it moves to the history
+// when the session ends.
+func GetDaemonOutputPath(name string) (string, error) {
+	dir, err := EnsureDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name+".out"), nil
+}
+
+// CreateDaemonOutput empties the daemon output file of session name for a
+// new daemon and opens it.
+func CreateDaemonOutput(name string) (*os.File, error) {
+	path, err := GetDaemonOutputPath(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+}
+
+// ReadDaemonOutput returns the daemon output of session name, taken from
+// the history once the session was archived.
+func ReadDaemonOutput(name string) (string, error) {
+	path, err := GetDaemonOutputPath(name)
+	if err != nil {
+		return "", err
+	}
+	if e, ok := FindHistory(name); ok && !exists(path) {
+		path = filepath.Join(e.Dir, filepath.Base(path))
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	return string(data), err
+}
+
+// RenameDaemonOutput moves the daemon output file of session oldName to
+// newName. It refuses to replace the output of another daemon of that name.
+func RenameDaemonOutput(oldName, newName string) error {
+	oldPath, err := GetDaemonOutputPath(oldName)
+	if err != nil {
+		return err
+	}
+	newPath, err := GetDaemonOutputPath(newName)
+	if err != nil {
+		return err
+	}
+	if exists(newPath) {
+		return fmt.Errorf("%s exists already", newPath)
+	}
+	if err := os.Rename(oldPath, newPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// crashMarkers start the trace the Go runtime prints when a daemon dies
+var crashMarkers = []string{"panic: ", "fatal error: "}
+
+// ReadDaemonCrash returns the panic or fatal error trace in the daemon
+// output of session name, or an empty string if there is none.
+func ReadDaemonCrash(name string) string {
+	path, err := GetDaemonOutputPath(name)
+	if err != nil {
+		return ""
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	start := -1
+	for _, marker := range crashMarkers {
+		i := strings.Index("\n"+string(data), "\n"+marker)
+		if i >= 0 && (start < 0 || i < start) {
+			start = i
+		}
+	}
+	if start < 0 {
+		return ""
+	}
+	return string(data[start:])
+}
+
+// detectCrash marks a session whose daemon died without ending it as
+// crashed if the daemon output holds a crash trace, which happens when the
+// Go runtime kills the daemon before it can report the crash itself. The
+// trace goes to the session's crash report.
+func detectCrash(info *Info) {
+	if info.State == StateCrashed || !info.Ended.IsZero() {
+		return
+	}
+	trace := ReadDaemonCrash(info.Name)
+	if trace == "" {
+		return
+	}
+	info.State = StateCrashed
+	_ = WriteInfo(*info)
+	if path, err := GetCrashPath(info.Name); err == nil {
+		report := fmt.Sprintf("session: %s\ntime: %s\n\n== daemon output ==\n%s", info.Name, time.Now().Format(time.RFC3339), trace)
+		_ = os.WriteFile(path, []byte(report), 0600)
+	}
+}
@@ -0,0 +1,47 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Errors of session, client and server functions, so that callers can tell
+// failures apart with errors.Is instead of by their message.
+var (
+	// ErrSessionNotFound means no session of that name is running
+	ErrSessionNotFound = errors.New("session not found")
+	// ErrSessionExists means a session of that name is already running
+	ErrSessionExists = errors.New("session already exists")
+	// ErrNotOwner means the session's files or socket belong to another user
+	ErrNotOwner = errors.New("session belongs to another user")
+	// ErrStateReadOnly means the state directory can't be written to
+	ErrStateReadOnly = errors.New("state directory is read-only")
+	// ErrInvalidName means a session name is empty or has characters other
+	// than alphanumerics, underscores and hyphens
+	ErrInvalidName = errors.New("invalid session name")
+)
+
+// Classify wraps err, a failure to use a session's files or socket, in the
+// matching error above. The result still matches err with errors.Is.
+func Classify(err error) error {
+	var kind error
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, ErrSessionNotFound), errors.Is(err, ErrSessionExists),
+		errors.Is(err, ErrNotOwner), errors.Is(err, ErrStateReadOnly):
+		return err
+	case errors.Is(err, os.ErrNotExist), errors.Is(err, syscall.ECONNREFUSED):
+		// A socket nobody listens on is left over by a daemon that died
+		kind = ErrSessionNotFound
+	case errors.Is(err, os.ErrPermission):
+		kind = ErrNotOwner
+	case errors.Is(err, syscall.EROFS):
+		kind = ErrStateReadOnly
+	default:
+		return err
+	}
+	return fmt.Errorf("%w: %w", kind, err)
+}
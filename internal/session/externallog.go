@@ -0,0 +1,150 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ExternalLog is a log file of an ended session kept outside the state
+// directory, e.g. with start -l. Clean never removes these on its own, so
+// they are tracked until removed with clean -logs or custom_log_cleanup.
+type ExternalLog struct {
+	Session string    `json:"session"`
+	Path    string    `json:"path"`
+	Ended   time.Time `json:"ended"`
+}
+
+// ExternalLogs returns the log file of the session and its rotated files if
+// the log is kept outside the state directory, oldest rotation last.
+func (i Info) ExternalLogs() []string {
+	dir, err := GetStateDir()
+	if err != nil || i.LogPath == "" || filepath.Dir(i.LogPath) == filepath.Clean(dir) {
+		return nil
+	}
+	paths := []string{i.LogPath}
+	matches, _ := filepath.Glob(i.LogPath + ".*")
+	for _, m := range matches {
+		if _, err := strconv.Atoi(strings.TrimPrefix(m, i.LogPath+".")); err == nil {
+			paths = append(paths, m)
+		}
+	}
+	return paths
+}
+
+// GetExternalLogsPath returns the path of the file tracking external logs
+func GetExternalLogsPath() (string, error) {
+	dir, err := EnsureDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "external_logs.json"), nil
+}
+
+// TrackExternalLogs records the external logs of a session that ended, see
+// ExternalLog. Paths already tracked keep their entry.
+func TrackExternalLogs(info Info) error {
+	paths := info.ExternalLogs()
+	if len(paths) == 0 {
+		return nil
+	}
+	return updateExternalLogs(func(logs []ExternalLog) []ExternalLog {
+		for _, path := range paths {
+			if !slices.ContainsFunc(logs, func(l ExternalLog) bool { return l.Path == path }) {
+				logs = append(logs, ExternalLog{Session: info.Name, Path: path, Ended: time.Now()})
+			}
+		}
+		return logs
+	})
+}
+
+// ListExternalLogs returns the tracked external logs that still exist and
+// don't belong to a running session, which may have been started again with
+// the same log path.
+func ListExternalLogs() ([]ExternalLog, error) {
+	path, err := GetExternalLogsPath()
+	if err != nil {
+		return nil, err
+	}
+	logs, err := readExternalLogs(path)
+	if err != nil {
+		return nil, err
+	}
+	inUse := make(map[string]bool)
+	if sessions, err := List(); err == nil {
+		for _, s := range sessions {
+			for _, p := range s.ExternalLogs() {
+				inUse[p] = true
+			}
+		}
+	}
+	return slices.DeleteFunc(logs, func(l ExternalLog) bool {
+		_, err := os.Stat(l.Path)
+		return err != nil || inUse[l.Path]
+	}), nil
+}
+
+// RemoveExternalLogs deletes the given external logs and stops tracking them,
+// along with tracked files that no longer exist. It returns the number of
+// files removed.
+func RemoveExternalLogs(remove []ExternalLog) (int, error) {
+	removed := 0
+	var errs []error
+	err := updateExternalLogs(func(logs []ExternalLog) []ExternalLog {
+		for _, l := range remove {
+			if err := os.Remove(l.Path); err == nil {
+				removed++
+			} else if !errors.Is(err, os.ErrNotExist) {
+				errs = append(errs, err)
+			}
+			_ = os.Remove(IndexPath(l.Path))
+		}
+		return slices.DeleteFunc(logs, func(l ExternalLog) bool {
+			_, err := os.Stat(l.Path)
+			return errors.Is(err, os.ErrNotExist)
+		})
+	})
+	return removed, errors.Join(append(errs, err)...)
+}
+
+func readExternalLogs(path string) ([]ExternalLog, error) {
+	var logs []ExternalLog
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &logs)
+	return logs, err
+}
+
+// updateExternalLogs changes the tracked external logs under a lock, as
+// daemons record their logs when they exit.
+func updateExternalLogs(change func([]ExternalLog) []ExternalLog) error {
+	path, err := GetExternalLogsPath()
+	if err != nil {
+		return err
+	}
+	unlock, err := lockFile(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	logs, err := readExternalLogs(path)
+	if err != nil {
+		// A broken file only loses the record, so start over
+		logs = nil
+	}
+	data, err := json.MarshalIndent(change(logs), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'))
+}
@@ -0,0 +1,243 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"persishtent/internal/config"
+)
+
+// RemovedExpired is the reason of history entries removed by Clean
+const RemovedExpired = "history expired"
+
+// HistoryEntry is an ended session whose logs were moved to the history
+// directory, see Archive. Info.LogPath points to the archived log, or to the
+// custom log of sessions started with -l, which isn't moved.
+type HistoryEntry struct {
+	Info
+	ID  string `json:"-"` // Name of the entry directory, <name>.<end time>
+	Dir string `json:"-"`
+}
+
+// historyInfoFile is the info of the session in its history entry
+const historyInfoFile = "info.json"
+
+// GetHistoryDir returns the directory holding the history of ended sessions
+func GetHistoryDir() (string, error) {
+	dir, err := EnsureDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "history"), nil
+}
+
+// Archive adds an ended session to the history, moving its log files,
+// their integrity indexes and the debug log out of the state directory. It returns false
+// without doing anything if history_retention_days is 0 or the session was
+// ephemeral, in which case the logs are left to the caller to remove. The
+// session's info file moves to the entry as well, marked as crashed first if
+// the daemon died of a crash, see detectCrash.
+func Archive(info Info) (bool, error) {
+	detectCrash(&info)
+	if !archives(info) {
+		return false, nil
+	}
+	dir, err := EnsureDir()
+	if err != nil {
+		return false, err
+	}
+	infoPath := filepath.Join(dir, info.Name+".info")
+	if _, err := os.Lstat(infoPath); errors.Is(err, os.ErrNotExist) {
+		// Archived already
+		return true, nil
+	}
+	historyDir, err := GetHistoryDir()
+	if err != nil {
+		return false, err
+	}
+	if err := os.MkdirAll(historyDir, 0700); err != nil {
+		return false, err
+	}
+	if info.Ended.IsZero() {
+		// The daemon died without recording the exit
+		info.Ended = time.Now()
+	}
+	id := info.Name + "." + info.Ended.Local().Format("20060102-150405")
+	entryDir := filepath.Join(historyDir, id)
+	for i := 2; ; i++ {
+		err = os.Mkdir(entryDir, 0700)
+		if !errors.Is(err, os.ErrExist) {
+			break
+		}
+		entryDir = filepath.Join(historyDir, id+"-"+strconv.Itoa(i))
+	}
+	if err != nil {
+		return false, err
+	}
+	// Taking the info file tells concurrent cleans that the logs are taken care of
+	if err := os.Rename(infoPath, filepath.Join(entryDir, historyInfoFile)); err != nil {
+		_ = os.Remove(entryDir)
+		return errors.Is(err, os.ErrNotExist), nil
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return false, err
+	}
+	logFile := regexp.MustCompile(`^` + regexp.QuoteMeta(info.Name) + `\.log(\.\d+)?(\.sum)?$`)
+	defaultLog := filepath.Join(dir, info.Name+".log")
+	for _, f := range files {
+		if logFile.MatchString(f.Name()) {
+			if err := os.Rename(filepath.Join(dir, f.Name()), filepath.Join(entryDir, f.Name())); err != nil {
+				return false, err
+			}
+		}
+	}
+	// The debug log is worth keeping as long as the logs
+	for _, suffix := range debugFiles {
+		if err := os.Rename(filepath.Join(dir, info.Name+suffix), filepath.Join(entryDir, info.Name+suffix)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return false, err
+		}
+	}
+	if info.LogPath == defaultLog {
+		info.LogPath = filepath.Join(entryDir, info.Name+".log")
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return false, err
+	}
+	return true, os.WriteFile(filepath.Join(entryDir, historyInfoFile), data, 0600)
+}
+
+// archives reports whether Archive keeps the logs of the session
+func archives(info Info) bool {
+	return config.Current().HistoryRetentionDays > 0 && !info.Ephemeral
+}
+
+// ListHistory returns the ended sessions in the history, most recently ended
+// first. Entries without a readable info are skipped.
+func ListHistory() ([]HistoryEntry, error) {
+	historyDir, err := GetHistoryDir()
+	if err != nil {
+		return nil, err
+	}
+	dirs, err := os.ReadDir(historyDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var entries []HistoryEntry
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		e := HistoryEntry{ID: d.Name(), Dir: filepath.Join(historyDir, d.Name())}
+		data, err := os.ReadFile(filepath.Join(e.Dir, historyInfoFile))
+		if err != nil || json.Unmarshal(data, &e.Info) != nil {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Ended.After(entries[j].Ended) })
+	return entries, nil
+}
+
+// FindHistory returns the history entry with the given ID, or the most
+// recently ended session named name.
+func FindHistory(name string) (HistoryEntry, bool) {
+	entries, _ := ListHistory()
+	for _, e := range entries {
+		if e.ID == name {
+			return e, true
+		}
+	}
+	for _, e := range entries {
+		if e.Name == name {
+			return e, true
+		}
+	}
+	return HistoryEntry{}, false
+}
+
+// LogSegments returns the log files of the entry like the package-level
+// LogSegments does for a running session
+func (e HistoryEntry) LogSegments() ([]LogSegment, error) {
+	if e.LogPath == "" {
+		return nil, nil
+	}
+	files, err := logFilesAt(e.LogPath)
+	if errors.Is(err, os.ErrNotExist) {
+		// A custom log removed since
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return logSegments(files), nil
+}
+
+// pruneHistory removes the history entries of sessions that ended more than
+// history_retention_days ago, or all of them if it is 0, and those opts asks
+// for. It runs with every clean, so the end time is taken from the entry's
+// name instead of its info.
+func pruneHistory(removed *[]RemovedFile, opts CleanOptions) {
+	historyDir, err := GetHistoryDir()
+	if err != nil {
+		return
+	}
+	dirs, _ := os.ReadDir(historyDir)
+	cutoff := time.Now().AddDate(0, 0, -config.Current().HistoryRetentionDays)
+	for _, d := range dirs {
+		name, stamp, ok := strings.Cut(d.Name(), ".")
+		if !ok || len(stamp) < 15 {
+			continue
+		}
+		ended, err := time.ParseInLocation("20060102-150405", stamp[:15], time.Local)
+		if err != nil {
+			continue
+		}
+		reason := RemovedExpired
+		switch {
+		case !ended.After(cutoff):
+		case opts.Archived:
+			reason = RemovedArchived
+		case ended.Before(opts.LogsOlderThan):
+			reason = RemovedOld
+		default:
+			continue
+		}
+		entryDir := filepath.Join(historyDir, d.Name())
+		files, _ := os.ReadDir(entryDir)
+		for _, f := range files {
+			removeFile(removed, filepath.Join(entryDir, f.Name()), name, reason, opts.DryRun)
+		}
+		if !opts.DryRun {
+			_ = os.Remove(entryDir)
+		}
+	}
+}
+
+// removeOldLogs removes the rotated logs of a running session last written
+// before opts.LogsOlderThan, with their integrity indexes. Custom logs are
+// left to their owner.
+func removeOldLogs(removed *[]RemovedFile, info Info, opts CleanOptions) {
+	if defaultLog, err := GetLogPath(info.Name); err != nil || info.LogPath != defaultLog {
+		return
+	}
+	files, _ := GetLogFiles(info.Name)
+	for _, path := range files {
+		fi, err := os.Stat(path)
+		if path == info.LogPath || err != nil || !fi.ModTime().Before(opts.LogsOlderThan) {
+			continue
+		}
+		removeFile(removed, path, info.Name, RemovedOld, opts.DryRun)
+		removeFile(removed, IndexPath(path), info.Name, RemovedOld, opts.DryRun)
+	}
+}
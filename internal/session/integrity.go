@@ -0,0 +1,546 @@
+package session
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// IntegrityMarker records the HMAC of a chunk of a log file. Markers are
+// kept one JSON object per line in a sidecar index next to the log (see
+// IndexPath), so truncated or altered logs can be detected and replay can
+// skip damaged chunks instead of garbling the terminal. Chunks end at line
+// boundaries where possible, which lets tails and time-based seeks start
+// reading near the end instead of scanning the whole log.
+type IntegrityMarker struct {
+	Offset int64 `json:"offset"`
+	Size   int64 `json:"size"`
+	Lines  int64 `json:"lines"` // Newlines in the chunk
+	// HMAC is the HMAC-SHA256 of the chunk with the key of IndexKey, which
+	// can't be recomputed for altered output without the key. Markers
+	// written before have a plain SHA256 instead.
+	HMAC   string    `json:"hmac,omitempty"`
+	SHA256 string    `json:"sha256,omitempty"`
+	Time   time.Time `json:"time"` // When the chunk was complete
+}
+
+// LogMark is a named point in a log, which logs -from-mark starts at. Marks
+// are kept in the index along with the markers, at a chunk boundary; readers
+// that predate them skip their lines, which have no size.
+type LogMark struct {
+	Offset int64     `json:"offset"`
+	Mark   string    `json:"mark"`
+	Time   time.Time `json:"time"`
+}
+
+// ErrNoIndex is returned for a mark in a log that isn't indexed
+var ErrNoIndex = errors.New("the log has no index, see log_integrity_kb")
+
+// indexKeyFile is the file in the state directory holding the key of the
+// integrity markers
+const indexKeyFile = "integrity.key"
+
+// IndexKey returns the key the integrity markers are signed with, created
+// on first use. Only the user can read it, unlike the logs if log_dir is
+// shared.
+func IndexKey() ([]byte, error) {
+	dir, err := EnsureDir()
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, indexKeyFile)
+	if key, err := os.ReadFile(path); err == nil || !errors.Is(err, os.ErrNotExist) {
+		return key, err
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if errors.Is(err, os.ErrExist) {
+		// Created by another daemon meanwhile
+		return os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Write(key)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(path)
+		return nil, err
+	}
+	return key, nil
+}
+
+// IndexPath returns the path of the integrity index of a log file. Rotated
+// files keep their index, e.g. name.log.2.sum.
+func IndexPath(logPath string) string {
+	return logPath + ".sum"
+}
+
+// IndexWriter hashes output as it is written to a log and appends a marker
+// to the index about every interval bytes. A nil IndexWriter ignores all calls, for
+// logs without an index.
+type IndexWriter struct {
+	f        *os.File
+	interval int64
+	offset   int64 // Start of the chunk being hashed
+	size     int64
+	lines    int64
+	sum      hash.Hash
+}
+
+// OpenIndex opens the index of the log at logPath for output written from
+// offset on. An offset of 0 starts a new index; otherwise markers are
+// appended to the existing one. An interval of 0 or less disables the index.
+func OpenIndex(logPath string, interval, offset int64) (*IndexWriter, error) {
+	if interval <= 0 {
+		return nil, nil
+	}
+	key, err := IndexKey()
+	if err != nil {
+		return nil, err
+	}
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if offset == 0 {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(IndexPath(logPath), flags, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &IndexWriter{f: f, interval: interval, offset: offset, sum: hmac.New(sha256.New, key)}, nil
+}
+
+// Add hashes p, which was just written to the log. Once a chunk reaches the
+// interval, it ends after the last newline in p; output without newlines,
+// e.g. of full screen programs, is cut at four times the interval.
+func (x *IndexWriter) Add(p []byte) error {
+	if x == nil {
+		return nil
+	}
+	for x.size+int64(len(p)) >= x.interval {
+		i := bytes.LastIndexByte(p, '\n') + 1
+		if i == 0 {
+			if x.size+int64(len(p)) < 4*x.interval {
+				break
+			}
+			i = len(p)
+		}
+		x.hash(p[:i])
+		p = p[i:]
+		if err := x.Flush(); err != nil {
+			return err
+		}
+	}
+	x.hash(p)
+	return nil
+}
+
+func (x *IndexWriter) hash(p []byte) {
+	x.sum.Write(p)
+	x.size += int64(len(p))
+	x.lines += int64(bytes.Count(p, []byte{'\n'}))
+}
+
+// Flush writes the marker of the output hashed so far, if any.
+func (x *IndexWriter) Flush() error {
+	if x == nil || x.size == 0 {
+		return nil
+	}
+	m := IntegrityMarker{Offset: x.offset, Size: x.size, Lines: x.lines, HMAC: hex.EncodeToString(x.sum.Sum(nil)), Time: time.Now()}
+	x.offset += x.size
+	x.size, x.lines = 0, 0
+	x.sum.Reset()
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = x.f.Write(append(data, '\n'))
+	return err
+}
+
+// Mark ends the current chunk and records a mark named name at the end of
+// the output written so far.
+func (x *IndexWriter) Mark(name string) error {
+	if x == nil {
+		return ErrNoIndex
+	}
+	if err := x.Flush(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(LogMark{Offset: x.offset, Mark: name, Time: time.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = x.f.Write(append(data, '\n'))
+	return err
+}
+
+// Close writes the marker of the last chunk and closes the index.
+func (x *IndexWriter) Close() error {
+	if x == nil {
+		return nil
+	}
+	err := x.Flush()
+	return errors.Join(err, x.f.Close())
+}
+
+// ReadIndex returns the markers of the log at logPath. Lines that can't be
+// parsed, such as one cut short by a crash, are skipped.
+func ReadIndex(logPath string) ([]IntegrityMarker, error) {
+	f, err := os.Open(IndexPath(logPath))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	var markers []IntegrityMarker
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var m IntegrityMarker
+		if json.Unmarshal(scanner.Bytes(), &m) == nil && m.Size > 0 {
+			markers = append(markers, m)
+		}
+	}
+	return markers, scanner.Err()
+}
+
+// ReadMarks returns the marks recorded in the index of the log at logPath,
+// oldest first.
+func ReadMarks(logPath string) ([]LogMark, error) {
+	f, err := os.Open(IndexPath(logPath))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	var marks []LogMark
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var m LogMark
+		if json.Unmarshal(scanner.Bytes(), &m) == nil && m.Mark != "" {
+			marks = append(marks, m)
+		}
+	}
+	return marks, scanner.Err()
+}
+
+// LogCheck is the result of verifying a log file against its index.
+type LogCheck struct {
+	Path      string
+	Markers   int               // 0 if the log has no index
+	Corrupt   []IntegrityMarker // Chunks whose contents don't match
+	Missing   int64             // Indexed bytes missing from the end of the log
+	Unindexed int64             // Bytes after the last marker, e.g. of a running session
+	// Unkeyed counts chunks that match a marker anyone could have written:
+	// one with a plain SHA256, or an HMAC while the key is gone
+	Unkeyed int
+}
+
+// OK reports whether all indexed chunks of the log are intact.
+func (c LogCheck) OK() bool {
+	return len(c.Corrupt) == 0 && c.Missing == 0
+}
+
+// Verified reports whether the log is intact as far as its index proves:
+// it has one, and all of its markers were signed with the key.
+func (c LogCheck) Verified() bool {
+	return c.OK() && c.Markers > 0 && c.Unkeyed == 0
+}
+
+// VerifyLog checks the log at logPath against its index. A log without an
+// index is not Verified.
+func VerifyLog(logPath string) (LogCheck, error) {
+	check := LogCheck{Path: logPath}
+	f, err := os.Open(logPath)
+	if err != nil {
+		return check, err
+	}
+	defer func() { _ = f.Close() }()
+	fi, err := f.Stat()
+	if err != nil {
+		return check, err
+	}
+	markers, err := ReadIndex(logPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return check, err
+	}
+	check.Markers = len(markers)
+	key, _ := readIndexKey()
+
+	var end int64
+	for _, m := range markers {
+		end = max(end, m.Offset+m.Size)
+		if m.Offset+m.Size > fi.Size() {
+			check.Missing += m.Offset + m.Size - max(m.Offset, fi.Size())
+			continue
+		}
+		_, ok, keyed := readChunk(f, m, key)
+		if !ok {
+			check.Corrupt = append(check.Corrupt, m)
+		} else if !keyed {
+			check.Unkeyed++
+		}
+	}
+	check.Unindexed = max(fi.Size()-end, 0)
+	return check, nil
+}
+
+// CopyVerified copies the log at logPath from offset from on to w, leaving
+// out chunks that don't match their marker so that replay picks up again at
+// the next intact one. skipped is called in place of every chunk left out.
+// Logs without an index are copied as they are.
+func CopyVerified(w io.Writer, logPath string, from int64, skipped func(IntegrityMarker)) error {
+	f, err := os.Open(logPath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	markers, _ := ReadIndex(logPath)
+	key, _ := readIndexKey()
+
+	pos := from
+	for _, m := range markers {
+		if m.Offset < pos {
+			continue
+		}
+		if _, err := io.Copy(w, io.NewSectionReader(f, pos, m.Offset-pos)); err != nil {
+			return err
+		}
+		data, ok, _ := readChunk(f, m, key)
+		if int64(len(data)) < m.Size {
+			// The log ends early, what is left is all there is
+			_, err := w.Write(data)
+			return err
+		}
+		if !ok {
+			skipped(m)
+		} else if _, err := w.Write(data); err != nil {
+			return err
+		}
+		pos = m.Offset + m.Size
+	}
+	_, err = f.Seek(pos, io.SeekStart)
+	if err == nil {
+		_, err = io.Copy(w, f)
+	}
+	return err
+}
+
+// SeekTime returns the offset in the log at logPath of the first chunk
+// completed at or after t, from which on the log holds all output since t.
+// Logs without an index are read from the start.
+func SeekTime(logPath string, t time.Time) int64 {
+	markers, _ := ReadIndex(logPath)
+	for _, m := range markers {
+		if !m.Time.Before(t) {
+			return m.Offset
+		}
+	}
+	if len(markers) == 0 {
+		return 0
+	}
+	last := markers[len(markers)-1]
+	return last.Offset + last.Size
+}
+
+// ReadTail returns the last n lines of the log at logPath. The index tells
+// how many lines each chunk holds, so only the chunks with the last n lines
+// are read. Like with CopyVerified, chunks that don't match their marker are
+// left out; damaged returns what goes in their place, if it isn't nil. ok is
+// false if the log has no index to go by.
+func ReadTail(logPath string, n int, damaged func(IntegrityMarker) []byte) (data []byte, ok bool) {
+	markers, err := ReadIndex(logPath)
+	if err != nil || len(markers) == 0 {
+		return nil, false
+	}
+	f, err := os.Open(logPath)
+	if err != nil {
+		return nil, false
+	}
+	defer func() { _ = f.Close() }()
+	fi, err := f.Stat()
+	last := markers[len(markers)-1]
+	if err != nil || last.Offset+last.Size > fi.Size() {
+		// A truncated log doesn't match its index
+		return nil, false
+	}
+
+	// Output after the last marker isn't counted in the index yet. One more
+	// line than asked for is needed, as the log may end with a newline.
+	start := last.Offset + last.Size
+	data, err = io.ReadAll(io.NewSectionReader(f, start, fi.Size()-start))
+	if err != nil {
+		return nil, false
+	}
+	lines := int64(bytes.Count(data, []byte{'\n'}))
+	for i := len(markers) - 1; i >= 0 && lines <= int64(n); i-- {
+		start = markers[i].Offset
+		lines += markers[i].Lines
+	}
+	var buf bytes.Buffer
+	err = CopyVerified(&buf, logPath, start, func(m IntegrityMarker) {
+		if damaged != nil {
+			buf.Write(damaged(m))
+		}
+	})
+	if err != nil {
+		return nil, false
+	}
+	data = buf.Bytes()
+	return data[TailStart(data, n):], true
+}
+
+// TailStart returns the index at which the last n lines of data start. A
+// newline at the very end doesn't start another line.
+func TailStart(data []byte, n int) int {
+	end := len(data)
+	if end > 0 && data[end-1] == '\n' {
+		end--
+	}
+	for lines := 0; end > 0; {
+		i := bytes.LastIndexByte(data[:end], '\n')
+		if i < 0 {
+			return 0
+		}
+		if lines++; lines >= n {
+			return i + 1
+		}
+		end = i
+	}
+	return 0
+}
+
+// readIndexKey returns the key of the integrity markers, or nil if there is
+// none yet
+func readIndexKey() ([]byte, error) {
+	dir, err := GetStateDir()
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(filepath.Join(dir, indexKeyFile))
+}
+
+// readChunk reads the chunk of f covered by m and reports whether it matches
+// the marker, and whether the match is proven by the marker's HMAC. Without
+// key, an HMAC can't be checked and any chunk matches. The data is short if
+// f ends early.
+func readChunk(f *os.File, m IntegrityMarker, key []byte) (data []byte, ok, keyed bool) {
+	data = make([]byte, m.Size)
+	n, _ := f.ReadAt(data, m.Offset)
+	data = data[:n]
+	if int64(n) != m.Size {
+		return data, false, false
+	}
+	if m.HMAC == "" {
+		sum := sha256.Sum256(data)
+		return data, hex.EncodeToString(sum[:]) == m.SHA256, false
+	}
+	if key == nil {
+		return data, true, false
+	}
+	want, err := hex.DecodeString(m.HMAC)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return data, err == nil && hmac.Equal(mac.Sum(nil), want), true
+}
+
+// TrimLog removes the output before offset cut from the rotated log file at
+// logPath, or the whole file and its index if nothing is left. The cut moves
+// forward to the next chunk of the index, or without one to the next line,
+// so the file still starts at a line boundary and its index stays valid. It
+// returns the number of bytes removed. The file must not be written
+// meanwhile.
+func TrimLog(logPath string, cut int64) (int64, error) {
+	fi, err := os.Stat(logPath)
+	if err != nil || cut <= 0 {
+		return 0, err
+	}
+	size := fi.Size()
+	markers, _ := ReadIndex(logPath)
+	if cut < size {
+		cut = alignCut(logPath, markers, cut, size)
+	}
+	if cut >= size {
+		if err := os.Remove(logPath); err != nil {
+			return 0, err
+		}
+		_ = os.Remove(IndexPath(logPath))
+		return size, nil
+	}
+
+	src, err := os.Open(logPath)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = src.Close() }()
+	dst, err := os.CreateTemp(filepath.Dir(logPath), "."+filepath.Base(logPath)+".*")
+	if err != nil {
+		return 0, err
+	}
+	_, err = io.Copy(dst, io.NewSectionReader(src, cut, size-cut))
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(dst.Name(), logPath)
+	}
+	if err != nil {
+		_ = os.Remove(dst.Name())
+		return 0, err
+	}
+
+	// Markers of the removed chunks go, the others move with the output
+	var index []byte
+	for _, m := range markers {
+		if m.Offset >= cut {
+			m.Offset -= cut
+			data, _ := json.Marshal(m)
+			index = append(append(index, data...), '\n')
+		}
+	}
+	if len(markers) > 0 {
+		_ = writeFileAtomic(IndexPath(logPath), index)
+	}
+	return cut, nil
+}
+
+// alignCut returns the offset of the first chunk in markers at or after cut,
+// or after the last chunk the offset after the next newline. It returns size
+// if there is none.
+func alignCut(logPath string, markers []IntegrityMarker, cut, size int64) int64 {
+	for _, m := range markers {
+		if m.Offset >= cut {
+			return m.Offset
+		}
+	}
+	f, err := os.Open(logPath)
+	if err != nil {
+		return size
+	}
+	defer func() { _ = f.Close() }()
+	r := bufio.NewReader(io.NewSectionReader(f, cut, size-cut))
+	skipped, err := r.ReadSlice('\n')
+	for err == bufio.ErrBufferFull {
+		cut += int64(len(skipped))
+		skipped, err = r.ReadSlice('\n')
+	}
+	if err != nil {
+		return size
+	}
+	return cut + int64(len(skipped))
+}
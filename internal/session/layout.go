@@ -0,0 +1,167 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"time"
+)
+
+// Attachment records a client attached to a session from a terminal window,
+// so the arrangement can be restored after the terminal is gone.
+type Attachment struct {
+	Session  string    `json:"session"`
+	ReadOnly bool      `json:"read_only,omitempty"`
+	Terminal string    `json:"terminal,omitempty"` // See DetectWindow
+	Window   string    `json:"window,omitempty"`   // Window, tab or pane ID given by the terminal
+	PID      int       `json:"pid"`                // The attached client
+	Time     time.Time `json:"time"`
+}
+
+// Layout lists attachments, oldest first.
+type Layout struct {
+	Attachments []Attachment `json:"attachments"`
+}
+
+// Terminals recognized by DetectWindow
+const (
+	TerminalTmux          = "tmux"
+	TerminalWezTerm       = "wezterm"
+	TerminalKitty         = "kitty"
+	TerminalITerm         = "iterm"
+	TerminalAppleTerminal = "apple_terminal"
+)
+
+// DetectWindow returns the terminal hosting this process and the ID of its
+// window there, from the terminal's environment variables. The terminal is
+// empty if unknown; the window may be empty too.
+func DetectWindow(getenv func(string) string) (terminal, window string) {
+	switch {
+	case getenv("TMUX") != "":
+		return TerminalTmux, getenv("TMUX_PANE")
+	case getenv("WEZTERM_PANE") != "":
+		return TerminalWezTerm, getenv("WEZTERM_PANE")
+	case getenv("KITTY_WINDOW_ID") != "":
+		return TerminalKitty, getenv("KITTY_WINDOW_ID")
+	case getenv("TERM_PROGRAM") == "iTerm.app":
+		return TerminalITerm, getenv("ITERM_SESSION_ID")
+	case getenv("TERM_PROGRAM") == "Apple_Terminal":
+		return TerminalAppleTerminal, getenv("TERM_SESSION_ID")
+	}
+	return "", getenv("WINDOWID")
+}
+
+// GetLayoutPath returns the path of the file recording current attachments
+func GetLayoutPath() (string, error) {
+	dir, err := EnsureDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "attachments.json"), nil
+}
+
+// ReadLayout reads a layout file. A missing file is an empty layout.
+func ReadLayout(path string) (Layout, error) {
+	var l Layout
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	} else if err != nil {
+		return l, err
+	}
+	err = json.Unmarshal(data, &l)
+	return l, err
+}
+
+// WriteLayout replaces a layout file
+func WriteLayout(path string, l Layout) error {
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'))
+}
+
+// writeFileAtomic writes a new file next to path and renames it, so readers
+// never see a partly written file
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// RecordAttachment adds a to the recorded attachments. Earlier attachments to
+// the same session whose client is gone are dropped, as a is what restored
+// them.
+func RecordAttachment(a Attachment) error {
+	return updateLayout(func(l *Layout) {
+		l.Attachments = slices.DeleteFunc(l.Attachments, func(old Attachment) bool {
+			return old.PID == a.PID || (old.Session == a.Session && !IsPIDAlive(old.PID))
+		})
+		l.Attachments = append(l.Attachments, a)
+	})
+}
+
+// RemoveAttachment forgets the attachment of the client with the given PID,
+// once it detached or its session ended.
+func RemoveAttachment(pid int) error {
+	return updateLayout(func(l *Layout) {
+		l.Attachments = slices.DeleteFunc(l.Attachments, func(a Attachment) bool {
+			return a.PID == pid
+		})
+	})
+}
+
+// updateLayout changes the recorded attachments, holding a lock so clients
+// attaching at the same time don't lose each other's changes.
+func updateLayout(change func(*Layout)) error {
+	path, err := GetLayoutPath()
+	if err != nil {
+		return err
+	}
+	unlock, err := lockFile(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	l, err := ReadLayout(path)
+	if err != nil {
+		// A broken file only loses the record, so start over
+		l = Layout{}
+	}
+	change(&l)
+	return WriteLayout(path, l)
+}
+
+// lockFile takes an exclusive flock on path.lock, for changes to path that
+// must not race with other processes. The returned func releases it.
+func lockFile(path string) (func(), error) {
+	lock, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		_ = lock.Close()
+		return nil, err
+	}
+	return func() { _ = lock.Close() }, nil
+}
@@ -0,0 +1,95 @@
+package session
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+// MetaChange is a change to the tags and group of sessions, applied by
+// retag and regroup to all sessions matching a pattern.
+type MetaChange struct {
+	SetTags     []string `json:"set_tags,omitempty"` // Replace the tags, if ReplaceTags
+	ReplaceTags bool     `json:"replace_tags,omitempty"`
+	AddTags     []string `json:"add_tags,omitempty"`
+	RemoveTags  []string `json:"remove_tags,omitempty"`
+	Group       *string  `json:"group,omitempty"` // Set the group, "" removes it
+}
+
+// ParseTagChange parses a retag spec: a comma-separated list of tags that
+// replaces the session's tags, or of tags prefixed with + or - that are
+// added or removed, e.g. "+prod,-staging".
+func ParseTagChange(spec string) (MetaChange, error) {
+	var c MetaChange
+	var plain, prefixed bool
+	for _, tag := range strings.Split(spec, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		list := &c.SetTags
+		switch tag[0] {
+		case '+':
+			list, tag, prefixed = &c.AddTags, tag[1:], true
+		case '-':
+			list, tag, prefixed = &c.RemoveTags, tag[1:], true
+		default:
+			plain = true
+		}
+		if !nameRegex.MatchString(tag) {
+			return MetaChange{}, fmt.Errorf("tag '%s' must only contain alphanumeric characters, underscores, and hyphens", tag)
+		}
+		*list = append(*list, tag)
+	}
+	if plain && prefixed {
+		return MetaChange{}, fmt.Errorf("tags must either all or none be prefixed with + or -")
+	}
+	c.ReplaceTags = !prefixed
+	return c, nil
+}
+
+// ValidateGroup checks if a group name is valid. The empty group is valid and
+// means no group.
+func ValidateGroup(group string) error {
+	if group != "" && !nameRegex.MatchString(group) {
+		return fmt.Errorf("group name must only contain alphanumeric characters, underscores, and hyphens")
+	}
+	return nil
+}
+
+// Apply makes the change to info
+func (c MetaChange) Apply(info *Info) {
+	if c.ReplaceTags {
+		info.Tags = slices.Clone(c.SetTags)
+	}
+	for _, tag := range c.AddTags {
+		if !info.HasTag(tag) {
+			info.Tags = append(info.Tags, tag)
+		}
+	}
+	info.Tags = slices.DeleteFunc(info.Tags, func(tag string) bool {
+		return slices.Contains(c.RemoveTags, tag)
+	})
+	if len(info.Tags) == 0 {
+		info.Tags = nil
+	}
+	if c.Group != nil {
+		info.Group = *c.Group
+	}
+}
+
+// Match returns the sessions whose name matches the glob pattern, as with
+// path.Match.
+func Match(sessions []Info, pattern string) ([]Info, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid pattern '%s': %w", pattern, err)
+	}
+	var matched []Info
+	for _, s := range sessions {
+		if ok, _ := path.Match(pattern, s.Name); ok {
+			matched = append(matched, s)
+		}
+	}
+	return matched, nil
+}
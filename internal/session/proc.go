@@ -0,0 +1,322 @@
+package session
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ProcStartTime returns the start time of a process in clock ticks since boot,
+// as reported by /proc/<pid>/stat. It is used to tell a session's shell apart
+// from an unrelated process that later reused the same PID.
+func ProcStartTime(pid int) (uint64, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	return parseStatStartTime(data)
+}
+
+// ProcCwd returns the current working directory of a process.
+func ProcCwd(pid int) (string, error) {
+	return os.Readlink(fmt.Sprintf("/proc/%d/cwd", pid))
+}
+
+// parseStatStartTime extracts field 22 (starttime) from the contents of a
+// /proc/<pid>/stat file. The comm field may contain spaces and parentheses,
+// so fields are counted from the last closing parenthesis.
+func parseStatStartTime(data []byte) (uint64, error) {
+	end := bytes.LastIndexByte(data, ')')
+	if end < 0 {
+		return 0, fmt.Errorf("malformed stat: missing comm")
+	}
+	// Fields after comm start at field 3 (state)
+	fields := bytes.Fields(data[end+1:])
+	const startTimeIdx = 22 - 3
+	if len(fields) <= startTimeIdx {
+		return 0, fmt.Errorf("malformed stat: too few fields")
+	}
+	return strconv.ParseUint(string(fields[startTimeIdx]), 10, 64)
+}
+
+// ProcState returns the state letter of a process (R, S, T, Z, ...).
+func ProcState(pid int) (byte, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	st, err := parseStat(data)
+	return st.state, err
+}
+
+// ProcGroups returns the process groups with members in the given session,
+// e.g. the shell and all of its jobs when sid is the shell's PID.
+func ProcGroups(sid int) []int {
+	stats, _ := filepath.Glob("/proc/[0-9]*/stat")
+	seen := make(map[int]bool)
+	var groups []int
+	for _, path := range stats {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		st, err := parseStat(data)
+		if err != nil || st.sid != sid || seen[st.pgrp] {
+			continue
+		}
+		seen[st.pgrp] = true
+		groups = append(groups, st.pgrp)
+	}
+	return groups
+}
+
+type procStat struct {
+	state     byte
+	pgrp, sid int
+}
+
+// parseStat extracts the state, process group and session ID (fields 3, 5
+// and 6) from the contents of a /proc/<pid>/stat file.
+func parseStat(data []byte) (procStat, error) {
+	end := bytes.LastIndexByte(data, ')')
+	if end < 0 {
+		return procStat{}, fmt.Errorf("malformed stat: missing comm")
+	}
+	fields := bytes.Fields(data[end+1:])
+	if len(fields) < 4 || len(fields[0]) != 1 {
+		return procStat{}, fmt.Errorf("malformed stat: too few fields")
+	}
+	pgrp, err := strconv.Atoi(string(fields[5-3]))
+	if err != nil {
+		return procStat{}, err
+	}
+	sid, err := strconv.Atoi(string(fields[6-3]))
+	if err != nil {
+		return procStat{}, err
+	}
+	return procStat{state: fields[0][0], pgrp: pgrp, sid: sid}, nil
+}
+
+// clockTicks is USER_HZ, the unit of CPU times in /proc/<pid>/stat. It is
+// 100 on all common Linux platforms.
+const clockTicks = 100
+
+// Proc is a process in the tree below a session's shell.
+type Proc struct {
+	PID      int
+	PPID     int
+	Command  string
+	State    byte
+	CPU      time.Duration // User and system time used so far
+	Age      time.Duration // Time since the process started
+	RSS      uint64        // Resident memory in bytes
+	Children []*Proc
+}
+
+// ProcTree returns pid and all of its descendants.
+func ProcTree(pid int) (*Proc, error) {
+	uptime, err := systemUptime()
+	if err != nil {
+		return nil, err
+	}
+	stats, _ := filepath.Glob("/proc/[0-9]*/stat")
+	procs := make(map[int]*Proc)
+	for _, path := range stats {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue // Exited meanwhile
+		}
+		p, err := parseProc(data, uptime)
+		if err != nil {
+			continue
+		}
+		p.Command = procCommand(p.PID, p.Command)
+		procs[p.PID] = p
+	}
+
+	root, ok := procs[pid]
+	if !ok {
+		return nil, fmt.Errorf("process %d not found", pid)
+	}
+	for _, p := range procs {
+		if parent, ok := procs[p.PPID]; ok && p.PID != pid {
+			parent.Children = append(parent.Children, p)
+		}
+	}
+	sortTree(root)
+	return root, nil
+}
+
+func sortTree(p *Proc) {
+	sort.Slice(p.Children, func(i, j int) bool { return p.Children[i].PID < p.Children[j].PID })
+	for _, c := range p.Children {
+		sortTree(c)
+	}
+}
+
+// procCommand returns the command line of a process, or its name in
+// brackets if it has none (zombies and kernel threads), like ps does.
+func procCommand(pid int, comm string) string {
+	data, _ := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	cmdline := strings.TrimSpace(strings.ReplaceAll(string(data), "\x00", " "))
+	if cmdline == "" {
+		return "[" + comm + "]"
+	}
+	return cmdline
+}
+
+// systemUptime returns the time since boot from /proc/uptime.
+func systemUptime() (time.Duration, error) {
+	data, err := os.ReadFile("/proc/uptime")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("malformed uptime")
+	}
+	secs, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(secs * float64(time.Second)), nil
+}
+
+// parseProc extracts the name, state, parent, CPU time (fields 14 and 15),
+// start time (22) and RSS (24) from the contents of a /proc/<pid>/stat file.
+// The start time is converted into an age using the system uptime.
+func parseProc(data []byte, uptime time.Duration) (*Proc, error) {
+	start := bytes.IndexByte(data, '(')
+	end := bytes.LastIndexByte(data, ')')
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("malformed stat: missing comm")
+	}
+	pid, err := strconv.Atoi(string(bytes.TrimSpace(data[:start])))
+	if err != nil {
+		return nil, err
+	}
+	fields := bytes.Fields(data[end+1:])
+	if len(fields) <= 24-3 || len(fields[0]) != 1 {
+		return nil, fmt.Errorf("malformed stat: too few fields")
+	}
+	field := func(n int) uint64 {
+		v, _ := strconv.ParseUint(string(fields[n-3]), 10, 64)
+		return v
+	}
+	ticks := func(t uint64) time.Duration { return time.Duration(t) * time.Second / clockTicks }
+
+	return &Proc{
+		PID:     pid,
+		PPID:    int(field(4)),
+		Command: string(data[start+1 : end]),
+		State:   fields[0][0],
+		CPU:     ticks(field(14) + field(15)),
+		Age:     uptime - ticks(field(22)),
+		RSS:     field(24) * uint64(os.Getpagesize()),
+	}, nil
+}
+
+// Daemon is a persishtent daemon process found in the process table.
+type Daemon struct {
+	PID      int
+	Name     string // Session name the daemon was started with; renames aren't reflected
+	SockPath string // Custom socket path, if any
+	Age      time.Duration
+}
+
+// Daemons returns the daemon processes of the current user that use the same
+// PERSISHTENT_DIR as this process. Daemons of other state directories aren't
+// ours to manage.
+func Daemons() ([]Daemon, error) {
+	uptime, err := systemUptime()
+	if err != nil {
+		return nil, err
+	}
+	exe, _ := os.Executable()
+	stats, _ := filepath.Glob("/proc/[0-9]*/stat")
+	var daemons []Daemon
+	for _, path := range stats {
+		dir := filepath.Dir(path)
+		if fi, err := os.Stat(dir); err != nil || !ownedByUser(fi) {
+			continue
+		}
+		cmdline, err := os.ReadFile(filepath.Join(dir, "cmdline"))
+		if err != nil {
+			continue
+		}
+		args := strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00")
+		if len(args) < 3 || args[1] != "daemon" {
+			continue
+		}
+		if base := filepath.Base(args[0]); base != AppName && base != filepath.Base(exe) {
+			continue
+		}
+		environ, _ := os.ReadFile(filepath.Join(dir, "environ"))
+		if envValue(environ, "PERSISHTENT_DIR") != os.Getenv("PERSISHTENT_DIR") {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		p, err := parseProc(data, uptime)
+		if err != nil {
+			continue
+		}
+		d := parseDaemonArgs(args[2:])
+		d.PID, d.Age = p.PID, p.Age
+		daemons = append(daemons, d)
+	}
+	sort.Slice(daemons, func(i, j int) bool { return daemons[i].PID < daemons[j].PID })
+	return daemons, nil
+}
+
+// ProcParent returns the parent PID of a process.
+func ProcParent(pid int) (int, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	p, err := parseProc(data, 0)
+	if err != nil {
+		return 0, err
+	}
+	return p.PPID, nil
+}
+
+// parseDaemonArgs extracts the session name and socket path from the
+// arguments of a daemon, as passed by the CLI: flags first, the name last.
+func parseDaemonArgs(args []string) Daemon {
+	var d Daemon
+	for i, arg := range args {
+		if arg == "-s" && i+1 < len(args) {
+			d.SockPath = args[i+1]
+		}
+	}
+	if len(args) > 0 {
+		d.Name = args[len(args)-1]
+	}
+	return d
+}
+
+// envValue returns the value of key in the contents of a /proc/<pid>/environ file
+func envValue(environ []byte, key string) string {
+	for _, kv := range strings.Split(string(environ), "\x00") {
+		if v, ok := strings.CutPrefix(kv, key+"="); ok {
+			return v
+		}
+	}
+	return ""
+}
+
+// ownedByUser reports whether a /proc/<pid> directory belongs to the current user
+func ownedByUser(fi os.FileInfo) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && int(st.Uid) == os.Getuid()
+}
@@ -3,14 +3,21 @@ package session
 import (
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"net"
 	"os"
 	"path/filepath"
 	"regexp"
+	"runtime"
 	"sort"
 	"strconv"
+	"strings"
 	"syscall"
+	"text/template"
 	"time"
+
+	"persishtent/internal/config"
+	"persishtent/internal/timing"
 )
 
 var nameRegex = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
@@ -18,16 +25,17 @@ var nameRegex = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
 // ValidateName checks if a session name is valid
 func ValidateName(name string) error {
 	if name == "" {
-		return fmt.Errorf("session name cannot be empty")
+		return fmt.Errorf("%w: cannot be empty", ErrInvalidName)
 	}
 	if !nameRegex.MatchString(name) {
-		return fmt.Errorf("session name must only contain alphanumeric characters, underscores, and hyphens")
+		return fmt.Errorf("%w: must only contain alphanumeric characters, underscores, and hyphens", ErrInvalidName)
 	}
 	return nil
 }
 
 const (
-	DirName          = ".persishtent"
+	DirName          = ".persishtent" // Legacy state directory in $HOME
+	AppName          = "persishtent"
 	MaxLogRotations = 5
 )
 
@@ -36,24 +44,277 @@ type Info struct {
 	Name      string    `json:"name"`
 	PID       int       `json:"pid"`
 	Command   string    `json:"command"`
+	// Argv is the program and arguments of sessions started with start --,
+	// run without a shell; Command then holds them quoted for display
+	Argv      []string  `json:"argv,omitempty"`
 	LogPath   string    `json:"log_path"`
+	// Socket is the custom socket path the session was started with, if any
+	Socket    string    `json:"socket,omitempty"`
 	StartTime time.Time `json:"start_time"`
+	ProcStart uint64    `json:"proc_start,omitempty"`
+	State     string    `json:"state,omitempty"`
+	Ephemeral bool      `json:"ephemeral,omitempty"`
+	Exclusive bool      `json:"exclusive,omitempty"` // Master attaches lock the session
+	// EnvFile and EnvLinks hold the forwarded environment of the shell. They
+	// keep their original paths when the session is renamed.
+	EnvFile     string            `json:"env_file,omitempty"`
+	EnvLinks    map[string]string `json:"env_links,omitempty"`
+	Banner      string `json:"banner,omitempty"`
+	StartDir    string `json:"start_dir,omitempty"`
+	Cwd         string   `json:"cwd,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	Group       string   `json:"group,omitempty"`
+	// Heartbeat is refreshed periodically by the daemon
+	Heartbeat time.Time `json:"heartbeat,omitempty"`
+	// Host is the machine the daemon runs on, for state dirs shared between hosts
+	Host string `json:"host,omitempty"`
+	// Recording is the asciicast file of the session, if it is being recorded
+	Recording string `json:"recording,omitempty"`
+	// Profile is the config profile the session was started with
+	Profile string `json:"profile,omitempty"`
+	// Umask, Locale and TZ are the overrides of the shell's environment
+	Umask  string `json:"umask,omitempty"`
+	Locale string `json:"locale,omitempty"`
+	TZ     string `json:"tz,omitempty"`
+	// Term is the TERM of the shell, once it is known from the starting
+	// terminal, the first master or the term setting
+	Term string `json:"term,omitempty"`
+	// Env holds the names of the variables given with start -e. Their values
+	// may be secrets and are never written to disk.
+	Env []string `json:"env,omitempty"`
+	// Waiting names the precondition the daemon waits for before starting
+	// the session command
+	Waiting string `json:"waiting,omitempty"`
+	// Ended and ExitCode are set by the daemon when the session command
+	// exits; ExitCode is nil if the daemon died first
+	Ended    time.Time `json:"ended,omitempty"`
+	ExitCode *int      `json:"exit_code,omitempty"`
+}
+
+// Hostname returns the name of the local host, or an empty string if unknown
+func Hostname() string {
+	host, _ := os.Hostname()
+	return host
+}
+
+// SplitHost splits a host-qualified session name of the form name@host.
+// qualified is true if the target contained an @, even with an empty host.
+func SplitHost(target string) (name, host string, qualified bool) {
+	name, host, qualified = strings.Cut(target, "@")
+	return name, host, qualified
+}
+
+// IsLocal reports whether the session runs on this host. Sessions recorded
+// before hosts were tracked are assumed to be local.
+func (i Info) IsLocal() bool {
+	return i.Host == "" || i.Host == Hostname()
+}
+
+// HeartbeatTimeout is how long a daemon heartbeat is trusted as proof of liveness
+const HeartbeatTimeout = 15 * time.Second
+
+// HasTag reports whether the session carries the given tag
+func (i Info) HasTag(tag string) bool {
+	for _, t := range i.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseTags splits a comma-separated tag list and validates each tag
+func ParseTags(list string) ([]string, error) {
+	var tags []string
+	for _, tag := range strings.Split(list, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		if !nameRegex.MatchString(tag) {
+			return nil, fmt.Errorf("tag '%s' must only contain alphanumeric characters, underscores, and hyphens", tag)
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+// bannerData is the data available to banner templates
+type bannerData struct {
+	Name      string
+	Command   string
+	Host      string
+	User      string
+	StartTime time.Time
+}
+
+// BannerFor returns the rendered banner of a session, ready to be written to a
+// terminal. The session's own banner takes precedence over the global one.
+func BannerFor(info Info) string {
+	tmpl := info.Banner
+	if tmpl == "" {
+		tmpl = config.Current().Banner
+	}
+	if tmpl == "" {
+		return ""
+	}
+	text, err := RenderBanner(tmpl, info)
+	if err != nil {
+		text = tmpl
+	}
+	text = strings.TrimRight(text, "\n")
+	var b strings.Builder
+	for _, line := range strings.Split(text, "\n") {
+		b.WriteString("\x1b[7m" + line + "\x1b[0m\r\n")
+	}
+	return b.String()
+}
+
+// RenderBanner renders a banner template (text/template syntax) for a session.
+// Templates can use {{.Name}}, {{.Command}}, {{.Host}}, {{.User}} and {{.StartTime}}.
+func RenderBanner(tmpl string, info Info) (string, error) {
+	t, err := template.New("banner").Parse(tmpl)
+	if err != nil {
+		return "", err
+	}
+	host, _ := os.Hostname()
+	data := bannerData{
+		Name:      info.Name,
+		Command:   info.Command,
+		Host:      host,
+		User:      os.Getenv("USER"),
+		StartTime: info.StartTime,
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// StateCrashed marks a session whose daemon died from a panic.
+const StateCrashed = "crashed"
+
+// StateSuspended marks a session whose processes were stopped with suspend.
+const StateSuspended = "suspended"
+
+// GetCrashPath returns the path to the crash report for a session
+func GetCrashPath(name string) (string, error) {
+	dir, err := EnsureDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, fmt.Sprintf("%s.crash", name)), nil
+}
+
+// CrashReport describes a crash report left behind by a daemon
+type CrashReport struct {
+	Name string
+	Path string
+	Time time.Time
+}
+
+// ListCrashes returns all crash reports, newest first
+func ListCrashes() ([]CrashReport, error) {
+	dir, err := EnsureDir()
+	if err != nil {
+		return nil, err
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var reports []CrashReport
+	for _, f := range files {
+		if filepath.Ext(f.Name()) != ".crash" {
+			continue
+		}
+		fi, err := f.Info()
+		if err != nil {
+			continue
+		}
+		reports = append(reports, CrashReport{
+			Name: f.Name()[:len(f.Name())-6],
+			Path: filepath.Join(dir, f.Name()),
+			Time: fi.ModTime(),
+		})
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].Time.After(reports[j].Time)
+	})
+	return reports, nil
+}
+
+// GetNameFilePath returns the path of the file holding the current name of
+// the session served by the daemon with the given PID. Shell integration reads
+// it to follow live renames.
+func GetNameFilePath(daemonPID int) (string, error) {
+	dir, err := EnsureDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, fmt.Sprintf(".%s-%d.name", Hostname(), daemonPID)), nil
+}
+
+// parseNameFile extracts the host and daemon PID from a name file's base name
+func parseNameFile(base string) (string, int, error) {
+	stem := strings.TrimSuffix(strings.TrimPrefix(base, "."), ".name")
+	idx := strings.LastIndexByte(stem, '-')
+	if idx < 0 {
+		pid, err := strconv.Atoi(stem)
+		return "", pid, err
+	}
+	pid, err := strconv.Atoi(stem[idx+1:])
+	return stem[:idx], pid, err
+}
+
+// GetRecordingPath returns the path of an asciicast recording of a session
+// started at the given time. Recordings outlive their session and are never
+// removed by Clean.
+func GetRecordingPath(name string, started time.Time) (string, error) {
+	dir, err := EnsureDir()
+	if err != nil {
+		return "", err
+	}
+	recDir := filepath.Join(dir, "recordings")
+	if err := os.MkdirAll(recDir, 0700); err != nil {
+		return "", err
+	}
+	return filepath.Join(recDir, fmt.Sprintf("%s-%s.cast", name, started.Format("20060102-150405"))), nil
 }
 
-// GetSSHSockPath returns the path to the stable ssh-agent symlink for a session
-func GetSSHSockPath(name string) (string, error) {
+// GetEnvFilePath returns the path to the file exporting a session's forwarded environment
+func GetEnvFilePath(name string) (string, error) {
 	dir, err := EnsureDir()
 	if err != nil {
 		return "", err
 	}
-	return filepath.Join(dir, fmt.Sprintf("%s.ssh_auth_sock", name)), nil
+	return filepath.Join(dir, fmt.Sprintf("%s.env", name)), nil
 }
 
+// GetEnvLinkPath returns the path to the stable symlink for a forwarded
+// environment variable holding a path (e.g. SSH_AUTH_SOCK)
+func GetEnvLinkPath(name, key string) (string, error) {
+	dir, err := EnsureDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, fmt.Sprintf("%s.env.%s", name, strings.ToLower(key))), nil
+}
+
+// envFileRegex matches env files and env symlinks, capturing the session name
+var envFileRegex = regexp.MustCompile(`^([a-zA-Z0-9_-]+)\.env(\.\w+)?$`)
+
 // IsAlive checks if the shell process is still running and the socket is active
 func (i Info) IsAlive() bool {
 	if i.PID <= 0 {
 		return false
 	}
+	// PIDs and sockets of other hosts can't be checked from here; trust the heartbeat
+	if !i.IsLocal() {
+		return time.Since(i.Heartbeat) < HeartbeatTimeout
+	}
 	process, err := os.FindProcess(i.PID)
 	if err != nil {
 		return false
@@ -63,10 +324,91 @@ func (i Info) IsAlive() bool {
 		return false
 	}
 
+	// Verify the PID still belongs to our shell and was not reused
+	if i.ProcStart != 0 {
+		if start, err := ProcStartTime(i.PID); err == nil && start != i.ProcStart {
+			return false
+		}
+	}
+
+	sockPath, err := i.SocketPath()
+	if err != nil {
+		return false
+	}
+
+	// Abstract sockets leave no stale files behind, and daemons waiting for
+	// preconditions have no socket yet, so a recent heartbeat is enough
+	if (IsAbstract(sockPath) || i.Waiting != "") && time.Since(i.Heartbeat) < HeartbeatTimeout {
+		return true
+	}
+
 	// Double check socket liveness to handle PID reuse after reboot/crash
-	dir, _ := EnsureDir()
-	sockPath := filepath.Join(dir, i.Name+".sock")
+	return SocketExists(sockPath)
+}
+
+// SocketPath returns the socket of the session: its custom socket, or the
+// default one for its name.
+func (i Info) SocketPath() (string, error) {
+	if i.Socket != "" {
+		return i.Socket, nil
+	}
+	return GetSocketPath(i.Name)
+}
+
+// ResolveSocketPath returns the socket of session name, looked up in its info
+// file so sessions started with a custom socket are found by name too.
+func ResolveSocketPath(name string) (string, error) {
+	if info, err := ReadInfo(name); err == nil && info.Socket != "" {
+		return info.Socket, nil
+	}
+	return GetSocketPath(name)
+}
+
+// ListenUnix binds a Unix socket at path that only the user can connect to.
+// A stale socket at path is replaced; any other file is left alone. The
+// umask is set while binding, so the socket is never open to others.
+func ListenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode().Type() != os.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		_ = os.Remove(path)
+	}
+	defer syscall.Umask(syscall.Umask(0077))
+	return net.Listen("unix", path)
+}
+
+// isSocket reports whether path is a socket file, not following symlinks
+func isSocket(path string) bool {
+	fi, err := os.Lstat(path)
+	return err == nil && fi.Mode().Type() == os.ModeSocket
+}
+
+// removeSocket removes path if it is a socket. Socket paths can be given by
+// the user, so whatever else is there is left alone.
+func removeSocket(path string) {
+	if isSocket(path) {
+		_ = os.Remove(path)
+	}
+}
+
+// IsAbstract reports whether a socket path names a Linux abstract socket
+func IsAbstract(sockPath string) bool {
+	return strings.HasPrefix(sockPath, "@")
+}
+
+// SocketExists reports whether a session socket is accepting connections.
+// Abstract sockets have no file, so only the dial is meaningful for them.
+func SocketExists(sockPath string) bool {
+	if !IsAbstract(sockPath) {
+		_, err := os.Stat(sockPath)
+		if err != nil {
+			return false
+		}
+	}
+	done := timing.Track("liveness dial")
 	conn, err := net.DialTimeout("unix", sockPath, 50*time.Millisecond)
+	done()
 	if err != nil {
 		// Socket file exists but no one is listening -> stale
 		return false
@@ -75,12 +417,47 @@ func (i Info) IsAlive() bool {
 	return true
 }
 
-// Cleanup removes all files associated with a session
+// IsPIDAlive reports whether a process with the given PID exists
+func IsPIDAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	return process.Signal(syscall.Signal(0)) == nil
+}
+
+// Cleanup removes all files associated with a session, moving its logs to
+// the history first, see Archive
 func Cleanup(name string) {
 	dir, _ := EnsureDir()
-	_ = os.Remove(filepath.Join(dir, name+".sock"))
+	if info, err := ReadInfo(name); err == nil {
+		// Logs move to the history unless it is disabled
+		_, _ = Archive(info)
+		// Forwarded env files may still carry a previous session name
+		if info.EnvFile != "" {
+			_ = os.Remove(info.EnvFile)
+		}
+		for _, link := range info.EnvLinks {
+			_ = os.Remove(link)
+		}
+		// Logs outside the state directory are tracked until clean -logs
+		// or custom_log_cleanup removes them
+		_ = TrackExternalLogs(info)
+		if info.Socket != "" && !IsAbstract(info.Socket) && !SocketExists(info.Socket) {
+			removeSocket(info.Socket)
+		}
+	}
+	if sockPath, err := GetSocketPath(name); err == nil && !IsAbstract(sockPath) {
+		removeSocket(sockPath)
+	}
 	_ = os.Remove(filepath.Join(dir, name+".info"))
-	_ = os.Remove(filepath.Join(dir, name+".ssh_auth_sock"))
+	_ = os.Remove(filepath.Join(dir, name+".env"))
+	for _, suffix := range debugFiles {
+		_ = os.Remove(filepath.Join(dir, name+suffix))
+	}
 	
 	// Remove all .log and .log.N files
 	files, _ := os.ReadDir(dir)
@@ -98,6 +475,18 @@ func GetLogFiles(name string) ([]string, error) {
 		return nil, err
 	}
 	
+	activeLog := filepath.Join(dir, name+".log")
+	if info, err := ReadInfo(name); err == nil && info.LogPath != "" {
+		// Custom logs rotate next to themselves
+		activeLog = info.LogPath
+	}
+	return logFilesAt(activeLog)
+}
+
+// logFilesAt returns the active log file at activeLog and the files rotated
+// next to it, oldest first
+func logFilesAt(activeLog string) ([]string, error) {
+	dir := filepath.Dir(activeLog)
 	files, err := os.ReadDir(dir)
 	if err != nil {
 		return nil, err
@@ -109,9 +498,7 @@ func GetLogFiles(name string) ([]string, error) {
 	}
 	var rotated []logEntry
 
-	activeLog := filepath.Join(dir, name+".log")
-
-	prefix := name + ".log."
+	prefix := filepath.Base(activeLog) + "."
 	for _, f := range files {
 		if len(f.Name()) > len(prefix) && f.Name()[:len(prefix)] == prefix {
 			idx, err := strconv.Atoi(f.Name()[len(prefix):])
@@ -139,6 +526,69 @@ func GetLogFiles(name string) ([]string, error) {
 	return result, nil
 }
 
+// LogSegment is a log file of a session with the rotation marker to show
+// before its contents, if any.
+type LogSegment struct {
+	Path   string
+	Marker string
+}
+
+// markerData is the data available to rotation marker templates
+type markerData struct {
+	Time      time.Time // When the previous file was rotated
+	Dropped   int       // Number of older files removed by rotation
+	DroppedMB int       // Approximate size of the removed files
+}
+
+// LogSegments returns the log files of a session, oldest first, each with the
+// rotation_marker to insert before it. The oldest file gets a marker only if
+// rotation removed files before it.
+func LogSegments(name string) ([]LogSegment, error) {
+	files, err := GetLogFiles(name)
+	if err != nil {
+		return nil, err
+	}
+	return logSegments(files), nil
+}
+
+// logSegments adds the rotation markers to log files, see LogSegments
+func logSegments(files []string) []LogSegment {
+	tmpl := config.Current().RotationMarker
+	segments := make([]LogSegment, 0, len(files))
+	for i, path := range files {
+		seg := LogSegment{Path: path}
+		var data markerData
+		if i == 0 {
+			// Rotated files are numbered from 1 and only the oldest are removed
+			if idx, err := strconv.Atoi(strings.TrimPrefix(filepath.Ext(path), ".")); err == nil && idx > 1 {
+				data.Dropped = idx - 1
+				data.DroppedMB = data.Dropped * config.Current().LogRotationSizeMB
+			}
+		} else if fi, err := os.Stat(files[i-1]); err == nil {
+			data.Time = fi.ModTime()
+		}
+		if tmpl != "" && (i > 0 || data.Dropped > 0) {
+			seg.Marker = renderMarker(tmpl, data)
+		}
+		segments = append(segments, seg)
+	}
+	return segments
+}
+
+// renderMarker renders a rotation marker template, or returns it unrendered
+// if it is invalid
+func renderMarker(tmpl string, data markerData) string {
+	t, err := template.New("marker").Parse(tmpl)
+	if err != nil {
+		return tmpl
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return tmpl
+	}
+	return b.String()
+}
+
 // Rename moves all session files to a new name
 func Rename(oldName, newName string) error {
 	dir, err := EnsureDir()
@@ -146,12 +596,19 @@ func Rename(oldName, newName string) error {
 		return err
 	}
 
-	extensions := []string{".sock", ".info", ".log"}
-	for _, ext := range extensions {
-		oldPath := filepath.Join(dir, oldName+ext)
-		newPath := filepath.Join(dir, newName+ext)
-		if _, err := os.Stat(oldPath); err == nil {
-			if err := os.Rename(oldPath, newPath); err != nil {
+	var paths [][2]string
+	// Custom sockets keep their path
+	oldInfo, oldErr := ReadInfo(oldName)
+	if oldSock, err := GetSocketPath(oldName); err == nil && !IsAbstract(oldSock) && (oldErr != nil || oldInfo.Socket == "") {
+		newSock, _ := GetSocketPath(newName)
+		paths = append(paths, [2]string{oldSock, newSock})
+	}
+	for _, ext := range []string{".info", ".log", ".log.sum"} {
+		paths = append(paths, [2]string{filepath.Join(dir, oldName+ext), filepath.Join(dir, newName+ext)})
+	}
+	for _, p := range paths {
+		if _, err := os.Stat(p[0]); err == nil {
+			if err := os.Rename(p[0], p[1]); err != nil {
 				return err
 			}
 		}
@@ -163,6 +620,13 @@ func Rename(oldName, newName string) error {
 		info.Name = newName
 		_ = WriteInfo(info)
 	}
+	_ = updateLayout(func(l *Layout) {
+		for i := range l.Attachments {
+			if l.Attachments[i].Session == oldName {
+				l.Attachments[i].Session = newName
+			}
+		}
+	})
 
 	return nil
 }
@@ -172,28 +636,102 @@ func GetHomeDir() (string, error) {
 	return os.UserHomeDir()
 }
 
-// EnsureDir creates the persistent directory if it doesn't exist
-func EnsureDir() (string, error) {
+// GetStateDir returns the directory holding session state (info, logs, ...):
+// $PERSISHTENT_DIR if set, the legacy ~/.persishtent if it exists, and
+// $XDG_STATE_HOME/persishtent (default ~/.local/state/persishtent) otherwise.
+func GetStateDir() (string, error) {
+	if dir := os.Getenv("PERSISHTENT_DIR"); dir != "" {
+		return dir, nil
+	}
 	home, err := GetHomeDir()
 	if err != nil {
 		return "", err
 	}
-	path := filepath.Join(home, DirName)
+	legacy := filepath.Join(home, DirName)
+	if fi, err := os.Stat(legacy); err == nil && fi.IsDir() {
+		return legacy, nil
+	}
+	stateHome := os.Getenv("XDG_STATE_HOME")
+	if !filepath.IsAbs(stateHome) {
+		stateHome = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(stateHome, AppName), nil
+}
+
+// GetRuntimeDir returns the directory holding session sockets. Sockets live
+// in $XDG_RUNTIME_DIR/persishtent, as they don't work on network filesystems;
+// /run/user/<uid> is used if the variable is unset (e.g. under sudo or cron)
+// so all clients agree on the path. With PERSISHTENT_DIR set or a legacy
+// ~/.persishtent, sockets stay next to the state.
+func GetRuntimeDir() (string, error) {
+	state, err := GetStateDir()
+	if err != nil {
+		return "", err
+	}
+	if os.Getenv("PERSISHTENT_DIR") != "" {
+		return state, nil
+	}
+	if home, err := GetHomeDir(); err == nil && state == filepath.Join(home, DirName) {
+		return state, nil
+	}
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if !filepath.IsAbs(runtimeDir) {
+		runtimeDir = fmt.Sprintf("/run/user/%d", os.Getuid())
+		if fi, err := os.Stat(runtimeDir); err != nil || !fi.IsDir() {
+			return state, nil
+		}
+	}
+	return filepath.Join(runtimeDir, AppName), nil
+}
+
+// EnsureDir creates the state directory if it doesn't exist
+func EnsureDir() (string, error) {
+	path, err := GetStateDir()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// EnsureRuntimeDir creates the socket directory if it doesn't exist
+func EnsureRuntimeDir() (string, error) {
+	path, err := GetRuntimeDir()
+	if err != nil {
+		return "", err
+	}
 	if err := os.MkdirAll(path, 0700); err != nil {
 		return "", err
 	}
 	return path, nil
 }
 
-// GetSocketPath returns the path to the unix socket for a session
+// GetSocketPath returns the path to the unix socket for a session. With
+// abstract_sockets enabled on Linux, the path is an abstract socket name
+// (prefixed with @) scoped to the state directory.
 func GetSocketPath(name string) (string, error) {
-	dir, err := EnsureDir()
+	if useAbstractSockets() {
+		dir, err := EnsureDir()
+		if err != nil {
+			return "", err
+		}
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(dir))
+		return fmt.Sprintf("@persishtent-%08x/%s", h.Sum32(), name), nil
+	}
+	dir, err := EnsureRuntimeDir()
 	if err != nil {
 		return "", err
 	}
 	return filepath.Join(dir, fmt.Sprintf("%s.sock", name)), nil
 }
 
+func useAbstractSockets() bool {
+	return config.Current().AbstractSockets && runtime.GOOS == "linux"
+}
+
 // GetLogPath returns the path to the log file for a session
 func GetLogPath(name string) (string, error) {
 	dir, err := EnsureDir()
@@ -222,7 +760,27 @@ func WriteInfo(info Info) error {
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(path, data, 0600)
+
+	// Write a new file and rename it, so a full disk or quota never leaves a
+	// truncated info file behind
+	f, err := os.CreateTemp(filepath.Dir(path), "."+info.Name+".info.*")
+	if err != nil {
+		return Classify(err)
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	return nil
 }
 
 // ReadInfo reads session info from a file
@@ -233,43 +791,128 @@ func ReadInfo(name string) (Info, error) {
 	}
 	data, err := os.ReadFile(path)
 	if err != nil {
-		return Info{}, err
+		return Info{}, Classify(err)
 	}
 	var info Info
 	err = json.Unmarshal(data, &info)
 	return info, err
 }
 
-// Clean removes all stale sessions and orphaned files, returning active sessions and count of removed files
-func Clean() ([]Info, int, error) {
+// Reasons Clean removed a file, see RemovedFile
+const (
+	RemovedEnded    = "session ended" // A file of a session whose shell exited
+	RemovedOrphaned = "orphaned"      // A file of no known session, e.g. left by a crash
+	RemovedSocket   = "stale socket"  // A socket nobody listens on
+	RemovedOld      = "old log"       // A log last written before CleanOptions.LogsOlderThan
+	RemovedArchived = "archived"      // A file of the history, see CleanOptions.Archived
+)
+
+// CleanOptions makes CleanWith remove more than Clean does, or nothing
+type CleanOptions struct {
+	DryRun bool // Only report the files that would be removed
+	// LogsOlderThan also removes history entries of sessions that ended
+	// before it, and rotated logs of running sessions last written before it
+	LogsOlderThan time.Time
+	Archived      bool // Remove the whole history
+	// SocketsOnly only removes stale sockets, leaving ended sessions, their
+	// logs and the history alone, see CleanSockets
+	SocketsOnly bool
+}
+
+// RemovedFile is a file removed by Clean
+type RemovedFile struct {
+	Path    string `json:"path"`
+	Session string `json:"session,omitempty"` // The session the file belonged to
+	Reason  string `json:"reason"`
+	Size    int64  `json:"size"` // Bytes reclaimed
+}
+
+// removeFile removes path and records it in removed. With dryRun, path is
+// only recorded if it exists.
+func removeFile(removed *[]RemovedFile, path string, name string, reason string, dryRun bool) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return
+	}
+	var size int64
+	if fi.Mode().IsRegular() {
+		size = fi.Size()
+	}
+	if dryRun || os.Remove(path) == nil {
+		*removed = append(*removed, RemovedFile{Path: path, Session: name, Reason: reason, Size: size})
+	}
+}
+
+// Clean removes all stale sessions and orphaned files, returning active
+// sessions and the files removed
+func Clean() ([]Info, []RemovedFile, error) {
+	return CleanWith(CleanOptions{})
+}
+
+// CleanSockets removes the stale sockets left by crashed daemons, returning
+// active sessions and the sockets removed. Run on every invocation, it
+// leaves archiving and pruning the history to Clean.
+func CleanSockets() ([]Info, []RemovedFile, error) {
+	return CleanWith(CleanOptions{SocketsOnly: true})
+}
+
+// CleanWith is Clean with options, see CleanOptions
+func CleanWith(opts CleanOptions) ([]Info, []RemovedFile, error) {
 	dir, err := EnsureDir()
 	if err != nil {
-		return nil, 0, err
+		return nil, nil, err
 	}
 
 	files, err := os.ReadDir(dir)
 	if err != nil {
-		return nil, 0, err
+		return nil, nil, err
 	}
 
 	// 1. Identify active sessions
+	var removed []RemovedFile
 	active := make(map[string]bool)
+	ended := make(map[string]bool)
+	archived := make(map[string]bool) // Logs moved to the history, maybe by another clean
+	keep := make(map[string]bool)
 	var sessions []Info
 	for _, f := range files {
 		if filepath.Ext(f.Name()) == ".info" {
 			name := f.Name()[:len(f.Name())-5]
 			info, err := ReadInfo(name)
+			if err == nil && !info.IsLocal() {
+				// Never remove the files of sessions owned by another host
+				active[name] = true
+				continue
+			}
+			if err == nil && !info.IsAlive() && !opts.SocketsOnly {
+				ended[name] = true
+				if opts.DryRun {
+					archived[name] = archives(info)
+				} else {
+					_ = TrackExternalLogs(info)
+					archived[name], _ = Archive(info)
+				}
+			}
+			if err == nil && !info.IsAlive() && info.Socket != "" && !IsAbstract(info.Socket) && !SocketExists(info.Socket) && isSocket(info.Socket) {
+				// Stale custom sockets live outside the state directory
+				removeFile(&removed, info.Socket, name, RemovedSocket, opts.DryRun)
+			}
 			if err == nil && info.IsAlive() {
 				active[name] = true
 				sessions = append(sessions, info)
+				if info.EnvFile != "" {
+					keep[filepath.Base(info.EnvFile)] = true
+				}
+				for _, link := range info.EnvLinks {
+					keep[filepath.Base(link)] = true
+				}
 			}
 		}
 	}
 
 	// 2. Remove files not belonging to active sessions
-	removedCount := 0
 	for _, f := range files {
-		if f.IsDir() {
+		if f.IsDir() || opts.SocketsOnly && filepath.Ext(f.Name()) != ".sock" {
 			continue
 		}
 
@@ -282,36 +925,171 @@ func Clean() ([]Info, int, error) {
 			isSessionFile = true
 		} else if filepath.Ext(name) == ".info" {
 			sessionName = name[:len(name)-5]
+			isSessionFile = !archived[sessionName]
+		} else if matches := envFileRegex.FindStringSubmatch(name); matches != nil {
+			sessionName = matches[1]
 			isSessionFile = true
-		} else if len(name) > 14 && name[len(name)-14:] == ".ssh_auth_sock" {
-			sessionName = name[:len(name)-14]
+		} else if strings.HasSuffix(name, ".ssh_auth_sock") {
+			// Agent symlinks left behind by older versions
+			sessionName = strings.TrimSuffix(name, ".ssh_auth_sock")
+			isSessionFile = true
+		} else if filepath.Ext(name) == ".name" {
+			// Daemon name files are keyed by host and daemon PID
+			host, pid, err := parseNameFile(name)
+			if err == nil && ((host != "" && host != Hostname()) || IsPIDAlive(pid)) {
+				continue
+			}
+			sessionName = name
 			isSessionFile = true
 		} else if filepath.Ext(name) == ".log" {
 			sessionName = name[:len(name)-4]
-			isSessionFile = true
+			isSessionFile = !archived[sessionName]
+		} else if debugName, ok := debugFileSession(name); ok {
+			sessionName = debugName
+			isSessionFile = !archived[sessionName]
 		} else {
-			// Handle rotated logs: name.log.N
+			// Handle rotated logs and integrity indexes: name.log.N,
+			// name.log.sum and name.log.N.sum
 			// We look for ".log." inside the name
-			re := regexp.MustCompile(`^(.*)\.log\.\d+$`)
+			re := regexp.MustCompile(`^(.*)\.log(\.\d+|(\.\d+)?\.sum)$`)
 			matches := re.FindStringSubmatch(name)
 			if len(matches) > 1 {
 				sessionName = matches[1]
-				isSessionFile = true
+				isSessionFile = !archived[sessionName]
 			}
 		}
 
-		if isSessionFile && sessionName != "" && !active[sessionName] {
+		if isSessionFile && sessionName != "" && !active[sessionName] && !keep[name] {
 			fullPath := filepath.Join(dir, name)
-			if err := os.Remove(fullPath); err == nil {
-				removedCount++
+			// A daemon whose info was deleted still listens; gc needs its
+			// socket. Other files named like sockets aren't ours.
+			if filepath.Ext(name) == ".sock" && (SocketExists(fullPath) || !isSocket(fullPath)) {
+				continue
+			}
+			reason := RemovedOrphaned
+			if filepath.Ext(name) == ".sock" {
+				reason = RemovedSocket
+			} else if ended[sessionName] {
+				reason = RemovedEnded
+			}
+			if filepath.Ext(name) == ".name" {
+				// Name files aren't named after their session
+				sessionName = ""
+			}
+			removeFile(&removed, fullPath, sessionName, reason, opts.DryRun)
+		}
+	}
+
+	// 3. Remove history entries past history_retention_days, and old logs on request
+	if !opts.SocketsOnly {
+		pruneHistory(&removed, opts)
+	}
+	if !opts.LogsOlderThan.IsZero() {
+		for _, info := range sessions {
+			removeOldLogs(&removed, info, opts)
+		}
+	}
+
+	// 4. Remove stale sockets kept outside the state directory
+	if runtimeDir, err := GetRuntimeDir(); err == nil && runtimeDir != dir {
+		socks, _ := os.ReadDir(runtimeDir)
+		for _, f := range socks {
+			name := f.Name()
+			if filepath.Ext(name) != ".sock" || active[name[:len(name)-5]] {
+				continue
 			}
+			if SocketExists(filepath.Join(runtimeDir, name)) {
+				continue
+			}
+			removeFile(&removed, filepath.Join(runtimeDir, name), name[:len(name)-5], RemovedSocket, opts.DryRun)
 		}
 	}
-	return sessions, removedCount, nil
+	return sessions, removed, nil
 }
 
-// List returns a list of active sessions
+// List returns a list of active sessions on this host
 func List() ([]Info, error) {
+	return list(false)
+}
+
+// Next returns the active session listed after name, wrapping around to the
+// first, or "" if there is no other session
+func Next(name string) string {
+	sessions, err := List()
+	if err != nil {
+		return ""
+	}
+	for i, info := range sessions {
+		if info.Name == name {
+			if next := sessions[(i+1)%len(sessions)]; next.Name != name {
+				return next.Name
+			}
+			return ""
+		}
+	}
+	if len(sessions) > 0 {
+		return sessions[0].Name
+	}
+	return ""
+}
+
+// ListAllHosts returns active sessions of all hosts sharing the state directory
+func ListAllHosts() ([]Info, error) {
+	return list(true)
+}
+
+// Details is an active session with what its files tell beyond the info
+type Details struct {
+	Info
+	HeartbeatAge time.Duration `json:"heartbeat_age"` // Since the daemon last refreshed the info file, 0 if unknown
+	LogSize      int64         `json:"log_size"`      // Bytes in the log files, rotated ones included
+	LogFiles     int           `json:"log_files"`
+	LastOutput   time.Time     `json:"last_output"`             // When the active log file was last written, zero if unknown
+	CustomSocket bool          `json:"custom_socket,omitempty"` // Started with a socket path, see Info.Socket
+	CustomLog    bool          `json:"custom_log,omitempty"`    // Logging outside the state directory
+}
+
+// ListDetails returns the active sessions of List, or of ListAllHosts if
+// allHosts, with details gathered from their files.
+func ListDetails(allHosts bool) ([]Details, error) {
+	sessions, err := list(allHosts)
+	if err != nil {
+		return nil, err
+	}
+	details := make([]Details, len(sessions))
+	for i, info := range sessions {
+		details[i] = describe(info)
+	}
+	return details, nil
+}
+
+// describe gathers the details of an active session. The log files of
+// sessions of other hosts may not be visible from here and aren't counted.
+func describe(info Info) Details {
+	d := Details{Info: info, CustomSocket: info.Socket != ""}
+	if !info.Heartbeat.IsZero() {
+		d.HeartbeatAge = time.Since(info.Heartbeat)
+	}
+	if defaultLog, err := GetLogPath(info.Name); err == nil && info.LogPath != "" && info.LogPath != defaultLog {
+		d.CustomLog = true
+	}
+	if info.LogPath == "" || !info.IsLocal() {
+		return d
+	}
+	if fi, err := os.Stat(info.LogPath); err == nil {
+		d.LastOutput = fi.ModTime()
+	}
+	files, _ := GetLogFiles(info.Name)
+	for _, path := range files {
+		if fi, err := os.Stat(path); err == nil {
+			d.LogSize += fi.Size()
+			d.LogFiles++
+		}
+	}
+	return d
+}
+
+func list(allHosts bool) ([]Info, error) {
 	dir, err := EnsureDir()
 	if err != nil {
 		return nil, err
@@ -322,9 +1100,10 @@ func List() ([]Info, error) {
 		return nil, err
 	}
 	
+	// Info files are the session registry; socket files may not exist for abstract sockets
 	var sessions []Info
 	for _, f := range files {
-		if filepath.Ext(f.Name()) == ".sock" {
+		if filepath.Ext(f.Name()) == ".info" {
 			name := f.Name()[:len(f.Name())-5]
 			info, err := ReadInfo(name)
 			if err != nil {
@@ -333,7 +1112,15 @@ func List() ([]Info, error) {
 				Cleanup(name)
 				continue
 			}
-			
+
+			if !info.IsLocal() {
+				// Sessions of other hosts are left to their own daemons
+				if allHosts && info.IsAlive() {
+					sessions = append(sessions, info)
+				}
+				continue
+			}
+
 			if info.IsAlive() {
 				sessions = append(sessions, info)
 			} else {
@@ -1,17 +1,33 @@
 package session
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"net"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
+
+	"persishtent/internal/config"
 )
 
+// setHome isolates a test in a temporary home directory, with all session
+// files in the legacy location regardless of the caller's XDG variables.
+func setHome(t *testing.T, home string) {
+	t.Setenv("HOME", home)
+	t.Setenv("PERSISHTENT_DIR", filepath.Join(home, DirName))
+}
+
 func TestEnsureDir(t *testing.T) {
 	home := t.TempDir()
-	t.Setenv("HOME", home)
+	setHome(t, home)
 
 	path, err := EnsureDir()
 	if err != nil {
@@ -29,7 +45,7 @@ func TestEnsureDir(t *testing.T) {
 
 func TestGetPaths(t *testing.T) {
 	fakeHome := t.TempDir()
-	t.Setenv("HOME", fakeHome)
+	setHome(t, fakeHome)
 
 	name := "testsession"
 
@@ -59,9 +75,76 @@ func TestGetPaths(t *testing.T) {
 	}
 }
 
-func TestSessionInfo(t *testing.T) {
+func TestStateDirs(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("PERSISHTENT_DIR", "")
+	t.Setenv("XDG_STATE_HOME", filepath.Join(home, "state"))
+	t.Setenv("XDG_RUNTIME_DIR", filepath.Join(home, "run"))
+
+	// XDG locations
+	state, _ := GetStateDir()
+	if want := filepath.Join(home, "state", AppName); state != want {
+		t.Errorf("Expected state dir %s, got %s", want, state)
+	}
+	sock, _ := GetSocketPath("xdg")
+	if want := filepath.Join(home, "run", AppName, "xdg.sock"); sock != want {
+		t.Errorf("Expected socket %s, got %s", want, sock)
+	}
+
+	// Relative values are ignored as required by the spec
+	t.Setenv("XDG_STATE_HOME", "relative")
+	state, _ = GetStateDir()
+	if want := filepath.Join(home, ".local", "state", AppName); state != want {
+		t.Errorf("Expected state dir %s, got %s", want, state)
+	}
+
+	// An existing legacy directory keeps everything in one place
+	legacy := filepath.Join(home, DirName)
+	if err := os.Mkdir(legacy, 0700); err != nil {
+		t.Fatal(err)
+	}
+	state, _ = GetStateDir()
+	runtimeDir, _ := GetRuntimeDir()
+	if state != legacy || runtimeDir != legacy {
+		t.Errorf("Expected legacy dir %s, got %s and %s", legacy, state, runtimeDir)
+	}
+
+	// PERSISHTENT_DIR overrides everything
+	custom := filepath.Join(home, "custom")
+	t.Setenv("PERSISHTENT_DIR", custom)
+	sock, _ = GetSocketPath("custom")
+	logPath, _ := GetLogPath("custom")
+	if sock != filepath.Join(custom, "custom.sock") || logPath != filepath.Join(custom, "custom.log") {
+		t.Errorf("Expected files in %s, got %s and %s", custom, sock, logPath)
+	}
+}
+
+func TestCleanRuntimeDir(t *testing.T) {
 	home := t.TempDir()
 	t.Setenv("HOME", home)
+	t.Setenv("PERSISHTENT_DIR", "")
+	t.Setenv("XDG_STATE_HOME", filepath.Join(home, "state"))
+	t.Setenv("XDG_RUNTIME_DIR", filepath.Join(home, "run"))
+
+	stale, _ := GetSocketPath("stale")
+	_ = os.WriteFile(stale, []byte("sock"), 0600)
+
+	_, removed, err := Clean()
+	if err != nil {
+		t.Fatalf("Clean failed: %v", err)
+	}
+	if len(removed) != 1 || removed[0].Reason != RemovedSocket || removed[0].Session != "stale" {
+		t.Errorf("Expected the stale socket removed, got %+v", removed)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Error("Expected stale socket in runtime dir to be removed")
+	}
+}
+
+func TestSessionInfo(t *testing.T) {
+	home := t.TempDir()
+	setHome(t, home)
 
 	name := "infotest"
 	now := time.Now().Round(time.Second)
@@ -102,6 +185,36 @@ func TestSessionInfo(t *testing.T) {
 	}
 }
 
+func TestSessionErrors(t *testing.T) {
+	setHome(t, t.TempDir())
+
+	_, err := ReadInfo("missing")
+	if !errors.Is(err, ErrSessionNotFound) || !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("ReadInfo of a missing session = %v, want ErrSessionNotFound", err)
+	}
+
+	tests := []struct {
+		err  error
+		want error
+	}{
+		{syscall.ECONNREFUSED, ErrSessionNotFound},
+		{syscall.EACCES, ErrNotOwner},
+		{syscall.EROFS, ErrStateReadOnly},
+	}
+	for _, tt := range tests {
+		err := Classify(&net.OpError{Op: "dial", Net: "unix", Err: tt.err})
+		if !errors.Is(err, tt.want) || !errors.Is(err, tt.err) {
+			t.Errorf("Classify(%v) = %v, want %v", tt.err, err, tt.want)
+		}
+	}
+	if err := Classify(syscall.EIO); err != syscall.EIO {
+		t.Errorf("Classify(EIO) = %v, want it unchanged", err)
+	}
+	if err := Classify(nil); err != nil {
+		t.Errorf("Classify(nil) = %v", err)
+	}
+}
+
 func TestValidateName(t *testing.T) {
 	validNames := []string{"session1", "my_session", "test-session", "123", "S_1-2"}
 	invalidNames := []string{"", "session 1", "session/1", "session!", "session$"}
@@ -121,7 +234,7 @@ func TestValidateName(t *testing.T) {
 
 func TestSessionRename(t *testing.T) {
 	home := t.TempDir()
-	t.Setenv("HOME", home)
+	setHome(t, home)
 
 	oldName := "old-session"
 	newName := "new-session"
@@ -169,9 +282,53 @@ func TestIsAliveEdgeCases(t *testing.T) {
 	}
 }
 
+func TestLogSegments(t *testing.T) {
+	home := t.TempDir()
+	setHome(t, home)
+	defer config.Use(*config.Current())
+	config.Update(func(c *config.Config) {
+		c.RotationMarker = config.DefaultRotationMarker
+		c.LogRotationSizeMB = 2
+	})
+
+	name := "segtest"
+	dir, _ := EnsureDir()
+	_ = os.WriteFile(filepath.Join(dir, name+".log.4"), []byte("4"), 0600)
+	_ = os.WriteFile(filepath.Join(dir, name+".log.5"), []byte("5"), 0600)
+	_ = os.WriteFile(filepath.Join(dir, name+".log"), []byte("active"), 0600)
+	rotated := time.Date(2026, 1, 2, 3, 4, 5, 0, time.Local)
+	_ = os.Chtimes(filepath.Join(dir, name+".log.5"), rotated, rotated)
+
+	segments, err := LogSegments(name)
+	if err != nil || len(segments) != 3 {
+		t.Fatalf("LogSegments = %v, %v", segments, err)
+	}
+	if want := "[3 older log files (about 6 MB) removed by rotation]"; segments[0].Marker != want {
+		t.Errorf("First marker = %q, want %q", segments[0].Marker, want)
+	}
+	if !strings.HasPrefix(segments[1].Marker, "[log rotated ") {
+		t.Errorf("Unexpected boundary marker %q", segments[1].Marker)
+	}
+	if want := "[log rotated 2026-01-02 03:04:05]"; segments[2].Marker != want {
+		t.Errorf("Active log marker = %q, want %q", segments[2].Marker, want)
+	}
+
+	// Without removed files the history starts without a marker
+	_ = os.Remove(filepath.Join(dir, name+".log.4"))
+	_ = os.Rename(filepath.Join(dir, name+".log.5"), filepath.Join(dir, name+".log.1"))
+	if segments, _ := LogSegments(name); len(segments) != 2 || segments[0].Marker != "" || segments[1].Marker == "" {
+		t.Errorf("Unexpected segments %+v", segments)
+	}
+
+	config.Update(func(c *config.Config) { c.RotationMarker = "" })
+	if segments, _ := LogSegments(name); segments[1].Marker != "" {
+		t.Errorf("Markers should be disabled, got %q", segments[1].Marker)
+	}
+}
+
 func TestGetLogFiles(t *testing.T) {
 	home := t.TempDir()
-	t.Setenv("HOME", home)
+	setHome(t, home)
 
 	name := "logtest"
 	Cleanup(name)
@@ -207,7 +364,11 @@ func TestGetLogFiles(t *testing.T) {
 func TestClean(t *testing.T) {
 	// Isolate test by using a temp home directory
 	home := t.TempDir()
-	t.Setenv("HOME", home)
+	setHome(t, home)
+
+	// Without a history, the logs of ended sessions are removed
+	defer config.Use(*config.Current())
+	config.Update(func(c *config.Config) { c.HistoryRetentionDays = 0 })
 
 	name := "cleantest"
 	Cleanup(name)
@@ -217,10 +378,18 @@ func TestClean(t *testing.T) {
 
 	// Create some stale files
 	_ = os.WriteFile(filepath.Join(dir, name+".info"), []byte(`{"name":"cleantest","pid":999999}`), 0600)
-	_ = os.WriteFile(filepath.Join(dir, name+".sock"), []byte("sock"), 0600)
+	if stale, err := net.Listen("unix", filepath.Join(dir, name+".sock")); err == nil {
+		// A socket nobody listens on anymore
+		stale.(*net.UnixListener).SetUnlinkOnClose(false)
+		_ = stale.Close()
+	}
 	_ = os.WriteFile(filepath.Join(dir, name+".log"), []byte("log"), 0600)
 	_ = os.WriteFile(filepath.Join(dir, name+".log.1"), []byte("log1"), 0600)
+	_ = os.WriteFile(filepath.Join(dir, name+".log.sum"), []byte("{}"), 0600)
+	_ = os.WriteFile(filepath.Join(dir, name+".log.1.sum"), []byte("{}"), 0600)
 	_ = os.WriteFile(filepath.Join(dir, name+".ssh_auth_sock"), []byte("ssh"), 0600)
+	_ = os.WriteFile(filepath.Join(dir, name+".env"), []byte("env"), 0600)
+	_ = os.WriteFile(filepath.Join(dir, name+".env.ssh_auth_sock"), []byte("ssh"), 0600)
 	
 	// Create a file that should NOT be cleaned
 	otherFile := filepath.Join(dir, "keep_me.txt")
@@ -250,13 +419,25 @@ func TestClean(t *testing.T) {
 	_ = os.WriteFile(filepath.Join(dir, activeName+".info"), activeInfoBytes, 0600)
 	defer Cleanup(activeName)
 
-	sessions, count, err := Clean()
+	sessions, removed, err := Clean()
 	if err != nil {
 		t.Fatalf("Clean failed: %v", err)
 	}
 
-	if count < 5 {
-		t.Errorf("Expected at least 5 files to be cleaned, got %d", count)
+	if len(removed) < 5 {
+		t.Errorf("Expected at least 5 files to be cleaned, got %d", len(removed))
+	}
+	for _, f := range removed {
+		want := RemovedEnded
+		if filepath.Ext(f.Path) == ".sock" {
+			want = RemovedSocket
+		}
+		if f.Session != name || f.Reason != want {
+			t.Errorf("Removed %s of session %q as %q, want %q", filepath.Base(f.Path), f.Session, f.Reason, want)
+		}
+		if filepath.Base(f.Path) == name+".log.1" && f.Size != 4 {
+			t.Errorf("Expected 4 bytes reclaimed from %s, got %d", f.Path, f.Size)
+		}
 	}
 	
 	if len(sessions) != 1 {
@@ -272,7 +453,7 @@ func TestClean(t *testing.T) {
 	}
 
 	// Verify files are gone
-	extensions := []string{".info", ".sock", ".log", ".log.1", ".ssh_auth_sock"}
+	extensions := []string{".info", ".sock", ".log", ".log.1", ".log.sum", ".log.1.sum", ".ssh_auth_sock", ".env", ".env.ssh_auth_sock"}
 	for _, ext := range extensions {
 		if _, err := os.Stat(filepath.Join(dir, name+ext)); err == nil {
 			t.Errorf("File %s%s still exists after Clean", name, ext)
@@ -283,4 +464,1130 @@ func TestClean(t *testing.T) {
 	if _, err := os.Stat(otherFile); err != nil {
 		t.Errorf("File keep_me.txt was incorrectly cleaned")
 	}
-}
\ No newline at end of file
+}
+
+func TestArchive(t *testing.T) {
+	setHome(t, t.TempDir())
+	defer config.Use(*config.Current())
+	config.Update(func(c *config.Config) { c.HistoryRetentionDays = 30 })
+	dir, _ := EnsureDir()
+
+	code := 3
+	ended := time.Now().Add(-time.Minute)
+	for _, info := range []Info{
+		{Name: "build", PID: 999999, LogPath: filepath.Join(dir, "build.log"), StartTime: ended.Add(-time.Hour), Ended: ended, ExitCode: &code},
+		{Name: "tmp", PID: 999999, LogPath: filepath.Join(dir, "tmp.log"), Ephemeral: true},
+	} {
+		if err := WriteInfo(info); err != nil {
+			t.Fatal(err)
+		}
+		_ = os.WriteFile(filepath.Join(dir, info.Name+".log.1"), []byte("old "), 0600)
+		_ = os.WriteFile(filepath.Join(dir, info.Name+".log"), []byte("new"), 0600)
+	}
+	// An entry past the retention is removed by Clean
+	historyDir, _ := GetHistoryDir()
+	expired := filepath.Join(historyDir, "old."+time.Now().AddDate(0, 0, -31).Format("20060102-150405"))
+	_ = os.MkdirAll(expired, 0700)
+	_ = os.WriteFile(filepath.Join(expired, "old.log"), []byte("x"), 0600)
+
+	_, removed, err := Clean()
+	if err != nil {
+		t.Fatalf("Clean failed: %v", err)
+	}
+	for _, f := range removed {
+		if f.Session == "build" {
+			t.Errorf("Clean removed %s instead of archiving it", f.Path)
+		}
+	}
+	if _, err := os.Stat(expired); !os.IsNotExist(err) {
+		t.Errorf("Expired history entry was kept")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "tmp.log")); !os.IsNotExist(err) {
+		t.Errorf("Logs of ephemeral sessions should be removed")
+	}
+
+	entries, err := ListHistory()
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Expected 1 history entry, got %v (%v)", entries, err)
+	}
+	e := entries[0]
+	if e.Name != "build" || e.ExitCode == nil || *e.ExitCode != 3 || !strings.HasPrefix(e.ID, "build.") {
+		t.Errorf("Unexpected history entry %+v", e)
+	}
+	if found, ok := FindHistory("build"); !ok || found.ID != e.ID {
+		t.Errorf("FindHistory didn't find %s", e.ID)
+	}
+	segments, err := e.LogSegments()
+	if err != nil || len(segments) != 2 {
+		t.Fatalf("Expected 2 archived log files, got %v (%v)", segments, err)
+	}
+	var out []byte
+	for _, seg := range segments {
+		data, _ := os.ReadFile(seg.Path)
+		out = append(out, data...)
+	}
+	if string(out) != "old new" {
+		t.Errorf("Archived logs contain %q", out)
+	}
+}
+
+func TestCleanSockets(t *testing.T) {
+	setHome(t, t.TempDir())
+	dir, _ := EnsureDir()
+
+	// An ended session with a stale socket and a log
+	_ = os.WriteFile(filepath.Join(dir, "gone.info"), []byte(`{"name":"gone","pid":999999}`), 0600)
+	_ = os.WriteFile(filepath.Join(dir, "gone.log"), []byte("log"), 0600)
+	stale, err := net.Listen("unix", filepath.Join(dir, "gone.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = stale.Close()
+
+	_, removed, err := CleanSockets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || filepath.Base(removed[0].Path) != "gone.sock" || removed[0].Reason != RemovedSocket {
+		t.Errorf("CleanSockets removed %+v, want only the stale socket", removed)
+	}
+	// Archiving is left to Clean
+	for _, f := range []string{"gone.info", "gone.log"} {
+		if _, err := os.Stat(filepath.Join(dir, f)); err != nil {
+			t.Errorf("%s: %v", f, err)
+		}
+	}
+}
+
+func TestCleanWith(t *testing.T) {
+	setHome(t, t.TempDir())
+	dir, _ := EnsureDir()
+	historyDir, _ := GetHistoryDir()
+
+	// A running session with an old rotated log
+	l, err := net.Listen("unix", filepath.Join(dir, "live.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+	_ = WriteInfo(Info{Name: "live", PID: os.Getpid(), LogPath: filepath.Join(dir, "live.log")})
+	old := time.Now().AddDate(0, 0, -10)
+	for _, f := range []string{"live.log.1", "live.log.1.sum", "live.log"} {
+		_ = os.WriteFile(filepath.Join(dir, f), []byte("x"), 0600)
+	}
+	_ = os.Chtimes(filepath.Join(dir, "live.log.1"), old, old)
+	// History entries that ended 10 days and an hour ago
+	recent := filepath.Join(historyDir, "recent."+time.Now().Add(-time.Hour).Format("20060102-150405"))
+	ten := filepath.Join(historyDir, "ten."+old.Format("20060102-150405"))
+	for _, d := range []string{recent, ten} {
+		_ = os.MkdirAll(d, 0700)
+		_ = os.WriteFile(filepath.Join(d, "info.json"), []byte("{}"), 0600)
+	}
+
+	week := time.Now().AddDate(0, 0, -7)
+	_, removed, err := CleanWith(CleanOptions{DryRun: true, LogsOlderThan: week})
+	if err != nil {
+		t.Fatalf("CleanWith failed: %v", err)
+	}
+	var names []string
+	for _, f := range removed {
+		if f.Reason != RemovedOld {
+			t.Errorf("Removed %s as %q, want %q", f.Path, f.Reason, RemovedOld)
+		}
+		names = append(names, filepath.Base(f.Path))
+	}
+	if strings.Join(names, " ") != "info.json live.log.1 live.log.1.sum" {
+		t.Errorf("Dry run reported %v", names)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "live.log.1")); err != nil {
+		t.Errorf("Dry run removed a file: %v", err)
+	}
+
+	if _, _, err := CleanWith(CleanOptions{LogsOlderThan: week}); err != nil {
+		t.Fatalf("CleanWith failed: %v", err)
+	}
+	for _, path := range []string{filepath.Join(dir, "live.log.1"), ten} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s should be removed", path)
+		}
+	}
+	for _, path := range []string{filepath.Join(dir, "live.log"), recent} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s should be kept: %v", path, err)
+		}
+	}
+
+	if _, removed, _ := CleanWith(CleanOptions{Archived: true}); len(removed) != 1 || removed[0].Reason != RemovedArchived {
+		t.Errorf("Expected the history to be removed, got %v", removed)
+	}
+	if _, err := os.Stat(recent); !os.IsNotExist(err) {
+		t.Errorf("History entry should be removed")
+	}
+}
+
+func TestParseStatStartTime(t *testing.T) {
+	stat := []byte("1234 (weird) name) S 1 1234 1234 0 -1 4194560 100 0 0 0 1 2 0 0 20 0 1 0 987654 1000 100")
+	start, err := parseStatStartTime(stat)
+	if err != nil {
+		t.Fatalf("parseStatStartTime failed: %v", err)
+	}
+	if start != 987654 {
+		t.Errorf("Start time mismatch. Got %d, want 987654", start)
+	}
+
+	if _, err := parseStatStartTime([]byte("1234 (short) S 1")); err == nil {
+		t.Error("Expected error for truncated stat")
+	}
+}
+
+func TestParseStat(t *testing.T) {
+	st, err := parseStat([]byte("4321 (vim (x) y) T 4000 4321 4000 34816 4321 4194304"))
+	if err != nil {
+		t.Fatalf("parseStat failed: %v", err)
+	}
+	if st.state != 'T' || st.pgrp != 4321 || st.sid != 4000 {
+		t.Errorf("Got %+v, want state T, pgrp 4321, sid 4000", st)
+	}
+
+	if _, err := parseStat([]byte("1234 (short) S 1")); err == nil {
+		t.Error("Expected error for truncated stat")
+	}
+}
+
+func TestParseProc(t *testing.T) {
+	// utime 150, stime 50, starttime 1000 ticks, rss 10 pages
+	stat := []byte("4321 (vim (x) y) S 4000 4321 4000 34816 4321 4194304 0 0 0 0 150 50 0 0 20 0 1 0 1000 100000 10")
+	p, err := parseProc(stat, 30*time.Second)
+	if err != nil {
+		t.Fatalf("parseProc failed: %v", err)
+	}
+	if p.PID != 4321 || p.PPID != 4000 || p.Command != "vim (x) y" || p.State != 'S' {
+		t.Errorf("Unexpected process: %+v", p)
+	}
+	if p.CPU != 2*time.Second || p.Age != 20*time.Second || p.RSS != 10*uint64(os.Getpagesize()) {
+		t.Errorf("Got CPU %s, age %s, RSS %d", p.CPU, p.Age, p.RSS)
+	}
+
+	if _, err := parseProc([]byte("1234 (short) S 1"), time.Second); err == nil {
+		t.Error("Expected error for truncated stat")
+	}
+}
+
+func TestParseDaemonArgs(t *testing.T) {
+	d := parseDaemonArgs([]string{"-s", "/tmp/x.sock", "-tag", "a,b", "-record", "work"})
+	if d.Name != "work" || d.SockPath != "/tmp/x.sock" {
+		t.Errorf("parseDaemonArgs = %+v", d)
+	}
+	environ := []byte("HOME=/home/me\x00PERSISHTENT_DIR=/tmp/state\x00")
+	if v := envValue(environ, "PERSISHTENT_DIR"); v != "/tmp/state" {
+		t.Errorf("envValue = %q", v)
+	}
+	if v := envValue(environ, "PERSISHTENT"); v != "" {
+		t.Errorf("envValue matched a prefix: %q", v)
+	}
+}
+
+func TestProcTree(t *testing.T) {
+	cmd := exec.Command("sleep", "10")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("Cannot start child: %v", err)
+	}
+	defer func() { _ = cmd.Process.Kill(); _ = cmd.Wait() }()
+
+	root, err := ProcTree(os.Getpid())
+	if err != nil {
+		t.Skipf("proc unavailable: %v", err)
+	}
+	for _, c := range root.Children {
+		if c.PID == cmd.Process.Pid && c.Command == "sleep 10" {
+			return
+		}
+	}
+	t.Errorf("Child %d not found in tree: %+v", cmd.Process.Pid, root.Children)
+}
+
+func TestIsAlivePIDReuse(t *testing.T) {
+	home := t.TempDir()
+	setHome(t, home)
+
+	start, err := ProcStartTime(os.Getpid())
+	if err != nil {
+		t.Skipf("process start time unavailable: %v", err)
+	}
+
+	name := "reuse"
+	sock, _ := GetSocketPath(name)
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("Failed to create mock socket: %v", err)
+	}
+	defer func() { _ = l.Close() }()
+
+	info := Info{Name: name, PID: os.Getpid(), ProcStart: start}
+	if !info.IsAlive() {
+		t.Error("Expected IsAlive to be true when start time matches")
+	}
+
+	info.ProcStart = start + 1
+	if info.IsAlive() {
+		t.Error("Expected IsAlive to be false when start time differs")
+	}
+}
+
+func TestListCrashes(t *testing.T) {
+	home := t.TempDir()
+	setHome(t, home)
+
+	dir, _ := EnsureDir()
+	_ = os.WriteFile(filepath.Join(dir, "older.crash"), []byte("old"), 0600)
+	_ = os.WriteFile(filepath.Join(dir, "newer.crash"), []byte("new"), 0600)
+	_ = os.WriteFile(filepath.Join(dir, "other.log"), []byte("log"), 0600)
+	past := time.Now().Add(-time.Hour)
+	_ = os.Chtimes(filepath.Join(dir, "older.crash"), past, past)
+
+	reports, err := ListCrashes()
+	if err != nil {
+		t.Fatalf("ListCrashes failed: %v", err)
+	}
+	if len(reports) != 2 {
+		t.Fatalf("Expected 2 crash reports, got %d", len(reports))
+	}
+	if reports[0].Name != "newer" || reports[1].Name != "older" {
+		t.Errorf("Expected newest first, got %s, %s", reports[0].Name, reports[1].Name)
+	}
+
+	// Crash reports must survive Clean
+	if _, _, err := Clean(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "older.crash")); err != nil {
+		t.Error("Clean removed a crash report")
+	}
+}
+
+func TestBanner(t *testing.T) {
+	defer config.Use(*config.Current())
+
+	info := Info{Name: "prod-db", Command: "psql"}
+	text, err := RenderBanner("PRODUCTION: {{.Name}} ({{.Command}})", info)
+	if err != nil {
+		t.Fatalf("RenderBanner failed: %v", err)
+	}
+	if text != "PRODUCTION: prod-db (psql)" {
+		t.Errorf("Unexpected banner %q", text)
+	}
+
+	config.Update(func(c *config.Config) { c.Banner = "" })
+	if got := BannerFor(info); got != "" {
+		t.Errorf("Expected no banner, got %q", got)
+	}
+
+	config.Update(func(c *config.Config) { c.Banner = "global {{.Name}}" })
+	if got := BannerFor(info); got != "\x1b[7mglobal prod-db\x1b[0m\r\n" {
+		t.Errorf("Expected global banner, got %q", got)
+	}
+
+	info.Banner = "line1\nline2"
+	if got := BannerFor(info); got != "\x1b[7mline1\x1b[0m\r\n\x1b[7mline2\x1b[0m\r\n" {
+		t.Errorf("Expected per-session banner to take precedence, got %q", got)
+	}
+}
+
+func TestProcCwd(t *testing.T) {
+	wd, _ := os.Getwd()
+	cwd, err := ProcCwd(os.Getpid())
+	if err != nil {
+		t.Skipf("process cwd unavailable: %v", err)
+	}
+	if cwd != wd {
+		t.Errorf("ProcCwd mismatch. Got %s, want %s", cwd, wd)
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	tags, err := ParseTags("prod, db,,web-1")
+	if err != nil {
+		t.Fatalf("ParseTags failed: %v", err)
+	}
+	if strings.Join(tags, "|") != "prod|db|web-1" {
+		t.Errorf("Unexpected tags %v", tags)
+	}
+	if _, err := ParseTags("bad tag!"); err == nil {
+		t.Error("Expected error for invalid tag")
+	}
+	info := Info{Tags: tags}
+	if !info.HasTag("db") || info.HasTag("dev") {
+		t.Error("HasTag mismatch")
+	}
+}
+
+func TestAbstractSockets(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("abstract sockets are Linux-only")
+	}
+	home := t.TempDir()
+	setHome(t, home)
+	config.Update(func(c *config.Config) { c.AbstractSockets = true })
+	defer config.Update(func(c *config.Config) { c.AbstractSockets = false })
+
+	name := "abstract"
+	sock, err := GetSocketPath(name)
+	if err != nil {
+		t.Fatalf("GetSocketPath failed: %v", err)
+	}
+	if !IsAbstract(sock) || !strings.HasSuffix(sock, "/"+name) {
+		t.Fatalf("Expected abstract socket name, got %s", sock)
+	}
+	if SocketExists(sock) {
+		t.Fatal("Expected socket to be absent before listening")
+	}
+
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("Failed to listen on abstract socket: %v", err)
+	}
+	if !SocketExists(sock) {
+		t.Error("Expected abstract socket to exist")
+	}
+
+	// List discovers sessions through info files, not socket files
+	info := Info{Name: name, PID: os.Getpid(), Heartbeat: time.Now()}
+	if err := WriteInfo(info); err != nil {
+		t.Fatalf("WriteInfo failed: %v", err)
+	}
+	sessions, err := List()
+	if err != nil || len(sessions) != 1 || sessions[0].Name != name {
+		t.Fatalf("Expected abstract session in list, got %v (%v)", sessions, err)
+	}
+
+	// A fresh heartbeat counts as alive even when the socket is unreachable
+	_ = l.Close()
+	if !info.IsAlive() {
+		t.Error("Expected IsAlive with a recent heartbeat")
+	}
+	info.Heartbeat = time.Now().Add(-2 * HeartbeatTimeout)
+	if info.IsAlive() {
+		t.Error("Expected IsAlive to be false with a stale heartbeat and no socket")
+	}
+}
+
+func TestRemoteHostSessions(t *testing.T) {
+	home := t.TempDir()
+	setHome(t, home)
+
+	remote := Info{Name: "remote", PID: 1, Host: "other-host-" + Hostname(), Heartbeat: time.Now()}
+	if remote.IsLocal() {
+		t.Fatal("Expected session of another host not to be local")
+	}
+	if !remote.IsAlive() {
+		t.Error("Expected remote session with a recent heartbeat to be alive")
+	}
+	if err := WriteInfo(remote); err != nil {
+		t.Fatalf("WriteInfo failed: %v", err)
+	}
+	dir, _ := EnsureDir()
+	logPath := filepath.Join(dir, "remote.log")
+	_ = os.WriteFile(logPath, []byte("log"), 0600)
+	nameFile := filepath.Join(dir, ".other-host-99999999.name")
+	_ = os.WriteFile(nameFile, []byte("remote"), 0600)
+
+	sessions, _ := List()
+	if len(sessions) != 0 {
+		t.Errorf("Expected remote session to be hidden from List, got %v", sessions)
+	}
+	all, _ := ListAllHosts()
+	if len(all) != 1 || all[0].Host != remote.Host {
+		t.Errorf("Expected remote session in ListAllHosts, got %v", all)
+	}
+
+	// Even with a stale heartbeat, files of other hosts must survive Clean
+	remote.Heartbeat = time.Now().Add(-2 * HeartbeatTimeout)
+	_ = WriteInfo(remote)
+	if _, _, err := Clean(); err != nil {
+		t.Fatalf("Clean failed: %v", err)
+	}
+	for _, p := range []string{logPath, nameFile, filepath.Join(dir, "remote.info")} {
+		if _, err := os.Stat(p); err != nil {
+			t.Errorf("Expected %s to be kept: %v", p, err)
+		}
+	}
+}
+
+func TestParseNameFile(t *testing.T) {
+	host, pid, err := parseNameFile(".web-1-4242.name")
+	if err != nil || host != "web-1" || pid != 4242 {
+		t.Errorf("Unexpected result: %q %d %v", host, pid, err)
+	}
+	host, pid, err = parseNameFile(".4242.name")
+	if err != nil || host != "" || pid != 4242 {
+		t.Errorf("Unexpected result for legacy name file: %q %d %v", host, pid, err)
+	}
+}
+
+func TestSplitHost(t *testing.T) {
+	tests := []struct {
+		target, name, host string
+		qualified          bool
+	}{
+		{"dev", "dev", "", false},
+		{"dev@web1", "dev", "web1", true},
+		{"dev@", "dev", "", true},
+	}
+	for _, tt := range tests {
+		name, host, qualified := SplitHost(tt.target)
+		if name != tt.name || host != tt.host || qualified != tt.qualified {
+			t.Errorf("SplitHost(%q) = %q, %q, %v", tt.target, name, host, qualified)
+		}
+	}
+}
+
+func TestParseTagChange(t *testing.T) {
+	c, err := ParseTagChange("prod, api")
+	if err != nil || !c.ReplaceTags || strings.Join(c.SetTags, ",") != "prod,api" {
+		t.Errorf("Plain list = %+v, %v", c, err)
+	}
+	c, err = ParseTagChange("+prod,-staging")
+	if err != nil || c.ReplaceTags || strings.Join(c.AddTags, ",") != "prod" || strings.Join(c.RemoveTags, ",") != "staging" {
+		t.Errorf("Prefixed list = %+v, %v", c, err)
+	}
+	if c, err := ParseTagChange(""); err != nil || !c.ReplaceTags || len(c.SetTags) != 0 {
+		t.Errorf("Empty list should remove all tags, got %+v, %v", c, err)
+	}
+	for _, spec := range []string{"prod,+api", "bad tag", "+"} {
+		if _, err := ParseTagChange(spec); err == nil {
+			t.Errorf("ParseTagChange(%q) should fail", spec)
+		}
+	}
+}
+
+func TestMetaChangeApply(t *testing.T) {
+	group := "backend"
+	info := Info{Tags: []string{"staging", "api"}, Group: "old"}
+	MetaChange{AddTags: []string{"prod", "api"}, RemoveTags: []string{"staging"}, Group: &group}.Apply(&info)
+	if strings.Join(info.Tags, ",") != "api,prod" || info.Group != "backend" {
+		t.Errorf("Unexpected info after change: %+v", info)
+	}
+
+	MetaChange{ReplaceTags: true}.Apply(&info)
+	if info.Tags != nil || info.Group != "backend" {
+		t.Errorf("Replacing tags should only clear them: %+v", info)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	sessions := []Info{{Name: "api-1"}, {Name: "api-2"}, {Name: "web"}}
+	matched, err := Match(sessions, "api-*")
+	if err != nil || len(matched) != 2 || matched[1].Name != "api-2" {
+		t.Errorf("Match = %v, %v", matched, err)
+	}
+	if _, err := Match(sessions, "[api"); err == nil {
+		t.Error("Expected an error for an invalid pattern")
+	}
+}
+
+func TestDetectWindow(t *testing.T) {
+	tests := []struct {
+		env      map[string]string
+		terminal string
+		window   string
+	}{
+		{map[string]string{"TMUX": "/tmp/tmux", "TMUX_PANE": "%3", "WEZTERM_PANE": "1"}, TerminalTmux, "%3"},
+		{map[string]string{"TERM_PROGRAM": "WezTerm", "WEZTERM_PANE": "7"}, TerminalWezTerm, "7"},
+		{map[string]string{"KITTY_WINDOW_ID": "2"}, TerminalKitty, "2"},
+		{map[string]string{"TERM_PROGRAM": "iTerm.app", "ITERM_SESSION_ID": "w0t1p0:ABC"}, TerminalITerm, "w0t1p0:ABC"},
+		{map[string]string{"WINDOWID": "12345"}, "", "12345"},
+		{nil, "", ""},
+	}
+	for _, tt := range tests {
+		terminal, window := DetectWindow(func(key string) string { return tt.env[key] })
+		if terminal != tt.terminal || window != tt.window {
+			t.Errorf("DetectWindow(%v) = %q, %q, want %q, %q", tt.env, terminal, window, tt.terminal, tt.window)
+		}
+	}
+}
+
+func TestAttachmentLayout(t *testing.T) {
+	setHome(t, t.TempDir())
+	path, err := GetLayoutPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l, err := ReadLayout(path); err != nil || len(l.Attachments) != 0 {
+		t.Fatalf("Expected an empty layout without a file, got %v, %v", l, err)
+	}
+
+	// A client that is gone left an attachment to web behind
+	dead := exec.Command("true")
+	if err := dead.Run(); err != nil {
+		t.Skip("can't run true:", err)
+	}
+	_ = RecordAttachment(Attachment{Session: "web", PID: dead.Process.Pid})
+	_ = RecordAttachment(Attachment{Session: "db", PID: os.Getpid()})
+	l, _ := ReadLayout(path)
+	if len(l.Attachments) != 2 {
+		t.Fatalf("Expected 2 attachments, got %v", l.Attachments)
+	}
+
+	// Attaching to web again replaces the stale attachment
+	_ = RecordAttachment(Attachment{Session: "web", Terminal: TerminalKitty, Window: "4", PID: os.Getppid()})
+	l, _ = ReadLayout(path)
+	if len(l.Attachments) != 2 || l.Attachments[1].Window != "4" {
+		t.Fatalf("Stale attachment not replaced: %v", l.Attachments)
+	}
+
+	// Renames follow, detaching removes
+	_ = WriteInfo(Info{Name: "db", PID: 1})
+	if err := Rename("db", "db2"); err != nil {
+		t.Fatal(err)
+	}
+	_ = RemoveAttachment(os.Getppid())
+	l, _ = ReadLayout(path)
+	if len(l.Attachments) != 1 || l.Attachments[0].Session != "db2" {
+		t.Errorf("Unexpected attachments after rename and detach: %v", l.Attachments)
+	}
+}
+
+func TestCustomSocket(t *testing.T) {
+	home := t.TempDir()
+	setHome(t, home)
+
+	custom := filepath.Join(t.TempDir(), "c.sock")
+	l, err := net.Listen("unix", custom)
+	if err != nil {
+		t.Fatalf("Failed to create socket: %v", err)
+	}
+	defer func() { _ = l.Close() }()
+	info := Info{Name: "custom", PID: os.Getpid(), Socket: custom}
+	if err := WriteInfo(info); err != nil {
+		t.Fatal(err)
+	}
+
+	if sock, err := ResolveSocketPath("custom"); err != nil || sock != custom {
+		t.Errorf("ResolveSocketPath() = %q, %v, want %q", sock, err, custom)
+	}
+	if sock, _ := ResolveSocketPath("other"); sock == custom {
+		t.Error("Sessions without a custom socket must use the default one")
+	}
+	if !info.IsAlive() {
+		t.Error("Expected a session listening on its custom socket to be alive")
+	}
+	if sessions, _ := List(); len(sessions) != 1 || sessions[0].Name != "custom" {
+		t.Errorf("Expected the session listed, got %v", sessions)
+	}
+
+	// A stale custom socket is removed with its session
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = l.Close()
+	if _, removed, _ := Clean(); len(removed) == 0 {
+		t.Error("Expected stale files removed")
+	}
+	if _, err := os.Stat(custom); !os.IsNotExist(err) {
+		t.Errorf("Stale custom socket not removed: %v", err)
+	}
+
+	// Other files at socket paths are left alone
+	_ = os.WriteFile(custom, []byte("data"), 0600)
+	_ = os.WriteFile(filepath.Join(home, DirName, "other.sock"), []byte("data"), 0600)
+	_ = WriteInfo(Info{Name: "other", PID: 1, Socket: custom})
+	Cleanup("other")
+	_, _, _ = Clean()
+	for _, path := range []string{custom, filepath.Join(home, DirName, "other.sock")} {
+		if data, _ := os.ReadFile(path); string(data) != "data" {
+			t.Errorf("%s was removed or changed: %q", path, data)
+		}
+	}
+}
+
+func TestGetLogFilesCustomPath(t *testing.T) {
+	home := t.TempDir()
+	setHome(t, home)
+
+	logDir := t.TempDir()
+	custom := filepath.Join(logDir, "build.txt")
+	_ = os.WriteFile(custom+".1", []byte("old"), 0600)
+	_ = os.WriteFile(custom, []byte("active"), 0600)
+	_ = WriteInfo(Info{Name: "custom-log", PID: 1, LogPath: custom})
+
+	files, err := GetLogFiles("custom-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0] != custom+".1" || files[1] != custom {
+		t.Errorf("Unexpected log files %v", files)
+	}
+}
+
+func TestExternalLogs(t *testing.T) {
+	setHome(t, t.TempDir())
+	dead := exec.Command("true")
+	if err := dead.Run(); err != nil {
+		t.Skip("can't run true:", err)
+	}
+
+	custom := filepath.Join(t.TempDir(), "build.txt")
+	_ = os.WriteFile(custom, []byte("active"), 0600)
+	_ = os.WriteFile(custom+".1", []byte("old"), 0600)
+	_ = WriteInfo(Info{Name: "ended", PID: dead.Process.Pid, LogPath: custom})
+	defaultLog, _ := GetLogPath("plain")
+	_ = WriteInfo(Info{Name: "plain", PID: dead.Process.Pid, LogPath: defaultLog})
+
+	// Clean forgets the ended sessions but tracks the log kept elsewhere
+	if _, _, err := Clean(); err != nil {
+		t.Fatal(err)
+	}
+	logs, err := ListExternalLogs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 2 || logs[0].Session != "ended" || logs[0].Path != custom || logs[1].Path != custom+".1" {
+		t.Fatalf("Unexpected external logs %+v", logs)
+	}
+	if _, err := os.Stat(custom); err != nil {
+		t.Fatalf("Clean removed the custom log: %v", err)
+	}
+
+	// Tracking again keeps one entry per file
+	_ = TrackExternalLogs(Info{Name: "ended", LogPath: custom})
+	if logs, _ = ListExternalLogs(); len(logs) != 2 {
+		t.Fatalf("Expected 2 external logs, got %+v", logs)
+	}
+
+	if n, err := RemoveExternalLogs(logs); err != nil || n != 2 {
+		t.Fatalf("RemoveExternalLogs() = %d, %v", n, err)
+	}
+	if _, err := os.Stat(custom); !os.IsNotExist(err) {
+		t.Error("Expected the custom log removed")
+	}
+	if logs, _ = ListExternalLogs(); len(logs) != 0 {
+		t.Errorf("Expected no external logs left, got %+v", logs)
+	}
+}
+
+func TestLogIntegrity(t *testing.T) {
+	t.Setenv("PERSISHTENT_DIR", t.TempDir())
+	logPath := filepath.Join(t.TempDir(), "s.log")
+	f, err := os.Create(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := OpenIndex(logPath, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, chunk := range []string{"012345678\n", "abcdefghi\n", "ABCD\n", "EFGH\n", "tail"} {
+		_, _ = f.WriteString(chunk)
+		_ = index.Add([]byte(chunk))
+	}
+	_ = f.Close()
+
+	// The tail isn't covered until the index is closed
+	if check, err := VerifyLog(logPath); err != nil || !check.OK() || check.Markers != 3 || check.Unindexed != 4 {
+		t.Errorf("Unexpected check %+v, %v", check, err)
+	}
+	_ = index.Close()
+	if check, _ := VerifyLog(logPath); !check.Verified() || check.Markers != 4 || check.Unindexed != 0 {
+		t.Errorf("Unexpected check after close %+v", check)
+	}
+
+	// Markers anyone could have written don't verify a log
+	signed, _ := os.ReadFile(IndexPath(logPath))
+	sum := sha256.Sum256([]byte("012345678\n"))
+	forged, _ := json.Marshal(IntegrityMarker{Size: 10, Lines: 1, SHA256: hex.EncodeToString(sum[:])})
+	_ = os.WriteFile(IndexPath(logPath), append(forged, '\n'), 0600)
+	if check, _ := VerifyLog(logPath); !check.OK() || check.Verified() || check.Unkeyed != 1 {
+		t.Errorf("Unexpected check with a plain hash %+v", check)
+	}
+	_ = os.WriteFile(IndexPath(logPath), signed, 0600)
+	key, _ := IndexKey()
+	_ = os.Remove(filepath.Join(os.Getenv("PERSISHTENT_DIR"), indexKeyFile))
+	if check, _ := VerifyLog(logPath); !check.OK() || check.Verified() || check.Unkeyed != 4 {
+		t.Errorf("Unexpected check without the key %+v", check)
+	}
+	_ = os.WriteFile(filepath.Join(os.Getenv("PERSISHTENT_DIR"), indexKeyFile), key, 0600)
+
+	// Output without newlines is cut at four times the interval
+	other, _ := OpenIndex(logPath+".2", 10, 0)
+	_ = other.Add([]byte(strings.Repeat("x", 45)))
+	if markers, _ := ReadIndex(logPath + ".2"); len(markers) != 1 || markers[0].Size != 45 {
+		t.Errorf("Unexpected markers without newlines %+v", markers)
+	}
+	_ = other.Close()
+
+	// Chunks end at line boundaries, so tails only read the last ones
+	markers, _ := ReadIndex(logPath)
+	if markers[2].Offset != 20 || markers[2].Size != 10 || markers[2].Lines != 2 {
+		t.Errorf("Unexpected marker %+v", markers[2])
+	}
+	if tail, ok := ReadTail(logPath, 2, nil); !ok || string(tail) != "EFGH\ntail" {
+		t.Errorf("Unexpected tail %q, %v", tail, ok)
+	}
+	if tail, _ := ReadTail(logPath, 10, nil); len(tail) != 34 {
+		t.Errorf("Expected the whole log as tail, got %q", tail)
+	}
+	if got := SeekTime(logPath, markers[1].Time); got != markers[1].Offset {
+		t.Errorf("SeekTime returned %d", got)
+	}
+	if got := SeekTime(logPath, time.Now().Add(time.Hour)); got != 34 {
+		t.Errorf("SeekTime after the log returned %d", got)
+	}
+
+	// A changed chunk is detected and skipped on replay
+	data, _ := os.ReadFile(logPath)
+	data[12] = 'X'
+	_ = os.WriteFile(logPath, data, 0600)
+	check, _ := VerifyLog(logPath)
+	if len(check.Corrupt) != 1 || check.Corrupt[0].Offset != 10 {
+		t.Errorf("Expected the second chunk to be damaged, got %+v", check)
+	}
+	var out strings.Builder
+	var skipped []IntegrityMarker
+	if err := CopyVerified(&out, logPath, 0, func(m IntegrityMarker) { skipped = append(skipped, m) }); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "012345678\nABCD\nEFGH\ntail" || len(skipped) != 1 || skipped[0].Size != 10 {
+		t.Errorf("Unexpected replay %q, skipped %+v", out.String(), skipped)
+	}
+	damaged := func(IntegrityMarker) []byte { return []byte("[damaged]\n") }
+	if tail, _ := ReadTail(logPath, 10, damaged); string(tail) != "012345678\n[damaged]\nABCD\nEFGH\ntail" {
+		t.Errorf("Unexpected tail with a damaged chunk %q", tail)
+	}
+
+	// Truncation is reported, and what is left is still replayed
+	_ = os.Truncate(logPath, 22)
+	if check, _ := VerifyLog(logPath); check.Missing != 12 {
+		t.Errorf("Expected 12 bytes missing, got %+v", check)
+	}
+	out.Reset()
+	_ = CopyVerified(&out, logPath, 0, func(IntegrityMarker) {})
+	if out.String() != "012345678\nAB" {
+		t.Errorf("Unexpected replay of truncated log %q", out.String())
+	}
+
+	// Logs without an index are copied as they are
+	_ = os.Remove(IndexPath(logPath))
+	out.Reset()
+	_ = CopyVerified(&out, logPath, 0, func(IntegrityMarker) {})
+	if _, ok := ReadTail(logPath, 1, nil); ok {
+		t.Error("Expected no tail without index")
+	}
+	if check, _ := VerifyLog(logPath); check.Markers != 0 || !check.OK() || check.Verified() || out.Len() != 22 {
+		t.Errorf("Unexpected result without index %+v, %q", check, out.String())
+	}
+}
+
+func TestLogMarks(t *testing.T) {
+	t.Setenv("PERSISHTENT_DIR", t.TempDir())
+	logPath := filepath.Join(t.TempDir(), "s.log")
+	index, err := OpenIndex(logPath, 1024, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = index.Add([]byte("make\n"))
+	if err := index.Mark("build"); err != nil {
+		t.Fatal(err)
+	}
+	_ = index.Add([]byte("ok\n"))
+	_ = index.Close()
+	_ = os.WriteFile(logPath, []byte("make\nok\n"), 0600)
+
+	// Marks end a chunk and don't count as markers
+	marks, err := ReadMarks(logPath)
+	if err != nil || len(marks) != 1 || marks[0].Mark != "build" || marks[0].Offset != 5 {
+		t.Errorf("ReadMarks = %+v, %v", marks, err)
+	}
+	if check, _ := VerifyLog(logPath); !check.Verified() || check.Markers != 2 {
+		t.Errorf("Unexpected check with a mark %+v", check)
+	}
+
+	var none *IndexWriter
+	if err := none.Mark("build"); !errors.Is(err, ErrNoIndex) {
+		t.Errorf("Mark without an index = %v", err)
+	}
+}
+
+func TestTrimLog(t *testing.T) {
+	t.Setenv("PERSISHTENT_DIR", t.TempDir())
+	logPath := filepath.Join(t.TempDir(), "s.log.1")
+	_ = os.WriteFile(logPath, []byte("012345678\nabcdefghi\nABCD\nEFGH\n"), 0600)
+	index, _ := OpenIndex(logPath, 10, 0)
+	for _, chunk := range []string{"012345678\n", "abcdefghi\n", "ABCD\nEFGH\n"} {
+		_ = index.Add([]byte(chunk))
+	}
+	_ = index.Close()
+
+	// The cut moves forward to the next chunk and the markers move along
+	if n, err := TrimLog(logPath, 3); err != nil || n != 10 {
+		t.Fatalf("TrimLog removed %d, %v", n, err)
+	}
+	if data, _ := os.ReadFile(logPath); string(data) != "abcdefghi\nABCD\nEFGH\n" {
+		t.Errorf("Unexpected log after trim %q", data)
+	}
+	if check, _ := VerifyLog(logPath); !check.OK() || check.Markers != 2 || check.Unindexed != 0 {
+		t.Errorf("Unexpected check after trim %+v", check)
+	}
+
+	// Without an index, the cut moves to the next line
+	_ = os.Remove(IndexPath(logPath))
+	if n, _ := TrimLog(logPath, 12); n != 15 {
+		t.Errorf("Expected 15 bytes removed, got %d", n)
+	}
+	if data, _ := os.ReadFile(logPath); string(data) != "EFGH\n" {
+		t.Errorf("Unexpected log after trim %q", data)
+	}
+
+	// Cutting everything removes the file
+	if n, _ := TrimLog(logPath, 2); n != 5 {
+		t.Errorf("Expected the whole file removed, got %d", n)
+	}
+	if _, err := os.Stat(logPath); !os.IsNotExist(err) {
+		t.Errorf("Expected the log to be removed, got %v", err)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	t.Setenv("PERSISHTENT_DIR", t.TempDir())
+	if events, err := ReadAudit(""); err != nil || len(events) != 0 {
+		t.Errorf("Expected no events without audit log, got %v, %v", events, err)
+	}
+	_ = AppendAudit(AuditEvent{Session: "a", Event: AuditStart})
+	_ = AppendAudit(AuditEvent{Session: "b", Event: AuditAttach, Client: "bob@box (pid 2)", Mode: "master"})
+	path, _ := GetAuditPath()
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	_, _ = f.WriteString("{broken\n")
+	_ = f.Close()
+	_ = AppendAudit(AuditEvent{Session: "a", Event: AuditExit, Detail: "exit status 0"})
+
+	events, err := ReadAudit("a")
+	if err != nil || len(events) != 2 || events[0].Event != AuditStart || events[1].Detail != "exit status 0" || events[0].Time.IsZero() {
+		t.Errorf("Unexpected events of a: %+v, %v", events, err)
+	}
+	if events, _ := ReadAudit(""); len(events) != 3 {
+		t.Errorf("Expected 3 events in total, got %+v", events)
+	}
+}
+
+func TestDebugLog(t *testing.T) {
+	t.Setenv("PERSISHTENT_DIR", t.TempDir())
+	if events, err := ReadDebugLog("dbg"); err != nil || len(events) != 0 {
+		t.Errorf("Expected no events without debug log, got %v, %v", events, err)
+	}
+	// Each event fills the log, so the one before moves to the .1 file
+	for _, msg := range []string{"lost", "first", "second"} {
+		if err := AppendDebugLog("dbg", DebugEvent{Level: "info", Message: msg}, 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	events, err := ReadDebugLog("dbg")
+	if err != nil || len(events) != 2 || events[0].Message != "first" || events[1].Message != "second" {
+		t.Errorf("Unexpected events: %+v, %v", events, err)
+	}
+
+	if err := RenameDebugLog("dbg", "renamed"); err != nil {
+		t.Fatal(err)
+	}
+	if events, _ := ReadDebugLog("renamed"); len(events) != 2 {
+		t.Errorf("Expected the events to move along, got %+v", events)
+	}
+	if events, _ := ReadDebugLog("dbg"); len(events) != 0 {
+		t.Errorf("Expected no events left under the old name, got %+v", events)
+	}
+
+	// Renaming onto the debug log of another session adds to it
+	if err := AppendDebugLog("other", DebugEvent{Level: "info", Message: "mine"}, 1024); err != nil {
+		t.Fatal(err)
+	}
+	if err := RenameDebugLog("renamed", "other"); err != nil {
+		t.Fatal(err)
+	}
+	if events, _ := ReadDebugLog("other"); len(events) != 3 || events[0].Message != "mine" {
+		t.Errorf("Expected the events to be added to the existing log, got %+v", events)
+	}
+
+	// The debug log moves to the history with the session
+	if err := WriteInfo(Info{Name: "other", PID: 999999}); err != nil {
+		t.Fatal(err)
+	}
+	if archived, err := Archive(Info{Name: "other", PID: 999999}); !archived || err != nil {
+		t.Fatalf("Archive = %v, %v", archived, err)
+	}
+	path, _ := GetDebugLogPath("other")
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected the debug log to leave the state directory, got %v", err)
+	}
+	if events, _ := ReadDebugLog("other"); len(events) != 3 {
+		t.Errorf("Expected the archived debug log to be read, got %+v", events)
+	}
+
+	// Clean removes the debug logs of sessions that are gone
+	if err := AppendDebugLog("gone", DebugEvent{Level: "info", Message: "left"}, 1024); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Clean(); err != nil {
+		t.Fatal(err)
+	}
+	if events, _ := ReadDebugLog("gone"); len(events) != 0 {
+		t.Errorf("Expected the orphaned debug log to be removed, got %+v", events)
+	}
+}
+
+func TestDaemonCrash(t *testing.T) {
+	setHome(t, t.TempDir())
+	for name, output := range map[string]string{
+		"boom": "starting\nfatal error: concurrent map writes\n\ngoroutine 7 [running]:\n",
+		"fine": "Error: no such file or directory\n",
+	} {
+		if err := WriteInfo(Info{Name: name, PID: 999999}); err != nil {
+			t.Fatal(err)
+		}
+		out, err := CreateDaemonOutput(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = out.WriteString(output)
+		_ = out.Close()
+	}
+	if got := ReadDaemonCrash("boom"); !strings.HasPrefix(got, "fatal error: concurrent map writes") {
+		t.Errorf("ReadDaemonCrash = %q", got)
+	}
+	if got := ReadDaemonCrash("fine"); got != "" {
+		t.Errorf("ReadDaemonCrash of an error message = %q, want none", got)
+	}
+
+	if _, _, err := Clean(); err != nil {
+		t.Fatalf("Clean failed: %v", err)
+	}
+	path, _ := GetCrashPath("boom")
+	if report, err := os.ReadFile(path); err != nil || !strings.Contains(string(report), "goroutine 7 [running]") {
+		t.Errorf("Expected a crash report with the trace, got %q, %v", report, err)
+	}
+	path, _ = GetCrashPath("fine")
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected no crash report for a daemon that exited with an error")
+	}
+
+	// Listing sessions archives dead ones the same way
+	if err := WriteInfo(Info{Name: "listed", PID: 999999}); err != nil {
+		t.Fatal(err)
+	}
+	out, err := CreateDaemonOutput("listed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = out.WriteString("panic: runtime error\n")
+	_ = out.Close()
+	if _, err := List(); err != nil {
+		t.Fatal(err)
+	}
+	path, _ = GetCrashPath("listed")
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("Expected a crash report after list: %v", err)
+	}
+	if e, ok := FindHistory("listed"); !ok || e.State != StateCrashed {
+		t.Errorf("Expected the archived session to be marked crashed, got %+v", e)
+	}
+	// The output moved along and is still found
+	if output, err := ReadDaemonOutput("listed"); err != nil || !strings.HasPrefix(output, "panic: ") {
+		t.Errorf("ReadDaemonOutput after archiving = %q, %v", output, err)
+	}
+}
+
+func TestRenameDaemonOutput(t *testing.T) {
+	setHome(t, t.TempDir())
+	for _, name := range []string{"old", "taken"} {
+		out, err := CreateDaemonOutput(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = out.WriteString(name)
+		_ = out.Close()
+	}
+	if err := RenameDaemonOutput("old", "taken"); err == nil {
+		t.Error("Expected renaming over the output of another daemon to fail")
+	}
+	if output, _ := ReadDaemonOutput("taken"); output != "taken" {
+		t.Errorf("Expected the other output to be kept, got %q", output)
+	}
+	if err := RenameDaemonOutput("old", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if output, _ := ReadDaemonOutput("new"); output != "old" {
+		t.Errorf("Expected the output to move, got %q", output)
+	}
+
+	// Clean removes the output of sessions that are gone
+	if _, _, err := Clean(); err != nil {
+		t.Fatal(err)
+	}
+	if output, _ := ReadDaemonOutput("new"); output != "" {
+		t.Errorf("Expected the orphaned output to be removed, got %q", output)
+	}
+}
+
+func TestListDetails(t *testing.T) {
+	setHome(t, t.TempDir())
+	dir, _ := EnsureDir()
+
+	name := "detailed"
+	l, err := net.Listen("unix", filepath.Join(dir, name+".sock"))
+	if err != nil {
+		t.Fatalf("Failed to create mock socket: %v", err)
+	}
+	defer func() { _ = l.Close() }()
+	logPath := filepath.Join(dir, name+".log")
+	_ = os.WriteFile(logPath, []byte("hello"), 0600)
+	_ = os.WriteFile(logPath+".1", []byte("older"), 0600)
+	info := Info{Name: name, PID: os.Getpid(), LogPath: logPath, Heartbeat: time.Now().Add(-time.Minute)}
+	if err := WriteInfo(info); err != nil {
+		t.Fatalf("WriteInfo failed: %v", err)
+	}
+
+	details, err := ListDetails(false)
+	if err != nil || len(details) != 1 {
+		t.Fatalf("ListDetails = %v, %v", details, err)
+	}
+	d := details[0]
+	if d.Name != name || d.LogSize != 10 || d.LogFiles != 2 {
+		t.Errorf("Expected 10 bytes in 2 log files, got %+v", d)
+	}
+	if d.HeartbeatAge < time.Minute {
+		t.Errorf("Expected a heartbeat age of a minute, got %s", d.HeartbeatAge)
+	}
+	if d.CustomSocket || d.CustomLog {
+		t.Errorf("Expected default paths, got %+v", d)
+	}
+}
+
+func TestBuffers(t *testing.T) {
+	t.Setenv("PERSISHTENT_DIR", t.TempDir())
+	if _, err := ReadBuffer(""); !errors.Is(err, ErrBufferNotFound) {
+		t.Errorf("Expected ErrBufferNotFound without buffers, got %v", err)
+	}
+	if err := WriteBuffer("../escape", []byte("x")); !errors.Is(err, ErrInvalidBufferName) {
+		t.Errorf("Expected ErrInvalidName, got %v", err)
+	}
+
+	_ = WriteBuffer("old", []byte("first"))
+	_ = WriteBuffer(DefaultBuffer, []byte("second"))
+	dir, _ := GetBufferDir()
+	past := time.Now().Add(-time.Hour)
+	_ = os.Chtimes(filepath.Join(dir, "old"), past, past)
+
+	buffers, err := ListBuffers()
+	if err != nil || len(buffers) != 2 || buffers[0].Name != DefaultBuffer || buffers[1].Size != 5 {
+		t.Fatalf("Unexpected buffers: %+v, %v", buffers, err)
+	}
+	if data, _ := ReadBuffer(""); string(data) != "second" {
+		t.Errorf("Expected the newest buffer, got %q", data)
+	}
+	if data, _ := ReadBuffer("old"); string(data) != "first" {
+		t.Errorf("Expected buffer old, got %q", data)
+	}
+
+	if err := RemoveBuffer("old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveBuffer("old"); !errors.Is(err, ErrBufferNotFound) {
+		t.Errorf("Expected ErrBufferNotFound for a removed buffer, got %v", err)
+	}
+}
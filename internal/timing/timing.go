@@ -0,0 +1,108 @@
+// Package timing measures where a CLI invocation spends its time.
+package timing
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// phase is the time spent in all measurements of the same name
+type phase struct {
+	name  string
+	total time.Duration
+	count int
+}
+
+var (
+	mu     sync.Mutex
+	start  = time.Now()
+	phases []*phase
+)
+
+// Track starts measuring phase name and returns the function that ends the
+// measurement, e.g. defer timing.Track("clean")(). Measurements of the same
+// name are added up, so recording stays cheap enough to be always on.
+func Track(name string) func() {
+	t := time.Now()
+	return func() { add(name, time.Since(t)) }
+}
+
+func add(name string, d time.Duration) {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, p := range phases {
+		if p.name == name {
+			p.total += d
+			p.count++
+			return
+		}
+	}
+	phases = append(phases, &phase{name: name, total: d, count: 1})
+}
+
+// Report writes the total run time and the time of every phase to w, in the
+// order the phases first completed. Phases may overlap, e.g. liveness dials
+// happen during clean.
+func Report(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+	fmt.Fprintf(w, "timing: total %s\n", round(time.Since(start)))
+	for _, p := range phases {
+		count := ""
+		if p.count > 1 {
+			count = fmt.Sprintf(" (%dx)", p.count)
+		}
+		fmt.Fprintf(w, "  %-16s %10s%s\n", p.name, round(p.total), count)
+	}
+}
+
+// record is one invocation in the diagnostics file
+type record struct {
+	Time    time.Time     `json:"time"`
+	Args    []string      `json:"args"`
+	TotalMS float64       `json:"total_ms"`
+	Phases  []phaseRecord `json:"phases"`
+}
+
+type phaseRecord struct {
+	Name  string  `json:"name"`
+	MS    float64 `json:"ms"`
+	Count int     `json:"count"`
+}
+
+// Append adds the measurements of the invocation with args to the
+// diagnostics file at path, one JSON object per line.
+func Append(path string, args []string) error {
+	mu.Lock()
+	r := record{Time: start, Args: args, TotalMS: ms(time.Since(start)), Phases: []phaseRecord{}}
+	for _, p := range phases {
+		r.Phases = append(r.Phases, phaseRecord{p.name, ms(p.total), p.count})
+	}
+	mu.Unlock()
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func round(d time.Duration) time.Duration {
+	return d.Round(10 * time.Microsecond)
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
@@ -0,0 +1,52 @@
+package timing
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrack(t *testing.T) {
+	phases = nil
+	for i := 0; i < 3; i++ {
+		done := Track("dial")
+		time.Sleep(time.Millisecond)
+		done()
+	}
+	Track("clean")()
+
+	var b strings.Builder
+	Report(&b)
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "timing: total ") {
+		t.Fatalf("Unexpected report:\n%s", b.String())
+	}
+	if !strings.Contains(lines[1], "dial") || !strings.HasSuffix(lines[1], "(3x)") {
+		t.Errorf("Expected dial measurements to be added up, got %q", lines[1])
+	}
+	if !strings.Contains(lines[2], "clean") || strings.HasSuffix(lines[2], "x)") {
+		t.Errorf("Unexpected clean line %q", lines[2])
+	}
+
+	path := filepath.Join(t.TempDir(), "timing.jsonl")
+	for i := 0; i < 2; i++ {
+		if err := Append(path, []string{"list", "-v"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, _ := os.ReadFile(path)
+	records := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 records, got %d", len(records))
+	}
+	var r record
+	if err := json.Unmarshal([]byte(records[0]), &r); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Args) != 2 || len(r.Phases) != 2 || r.Phases[0].Name != "dial" || r.Phases[0].Count != 3 || r.Phases[0].MS < 3 {
+		t.Errorf("Unexpected record: %+v", r)
+	}
+}
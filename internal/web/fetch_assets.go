@@ -0,0 +1,114 @@
+//go:build ignore
+
+// fetch_assets downloads the xterm.js release the frontend is written for
+// from the npm registry into assets/, which is embedded into the binary.
+// Each package is checked against the integrity hash the registry publishes
+// for it. Run it with go generate after changing a version and commit the
+// result, so builds never depend on the network or a CDN.
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// packages maps each npm package to the files taken from it, by their path
+// in the package and their name in assets/
+var packages = []struct {
+	name, version string
+	files         map[string]string
+}{
+	{"@xterm/xterm", "5.5.0", map[string]string{
+		"package/lib/xterm.js":  "xterm.js",
+		"package/css/xterm.css": "xterm.css",
+		"package/LICENSE":       "LICENSE.xterm",
+	}},
+	{"@xterm/addon-fit", "0.10.0", map[string]string{
+		"package/lib/addon-fit.js": "addon-fit.js",
+	}},
+}
+
+func main() {
+	for _, p := range packages {
+		if err := fetch(p.name, p.version, p.files); err != nil {
+			fmt.Fprintf(os.Stderr, "%s@%s: %v\n", p.name, p.version, err)
+			os.Exit(1)
+		}
+	}
+}
+
+func fetch(name, version string, files map[string]string) error {
+	var meta struct {
+		Dist struct {
+			Tarball   string `json:"tarball"`
+			Integrity string `json:"integrity"`
+		} `json:"dist"`
+	}
+	data, err := get("https://registry.npmjs.org/" + name + "/" + version)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return err
+	}
+	tarball, err := get(meta.Dist.Tarball)
+	if err != nil {
+		return err
+	}
+	sum := sha512.Sum512(tarball)
+	if got := "sha512-" + base64.StdEncoding.EncodeToString(sum[:]); got != meta.Dist.Integrity {
+		return fmt.Errorf("integrity %s, the registry lists %s", got, meta.Dist.Integrity)
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(tarball))
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		dst, ok := files[hdr.Name]
+		if !ok {
+			continue
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join("assets", dst), content, 0644); err != nil {
+			return err
+		}
+		delete(files, hdr.Name)
+	}
+	for src := range files {
+		return fmt.Errorf("%s is missing from the package", src)
+	}
+	return nil
+}
+
+func get(url string) ([]byte, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
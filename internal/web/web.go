@@ -0,0 +1,378 @@
+// Package web serves a browser frontend for sessions: an xterm.js terminal
+// bridged over a WebSocket to the session's socket. Every request must carry
+// the gateway's token, which the browser keeps in a cookie after the first
+// visit of the URL printed by persishtent web.
+package web
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"persishtent/internal/protocol"
+	"persishtent/internal/session"
+)
+
+//go:generate go run fetch_assets.go
+
+//go:embed index.html
+var indexHTML []byte
+
+// assets holds xterm.js, served by the gateway itself so that no third
+// party can change the code of a page with shell access
+//
+//go:embed assets
+var assets embed.FS
+
+// assetFiles are the files of assets the frontend loads
+var assetFiles = []string{"xterm.js", "xterm.css", "addon-fit.js"}
+
+// CheckAssets returns an error if the binary was built without the files
+// of the frontend, see assets/README.md
+func CheckAssets() error {
+	var missing []string
+	for _, name := range assetFiles {
+		if _, err := fs.Stat(assets, "assets/"+name); err != nil {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("built without the web frontend's %s, run go generate ./internal/web and rebuild", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// tokenCookie holds the token in the browser, so it isn't needed in every URL
+const tokenCookie = "persishtent_token"
+
+// Options configures the gateway
+type Options struct {
+	Token    string // Required on every request
+	ReadOnly bool   // Attach all browsers read-only
+	CertFile string // Serve HTTPS with this certificate and KeyFile
+	KeyFile  string
+}
+
+// Token returns the gateway's token, stored in web.token in the state
+// directory so bookmarked URLs keep working. A new token is generated if
+// there is none yet or reset is set, which logs out all browsers.
+func Token(reset bool) (string, error) {
+	dir, err := session.EnsureDir()
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, "web.token")
+	if !reset {
+		if data, err := os.ReadFile(path); err == nil && len(strings.TrimSpace(string(data))) > 0 {
+			return strings.TrimSpace(string(data)), nil
+		}
+	}
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	if err := os.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// IsLoopback reports whether the listen address addr only accepts
+// connections from this machine.
+func IsLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// URL returns the address to open in a browser for a gateway listening on
+// addr, with the token to log in.
+func URL(addr string, opts Options) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, ""
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = session.Hostname()
+	}
+	scheme := "http"
+	if opts.CertFile != "" {
+		scheme = "https"
+	}
+	u := url.URL{Scheme: scheme, Host: net.JoinHostPort(host, port), Path: "/", RawQuery: "token=" + url.QueryEscape(opts.Token)}
+	return u.String()
+}
+
+// Serve answers requests of browsers until the listener fails
+func Serve(l net.Listener, opts Options) error {
+	srv := &http.Server{Handler: newHandler(opts), ReadHeaderTimeout: 5 * time.Second}
+	if opts.CertFile != "" {
+		return srv.ServeTLS(l, opts.CertFile, opts.KeyFile)
+	}
+	return srv.Serve(l)
+}
+
+func newHandler(opts Options) http.Handler {
+	g := &gateway{opts: opts}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", g.index)
+	mux.HandleFunc("/assets/", asset)
+	mux.HandleFunc("/sessions", g.auth(g.sessions))
+	mux.HandleFunc("/ws", g.auth(g.attach))
+	return mux
+}
+
+type gateway struct {
+	opts Options
+}
+
+// authorized reports whether r carries the token, in its cookie or as a bearer token
+func (g *gateway) authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if c, err := r.Cookie(tokenCookie); err == nil {
+		token = c.Value
+	}
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(g.opts.Token)) == 1
+}
+
+func (g *gateway) auth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !g.authorized(r) {
+			http.Error(w, "unauthorized, open the URL printed by persishtent web", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// index serves the frontend. A token in the URL is moved into a cookie and
+// removed from the address bar, so it doesn't end up in the browser history.
+// asset serves one of assetFiles
+func asset(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/assets/")
+	if !slices.Contains(assetFiles, name) {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeFileFS(w, r, assets, "assets/"+name)
+}
+
+func (g *gateway) index(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	if token := r.URL.Query().Get("token"); token != "" {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(g.opts.Token)) != 1 {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: tokenCookie, Value: token, Path: "/", HttpOnly: true,
+			Secure: g.opts.CertFile != "", SameSite: http.SameSiteLaxMode, MaxAge: 365 * 24 * 3600})
+		query := r.URL.Query()
+		query.Del("token")
+		target := url.URL{Path: "/", RawQuery: query.Encode()}
+		http.Redirect(w, r, target.String(), http.StatusSeeOther)
+		return
+	}
+	if !g.authorized(r) {
+		http.Error(w, "unauthorized, open the URL printed by persishtent web", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	// Scripts and styles only come from the gateway
+	w.Header().Set("Content-Security-Policy", "script-src 'self' 'unsafe-inline'; style-src 'self' 'unsafe-inline'")
+	_, _ = w.Write(indexHTML)
+}
+
+// sessions lists the local sessions for the frontend's menu
+func (g *gateway) sessions(w http.ResponseWriter, r *http.Request) {
+	details, err := session.ListDetails(false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if details == nil {
+		details = []session.Details{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(details)
+}
+
+// sameOrigin reports whether a WebSocket request comes from a page of this
+// gateway. Browsers send cookies along with cross-site WebSocket requests,
+// so without this check any website could attach to sessions.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true // Not a browser
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// event is a text message to the frontend; output is sent as binary messages
+type event struct {
+	Event  string `json:"event"` // exit, kicked, refused or error
+	Detail string `json:"detail,omitempty"`
+}
+
+// resize is a text message from the frontend; input is sent as binary messages
+type resize struct {
+	Rows uint16 `json:"rows"`
+	Cols uint16 `json:"cols"`
+}
+
+// attach bridges a WebSocket to a session, attaching like a regular client
+// that wants the session's history replayed.
+func (g *gateway) attach(w http.ResponseWriter, r *http.Request) {
+	if !sameOrigin(r) {
+		http.Error(w, "cross-origin request refused", http.StatusForbidden)
+		return
+	}
+	name := r.URL.Query().Get("session")
+	if err := session.ValidateName(name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	readOnly := g.opts.ReadOnly || r.URL.Query().Get("ro") == "1"
+
+	ws, err := upgrade(w, r)
+	if err != nil {
+		return
+	}
+	defer func() { _ = ws.Close() }()
+	conn, err := dial(name, readOnly, remoteIdentity(r))
+	if err != nil {
+		sendEvent(ws, event{Event: "error", Detail: err.Error()})
+		return
+	}
+	defer func() { _ = conn.Close() }()
+
+	// Browser -> session. Closing conn when the browser leaves ends the other direction.
+	go func() {
+		defer func() { _ = conn.Close() }()
+		for {
+			op, message, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			if op == opText {
+				var size resize
+				if json.Unmarshal(message, &size) == nil && size.Rows > 0 && size.Cols > 0 {
+					_ = protocol.WritePacket(conn, protocol.TypeResize, protocol.ResizePayload(size.Rows, size.Cols))
+				}
+				continue
+			}
+			for len(message) > 0 && !readOnly {
+				n := min(len(message), protocol.MaxPayloadSize)
+				if protocol.WritePacket(conn, protocol.TypeData, message[:n]) != nil {
+					return
+				}
+				message = message[n:]
+			}
+		}
+	}()
+
+	// Session -> browser. Output is acknowledged once it was handed to the
+	// browser's connection, so a slow phone holds back the session's output.
+	packets := protocol.NewReader(conn)
+	var unacked uint32
+	for {
+		t, payload, err := packets.ReadPacket()
+		if err != nil {
+			sendEvent(ws, event{Event: "exit"})
+			return
+		}
+		switch t {
+		case protocol.TypeData, protocol.TypeReplay:
+			if len(payload) > 0 && ws.writeFrame(opBinary, payload) != nil {
+				return
+			}
+			if t == protocol.TypeData {
+				if unacked += uint32(len(payload)); unacked >= protocol.FlowWindow/4 {
+					_ = protocol.WritePacket(conn, protocol.TypeAck, protocol.AckPayload(unacked))
+					unacked = 0
+				}
+			}
+		case protocol.TypeExit:
+			sendEvent(ws, event{Event: "exit"})
+			return
+		case protocol.TypeKick:
+			sendEvent(ws, event{Event: "kicked", Detail: string(payload)})
+			return
+		case protocol.TypeRefused:
+			sendEvent(ws, event{Event: "refused", Detail: string(payload)})
+			return
+		case protocol.TypeError:
+			// The daemon closes the connection after anything but rejected input
+			if err := protocol.DecodeErrorPayload(payload); err.Code != protocol.ErrorNoWriteAccess && err.Code != protocol.ErrorLocked {
+				sendEvent(ws, event{Event: "error", Detail: err.Message})
+				return
+			}
+		case protocol.TypePing:
+			_ = protocol.WritePacket(conn, protocol.TypePing, nil)
+		}
+	}
+}
+
+func sendEvent(ws *wsConn, e event) {
+	data, _ := json.Marshal(e)
+	_ = ws.writeFrame(opText, data)
+}
+
+// remoteIdentity describes the browser to the daemon, so list -clients and
+// the audit log show where a web client is connected from.
+func remoteIdentity(r *http.Request) protocol.Identity {
+	id := protocol.Identity{User: os.Getenv("USER"), Host: session.Hostname(), TTY: "web", PID: os.Getpid(), Term: "xterm-256color", ColorTerm: "truecolor"}
+	if u, err := user.Current(); id.User == "" && err == nil {
+		id.User = u.Username
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		id.From = host
+	}
+	return id
+}
+
+// dial attaches to session name
+func dial(name string, readOnly bool, id protocol.Identity) (net.Conn, error) {
+	sockPath, err := session.ResolveSocketPath(name)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.Dial("unix", sockPath)
+	if err != nil {
+		return nil, session.Classify(err)
+	}
+	mode := protocol.ModeMaster
+	if readOnly {
+		mode = protocol.ModeReadOnly
+	}
+	caps := protocol.CapReplay | protocol.CapIdentity | protocol.CapPing | protocol.CapFlow | protocol.CapErrors
+	if err := protocol.WritePacket(conn, protocol.TypeMode, protocol.AppendIdentity(protocol.ModePayload(mode, caps, 0), id)); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
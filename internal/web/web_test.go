@@ -0,0 +1,244 @@
+package web
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"persishtent/internal/protocol"
+	"persishtent/internal/session"
+)
+
+func TestAcceptKey(t *testing.T) {
+	// Example of RFC 6455, section 1.3
+	if got := acceptKey("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("acceptKey = %q", got)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	srv := httptest.NewServer(newHandler(Options{Token: "secret"}))
+	defer srv.Close()
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	get := func(path string, cookie string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest("GET", srv.URL+path, nil)
+		if cookie != "" {
+			req.AddCookie(&http.Cookie{Name: tokenCookie, Value: cookie})
+		}
+		resp, err := noRedirect.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		_ = resp.Body.Close()
+		return resp
+	}
+
+	for _, path := range []string{"/", "/sessions", "/ws?session=a"} {
+		if resp := get(path, ""); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("GET %s without token = %d", path, resp.StatusCode)
+		}
+		if resp := get(path, "wrong"); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("GET %s with a wrong token = %d", path, resp.StatusCode)
+		}
+	}
+	if resp := get("/?token=wrong", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Login with a wrong token = %d", resp.StatusCode)
+	}
+
+	// The token moves from the URL into a cookie
+	resp := get("/?token=secret&session=web", "")
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/?session=web" {
+		t.Errorf("Login = %d to %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if cookies := resp.Cookies(); len(cookies) != 1 || cookies[0].Value != "secret" || !cookies[0].HttpOnly {
+		t.Errorf("Login cookies = %v", cookies)
+	}
+	if resp := get("/", "secret"); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET / with the cookie = %d", resp.StatusCode)
+	}
+
+	// Only the frontend's files are served from assets
+	for _, path := range []string{"/assets/", "/assets/README.md"} {
+		if resp := get(path, "secret"); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("GET %s = %d", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestURL(t *testing.T) {
+	if got := URL("127.0.0.1:8080", Options{Token: "t"}); got != "http://127.0.0.1:8080/?token=t" {
+		t.Errorf("URL = %q", got)
+	}
+	if got := URL("[::]:443", Options{Token: "t", CertFile: "cert.pem"}); got != "https://"+session.Hostname()+":443/?token=t" {
+		t.Errorf("URL = %q", got)
+	}
+	for addr, want := range map[string]bool{"localhost:8080": true, "127.0.0.1:80": true, "[::1]:80": true, ":8080": false, "0.0.0.0:80": false} {
+		if IsLoopback(addr) != want {
+			t.Errorf("IsLoopback(%q) = %v", addr, !want)
+		}
+	}
+}
+
+// dialWS opens a WebSocket to the gateway at addr, with the token cookie
+func dialWS(t *testing.T, addr string, path string, origin string) (*wsConn, string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	req := "GET " + path + " HTTP/1.1\r\nHost: " + addr + "\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n" +
+		"Origin: " + origin + "\r\nCookie: " + tokenCookie + "=secret\r\n\r\n"
+	if _, err := conn.Write([]byte(req)); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &wsConn{conn: conn, r: r}, resp.Status
+}
+
+// writeMasked sends a frame the way browsers do
+func writeMasked(t *testing.T, c *wsConn, fin bool, op byte, payload []byte) {
+	t.Helper()
+	mask := []byte{1, 2, 3, 4}
+	head := []byte{op}
+	if fin {
+		head[0] |= 0x80
+	}
+	if len(payload) < 126 {
+		head = append(head, 0x80|byte(len(payload)))
+	} else {
+		head = binary.BigEndian.AppendUint16(append(head, 0x80|126), uint16(len(payload)))
+	}
+	head = append(head, mask...)
+	masked := make([]byte, len(payload))
+	for i := range payload {
+		masked[i] = payload[i] ^ mask[i%4]
+	}
+	if _, err := c.conn.Write(append(head, masked...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadFrame_Invalid(t *testing.T) {
+	tests := []struct {
+		frame []byte
+		want  error
+	}{
+		{[]byte{0x80 | opText, 2, 'h', 'i'}, errUnmaskedFrame},
+		{append([]byte{0x80 | opPing, 0x80 | 126, 0, 126}, make([]byte, 4+126)...), errControlFrame},
+		{[]byte{opPing, 0x80, 0, 0, 0, 0}, errControlFrame},
+	}
+	for _, tt := range tests {
+		server, browser := net.Pipe()
+		go func() { _, _ = browser.Write(tt.frame) }()
+		ws := &wsConn{conn: server, r: bufio.NewReader(server), masked: true}
+		if _, _, _, err := ws.readFrame(); !errors.Is(err, tt.want) {
+			t.Errorf("readFrame(%x) = %v, want %v", tt.frame[:2], err, tt.want)
+		}
+		_ = server.Close()
+		_ = browser.Close()
+	}
+}
+
+func TestAttach(t *testing.T) {
+	t.Setenv("PERSISHTENT_DIR", t.TempDir())
+	sockPath, err := session.GetSocketPath("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	daemon, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = daemon.Close() }()
+	// A fake daemon that replays history, reports input and ends the session
+	received := make(chan string, 4)
+	go func() {
+		conn, err := daemon.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		packets := protocol.NewReader(conn)
+		if t, payload, err := packets.ReadPacket(); err != nil || t != protocol.TypeMode {
+			return
+		} else if id, ok := protocol.DecodeModeIdentity(payload); ok {
+			received <- "identity " + id.TTY + " " + id.From
+		}
+		_ = protocol.WritePacket(conn, protocol.TypeReplay, []byte("history"))
+		_ = protocol.WritePacket(conn, protocol.TypeReplay, nil)
+		for i := 0; i < 2; i++ {
+			t, payload, err := packets.ReadPacket()
+			if err != nil {
+				return
+			}
+			if t == protocol.TypeResize {
+				rows, cols := protocol.DecodeResizePayload(payload)
+				received <- fmt.Sprintf("resize %dx%d", rows, cols)
+			} else {
+				received <- string(payload)
+			}
+		}
+		_ = protocol.WritePacket(conn, protocol.TypeExit, protocol.ExitPayload(0))
+	}()
+
+	srv := httptest.NewServer(newHandler(Options{Token: "secret"}))
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	if _, status := dialWS(t, addr, "/ws?session=web", "https://evil.example"); !strings.HasPrefix(status, "403") {
+		t.Errorf("Cross-origin WebSocket = %s, want 403", status)
+	}
+
+	ws, status := dialWS(t, addr, "/ws?session=web", "http://"+addr)
+	if !strings.HasPrefix(status, "101") {
+		t.Fatalf("WebSocket handshake = %s", status)
+	}
+	if got := <-received; got != "identity web 127.0.0.1" {
+		t.Errorf("Daemon got %q", got)
+	}
+	if op, msg, err := ws.ReadMessage(); err != nil || op != opBinary || string(msg) != "history" {
+		t.Errorf("First message = %d %q %v, want the history", op, msg, err)
+	}
+
+	writeMasked(t, ws, true, opText, []byte(`{"rows":24,"cols":80}`))
+	// A fragmented message with a ping in between
+	writeMasked(t, ws, false, opBinary, []byte("ls "))
+	writeMasked(t, ws, true, opPing, nil)
+	writeMasked(t, ws, true, opContinuation, []byte("-l\r"))
+	if got := <-received; got != "resize 24x80" {
+		t.Errorf("Daemon got %q, want the resize", got)
+	}
+	if got := <-received; got != "ls -l\r" {
+		t.Errorf("Daemon got %q, want the input", got)
+	}
+
+	var events []string
+	for {
+		_, op, payload, err := ws.readFrame()
+		if err != nil {
+			break
+		}
+		events = append(events, fmt.Sprintf("%d %s", op, payload))
+		if op == opText {
+			break
+		}
+	}
+	if len(events) != 2 || events[0] != "10 " || events[1] != `1 {"event":"exit"}` {
+		t.Errorf("Messages after the input = %q, want a pong and the exit", events)
+	}
+}
@@ -0,0 +1,220 @@
+package web
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// WebSocket opcodes, see RFC 6455
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// maxMessageSize limits a message from the browser, e.g. a large paste
+const maxMessageSize = 1024 * 1024
+
+// websocketGUID is appended to the key of the handshake, see RFC 6455
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// closeProtocolError is the status of a close frame ending a connection
+// whose peer broke the protocol
+const closeProtocolError = 1002
+
+var (
+	errMessageTooLarge = errors.New("websocket message too large")
+	errUnmaskedFrame   = errors.New("websocket frame from the browser isn't masked")
+	errControlFrame    = errors.New("websocket control frame is fragmented or too long")
+)
+
+// wsConn is the server side of a WebSocket connection. Only the standard
+// library is used, as the gateway needs nothing beyond plain messages.
+type wsConn struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	mu     sync.Mutex // Serializes frames, which are written from several goroutines
+	masked bool       // Frames of the peer must be masked, as browsers must mask theirs
+}
+
+// acceptKey returns the Sec-WebSocket-Accept value for key
+func acceptKey(key string) string {
+	h := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// headerContains reports whether the comma separated header name of r
+// contains token, ignoring case.
+func headerContains(r *http.Request, name string, token string) bool {
+	for _, value := range r.Header.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upgrade completes the WebSocket handshake of r and takes over its connection
+func upgrade(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || key == "" || !headerContains(r, "Connection", "upgrade") || !headerContains(r, "Upgrade", "websocket") {
+		http.Error(w, "expected a WebSocket handshake", http.StatusBadRequest)
+		return nil, errors.New("not a WebSocket handshake")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("unsupported WebSocket version")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection can't be upgraded", http.StatusInternalServerError)
+		return nil, errors.New("response doesn't support hijacking")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	_, err = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n")
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, r: rw.Reader, masked: true}, nil
+}
+
+// writeFrame sends a single unmasked frame, as servers must
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	header := []byte{0x80 | op}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xFFFF:
+		header = binary.BigEndian.AppendUint16(append(header, 126), uint16(n))
+	default:
+		header = binary.BigEndian.AppendUint64(append(header, 127), uint64(n))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.conn.Write(header); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(payload)
+	return err
+}
+
+// readFrame reads a frame and unmasks its payload. Unmasked frames of a
+// browser and fragmented or long control frames are refused, see RFC 6455
+// sections 5.1 and 5.5.
+func (c *wsConn) readFrame() (fin bool, op byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(c.r, head[:]); err != nil {
+		return
+	}
+	fin, op = head[0]&0x80 != 0, head[0]&0x0F
+	masked := head[1]&0x80 != 0
+	n := uint64(head[1] & 0x7F)
+	if c.masked && !masked {
+		return false, 0, nil, errUnmaskedFrame
+	}
+	if op&0x8 != 0 && (n > 125 || !fin) {
+		return false, 0, nil, errControlFrame
+	}
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.r, ext[:]); err != nil {
+			return
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.r, ext[:]); err != nil {
+			return
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if n > maxMessageSize {
+		return false, 0, nil, errMessageTooLarge
+	}
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(c.r, mask[:]); err != nil {
+			return
+		}
+	}
+	payload = make([]byte, n)
+	if _, err = io.ReadFull(c.r, payload); err != nil {
+		return
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return
+}
+
+// ReadMessage returns the next text or binary message, reassembled from its
+// fragments. Pings are answered, a close frame ends the connection with io.EOF.
+func (c *wsConn) ReadMessage() (op byte, message []byte, err error) {
+	for {
+		fin, frameOp, payload, err := c.readFrame()
+		if errors.Is(err, errUnmaskedFrame) || errors.Is(err, errControlFrame) {
+			_ = c.writeFrame(opClose, binary.BigEndian.AppendUint16(nil, closeProtocolError))
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		switch frameOp {
+		case opPing:
+			if err := c.writeFrame(opPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			_ = c.writeFrame(opClose, nil)
+			return 0, nil, io.EOF
+		case opText, opBinary:
+			op, message = frameOp, payload
+		case opContinuation:
+			if op == 0 {
+				return 0, nil, errors.New("websocket continuation without a message")
+			}
+			if len(message)+len(payload) > maxMessageSize {
+				return 0, nil, errMessageTooLarge
+			}
+			message = append(message, payload...)
+		default:
+			return 0, nil, errors.New("unknown websocket opcode")
+		}
+		if fin {
+			return op, message, nil
+		}
+	}
+}
+
+// Close sends a close frame and closes the connection
+func (c *wsConn) Close() error {
+	_ = c.writeFrame(opClose, nil)
+	return c.conn.Close()
+}
@@ -18,6 +18,7 @@ func BenchmarkThroughput(b *testing.B) {
 	// Setup
 	tmpDir := b.TempDir()
 	b.Setenv("HOME", tmpDir)
+	b.Setenv("PERSISHTENT_DIR", tmpDir)
 	
 	sessionName := "bench"
 	sockPath := filepath.Join(tmpDir, "bench.sock")
@@ -38,7 +39,7 @@ func BenchmarkThroughput(b *testing.B) {
 	go func() {
 		// Use a simple command that echoes input back or just stays alive
 		// "cat" will echo what we write to PTY master.
-		if err := server.Run(sessionName, sockPath, logPath, "cat"); err != nil {
+		if err := server.Run(sessionName, server.Options{SockPath: sockPath, LogPath: logPath, Command: "cat"}); err != nil {
 			// b.Logf("Server exited: %v", err)
 		}
 	}()
@@ -93,8 +94,9 @@ func BenchmarkThroughput(b *testing.B) {
 	// Actually, strict synchronization in benchmarks is tricky with async PTY.
 	// Instead, let's just measure the write/read loop speed.
 	
+	packets := protocol.NewReader(conn)
 	for received < target {
-		t, payload, err := protocol.ReadPacket(conn)
+		t, payload, err := packets.ReadPacket()
 		if err != nil {
 			if err == io.EOF {
 				break
@@ -1,42 +1,81 @@
 package tests
 
 import (
+	"bufio"
 	"bytes"
+	"io"
+	"encoding/json"
+	"fmt"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/creack/pty"
 )
 
-func TestIntegration(t *testing.T) {
-	// Build binary
-	tmpDir := t.TempDir()
-	binPath := filepath.Join(tmpDir, "persishtent")
-	
-	cmd := exec.Command("go", "build", "-o", binPath, "../cmd/persishtent/main.go")
-	if output, err := cmd.CombinedOutput(); err != nil {
-		t.Fatalf("Failed to build: %v\nOutput: %s", err, output)
+// binPath is the persishtent binary TestMain builds for all tests
+var binPath string
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "persishtent-bin")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
-	
-	// Create a fake home directory for isolation
-	fakeHome := t.TempDir()
-	
-	// Helper to run commands with fake HOME and without nesting blocks
-	prepareCmd := func(name string, args ...string) *exec.Cmd {
-		c := exec.Command(name, args...)
-		for _, env := range os.Environ() {
-			if !bytes.HasPrefix([]byte(env), []byte("PERSISHTENT_SESSION=")) &&
-				!bytes.HasPrefix([]byte(env), []byte("HOME=")) {
-				c.Env = append(c.Env, env)
-			}
-		}
-		c.Env = append(c.Env, "HOME="+fakeHome)
+	binPath = filepath.Join(dir, "persishtent")
+	code := 1
+	if output, err := exec.Command("go", "build", "-o", binPath, "../cmd/persishtent/main.go").CombinedOutput(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to build: %v\nOutput: %s", err, output)
+	} else {
+		code = m.Run()
+	}
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// testHome returns a HOME of the test's own and a function running the
+// binary with it, outside of any session, with the extra KEY=value variables
+// of env. When the test ends, sessions still running are killed and HOME is
+// removed once the daemons of ended sessions are done archiving them.
+func testHome(t *testing.T, env ...string) (string, func(args ...string) *exec.Cmd) {
+	home, err := os.MkdirTemp("", "persishtent-home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateDir := filepath.Join(home, ".persishtent")
+	run := func(args ...string) *exec.Cmd {
+		c := exec.Command(binPath, args...)
+		c.Env = append(append(os.Environ(), "HOME="+home, "PERSISHTENT_DIR="+stateDir, "PERSISHTENT_SESSION="), env...)
 		return c
 	}
-	
+	t.Cleanup(func() {
+		infos, _ := filepath.Glob(filepath.Join(stateDir, "*.info"))
+		for _, info := range infos {
+			_ = run("kill", "-signal", "KILL", strings.TrimSuffix(filepath.Base(info), ".info")).Run()
+		}
+		for start := time.Now(); ; time.Sleep(100 * time.Millisecond) {
+			err := os.RemoveAll(home)
+			if err == nil {
+				return
+			}
+			if time.Since(start) > 5*time.Second {
+				t.Errorf("Failed to remove the test's HOME: %v", err)
+				return
+			}
+		}
+	})
+	return home, run
+}
+
+func TestIntegration(t *testing.T) {
+	tmpDir := t.TempDir()
+	fakeHome, run := testHome(t)
+
 	sessionName := "integration-test"
 	
 	// paths relative to fake home
@@ -53,7 +92,7 @@ func TestIntegration(t *testing.T) {
 	}
 
 	// Start Session (detached)
-	startCmd := prepareCmd(binPath, "start", "-d", sessionName)
+	startCmd := run("start", "-d", sessionName)
 	if out, err := startCmd.CombinedOutput(); err != nil {
 		t.Fatalf("Failed to start session: %v, out: %s", err, out)
 	}
@@ -71,7 +110,7 @@ func TestIntegration(t *testing.T) {
 	}
 	
 	// Attach
-	attachCmd := prepareCmd(binPath, "attach", sessionName)
+	attachCmd := run("attach", sessionName)
 	ptmx, err := pty.Start(attachCmd)
 	if err != nil {
 		t.Fatalf("Failed to attach with PTY: %v", err)
@@ -139,7 +178,7 @@ time.Sleep(500 * time.Millisecond)
 	}
 	
 	// Attach again
-	attachCmd2 := prepareCmd(binPath, "attach", sessionName)
+	attachCmd2 := run("attach", sessionName)
 	ptmx2, err := pty.Start(attachCmd2)
 	if err != nil {
 		t.Fatalf("Failed to re-attach with PTY: %v", err)
@@ -171,7 +210,7 @@ time.Sleep(500 * time.Millisecond)
 	killSessionName := "kill-test"
 	killSockPath := filepath.Join(fakeHome, ".persishtent", killSessionName+".sock")
 	
-	startKillCmd := prepareCmd(binPath, "start", "-d", killSessionName)
+	startKillCmd := run("start", "-d", killSessionName)
 	if out, err := startKillCmd.CombinedOutput(); err != nil {
 		t.Fatalf("Failed to start kill-test session: %v, out: %s", err, out)
 	}
@@ -182,7 +221,7 @@ time.Sleep(500 * time.Millisecond)
 		t.Fatalf("kill-test session failed to start")
 	}
 	
-	killCmd := prepareCmd(binPath, "kill", killSessionName)
+	killCmd := run("kill", killSessionName)
 	if out, err := killCmd.CombinedOutput(); err != nil {
 		t.Fatalf("Failed to run kill command: %v, output: %s", err, out)
 	}
@@ -195,7 +234,7 @@ time.Sleep(500 * time.Millisecond)
 			break
 		}
 		// Run list to trigger lazy cleanup
-		_, _ = prepareCmd(binPath, "list").CombinedOutput()
+		_, _ = run("list").CombinedOutput()
 		time.Sleep(100 * time.Millisecond)
 	}
 	if !gone {
@@ -205,13 +244,13 @@ time.Sleep(500 * time.Millisecond)
 	// --- Test Start-as-Attach ---
 	startName := "start-as-attach"
 	// 1. Start detached
-	if out, err := prepareCmd(binPath, "start", "-d", startName).CombinedOutput(); err != nil {
+	if out, err := run("start", "-d", startName).CombinedOutput(); err != nil {
 		t.Fatalf("Failed to start initial session: %v, out: %s", err, out)
 	}
 	
 	// 2. Start again (should attach)
 	// We'll use pty to verify we are attached
-	startAttachCmd := prepareCmd(binPath, "start", startName)
+	startAttachCmd := run("start", startName)
 	ptmx3, err := pty.Start(startAttachCmd)
 	if err != nil {
 		t.Fatalf("Failed to start-attach with PTY: %v", err)
@@ -226,3 +265,1263 @@ time.Sleep(500 * time.Millisecond)
 	
 	_ = startAttachCmd.Wait()
 }
+
+func TestSelfTestCommand(t *testing.T) {
+	// The state directory of the user's sessions must stay untouched
+	home, run := testHome(t)
+	stateDir := filepath.Join(home, ".persishtent")
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	out, err := run("selftest").CombinedOutput()
+	if err != nil {
+		t.Fatalf("selftest failed: %v\nOutput: %s", err, out)
+	}
+	if !bytes.Contains(out, []byte("All checks passed.")) {
+		t.Errorf("Unexpected selftest output: %s", out)
+	}
+	if entries, _ := os.ReadDir(stateDir); len(entries) > 0 {
+		t.Errorf("selftest left files in the state directory: %v", entries)
+	}
+}
+
+func TestWaitCommand(t *testing.T) {
+	fakeHome, run := testHome(t)
+
+	if out, err := run("start", "-d", "-c", "sleep 1; exit 3", "wait-test").CombinedOutput(); err != nil {
+		t.Fatalf("Failed to start session: %v, out: %s", err, out)
+	}
+	sockPath := filepath.Join(fakeHome, ".persishtent", "wait-test.sock")
+	for i := 0; i < 20; i++ {
+		if _, err := os.Stat(sockPath); err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	err := run("wait", "wait-test").Run()
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		t.Fatalf("Expected wait to exit with the session's status, got %v", err)
+	}
+	if exitErr.ExitCode() != 3 {
+		t.Errorf("Expected exit status 3, got %d", exitErr.ExitCode())
+	}
+
+	// A command after -- gets its arguments as given, without a shell
+	// splitting them, and relative programs start in -cwd
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "exit.sh"), []byte("#!/bin/sh\nsleep 1\n[ \"$1\" = \"a b\" ] && exit 4\nexit 1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := run("start", "-d", "-cwd", dir, "argv-test", "--", "./exit.sh", "a b").CombinedOutput(); err != nil {
+		t.Fatalf("Failed to start session: %v, out: %s", err, out)
+	}
+	infoPath := filepath.Join(fakeHome, ".persishtent", "argv-test.info")
+	var info struct {
+		Command string   `json:"command"`
+		Argv    []string `json:"argv"`
+	}
+	for i := 0; i < 40; i++ {
+		if data, err := os.ReadFile(infoPath); err == nil && json.Unmarshal(data, &info) == nil && info.Command != "" {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if strings.Join(info.Argv, "|") != "./exit.sh|a b" || info.Command != "./exit.sh 'a b'" {
+		t.Errorf("Unexpected command in info: %q %q", info.Argv, info.Command)
+	}
+	err = run("wait", "argv-test").Run()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 4 {
+		t.Errorf("Expected exit status 4 of the program, got %v", err)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	fakeHome, run := testHome(t)
+
+	if out, err := run("start", "-d", "-c", "sleep 1; echo done-$((1 + 1)); exit 3", "history-test").CombinedOutput(); err != nil {
+		t.Fatalf("Failed to start session: %v, out: %s", err, out)
+	}
+	sockPath := filepath.Join(fakeHome, ".persishtent", "history-test.sock")
+	for i := 0; i < 20; i++ {
+		if _, err := os.Stat(sockPath); err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	_ = run("wait", "history-test").Run()
+
+	// The next command archives the logs instead of removing them
+	out, err := run("history").CombinedOutput()
+	if err != nil || !bytes.Contains(out, []byte("history-test.")) || !bytes.Contains(out, []byte("exit status 3")) {
+		t.Errorf("history should list the ended session: %v\n%s", err, out)
+	}
+	if _, err := os.Stat(filepath.Join(fakeHome, ".persishtent", "history-test.log")); !os.IsNotExist(err) {
+		t.Errorf("Log should have moved to the history")
+	}
+	out, err = run("history", "show", "history-test").CombinedOutput()
+	if err != nil || !bytes.Contains(out, []byte("done-2")) {
+		t.Errorf("history show should print the transcript: %v\n%s", err, out)
+	}
+	if err := run("history", "show", "no-such-session").Run(); err == nil {
+		t.Errorf("history show of an unknown session should fail")
+	}
+}
+
+func TestEphemeralSession(t *testing.T) {
+	fakeHome, run := testHome(t)
+
+	name := "ephemeral-test"
+	sockPath := filepath.Join(fakeHome, ".persishtent", name+".sock")
+	logPath := filepath.Join(fakeHome, ".persishtent", name+".log")
+
+	if out, err := run("start", "-d", "-ephemeral", name).CombinedOutput(); err != nil {
+		t.Fatalf("Failed to start session: %v, out: %s", err, out)
+	}
+	time.Sleep(1 * time.Second)
+
+	// Detached sessions survive until someone attaches and leaves
+	if _, err := os.Stat(sockPath); err != nil {
+		t.Fatalf("Ephemeral session did not start: %v", err)
+	}
+
+	attachCmd := run("attach", name)
+	ptmx, err := pty.Start(attachCmd)
+	if err != nil {
+		t.Fatalf("Failed to attach with PTY: %v", err)
+	}
+	defer func() { _ = ptmx.Close() }()
+	time.Sleep(1 * time.Second)
+
+	// Detach
+	_ = attachCmd.Process.Kill()
+	_ = attachCmd.Wait()
+
+	gone := false
+	for i := 0; i < 50; i++ {
+		_, sockErr := os.Stat(sockPath)
+		_, logErr := os.Stat(logPath)
+		if os.IsNotExist(sockErr) && os.IsNotExist(logErr) {
+			gone = true
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !gone {
+		t.Fatal("Ephemeral session files still exist after last client detached")
+	}
+}
+
+func TestReplayCustomLog(t *testing.T) {
+	_, run := testHome(t)
+
+	// The client can't find a custom log, the history comes from the daemon
+	name := "replay-test"
+	logPath := filepath.Join(t.TempDir(), "custom.log")
+	if out, err := run("start", "-d", "-l", logPath, "-c", "echo first-line; echo second-line; sleep 60", name).CombinedOutput(); err != nil {
+		t.Fatalf("Failed to start session: %v, out: %s", err, out)
+	}
+	defer func() { _ = run("kill", "-signal", "KILL", name).Run() }()
+	time.Sleep(1 * time.Second)
+
+	attach := func(args ...string) string {
+		attachCmd := run(append([]string{"attach"}, args...)...)
+		ptmx, err := pty.Start(attachCmd)
+		if err != nil {
+			t.Fatalf("Failed to attach with PTY: %v", err)
+		}
+		var out bytes.Buffer
+		copied := make(chan struct{})
+		go func() {
+			_, _ = io.Copy(&out, ptmx)
+			close(copied)
+		}()
+		time.Sleep(1 * time.Second)
+		_ = attachCmd.Process.Kill()
+		_ = attachCmd.Wait()
+		_ = ptmx.Close()
+		<-copied
+		return out.String()
+	}
+
+	if out := attach(name); !strings.Contains(out, "first-line") || !strings.Contains(out, "second-line") {
+		t.Errorf("History not replayed: %q", out)
+	}
+	if out := attach("-t", "1", name); strings.Contains(out, "first-line") || !strings.Contains(out, "second-line") {
+		t.Errorf("Expected only the last line replayed: %q", out)
+	}
+}
+
+func TestNoLog(t *testing.T) {
+	fakeHome, run := testHome(t)
+	stateDir := filepath.Join(fakeHome, ".persishtent")
+
+	if out, _ := run("start", "-d", "-no-log", "-record", "nolog-test").CombinedOutput(); !bytes.Contains(out, []byte("cannot be combined")) {
+		t.Errorf("Expected -no-log -record to be refused, got: %s", out)
+	}
+
+	name := "nolog-test"
+	if out, err := run("start", "-d", "-no-log", "-c", "echo sensitive-$((40 + 2)); sleep 60", name).CombinedOutput(); err != nil {
+		t.Fatalf("Failed to start session: %v, out: %s", err, out)
+	}
+	defer func() { _ = run("kill", "-signal", "KILL", name).Run() }()
+	time.Sleep(1 * time.Second)
+
+	files, _ := os.ReadDir(stateDir)
+	for _, f := range files {
+		if strings.Contains(f.Name(), ".log") {
+			t.Errorf("Log file written: %s", f.Name())
+		}
+		if data, _ := os.ReadFile(filepath.Join(stateDir, f.Name())); bytes.Contains(data, []byte("sensitive-42")) {
+			t.Errorf("Output persisted in %s", f.Name())
+		}
+	}
+	if out, _ := run("info", name).CombinedOutput(); !bytes.Contains(out, []byte("Log:      disabled")) {
+		t.Errorf("info should show the disabled log:\n%s", out)
+	}
+
+	// The daemon still replays its in-memory scrollback
+	attachCmd := run("attach", name)
+	ptmx, err := pty.Start(attachCmd)
+	if err != nil {
+		t.Fatalf("Failed to attach with PTY: %v", err)
+	}
+	var out bytes.Buffer
+	copied := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(&out, ptmx)
+		close(copied)
+	}()
+	time.Sleep(1 * time.Second)
+	_ = attachCmd.Process.Kill()
+	_ = attachCmd.Wait()
+	_ = ptmx.Close()
+	<-copied
+	if !strings.Contains(out.String(), "sensitive-42") {
+		t.Errorf("History not replayed: %q", out.String())
+	}
+}
+
+func TestLiveRename(t *testing.T) {
+	fakeHome, run := testHome(t)
+	stateDir := filepath.Join(fakeHome, ".persishtent")
+
+	if out, err := run("start", "-d", "rename-old").CombinedOutput(); err != nil {
+		t.Fatalf("Failed to start session: %v, out: %s", err, out)
+	}
+	time.Sleep(1 * time.Second)
+
+	if out, err := run("rename", "rename-old", "rename-new").CombinedOutput(); err != nil || !bytes.Contains(out, []byte("renamed")) {
+		t.Fatalf("Rename failed: %v, out: %s", err, out)
+	}
+
+	for _, f := range []string{"rename-new.sock", "rename-new.info", "rename-new.log"} {
+		if _, err := os.Stat(filepath.Join(stateDir, f)); err != nil {
+			t.Errorf("Expected %s after rename: %v", f, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(stateDir, "rename-old.sock")); !os.IsNotExist(err) {
+		t.Error("Old socket still exists after rename")
+	}
+
+	// The daemon must still be reachable under the new name
+	out, _ := run("list").CombinedOutput()
+	if !bytes.Contains(out, []byte("rename-new")) {
+		t.Fatalf("Renamed session not listed: %s", out)
+	}
+	if out, err := run("kill", "-signal", "KILL", "rename-new").CombinedOutput(); err != nil {
+		t.Fatalf("Failed to kill renamed session: %v, out: %s", err, out)
+	}
+}
+
+func TestRetagRegroup(t *testing.T) {
+	_, run := testHome(t)
+
+	for _, name := range []string{"api-1", "api-2", "web"} {
+		if out, err := run("start", "-d", "-tag", "staging", name).CombinedOutput(); err != nil {
+			t.Fatalf("Failed to start session: %v, out: %s", err, out)
+		}
+		defer func(name string) { _ = run("kill", "-signal", "KILL", name).Run() }(name)
+	}
+	time.Sleep(1 * time.Second)
+
+	if out, err := run("retag", "api-*", "+prod,-staging").CombinedOutput(); err != nil || bytes.Count(out, []byte("updated")) != 2 {
+		t.Fatalf("Retag failed: %v, out: %s", err, out)
+	}
+	if out, err := run("regroup", "api-*", "backend").CombinedOutput(); err != nil {
+		t.Fatalf("Regroup failed: %v, out: %s", err, out)
+	}
+	if out, err := run("regroup", "nothing-*", "backend").CombinedOutput(); err == nil {
+		t.Errorf("Regroup without matches should fail, out: %s", out)
+	}
+
+	out, _ := run("list").CombinedOutput()
+	for _, line := range strings.Split(string(out), "\n") {
+		switch {
+		case strings.Contains(line, "api-"):
+			if !strings.Contains(line, "tags: prod") || !strings.Contains(line, "group: backend") {
+				t.Errorf("Unexpected list entry: %s", line)
+			}
+		case strings.Contains(line, "web"):
+			if !strings.Contains(line, "tags: staging") || strings.Contains(line, "group") {
+				t.Errorf("Unmatched session changed: %s", line)
+			}
+		}
+	}
+}
+
+func TestInfoCommand(t *testing.T) {
+	_, run := testHome(t)
+
+	if out, err := run("start", "-d", "info-test").CombinedOutput(); err != nil {
+		t.Fatalf("Failed to start session: %v, out: %s", err, out)
+	}
+	defer func() { _ = run("kill", "-signal", "KILL", "info-test").Run() }()
+	time.Sleep(1 * time.Second)
+
+	out, err := run("info", "info-test").CombinedOutput()
+	if err != nil {
+		t.Fatalf("info failed: %v, out: %s", err, out)
+	}
+	for _, want := range []string{"Session:  info-test", "Size:", "Clients:  0", "Traffic:", "Counts:   0 client connects"} {
+		if !bytes.Contains(out, []byte(want)) {
+			t.Errorf("info output missing %q:\n%s", want, out)
+		}
+	}
+
+	out, _ = run("list", "-v").CombinedOutput()
+	if !bytes.Contains(out, []byte("clients: 0")) || !bytes.Contains(out, []byte("connects: 0")) {
+		t.Errorf("list -v missing live status:\n%s", out)
+	}
+
+	if out, _ := run("list", "-quiet", "-sort", "activity", "-filter", "name~^info").CombinedOutput(); string(out) != "info-test\n" {
+		t.Errorf("list -filter should match the session, got %q", out)
+	}
+	if out, _ := run("list", "-q", "-filter", "cmd~^nomatch$").CombinedOutput(); len(out) != 0 {
+		t.Errorf("list -filter should match no session, got %q", out)
+	}
+}
+
+func TestSuspendResume(t *testing.T) {
+	if _, err := os.Stat("/proc/self/stat"); err != nil {
+		t.Skip("requires /proc")
+	}
+	fakeHome, run := testHome(t)
+	stateDir := filepath.Join(fakeHome, ".persishtent")
+
+	if out, err := run("start", "-d", "suspend-test").CombinedOutput(); err != nil {
+		t.Fatalf("Failed to start session: %v, out: %s", err, out)
+	}
+	defer func() { _ = run("kill", "-signal", "KILL", "suspend-test").Run() }()
+	time.Sleep(1 * time.Second)
+
+	readInfo := func() (pid int, state string) {
+		data, err := os.ReadFile(filepath.Join(stateDir, "suspend-test.info"))
+		if err != nil {
+			t.Fatalf("Failed to read info: %v", err)
+		}
+		var info struct {
+			PID   int    `json:"pid"`
+			State string `json:"state"`
+		}
+		_ = json.Unmarshal(data, &info)
+		return info.PID, info.State
+	}
+	procState := func(pid int) string {
+		data, _ := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+		fields := strings.Fields(string(data[bytes.LastIndexByte(data, ')')+1:]))
+		return fields[0]
+	}
+
+	if out, err := run("suspend", "suspend-test").CombinedOutput(); err != nil {
+		t.Fatalf("suspend failed: %v, out: %s", err, out)
+	}
+	pid, state := readInfo()
+	if state != "suspended" {
+		t.Errorf("Expected suspended state in info, got %q", state)
+	}
+	if s := procState(pid); s != "T" {
+		t.Errorf("Expected shell to be stopped, got state %s", s)
+	}
+	if out, _ := run("list").CombinedOutput(); !bytes.Contains(out, []byte("suspended")) {
+		t.Errorf("list does not show suspended session:\n%s", out)
+	}
+
+	if out, err := run("resume", "suspend-test").CombinedOutput(); err != nil {
+		t.Fatalf("resume failed: %v, out: %s", err, out)
+	}
+	if _, state := readInfo(); state != "" {
+		t.Errorf("Expected state to be cleared, got %q", state)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if s := procState(pid); s == "T" {
+		t.Error("Expected shell to be running after resume")
+	}
+}
+
+func TestSerialSession(t *testing.T) {
+	fakeHome, run := testHome(t)
+	stateDir := filepath.Join(fakeHome, ".persishtent")
+
+	// The PTY slave plays the serial console, the test drives the other end
+	device, tty, err := pty.Open()
+	if err != nil {
+		t.Skipf("pty unavailable: %v", err)
+	}
+	defer func() { _ = device.Close() }()
+	defer func() { _ = tty.Close() }()
+
+	if out, err := run("start", "-d", "-tty", tty.Name(), "-baud", "9600", "serial-test").CombinedOutput(); err != nil {
+		t.Fatalf("Failed to start session: %v, out: %s", err, out)
+	}
+	defer func() { _ = run("kill", "serial-test").Run() }()
+	time.Sleep(500 * time.Millisecond)
+
+	_, _ = device.Write([]byte("U-Boot 2024.01\r\n"))
+	time.Sleep(300 * time.Millisecond)
+	logData, _ := os.ReadFile(filepath.Join(stateDir, "serial-test.log"))
+	if !bytes.Contains(logData, []byte("U-Boot 2024.01")) {
+		t.Errorf("Device output not logged: %q", logData)
+	}
+
+	out, _ := run("list").CombinedOutput()
+	if !bytes.Contains(out, []byte(tty.Name()+" (9600 baud)")) {
+		t.Errorf("list does not show the device:\n%s", out)
+	}
+
+	if out, err := run("kill", "serial-test").CombinedOutput(); err != nil {
+		t.Fatalf("kill failed: %v, out: %s", err, out)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if _, err := os.Stat(filepath.Join(stateDir, "serial-test.info")); !os.IsNotExist(err) {
+		t.Error("Session info still exists after kill")
+	}
+}
+
+func TestStartProfile(t *testing.T) {
+	fakeHome, run := testHome(t)
+
+	marker := filepath.Join(fakeHome, "marker")
+	configDir := filepath.Join(fakeHome, ".config", "persishtent")
+	_ = os.MkdirAll(configDir, 0700)
+	cfg, _ := json.Marshal(map[string]any{"profiles": map[string]any{
+		"build": map[string]any{
+			"command": `echo "$GREETING" > ` + marker + `; umask >> ` + marker + `; echo "$LANG $TZ" >> ` + marker + `; sleep 30`,
+			"cwd":     "~",
+			"env":     map[string]string{"GREETING": "from profile"},
+			"tags":    []string{"ci"},
+			"umask":   "077",
+			"locale":  "C",
+			"tz":      "Asia/Tokyo",
+		},
+	}})
+	if err := os.WriteFile(filepath.Join(configDir, "config.json"), cfg, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if out, err := run("start", "-d", "-profile", "nope", "profile-test").CombinedOutput(); !bytes.Contains(out, []byte("unknown profile")) {
+		t.Errorf("Expected unknown profile error, got %v: %s", err, out)
+	}
+
+	// Flags override the profile
+	if out, err := run("start", "-d", "-profile", "build", "-tag", "dev", "-tz", "UTC", "profile-test").CombinedOutput(); err != nil {
+		t.Fatalf("Failed to start session: %v, out: %s", err, out)
+	}
+	defer func() { _ = run("kill", "-signal", "KILL", "profile-test").Run() }()
+	time.Sleep(1 * time.Second)
+
+	if data, _ := os.ReadFile(marker); string(data) != "from profile\n0077\nC UTC\n" {
+		t.Errorf("Profile environment not applied, marker: %q", data)
+	}
+	out, _ := run("list").CombinedOutput()
+	for _, want := range []string{"profile: build", "tags: dev", "cwd: ~"} {
+		if !bytes.Contains(out, []byte(want)) {
+			t.Errorf("list output missing %q:\n%s", want, out)
+		}
+	}
+	out, _ = run("info", "profile-test").CombinedOutput()
+	for _, want := range []string{"Umask:    077", "Locale:   C", "TZ:       UTC"} {
+		if !bytes.Contains(out, []byte(want)) {
+			t.Errorf("info output missing %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestReloadCommand(t *testing.T) {
+	fakeHome, run := testHome(t)
+
+	if out, err := run("start", "-d", "reload-test").CombinedOutput(); err != nil {
+		t.Fatalf("Failed to start session: %v, out: %s", err, out)
+	}
+	defer func() { _ = run("kill", "-signal", "KILL", "reload-test").Run() }()
+	time.Sleep(500 * time.Millisecond)
+
+	configDir := filepath.Join(fakeHome, ".config", "persishtent")
+	_ = os.MkdirAll(configDir, 0700)
+	configPath := filepath.Join(configDir, "config.json")
+
+	_ = os.WriteFile(configPath, []byte(`{"log_rotation_size_mb": 2}`), 0600)
+	out, _ := run("reload").CombinedOutput()
+	if !bytes.Contains(out, []byte("Session 'reload-test' reloaded config.")) {
+		t.Errorf("Unexpected reload output:\n%s", out)
+	}
+
+	// The daemon reports a broken config and keeps running
+	_ = os.WriteFile(configPath, []byte(`{"log_rotation_size_mb": "x"}`), 0600)
+	out, _ = run("reload", "reload-test").CombinedOutput()
+	if !bytes.Contains(out, []byte("Error reloading config of session 'reload-test'")) {
+		t.Errorf("Expected reload error, got:\n%s", out)
+	}
+	// The daemon's debug log keeps the failure
+	out, _ = run("debug", "-level", "error", "reload-test").CombinedOutput()
+	if !bytes.Contains(out, []byte("config reload failed")) || bytes.Contains(out, []byte("config reloaded")) {
+		t.Errorf("Expected only the reload failure in the debug log, got:\n%s", out)
+	}
+	_ = os.Remove(configPath)
+	if out, _ := run("list").CombinedOutput(); !bytes.Contains(out, []byte("reload-test")) {
+		t.Errorf("Session gone after failed reload:\n%s", out)
+	}
+}
+
+func TestStartPreconditions(t *testing.T) {
+	fakeHome, run := testHome(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+
+	marker := filepath.Join(fakeHome, "marker")
+	configDir := filepath.Join(fakeHome, ".config", "persishtent")
+	_ = os.MkdirAll(configDir, 0700)
+	cfg, _ := json.Marshal(map[string]any{"profiles": map[string]any{
+		"db": map[string]any{
+			"command":  "touch " + marker + "; sleep 30",
+			"wait_for": []map[string]string{{"name": "database", "tcp": addr}},
+		},
+	}})
+	if err := os.WriteFile(filepath.Join(configDir, "config.json"), cfg, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"wait-test", "wait-kill"} {
+		if out, err := run("start", "-d", "-profile", "db", name).CombinedOutput(); err != nil {
+			t.Fatalf("Failed to start session: %v, out: %s", err, out)
+		}
+	}
+	defer func() { _ = run("kill", "-signal", "KILL", "wait-test").Run() }()
+	time.Sleep(1 * time.Second)
+
+	out, _ := run("list").CombinedOutput()
+	if bytes.Count(out, []byte("waiting: database")) != 2 {
+		t.Errorf("list should show both sessions waiting:\n%s", out)
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Error("Command ran before the precondition was met")
+	}
+
+	// Waiting sessions can be killed without a socket
+	if out, err := run("kill", "wait-kill").CombinedOutput(); err != nil {
+		t.Fatalf("Failed to kill waiting session: %v, out: %s", err, out)
+	}
+
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+	time.Sleep(2 * time.Second)
+
+	if _, err := os.Stat(marker); err != nil {
+		t.Error("Command did not run once the precondition was met")
+	}
+	out, _ = run("list").CombinedOutput()
+	if bytes.Contains(out, []byte("waiting")) || !bytes.Contains(out, []byte("wait-test")) || bytes.Contains(out, []byte("wait-kill")) {
+		t.Errorf("Unexpected list output:\n%s", out)
+	}
+}
+
+func TestGCOrphanedDaemons(t *testing.T) {
+	fakeHome, run := testHome(t)
+	stateDir := filepath.Join(fakeHome, ".persishtent")
+
+	name := "gc-test"
+	if out, err := run("start", "-d", "-c", "sleep 60", name).CombinedOutput(); err != nil {
+		t.Fatalf("Failed to start session: %v, out: %s", err, out)
+	}
+	defer func() { _ = run("kill", "-signal", "KILL", name).Run() }()
+	time.Sleep(4 * time.Second)
+
+	if out, _ := run("gc").CombinedOutput(); !bytes.Contains(out, []byte("No orphaned daemons")) {
+		t.Errorf("Live session reported as orphaned:\n%s", out)
+	}
+
+	// Deleting the info hides the session from everything but gc
+	_ = os.Remove(filepath.Join(stateDir, name+".info"))
+	if out, _ := run("list", "-q").CombinedOutput(); bytes.Contains(out, []byte(name)) {
+		t.Fatalf("Session still listed:\n%s", out)
+	}
+	if out, _ := run("gc").CombinedOutput(); !bytes.Contains(out, []byte("session '"+name+"'")) {
+		t.Fatalf("Orphaned daemon not found:\n%s", out)
+	}
+
+	out, err := run("gc", "-register").CombinedOutput()
+	if err != nil {
+		t.Fatalf("gc -register failed: %v, out: %s", err, out)
+	}
+	if out, _ := run("list", "-q").CombinedOutput(); !bytes.Contains(out, []byte(name)) {
+		t.Errorf("Session not registered again:\n%s", out)
+	}
+
+	_ = os.Remove(filepath.Join(stateDir, name+".info"))
+	if out, err := run("gc", "-kill").CombinedOutput(); err != nil || !bytes.Contains(out, []byte("Killed daemon")) {
+		t.Fatalf("gc -kill failed: %v, out: %s", err, out)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if out, _ := run("gc").CombinedOutput(); !bytes.Contains(out, []byte("No orphaned daemons")) {
+		t.Errorf("Daemon survived gc -kill:\n%s", out)
+	}
+}
+
+func TestPipeCommand(t *testing.T) {
+	_, run := testHome(t)
+
+	name := "pipe-test"
+	if out, err := run("start", "-d", "-c", "sleep 1; echo build-$((1 + 1)); sleep 60", name).CombinedOutput(); err != nil {
+		t.Fatalf("Failed to start session: %v, out: %s", err, out)
+	}
+	defer func() { _ = run("kill", "-signal", "KILL", name).Run() }()
+	time.Sleep(300 * time.Millisecond)
+
+	shipped := filepath.Join(t.TempDir(), "shipped")
+	if out, err := run("pipe", name, "--", "cat > "+shipped).CombinedOutput(); err != nil {
+		t.Fatalf("pipe failed: %v, out: %s", err, out)
+	}
+	if out, _ := run("info", name).CombinedOutput(); !bytes.Contains(out, []byte("Pipe:     cat > "+shipped)) {
+		t.Errorf("info should show the pipe:\n%s", out)
+	}
+	time.Sleep(1500 * time.Millisecond)
+
+	if out, err := run("pipe", "-stop", name).CombinedOutput(); err != nil {
+		t.Fatalf("pipe -stop failed: %v, out: %s", err, out)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if data, _ := os.ReadFile(shipped); !bytes.Contains(data, []byte("build-2")) {
+		t.Errorf("Output not piped: %q", data)
+	}
+	if out, err := run("pipe", "-stop", name).CombinedOutput(); err == nil {
+		t.Errorf("Stopping twice should fail: %s", out)
+	}
+}
+
+func TestCaptureScreen(t *testing.T) {
+	_, run := testHome(t)
+
+	// 30 lines scroll the first ones off the 24 line screen, then the last
+	// line is overwritten in place
+	name := "capture-test"
+	script := `for i in $(seq 1 30); do echo line-$i; done; printf 'progress 10%%\rprogress %s%%' $((50 + 50)); sleep 60`
+	if out, err := run("start", "-d", "-c", script, name).CombinedOutput(); err != nil {
+		t.Fatalf("Failed to start session: %v, out: %s", err, out)
+	}
+	defer func() { _ = run("kill", "-signal", "KILL", name).Run() }()
+	time.Sleep(500 * time.Millisecond)
+
+	out, err := run("capture", name).Output()
+	if err != nil {
+		t.Fatalf("capture failed: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(out), "\n"), "\n")
+	if last := lines[len(lines)-1]; last != "progress 100%" {
+		t.Errorf("Expected the overwritten line, got %q in:\n%s", last, out)
+	}
+	if strings.Contains(string(out), "line-1\n") {
+		t.Errorf("Lines scrolled off should not be on the screen:\n%s", out)
+	}
+
+	out, err = run("capture", "-S", "-100", name).Output()
+	if err != nil {
+		t.Fatalf("capture -S failed: %v", err)
+	}
+	if !strings.Contains(string(out), "line-1\nline-2\n") {
+		t.Errorf("Expected scrollback lines:\n%s", out)
+	}
+}
+
+func TestReattachAll(t *testing.T) {
+	fakeHome, run := testHome(t, "TMUX=", "KITTY_WINDOW_ID=", "TERM_PROGRAM=", "WEZTERM_PANE=5")
+
+	name := "reattach-test"
+	if out, err := run("start", "-d", name).CombinedOutput(); err != nil {
+		t.Fatalf("Failed to start session: %v, out: %s", err, out)
+	}
+	defer func() { _ = run("kill", name).Run() }()
+	time.Sleep(500 * time.Millisecond)
+
+	// The terminal window goes away without a detach
+	attachCmd := run("attach", name)
+	ptmx, err := pty.Start(attachCmd)
+	if err != nil {
+		t.Fatalf("Failed to attach with PTY: %v", err)
+	}
+	time.Sleep(1 * time.Second)
+	_ = attachCmd.Process.Kill()
+	_ = attachCmd.Wait()
+	_ = ptmx.Close()
+
+	want := "wezterm cli spawn --new-window -- persishtent attach " + name
+	out, err := run("reattach-all").CombinedOutput()
+	if err != nil || strings.TrimSpace(string(out)) != want {
+		t.Fatalf("Expected %q, got %q, %v", want, out, err)
+	}
+	layout := filepath.Join(fakeHome, "layout.json")
+	if out, err := run("reattach-all", "-layout", layout, "-save").CombinedOutput(); err != nil {
+		t.Fatalf("Failed to save layout: %v, out: %s", err, out)
+	}
+
+	// A deliberate detach leaves nothing to restore
+	attachCmd = run("attach", name)
+	ptmx, err = pty.Start(attachCmd)
+	if err != nil {
+		t.Fatalf("Failed to attach with PTY: %v", err)
+	}
+	defer func() { _ = ptmx.Close() }()
+	time.Sleep(1 * time.Second)
+	_, _ = ptmx.Write([]byte{0x04, 'd'})
+	_ = attachCmd.Wait()
+
+	if out, _ := run("reattach-all").CombinedOutput(); !strings.Contains(string(out), "No attachments") {
+		t.Errorf("Expected nothing to restore after detaching, got %q", out)
+	}
+	if out, _ := run("reattach-all", "-layout", layout).CombinedOutput(); strings.TrimSpace(string(out)) != want {
+		t.Errorf("Expected the saved layout to restore %q, got %q", want, out)
+	}
+}
+
+func TestViewSessions(t *testing.T) {
+	_, run := testHome(t)
+
+	if out, err := run("start", "-d", "view-a").CombinedOutput(); err != nil {
+		t.Fatalf("Failed to start session: %v, out: %s", err, out)
+	}
+	defer func() { _ = run("kill", "-signal", "KILL", "view-a").Run() }()
+	if out, err := run("start", "-d", "-c", "echo beta-$((1 + 1)); sleep 60", "view-b").CombinedOutput(); err != nil {
+		t.Fatalf("Failed to start session: %v, out: %s", err, out)
+	}
+	defer func() { _ = run("kill", "-signal", "KILL", "view-b").Run() }()
+	time.Sleep(500 * time.Millisecond)
+
+	viewCmd := run("view", "view-a,view-b")
+	ptmx, err := pty.StartWithSize(viewCmd, &pty.Winsize{Rows: 20, Cols: 100})
+	if err != nil {
+		t.Fatalf("Failed to start view with PTY: %v", err)
+	}
+	defer func() { _ = ptmx.Close() }()
+	var mu sync.Mutex
+	var screen bytes.Buffer
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := ptmx.Read(buf)
+			mu.Lock()
+			screen.Write(buf[:n])
+			mu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+	shows := func(text string) bool {
+		for i := 0; i < 50; i++ {
+			mu.Lock()
+			found := strings.Contains(screen.String(), text)
+			mu.Unlock()
+			if found {
+				return true
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		return false
+	}
+	if !shows("beta-2") || !shows(" view-a") {
+		t.Fatalf("Panes not shown:\n%q", screen.String())
+	}
+
+	// Input goes to the focused pane only
+	_, _ = ptmx.Write([]byte("echo gamma-$((3 + 4))\r"))
+	if !shows("gamma-7") {
+		t.Errorf("Input not echoed in the pane:\n%q", screen.String())
+	}
+	if out, _ := run("capture", "view-a").Output(); !strings.Contains(string(out), "gamma-7") {
+		t.Errorf("Input did not reach the focused session:\n%s", out)
+	}
+
+	// The sessions take the size of their panes
+	if out, _ := run("info", "view-b").Output(); !strings.Contains(string(out), "Size:     50x19") {
+		t.Errorf("Expected view-b resized to its pane:\n%s", out)
+	}
+
+	_, _ = ptmx.Write([]byte{0x04, 'd'})
+	done := make(chan error, 1)
+	go func() { done <- viewCmd.Wait() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("view exited with %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		_ = viewCmd.Process.Kill()
+		t.Fatal("view did not quit on ctrl+d, d")
+	}
+}
+
+func TestCustomSocketByName(t *testing.T) {
+	_, run := testHome(t)
+
+	name := "custom-sock"
+	sock := filepath.Join(t.TempDir(), "my.sock")
+	if out, err := run("start", "-d", "-s", sock, name).CombinedOutput(); err != nil {
+		t.Fatalf("Failed to start session: %v, out: %s", err, out)
+	}
+	defer func() { _ = run("kill", "-signal", "KILL", "-s", sock, name).Run() }()
+	time.Sleep(500 * time.Millisecond)
+
+	// Commands find the session by name alone
+	if out, _ := run("list", "-q").Output(); strings.TrimSpace(string(out)) != name {
+		t.Fatalf("Expected the session listed, got %q", out)
+	}
+	if out, err := run("info", name).Output(); err != nil || !strings.Contains(string(out), "Socket:   "+sock) {
+		t.Errorf("Expected the custom socket in info: %v\n%s", err, out)
+	}
+	if out, err := run("kill", name).CombinedOutput(); err != nil {
+		t.Fatalf("kill by name failed: %v, out: %s", err, out)
+	}
+	for i := 0; i < 50; i++ {
+		if _, err := os.Stat(sock); os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Error("Custom socket still exists after kill")
+}
+
+func TestExclusiveAttach(t *testing.T) {
+	_, run := testHome(t)
+
+	name := "exclusive"
+	if out, err := run("start", "-d", "-exclusive", name).CombinedOutput(); err != nil {
+		t.Fatalf("Failed to start session: %v, out: %s", err, out)
+	}
+	defer func() { _ = run("kill", "-signal", "KILL", name).Run() }()
+	time.Sleep(500 * time.Millisecond)
+
+	first := run("attach", name)
+	ptmx, err := pty.Start(first)
+	if err != nil {
+		t.Fatalf("Failed to attach with PTY: %v", err)
+	}
+	defer func() { _ = ptmx.Close() }()
+	go func() { _, _ = io.Copy(io.Discard, ptmx) }()
+
+	var out []byte
+	for i := 0; i < 50; i++ {
+		out, _ = run("info", name).Output()
+		if strings.Contains(string(out), "locked") {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !strings.Contains(string(out), "(master attached, locked)") {
+		t.Fatalf("Expected the session locked by the first attach:\n%s", out)
+	}
+
+	// A second writable attach is refused, and the first stays attached
+	second := run("attach", name)
+	ptmx2, err := pty.Start(second)
+	if err != nil {
+		t.Fatalf("Failed to attach with PTY: %v", err)
+	}
+	defer func() { _ = ptmx2.Close() }()
+	var screen bytes.Buffer
+	_, _ = io.Copy(&screen, ptmx2)
+	_ = second.Wait()
+	if !strings.Contains(screen.String(), "locked by an exclusive attach") {
+		t.Errorf("Expected the attach refused:\n%q", screen.String())
+	}
+	if out, _ := run("info", name).Output(); !strings.Contains(string(out), "locked") {
+		t.Errorf("The first attach lost its lock:\n%s", out)
+	}
+
+	// Detaching releases the lock
+	_, _ = ptmx.Write([]byte{0x04, 'd'})
+	_ = first.Wait()
+	if out, _ := run("info", name).Output(); strings.Contains(string(out), "master attached") {
+		t.Errorf("Expected no master after detaching:\n%s", out)
+	}
+
+	// kill isn't refused by the lock
+	third := run("attach", "-x", name)
+	ptmx3, err := pty.Start(third)
+	if err != nil {
+		t.Fatalf("Failed to attach with PTY: %v", err)
+	}
+	defer func() { _ = ptmx3.Close() }()
+	go func() { _, _ = io.Copy(io.Discard, ptmx3) }()
+	time.Sleep(500 * time.Millisecond)
+	if out, err := run("kill", name).CombinedOutput(); err != nil || !strings.Contains(string(out), "killed") {
+		t.Errorf("kill of a locked session failed: %v\n%s", err, out)
+	}
+	done := make(chan error, 1)
+	go func() { done <- third.Wait() }()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		_ = third.Process.Kill()
+		t.Error("The attached client did not end with its session")
+	}
+}
+
+func TestCleanCustomLogs(t *testing.T) {
+	_, run := testHome(t)
+
+	name := "custom-log"
+	logPath := filepath.Join(t.TempDir(), "build.txt")
+	if out, err := run("start", "-d", "-l", logPath, name).CombinedOutput(); err != nil {
+		t.Fatalf("Failed to start session: %v, out: %s", err, out)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if out, err := run("kill", name).CombinedOutput(); err != nil {
+		t.Fatalf("kill failed: %v, out: %s", err, out)
+	}
+
+	// The log outlives its session until clean is asked to remove it
+	if _, err := os.Stat(logPath); err != nil {
+		t.Fatalf("Expected the custom log kept: %v", err)
+	}
+	if out, _ := run("clean", "-logs").CombinedOutput(); !strings.Contains(string(out), logPath) {
+		t.Errorf("Expected clean -logs to list the log:\n%s", out)
+	}
+	if _, err := os.Stat(logPath); err != nil {
+		t.Fatalf("Log removed without confirmation: %v", err)
+	}
+
+	if out, err := run("config", "set", "custom_log_cleanup", "remove").CombinedOutput(); err != nil {
+		t.Fatalf("config set failed: %v, out: %s", err, out)
+	}
+	if out, _ := run("clean").CombinedOutput(); !strings.Contains(string(out), "Removed 1 log files") {
+		t.Errorf("Expected clean to remove the log:\n%s", out)
+	}
+	if _, err := os.Stat(logPath); !os.IsNotExist(err) {
+		t.Error("Custom log still exists")
+	}
+}
+
+func TestListClients(t *testing.T) {
+	_, run := testHome(t)
+
+	name := "clients"
+	if out, err := run("start", "-d", name).CombinedOutput(); err != nil {
+		t.Fatalf("Failed to start session: %v, out: %s", err, out)
+	}
+	defer func() { _ = run("kill", "-signal", "KILL", name).Run() }()
+	time.Sleep(500 * time.Millisecond)
+
+	if out, _ := run("clients", name).CombinedOutput(); !strings.Contains(string(out), "No clients attached") {
+		t.Errorf("Expected no clients before attaching:\n%s", out)
+	}
+
+	first := run("attach", name)
+	ptmx, err := pty.Start(first)
+	if err != nil {
+		t.Fatalf("Failed to attach with PTY: %v", err)
+	}
+	defer func() { _ = ptmx.Close() }()
+	var screen bytes.Buffer
+	copied := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(&screen, ptmx)
+		close(copied)
+	}()
+
+	var out []byte
+	for i := 0; i < 50; i++ {
+		out, _ = run("clients", name).Output()
+		if strings.Contains(string(out), "master") {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if want := fmt.Sprintf("pid %d", first.Process.Pid); !strings.Contains(string(out), "master") || !strings.Contains(string(out), want) {
+		t.Fatalf("Expected the attached client with %s:\n%s", want, out)
+	}
+
+	// A second attach takes over and the first is told by whom
+	second := run("attach", name)
+	ptmx2, err := pty.Start(second)
+	if err != nil {
+		t.Fatalf("Failed to attach with PTY: %v", err)
+	}
+	defer func() { _ = ptmx2.Close() }()
+	go func() { _, _ = io.Copy(io.Discard, ptmx2) }()
+	_ = first.Wait()
+	<-copied
+	if want := fmt.Sprintf("pid %d)]", second.Process.Pid); !strings.Contains(screen.String(), "[detached by ") || !strings.Contains(screen.String(), want) {
+		t.Errorf("Expected the detach notice naming %s:\n%q", want, screen.String())
+	}
+
+	// kick detaches a single client by the ID clients shows
+	out, _ = run("clients", name).Output()
+	fields := strings.Fields(string(out))
+	if len(fields) < 2 || fields[1] != "master" {
+		t.Fatalf("Expected the second attach listed:\n%s", out)
+	}
+	if out, err := run("kick", name, fields[0]).CombinedOutput(); err != nil || !strings.Contains(string(out), "detached from session") {
+		t.Errorf("kick failed: %v\n%s", err, out)
+	}
+	done := make(chan struct{})
+	go func() {
+		_ = second.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The kicked client is still attached")
+	}
+	if out, err := run("kick", name, fields[0]).CombinedOutput(); err == nil || !strings.Contains(string(out), "no client with ID") {
+		t.Errorf("Expected kicking a gone client to fail: %v\n%s", err, out)
+	}
+	if out, err := run("detach", name).CombinedOutput(); err == nil || !strings.Contains(string(out), "no master attached") {
+		t.Errorf("Expected detaching without a master to fail: %v\n%s", err, out)
+	}
+
+	// The audit log tells who attached and who kicked them
+	out, _ = run("audit", name).Output()
+	for _, want := range []string{"start", "attach", fmt.Sprintf("pid %d) as master by ", second.Process.Pid), "detach"} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("Expected %q in the audit log:\n%s", want, out)
+		}
+	}
+	if lines := strings.Count(string(out), "\n"); lines < 7 {
+		t.Errorf("Expected at least 7 audit events:\n%s", out)
+	}
+}
+
+func TestFastAttach(t *testing.T) {
+	_, run := testHome(t)
+
+	name := "fast"
+	if out, err := run("start", "-d", name).CombinedOutput(); err != nil {
+		t.Fatalf("Failed to start session: %v, out: %s", err, out)
+	}
+	defer func() { _ = run("kill", "-signal", "KILL", name).Run() }()
+	time.Sleep(500 * time.Millisecond)
+
+	first := run("attach", name)
+	ptmx, err := pty.Start(first)
+	if err != nil {
+		t.Fatalf("Failed to attach with PTY: %v", err)
+	}
+	defer func() { _ = ptmx.Close() }()
+	go func() { _, _ = io.Copy(io.Discard, ptmx) }()
+	time.Sleep(500 * time.Millisecond)
+
+	// The fast path skips the clean and still lists the other client
+	viewer := run("attach", "-ro", name, "--timing")
+	viewer.Env = append(viewer.Env, "PERSISHTENT_FAST=1")
+	start := time.Now()
+	ptmx2, err := pty.Start(viewer)
+	if err != nil {
+		t.Fatalf("Failed to attach with PTY: %v", err)
+	}
+	defer func() { _ = ptmx2.Close() }()
+	var screen bytes.Buffer
+	copied := make(chan struct{})
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := ptmx2.Read(buf)
+			if screen.Len() == 0 && n > 0 {
+				t.Logf("First byte after %v", time.Since(start))
+			}
+			screen.Write(buf[:n])
+			if err != nil {
+				close(copied)
+				return
+			}
+		}
+	}()
+	time.Sleep(time.Second)
+	_, _ = ptmx2.Write([]byte{0x04, 'd'})
+	_ = viewer.Wait()
+	_ = ptmx2.Close()
+	<-copied
+
+	out := screen.String()
+	if !strings.Contains(out, "Also attached: ") {
+		t.Errorf("Expected the first client listed on attach:\n%q", out)
+	}
+	if !strings.Contains(out, "timing: total") || strings.Contains(out, " clean ") {
+		t.Errorf("Expected timing without the clean:\n%q", out)
+	}
+}
+
+func TestManagementAPI(t *testing.T) {
+	fakeHome, run := testHome(t)
+
+	sockPath := filepath.Join(fakeHome, "api.socket")
+	apiCmd := run("api", "-listen", sockPath)
+	if err := apiCmd.Start(); err != nil {
+		t.Fatalf("Failed to start the API: %v", err)
+	}
+	defer func() {
+		_ = apiCmd.Process.Kill()
+		_ = apiCmd.Wait()
+	}()
+	var conn net.Conn
+	for i := 0; i < 50; i++ {
+		var err error
+		if conn, err = net.Dial("unix", sockPath); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if conn == nil {
+		t.Fatal("API socket never appeared")
+	}
+	defer func() { _ = conn.Close() }()
+	replies := bufio.NewScanner(conn)
+	call := func(request string) string {
+		_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+		if _, err := conn.Write([]byte(request + "\n")); err != nil || !replies.Scan() {
+			t.Fatalf("No reply to %s", request)
+		}
+		return replies.Text()
+	}
+
+	if reply := call(`{"jsonrpc":"2.0","id":1,"method":"start","params":{"name":"api-test"}}`); !strings.Contains(reply, `"result":{"name":"api-test"}`) {
+		t.Fatalf("start = %s", reply)
+	}
+	defer func() { _ = run("kill", "-signal", "KILL", "api-renamed").Run() }()
+	if reply := call(`{"jsonrpc":"2.0","id":2,"method":"start","params":{"name":"api-test"}}`); !strings.Contains(reply, `"code":2`) {
+		t.Errorf("Second start = %s, want code 2", reply)
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	if reply := call(`{"jsonrpc":"2.0","id":3,"method":"send-keys","params":{"name":"api-test","keys":"echo api-$((2 + 3))","enter":true}}`); !strings.Contains(reply, `"result":true`) {
+		t.Fatalf("send-keys = %s", reply)
+	}
+	var screen []byte
+	for i := 0; i < 50; i++ {
+		screen, _ = run("capture", "api-test").Output()
+		if strings.Contains(string(screen), "api-5") {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !strings.Contains(string(screen), "api-5") {
+		t.Errorf("Keys not typed into the session:\n%s", screen)
+	}
+
+	if reply := call(`{"jsonrpc":"2.0","id":4,"method":"rename","params":{"name":"api-test","new_name":"api-renamed"}}`); !strings.Contains(reply, `"result":true`) {
+		t.Fatalf("rename = %s", reply)
+	}
+	if reply := call(`{"jsonrpc":"2.0","id":5,"method":"list"}`); !strings.Contains(reply, `"name":"api-renamed"`) || !strings.Contains(reply, `"log_files":1`) {
+		t.Errorf("list = %s", reply)
+	}
+	if reply := call(`{"jsonrpc":"2.0","id":6,"method":"kill","params":{"name":"api-renamed"}}`); !strings.Contains(reply, `"result":true`) {
+		t.Errorf("kill = %s", reply)
+	}
+	var reply string
+	for i := 0; i < 50; i++ {
+		if reply = call(`{"jsonrpc":"2.0","id":7,"method":"list"}`); strings.Contains(reply, `"result":[]`) {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !strings.Contains(reply, `"result":[]`) {
+		t.Errorf("list after kill = %s", reply)
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	// The new daemon binary, as after an update
+	newBin := filepath.Join(t.TempDir(), "persishtent-new")
+	data, err := os.ReadFile(binPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(newBin, data, 0755); err != nil {
+		t.Fatal(err)
+	}
+	fakeHome, run := testHome(t)
+	stateDir := filepath.Join(fakeHome, ".persishtent")
+	shellPID := func() string {
+		out, _ := run("info", "upgrade-test").Output()
+		for _, line := range strings.Split(string(out), "\n") {
+			if strings.HasPrefix(line, "PID:") {
+				return strings.TrimSpace(strings.TrimPrefix(line, "PID:"))
+			}
+		}
+		return ""
+	}
+
+	if out, err := run("start", "-d", "upgrade-test").CombinedOutput(); err != nil {
+		t.Fatalf("Failed to start session: %v, out: %s", err, out)
+	}
+	defer func() { _ = run("kill", "-signal", "KILL", "upgrade-test").Run() }()
+	time.Sleep(500 * time.Millisecond)
+
+	attach := run("attach", "upgrade-test")
+	ptmx, err := pty.Start(attach)
+	if err != nil {
+		t.Fatalf("Failed to attach with PTY: %v", err)
+	}
+	defer func() { _ = ptmx.Close() }()
+	go func() { _, _ = io.Copy(io.Discard, ptmx) }()
+	time.Sleep(time.Second)
+	_, _ = ptmx.Write([]byte("echo before-$((1 + 1))\n"))
+	time.Sleep(300 * time.Millisecond)
+
+	pid := shellPID()
+	if out, err := run("upgrade", "-exe", newBin, "upgrade-test").CombinedOutput(); err != nil {
+		t.Fatalf("upgrade failed: %v, out: %s", err, out)
+	}
+	if got := shellPID(); pid == "" || got != pid {
+		t.Errorf("Shell PID changed from %q to %q", pid, got)
+	}
+
+	// The attached client reconnects and its input reaches the same shell
+	marker := filepath.Join(t.TempDir(), "marker")
+	_, _ = ptmx.Write([]byte("echo after-$((2 + 2)) | tee " + marker + "\n"))
+	for i := 0; i < 50; i++ {
+		if data, _ := os.ReadFile(marker); bytes.Contains(data, []byte("after-4")) {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+		if i%10 == 9 {
+			_, _ = ptmx.Write([]byte("echo after-$((2 + 2)) | tee " + marker + "\n"))
+		}
+	}
+	if data, _ := os.ReadFile(marker); !bytes.Contains(data, []byte("after-4")) {
+		t.Fatalf("Input after the upgrade did not reach the shell: %q", data)
+	}
+
+	log, _ := os.ReadFile(filepath.Join(stateDir, "upgrade-test.log"))
+	if !bytes.Contains(log, []byte("before-2")) || !bytes.Contains(log, []byte("after-4")) {
+		t.Errorf("Log not continued across the upgrade:\n%s", log)
+	}
+	if out, err := run("logs", "-verify", "upgrade-test").CombinedOutput(); err != nil {
+		t.Errorf("Log integrity broken by the upgrade: %v\n%s", err, out)
+	}
+
+	if out, err := run("upgrade", "-exe", "/nonexistent/persishtent", "upgrade-test").CombinedOutput(); err == nil {
+		t.Errorf("Upgrading to a missing binary should fail: %s", out)
+	}
+	if got := shellPID(); got != pid {
+		t.Errorf("Session lost after a failed upgrade: PID %q", got)
+	}
+}